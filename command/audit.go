@@ -0,0 +1,96 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// The input formats accepted for time range of show-audit, in the order they are tried.
+var auditTimeInputFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// Return the audit log location from server configuration, or an empty string if audit log is disabled.
+func getAuditLogPath() (string, error) {
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read configuratioon file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+	}
+	return sysconf.GetString(keyserv.SRV_CONF_AUDIT_LOG, keyserv.DefaultAuditLogPath), nil
+}
+
+/*
+Record an administrative action that was carried out locally on the key server (i.e. not via RPC) in audit log.
+Failure to write the audit log is logged but does not fail the action.
+*/
+func auditAdminAction(event, uuid, result, reason string) {
+	auditPath, err := getAuditLogPath()
+	if err != nil || auditPath == "" {
+		return
+	}
+	audit, err := keyserv.NewAuditLog(auditPath)
+	if err != nil {
+		log.Printf("auditAdminAction: %v", err)
+		return
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	audit.Record(keyserv.AuditEvent{
+		Event:    event,
+		IP:       "@",
+		Hostname: hostname,
+		UUID:     uuid,
+		Result:   result,
+		Reason:   reason,
+	})
+	audit.Close()
+}
+
+// Parse the time given to show-audit, an empty string results in zero time.
+func parseAuditTime(in string) (time.Time, error) {
+	if in == "" {
+		return time.Time{}, nil
+	}
+	for _, format := range auditTimeInputFormats {
+		if t, err := time.ParseInLocation(format, in, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Time \"%s\" is not in a recognised format (e.g. \"2006-01-02 15:04:05\")", in)
+}
+
+// Server - print audit log entries that match the UUID, host, and time range. Empty criteria match all entries.
+func ShowAudit(uuid, host, since, until string) error {
+	auditPath, err := getAuditLogPath()
+	if err != nil {
+		return err
+	}
+	if auditPath == "" {
+		return fmt.Errorf("Audit log is disabled, set %s in \"%s\" to enable it.", keyserv.SRV_CONF_AUDIT_LOG, SERVER_CONFIG_PATH)
+	}
+	filter := keyserv.AuditFilter{UUID: uuid, Host: host}
+	if filter.Since, err = parseAuditTime(since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseAuditTime(until); err != nil {
+		return err
+	}
+	events, err := keyserv.ReadAuditLog(auditPath, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Total: %d entries (date and time are in zone %s)\n", len(events), time.Now().Format("MST"))
+	fmt.Println("When                Event              Result   UUID                                 IP              Cert.CN          Hostname         Reason")
+	for _, evt := range events {
+		reason := evt.Reason
+		if evt.IdentityMismatch {
+			reason = strings.TrimSpace("IDENTITY MISMATCH " + reason)
+		}
+		fmt.Printf("%-19s %-18s %-8s %-36s %-15s %-16s %-16s %s\n",
+			evt.Time.Local().Format(TIME_OUTPUT_FORMAT), evt.Event, evt.Result, evt.UUID, evt.IP, evt.CertCN, evt.Hostname, reason)
+	}
+	return nil
+}
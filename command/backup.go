@@ -0,0 +1,182 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+Server - write an encrypted backup of the key database and server configuration into a new file. The backup carries
+every key in plain within its encryption, so that it can be restored without the key database master key, hence the
+key server password is checked first, by the running key server if there is one. The passphrase is taken from the
+first line of the password file if given, otherwise it is asked for twice.
+*/
+func BackupKeyDB(archivePath, publicKeyFile, passwordFile string) error {
+	sys.LockMem()
+	if archivePath == "" {
+		return errors.New("Please specify the backup file with -archive")
+	}
+	var publicKey *rsa.PublicKey
+	passphrase := ""
+	if publicKeyFile != "" {
+		if passwordFile != "" {
+			return errors.New("The backup is encrypted either by a passphrase or by a public key, not both")
+		}
+		var err error
+		if publicKey, err = keyserv.ReadBackupPublicKey(publicKeyFile); err != nil {
+			return err
+		}
+	} else if passwordFile != "" {
+		var err error
+		if passphrase, err = readPasswordFile(passwordFile); err != nil {
+			return fmt.Errorf("Failed to read the backup passphrase - %v", err)
+		}
+		if len(passphrase) < MIN_PASSWORD_LEN {
+			return fmt.Errorf("Passphrase must be at least %d characters long", MIN_PASSWORD_LEN)
+		}
+	} else {
+		passphrase = sys.InputPassword(true, "", "Backup passphrase (min. %d chars, no echo)", MIN_PASSWORD_LEN)
+		if len(passphrase) < MIN_PASSWORD_LEN {
+			return fmt.Errorf("Passphrase must be at least %d characters long", MIN_PASSWORD_LEN)
+		} else if sys.InputPassword(true, "", "Confirm backup passphrase (no echo)") != passphrase {
+			return errors.New("Passphrases do not match")
+		}
+	}
+	if err := verifyServerPassword("BackupKeyDB", ""); err != nil {
+		return err
+	}
+	sysconfigText, err := ioutil.ReadFile(SERVER_CONFIG_PATH)
+	if err != nil {
+		return fmt.Errorf("Failed to read configuration file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	archive, err := keyserv.NewBackupArchive(db, string(sysconfigText))
+	if err != nil {
+		return err
+	}
+	if err := archive.DecodeKeys(db); err != nil {
+		return err
+	}
+	sealed, err := keyserv.EncryptBackup(archive, passphrase, publicKey)
+	if err != nil {
+		return err
+	}
+	if err := sys.WriteNewFile(archivePath, sealed, sys.SecureFileMode, true); err != nil {
+		return err
+	}
+	auditAdminAction("BackupKeyDB", "", keyserv.AuditResultGranted, archivePath)
+	fmt.Printf("%d records have been backed up to %s\n", len(archive.Records), archivePath)
+	return nil
+}
+
+/*
+Server - validate a backup made by backup-keydb or the scheduled backup, show what restoring it would change, and
+restore the records upon confirmation. New records are always restored, existing records are only replaced if
+overwrite is true. If the key server is running, it restores the records on behalf of this command. The passphrase is
+taken from the first line of the password file if given, otherwise it is asked for.
+*/
+func RestoreKeyDB(archivePath, privateKeyFile, passwordFile string, overwrite bool) error {
+	sys.LockMem()
+	if archivePath == "" {
+		return errors.New("Please specify the backup file with -archive")
+	}
+	sealed, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read backup \"%s\" - %v", archivePath, err)
+	}
+	needsPrivateKey, err := keyserv.BackupNeedsPrivateKey(sealed)
+	if err != nil {
+		return err
+	}
+	var privateKey *rsa.PrivateKey
+	passphrase := ""
+	if needsPrivateKey {
+		if privateKeyFile == "" {
+			return errors.New("The backup is encrypted by a public key, specify its private key with -privateKey")
+		}
+		if privateKey, err = keyserv.ReadBackupPrivateKey(privateKeyFile); err != nil {
+			return err
+		}
+	} else if passwordFile != "" {
+		if passphrase, err = readPasswordFile(passwordFile); err != nil {
+			return fmt.Errorf("Failed to read the backup passphrase - %v", err)
+		}
+	} else {
+		passphrase = sys.InputPassword(true, "", "Backup passphrase (no echo)")
+	}
+	archive, err := keyserv.DecryptBackup(sealed, passphrase, privateKey)
+	if err != nil {
+		return err
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	diff, err := archive.Compare(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-34s%s\n", "Backup time:", archive.Time.Format(TIME_OUTPUT_FORMAT))
+	fmt.Printf("%-34s%d\n", "Records in backup:", len(archive.Records))
+	fmt.Printf("%-34s%s\n", "New records:", strings.Join(diff.New, " "))
+	fmt.Printf("%-34s%s\n", "Existing records, same key:", strings.Join(diff.SameKey, " "))
+	fmt.Printf("%-34s%s\n", "Conflicting records:", strings.Join(diff.Conflicting, " "))
+	restore := append([]string{}, diff.New...)
+	if overwrite {
+		restore = append(append(restore, diff.SameKey...), diff.Conflicting...)
+	} else if len(diff.SameKey)+len(diff.Conflicting) > 0 {
+		fmt.Println("Existing records are left alone, use -overwrite to replace them with their backup.")
+	}
+	if len(restore) == 0 {
+		fmt.Println("There is nothing to restore.")
+		return nil
+	}
+	if !sys.InputBool(false, "Restore %d records?", len(restore)) {
+		return errors.New("Restore is cancelled")
+	}
+	records := make(map[string][]byte)
+	for _, uuid := range restore {
+		records[uuid] = archive.Records[uuid]
+	}
+	rpcClient, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return err
+	}
+	if _, err := rpcClient.GetHealth(keyserv.HealthReq{}); err == nil {
+		// The running server keeps records in memory, let it restore them so that they are not overwritten later.
+		password := inputServerPassword(true, "Enter key server's password (no echo)")
+		if err := rpcClient.ImportRecords(keyserv.ImportRecordsReq{PlainPassword: password, Records: records}); err != nil {
+			return fmt.Errorf("The running key server failed to restore the records - %v", err)
+		}
+	} else {
+		for _, uuid := range restore {
+			rec, err := db.DecodeRecord(records[uuid])
+			if err == nil {
+				err = db.ImportRecord(rec)
+			}
+			if err != nil {
+				auditAdminAction("RestoreKeyDB", uuid, keyserv.AuditResultFailed, err.Error())
+				return fmt.Errorf("Failed to restore record \"%s\" - %v", uuid, err)
+			}
+			auditAdminAction("RestoreKeyDB", uuid, keyserv.AuditResultGranted, archivePath)
+		}
+	}
+	fmt.Printf("%d records have been restored.\n", len(restore))
+	// The configuration is not restored automatically, as it may carry settings of a different computer.
+	restoredConfig := SERVER_CONFIG_PATH + ".from-backup"
+	if err := sys.ReplaceFile(restoredConfig, []byte(archive.Sysconfig), sys.SecureFileMode, true); err != nil {
+		return fmt.Errorf("Failed to write the server configuration of the backup - %v", err)
+	}
+	fmt.Printf("The server configuration of the backup (without email password) is saved in %s for comparison.\n", restoredConfig)
+	return nil
+}
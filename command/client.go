@@ -8,14 +8,20 @@ import (
 	"cryptctl2/keyserv"
 	"cryptctl2/routine"
 	"cryptctl2/sys"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -36,9 +42,22 @@ Do you wish to proceed and switch to the new key server?`
 	MSG_ASK_ENC_DISK          = "Path of disk partition (/dev/sdXXX) that will hold the directory after encryption"
 	MSG_ASK_MAX_ACTIVE        = "How many computers can use the encrypted disk simultaneously"
 	MSG_ASK_ALIVE_TIMEOUT     = "If the key server does not hear from this computer for so many seconds, other computers will be allowed to use the key"
+	MSG_ASK_ALIVE_INTERVAL    = "How often (in seconds) should computers report to the key server that they are using the disk"
 	MSG_ASK_KEYREC_PATH       = "Path of the key record"
 	MSG_ASK_MOUNT             = "Where should the file system be mounted"
 	MSG_ASK_MOUNT_OPT         = "Mount options (comma-separated)"
+	MSG_ASK_UNKNOWN_MOUNT_OPT = "Mount options \"%s\" are not known to the file system, use them anyway?"
+	MSG_ASK_GROUP             = "Consistency group of the disk (enter \"-\" to leave the group)"
+	MSG_ASK_GROUP_PRIORITY    = "Mount order among group members (lower number is mounted first)"
+	MSG_ASK_TAGS              = "Tags of the disk, comma-separated name=value (enter \"-\" to remove all)"
+	MSG_ASK_TANG_URL          = "Tang server URL to also bind the disk to, for unlocking while key server is unreachable (optional)"
+	MSG_ASK_FSCK_POLICY       = "Check the file system before mounting (off, preen, or force)"
+	MSG_ASK_UNLOCK_AFTER      = "UUIDs of disks to unlock before this one, comma-separated (enter \"-\" to remove all)"
+	MSG_ASK_UNLOCK_WINDOWS    = "Periods during which the disk is unlocked automatically, e.g. \"Mon-Fri 22:00-04:00; Sat,Sun 20:00-06:00\" (enter \"-\" to allow any time)"
+	MSG_ASK_UMOUNT_AT_WINDOW  = "Have the computers umount the disk once its unlock window ends"
+	MSG_ASK_BIND_MOUNTS       = "Bind-mounts applied after mounting, space-separated target[:propagation[:options]] (enter \"-\" to remove all)"
+	MSG_ASK_SEAL_TO_TPM       = "Allow computers to keep the key sealed by their TPM2 to unlock the disk without network"
+	MSG_ASK_SEAL_MAX_HOURS    = "How many hours may a sealed key be used until the key server hands it out again (0 - no limit)"
 	MSG_ALIVE_TIMEOUT_ROUNDED = "The number of seconds has been rounded to %d.\n"
 	MSG_ENC_SEQUENCE          = `
 Please take note to:
@@ -50,6 +69,23 @@ The encryption sequence will carry out the following tasks:
   2. Copy data from "%s" into the disk.
   3. Announce the encrypted disk to key server.
 
+`
+	MSG_ASK_INPLACE_DISK = "Path of disk partition (/dev/sdXXX) that carries the file system to be encrypted"
+	MSG_INPLACE_SEQUENCE = `
+Please take note to:
+  - Back up the data on the disk, a power loss during the operation is survivable but a damaged disk is not.
+  - Avoid mounting the disk until the operation completes.
+
+The encryption sequence will carry out the following tasks:
+  1. Shrink file system on disk "%s" to make room for encryption header.
+  2. Install encryption key on the disk and announce it to key server.
+  3. Encrypt the data on the disk in-place.
+
+`
+	MSG_INPLACE_RESUME_SEQUENCE = `
+The encryption of disk "%s" was interrupted, its key already is on the key server.
+The encryption sequence will resume encrypting the data on the disk in-place.
+
 `
 	MSG_E_CANCELLED           = "Operation is cancelled."
 	MSG_E_SAVE_SYSCONF        = "Failed to save settings into %s - %v"
@@ -60,48 +96,106 @@ The encryption sequence will carry out the following tasks:
 	MSG_ERASE_UUID            = "UUID of the file system to erase"
 	MSG_ERASE_UUID_AGAIN      = "Warning! Data on \"%s\" will be irreversibly lost, type the UUID once again to confirm"
 	MSG_E_ERASE_UUID_MISMATCH = "UUID input does not match."
+	MSG_ERASE_KEY_SLOT_AGAIN  = "The key slot of \"%s\" managed by cryptctl2 will be removed and its other key slots kept, type the UUID once again to confirm"
+	MSG_ERASE_FORGET_AGAIN    = "The key server will destroy its copy of the key of \"%s\" for good, type the UUID once again to confirm"
+	MSG_ERASE_FORGET_NO_SLOT  = "The key slot of \"%s\" stays in place, its data is only accessible by that key slot while the disk stays unlocked or by another key slot. Proceed?"
 	MSG_E_ERASE_NO_CONF       = "The erase operation must contact key server in order to erase a key, but cryptctl2 configuration is empty."
 
-	ClientDaemonService = "cryptctl2-client"
+	OutputText = "text" // OutputText is the default output format of the commands that print a report.
+	OutputJSON = "json" // OutputJSON makes the commands that print a report print JSON instead.
+
+	ClientDaemonService  = "cryptctl2-client"
+	GroupMountTimeoutSec = 60 // GroupMountTimeoutSec is the number of seconds to wait for a consistency group member to be mounted.
+
+	ClientCertDir = "/etc/cryptctl2/client" // ClientCertDir holds the client certificate, its key, and the key server CA written by register-client.
 )
 
+/*
+TLSOverrides are the settings of trusting and reaching the key server given on the command line, they take precedence
+over client sysconfig. Empty attributes leave the sysconfig settings in effect.
+*/
+type TLSOverrides struct {
+	CAFile         string // CAFile is the PEM file of key server CA bundle.
+	Fingerprint    string // Fingerprint is the expected SHA256 fingerprint of key server certificate.
+	VerifyHostname string // VerifyHostname is "yes" or "no" to check that key server certificate carries the server's host name.
+	BindAddress    string // BindAddress is the local IP to connect to key server from.
+	Proxy          string // Proxy is the SOCKS5 or HTTP proxy to reach key server through.
+}
+
+var tlsOverrides TLSOverrides // tlsOverrides are given by SetTLSOverrides
+
+// SetTLSOverrides makes the command line settings of trusting key server certificate take precedence over sysconfig.
+func SetTLSOverrides(overrides TLSOverrides) {
+	tlsOverrides = overrides
+}
+
+// Put the command line settings of trusting and reaching key server into client sysconfig.
+func applyTLSOverrides(sysconf *sys.Sysconfig) {
+	if tlsOverrides.CAFile != "" {
+		sysconf.Set(keyserv.CLIENT_CONF_CA, tlsOverrides.CAFile)
+	}
+	if tlsOverrides.Fingerprint != "" {
+		sysconf.Set(keyserv.CLIENT_CONF_SERVER_FINGERPRINT, tlsOverrides.Fingerprint)
+	}
+	if tlsOverrides.VerifyHostname != "" {
+		sysconf.Set(keyserv.CLIENT_CONF_VERIFY_HOSTNAME, tlsOverrides.VerifyHostname)
+	}
+	if tlsOverrides.BindAddress != "" {
+		sysconf.Set(keyserv.CLIENT_CONF_BIND_ADDRESS, tlsOverrides.BindAddress)
+	}
+	if tlsOverrides.Proxy != "" {
+		sysconf.Set(keyserv.CLIENT_CONF_PROXY, tlsOverrides.Proxy)
+	}
+}
+
 /*
 ConnectToKeyServer establishes a TCP connection to key server by interactively reading password from terminal,
-and then ping server via TCP to check connectivity and password. Returns initialised client.
+and then ping server via TCP to check connectivity and password. Returns initialised client. The host may list several
+key servers in order of preference, see keyserv.ParseServerAddresses.
 */
-func ConnectToKeyServer(caFile, certFile, keyFile, keyServer string) (client *keyserv.CryptClient, password string, err error) {
+func ConnectToKeyServer(caFile, certFile, keyFile, host string, port int, verify keyserv.TLSVerification, connection keyserv.ConnectionSettings) (client *keyserv.CryptClient, password string, err error) {
 	sys.LockMem()
-	serverAddr := keyServer
-	port := keyserv.SRV_DEFAULT_PORT
-	if portIdx := strings.LastIndex(keyServer, ":"); portIdx != -1 {
-		portStr := keyServer[portIdx+1:]
-		portInt, err := strconv.Atoi(portStr)
-		if err != nil {
-			return nil, "", fmt.Errorf("Port number is not a valid integer in \"%s\"", keyServer)
-		}
-		port = portInt
-		serverAddr = keyServer[0:portIdx]
+	client, err = dialKeyServer(caFile, certFile, keyFile, host, port, verify, connection)
+	if err != nil {
+		return nil, "", err
+	}
+	password = inputServerPassword(true, "Enter key server's password (no echo)")
+	fmt.Fprintf(os.Stderr, "Establishing connection to %s...\n", strings.Join(client.Addresses, ", "))
+	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+		return nil, "", err
+	}
+	return
+}
+
+/*
+Initialise a TCP client of the key servers on the host setting that trusts the server certificate and reaches the
+servers as given, without asking for the password.
+*/
+func dialKeyServer(caFile, certFile, keyFile, host string, port int, verify keyserv.TLSVerification, connection keyserv.ConnectionSettings) (*keyserv.CryptClient, error) {
+	addrs, err := keyserv.ParseServerAddresses(host, port)
+	if err != nil {
+		return nil, err
 	}
 	// Read custom CA file
 	var customCA []byte
 	if caFile != "" {
 		caFileContent, err := ioutil.ReadFile(caFile)
 		if err != nil {
-			return nil, "", fmt.Errorf("Failed to read custom CA file \"%s\" - %v", caFile, err)
+			return nil, fmt.Errorf("Failed to read custom CA file \"%s\" - %v", caFile, err)
 		}
 		customCA = caFileContent
 	}
-	// Initialise client and test connectivity with the server
-	client, err = keyserv.NewCryptClient("tcp", fmt.Sprintf("%s:%d", serverAddr, port), customCA, certFile, keyFile)
+	client, err := keyserv.NewCryptClient("tcp", strings.Join(addrs, ","), customCA, certFile, keyFile)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	password = sys.InputPassword(true, "", "Enter key server's password (no echo)")
-	fmt.Fprintf(os.Stderr, "Establishing connection to %s on port %d...\n", serverAddr, port)
-	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
-		return nil, "", err
+	if err := client.SetTLSVerification(verify); err != nil {
+		return nil, err
 	}
-	return
+	if err := client.SetConnection(connection); err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 // Prompt user to enter key server's CA file, host name, and port. Defaults are provided by existing configuration.
@@ -110,6 +204,7 @@ func PromptForKeyServer() (sysconf *sys.Sysconfig, caFile, certFile, certKeyFile
 	if err != nil {
 		return
 	}
+	applyTLSOverrides(sysconf)
 	defaultHost := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
 	if host = sys.Input(true, defaultHost, MSG_ASK_HOSTNAME); host == "" {
 		host = defaultHost
@@ -135,9 +230,15 @@ func PromptForKeyServer() (sysconf *sys.Sysconfig, caFile, certFile, certKeyFile
 	return
 }
 
-// CLI command: set up encryption on a file system using a randomly generated key and upload the key to key server.
-func EncryptFS() error {
+/*
+CLI command: set up encryption on a file system using a randomly generated key and upload the key to key server.
+If resume is true, carry on copying data into the encrypted disk after a previous encryption was interrupted.
+*/
+func EncryptFS(resume bool, tangURL string, cryptOpts fs.CryptFormatOptions) error {
 	sys.LockMem()
+	if err := cryptOpts.Validate(); err != nil {
+		return err
+	}
 
 	// Prompt for connection details
 	sysconf, caFile, certFile, certKeyFile, host, port, err := PromptForKeyServer()
@@ -152,7 +253,7 @@ func EncryptFS() error {
 	}
 
 	// Check server connectivity before commencing encryption
-	client, password, err := ConnectToKeyServer(caFile, certFile, certKeyFile, fmt.Sprintf("%s:%d", host, port))
+	client, password, err := ConnectToKeyServer(caFile, certFile, certKeyFile, host, port, keyserv.TLSVerificationFromSysconfig(sysconf), keyserv.ConnectionSettingsFromSysconfig(sysconf))
 	if err != nil {
 		return err
 	}
@@ -160,6 +261,14 @@ func EncryptFS() error {
 	// Ask about encrypted disks
 	srcDir := sys.InputAbsFilePath(true, "", MSG_ASK_SRC_DIR)
 	srcDir = filepath.Clean(srcDir)
+	if resume {
+		// The remaining details were recorded in the migration journal when the encryption started
+		uuid, err := routine.ResumeEncryptFS(os.Stdout, client, password, srcDir)
+		if err != nil {
+			return err
+		}
+		return activateEncryptedFS(sysconf, caFile, certFile, certKeyFile, host, port, uuid)
+	}
 	encDisk := sys.InputAbsFilePath(true, "", MSG_ASK_ENC_DISK)
 	encDisk = filepath.Clean(encDisk)
 	maxActive := sys.InputInt(true, 1, 1, 99999, MSG_ASK_MAX_ACTIVE)
@@ -170,10 +279,21 @@ func EncryptFS() error {
 	if aliveTimeout == 0 {
 		aliveTimeout = DEFUALT_ALIVE_TIMEOUT
 	}
-	roundedAliveTimeout := aliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC * routine.REPORT_ALIVE_INTERVAL_SEC
+	roundedAliveTimeout, aliveCount := routine.RoundAliveTimeout(aliveTimeout, routine.REPORT_ALIVE_INTERVAL_SEC)
 	if roundedAliveTimeout != aliveTimeout {
 		fmt.Printf(MSG_ALIVE_TIMEOUT_ROUNDED, roundedAliveTimeout)
 	}
+	for {
+		if newTangURL := sys.Input(false, tangURL, MSG_ASK_TANG_URL); newTangURL != "" {
+			tangURL = newTangURL
+		}
+		if err := keydb.ValidateTangURL(tangURL); err != nil {
+			fmt.Println(err)
+			tangURL = ""
+			continue
+		}
+		break
+	}
 
 	// Check pre-conditions for encryption
 	if err := routine.EncryptFSPreCheck(srcDir, encDisk); err != nil {
@@ -185,20 +305,95 @@ func EncryptFS() error {
 	if !sys.InputBool(false, MSG_ASK_PROCEED) {
 		return errors.New(MSG_E_CANCELLED)
 	}
-	// Alive-report interval is hard coded for now until there is a very good reason to change it
+	// New records start with the default alive-report interval, it may be changed later via edit-key.
 	uuid, err := routine.EncryptFS(os.Stdout, client, password, srcDir, encDisk, maxActive,
-		routine.REPORT_ALIVE_INTERVAL_SEC, roundedAliveTimeout/routine.REPORT_ALIVE_INTERVAL_SEC)
+		routine.REPORT_ALIVE_INTERVAL_SEC, aliveCount, tangURL, cryptOpts)
+	if err != nil || routine.IsDryRun() {
+		// A dry run leaves the client configuration and daemons alone too
+		return err
+	}
+	return activateEncryptedFS(sysconf, caFile, certFile, certKeyFile, host, port, uuid)
+}
+
+/*
+Sub-command: encrypt the existing file system on a disk in-place, or resume an interrupted in-place encryption, and
+keep the key on a key server.
+*/
+func InplaceEncryptFS() error {
+	sys.LockMem()
+
+	// Prompt for connection details
+	sysconf, caFile, certFile, certKeyFile, host, port, err := PromptForKeyServer()
+	if err != nil {
+		return err
+	}
+	storedHost := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
+	if storedHost != "" && host != storedHost {
+		if !sys.InputBool(false, MSG_ASK_DIFF_HOST, storedHost, host) {
+			return errors.New(MSG_E_CANCELLED)
+		}
+	}
+
+	// Check server connectivity before commencing encryption
+	client, password, err := ConnectToKeyServer(caFile, certFile, certKeyFile, host, port, keyserv.TLSVerificationFromSysconfig(sysconf), keyserv.ConnectionSettingsFromSysconfig(sysconf))
+	if err != nil {
+		return err
+	}
+
+	// Ask about the disk, an interrupted encryption is resumed with the settings given when it started.
+	encDisk := sys.InputAbsFilePath(true, "", MSG_ASK_INPLACE_DISK)
+	encDisk = filepath.Clean(encDisk)
+	resume, err := routine.InplaceEncryptFSPreCheck(encDisk)
+	if err != nil {
+		return err
+	}
+	var mountPoint string
+	var maxActive, aliveCount int
+	if resume {
+		fmt.Printf(MSG_INPLACE_RESUME_SEQUENCE, encDisk)
+	} else {
+		mountPoint = sys.InputAbsFilePath(true, "", MSG_ASK_MOUNT)
+		mountPoint = filepath.Clean(mountPoint)
+		maxActive = sys.InputInt(true, 1, 1, 99999, MSG_ASK_MAX_ACTIVE)
+		if maxActive == 0 {
+			maxActive = 1
+		}
+		aliveTimeout := sys.InputInt(true, DEFUALT_ALIVE_TIMEOUT, DEFUALT_ALIVE_TIMEOUT, 3600*24*7, MSG_ASK_ALIVE_TIMEOUT)
+		if aliveTimeout == 0 {
+			aliveTimeout = DEFUALT_ALIVE_TIMEOUT
+		}
+		var roundedAliveTimeout int
+		roundedAliveTimeout, aliveCount = routine.RoundAliveTimeout(aliveTimeout, routine.REPORT_ALIVE_INTERVAL_SEC)
+		if roundedAliveTimeout != aliveTimeout {
+			fmt.Printf(MSG_ALIVE_TIMEOUT_ROUNDED, roundedAliveTimeout)
+		}
+		fmt.Printf(MSG_INPLACE_SEQUENCE, encDisk)
+	}
+
+	// Prompt user for confirmation and then proceed
+	if !sys.InputBool(false, MSG_ASK_PROCEED) {
+		return errors.New(MSG_E_CANCELLED)
+	}
+	uuid, err := routine.InplaceEncryptFS(os.Stdout, client, password, encDisk, mountPoint, maxActive,
+		routine.REPORT_ALIVE_INTERVAL_SEC, aliveCount)
 	if err != nil {
 		return err
 	}
+	return activateEncryptedFS(sysconf, caFile, certFile, certKeyFile, host, port, uuid)
+}
 
+/*
+Save the key server details into client configuration, and start the daemons that report alive messages of the newly
+encrypted disk and poll for pending messages.
+*/
+func activateEncryptedFS(sysconf *sys.Sysconfig, caFile, certFile, certKeyFile, host string, port int, uuid string) error {
 	// Put latest key server details into client configuration file
 	sysconf.Set(keyserv.CLIENT_CONF_HOST, host)
 	sysconf.Set(keyserv.CLIENT_CONF_PORT, strconv.Itoa(port))
 	sysconf.Set(keyserv.CLIENT_CONF_CA, caFile)
 	sysconf.Set(keyserv.CLIENT_CONF_CERT, certFile)
 	sysconf.Set(keyserv.CLIENT_CONF_CERT_KEY, certKeyFile)
-	if err := ioutil.WriteFile(CLIENT_CONFIG_PATH, []byte(sysconf.ToText()), 0600); err != nil {
+	if err := sys.ReplaceFile(CLIENT_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true); err != nil {
 		return fmt.Errorf(MSG_E_SAVE_SYSCONF, CLIENT_CONFIG_PATH, err)
 	}
 
@@ -213,18 +408,52 @@ func EncryptFS() error {
 	return nil
 }
 
-// Sub-command: forcibly unlock all file systems that have their keys on a key server.
-func ManOnlineUnlockFS() error {
+/*
+Sub-command: forcibly unlock all file systems that have their keys on a key server, using up to the number of parallel
+workers. With force, keys in use by as many computers as allowed are granted too by evicting the stalest computer.
+*/
+func ManOnlineUnlockFS(parallel int, force bool) error {
+	sys.LockMem()
+	sysconf, caFile, certFile, certKeyFile, host, port, err := PromptForKeyServer()
+	if err != nil {
+		return err
+	}
+	client, password, err := ConnectToKeyServer(caFile, certFile, certKeyFile, host, port, keyserv.TLSVerificationFromSysconfig(sysconf), keyserv.ConnectionSettingsFromSysconfig(sysconf))
+	if err != nil {
+		return err
+	}
+	return routine.ManOnlineUnlockFS(os.Stdout, client, password, parallel, force)
+}
+
+/*
+Sub-command: unlock a single file system by a one-time unlock token instead of the password, e.g. for a technician
+whose computer is not among the allowed clients.
+*/
+func TokenOnlineUnlockFS(deviceID, token string) error {
 	sys.LockMem()
-	_, caFile, certFile, certKeyFile, host, port, err := PromptForKeyServer()
+	if err := keydb.ValidateDeviceID(deviceID); err != nil {
+		return err
+	}
+	sysconf, caFile, certFile, certKeyFile, host, port, err := PromptForKeyServer()
+	if err != nil {
+		return err
+	}
+	client, err := dialKeyServer(caFile, certFile, certKeyFile, host, port, keyserv.TLSVerificationFromSysconfig(sysconf), keyserv.ConnectionSettingsFromSysconfig(sysconf))
 	if err != nil {
 		return err
 	}
-	client, password, err := ConnectToKeyServer(caFile, certFile, certKeyFile, fmt.Sprintf("%s:%d", host, port))
+	if token == "" {
+		if !sys.IsInteractive() {
+			return errors.New("Standard input is not a terminal, give the unlock token by -token")
+		}
+		token = sys.InputPassword(true, "", "Enter the unlock token (no echo)")
+	}
+	rec, err := routine.TokenUnlockFS(os.Stdout, client, deviceID, token)
 	if err != nil {
 		return err
 	}
-	return routine.ManOnlineUnlockFS(os.Stdout, client, password)
+	fmt.Printf("%s: unlocked by key record \"%s\", the unlock token has been used up\n", deviceID, rec.UUID)
+	return nil
 }
 
 // Sub-command: unlock a single file systems using a key record file.
@@ -235,20 +464,107 @@ func ManOfflineUnlockFS() error {
 	if err != nil {
 		return fmt.Errorf(MSG_E_READ_FILE, keyRecordPath, err)
 	}
+	// The record file content holds the key too
+	defer sys.SecureBytes(content).Wipe()
 	rec := keydb.Record{}
 	if err := rec.Deserialise(content); err != nil {
 		return fmt.Errorf(MSG_E_BAD_KEYREC, err)
 	}
+	defer rec.Key.Wipe()
 	fmt.Printf("Input key record:\n%s\n\n", rec.FormatAttrs("\n"))
 	if newMountPoint := sys.Input(false, rec.MountPoint, MSG_ASK_MOUNT); newMountPoint != "" {
 		rec.MountPoint = newMountPoint
 	}
 	if newMountOptions := sys.Input(false, rec.GetMountOptionStr(), MSG_ASK_MOUNT_OPT); newMountOptions != "" {
-		rec.MountOptions = strings.Split(newMountOptions, ",")
+		rec.MountOptions = fs.ParseMountOptions(newMountOptions)
 	}
 	return routine.UnlockFS(os.Stderr, rec, 3)
 }
 
+// ReportInventory sends the block devices of this computer to key server, the mount points under excluded paths are left out.
+func ReportInventory(client *keyserv.CryptClient, excludePaths []string) error {
+	hostname, _ := sys.GetHostnameAndIP()
+	disks := keyserv.NewInventoryDisks(fs.GetBlockDevices(), excludePaths)
+	if err := client.ReportInventory(keyserv.ReportInventoryReq{Hostname: hostname, Disks: disks}); err != nil {
+		log.Printf("Failed to report disk inventory: %v", err)
+		return err
+	}
+	log.Printf("Reported %d disks to server's disk inventory", len(disks))
+	return nil
+}
+
+/*
+AutoEncryptBlankDisks looks for the blank disks of the records this computer is entitled to and that allow automatic
+encryption, then encrypts, formats, and mounts them, and sends their alive reports along with the other held disks.
+A disk that failed once is remembered in failed and left alone until the daemon restarts, an administrator should look
+into it rather than have it formatted over and over.
+*/
+func AutoEncryptBlankDisks(client *keyserv.CryptClient, failed map[string]bool) {
+	entitled, err := listEntitledDevices(client)
+	if err != nil {
+		log.Printf("Failed to look for blank disks to encrypt: %v", err)
+		return
+	}
+	disks := routine.FindAutoEncryptDisks(fs.GetBlockDevices(), entitled)
+	for uuid := range disks {
+		if failed[uuid] {
+			delete(disks, uuid)
+		}
+	}
+	if len(disks) == 0 {
+		return
+	}
+	results, err := routine.AutoEncryptDisks(os.Stderr, client, disks)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, result := range results {
+		_, isBindErr := result.Err.(routine.BindMountErrors)
+		if result.Err != nil && !isBindErr {
+			log.Printf("Failed to encrypt blank disk %s of record \"%s\", leaving it alone until restart: %v", result.DeviceID, result.RecordID, result.Err)
+			failed[result.RecordID] = true
+			continue
+		}
+		log.Printf("Blank disk %s of record \"%s\" has been encrypted and mounted.", result.DeviceID, result.RecordID)
+		disk := routine.HeldDisk{UUID: result.RecordID, IntervalSec: result.AliveIntervalSec, PID: os.Getpid()}
+		if isBindErr {
+			disk.Health = result.Err.Error()
+		}
+		if err := routine.HoldDisk(routine.ALIVE_STATE_DIR, disk); err != nil {
+			log.Printf("Alive reports for disk \"%s\" are not sent: %v", result.RecordID, err)
+		}
+	}
+}
+
+/*
+ReportCryptInventory sends the LUKS and crypt devices of this computer to key server on request of a pending command,
+regardless of whether the daily inventory reports are enabled. Returns human-readable result text.
+*/
+func ReportCryptInventory(client *keyserv.CryptClient) string {
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return fmt.Sprintf("Failed to read configuration file - %v", err)
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	disks := keyserv.NewCryptInventoryDisks(fs.GetBlockDevices(), sysconf.GetStringArray(keyserv.CLIENT_CONF_INVENTORY_EXCLUDE, []string{}))
+	if err := client.ReportInventory(keyserv.ReportInventoryReq{Hostname: hostname, Disks: disks, CryptOnly: true}); err != nil {
+		return fmt.Sprintf("Failed to report device inventory - %v", err)
+	}
+	log.Printf("Reported %d encrypted devices to server's disk inventory", len(disks))
+	return "Success"
+}
+
+// Print the value as indented JSON to stdout.
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
 /*
 Helper to get a client connection from sysconfig
 */
@@ -261,151 +577,1041 @@ func OpenConnection() (*keyserv.CryptClient, error) {
 	if sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") == "" {
 		return nil, fmt.Errorf(MSG_UNLOCK_IS_NOP)
 	}
+	applyTLSOverrides(sysconf)
 	return keyserv.NewCryptClientFromSysconfig(sysconf)
 }
 
 /*
-Sub-command: contact key server to retrieve encryption key to unlock a single file system, then continuously send alive
-reports to server to indicate that computer is still holding onto the encrypted disk.
-Block caller until the program quits or server rejects this computer.
+Helper to get a client connection to the key server given in "host:port", or several of them separated by comma in
+order of preference, using the remaining settings (CA and client certificate) from sysconfig. The port number is
+optional and defaults to key server's default port. If the key server is empty, the one from sysconfig is used.
 */
-func AutoOnlineUnlockFS(uuid string) error {
-	client, err := OpenConnection()
+func OpenConnectionTo(keyServer string) (*keyserv.CryptClient, error) {
+	if keyServer == "" {
+		return OpenConnection()
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := routine.AutoOnlineUnlockFS(os.Stdout, client, uuid, ONLINE_UNLOCK_RETRY_SEC); err != nil {
-		return err
+	if _, err := keyserv.ParseServerAddresses(keyServer, keyserv.SRV_DEFAULT_PORT); err != nil {
+		return nil, err
 	}
-	return routine.ReportAlive(os.Stderr, client, uuid)
+	sysconf.Set(keyserv.CLIENT_CONF_HOST, keyServer)
+	sysconf.Set(keyserv.CLIENT_CONF_PORT, strconv.Itoa(keyserv.SRV_DEFAULT_PORT))
+	applyTLSOverrides(sysconf)
+	return keyserv.NewCryptClientFromSysconfig(sysconf)
 }
 
 /*
-Check if the device with given uuid should be handled by cryptctl2 client daemon on this client
+Sub-command: enroll this computer with the key server. A client certificate for the host name (this computer's host
+name by default) is requested by the password, or by an enrollment token so that the password never has to be present
+on this computer. The certificate, its key, and the CA are written into ClientCertDir, and the key server along with
+them into client configuration. With inventory, the LUKS devices of this computer are reported to the key server right
+away, so that the administrator may add their records and allowed clients.
 */
-func CheckAutoUnlock(uuid string) error {
-	client, err := OpenConnection()
+func RegisterClient(keyServer, token, dnsName string, inventory bool) error {
+	sys.LockMem()
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, true)
+	if err != nil {
+		return err
+	}
+	applyTLSOverrides(sysconf)
+	if keyServer == "" {
+		defaultHost := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
+		if keyServer = sys.Input(true, defaultHost, MSG_ASK_HOSTNAME); keyServer == "" {
+			keyServer = defaultHost
+		}
+	}
+	port := sysconf.GetInt(keyserv.CLIENT_CONF_PORT, keyserv.SRV_DEFAULT_PORT)
+	if dnsName == "" {
+		dnsName, _ = sys.GetHostnameAndIP()
+	}
+	client, err := dialKeyServer(sysconf.GetString(keyserv.CLIENT_CONF_CA, ""), "", "", keyServer, port, keyserv.TLSVerificationFromSysconfig(sysconf), keyserv.ConnectionSettingsFromSysconfig(sysconf))
 	if err != nil {
 		return err
 	}
-	if err := routine.CheckAutoUnlock(client, uuid); err != nil {
+	req := keyserv.EnrollClientReq{Token: token, Hostname: dnsName}
+	if token == "" {
+		req.PlainPassword = inputServerPassword(true, "Enter key server's password (no echo)")
+	}
+	fmt.Fprintf(os.Stderr, "Requesting a client certificate for %s from %s...\n", dnsName, strings.Join(client.Addresses, ", "))
+	resp, err := client.EnrollClient(req)
+	if err != nil {
 		return err
 	}
+	// Write down the certificate and key server before anything else may fail
+	if err := sys.MkdirSecure(ClientCertDir); err != nil {
+		return fmt.Errorf("Failed to create directory \"%s\" - %v", ClientCertDir, err)
+	}
+	caFile, certFile, keyFile := filepath.Join(ClientCertDir, "ca.pem"), filepath.Join(ClientCertDir, "client.crt"), filepath.Join(ClientCertDir, "client.key")
+	for file, content := range map[string][]byte{caFile: resp.CAPEM, certFile: resp.CertPEM, keyFile: resp.KeyPEM} {
+		if err := sys.ReplaceFile(file, content, sys.SecureFileMode, true); err != nil {
+			return err
+		}
+	}
+	sysconf.Set(keyserv.CLIENT_CONF_HOST, keyServer)
+	sysconf.Set(keyserv.CLIENT_CONF_PORT, strconv.Itoa(port))
+	sysconf.Set(keyserv.CLIENT_CONF_CA, caFile)
+	sysconf.Set(keyserv.CLIENT_CONF_CERT, certFile)
+	sysconf.Set(keyserv.CLIENT_CONF_CERT_KEY, keyFile)
+	if err := sys.ReplaceFile(CLIENT_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true); err != nil {
+		return fmt.Errorf(MSG_E_SAVE_SYSCONF, CLIENT_CONFIG_PATH, err)
+	}
+	fmt.Printf("%-34s%s\n", "Client Certificate", certFile)
+	fmt.Printf("%-34s%s\n", "Issued For", strings.TrimSpace(dnsName+" "+resp.IP))
+	fmt.Printf("%-34s%s\n", "Key Server", keyServer)
+	if inventory {
+		if client, err = keyserv.NewCryptClientFromSysconfig(sysconf); err != nil {
+			return err
+		}
+		disks := keyserv.NewCryptInventoryDisks(fs.GetBlockDevices(), sysconf.GetStringArray(keyserv.CLIENT_CONF_INVENTORY_EXCLUDE, []string{}))
+		if err := client.ReportInventory(keyserv.ReportInventoryReq{Hostname: dnsName, Disks: disks, CryptOnly: true}); err != nil {
+			return fmt.Errorf("The computer is registered, but its devices could not be reported - %v", err)
+		}
+		fmt.Printf("%-34s%d\n", "Reported LUKS Devices", len(disks))
+	}
 	return nil
 }
 
-// Creates a new record for an uuid
-func AddDevice(UUID, MappedName, MountPoint, MountOptions, AllowedClients string, MaxActive int, AutoEncryption bool, FileSystem string) error {
-	var client *keyserv.CryptClient
-	var err error
-	if _, err = os.Stat(keyserv.DomainSocketFile); err == nil {
-		client, err = keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
-	} else {
-		client, err = OpenConnection()
+// Sub-command: print key server's protocol version, features, limits, and certificate expiry as a table or JSON.
+func ShowCapabilities(keyServer, output string) error {
+	client, err := OpenConnectionTo(keyServer)
+	if err != nil {
+		return err
 	}
+	caps, err := client.GetCapabilities()
 	if err != nil {
-		return fmt.Errorf("AddRecord: failed to create connection to cryptctl2 server - %v", err)
+		return err
 	}
-	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
-	// Test the connection and password
-	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
-		return fmt.Errorf("AddRecord: failed to authorize to cryptctl2 server - %v", err)
+	switch output {
+	case OutputJSON:
+		return printJSON(caps)
+	case "", OutputText:
+	default:
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
 	}
-
-	req := keyserv.CreateKeyReq{
-		PlainPassword:  password,
-		UUID:           UUID,
-		MappedName:     MappedName,
-		MountPoint:     MountPoint,
-		MountOptions:   strings.Split(MountOptions, ","),
-		MaxActive:      MaxActive,
-		AllowedClients: strings.Split(AllowedClients, ","),
-		AutoEncryption: AutoEncryption,
-		FileSystem:     FileSystem,
-		AliveCount:     4,
+	formatLimit := func(limit int) string {
+		if limit <= 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(limit)
 	}
-	if _, err := client.CreateKey(req); err != nil {
-		return fmt.Errorf("AddRecord: failed to add new record to cryptctl2 server - %v , %v", err, req)
+	formatExpiry := func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return t.Local().Format(TIME_OUTPUT_FORMAT)
+	}
+	fmt.Printf("%-34s%s\n", "Key Server", client.CurrentAddress())
+	fmt.Printf("%-34s%d\n", "Protocol Version", caps.ProtocolVersion)
+	fmt.Printf("%-34s%s\n", "Replication Role", caps.ReplicationRole)
+	fmt.Printf("%-34s%s\n", "Max. UUIDs Per Request", formatLimit(caps.MaxUUIDsPerRequest))
+	fmt.Printf("%-34s%s\n", "Max. Request Size (bytes)", formatLimit(caps.MaxRequestSize))
+	fmt.Printf("%-34s%s\n", "TLS Certificate Expiry", formatExpiry(caps.CertNotAfter))
+	fmt.Printf("%-34s%s\n", "CA Certificate Expiry", formatExpiry(caps.CANotAfter))
+	features := make([]string, 0, len(caps.Features))
+	for feature := range caps.Features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	for _, feature := range features {
+		fmt.Printf("%-34s%s\n", "Feature "+feature, strconv.FormatBool(caps.Features[feature]))
 	}
-	fmt.Printf("Record to %s was created succesfully", UUID)
 	return nil
 }
 
-/*
-Sub-command: erase encryption headers for the encrypted disk, so that its content becomes irreversibly lost.
-*/
-func EraseKey() error {
-	sys.LockMem()
-	// Establish connection to key server
-	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+// Ask key server for the records this computer is allowed to unlock.
+func listEntitledDevices(client *keyserv.CryptClient) ([]keydb.ClientDevice, error) {
+	caps, err := client.GetCapabilities()
 	if err != nil {
-		return err
-	}
-	host := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
-	if host == "" {
-		return errors.New(MSG_E_ERASE_NO_CONF)
+		return nil, err
+	} else if !caps.Features[keyserv.FeatureClientDevices] {
+		return nil, errors.New("Key server is too old to tell which devices this computer is allowed to unlock")
 	}
-	port := sysconf.GetInt(keyserv.CLIENT_CONF_PORT, 3737)
-	if port == 0 {
-		return errors.New(MSG_E_ERASE_NO_CONF)
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.ListClientDevices(keyserv.ListClientDevicesReq{Hostname: hostname})
+	return resp.Devices, err
+}
+
+// Client - print the records this computer is allowed to unlock, as told by key server.
+func ListEntitledDevices(output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
 	}
-	caFile := sysconf.GetString(keyserv.CLIENT_CONF_CA, "")
-	client, password, err := ConnectToKeyServer(
-		caFile,
-		sysconf.GetString(keyserv.CLIENT_CONF_CERT, ""),
-		sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, ""),
-		fmt.Sprintf("%s:%d", host, port))
+	client, err := OpenConnection()
 	if err != nil {
 		return err
 	}
-	// Ask for the UUID to wipe and proceed
-	uuid := sys.Input(true, "", MSG_ERASE_UUID)
-	confirmUUID := sys.Input(true, "", MSG_ERASE_UUID_AGAIN, uuid)
-	if confirmUUID != uuid {
-		return errors.New(MSG_E_ERASE_UUID_MISMATCH)
-	}
-	if err := routine.EraseKey(os.Stdout, client, password, uuid); err != nil {
+	devices, err := listEntitledDevices(client)
+	if err != nil {
 		return err
 	}
+	if output == OutputJSON {
+		return printJSON(devices)
+	}
+	printClientDevices(devices)
 	return nil
 }
 
 /*
-ClientDaemon runs the main routine of "client-daemon" sub-command.
-The routine primarily polls for pending commands and execute them.
+Sub-command: contact key server to retrieve encryption keys to unlock the file systems of the devices, or of all
+encrypted file systems on this computer if all is true, asking for all keys in one request. Then make sure that alive
+reports are sent to server to indicate that computer is still holding onto the encrypted disks. If the client daemon is
+running, the disks are handed to the daemon, which sends the reports of all disks in one request; otherwise the reports
+are sent from here.
+The result of each device is reported individually. An error is returned if any device that has a key on the server
+failed to unlock, or if a device does not have a key on the server at all, which is only warned about if all is true.
+The keys are asked for according to the retry settings, see AutoUnlockRetry.
+Block caller until the program quits or server rejects this computer.
 */
-func ClientDaemon() error {
-	client, err := OpenConnection()
-	if err != nil {
-		return err
+func AutoOnlineUnlockFS(deviceIDs []string, all bool, retry routine.UnlockRetry) error {
+	if retry.IntervalSec < 1 {
+		return fmt.Errorf("The retry interval must be at least 1 second, it is %d.", retry.IntervalSec)
 	}
-	log.Printf("Going to poll for commands from server %s every 30 seconds.", client.Address)
-	for {
-		time.Sleep(30 * time.Second)
-
-		devs := fs.GetBlockDevices()
+	if all {
+		deviceIDs, _ = routine.EncryptedFSToUnlock(fs.GetBlockDevices())
+		if len(deviceIDs) == 0 {
+			return errors.New("Cannot find any more encrypted file systems.")
+		}
+	} else {
+		for _, deviceID := range deviceIDs {
+			if err := keydb.ValidateDeviceID(deviceID); err != nil {
+				return err
+			}
+		}
+	}
+	// The client daemon reports the progress of the devices to status queries
+	for _, deviceID := range deviceIDs {
+		recordUnlockProgress(deviceID, routine.DeviceUnlocking, "")
+	}
+	retry.OnFailure = func(deviceID string, err error) {
+		recordUnlockProgress(deviceID, routine.DeviceUnlocking, err.Error())
+	}
+	client, err := OpenConnection()
+	if err != nil {
+		for _, deviceID := range deviceIDs {
+			recordUnlockProgress(deviceID, routine.DeviceError, err.Error())
+		}
+		return err
+	}
+	results := routine.AutoOnlineUnlockManyFS(os.Stdout, client, deviceIDs, retry, tpm2UnlockPCRs())
+	disks := make([]routine.HeldDisk, 0, len(results))
+	failures := make([]string, 0, len(results))
+	var unlockErr error
+	for _, result := range results {
+		health := ""
+		if bindErrs, isBindErr := result.Err.(routine.BindMountErrors); isBindErr {
+			// The disk is in use despite failed bind-mounts, let the server know about them.
+			health = bindErrs.Error()
+		} else if result.Missing && all {
+			fmt.Printf("%s: skipped, the server does not have its encryption key\n", result.DeviceID)
+			clearUnlockProgress(result.DeviceID)
+			continue
+		} else if result.Err != nil {
+			fmt.Printf("%s: failed - %v\n", result.DeviceID, result.Err)
+			recordUnlockProgress(result.DeviceID, routine.DeviceError, result.Err.Error())
+			failures = append(failures, result.DeviceID)
+			unlockErr = result.Err
+			continue
+		}
+		if routine.IsDryRun() {
+			fmt.Printf("%s: would be unlocked by key record \"%s\"\n", result.DeviceID, result.RecordID)
+			continue
+		}
+		fmt.Printf("%s: unlocked by key record \"%s\"\n", result.DeviceID, result.RecordID)
+		clearUnlockProgress(result.DeviceID)
+		disks = append(disks, routine.HeldDisk{UUID: result.RecordID, Health: health, IntervalSec: result.AliveIntervalSec, PID: os.Getpid()})
+	}
+	if len(failures) > 1 {
+		unlockErr = fmt.Errorf("Failed to unlock %d of the encrypted file systems (%s). Check output for more details.",
+			len(failures), strings.Join(failures, ", "))
+	}
+	if len(disks) == 0 {
+		return unlockErr
+	}
+	// Units ordered after an unlock unit (e.g. the mount unit) may start now that the disks are unlocked
+	if err := sys.SdNotify("READY=1"); err != nil {
+		log.Print(err)
+	}
+	var holdErr error
+	if !sys.SystemctlIsRunning(ClientDaemonService) {
+		holdErr = reportAliveUntilRejected(client, disks)
+	} else {
+		holdErr = holdDisksUntilRejected(disks)
+	}
+	// The disks that could not be unlocked fail the program once it stops holding the others
+	if unlockErr != nil {
+		return unlockErr
+	}
+	return holdErr
+}
+
+/*
+Sub-command: automatically unlock a single file system by a one-time unlock token in place of allowed client
+membership, and then send alive reports of the disk like AutoOnlineUnlockFS does.
+*/
+func TokenAutoUnlockFS(deviceID, token string) error {
+	if err := keydb.ValidateDeviceID(deviceID); err != nil {
+		return err
+	}
+	recordUnlockProgress(deviceID, routine.DeviceUnlocking, "")
+	client, err := OpenConnection()
+	if err != nil {
+		recordUnlockProgress(deviceID, routine.DeviceError, err.Error())
+		return err
+	}
+	rec, err := routine.TokenUnlockFS(os.Stdout, client, deviceID, token)
+	if err != nil {
+		recordUnlockProgress(deviceID, routine.DeviceError, err.Error())
+		return err
+	}
+	fmt.Printf("%s: unlocked by key record \"%s\", the unlock token has been used up\n", deviceID, rec.UUID)
+	clearUnlockProgress(deviceID)
+	if err := sys.SdNotify("READY=1"); err != nil {
+		log.Print(err)
+	}
+	disks := []routine.HeldDisk{{UUID: rec.UUID, IntervalSec: rec.AliveIntervalSec, PID: os.Getpid()}}
+	if !sys.SystemctlIsRunning(ClientDaemonService) {
+		return reportAliveUntilRejected(client, disks)
+	}
+	return holdDisksUntilRejected(disks)
+}
+
+// Record the unlock progress of the device for status queries, a failure to do so is only logged.
+func recordUnlockProgress(deviceID, state, lastErr string) {
+	if routine.IsDryRun() {
+		// A dry run does not unlock anything that the client daemon should know about
+		return
+	}
+	progress := routine.UnlockProgress{DeviceID: deviceID, State: state, Error: lastErr, PID: os.Getpid()}
+	if err := routine.RecordUnlockProgress(routine.UNLOCK_STATE_DIR, progress); err != nil {
+		log.Print(err)
+	}
+}
+
+// Clear the unlock progress of the device once it no longer needs to be reported, a failure to do so is only logged.
+func clearUnlockProgress(deviceID string) {
+	if routine.IsDryRun() {
+		return
+	}
+	if err := routine.ClearUnlockProgress(routine.UNLOCK_STATE_DIR, deviceID); err != nil {
+		log.Print(err)
+	}
+}
+
+// Send alive reports of the disks from here in one request each time, and block until the server rejects all of them.
+func reportAliveUntilRejected(client *keyserv.CryptClient, disks []routine.HeldDisk) error {
+	stop := make(chan struct{})
+	var reporter *routine.AliveReporter
+	reporter = routine.NewAliveReporter(client, func(uuid string) {
+		log.Printf("Server has rejected the alive report of disk \"%s\", stop reporting for it.", uuid)
+		if len(reporter.Held()) == 0 {
+			close(stop)
+		}
+	})
+	reporter.MaxBackoffSec = aliveReportMaxBackoff()
+	reporter.SealDir = routine.TPM2_SEALED_KEY_DIR
+	for _, disk := range disks {
+		reporter.Hold(disk)
+	}
+	reporter.Run(os.Stderr, "", stop)
+	return errors.New("Stop sending alive reports because server has rejected all disks")
+}
+
+// Hand the disks to the client daemon for alive reports, and block until the server rejects all of them or the program quits.
+func holdDisksUntilRejected(disks []routine.HeldDisk) error {
+	uuids := make([]string, 0, len(disks))
+	for _, disk := range disks {
+		if err := routine.HoldDisk(routine.ALIVE_STATE_DIR, disk); err != nil {
+			return err
+		}
+		log.Printf("Alive reports for disk \"%s\" are sent by %s", disk.UUID, ClientDaemonService)
+		uuids = append(uuids, disk.UUID)
+	}
+	// The service is stopped when the disks are locked, the daemon must stop reporting for them then.
+	stopSignal := make(chan os.Signal, 1)
+	signal.Notify(stopSignal, syscall.SIGTERM, syscall.SIGINT)
+	stop := make(chan struct{})
+	go func() {
+		<-stopSignal
+		close(stop)
+	}()
+	var wg sync.WaitGroup
+	for _, uuid := range uuids {
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+			routine.WaitForRelease(routine.ALIVE_STATE_DIR, uuid, stop)
+		}(uuid)
+	}
+	wg.Wait()
+	select {
+	case <-stop:
+		var releaseErr error
+		for _, uuid := range uuids {
+			if err := routine.ReleaseDisk(routine.ALIVE_STATE_DIR, uuid); err != nil {
+				releaseErr = err
+			}
+		}
+		return releaseErr
+	default:
+		return fmt.Errorf("Stop holding disk \"%s\" because server has rejected it", strings.Join(uuids, "\", \""))
+	}
+}
+
+/*
+Sub-command: write a systemd unit that unlocks the disk before it is mounted, for each disk on this computer that has
+a key record, or only for the device if an ID is given. Units edited by hand are only overwritten if force is true.
+If enable is true, the units are enabled too. If unit directory is empty, the units are written into systemd's
+directory for local units.
+*/
+func GenerateSystemdUnits(deviceID, unitDir string, enable, force bool, retry *routine.UnlockRetry) error {
+	sys.LockMem()
+	if unitDir == "" {
+		unitDir = routine.SYSTEMD_UNIT_DIR
+	}
+	client, err := OpenConnection()
+	if err != nil {
+		return err
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(unitDir, 0755); err != nil {
+		return fmt.Errorf("Failed to make directory \"%s\" - %v", unitDir, err)
+	}
+	unitNames, genErr := routine.GenerateSystemdUnlockUnits(os.Stdout, client, password, deviceID, unitDir, force, retry)
+	if enable && len(unitNames) > 0 {
+		if err := sys.SystemctlDaemonReload(); err != nil {
+			return err
+		}
+		for _, name := range unitNames {
+			if err := sys.SystemctlEnable(name); err != nil {
+				return err
+			}
+			fmt.Printf("Enabled %s\n", name)
+		}
+	}
+	return genErr
+}
+
+/*
+Sub-command: disable and remove the unlock units written by generate-systemd-units for the device, or all of them if
+the device ID is empty. The disks that are unlocked already remain so.
+*/
+func RemoveSystemdUnits(deviceID, unitDir string, force bool) error {
+	if unitDir == "" {
+		unitDir = routine.SYSTEMD_UNIT_DIR
+	}
+	unitNames, removeErr := routine.RemoveSystemdUnlockUnits(os.Stdout, deviceID, unitDir, force, sys.SystemctlDisable)
+	if len(unitNames) > 0 {
+		if err := sys.SystemctlDaemonReload(); err != nil {
+			return err
+		}
+	}
+	return removeErr
+}
+
+/*
+Sub-command: write the configuration bundle that lets the initrd unlock the encrypted root device without password,
+using the key server, certificates, and retry settings of this computer. If the directory is empty, the bundle is
+written into routine.INITRD_CONFIG_DIR.
+*/
+func GenerateInitrdConfig(deviceID, dir string) error {
+	sys.LockMem()
+	if dir == "" {
+		dir = routine.INITRD_CONFIG_DIR
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	applyTLSOverrides(sysconf)
+	host := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
+	if host == "" {
+		return fmt.Errorf(MSG_UNLOCK_IS_NOP)
+	}
+	blkDev, _, err := fs.GetBlockDevices().ResolveDeviceID(deviceID)
+	if err != nil {
+		return err
+	}
+	addrs, err := keyserv.ParseServerAddresses(host, sysconf.GetInt(keyserv.CLIENT_CONF_PORT, 3737))
+	if err != nil {
+		return err
+	}
+	retry := AutoUnlockRetry()
+	verify := keyserv.TLSVerificationFromSysconfig(sysconf)
+	connection := keyserv.ConnectionSettingsFromSysconfig(sysconf)
+	conf := routine.InitrdConfig{
+		Server:            strings.Join(addrs, ","),
+		UUID:              blkDev.UUID,
+		MaxRetrySec:       retry.MaxRetrySec,
+		RetryIntervalSec:  retry.IntervalSec,
+		ServerFingerprint: verify.Fingerprint,
+		SkipHostname:      verify.SkipHostname,
+		BindAddress:       connection.BindAddress,
+		Proxy:             connection.Proxy,
+	}
+	if err := routine.WriteInitrdConfig(dir, conf, sysconf.GetString(keyserv.CLIENT_CONF_CA, ""),
+		sysconf.GetString(keyserv.CLIENT_CONF_CERT, ""), sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, "")); err != nil {
+		return err
+	}
+	fmt.Printf("The initrd configuration for device with UUID '%s' has been written into \"%s\", include it in the initrd along with this program.\n", blkDev.UUID, dir)
+	return nil
+}
+
+/*
+Sub-command: replace the encryption key of the device with a new one, both in its encryption header and on the key
+server. Without a password, the key server must grant this computer the key as if it was unlocking the disk.
+On the key server, if the device is not a local disk, the server generates the new key of the record and tells the
+computers holding the disk to rotate to it.
+*/
+func RotateKey(deviceID string) error {
+	sys.LockMem()
+	if _, err := os.Stat(keyserv.DomainSocketFile); err == nil {
+		if _, _, err := fs.GetBlockDevices().ResolveDeviceID(deviceID); err != nil {
+			return startServerKeyRotation(deviceID)
+		}
+	}
+	client, err := OpenConnection()
+	if err != nil {
+		return err
+	}
+	password := inputServerPassword(false, "Enter key server's password (no echo), leave empty to use auto-unlock authorisation")
+	if password != "" {
+		if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+			return err
+		}
+	}
+	return routine.RotateKey(os.Stdout, client, password, deviceID, routine.KEY_ROTATION_STATE_DIR, tpm2UnlockPCRs())
+}
+
+// Have the key server running on this computer generate a new key of the record, the computers holding the disk rotate to it.
+func startServerKeyRotation(uuid string) error {
+	if err := keydb.ValidateUUID(uuid); err != nil {
+		return err
+	}
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return fmt.Errorf("Key server is not running - %v", err)
+	}
+	if caps, err := client.GetCapabilities(); err != nil {
+		return fmt.Errorf("Key server did not answer - %v", err)
+	} else if !caps.Features[keyserv.FeatureServerKeyRotation] {
+		return errors.New("The running key server cannot rotate keys, they are either stored on an external KMIP server or the server needs a restart.")
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	fmt.Println()
+	resp, err := client.StartKeyRotation(keyserv.StartKeyRotationReq{PlainPassword: password, UUID: uuid})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The key server has generated a new key for %s and keeps the old key until a computer has rotated the disk to the new one.\n", uuid)
+	if len(resp.Holders) == 0 {
+		fmt.Println("No computer is holding the disk at the moment, the first one to retrieve the key will carry out the rotation.")
+	} else {
+		fmt.Printf("The computers holding the disk have been told to rotate: %s\n", strings.Join(resp.Holders, " "))
+	}
+	return nil
+}
+
+/*
+AutoUnlockRetry returns the retry settings of auto-unlock according to sysconfig, by default auto-unlock keeps retrying
+for ONLINE_UNLOCK_RETRY_SEC at the interval of routine.AUTO_UNLOCK_RETRY_INTERVAL_SEC.
+*/
+func AutoUnlockRetry() routine.UnlockRetry {
+	retry := routine.UnlockRetry{
+		MaxRetrySec:    ONLINE_UNLOCK_RETRY_SEC,
+		IntervalSec:    routine.AUTO_UNLOCK_RETRY_INTERVAL_SEC,
+		MaxIntervalSec: routine.AUTO_UNLOCK_MAX_RETRY_INTERVAL_SEC,
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return retry
+	}
+	retry.MaxRetrySec = int64(sysconf.GetInt(routine.CLIENT_CONF_UNLOCK_MAX_RETRY, int(retry.MaxRetrySec)))
+	retry.IntervalSec = int64(sysconf.GetInt(routine.CLIENT_CONF_UNLOCK_INTERVAL, int(retry.IntervalSec)))
+	retry.MaxIntervalSec = int64(sysconf.GetInt(routine.CLIENT_CONF_UNLOCK_MAX_INTERVAL, int(retry.MaxIntervalSec)))
+	retry.TangFallbackSec = int64(sysconf.GetInt(routine.CLIENT_CONF_TANG_FALLBACK, routine.TANG_FALLBACK_SEC))
+	return retry
+}
+
+// Return the cap of the wait between failed alive reports according to sysconfig.
+func aliveReportMaxBackoff() int {
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return routine.REPORT_ALIVE_MAX_BACKOFF_SEC
+	}
+	return sysconf.GetInt(routine.CLIENT_CONF_ALIVE_MAX_BACKOFF, routine.REPORT_ALIVE_MAX_BACKOFF_SEC)
+}
+
+/*
+Return the TPM2 PCRs that bind the sealed keys of this computer according to sysconfig, or empty string if keys are
+not to be sealed by TPM2.
+*/
+func tpm2UnlockPCRs() string {
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil || !sysconf.GetBool(routine.CLIENT_CONF_TPM2_UNLOCK, false) {
+		return ""
+	}
+	pcrs := sysconf.GetString(routine.CLIENT_CONF_TPM2_PCRS, routine.DefaultTPM2PCRs)
+	if err := sys.ValidateTPM2PCRs(pcrs); err != nil {
+		log.Printf("TPM2 unlock is disabled due to invalid %s - %v", routine.CLIENT_CONF_TPM2_PCRS, err)
+		return ""
+	}
+	return pcrs
+}
+
+/*
+Check if the device with given uuid should be handled by cryptctl2 client daemon on this client
+*/
+func CheckAutoUnlock(uuid string) error {
+	client, err := OpenConnection()
+	if err != nil {
+		return err
+	}
+	if err := routine.CheckAutoUnlock(os.Stdout, client, uuid, tpm2UnlockPCRs()); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+AddDeviceOptions are the details of a new record given to add-device. The text fields are as given on the command line,
+e.g. comma-separated lists, they are parsed and validated by AddDevice.
+*/
+type AddDeviceOptions struct {
+	DeviceID          string                // DeviceID is any of the IDs of the device, e.g. "LABEL:data", see fs.SplitDeviceID.
+	MappedName        string                // MappedName is the device mapper name the disk is unlocked under, it is mandatory.
+	MountPoint        string                // MountPoint is where the file system is mounted.
+	MountOptions      string                // MountOptions are the comma-separated mount options.
+	AllowedClients    string                // AllowedClients are the comma-separated allowed client entries.
+	MaxActive         int                   // MaxActive is the maximum number of computers using the disk at once, at least 1.
+	AutoEncryption    bool                  // AutoEncryption lets the first client that finds the blank disk encrypt it.
+	FileSystem        string                // FileSystem is made on the disk by automatic encryption.
+	Group             string                // Group is the consistency group of the disk.
+	GroupPriority     int                   // GroupPriority is the mount order of the disk in its group.
+	Tags              string                // Tags are the comma-separated name=value tags.
+	Owner             string                // Owner is the team or administrator responsible for the disk.
+	UnlockAfter       string                // UnlockAfter are the comma-separated IDs of records unlocked before this one.
+	FsckPolicy        string                // FsckPolicy tells whether the file system is checked before it is mounted.
+	TangURL           string                // TangURL is the Tang server the disk is also bound to.
+	UnlockWindows     string                // UnlockWindows are the periods of time during which the key is handed out for auto-unlock.
+	UmountAtWindowEnd bool                  // UmountAtWindowEnd umounts the disk once an unlock window ends.
+	CryptOptions      fs.CryptFormatOptions // CryptOptions are the LUKS header parameters used when the disk is encrypted.
+	KeyFile           string                // KeyFile holds the key of a disk encrypted elsewhere, empty to have the server generate one.
+	Force             bool                  // Force updates an existing record instead of refusing it, its key is kept.
+}
+
+/*
+Creates a new record for a device. The device may be given by any of its IDs (e.g. "LABEL:data", see
+fs.SplitDeviceID), the record is saved under its canonical ID. Labels and paths can only be resolved on the computer
+that has the device. With a key file, the record keeps the key of a disk encrypted elsewhere instead of a new one.
+An existing record is refused, unless opts.Force is true, in which case its attributes are updated and its key is kept.
+*/
+func AddDevice(opts AddDeviceOptions) error {
+	sys.LockMem()
+	uuid := opts.DeviceID
+	if opts.MappedName == "" {
+		return errors.New("AddRecord: please specify -mappedName, the name of the device when it is unlocked")
+	} else if opts.MaxActive < 1 {
+		return fmt.Errorf("AddRecord: -maxActive must be at least 1, it is %d", opts.MaxActive)
+	}
+	if err := keydb.ValidateFileSystem(opts.FileSystem, opts.AutoEncryption); err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	allowedClients := make([]string, 0)
+	for _, entry := range strings.Split(opts.AllowedClients, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := keydb.ValidateAllowedClient(entry); err != nil {
+			return fmt.Errorf("AddRecord: %v", err)
+		}
+		allowedClients = append(allowedClients, entry)
+	}
+	var key []byte
+	if opts.KeyFile != "" {
+		if opts.AutoEncryption {
+			return errors.New("AddRecord: a disk whose key is imported by -keyFile is already encrypted, it cannot be encrypted automatically")
+		}
+		var err error
+		if key, err = routine.ReadKeyFile(opts.KeyFile); err != nil {
+			return fmt.Errorf("AddRecord: %v", err)
+		}
+	}
+	if err := opts.CryptOptions.Validate(); err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	tags, err := keydb.ParseTags(opts.Tags)
+	if err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	if err := keydb.ValidateFsckPolicy(opts.FsckPolicy); err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	if err := keydb.ValidateTangURL(opts.TangURL); err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	if err := keydb.ValidateOwner(opts.Owner); err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	unlockWindows, err := keydb.ParseUnlockWindows(opts.UnlockWindows)
+	if err != nil {
+		return fmt.Errorf("AddRecord: %v", err)
+	}
+	if opts.UmountAtWindowEnd && len(unlockWindows) == 0 {
+		return errors.New("AddRecord: umount at the end of unlock window requires an unlock window")
+	}
+	mountOptions := fs.ParseMountOptions(opts.MountOptions)
+	if !confirmMountOptions(opts.FileSystem, mountOptions) {
+		return fmt.Errorf("AddRecord: mount options \"%s\" are not accepted", opts.MountOptions)
+	}
+	var client *keyserv.CryptClient
+	if _, err = os.Stat(keyserv.DomainSocketFile); err == nil {
+		client, err = keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	} else {
+		client, err = OpenConnection()
+	}
+	if err != nil {
+		return fmt.Errorf("AddRecord: failed to create connection to cryptctl2 server - %v", err)
+	}
+	if _, canonicalID, err := fs.GetBlockDevices().ResolveDeviceID(uuid); err == nil {
+		uuid = canonicalID
+	} else if prefix, _ := fs.SplitDeviceID(uuid); prefix == fs.DeviceIDLabel || prefix == fs.DeviceIDPath {
+		return fmt.Errorf("AddRecord: %v", err)
+	} else {
+		// The device is not on this computer (e.g. the record is created on the key server itself)
+		uuid = keydb.CanonicalRecordID(uuid)
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	// Test the connection and password
+	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+		return fmt.Errorf("AddRecord: failed to authorize to cryptctl2 server - %v", err)
+	}
+
+	req := keyserv.CreateKeyReq{
+		PlainPassword:  password,
+		UUID:           uuid,
+		MappedName:     opts.MappedName,
+		MountPoint:     opts.MountPoint,
+		MountOptions:   mountOptions,
+		MaxActive:      opts.MaxActive,
+		AllowedClients: allowedClients,
+		AutoEncryption: opts.AutoEncryption,
+		FileSystem:     opts.FileSystem,
+		Group:          opts.Group,
+		GroupPriority:  opts.GroupPriority,
+		Tags:           tags,
+		Owner:          opts.Owner,
+		UnlockAfter:    keydb.ParseUnlockAfter(opts.UnlockAfter),
+		FsckPolicy:     opts.FsckPolicy,
+		TangURL:        opts.TangURL,
+		AliveCount:     4,
+		CryptOptions:   opts.CryptOptions,
+
+		UnlockWindows:     unlockWindows,
+		UmountAtWindowEnd: opts.UmountAtWindowEnd,
+
+		KeyContent:     key,
+		UpdateExisting: opts.Force,
+	}
+	if _, err := client.CreateKey(req); err != nil {
+		return fmt.Errorf("AddRecord: failed to add new record to cryptctl2 server - %v", err)
+	}
+	if opts.Force {
+		fmt.Printf("Record to %s was saved succesfully, the key of an existing record is kept\n", uuid)
+	} else {
+		fmt.Printf("Record to %s was created succesfully\n", uuid)
+	}
+	return nil
+}
+
+/*
+Sub-command: erase encryption headers for the encrypted disk, so that its content becomes irreversibly lost. A disk
+that has an owner is only erased if the administrator acknowledges to act on behalf of the owner. With keySlotOnly only
+the key slot managed by cryptctl2 is removed from the disk, with forgetKey only the key server's copy of the key is
+destroyed while the record is kept, and with both, the key slot is removed before the key is forgotten.
+*/
+func EraseKey(ownerAcknowledged, keySlotOnly, forgetKey bool) error {
+	sys.LockMem()
+	// Establish connection to key server
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	applyTLSOverrides(sysconf)
+	host := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
+	if host == "" {
+		return errors.New(MSG_E_ERASE_NO_CONF)
+	}
+	port := sysconf.GetInt(keyserv.CLIENT_CONF_PORT, 3737)
+	if port == 0 {
+		return errors.New(MSG_E_ERASE_NO_CONF)
+	}
+	caFile := sysconf.GetString(keyserv.CLIENT_CONF_CA, "")
+	client, password, err := ConnectToKeyServer(
+		caFile,
+		sysconf.GetString(keyserv.CLIENT_CONF_CERT, ""),
+		sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, ""),
+		host, port,
+		keyserv.TLSVerificationFromSysconfig(sysconf), keyserv.ConnectionSettingsFromSysconfig(sysconf))
+	if err != nil {
+		return err
+	}
+	// Ask for the UUID to wipe and proceed
+	uuid := sys.Input(true, "", MSG_ERASE_UUID)
+	// Each variant is confirmed in its own words, so that a softer erase is not mistaken for the full one
+	if keySlotOnly {
+		if sys.Input(true, "", MSG_ERASE_KEY_SLOT_AGAIN, uuid) != uuid {
+			return errors.New(MSG_E_ERASE_UUID_MISMATCH)
+		}
+	}
+	if forgetKey {
+		if !keySlotOnly && !sys.InputBool(false, MSG_ERASE_FORGET_NO_SLOT, uuid) {
+			return errors.New(MSG_E_CANCELLED)
+		}
+		if sys.Input(true, "", MSG_ERASE_FORGET_AGAIN, uuid) != uuid {
+			return errors.New(MSG_E_ERASE_UUID_MISMATCH)
+		}
+	}
+	switch {
+	case keySlotOnly:
+		return routine.RemoveKeySlot(os.Stdout, client, password, uuid, ownerAcknowledged, forgetKey)
+	case forgetKey:
+		return routine.ForgetKey(os.Stdout, client, password, uuid, ownerAcknowledged)
+	}
+	confirmUUID := sys.Input(true, "", MSG_ERASE_UUID_AGAIN, uuid)
+	if confirmUUID != uuid {
+		return errors.New(MSG_E_ERASE_UUID_MISMATCH)
+	}
+	if err := routine.EraseKey(os.Stdout, client, password, uuid, ownerAcknowledged); err != nil {
+		return err
+	}
+	return nil
+}
+
+// serverContact tracks the outcome of the most recent poll of the client daemon to key server.
+type serverContact struct {
+	mutex       sync.Mutex
+	reachable   bool
+	lastContact time.Time
+	lastErr     string
+}
+
+// Record the outcome of a request to key server.
+func (contact *serverContact) update(err error) {
+	contact.mutex.Lock()
+	defer contact.mutex.Unlock()
+	if err == nil {
+		contact.reachable, contact.lastContact, contact.lastErr = true, time.Now(), ""
+	} else {
+		contact.reachable, contact.lastErr = false, err.Error()
+	}
+}
+
+/*
+Start listening for local status queries on routine.CLIENT_STATUS_SOCKET, which only root may use, or also the group
+configured in sysconfig.
+*/
+func listenClientStatus(sysconf *sys.Sysconfig, client *keyserv.CryptClient, reporter *routine.AliveReporter, contact *serverContact) (*routine.StatusServer, error) {
+	gid := -1
+	if groupName := sysconf.GetString(routine.CLIENT_CONF_STATUS_GROUP, ""); groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return nil, fmt.Errorf("group \"%s\" has an unexpected ID \"%s\"", groupName, group.Gid)
+		}
+	}
+	return routine.ListenStatus(routine.CLIENT_STATUS_SOCKET, gid, func() routine.ClientStatus {
+		held, err := routine.ListHeldDisks(routine.ALIVE_STATE_DIR)
+		if err != nil {
+			log.Print(err)
+		}
+		progresses, err := routine.ListUnlockProgress(routine.UNLOCK_STATE_DIR)
+		if err != nil {
+			log.Print(err)
+		}
+		status := routine.ClientStatus{
+			Time:    time.Now(),
+			Server:  client.Address,
+			Devices: routine.CollectDeviceStatus(fs.GetBlockDevices(), held, progresses),
+		}
+		status.LastAliveReport, status.AliveReportError = reporter.LastReport()
+		contact.mutex.Lock()
+		status.ServerReachable, status.LastServerContact, status.ServerError = contact.reachable, contact.lastContact, contact.lastErr
+		contact.mutex.Unlock()
+		return status
+	})
+}
+
+/*
+Sub-command: ask the client daemon for the state of the encrypted devices on this computer and of its connection to
+key server, and print it in the output format (text or JSON).
+*/
+func ClientStatus(output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	status, err := routine.QueryClientStatus(routine.CLIENT_STATUS_SOCKET)
+	if err != nil {
+		return err
+	}
+	if output == OutputJSON {
+		return printJSON(status)
+	}
+	reachable := "reachable"
+	if !status.ServerReachable {
+		reachable = "unreachable"
+		if status.ServerError != "" {
+			reachable += " - " + status.ServerError
+		}
+	}
+	fmt.Printf("%-34s%s (%s)\n", "Key Server", status.Server, reachable)
+	fmt.Printf("%-34s%s\n", "Last Server Contact", formatStatusTime(status.LastServerContact))
+	fmt.Printf("%-34s%s\n", "Last Alive Report", formatStatusTime(status.LastAliveReport))
+	if status.AliveReportError != "" {
+		fmt.Printf("%-34s%s\n", "Alive Report Error", status.AliveReportError)
+	}
+	fmt.Printf("Total: %d encrypted devices\n", len(status.Devices))
+	fmt.Println("State      UUID                                 Mapper.Name          Mount.Point          Last.Error")
+	for _, dev := range status.Devices {
+		fmt.Printf("%-10s %-36s %-20s %-20s %s\n", dev.State, dev.UUID, dev.MapperName, dev.MountPoint, dev.LastError)
+	}
+	return nil
+}
+
+// Return the time in output format, or "never" if it is zero.
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(TIME_OUTPUT_FORMAT)
+}
+
+/*
+ClientDaemon runs the main routine of "client-daemon" sub-command.
+The routine primarily polls for pending commands and execute them.
+*/
+func ClientDaemon() error {
+	client, err := OpenConnection()
+	if err != nil {
+		return err
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	// Mount points of the disks this computer is entitled to are in place before the disks are unlocked
+	if devices, err := listEntitledDevices(client); err != nil {
+		log.Printf("Mount points are not prepared: %v", err)
+	} else if made := routine.PrepareMountPoints(os.Stderr, devices); made > 0 {
+		log.Printf("Made %d mount point directories for the disks this computer is allowed to unlock.", made)
+	}
+	reportInventory := sysconf.GetBool(keyserv.CLIENT_CONF_INVENTORY_ENABLE, false)
+	inventoryExclude := sysconf.GetStringArray(keyserv.CLIENT_CONF_INVENTORY_EXCLUDE, []string{})
+	var lastInventory time.Time
+	// Blank disks of the records that allow automatic encryption are encrypted as soon as they are found
+	autoEncryptInterval := time.Duration(sysconf.GetInt(routine.CLIENT_CONF_AUTO_ENCRYPT_SCAN, routine.AUTO_ENCRYPT_SCAN_INTERVAL_SEC)) * time.Second
+	autoEncryptFailed := make(map[string]bool)
+	var lastAutoEncryptScan time.Time
+	// Alive reports of the disks held by auto-unlock are sent together in one request
+	reporter := routine.NewAliveReporter(client, func(uuid string) {
+		log.Printf("Server has rejected the alive report of disk \"%s\", stop reporting for it.", uuid)
+	})
+	reporter.MaxBackoffSec = sysconf.GetInt(routine.CLIENT_CONF_ALIVE_MAX_BACKOFF, routine.REPORT_ALIVE_MAX_BACKOFF_SEC)
+	reporter.SealDir = routine.TPM2_SEALED_KEY_DIR
+	go reporter.Run(os.Stderr, routine.ALIVE_STATE_DIR, make(chan struct{}))
+	// Local status queries are answered without waiting for key server
+	contact := new(serverContact)
+	if statusSrv, err := listenClientStatus(sysconf, client, reporter, contact); err != nil {
+		log.Printf("Local status queries will not be answered: %v", err)
+	} else {
+		go statusSrv.Serve()
+	}
+	// A command delivered once more, e.g. replayed, is never carried out twice
+	executed, err := routine.ReadExecutedCommands(routine.EXECUTED_COMMANDS_FILE)
+	if err != nil {
+		log.Printf("Starting over with the record of executed commands: %v", err)
+	}
+	log.Printf("Going to poll for commands from server %s every 30 seconds.", strings.Join(client.Addresses, ", "))
+	for {
+		time.Sleep(30 * time.Second)
+
+		if reportInventory && time.Since(lastInventory) >= keyserv.InventoryReportIntervalSec*time.Second {
+			// Retry in the next interval regardless of the outcome, rather than flooding the server
+			lastInventory = time.Now()
+			ReportInventory(client, inventoryExclude)
+		}
+
+		if autoEncryptInterval > 0 && time.Since(lastAutoEncryptScan) >= autoEncryptInterval {
+			lastAutoEncryptScan = time.Now()
+			AutoEncryptBlankDisks(client, autoEncryptFailed)
+		}
+
+		devs := fs.GetBlockDevices()
 		uuids := make([]string, 0, len(devs))
 		for _, dev := range devs {
-			if dev.UUID != "" {
-				uuids = append(uuids, dev.UUID)
+			// Records may be kept under any of the stable IDs of the device
+			for _, id := range dev.DeviceIDs() {
+				if id != "" {
+					uuids = append(uuids, id)
+				}
 			}
 		}
 
 		resp, err := client.PollCommand(keyserv.PollCommandReq{UUIDs: uuids})
+		contact.update(err)
 		if err != nil {
 			log.Printf("Failed to poll for pending commands: %v", err)
 			continue
 		}
+		// Expiry is told by the server's clock, older servers do not tell their clock
+		now := resp.ServerTime
+		if now.IsZero() {
+			now = time.Now()
+		}
+		groupCmds := make(map[string]map[string]keydb.PendingCommand)
 		for uuid, cmds := range resp.Commands {
 			for _, cmd := range cmds {
-				if cmd.IsValid() {
+				if !cmd.IsValidAt(now) {
+					log.Printf("Ignoring expired command: %+v\n", cmd)
+				} else if executed.Has(cmd.ID) {
+					log.Printf("Ignoring command %s that has already been carried out: %+v\n", cmd.ID, cmd)
+				} else if cmd.Group != "" {
+					// Commands of a consistency group are executed together once all of them are collected
+					if _, found := groupCmds[cmd.Group]; !found {
+						groupCmds[cmd.Group] = make(map[string]keydb.PendingCommand)
+					}
+					groupCmds[cmd.Group][uuid] = cmd
+				} else if err := executed.Remember(cmd); err != nil {
+					log.Printf("Not going to execute command %+v: %v", cmd, err)
+					reportCommandResult(client, uuid, cmd, fmt.Sprintf("Not carried out because the command could not be recorded - %v", err), 0)
+				} else {
 					log.Printf("Going to execute command %+v", cmd)
 					ExecutePendingCommand(client, uuid, cmd)
-				} else {
-					log.Printf("Ignoring expired command: %+v\n", cmd)
 				}
 			}
 		}
+		for group, cmds := range groupCmds {
+			groupMembers := make([]keydb.PendingCommand, 0, len(cmds))
+			for _, cmd := range cmds {
+				groupMembers = append(groupMembers, cmd)
+			}
+			if err := executed.Remember(groupMembers...); err != nil {
+				log.Printf("Not going to execute command for consistency group %s: %v", group, err)
+				for uuid, cmd := range cmds {
+					reportCommandResult(client, uuid, cmd, fmt.Sprintf("Not carried out because the command could not be recorded - %v", err), 0)
+				}
+				continue
+			}
+			log.Printf("Going to execute command for consistency group %s on %d disks", group, len(cmds))
+			ExecuteGroupCommand(client, group, cmds)
+		}
 
 	}
 }
@@ -415,6 +1621,24 @@ UmountCryptDev un-mounts and closes the crypt block device associated with the b
 Returns human-readable result text.
 */
 func UmountCryptDev(uuid string) string {
+	return closeCryptDev(uuid, false)
+}
+
+/*
+LockCryptDev un-mounts the crypt block device associated with the block device specified in UUID if it is mounted,
+and closes it, so that the encryption key no longer remains in memory. Unlike umount, a disk that is unlocked but not
+mounted, or not unlocked at all, is not a failure. Returns human-readable result text.
+*/
+func LockCryptDev(uuid string) string {
+	// A locked disk must not be unlocked by its sealed key without asking key server first
+	if err := routine.RemoveSealedRecord(routine.TPM2_SEALED_KEY_DIR, uuid); err != nil {
+		return err.Error()
+	}
+	return closeCryptDev(uuid, true)
+}
+
+// Umount and close the crypt device of the disk, and stop reporting alive-messages. Returns human-readable result text.
+func closeCryptDev(uuid string, lock bool) string {
 	/*
 		First steps should umount and close the disk.
 		At very last, if no errors are encountered, stop reporting alive-messages.
@@ -424,53 +1648,350 @@ func UmountCryptDev(uuid string) string {
 	if !found {
 		return "The disk disappeared from system"
 	}
+	serviceName := AUTO_UNLOCK_DAEMON + uuid
 	cryptDev, found := devs.GetByCriteria("", "", "crypt", "", "", underlyingDev.Name, "")
-	if !found {
+	if !found && lock {
+		// The unlock daemon may still be waiting for the key, make sure it will not unlock the disk later.
+		if err := sys.SystemctlStop(serviceName); err != nil {
+			return fmt.Sprintf("failed to stop service %s - %v", serviceName, err)
+		}
+		return "Success"
+	} else if !found {
 		return "The disk is not unlocked to begin with"
 	}
-	if cryptDev.MountPoint == "" {
+	if cryptDev.MountPoint == "" && !lock {
 		return "The disk is not mounted to begin with"
 	}
-	time.Sleep(3 * time.Second)
-	log.Printf("Umount %s ...", cryptDev.MountPoint)
-	if err := fs.Umount(cryptDev.MountPoint); err != nil {
-		return fmt.Sprintf("Failed to umount encrypted device - %v", err)
+	if cryptDev.MountPoint != "" {
+		if result := umountCryptDev(cryptDev); result != "" {
+			return result
+		}
 	}
 	time.Sleep(3 * time.Second)
 	log.Printf("Closing down %s ...", cryptDev.Path)
 	if err := fs.CryptClose(cryptDev.Path); err != nil {
 		return fmt.Sprintf("Failed to close encrypted device - %v", err)
 	}
-	serviceName := AUTO_UNLOCK_DAEMON + uuid
-	if err := sys.SystemctlStop(AUTO_UNLOCK_DAEMON + uuid); err != nil {
+	if err := sys.SystemctlStop(serviceName); err != nil {
 		return fmt.Sprintf("failed to stop service %s - %v", serviceName, err)
 	}
 	return "Success"
 }
 
+// Umount bind-mounts and then the file system of the crypt device. Returns human-readable failure text, or empty string on success.
+func umountCryptDev(cryptDev fs.BlockDevice) string {
+	time.Sleep(3 * time.Second)
+	// Bind-mounts were made after the primary mount, unwind them in reverse order.
+	mounts := fs.ParseMtab().GetManyByCriteria(cryptDev.Path, "", "")
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == cryptDev.MountPoint {
+			continue
+		}
+		log.Printf("Umount bind-mount %s ...", mounts[i].MountPoint)
+		if err := fs.Umount(mounts[i].MountPoint); err != nil {
+			return fmt.Sprintf("Failed to umount bind-mount of encrypted device - %v", err)
+		}
+	}
+	log.Printf("Umount %s ...", cryptDev.MountPoint)
+	if err := fs.Umount(cryptDev.MountPoint); err != nil {
+		return fmt.Sprintf("Failed to umount encrypted device - %v", err)
+	}
+	return ""
+}
+
 /*
-ExecutePendingCommand is called by client daemon to execute a freshly polled pending command.
-Execution result is logged into
+EraseCryptDev locks the block device specified in UUID and then erases its encryption header, the data on the disk
+can no longer be decrypted afterwards. The command must have been confirmed by the administrator.
+Returns human-readable result text.
 */
-func ExecutePendingCommand(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) {
-	result := "Success"
-	if cmd.Content == PendingCommandMount {
+func EraseCryptDev(uuid string, cmd keydb.PendingCommand) string {
+	if !cmd.Confirmed {
+		return "Refused to erase the disk because the administrator did not confirm the command"
+	}
+	underlyingDev, found := fs.GetBlockDevices().GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return "The disk disappeared from system"
+	}
+	if result := LockCryptDev(uuid); result != "Success" {
+		return result
+	}
+	log.Printf("Erasing encryption header of %s ...", underlyingDev.Path)
+	if err := fs.CryptErase(underlyingDev.Path); err != nil {
+		return fmt.Sprintf("Failed to erase encrypted device - %v", err)
+	}
+	return "Success"
+}
+
+/*
+FstrimCryptDev discards unused blocks of the file system mounted from the crypt device of the block device specified
+in UUID, which returns the space to thin-provisioned storage. Returns human-readable result text.
+*/
+func FstrimCryptDev(uuid string) string {
+	devs := fs.GetBlockDevices()
+	underlyingDev, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return "The disk disappeared from system"
+	}
+	cryptDev, found := devs.GetByCriteria("", "", "crypt", "", "", underlyingDev.Name, "")
+	if !found || cryptDev.MountPoint == "" {
+		return "The disk is not mounted to begin with"
+	}
+	summary, err := fs.Fstrim(cryptDev.MountPoint)
+	if err != nil {
+		return err.Error()
+	}
+	log.Printf("FstrimCryptDev: %s", summary)
+	return "Success"
+}
+
+/*
+RotateCryptDev carries out the key rotation that the key server has started for the block device specified in UUID,
+using auto-unlock authorisation. The encryption header receives the new key before the old key slot is removed, and
+computers sharing the disk may each carry out the rotation without harm. Returns human-readable result text.
+*/
+func RotateCryptDev(client *keyserv.CryptClient, uuid string) string {
+	if _, found := fs.GetBlockDevices().GetByCriteria(uuid, "", "", "", "", "", ""); !found {
+		return "The disk disappeared from system"
+	}
+	if err := routine.ApplyKeyRotation(log.Writer(), client, "", uuid, tpm2UnlockPCRs()); err != nil {
+		return err.Error()
+	}
+	return "Success"
+}
+
+/*
+RemountCryptDevReadOnly remounts the file system of the crypt device of the block device specified in UUID read-only,
+e.g. for a maintenance window, it stays mounted and unlocked. Returns human-readable result text.
+*/
+func RemountCryptDevReadOnly(uuid string) string {
+	devs := fs.GetBlockDevices()
+	underlyingDev, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return "The disk disappeared from system"
+	}
+	cryptDev, found := devs.GetByCriteria("", "", "crypt", "", "", underlyingDev.Name, "")
+	if !found || cryptDev.MountPoint == "" {
+		return "The disk is not mounted to begin with"
+	}
+	if err := fs.Remount(cryptDev.MountPoint, []string{"ro"}); err != nil {
+		return err.Error()
+	}
+	return "Success"
+}
+
+/*
+PurgeSealedCryptDev removes the TPM-sealed copy of the record of the block device specified in UUID, after which the
+disk is only unlocked by the key server. Returns human-readable result text.
+*/
+func PurgeSealedCryptDev(uuid string) string {
+	if err := routine.RemoveSealedRecord(routine.TPM2_SEALED_KEY_DIR, uuid); err != nil {
+		return err.Error()
+	}
+	return "Success"
+}
+
+/*
+RefreshStatus sends an alive message for the disk specified in UUID if it is unlocked on this computer, and reports
+the disk inventory if inventory reports are enabled, so that server learns of the computer's status right away.
+Returns human-readable result text.
+*/
+func RefreshStatus(client *keyserv.CryptClient, uuid string) string {
+	devs := fs.GetBlockDevices()
+	underlyingDev, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return "The disk disappeared from system"
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	if _, found := devs.GetByCriteria("", "", "crypt", "", "", underlyingDev.Name, ""); found {
+		rejected, err := client.ReportAlive(keyserv.ReportAliveReq{Hostname: hostname, UUIDs: []string{uuid}})
+		if err != nil {
+			return fmt.Sprintf("Failed to send alive message - %v", err)
+		} else if len(rejected) > 0 {
+			return "Server has rejected the alive message"
+		}
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return fmt.Sprintf("Failed to read configuration file - %v", err)
+	}
+	if sysconf.GetBool(keyserv.CLIENT_CONF_INVENTORY_ENABLE, false) {
+		if err := ReportInventory(client, sysconf.GetStringArray(keyserv.CLIENT_CONF_INVENTORY_EXCLUDE, []string{})); err != nil {
+			return fmt.Sprintf("Failed to report disk inventory - %v", err)
+		}
+	}
+	return "Success"
+}
+
+/*
+MountCryptDev starts the background service that unlocks the block device specified in UUID, and waits for the
+unlocked file system to be mounted. Returns human-readable result text.
+*/
+func MountCryptDev(uuid string) string {
+	devs := fs.GetBlockDevices()
+	underlyingDev, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return "The disk disappeared from system"
+	}
+	if err := sys.SystemctlStart(AUTO_UNLOCK_DAEMON + uuid); err != nil {
+		return fmt.Sprintf("Failed to start background daemon that reports disk status - %v", err)
+	}
+	for i := 0; i < GroupMountTimeoutSec; i++ {
+		time.Sleep(1 * time.Second)
+		devs = fs.GetBlockDevices()
+		if cryptDev, found := devs.GetByCriteria("", "", "crypt", "", "", underlyingDev.Name, ""); found && cryptDev.MountPoint != "" {
+			return "Success"
+		}
+	}
+	return fmt.Sprintf("The disk did not get mounted within %d seconds", GroupMountTimeoutSec)
+}
+
+/*
+ExecuteGroupCommand is called by client daemon to execute pending commands issued to all members of a consistency group.
+Nothing is done unless this computer received the command for every member of the group.
+Members are mounted in ascending group priority, should any of them fail, the members mounted so far are umounted again
+in reverse order so that the group never remains partially writable. Members are umounted and locked in the reverse
+order, other commands are carried out in mount order, and a group is never erased.
+Execution result of each member is reported to the server individually.
+*/
+func ExecuteGroupCommand(client *keyserv.CryptClient, group string, cmds map[string]keydb.PendingCommand) {
+	// All commands of a group were issued together, any of them carries the complete member list and content.
+	var groupCmd keydb.PendingCommand
+	for _, cmd := range cmds {
+		groupCmd = cmd
+		break
+	}
+	members := groupCmd.GroupMembers
+	results := make(map[string]string)
+	missing := make([]string, 0, 0)
+	start := time.Now()
+	for _, uuid := range members {
+		if _, found := cmds[uuid]; !found {
+			missing = append(missing, uuid)
+		}
+	}
+	if len(missing) > 0 {
+		for uuid := range cmds {
+			results[uuid] = fmt.Sprintf("Not carried out because group members %s did not receive the command on this computer", strings.Join(missing, " "))
+		}
+	} else if groupCmd.Content == PendingCommandMount {
+		mounted := make([]string, 0, len(members))
+		failed := ""
+		for _, uuid := range members {
+			if failed != "" {
+				results[uuid] = fmt.Sprintf("Not carried out because group member %s failed to mount", failed)
+				continue
+			}
+			if result := MountCryptDev(uuid); result != "Success" {
+				// Stop the unlock daemon from retrying on its own and eventually mounting the disk
+				if err := sys.SystemctlStop(AUTO_UNLOCK_DAEMON + uuid); err != nil {
+					log.Printf("ExecuteGroupCommand: failed to stop service %s - %v", AUTO_UNLOCK_DAEMON+uuid, err)
+				}
+				results[uuid] = result
+				failed = uuid
+				continue
+			}
+			results[uuid] = "Success"
+			mounted = append(mounted, uuid)
+		}
+		if failed != "" {
+			for i := len(mounted) - 1; i >= 0; i-- {
+				uuid := mounted[i]
+				results[uuid] = fmt.Sprintf("Rolled back because group member %s failed to mount - %s", failed, UmountCryptDev(uuid))
+			}
+		}
+	} else if groupCmd.Content == PendingCommandUmount || groupCmd.Content == PendingCommandLock {
+		// Umount as many members as possible even if some of them fail
+		for i := len(members) - 1; i >= 0; i-- {
+			results[members[i]] = executeCommand(client, members[i], cmds[members[i]])
+		}
+	} else if groupCmd.Content == PendingCommandErase {
+		for uuid := range cmds {
+			results[uuid] = "Refused to erase the disk because the command was sent to a consistency group"
+		}
+	} else if groupCmd.Content == PendingCommandRotate {
+		for uuid := range cmds {
+			results[uuid] = "Refused to rotate the key because the command was sent to a consistency group"
+		}
+	} else {
+		for _, uuid := range members {
+			results[uuid] = executeCommand(client, uuid, cmds[uuid])
+		}
+	}
+	for uuid, result := range results {
+		log.Printf("ExecuteGroupCommand: result of group %s member %s is %s", group, uuid, result)
+		if err := reportCommandResult(client, uuid, cmds[uuid], result, time.Since(start)); err != nil {
+			log.Printf("ExecuteGroupCommand: failed to save command result of %s - %v", uuid, err)
+		}
+	}
+}
+
+/*
+Tell server the outcome of a pending command and how long it took, result is "Success" if the command was carried out
+successfully, or otherwise the reason of failure. A server that does not yet understand the outcome only receives the
+result text.
+*/
+func reportCommandResult(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand, result string, duration time.Duration) error {
+	err := client.ReportCommandResult(keyserv.ReportCommandResultReq{
+		UUID:           uuid,
+		CommandID:      cmd.ID,
+		ValidFrom:      cmd.ValidFrom,
+		CommandContent: cmd.Content,
+		Succeeded:      result == "Success",
+		Message:        result,
+		Duration:       duration,
+	})
+	if err != nil && strings.Contains(err.Error(), "can't find method") {
+		return client.SaveCommandResult(keyserv.SaveCommandResultReq{
+			UUID:           uuid,
+			CommandContent: cmd.Content,
+			Result:         result,
+		})
+	}
+	return err
+}
+
+// Carry out the pending command on the disk, return human-readable result text that is "Success" on success.
+func executeCommand(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) string {
+	switch cmd.Content {
+	case PendingCommandMount:
 		// Mounting an already mounted disk will result in a failure and no other negative consequence
 		if err := sys.SystemctlStart(AUTO_UNLOCK_DAEMON + uuid); err != nil {
-			result = fmt.Sprintf("Failed to start background daemon that reports disk status - %v", err)
+			return fmt.Sprintf("Failed to start background daemon that reports disk status - %v", err)
 		}
-	} else if cmd.Content == PendingCommandUmount {
+		return "Success"
+	case PendingCommandUmount:
 		// Similar to mount, umount a disk that is not mounted is a failure and results in no other negative consequence.
-		result = UmountCryptDev(uuid)
-	} else {
-		result = fmt.Sprintf("Client does not understand command \"%v\"", cmd.Content)
+		return UmountCryptDev(uuid)
+	case PendingCommandLock:
+		return LockCryptDev(uuid)
+	case PendingCommandErase:
+		return EraseCryptDev(uuid, cmd)
+	case PendingCommandRefreshStatus:
+		return RefreshStatus(client, uuid)
+	case PendingCommandFstrim:
+		return FstrimCryptDev(uuid)
+	case PendingCommandInventory:
+		return ReportCryptInventory(client)
+	case PendingCommandRotate:
+		return RotateCryptDev(client, uuid)
+	case PendingCommandRemountRO:
+		return RemountCryptDevReadOnly(uuid)
+	case PendingCommandPurgeSealed:
+		return PurgeSealedCryptDev(uuid)
+	default:
+		return fmt.Sprintf("Client does not understand command \"%v\"", cmd.Content)
 	}
+}
+
+/*
+ExecutePendingCommand is called by client daemon to execute a freshly polled pending command.
+Execution result is logged into
+*/
+func ExecutePendingCommand(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) {
+	start := time.Now()
+	result := executeCommand(client, uuid, cmd)
 	log.Printf("ExecutePendingCommand: result is %s", result)
-	if err := client.SaveCommandResult(keyserv.SaveCommandResultReq{
-		UUID:           uuid,
-		CommandContent: cmd.Content,
-		Result:         result,
-	}); err != nil {
+	if err := reportCommandResult(client, uuid, cmd, result, time.Since(start)); err != nil {
 		log.Printf("ExecutePendingCommand: failed to save command result - %v", err)
 	}
 	return
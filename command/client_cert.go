@@ -0,0 +1,88 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keyserv"
+	"cryptctl2/routine"
+	"cryptctl2/sys"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Return the certificate directory of the CA generated by init-server.
+func serverCertDir() (string, error) {
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s - %v", SERVER_CONFIG_PATH, err)
+	}
+	return sysconf.GetString(keyserv.SRV_CONF_CERT_DIR, "/var/lib/cryptctl2/certs"), nil
+}
+
+/*
+Server - revoke the client certificate issued for the DNS name, or the certificate of the serial number. The running
+key server turns the certificate away from its next connection on, as long as it validates client certificates and
+TLS_CRL_PEM points to the revocation list of the certificate directory.
+*/
+func RevokeClientCertificate(dnsName, serial string) error {
+	sys.LockMem()
+	certDir, err := serverCertDir()
+	if err != nil {
+		return err
+	}
+	if err := verifyServerPassword("RevokeClientCertificate", ""); err != nil {
+		return err
+	}
+	revocation, err := routine.RevokeCertificate(certDir, dnsName, serial)
+	if err != nil {
+		auditAdminAction("RevokeClientCertificate", "", keyserv.AuditResultFailed, err.Error())
+		return err
+	}
+	auditAdminAction("RevokeClientCertificate", "", keyserv.AuditResultGranted, fmt.Sprintf("serial %s (%s)", revocation.Serial, revocation.CommonName))
+	fmt.Printf("Certificate of serial number %s (%s) has been revoked, the revocation list is %s.\n",
+		revocation.Serial, revocation.CommonName, path.Join(certDir, routine.CRLFileName))
+	if sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true); err == nil {
+		if !sysconf.GetBool(keyserv.SRV_CONF_TLS_VALIDATE_CLIENT, false) || sysconf.GetString(keyserv.SRV_CONF_TLS_CRL, "") == "" {
+			fmt.Printf("WARNING: the key server only turns away revoked certificates with %s enabled and %s set.\n",
+				keyserv.SRV_CONF_TLS_VALIDATE_CLIENT, keyserv.SRV_CONF_TLS_CRL)
+		}
+	}
+	return nil
+}
+
+// Server - print the certificates issued by the CA generated by init-server, along with their revocation status.
+func ListClientCertificates(output string) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	certDir, err := serverCertDir()
+	if err != nil {
+		return err
+	}
+	certs, err := routine.ListCertificates(certDir)
+	if err != nil {
+		return err
+	}
+	if output == OutputJSON {
+		for i := range certs {
+			if certs[i].DNSNames == nil {
+				certs[i].DNSNames = []string{}
+			}
+		}
+		return printJSON(certs)
+	}
+	fmt.Printf("Total: %d certificates in %s (date and time are in zone %s)\n", len(certs), certDir, time.Now().Format("MST"))
+	fmt.Println("Serial     Valid Until         Revoked On          Common Name          DNS Names")
+	for _, cert := range certs {
+		revokedOn := "-"
+		if cert.Revoked {
+			revokedOn = time.Unix(cert.RevokedAt, 0).Format(TIME_OUTPUT_FORMAT)
+		}
+		fmt.Printf("%-10s %-19s %-19s %-20s %s\n", cert.Serial, time.Unix(cert.NotAfter, 0).Format(TIME_OUTPUT_FORMAT),
+			revokedOn, cert.CommonName, strings.Join(cert.DNSNames, ","))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Split comma-separated allowed client entries, leaving out empty ones.
+func splitAllowedClients(members string) []string {
+	entries := make([]string, 0, 8)
+	for _, entry := range strings.Split(members, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Save the client group, audit the change, and let the running key server pick it up.
+func saveClientGroup(db *keydb.DB, group keydb.ClientGroup, event string) error {
+	if err := db.SaveClientGroup(group); err != nil {
+		auditAdminAction(event, "", keyserv.AuditResultFailed, fmt.Sprintf("%s: %v", group.Name, err))
+		return err
+	}
+	auditAdminAction(event, "", keyserv.AuditResultGranted, fmt.Sprintf("%s: %s", group.Name, strings.Join(group.Members, " ")))
+	return reloadKeyServer()
+}
+
+/*
+Server - create a client group of the comma-separated allowed client entries. Records refer to the group by the allowed
+client entry "@name".
+*/
+func CreateClientGroup(name, members string) error {
+	sys.LockMem()
+	if name == "" {
+		return errors.New("Please specify the client group name in -clientGroup parameter")
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	if _, found := db.ClientGroups[name]; found {
+		return fmt.Errorf("Client group \"%s\" already exists, use edit-group to change it", name)
+	}
+	return saveClientGroup(db, keydb.ClientGroup{Name: name, Members: splitAllowedClients(members)}, "CreateClientGroup")
+}
+
+/*
+Server - replace the members of a client group with the comma-separated allowed client entries. If no entries are
+given, they are asked for interactively. All records referring to the group are affected right away.
+*/
+func EditClientGroup(name, members string) error {
+	sys.LockMem()
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	group, found := db.ClientGroups[name]
+	if !found {
+		return fmt.Errorf("Client group \"%s\" does not exist", name)
+	}
+	if members == "" {
+		current := strings.Join(group.Members, ",")
+		if members = sys.Input(false, current, "Comma-separated members (DNS names, IPs, patterns, subnets, @groups)"); members == "" {
+			members = current
+		}
+	}
+	group.Members = splitAllowedClients(members)
+	return saveClientGroup(db, group, "EditClientGroup")
+}
+
+/*
+Server - delete a client group. A group still referred to by records or other client groups is only deleted with force,
+which removes the references too. A group that is the only allowed client of a record is never deleted.
+*/
+func DeleteClientGroup(name string, force bool) error {
+	sys.LockMem()
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	if refUUIDs, refGroups := db.ClientGroupReferences(name); !force && (len(refUUIDs) > 0 || len(refGroups) > 0) {
+		return fmt.Errorf("Client group \"%s\" is still referred to by %d records (%s) and %d client groups (%s), use -force to remove the references too",
+			name, len(refUUIDs), strings.Join(refUUIDs, " "), len(refGroups), strings.Join(refGroups, " "))
+	}
+	uuids, err := db.DeleteClientGroup(name, force)
+	if err != nil {
+		auditAdminAction("DeleteClientGroup", "", keyserv.AuditResultFailed, fmt.Sprintf("%s: %v", name, err))
+		return err
+	}
+	for _, uuid := range uuids {
+		auditAdminAction("DeleteClientGroup", uuid, keyserv.AuditResultGranted, fmt.Sprintf("removed reference to %s%s", keydb.ClientGroupPrefix, name))
+	}
+	auditAdminAction("DeleteClientGroup", "", keyserv.AuditResultGranted, name)
+	if len(uuids) > 0 {
+		fmt.Printf("Removed the reference from %d records: %s\n", len(uuids), strings.Join(uuids, " "))
+	}
+	return reloadKeyServer()
+}
+
+// ClientGroupInfo is a client group as presented by list-groups in JSON.
+type ClientGroupInfo struct {
+	keydb.ClientGroup
+	Records []string `json:"records"` // Records are the UUIDs of records that refer to the group directly.
+}
+
+// Server - print the client groups along with their members and the records that refer to them.
+func ListClientGroups(output string) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	groups := db.ListClientGroups()
+	infos := make([]ClientGroupInfo, 0, len(groups))
+	for _, group := range groups {
+		uuids, _ := db.ClientGroupReferences(group.Name)
+		infos = append(infos, ClientGroupInfo{ClientGroup: group, Records: uuids})
+	}
+	if output == OutputJSON {
+		return printJSON(infos)
+	}
+	fmt.Printf("Total: %d client groups\n", len(infos))
+	for _, info := range infos {
+		fmt.Printf("%-34s%s\n", keydb.ClientGroupPrefix+info.Name, strings.Join(info.Members, " "))
+		fmt.Printf("%-34s%d records %s\n", "", len(info.Records), strings.Join(info.Records, " "))
+	}
+	return nil
+}
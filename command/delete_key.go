@@ -0,0 +1,104 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+DeleteKey is a server routine that removes the key record of a disk that is gone for good, e.g. decommissioned or
+belonging to a computer that no longer exists, without touching the disk itself. The record is removed by the running
+key server if there is one, otherwise from the key database directory, and the key is destroyed on the external KMIP
+server if the key is kept there. A record still in use by computers that report alive is only deleted with force,
+which also skips the confirmation.
+*/
+func DeleteKey(uuid string, force, ownerAcknowledged bool) error {
+	sys.LockMem()
+	if err := keydb.ValidateDeviceID(uuid); err != nil {
+		return err
+	}
+	db, err := OpenKeyDB(uuid)
+	if err != nil {
+		return err
+	}
+	rec, found := db.GetByUUID(uuid)
+	if !found {
+		return db.NotFoundError(uuid, nil)
+	}
+	if err := verifyServerPassword("DeleteKey", uuid); err != nil {
+		return err
+	}
+	if err := confirmOwner(rec, ownerAcknowledged); err != nil {
+		auditAdminAction("DeleteKey", uuid, keyserv.AuditResultRejected, "owner did not acknowledge")
+		return err
+	}
+	fmt.Printf("%-34s%s\n", "UUID", rec.UUID)
+	fmt.Printf("%-34s%s\n", "Mount Point", rec.MountPoint)
+	if rec.LastRetrieval.Timestamp == 0 {
+		fmt.Printf("%-34s%s\n", "Last Retrieved By", "(never retrieved)")
+	} else {
+		fmt.Printf("%-34s%s\n", "Last Retrieved By", rec.LastRetrieval.DescribeHost())
+		fmt.Printf("%-34s%s\n", "Last Retrieved On", time.Unix(rec.LastRetrieval.Timestamp, 0).Format(TIME_OUTPUT_FORMAT))
+	}
+	rec.RemoveDeadHosts()
+	if aliveHosts := rec.ListAliveHosts(); len(aliveHosts) > 0 {
+		fmt.Printf("%d computers are still using the key:\n", len(aliveHosts))
+		for _, aliveHost := range aliveHosts {
+			fmt.Printf("- %s (%s), last alive on %s\n", aliveHost.IP, aliveHost.Hostname, time.Unix(aliveHost.LastAlive, 0).Format(TIME_OUTPUT_FORMAT))
+		}
+		if !force {
+			auditAdminAction("DeleteKey", uuid, keyserv.AuditResultRejected, "the key is still in use")
+			return fmt.Errorf("The key of %s is still in use, umount the disk on those computers first or add -force to delete the record regardless", uuid)
+		}
+	}
+	if !force && !sys.InputBool(false, "Delete the key record of %s? The key cannot be recovered afterwards", uuid) {
+		return errors.New("The key record is not deleted.")
+	}
+	if daemon, err := getRecordDaemon(); err != nil {
+		return err
+	} else if daemon != nil {
+		// Key server erases the record from memory and disk, and destroys the key on KMIP server
+		hostname, _ := sys.GetHostnameAndIP()
+		if err := daemon.client.EraseKey(keyserv.EraseKeyReq{PlainPassword: daemon.password, Hostname: hostname, UUID: uuid, OwnerAcknowledged: ownerAcknowledged}); err != nil {
+			return err
+		}
+		fmt.Printf("The key record of %s has been deleted.\n", uuid)
+		return nil
+	}
+	kmipErr := destroyExternalKMIPKey(rec)
+	if err := db.Erase(uuid); err != nil {
+		auditAdminAction("DeleteKey", uuid, keyserv.AuditResultFailed, err.Error())
+		return err
+	}
+	if kmipErr != nil {
+		auditAdminAction("DeleteKey", uuid, keyserv.AuditResultGranted, "KMIP did not erase the key - "+kmipErr.Error())
+		return fmt.Errorf("The key record of %s has been deleted, but KMIP server did not destroy the key - %v", uuid, kmipErr)
+	}
+	auditAdminAction("DeleteKey", uuid, keyserv.AuditResultGranted, "")
+	fmt.Printf("The key record of %s has been deleted.\n", uuid)
+	return nil
+}
+
+// Destroy the key of the record on the external KMIP server, if the server is configured with one and keeps the key there.
+func destroyExternalKMIPKey(rec keydb.Record) error {
+	if len(rec.Key) > 0 || rec.IsKeyForgotten() {
+		return nil
+	}
+	_, srvConf, _, err := readServerConfig()
+	if err != nil {
+		return err
+	} else if len(srvConf.KMIPAddresses) == 0 {
+		return nil
+	}
+	client, err := keyserv.NewExternalKMIPClient(srvConf)
+	if err != nil {
+		return err
+	}
+	return client.DestroyKey(rec.ID)
+}
@@ -0,0 +1,85 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keyserv"
+	"cryptctl2/routine"
+	"cryptctl2/sys"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DoctorReport is the outcome of the doctor action, each role is left out if it is not configured on this computer.
+type DoctorReport struct {
+	Server []keyserv.DoctorFinding `json:"server,omitempty"`
+	Client []keyserv.DoctorFinding `json:"client,omitempty"`
+}
+
+// Run the checks of key server configuration and key database.
+func diagnoseServer() []keyserv.DoctorFinding {
+	_, srvConf, mailer, err := readServerConfig()
+	if err != nil {
+		return []keyserv.DoctorFinding{keyserv.NewDoctorFinding("server configuration", keyserv.DoctorFail, err.Error(),
+			"correct the setting in "+SERVER_CONFIG_PATH)}
+	}
+	if srvConf.KeyDBMasterKeySource != "" {
+		if srvConf.KeyDBMasterKey, err = loadKeyDBMasterKey(srvConf); err != nil {
+			return []keyserv.DoctorFinding{keyserv.NewDoctorFinding("key database master key", keyserv.DoctorFail, err.Error(),
+				"check the key database master key settings in "+SERVER_CONFIG_PATH)}
+		}
+	}
+	return keyserv.DiagnoseServer(srvConf, mailer, time.Now())
+}
+
+// Print the findings of a role as text.
+func printDoctorFindings(role string, findings []keyserv.DoctorFinding) {
+	fmt.Printf("%s:\n", role)
+	for _, finding := range findings {
+		fmt.Printf("  %-6s%-26s%s\n", finding.Result, finding.Check, finding.Detail)
+		if finding.Hint != "" {
+			fmt.Printf("  %-6s%-26s%s\n", "", "", "hint: "+finding.Hint)
+		}
+	}
+	fmt.Println()
+}
+
+/*
+Server and client - check the configuration, certificates, key database, programs, key server connection, and
+encrypted devices of the roles configured on this computer, and print the findings along with hints of remedy. An
+error is returned if any check fails.
+*/
+func Doctor(output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	sys.LockMem()
+	var report DoctorReport
+	if srvSysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false); err == nil && srvSysconf.GetString(keyserv.SRV_CONF_KEYDB_DIR, "") != "" {
+		report.Server = diagnoseServer()
+	}
+	if clientSysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false); err == nil && clientSysconf.GetString(keyserv.CLIENT_CONF_HOST, "") != "" {
+		applyTLSOverrides(clientSysconf)
+		report.Client = routine.DiagnoseClient(clientSysconf)
+	}
+	if report.Server == nil && report.Client == nil {
+		return errors.New("Neither key server nor client is configured on this computer, run init-server or register-client first")
+	}
+	if output == OutputJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		if report.Server != nil {
+			printDoctorFindings("Key server", report.Server)
+		}
+		if report.Client != nil {
+			printDoctorFindings("Client", report.Client)
+		}
+	}
+	if keyserv.DoctorFailed(report.Server) || keyserv.DoctorFailed(report.Client) {
+		return errors.New("Some of the checks failed, see the hints above")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RecordVersionInfo is a version of key record as presented by show-key -history in JSON.
+type RecordVersionInfo struct {
+	Number    int       `json:"number"`               // Number counts up from 1 with each version of the record.
+	Time      time.Time `json:"time"`                 // Time is the moment the version was saved.
+	KeyDigest string    `json:"key_sha256,omitempty"` // KeyDigest is the hex SHA-256 digest of key content.
+	Changes   []string  `json:"changes"`              // Changes are the record details changed since the previous version kept.
+}
+
+/*
+Print the versions kept of the record with the details changed from one version to the next, followed by the key
+retrievals kept on the record, the most recent first. In JSON only the versions are printed, the retrievals are part of
+show-key output.
+*/
+func showKeyHistory(uuid, output string) error {
+	db, err := OpenKeyDB(uuid)
+	if err != nil {
+		return err
+	}
+	rec, found := db.GetByUUID(uuid)
+	if !found {
+		return db.NotFoundError(uuid, nil)
+	}
+	versions, err := db.ListVersions(uuid)
+	if err != nil {
+		return err
+	}
+	infos := make([]RecordVersionInfo, 0, len(versions))
+	for i, ver := range versions {
+		info := RecordVersionInfo{Number: ver.Number, Time: ver.Time, KeyDigest: hex.EncodeToString(ver.KeyDigest), Changes: []string{}}
+		if i > 0 {
+			info.Changes = ver.Changes(versions[i-1])
+		}
+		infos = append(infos, info)
+	}
+	if output == OutputJSON {
+		return printJSON(infos)
+	}
+	if len(infos) == 0 {
+		fmt.Println("There are no versions of the record.")
+	} else {
+		fmt.Printf("%-8s %-19s %s\n", "Version", "Saved On", "Changes")
+		for i, info := range infos {
+			changes := strings.Join(info.Changes, " ")
+			if i == 0 {
+				changes = "(oldest version kept)"
+			} else if changes == "" {
+				changes = "(none)"
+			}
+			fmt.Printf("%-8d %-19s %s\n", info.Number, info.Time.Format(TIME_OUTPUT_FORMAT), changes)
+		}
+	}
+	fmt.Println()
+	if len(rec.Retrievals) == 0 {
+		fmt.Println("There are no key retrievals kept on the record.")
+		return nil
+	}
+	fmt.Printf("%-19s %s\n", "Retrieved On", "Retrieval")
+	for _, ret := range rec.Retrievals {
+		fmt.Printf("%-19s %s\n", time.Unix(ret.Time, 0).Format(TIME_OUTPUT_FORMAT), ret)
+	}
+	return nil
+}
+
+/*
+Server - bring back the record details of a version shown by show-key -history. The key content remains as it is now,
+and the revert itself becomes a new version of the record.
+*/
+func RevertKey(uuid string, number int) error {
+	sys.LockMem()
+	db, err := OpenKeyDB(uuid)
+	if err != nil {
+		return err
+	}
+	current, found := db.GetByUUID(uuid)
+	if !found {
+		return db.NotFoundError(uuid, nil)
+	}
+	versions, err := db.ListVersions(uuid)
+	if err != nil {
+		return err
+	}
+	var ver *keydb.RecordVersion
+	for i := range versions {
+		if versions[i].Number == number {
+			ver = &versions[i]
+		}
+	}
+	if ver == nil {
+		return fmt.Errorf("Version %d of record %s is not kept, see show-key -history for the versions", number, uuid)
+	}
+	latest := versions[len(versions)-1]
+	changes := ver.Changes(latest)
+	fmt.Printf("%-34s%s\n", "Version saved on:", ver.Time.Format(TIME_OUTPUT_FORMAT))
+	fmt.Printf("%-34s%s\n", "Details to revert:", strings.Join(changes, " "))
+	if digest := sha256.Sum256(current.Key); len(current.Key) > 0 && !bytes.Equal(ver.KeyDigest, digest[:]) {
+		fmt.Println("The encryption key has changed since the version was saved, the current key is kept.")
+	}
+	if !sys.InputBool(false, "Revert record %s to version %d?", uuid, number) {
+		return errors.New("Revert is cancelled")
+	}
+	if _, err := db.RevertRecord(uuid, number); err != nil {
+		auditAdminAction("RevertKey", uuid, keyserv.AuditResultFailed, err.Error())
+		return err
+	}
+	auditAdminAction("RevertKey", uuid, keyserv.AuditResultGranted, fmt.Sprintf("version %d", number))
+	fmt.Println("Record has been reverted successfully.")
+	return reloadKeyServer()
+}
@@ -0,0 +1,47 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/sys"
+	"fmt"
+	"os"
+)
+
+var passwordFile string // passwordFile is given by SetPasswordFile
+
+/*
+SetPasswordFile makes the actions take the key server password from the first line of the file instead of asking for
+it, so that they can be scripted.
+*/
+func SetPasswordFile(file string) {
+	passwordFile = file
+}
+
+/*
+Return the key server password from the password file, or from environment variable CRYPTCTL2_ACCESS_PASSWORD, or ask
+for it on the terminal. If standard input is not a terminal and neither is given, a mandatory password is an
+sys.InputError that tells how to give it, an optional one is empty.
+*/
+func inputServerPassword(mandatory bool, format string, values ...interface{}) string {
+	if passwordFile != "" {
+		pwd, err := readPasswordFile(passwordFile)
+		if err != nil {
+			panic(sys.InputError{Prompt: fmt.Sprintf(format, values...), Reason: err.Error()})
+		}
+		return pwd
+	}
+	if pwd := os.Getenv(ENV_INIT_PASSWORD); pwd != "" {
+		return pwd
+	}
+	if !sys.IsInteractive() {
+		if !mandatory {
+			return ""
+		}
+		panic(sys.InputError{
+			Prompt: fmt.Sprintf(format, values...),
+			Reason: fmt.Sprintf("standard input is not a terminal, give the password by -passwordFile or environment variable %s", ENV_INIT_PASSWORD),
+		})
+	}
+	return sys.InputPassword(mandatory, "", format, values...)
+}
@@ -0,0 +1,84 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+/*
+Ask for the key server password and verify it, by the running key server or against the configuration if the server
+is not running, so that an action that requires the password does not merely rely on the permission to write record
+files. The password is asked only once per program run if the key server is running.
+*/
+func verifyServerPassword(action, uuid string) error {
+	daemon, err := getRecordDaemon()
+	if err != nil {
+		auditAdminAction(action, uuid, keyserv.AuditResultRejected, err.Error())
+		return err
+	} else if daemon != nil {
+		return nil
+	}
+	_, srvConf, _, err := readServerConfig()
+	if err != nil {
+		return err
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	hash := srvConf.PasswordKDF.Hash(srvConf.PasswordSalt, password)
+	if subtle.ConstantTimeCompare(hash[:], srvConf.PasswordHash[:]) != 1 {
+		auditAdminAction(action, uuid, keyserv.AuditResultRejected, "incorrect password")
+		return errors.New("The password is incorrect")
+	}
+	return nil
+}
+
+/*
+Show the owner of the disk before a destructive action, and return an error if the disk has an owner on whose behalf
+the administrator has not acknowledged to act by -iAmOwner or -force.
+*/
+func confirmOwner(rec keydb.Record, acknowledged bool) error {
+	if rec.Owner == "" {
+		return nil
+	}
+	fmt.Printf("Disk %s belongs to owner \"%s\".\n", rec.UUID, rec.Owner)
+	if !acknowledged {
+		return fmt.Errorf("Disk %s belongs to owner \"%s\", add -iAmOwner to confirm that you act on the owner's behalf", rec.UUID, rec.Owner)
+	}
+	return nil
+}
+
+// Server - set the owner of the disk, or remove the owner if it is empty. The key server password is always required.
+func SetKeyOwner(uuid, owner string) error {
+	sys.LockMem()
+	if err := keydb.ValidateDeviceID(uuid); err != nil {
+		return err
+	}
+	if err := keydb.ValidateOwner(owner); err != nil {
+		return err
+	}
+	db, err := OpenKeyDB(uuid)
+	if err != nil {
+		return err
+	}
+	rec, found := db.GetByUUID(uuid)
+	if !found {
+		return db.NotFoundError(uuid, nil)
+	}
+	if err := verifyServerPassword("SetOwner", rec.UUID); err != nil {
+		return err
+	}
+	if rec.Owner == owner {
+		fmt.Printf("Disk %s already belongs to owner \"%s\".\n", rec.UUID, owner)
+		return nil
+	}
+	if rec.Owner != "" {
+		fmt.Printf("Disk %s belonged to owner \"%s\".\n", rec.UUID, rec.Owner)
+	}
+	rec.Owner = owner
+	return UpdateRecord(db, rec, "SetOwner")
+}
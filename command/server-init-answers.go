@@ -0,0 +1,278 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/routine"
+	"cryptctl2/sys"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+The answer file of init-server carries the server's sysconfig keys (e.g. LISTEN_ADDRESS) along with the following keys
+that answer the remaining questions of the interactive setup.
+*/
+const (
+	ANSWER_PASSWORD          = "ACCESS_PASSWORD"      // ANSWER_PASSWORD is the access password in plain text.
+	ANSWER_PASSWORD_FILE     = "ACCESS_PASSWORD_FILE" // ANSWER_PASSWORD_FILE is a file that carries the access password on its first line.
+	ANSWER_GENERATE_CERT     = "GENERATE_CERT"        // ANSWER_GENERATE_CERT is "yes" to generate a self-signed TLS certificate in CERT_DIR.
+	ANSWER_CERT_HOSTNAME     = "CERT_HOSTNAME"        // ANSWER_CERT_HOSTNAME is the host name of the generated certificate.
+	ANSWER_CERT_IP           = "CERT_IP_ADDRESS"      // ANSWER_CERT_IP is the (optional) IP addresses of the generated certificate, separated by comma.
+	ANSWER_CERT_ORGANISATION = "CERT_ORGANISATION"    // ANSWER_CERT_ORGANISATION is the organisation name of the generated certificate.
+	ANSWER_CERT_VALID_YEARS  = "CERT_VALID_YEARS"     // ANSWER_CERT_VALID_YEARS is the number of years the generated certificate is valid for.
+
+	ENV_INIT_PASSWORD = "CRYPTCTL2_ACCESS_PASSWORD" // ENV_INIT_PASSWORD is the environment variable that may carry the access password.
+)
+
+/*
+Read the answer file of init-server, either a JSON object or lines of key=value in the format of sysconfig. JSON values
+may be strings, numbers, booleans ("yes" or "no"), or arrays of strings (joined by spaces).
+*/
+func readInitAnswers(answerFile string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(answerFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read answer file - %v", err)
+	}
+	answers := make(map[string]string)
+	if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		sysconf, err := sys.ParseSysconfig(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse answer file - %v", err)
+		}
+		for key, entry := range sysconf.KeyValue {
+			answers[key] = strings.TrimSpace(entry.Value)
+		}
+		return answers, nil
+	}
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("failed to parse answer file as JSON - %v", err)
+	}
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			answers[key] = strings.TrimSpace(v)
+		case json.Number:
+			answers[key] = v.String()
+		case bool:
+			answers[key] = map[bool]string{true: "yes", false: "no"}[v]
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			answers[key] = strings.Join(items, " ")
+		case nil:
+			answers[key] = ""
+		default:
+			return nil, fmt.Errorf("the value of key %s in answer file must be a string, number, boolean, or array", key)
+		}
+	}
+	return answers, nil
+}
+
+// Return the access password from the answer file, the password file it names, or the environment variable, in that order.
+func initAnswerPassword(answers map[string]string) (string, error) {
+	if pwd := answers[ANSWER_PASSWORD]; pwd != "" {
+		return pwd, nil
+	} else if pwdFile := answers[ANSWER_PASSWORD_FILE]; pwdFile != "" {
+		return readPasswordFile(pwdFile)
+	}
+	return os.Getenv(ENV_INIT_PASSWORD), nil
+}
+
+// Return the password on the first line of the file.
+func readPasswordFile(pwdFile string) (string, error) {
+	content, err := ioutil.ReadFile(pwdFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file - %v", err)
+	}
+	return strings.TrimRight(strings.SplitN(string(content), "\n", 2)[0], "\r"), nil
+}
+
+// Return true if the yes/no answer is yes, or an error if it is neither.
+func initAnswerBool(answers map[string]string, key string) (bool, error) {
+	switch strings.ToLower(answers[key]) {
+	case "yes", "true":
+		return true, nil
+	case "", "no", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("the value of key %s must be yes or no", key)
+}
+
+/*
+Server - complete the initial setup by reading all answers from a file instead of asking for them. The answers are
+validated as a whole, nothing is written unless all of them are good. If startService is true, the key server is
+(re)started afterwards. A generated certificate gets a key of the key type.
+*/
+func InitKeyServerFromAnswers(answerFile string, startService bool, keyType string) error {
+	sys.LockMem()
+	if err := routine.ValidateCertKeyType(keyType); err != nil {
+		return err
+	}
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
+	if err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: failed to read %s - %v", SERVER_CONFIG_PATH, err)
+	}
+	answers, err := readInitAnswers(answerFile)
+	if err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: %v", err)
+	}
+	answerKeys := map[string]bool{ANSWER_PASSWORD: true, ANSWER_PASSWORD_FILE: true, ANSWER_GENERATE_CERT: true,
+		ANSWER_CERT_HOSTNAME: true, ANSWER_CERT_IP: true, ANSWER_CERT_ORGANISATION: true, ANSWER_CERT_VALID_YEARS: true}
+	// A key unknown to the packaged sysconfig is most likely a typing mistake
+	unknown := make([]string, 0)
+	for key := range answers {
+		if _, exists := sysconf.KeyValue[key]; len(sysconf.KeyValue) > 0 && !exists && !answerKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("InitKeyServerFromAnswers: answer file \"%s\" has unknown keys: %s", answerFile, strings.Join(unknown, ", "))
+	}
+
+	// Work out the keys that must be answered, depending on the other answers
+	generateCert, err := initAnswerBool(answers, ANSWER_GENERATE_CERT)
+	if err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: %v", err)
+	}
+	validateClient, err := initAnswerBool(answers, keyserv.SRV_CONF_TLS_VALIDATE_CLIENT)
+	if err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: %v", err)
+	}
+	required := []string{keyserv.SRV_CONF_LISTEN_ADDR, keyserv.SRV_CONF_LISTEN_PORT, keyserv.SRV_CONF_KEYDB_DIR, keyserv.SRV_CONF_TLS_VALIDATE_CLIENT}
+	if generateCert {
+		required = append(required, keyserv.SRV_CONF_CERT_DIR, ANSWER_CERT_HOSTNAME, ANSWER_CERT_ORGANISATION, ANSWER_CERT_VALID_YEARS)
+	} else {
+		required = append(required, keyserv.SRV_CONF_TLS_CERT, keyserv.SRV_CONF_TLS_KEY)
+	}
+	if validateClient {
+		required = append(required, keyserv.SRV_CONF_TLS_CA)
+	}
+	if answers[keyserv.SRV_CONF_KMIP_SERVER_ADDRS] != "" {
+		if answers[keyserv.SRV_CONF_KMIP_SERVER_USER] == "" {
+			required = append(required, keyserv.SRV_CONF_KMIP_SERVER_TLS_CERT, keyserv.SRV_CONF_KMIP_SERVER_TLS_KEY)
+		} else {
+			required = append(required, keyserv.SRV_CONF_KMIP_SERVER_PASS)
+		}
+	}
+	if answers[keyserv.SRV_CONF_MAIL_AGENT_AND_PORT] != "" {
+		required = append(required, keyserv.SRV_CONF_MAIL_FROM_ADDR, keyserv.SRV_CONF_MAIL_RECIPIENTS)
+	}
+	missing := make([]string, 0)
+	for _, key := range required {
+		if answers[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	pwd, err := initAnswerPassword(answers)
+	if err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: %v", err)
+	} else if pwd == "" && sysconf.GetString(keyserv.SRV_CONF_PASS_HASH, "") == "" {
+		// An initialised server may keep its password
+		missing = append(missing, fmt.Sprintf("%s (or %s, or environment variable %s)", ANSWER_PASSWORD, ANSWER_PASSWORD_FILE, ENV_INIT_PASSWORD))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("InitKeyServerFromAnswers: answer file \"%s\" is missing keys: %s", answerFile, strings.Join(missing, ", "))
+	}
+
+	// Validate the answers that the interactive setup would not have accepted
+	if pwd != "" && len(pwd) < MIN_PASSWORD_LEN {
+		return fmt.Errorf("InitKeyServerFromAnswers: access password is too short, it must have a minimum of %d characters", MIN_PASSWORD_LEN)
+	}
+	if port, err := strconv.Atoi(answers[keyserv.SRV_CONF_LISTEN_PORT]); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("InitKeyServerFromAnswers: %s must be a port number between 1 and 65535", keyserv.SRV_CONF_LISTEN_PORT)
+	}
+	var certDir, certCommonName, hostIP, organization string
+	var maxAge int
+	if generateCert {
+		certDir, certCommonName, hostIP = answers[keyserv.SRV_CONF_CERT_DIR], answers[ANSWER_CERT_HOSTNAME], answers[ANSWER_CERT_IP]
+		organization = answers[ANSWER_CERT_ORGANISATION]
+		if !strings.HasPrefix(certDir, "/") {
+			return fmt.Errorf("InitKeyServerFromAnswers: certificate directory \"%s\" should be an absolute path", certDir)
+		}
+		if _, err := keydb.ParseIPList(hostIP); err != nil {
+			return fmt.Errorf("InitKeyServerFromAnswers: %s - %v", ANSWER_CERT_IP, err)
+		}
+		if maxAge, err = strconv.Atoi(answers[ANSWER_CERT_VALID_YEARS]); err != nil || maxAge < 1 || maxAge > 100 {
+			return fmt.Errorf("InitKeyServerFromAnswers: %s must be a number of years between 1 and 100", ANSWER_CERT_VALID_YEARS)
+		}
+	}
+	for _, key := range []string{keyserv.SRV_CONF_TLS_CA, keyserv.SRV_CONF_KMIP_SERVER_TLS_CA, keyserv.SRV_CONF_KMIP_SERVER_TLS_CERT} {
+		if answers[key] != "" {
+			if err := fs.FileContains(answers[key], "CERTIFICATE"); err != nil {
+				return fmt.Errorf("InitKeyServerFromAnswers: %s - %v", key, err)
+			}
+		}
+	}
+	if answers[keyserv.SRV_CONF_KMIP_SERVER_TLS_KEY] != "" {
+		if err := fs.FileContains(answers[keyserv.SRV_CONF_KMIP_SERVER_TLS_KEY], "KEY"); err != nil {
+			return fmt.Errorf("InitKeyServerFromAnswers: %s - %v", keyserv.SRV_CONF_KMIP_SERVER_TLS_KEY, err)
+		}
+	}
+
+	// Apply the answers to the configuration held in memory
+	for key, value := range answers {
+		if !answerKeys[key] {
+			sysconf.Set(key, value)
+		}
+	}
+	sysconf.Set(keyserv.SRV_CONF_TLS_VALIDATE_CLIENT, validateClient)
+	if generateCert {
+		sysconf.Set(keyserv.SRV_CONF_TLS_CERT, path.Join(certDir, certCommonName+".crt"))
+		sysconf.Set(keyserv.SRV_CONF_TLS_KEY, path.Join(certDir, certCommonName+".key"))
+	}
+	if pwd != "" {
+		setAccessPassword(sysconf, pwd)
+	}
+	var conf keyserv.CryptServiceConfig
+	if err := conf.LoadFromSysconfig(sysconf); err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: %v", err)
+	}
+	if generateCert {
+		// The certificate files come into existence only after all other settings are found good
+		err = conf.ValidateWithoutCert()
+	} else {
+		err = conf.Validate()
+	}
+	if err != nil {
+		return fmt.Errorf("InitKeyServerFromAnswers: %v", err)
+	}
+	if sysconf.GetString(keyserv.SRV_CONF_MAIL_AGENT_AND_PORT, "") != "" {
+		var mailer keyserv.Mailer
+		mailer.ReadFromSysconfig(sysconf)
+		if err := mailer.ValidateConfig(); err != nil {
+			return fmt.Errorf("InitKeyServerFromAnswers: email settings - %v", err)
+		}
+	}
+
+	// All answers are good, generate the certificate and save the settings.
+	if generateCert {
+		if err := generateServerCert(sysconf, certDir, certCommonName, hostIP, organization, maxAge, keyType); err != nil {
+			return err
+		}
+	}
+	if err := sys.ReplaceFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true); err != nil {
+		return fmt.Errorf("Failed to save settings into %s - %v", SERVER_CONFIG_PATH, err)
+	}
+	fmt.Printf("Settings from \"%s\" have been saved successfully!\n", answerFile)
+	if !startService {
+		return nil
+	}
+	return startKeyServer(false)
+}
@@ -3,24 +3,33 @@
 package command
 
 import (
+	"cryptctl2/keydb"
 	"cryptctl2/keyserv"
 	"cryptctl2/routine"
 	"cryptctl2/sys"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"time"
 )
 
-// Server - complete the initial setup.
-func InitKeyServer() error {
+// Server - complete the initial setup, a generated certificate gets a key of the key type (see routine.CertKeyTypes).
+func InitKeyServer(keyType string) error {
 	sys.LockMem()
+	if err := routine.ValidateCertKeyType(keyType); err != nil {
+		return err
+	}
 	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
 	if err != nil {
 		return fmt.Errorf("InitKeyServer: failed to read %s - %v", SERVER_CONFIG_PATH, err)
 	}
+	if !sys.IsInteractive() {
+		return errors.New("InitKeyServer: standard input is not a terminal, use -answerFile to set up the key server without questions")
+	}
 
 	// Some of the mandatory questions will accept empty answers if a configuration already exists
 	var reconfigure bool
@@ -57,10 +66,7 @@ Would you like to re-configure it?`) {
 		}
 	}
 	if pwd != "" {
-		newSalt := keyserv.NewSalt()
-		sysconf.Set(keyserv.SRV_CONF_PASS_SALT, hex.EncodeToString(newSalt[:]))
-		newPwd := keyserv.HashPassword(newSalt, pwd)
-		sysconf.Set(keyserv.SRV_CONF_PASS_HASH, hex.EncodeToString(newPwd[:]))
+		setAccessPassword(sysconf, pwd)
 	}
 	// Ask for TLS certificate and key, or generate a self-signed one if user wishes to.
 	generateCert := false
@@ -88,36 +94,22 @@ Would you like to re-configure it?`) {
 		}
 		certCommonName, hostIP := sys.GetHostnameAndIP()
 		certCommonName = sys.Input(true, certCommonName, "Host name for the generated certificate:")
-		hostIP = sys.Input(false, hostIP, "IP address for the generated certificate:")
-
-		if err := os.MkdirAll(certDir, 0700); err != nil {
-			return fmt.Errorf("Failed to create directory \"%s\" for storing generated certificates - %v", certDir, err)
+		for {
+			// Both the IPv4 and IPv6 address of the server may go into the certificate
+			if ips := sys.Input(false, hostIP, "IP addresses for the generated certificate, separated by comma:"); ips != "" {
+				hostIP = ips
+			}
+			_, err := keydb.ParseIPList(hostIP)
+			if err == nil {
+				break
+			}
+			fmt.Println(err)
 		}
 		maxAge := sys.InputInt(true, 10, 1, 100, "How long should the certificate be valid? Value in years.")
 		organization := sys.Input(true, "", "Enter the name of your organisation. This will be included into the certificat.")
-		// While openssl generates the certificate, print dots to stdout to show that program is busy.
-		fmt.Println("Generating certificate...")
-		opensslDone := make(chan bool, 1)
-		go func() {
-			for {
-				select {
-				case <-opensslDone:
-					return
-				case <-time.After(1 * time.Second):
-					fmt.Print(".")
-					os.Stdout.Sync()
-				}
-			}
-		}()
-		err := routine.GenerateSelfSignedCaCert(certCommonName, hostIP, certDir, organization, maxAge)
-		opensslDone <- true
-		if err != nil {
+		if err := generateServerCert(sysconf, certDir, certCommonName, hostIP, organization, maxAge, keyType); err != nil {
 			return err
 		}
-		fmt.Printf("\nSelf-signed CA and a certificate has been generated for host name '%s' in '%s'.\n", certCommonName, certDir)
-		// Point sysconfig values to the generated certificate
-		sysconf.Set(keyserv.SRV_CONF_TLS_CERT, path.Join(certDir, certCommonName+".crt"))
-		sysconf.Set(keyserv.SRV_CONF_TLS_KEY, path.Join(certDir, certCommonName+".key"))
 	} else {
 		// If certificate was specified, ask for its key file
 		if tlsKey := sys.InputAbsFilePath(!reconfigure,
@@ -129,8 +121,8 @@ Would you like to re-configure it?`) {
 
 	// Walk through the remaining mandatory configuration keys
 	if listenAddr := sys.Input(false,
-		sysconf.GetString(keyserv.SRV_CONF_LISTEN_ADDR, "0.0.0.0"),
-		"IP address for the server to listen on (0.0.0.0 to listen on all network interfaces)"); listenAddr != "" {
+		sysconf.GetString(keyserv.SRV_CONF_LISTEN_ADDR, defaultListenAddress()),
+		"IP address for the server to listen on (0.0.0.0 or :: to listen on all network interfaces)"); listenAddr != "" {
 		sysconf.Set(keyserv.SRV_CONF_LISTEN_ADDR, listenAddr)
 	}
 	if listenPort := sys.InputInt(false,
@@ -153,16 +145,35 @@ Would you like to re-configure it?`) {
 				sysconf.GetString(keyserv.SRV_CONF_TLS_CA, ""),
 				"PEM-encoded TLS certificate authority that will issue client certificates"))
 	}
+	// Walk through optional metrics settings
+	if metricsAddr := sys.Input(false,
+		sysconf.GetString(keyserv.SRV_CONF_METRICS_ADDRESS, ""),
+		"IP address to serve Prometheus metrics on (leave empty to disable metrics)"); metricsAddr != "" {
+		sysconf.Set(keyserv.SRV_CONF_METRICS_ADDRESS, metricsAddr)
+		sysconf.Set(keyserv.SRV_CONF_METRICS_PORT, sys.InputInt(true,
+			sysconf.GetInt(keyserv.SRV_CONF_METRICS_PORT, keyserv.DefaultMetricsPort), 1, 65535,
+			"TCP port number to serve metrics on"))
+		sysconf.Set(keyserv.SRV_CONF_METRICS_TLS, sys.InputBool(sysconf.GetBool(keyserv.SRV_CONF_METRICS_TLS, false),
+			"Should metrics be served over HTTPS with the server's TLS certificate?"))
+	} else {
+		sysconf.Set(keyserv.SRV_CONF_METRICS_ADDRESS, "")
+	}
 	// Walk through KMIP settings
 	useExternalKMIPServer := sys.InputBool(sysconf.GetString(keyserv.SRV_CONF_KMIP_SERVER_ADDRS, "") != "",
 		"Should encryption keys be kept on a KMIP-compatible key management appliance?")
 	if useExternalKMIPServer {
 		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_ADDRS, sys.Input(true, "", "Space-separated KMIP server addresses (host1:port1 host2:port2 ...)"))
-		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_USER, sys.Input(false, "", "KMIP username"))
-		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_PASS, sys.InputPassword(false, "", "KMIP password"))
+		kmipUser := sys.Input(false, "", "KMIP username (leave empty if the appliance authenticates by client certificate only)")
+		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_USER, kmipUser)
+		if kmipUser == "" {
+			sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_PASS, "")
+		} else {
+			sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_PASS, sys.InputPassword(false, "", "KMIP password"))
+		}
 		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_TLS_CA, sys.InputAbsFilePath(false, "", "PEM-encoded TLS certificate authority of KMIP server"))
-		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_TLS_CERT, sys.InputAbsFilePath(false, "", "PEM-encoded TLS client identity certificate"))
-		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_TLS_KEY, sys.InputAbsFilePath(false, "", "PEM-encoded TLS client identity certificate key"))
+		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_TLS_CERT, sys.InputAbsFilePath(kmipUser == "", "", "PEM-encoded TLS client identity certificate"))
+		sysconf.Set(keyserv.SRV_CONF_KMIP_SERVER_TLS_KEY, sys.InputAbsFilePath(kmipUser == "", "", "PEM-encoded TLS client identity certificate key"))
+		fmt.Println("Once the server is initialised, run \"cryptctl2 -action=kmip-status\" to check the KMIP connection.")
 	}
 	// Walk through optional email settings
 	fmt.Println("\nTo enable Email notifications, enter the following parameters:")
@@ -172,11 +183,23 @@ Would you like to re-configure it?`) {
 		sysconf.Set(keyserv.SRV_CONF_MAIL_AGENT_AND_PORT, mta)
 	}
 	if sysconf.GetString(keyserv.SRV_CONF_MAIL_AGENT_AND_PORT, "") != "" {
+		if tlsMode := sys.Input(false,
+			sysconf.GetString(keyserv.SRV_CONF_MAIL_TLS_MODE, keyserv.MailTLSNone),
+			"TLS mode of mail agent: none, starttls (usually port 587), or smtps (usually port 465)"); tlsMode != "" {
+			sysconf.Set(keyserv.SRV_CONF_MAIL_TLS_MODE, tlsMode)
+		}
+		if tlsMode := sysconf.GetString(keyserv.SRV_CONF_MAIL_TLS_MODE, ""); tlsMode == keyserv.MailTLSStartTLS || tlsMode == keyserv.MailTLSSMTPS {
+			if caFile := sys.Input(false,
+				sysconf.GetString(keyserv.SRV_CONF_MAIL_TLS_CA, ""),
+				"PEM file of certificate authority that verifies the mail agent (optional)"); caFile != "" {
+				sysconf.Set(keyserv.SRV_CONF_MAIL_TLS_CA, caFile)
+			}
+		}
 		if username := sys.Input(false,
 			sysconf.GetString(keyserv.SRV_CONF_MAIL_AGENT_USERNAME, ""),
 			"Plain authentication username for access to mail agent (optional)"); username != "" {
 			sysconf.Set(keyserv.SRV_CONF_MAIL_AGENT_USERNAME, username)
-			if password := sys.Input(false,
+			if password := sys.InputPassword(false,
 				sysconf.GetString(keyserv.SRV_CONF_MAIL_AGENT_PASSWORD, ""),
 				"Plain authentication password for access to mail agent (optional)"); password != "" {
 				sysconf.Set(keyserv.SRV_CONF_MAIL_AGENT_PASSWORD, password)
@@ -213,19 +236,170 @@ Would you like to re-configure it?`) {
 			sysconf.Set(keyserv.SRV_CONF_MAIL_RETRIEVAL_TEXT, retrievalText)
 		}
 	}
-	if err := ioutil.WriteFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), 0600); err != nil {
+	if err := sys.ReplaceFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true); err != nil {
 		return fmt.Errorf("Failed to save settings into %s - %v", SERVER_CONFIG_PATH, err)
 	}
-	// Restart server
 	fmt.Println("\nSettings have been saved successfully!")
-	var start bool
-	if sys.SystemctlIsRunning(SERVER_DAEMON) {
-		start = sys.InputBool(true, "Would you like to restart key server (%s) to apply the new settings?", SERVER_DAEMON)
-	} else {
-		start = sys.InputBool(true, "Would you like to start key server (%s) now?", SERVER_DAEMON)
+	return startKeyServer(true)
+}
+
+/*
+Give the key server a new access password by storing the hash of the password along with a new salt and the key
+derivation function that calculated the hash.
+*/
+func setAccessPassword(sysconf *sys.Sysconfig, pwd string) (keyserv.PasswordSalt, keyserv.HashedPassword, keyserv.PasswordKDF) {
+	newSalt := keyserv.NewSalt()
+	kdf := keyserv.DefaultPasswordKDF()
+	sysconf.Set(keyserv.SRV_CONF_PASS_SALT, hex.EncodeToString(newSalt[:]))
+	newPwd := kdf.Hash(newSalt, pwd)
+	sysconf.Set(keyserv.SRV_CONF_PASS_HASH, hex.EncodeToString(newPwd[:]))
+	sysconf.Set(keyserv.SRV_CONF_PASS_KDF, kdf.String())
+	return newSalt, newPwd, kdf
+}
+
+/*
+Server - change the access password without going through the complete initial setup. The current password is
+verified by the running key server, or against the configuration if the server is not running. The new hash and salt
+are saved into the configuration, and the running server accepts the new password right away. Both passwords are
+asked for, unless they are read from the first line of the password files.
+*/
+func ChangeServerPassword(oldPasswordFile, newPasswordFile string) error {
+	sys.LockMem()
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false)
+	if err != nil {
+		return fmt.Errorf("ChangeServerPassword: failed to read %s - %v", SERVER_CONFIG_PATH, err)
 	}
-	if !start {
-		return nil
+	if sysconf.GetString(keyserv.SRV_CONF_PASS_HASH, "") == "" {
+		return errors.New("The key server has not been initialised yet, run init-server first")
+	}
+	var oldPwd string
+	if (oldPasswordFile == "" || newPasswordFile == "") && !sys.IsInteractive() {
+		return errors.New("ChangeServerPassword: standard input is not a terminal, give the passwords by -oldPasswordFile and -newPasswordFile")
+	}
+	if oldPasswordFile == "" {
+		oldPwd = sys.InputPassword(true, "", "Enter key server's current password (no echo)")
+		fmt.Println()
+	} else if oldPwd, err = readPasswordFile(oldPasswordFile); err != nil {
+		return fmt.Errorf("ChangeServerPassword: %v", err)
+	}
+	// Let the running server verify the password, or verify it against the configuration.
+	var daemon *keyserv.CryptClient
+	if client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", ""); err == nil {
+		if caps, err := client.GetCapabilities(); err == nil {
+			if err := client.Ping(keyserv.PingRequest{PlainPassword: oldPwd}); err != nil {
+				return err
+			}
+			if caps.Features[keyserv.FeatureChangePassword] {
+				daemon = client
+			}
+		}
+	}
+	if daemon == nil {
+		var srvConf keyserv.CryptServiceConfig
+		if err := srvConf.LoadFromSysconfig(sysconf); err != nil {
+			return err
+		}
+		oldHash := srvConf.PasswordKDF.Hash(srvConf.PasswordSalt, oldPwd)
+		if subtle.ConstantTimeCompare(oldHash[:], srvConf.PasswordHash[:]) != 1 {
+			auditAdminAction("ChangePassword", "", keyserv.AuditResultRejected, "incorrect password")
+			return errors.New("The current password is incorrect")
+		}
+	}
+	var newPwd string
+	if newPasswordFile == "" {
+		for {
+			newPwd = sys.InputPassword(true, "", "New access password (min. %d chars, no echo)", MIN_PASSWORD_LEN)
+			fmt.Println()
+			if len(newPwd) < MIN_PASSWORD_LEN {
+				fmt.Printf("Password is too short, please enter a minimum of %d characters.\n", MIN_PASSWORD_LEN)
+				continue
+			}
+			confirmPwd := sys.InputPassword(true, "", "Confirm new access password (no echo)")
+			fmt.Println()
+			if confirmPwd == newPwd {
+				break
+			}
+			fmt.Println("Password does not match.")
+		}
+	} else if newPwd, err = readPasswordFile(newPasswordFile); err != nil {
+		return fmt.Errorf("ChangeServerPassword: %v", err)
+	} else if len(newPwd) < MIN_PASSWORD_LEN {
+		return fmt.Errorf("The new password is too short, it must have a minimum of %d characters", MIN_PASSWORD_LEN)
+	}
+	newSalt, newHash, newKDF := setAccessPassword(sysconf, newPwd)
+	if err := sys.ReplaceFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true); err != nil {
+		return fmt.Errorf("Failed to save settings into %s - %v", SERVER_CONFIG_PATH, err)
+	}
+	fmt.Println("The new password has been saved.")
+	if daemon == nil {
+		auditAdminAction("ChangePassword", "", keyserv.AuditResultGranted, "")
+		// An older key server takes over the password from configuration upon reload
+		return reloadKeyServer()
+	}
+	if err := daemon.ChangePassword(keyserv.ChangePasswordReq{PlainPassword: oldPwd, NewSalt: newSalt, NewHash: newHash, NewKDF: newKDF.String()}); err != nil {
+		return fmt.Errorf("The running key server still accepts the old password (%v), run \"systemctl reload %s\" to apply the new one", err, SERVER_DAEMON)
+	}
+	fmt.Println("The running key server now accepts the new password.")
+	return nil
+}
+
+// Generate a self-signed CA and a server certificate signed by it in the directory, and point sysconfig to the certificate.
+// Return the address that listens on all network interfaces, "::" on a computer without an IPv4 network.
+func defaultListenAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "0.0.0.0"
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return "0.0.0.0"
+		}
+	}
+	return "::"
+}
+
+func generateServerCert(sysconf *sys.Sysconfig, certDir, certCommonName, hostIP, organization string, maxAge int, keyType string) error {
+	if err := sys.MkdirSecure(certDir); err != nil {
+		return fmt.Errorf("Failed to create directory \"%s\" for storing generated certificates - %v", certDir, err)
+	}
+	// While openssl generates the certificate, print dots to stdout to show that program is busy.
+	fmt.Println("Generating certificate...")
+	opensslDone := make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case <-opensslDone:
+				return
+			case <-time.After(1 * time.Second):
+				fmt.Print(".")
+				os.Stdout.Sync()
+			}
+		}
+	}()
+	err := routine.GenerateSelfSignedCaCert(certCommonName, hostIP, certDir, organization, maxAge, keyType)
+	opensslDone <- true
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nSelf-signed CA and a certificate has been generated for host name '%s' in '%s'.\n", certCommonName, certDir)
+	// Point sysconfig values to the generated certificate
+	sysconf.Set(keyserv.SRV_CONF_TLS_CERT, path.Join(certDir, certCommonName+".crt"))
+	sysconf.Set(keyserv.SRV_CONF_TLS_KEY, path.Join(certDir, certCommonName+".key"))
+	return nil
+}
+
+// (Re)start the key server to apply new settings, ask the user for confirmation first if prompt is true.
+func startKeyServer(prompt bool) error {
+	if prompt {
+		var start bool
+		if sys.SystemctlIsRunning(SERVER_DAEMON) {
+			start = sys.InputBool(true, "Would you like to restart key server (%s) to apply the new settings?", SERVER_DAEMON)
+		} else {
+			start = sys.InputBool(true, "Would you like to start key server (%s) now?", SERVER_DAEMON)
+		}
+		if !start {
+			return nil
+		}
 	}
 	// (Re)start server and then display the PID in output.
 	if err := sys.SystemctlEnableRestart(SERVER_DAEMON); err != nil {
@@ -252,15 +426,61 @@ Would you like to re-configure it?`) {
 	return nil
 }
 
-func CreateCertificate(DNSName, IPAddress string) error {
+/*
+Server - issue a certificate for the comma-separated DNS names and IP addresses by the CA generated by init-server, its
+key is of the CA key's type unless given. The certificate is valid for the days, as long as the CA if 0. With a
+certificate signing request, the certificate is issued for the key of the request instead, and no key is generated.
+*/
+func CreateCertificate(DNSName, IPAddress, keyType, csrPath string, validityDays int) error {
+	if csrPath != "" && keyType != "" {
+		return errors.New("The key of a certificate signing request is already there, -keyType does not go with -csr")
+	}
+	if validityDays < 0 {
+		return fmt.Errorf("Validity of %d days must not be negative", validityDays)
+	}
 
 	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
 	if err != nil {
 		return fmt.Errorf("InitKeyServer: failed to read %s - %v", SERVER_CONFIG_PATH, err)
 	}
 	certDir := sysconf.GetString(keyserv.SRV_CONF_CERT_DIR, "/var/lib/cryptctl2/certs")
-	if err := routine.GenerateCertificate(DNSName, IPAddress, certDir); err != nil {
+	if csrPath != "" {
+		certPath, err := routine.SignCertificateRequest(csrPath, DNSName, IPAddress, certDir, validityDays)
+		if err != nil {
+			return fmt.Errorf("Failed to sign certificate request %s - %v", csrPath, err)
+		}
+		fmt.Printf("The certificate has been written to %s.\n", certPath)
+		return nil
+	}
+	if err := routine.GenerateCertificate(DNSName, IPAddress, certDir, keyType, validityDays); err != nil {
 		return fmt.Errorf("Failed to create certificate %s - %v", DNSName, err)
 	}
 	return nil
 }
+
+/*
+Return the function that lets the running key server issue client certificates to enrolling computers by the CA in the
+certificate directory, see keyserv.CryptServiceConn.EnrollClient. Return nil if the directory does not carry the CA
+generated by init-server, e.g. if the server certificate was issued elsewhere.
+*/
+func clientCertIssuer(certDir string) func(dnsName, ipAddress string) (certPEM, keyPEM, caPEM []byte, err error) {
+	// A missing serial file is recovered by routine.GetNextSerial
+	for _, name := range []string{"ca.crt", "ca.key"} {
+		if _, err := os.Stat(path.Join(certDir, name)); err != nil {
+			return nil
+		}
+	}
+	return func(dnsName, ipAddress string) (certPEM, keyPEM, caPEM []byte, err error) {
+		if err = routine.GenerateCertificate(dnsName, ipAddress, certDir, "", 0); err != nil {
+			return
+		}
+		if certPEM, err = os.ReadFile(path.Join(certDir, dnsName+".crt")); err != nil {
+			return
+		}
+		if keyPEM, err = os.ReadFile(path.Join(certDir, dnsName+".key")); err != nil {
+			return
+		}
+		caPEM, err = os.ReadFile(path.Join(certDir, "ca.crt"))
+		return
+	}
+}
@@ -3,47 +3,109 @@
 package command
 
 import (
+	"cryptctl2/fs"
 	"cryptctl2/helper"
 	"cryptctl2/keydb"
 	"cryptctl2/keyserv"
 	"cryptctl2/routine"
 	"cryptctl2/sys"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	SERVER_DAEMON      = "cryptctl2-server"
 	SERVER_CONFIG_PATH = "/etc/sysconfig/cryptctl2-server"
-	TIME_OUTPUT_FORMAT = "1967-04-17 23:04:00"
+	TIME_OUTPUT_FORMAT = "2006-01-02 15:04:05"
 	MIN_PASSWORD_LEN   = 10
 
-	PendingCommandMount  = "mount"  // PendingCommandMount is the content of a pending command that tells client computer to mount that disk.
-	PendingCommandUmount = "umount" // PendingCommandUmount is the content of a pending command that tells client computer to umount that disk.
+	ShowKeyRejections = 10 // ShowKeyRejections is the number of most recent rejected retrievals shown by show-key in text.
+
+	PendingCommandMount         = "mount"          // PendingCommandMount is the content of a pending command that tells client computer to mount that disk.
+	PendingCommandUmount        = "umount"         // PendingCommandUmount is the content of a pending command that tells client computer to umount that disk.
+	PendingCommandLock          = "lock"           // PendingCommandLock tells client computer to umount and close that disk, so that the key leaves its memory.
+	PendingCommandErase         = "erase"          // PendingCommandErase tells client computer to lock that disk and erase its encryption header.
+	PendingCommandRefreshStatus = "refresh-status" // PendingCommandRefreshStatus tells client computer to send an alive message and its disk inventory right away.
+	PendingCommandFstrim        = "fstrim"         // PendingCommandFstrim tells client computer to discard unused blocks of the file system on that disk.
+	PendingCommandInventory     = "inventory"      // PendingCommandInventory tells client computer to report its LUKS and crypt devices for show-client.
+	PendingCommandRotate        = "rotate"         // PendingCommandRotate tells client computer to carry out the key rotation started by "rotate-key" on the server.
+	PendingCommandRemountRO     = "remount-ro"     // PendingCommandRemountRO tells client computer to remount the file system on that disk read-only.
+	PendingCommandPurgeSealed   = "purge-sealed"   // PendingCommandPurgeSealed tells client computer to remove the TPM-sealed copy of that disk's record, also sent when the record is erased.
+
+	ServerShutdownTimeout     = 30 * time.Second // ServerShutdownTimeout is how long the server waits for RPC calls in progress to finish when it is stopped.
+	CommandResultPollInterval = 2 * time.Second  // CommandResultPollInterval is how often send-command -wait looks for the command result.
+	CommandTargetAll          = "all"            // CommandTargetAll is the answer that sends a pending command to all computers using the disk.
+	CommandDefaultExpireMin   = 10               // CommandDefaultExpireMin is the number of minutes a pending command stays valid unless told otherwise.
+	CommandMaxExpireMin       = 10080            // CommandMaxExpireMin is the longest validity of a pending command in minutes, a week.
 )
 
-// Server - run key service daemon.
-func KeyRPCDaemon() error {
-	sys.LockMem()
-	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
+// Read key server configuration and mailer settings from sysconfig file.
+func readServerConfig() (sysconf *sys.Sysconfig, srvConf keyserv.CryptServiceConfig, mailer keyserv.Mailer, err error) {
+	sysconf, err = sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
 	if err != nil {
-		return fmt.Errorf("Failed to read configuratioon file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+		err = fmt.Errorf("Failed to read configuratioon file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+		return
 	}
-	srvConf := keyserv.CryptServiceConfig{}
-	if err := srvConf.ReadFromSysconfig(sysconf); err != nil {
-		return fmt.Errorf("Failed to load configuration from file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+	if err = srvConf.ReadFromSysconfig(sysconf); err != nil {
+		err = fmt.Errorf("Failed to load configuration from file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+		return
 	}
-	mailer := keyserv.Mailer{}
 	mailer.ReadFromSysconfig(sysconf)
+	return
+}
+
+// Obtain key database master key from the configured source, the passphrase is asked from terminal if it is needed.
+func loadKeyDBMasterKey(srvConf keyserv.CryptServiceConfig) ([]byte, error) {
+	passphrase := ""
+	if srvConf.KeyDBMasterKeySource == keyserv.MasterKeySourcePassphrase {
+		passphrase = sys.InputPassword(true, "", "Enter key database passphrase (no echo)")
+	}
+	masterKey, err := keyserv.LoadKeyDBMasterKey(srvConf, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load key database master key - %v", err)
+	}
+	return masterKey, nil
+}
+
+/*
+Server - run key service daemon. On SIGHUP the configuration and key database are reloaded without interrupting
+connected clients. On SIGTERM the daemon stops accepting connections, waits for RPC calls in progress, and quits.
+The log level overrides LOG_LEVEL of the server configuration unless it is empty.
+*/
+func KeyRPCDaemon(logLevel string) error {
+	sys.LockMem()
+	sysconf, srvConf, mailer, err := readServerConfig()
+	if err != nil {
+		return err
+	}
+	if logLevel == "" {
+		logLevel = sysconf.GetString(keyserv.SRV_CONF_LOG_LEVEL, keyserv.DefaultLogLevel)
+	}
+	if err := keyserv.SetupDaemonLogging(logLevel); err != nil {
+		return err
+	}
+	if srvConf.KeyDBMasterKey, err = loadKeyDBMasterKey(srvConf); err != nil {
+		return err
+	}
 	srv, err := keyserv.NewCryptServer(srvConf, mailer)
 	if err != nil {
 		return fmt.Errorf("Failed to initialise server - %v", err)
 	}
+	srv.SavePassword = saveServerPassword
+	srv.IssueClientCert = clientCertIssuer(sysconf.GetString(keyserv.SRV_CONF_CERT_DIR, "/var/lib/cryptctl2/certs"))
 	// Print helpful information regarding server's initial setup and mailer configuration
 	if nonFatalErr := srv.CheckInitialSetup(); nonFatalErr != nil {
 		log.Print("Key server is not confiured yet. Please run `cryptctl2 init-server` to complete initial setup.")
@@ -54,6 +116,7 @@ func KeyRPCDaemon() error {
 	} else {
 		log.Printf("Email notifications are not enabled: %v", nonFatalErr)
 	}
+	warnLooseFileModes(SERVER_CONFIG_PATH, srvConf.KeyDBDir, sysconf.GetString(keyserv.SRV_CONF_CERT_DIR, ""))
 	log.Printf("GOMAXPROCS is currently: %d", runtime.GOMAXPROCS(-1))
 	// Start two RPC servers, one on TCP and the other on Unix domain socket.
 	if err := srv.ListenTCP(); err != nil {
@@ -62,9 +125,86 @@ func KeyRPCDaemon() error {
 	if err := srv.ListenUnix(); err != nil {
 		return fmt.Errorf("KeyRPCDaemon: failed to listen for domain socket connections - %v", err)
 	}
+	if err := srv.ListenMetrics(); err != nil {
+		return fmt.Errorf("KeyRPCDaemon: failed to listen for metrics requests - %v", err)
+	}
+	if srv.Metrics != nil {
+		go srv.Metrics.HandleConnections()
+	}
+	if err := srv.ListenHTTPAPI(); err != nil {
+		return fmt.Errorf("KeyRPCDaemon: failed to listen for JSON API requests - %v", err)
+	}
+	if srv.HTTPAPI != nil {
+		go srv.HTTPAPI.HandleConnections()
+	}
+	if err := srv.StartBackupSchedule(SERVER_CONFIG_PATH); err != nil {
+		return fmt.Errorf("KeyRPCDaemon: failed to start scheduled backups - %v", err)
+	}
+	srv.StartRetrievalDigest()
+	srv.StartLostHostMonitor()
+	srv.StartUnlockWindowMonitor()
+	stopSignal := make(chan os.Signal, 1)
+	signal.Notify(stopSignal, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	tcpDone := make(chan struct{})
 	go srv.HandleUnixConnections()
-	srv.HandleTCPConnections() // intentionally block here
-	return nil
+	go func() {
+		srv.HandleTCPConnections()
+		close(tcpDone)
+	}()
+	for {
+		select {
+		case <-tcpDone:
+			// The listener was closed by Shutdown RPC
+			srv.GracefulShutdown(ServerShutdownTimeout)
+			return nil
+		case sig := <-stopSignal:
+			if sig != syscall.SIGHUP {
+				log.Printf("Received %v, stop accepting connections and wait for RPC calls in progress...", sig)
+				if srv.GracefulShutdown(ServerShutdownTimeout) {
+					log.Print("Key server has shut down.")
+				}
+				return nil
+			}
+			log.Print("Received SIGHUP, reloading configuration and key database...")
+			_, newConf, newMailer, err := readServerConfig()
+			if err == nil {
+				err = srv.Reload(newConf, newMailer)
+			}
+			if err != nil {
+				log.Printf("Failed to reload, the server carries on with the existing configuration - %v", err)
+			} else {
+				log.Printf("Reloaded configuration and %d key records.", len(srv.KeyDB.List()))
+			}
+		}
+	}
+}
+
+// Save the password hash upgraded by the running key server into its configuration file.
+func saveServerPassword(salt keyserv.PasswordSalt, hash keyserv.HashedPassword, kdf keyserv.PasswordKDF) error {
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	sysconf.Set(keyserv.SRV_CONF_PASS_SALT, hex.EncodeToString(salt[:]))
+	sysconf.Set(keyserv.SRV_CONF_PASS_HASH, hex.EncodeToString(hash[:]))
+	sysconf.Set(keyserv.SRV_CONF_PASS_KDF, kdf.String())
+	return sys.ReplaceFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true)
+}
+
+// Log a warning for each file or directory among the paths that is accessible by users other than root.
+func warnLooseFileModes(paths ...string) {
+	for _, checkPath := range paths {
+		if checkPath == "" {
+			continue
+		}
+		loose, err := sys.FindLooseFileModes(checkPath, sys.SecureFileMode, sys.SecureDirMode)
+		if err != nil {
+			continue
+		}
+		for _, loosePath := range loose {
+			log.Printf("Warning: \"%s\" is accessible by other users, consider to restrict its permission with chmod go-rwx.", loosePath)
+		}
+	}
 }
 
 /*
@@ -81,44 +221,166 @@ func OpenKeyDB(recordUUID string) (*keydb.DB, error) {
 	if dbDir == "" {
 		return nil, errors.New("Key database directory is not configured. Is the server initialised?")
 	}
+	var masterKey []byte
+	if sysconf.GetString(keyserv.SRV_CONF_KEYDB_MASTER_KEY_SOURCE, "") != "" {
+		_, srvConf, _, err := readServerConfig()
+		if err != nil {
+			return nil, err
+		}
+		if masterKey, err = loadKeyDBMasterKey(srvConf); err != nil {
+			return nil, err
+		}
+	}
 	var db *keydb.DB
 	if recordUUID == "" {
 		// Load entire directory of database records into memory
-		db, err = keydb.OpenDB(dbDir)
+		db, err = keydb.OpenDBWithMasterKey(dbDir, masterKey)
 		if err != nil {
 			return nil, fmt.Errorf("OpenKeyDB: failed to open database directory \"%s\" - %v", dbDir, err)
 		}
 	} else {
 		// Load only one record into memory
-		db, err = keydb.OpenDBOneRecord(dbDir, recordUUID)
-		if err != nil {
+		db, err = keydb.OpenDBOneRecordWithMasterKey(dbDir, recordUUID, masterKey)
+		if _, notFound := err.(keydb.RecordNotFoundError); notFound {
+			return nil, err
+		} else if err != nil {
 			return nil, fmt.Errorf("OpenKeyDB: failed to open record \"%s\" - %v", recordUUID, err)
 		}
+		// The running key server has the latest copy of the record
+		if _, found := db.GetByUUID(recordUUID); found {
+			daemon, err := getRecordDaemon()
+			if err != nil {
+				return nil, err
+			} else if daemon != nil {
+				if err := refreshFromDaemon(db, daemon, recordUUID); err != nil {
+					return nil, fmt.Errorf("OpenKeyDB: failed to read record \"%s\" from key server - %v", recordUUID, err)
+				}
+			}
+		}
 	}
+	db.VersionsKept = sysconf.GetInt(keyserv.SRV_CONF_KEYDB_VERSIONS, keydb.DefaultRecordVersionsKept)
 	return db, nil
 }
 
-// Server - print all key records sorted according to last access.
-func ListKeys() error {
+// KeyListEntry is a key record as presented by list-keys in JSON.
+type KeyListEntry struct {
+	UUID            string            `json:"uuid"`
+	ID              string            `json:"id"`
+	MappedName      string            `json:"mapped_name"`
+	MountPoint      string            `json:"mount_point"`
+	MountOptions    []string          `json:"mount_options"`
+	AutoEncryption  bool              `json:"auto_encryption"`
+	FileSystem      string            `json:"file_system"`
+	KeepAliveSec    int               `json:"keep_alive_timeout_sec"`
+	AliveInterval   int               `json:"keep_alive_interval_sec"`
+	MaxActive       int               `json:"max_active"`
+	AllowedClients  []string          `json:"allowed_clients"`
+	ActiveClients   int               `json:"active_clients"`
+	Group           string            `json:"group,omitempty"`
+	GroupPriority   int               `json:"group_priority,omitempty"`
+	Tags            map[string]string `json:"tags"`
+	Owner           string            `json:"owner"`
+	LastRetrievedBy string            `json:"last_retrieved_by"`
+	LastRetrievedIP string            `json:"last_retrieved_ip"`
+	LastRetrievedOn int64             `json:"last_retrieved_on"`
+}
+
+/*
+Server - print key records that match the filter expression (all records if it is empty) and belong to the owner if
+given, sorted according to last access unless another order is given. The client, staleness, and unused conditions are
+added to those of the filter expression, they apply to text and JSON output alike.
+*/
+func ListKeys(filterExpr, owner, client, sortBy string, onlyStale time.Duration, unused bool, output string) error {
 	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	filter, err := keydb.ParseRecordFilter(filterExpr)
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		filter.Owner = owner
+	}
+	if client != "" {
+		filter.Client = client
+	}
+	if onlyStale < 0 {
+		return fmt.Errorf("Staleness %v must not be negative", onlyStale)
+	} else if onlyStale > 0 {
+		filter.StaleFor = onlyStale
+	}
+	filter.Unused = filter.Unused || unused
 	db, err := OpenKeyDB("")
 	if err != nil {
 		return err
 	}
-	recList := db.List()
+	recList := db.List().Filter(db, filter, time.Now())
+	if err := recList.SortBy(sortBy); err != nil {
+		return err
+	}
+	warnMaintenance(db, output)
+	if output == OutputJSON {
+		entries := make([]KeyListEntry, 0, len(recList))
+		for _, rec := range recList {
+			rec.RemoveDeadHosts()
+			entry := KeyListEntry{
+				UUID:            rec.UUID,
+				ID:              rec.ID,
+				MappedName:      rec.MappedName,
+				MountPoint:      rec.MountPoint,
+				MountOptions:    rec.MountOptions,
+				AutoEncryption:  rec.AutoEncryption,
+				FileSystem:      rec.FileSystem,
+				KeepAliveSec:    rec.AliveCount * rec.AliveIntervalSec,
+				AliveInterval:   rec.AliveIntervalSec,
+				MaxActive:       rec.MaxActive,
+				AllowedClients:  rec.AllowedClients,
+				ActiveClients:   len(rec.AliveMessages),
+				Group:           rec.Group,
+				GroupPriority:   rec.GroupPriority,
+				Tags:            rec.Tags,
+				Owner:           rec.Owner,
+				LastRetrievedBy: rec.LastRetrieval.Hostname,
+				LastRetrievedIP: rec.LastRetrieval.IP,
+				LastRetrievedOn: rec.LastRetrieval.Timestamp,
+			}
+			if entry.AllowedClients == nil {
+				entry.AllowedClients = []string{}
+			}
+			if entry.MountOptions == nil {
+				entry.MountOptions = []string{}
+			}
+			if entry.Tags == nil {
+				entry.Tags = map[string]string{}
+			}
+			entries = append(entries, entry)
+		}
+		return printJSON(entries)
+	}
 	fmt.Printf("Total: %d records (date and time are in zone %s)\n", len(recList), time.Now().Format("MST"))
-	// Print mount point last, making output possible to be parsed by a program
-	fmt.Println("Used By         When                ID           UUID                                 Max.Client Allowed.Client Act.Client Mount.Point    ")
+	// Print mount point and key length last, making output possible to be parsed by a program
+	fmt.Println("Used By         When                ID           UUID                                 Max.Client Allowed.Client Act.Client Group           Owner           Mount.Point     Key.Len")
 	for _, rec := range recList {
 		outputTime := time.Unix(rec.LastRetrieval.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
 		rec.RemoveDeadHosts()
-		fmt.Printf("%-15s %-19s %-12s %-36s %-10s %-14s %-11s %-15s %s\n",
+		group := "-"
+		if rec.Group != "" {
+			group = fmt.Sprintf("%s(%d)", rec.Group, rec.GroupPriority)
+		}
+		owner := "-"
+		if rec.Owner != "" {
+			owner = rec.Owner
+		}
+		fmt.Printf("%-15s %-19s %-12s %-36s %-10s %-14s %-10s %-15s %-15s %-15s %s\n",
 			rec.LastRetrieval.IP,
 			outputTime,
 			rec.ID, rec.UUID,
 			strconv.Itoa(rec.MaxActive),
 			strconv.Itoa(len(rec.AllowedClients)),
 			strconv.Itoa(len(rec.AliveMessages)),
+			group,
+			owner,
 			rec.MountPoint,
 			strconv.Itoa(len(rec.Key)),
 		)
@@ -126,243 +388,2016 @@ func ListKeys() error {
 	return nil
 }
 
-func UpdateRecord(db *keydb.DB, rec keydb.Record) error {
-	// Write record file and restart server to let it reload all records into memory
-	if _, err := db.Upsert(rec); err != nil {
-		return fmt.Errorf("Failed to update database record - %v", err)
+// recordDaemon is the running key server, administrative commands read and change records through its domain socket.
+type recordDaemon struct {
+	client   *keyserv.CryptClient
+	password string
+}
+
+var (
+	runningDaemon        *recordDaemon // runningDaemon is the key server found by getRecordDaemon, nil if it is not running.
+	runningDaemonChecked bool          // runningDaemonChecked is true once getRecordDaemon has looked for the key server.
+)
+
+/*
+Return the running key server, the password is asked only once per program run. Return nil if key server is not
+running, or is too old to change records on behalf of the administrator, in which case the record files are accessed
+directly.
+*/
+func getRecordDaemon() (*recordDaemon, error) {
+	if runningDaemonChecked {
+		return runningDaemon, nil
+	}
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if caps, err := client.GetCapabilities(); err != nil || !caps.Features[keyserv.FeatureRecordUpdate] {
+		runningDaemonChecked = true
+		return nil, nil
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+		return nil, err
+	}
+	useRecordDaemon(client, password)
+	return runningDaemon, nil
+}
+
+// Remember the connection to the running key server, whose password has been checked already, for reading and changing records.
+func useRecordDaemon(client *keyserv.CryptClient, password string) {
+	runningDaemon, runningDaemonChecked = nil, true
+	if caps, err := client.GetCapabilities(); err == nil && caps.Features[keyserv.FeatureRecordUpdate] {
+		runningDaemon = &recordDaemon{client: client, password: password}
+	}
+}
+
+/*
+Replace the record read from file by the one the running key server holds in memory, which carries the latest record
+usage. The key content is still taken from the file, as key server does not hand it out.
+*/
+func refreshFromDaemon(db *keydb.DB, daemon *recordDaemon, uuid string) error {
+	resp, err := daemon.client.GetRecord(keyserv.GetRecordReq{PlainPassword: daemon.password, UUID: uuid})
+	if err != nil {
+		return err
+	}
+	rec := resp.Record
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	if fileRec, found := db.RecordsByUUID[rec.UUID]; found {
+		rec.Key = fileRec.Key
+		delete(db.RecordsByID, fileRec.ID)
+	}
+	db.RecordsByUUID[rec.UUID] = rec
+	db.RecordsByID[rec.ID] = rec
+	return nil
+}
+
+/*
+UpdateRecord saves the record and records the action in audit log. If key server is running, it saves the change
+itself, and keeps the record usage it has gathered since the record was read (e.g. alive messages), so that neither
+is lost nor does key server have to reload. Otherwise the record file is written directly.
+*/
+func UpdateRecord(db *keydb.DB, rec keydb.Record, action string) error {
+	daemon, err := getRecordDaemon()
+	if err == nil {
+		err = saveRecord(db, daemon, rec, action)
+	}
+	if err != nil {
+		return err
 	}
 	fmt.Println("Record has been updated successfully.")
+	if daemon != nil {
+		return nil
+	}
+	// A key server that cannot change records by itself still has to pick up the record file
+	return reloadKeyServer()
+}
+
+/*
+Save the record through the running key server if there is one, otherwise write the record file, and record the action
+in audit log. A key server that is not running the record daemon is not made to pick up the record file.
+*/
+func saveRecord(db *keydb.DB, daemon *recordDaemon, rec keydb.Record, action string) (err error) {
+	if daemon != nil {
+		err = daemon.client.UpdateRecordFields(keyserv.UpdateRecordFieldsReq{PlainPassword: daemon.password, Record: rec})
+	} else {
+		_, err = db.Upsert(rec)
+	}
+	if err != nil {
+		auditAdminAction(action, rec.UUID, keyserv.AuditResultFailed, err.Error())
+		return fmt.Errorf("Failed to update database record - %v", err)
+	}
+	auditAdminAction(action, rec.UUID, keyserv.AuditResultGranted, "")
+	return nil
+}
+
+// Ask a running key server to reload its records, or restart it if it cannot reload.
+func reloadKeyServer() error {
 	if sys.SystemctlIsRunning(SERVER_DAEMON) {
-		fmt.Println("Restarting key server...")
-		if err := sys.SystemctlEnableRestart(SERVER_DAEMON); err != nil {
-			return err
+		fmt.Println("Reloading key server...")
+		if err := sys.SystemctlReload(SERVER_DAEMON); err != nil {
+			fmt.Printf("Failed to reload (%v), restarting key server instead...\n", err)
+			if err := sys.SystemctlEnableRestart(SERVER_DAEMON); err != nil {
+				return err
+			}
 		}
 		fmt.Println("All done.")
 	}
 	return nil
 }
 
-func AddAllowedClient(uuid, newClient string) error {
-	sys.LockMem()
-	db, err := OpenKeyDB(uuid)
+// DeviceSelectorAll selects every disk of the key database in place of a UUID.
+const DeviceSelectorAll = "all"
+
+/*
+Open the key database and return the records of the disks selected by UUID, by a UUID pattern such as "5f1c*", or by
+DeviceSelectorAll, in order of UUID. It is an error if nothing is selected.
+*/
+func selectDevices(selector string) (*keydb.DB, []keydb.Record, error) {
+	if selector != DeviceSelectorAll && !strings.ContainsAny(selector, "*?[") {
+		db, err := OpenKeyDB(selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		rec, found := db.GetByUUID(selector)
+		if !found {
+			return nil, nil, db.NotFoundError(selector, nil)
+		}
+		return db, []keydb.Record{rec}, nil
+	}
+	if _, err := path.Match(selector, ""); err != nil {
+		return nil, nil, fmt.Errorf("Device pattern \"%s\" is malformed - %v", selector, err)
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return nil, nil, err
+	}
+	selected := keydb.RecordSlice{}
+	for _, rec := range db.List() {
+		if matched, _ := path.Match(selector, rec.UUID); matched || selector == DeviceSelectorAll {
+			selected = append(selected, rec)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, nil, fmt.Errorf("No disk matches \"%s\"", selector)
+	}
+	selected.SortBy(keydb.SortByUUID)
+	return db, selected, nil
+}
+
+/*
+Apply the change to the allowed clients of every disk in a single pass. The change returns the new allowed
+clients along with the clients that left them unchanged, and the record is saved only if something changed. A key server
+that cannot change records by itself is reloaded once at the end. A record that fails to be saved does not stop the
+others from being changed, the failures are summarised in the returned error.
+*/
+func changeAllowedClients(db *keydb.DB, recs []keydb.Record, action, unchangedVerb string, change func(rec keydb.Record) (newClients, unchanged []string)) error {
+	daemon, err := getRecordDaemon()
 	if err != nil {
 		return err
 	}
-	rec, found := db.GetByUUID(uuid)
-	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
+	modified, failures := 0, []string{}
+	for _, rec := range recs {
+		newClients, unchanged := change(rec)
+		if len(unchanged) > 0 {
+			fmt.Printf("%s %s %s\n", rec.UUID, unchangedVerb, strings.Join(unchanged, ", "))
+		}
+		if len(newClients) == len(rec.AllowedClients) {
+			continue
+		}
+		rec.AllowedClients = newClients
+		if err := saveRecord(db, daemon, rec, action); err != nil {
+			fmt.Printf("%s: %v\n", rec.UUID, err)
+			failures = append(failures, rec.UUID)
+			continue
+		}
+		modified++
+	}
+	fmt.Printf("%d of %d records have been modified.\n", modified, len(recs))
+	if modified > 0 && daemon == nil {
+		// A key server that cannot change records by itself still has to pick up the record files
+		if err := reloadKeyServer(); err != nil {
+			return err
+		}
 	}
-	if !helper.Contains(rec.AllowedClients, newClient) {
-		rec.AllowedClients = append(rec.AllowedClients, newClient)
-		return UpdateRecord(db, rec)
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to update %d records: %s", len(failures), strings.Join(failures, ", "))
 	}
-	fmt.Println("Nothing to do. Client already contained")
 	return nil
 }
 
-func DeleteAllowedClient(uuid, client string) error {
+/*
+Server - allow clients to access the disk, or every disk matching a UUID pattern, or DeviceSelectorAll. A client may be
+given by its DNS name or IP, by a DNS name pattern such as "node-*.example.com", by a subnet such as "10.20.0.0/16", or
+by a client group "@name".
+*/
+func AddAllowedClient(selector string, newClients []string) error {
 	sys.LockMem()
-	db, err := OpenKeyDB(uuid)
+	clients := make([]string, 0, len(newClients))
+	for _, newClient := range newClients {
+		newClient = strings.TrimSpace(newClient)
+		if err := keydb.ValidateAllowedClient(newClient); err != nil {
+			return err
+		}
+		clients = append(clients, newClient)
+	}
+	db, recs, err := selectDevices(selector)
 	if err != nil {
 		return err
 	}
-	rec, found := db.GetByUUID(uuid)
-	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
+	for _, newClient := range clients {
+		if keydb.AllowedClientType(newClient) == keydb.AllowedClientGroup {
+			if _, found := db.ClientGroups[strings.TrimPrefix(newClient, keydb.ClientGroupPrefix)]; !found {
+				return fmt.Errorf("Client group \"%s\" does not exist, create it with create-group first", newClient)
+			}
+		}
+	}
+	return changeAllowedClients(db, recs, "AddAllowedClient", "already allows", func(rec keydb.Record) (newClients, unchanged []string) {
+		newClients = append([]string{}, rec.AllowedClients...)
+		for _, client := range clients {
+			if helper.Contains(newClients, client) {
+				unchanged = append(unchanged, client)
+			} else {
+				newClients = append(newClients, client)
+			}
+		}
+		return
+	})
+}
+
+/*
+Server - remove allowed client entries from the disk, or every disk matching a UUID pattern, or DeviceSelectorAll. The
+entries must be given in the same form they were added. As a key without allowed clients may be retrieved by any
+computer, a record is left unchanged rather than losing its last allowed client, unless force is given. The records
+left unchanged this way are listed in the returned error.
+*/
+func DeleteAllowedClient(selector string, clients []string, force bool) error {
+	sys.LockMem()
+	for i := range clients {
+		clients[i] = strings.TrimSpace(clients[i])
+	}
+	db, recs, err := selectDevices(selector)
+	if err != nil {
+		return err
 	}
-	if helper.Contains(rec.AllowedClients, client) {
-		a := []string{}
-		for _, s := range rec.AllowedClients {
-			if s != client {
-				a = append(a, s)
+	skipped := []string{}
+	err = changeAllowedClients(db, recs, "DeleteAllowedClient", "does not allow", func(rec keydb.Record) (newClients, unchanged []string) {
+		for _, client := range clients {
+			if !helper.Contains(rec.AllowedClients, client) {
+				unchanged = append(unchanged, client)
 			}
 		}
-		rec.AllowedClients = a
-		return UpdateRecord(db, rec)
+		newClients, err := keydb.RemoveAllowedClients(rec.AllowedClients, clients, force)
+		if err != nil {
+			fmt.Printf("%s: %v, skipped\n", rec.UUID, err)
+			skipped = append(skipped, rec.UUID)
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("%d records were left unchanged to keep their last allowed client, add -force to remove it regardless: %s",
+			len(skipped), strings.Join(skipped, ", "))
 	}
-	fmt.Println("Nothing to do. Client not contained")
 	return nil
 }
 
-func ListAllowedClient(uuid string) error {
+// AllowedClientEntry is an allowed client of a disk as presented by list-allowed-clients in JSON.
+type AllowedClientEntry struct {
+	Type  string `json:"type"`
+	Entry string `json:"entry"`
+}
+
+// AllowedClientsInfo is the presentation of list-allowed-clients in JSON, no allowed clients means any client is allowed.
+type AllowedClientsInfo struct {
+	UUID             string               `json:"uuid"`
+	AllowedClients   []AllowedClientEntry `json:"allowed_clients"`
+	EffectiveClients string               `json:"effective_allowed_clients,omitempty"`
+}
+
+// Server - print the allowed clients of a disk along with their types, and with client groups resolved.
+func ListAllowedClient(uuid, output string) error {
 	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
 	db, err := OpenKeyDB(uuid)
 	if err != nil {
 		return err
 	}
 	rec, found := db.GetByUUID(uuid)
 	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
+		return db.NotFoundError(uuid, nil)
+	}
+	if output == OutputJSON {
+		info := AllowedClientsInfo{UUID: uuid, AllowedClients: []AllowedClientEntry{}, EffectiveClients: effectiveAllowedClients(db, rec)}
+		for _, entry := range rec.AllowedClients {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				info.AllowedClients = append(info.AllowedClients, AllowedClientEntry{Type: keydb.AllowedClientType(entry), Entry: entry})
+			}
+		}
+		return printJSON(info)
+	}
+	if helper.IsEmpty(rec.AllowedClients) {
+		fmt.Printf("%s does not restrict its clients\n", uuid)
+		return nil
+	}
+	fmt.Printf("Allowed clients of %s (exact entries take precedence, then patterns, then the most specific subnet):\n", uuid)
+	for _, entry := range rec.AllowedClients {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			fmt.Printf("%-6s %s\n", keydb.AllowedClientType(entry), entry)
+		}
+	}
+	if effectiveClients := effectiveAllowedClients(db, rec); effectiveClients != "" {
+		fmt.Printf("Effective allowed clients with client groups resolved: %s\n", effectiveClients)
 	}
-	fmt.Println(uuid, rec.GetAllowedClients())
 	return nil
 }
 
+/*
+Return the allowed clients of the record with client groups resolved into their members, or an empty string if the
+record does not refer to any client group.
+*/
+func effectiveAllowedClients(db *keydb.DB, rec keydb.Record) string {
+	refersToGroup := false
+	for _, entry := range rec.AllowedClients {
+		if keydb.AllowedClientType(strings.TrimSpace(entry)) == keydb.AllowedClientGroup {
+			refersToGroup = true
+		}
+	}
+	if !refersToGroup {
+		return ""
+	}
+	expanded, err := db.ExpandAllowedClients(rec)
+	if err != nil {
+		return fmt.Sprintf("(none, %v)", err)
+	} else if len(expanded) == 0 {
+		return "(none, the client groups are empty or missing)"
+	}
+	return strings.Join(expanded, " ")
+}
+
+// Return the file system check policy, an empty policy means the default.
+func fsckPolicyOrDefault(policy string) string {
+	if policy == "" {
+		return keydb.FsckPreen
+	}
+	return policy
+}
+
+/*
+Return true if the mount options are valid and the user confirms those unknown to the file system, which are likely
+typos. Errors and warnings are printed.
+*/
+func confirmMountOptions(fsType string, options []string) bool {
+	unknown, err := fs.ValidateMountOptions(fsType, options)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	if len(unknown) > 0 {
+		return sys.InputBool(false, MSG_ASK_UNKNOWN_MOUNT_OPT, strings.Join(unknown, ","))
+	}
+	return true
+}
+
 // Server - let user edit key details such as mount point and mount options
 func EditKey(uuid string) error {
 	sys.LockMem()
+	if err := keydb.ValidateDeviceID(uuid); err != nil {
+		return err
+	}
 	db, err := OpenKeyDB(uuid)
 	if err != nil {
 		return err
 	}
 	rec, found := db.GetByUUID(uuid)
 	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
+		return db.NotFoundError(uuid, nil)
 	}
 	// Similar to the encryption routine, ask user all the configuration questions.
 	newMountPoint := sys.Input(false, rec.MountPoint, "Mount point")
 	if newMountPoint != "" {
 		rec.MountPoint = newMountPoint
 	}
-	newOptions := sys.Input(false, strings.Join(rec.MountOptions, ","), "Mount options (space-separated)")
-	if newOptions != "" {
-		rec.MountOptions = strings.Split(newOptions, ",")
+	for {
+		newOptions := sys.Input(false, rec.GetMountOptionStr(), MSG_ASK_MOUNT_OPT)
+		if newOptions == "" {
+			break
+		}
+		options := fs.ParseMountOptions(newOptions)
+		if !confirmMountOptions(rec.FileSystem, options) {
+			continue
+		}
+		rec.MountOptions = options
+		break
 	}
 	rec.MaxActive = sys.InputInt(false, rec.MaxActive, 1, 99999, MSG_ASK_MAX_ACTIVE)
 
-	newAliveTimeout := sys.InputInt(false, rec.AliveIntervalSec*rec.AliveCount, DEFUALT_ALIVE_TIMEOUT, 3600*24*7, MSG_ASK_ALIVE_TIMEOUT)
-	if newAliveTimeout != 0 {
-		roundedAliveTimeout := newAliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC * routine.REPORT_ALIVE_INTERVAL_SEC
-		if roundedAliveTimeout != newAliveTimeout {
-			fmt.Printf(MSG_ALIVE_TIMEOUT_ROUNDED, roundedAliveTimeout)
-		}
-		rec.AliveCount = roundedAliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC
+	// Computers learn of a new interval the next time they retrieve the key, until then they report at the old one.
+	aliveTimeout := rec.AliveIntervalSec * rec.AliveCount
+	rec.AliveIntervalSec = sys.InputInt(false, rec.AliveIntervalSec, 1, routine.MAX_REPORT_ALIVE_INTERVAL_SEC, MSG_ASK_ALIVE_INTERVAL)
+	if newAliveTimeout := sys.InputInt(false, aliveTimeout, DEFUALT_ALIVE_TIMEOUT, 3600*24*7, MSG_ASK_ALIVE_TIMEOUT); newAliveTimeout != 0 {
+		aliveTimeout = newAliveTimeout
+	}
+	roundedAliveTimeout, aliveCount := routine.RoundAliveTimeout(aliveTimeout, rec.AliveIntervalSec)
+	if roundedAliveTimeout != aliveTimeout {
+		fmt.Printf(MSG_ALIVE_TIMEOUT_ROUNDED, roundedAliveTimeout)
 	}
-	rec.AutoEncryption = sys.InputBool(rec.AutoEncryption, "Enable auto encrytion")
+	rec.AliveCount = aliveCount
+	rec.AutoEncryption = sys.InputBool(rec.AutoEncryption, "Enable auto encryption")
+	rec.SealToTPM = sys.InputBool(rec.SealToTPM, MSG_ASK_SEAL_TO_TPM)
+	if rec.SealToTPM {
+		rec.SealMaxHours = sys.InputInt(false, rec.SealMaxHours, 0, 24*366, MSG_ASK_SEAL_MAX_HOURS)
+	}
+	// The encryption header cannot be changed by editing the record, hence the options are only shown.
+	fmt.Printf("Encryption options (cannot be changed): %s\n", rec.CryptOptions.String())
 
 	if rec.AutoEncryption {
-		rec.FileSystem = sys.Input(false, rec.FileSystem, "File system to be created.", "ext4", "ext3", "xfs", "btrfs")
+		rec.FileSystem = sys.Input(false, rec.FileSystem, "File system to be created (ext4, ext3, xfs, btrfs)")
+		rec.AutoEncryptForce = sys.InputBool(rec.AutoEncryptForce, "Also auto encrypt a disk that is not blank, destroying its content")
 	}
 
 	rec.AliveCount = sys.InputInt(true, rec.AliveCount, 2, 999, "Count of keeped alive packages. Min 2")
 
-	return UpdateRecord(db, rec)
-}
-
-// Server - show key record details but hide key content
-func ShowKey(uuid string) error {
-	sys.LockMem()
-	db, err := OpenKeyDB(uuid)
-	if err != nil {
-		return err
+	if newGroup := sys.Input(false, rec.Group, MSG_ASK_GROUP); newGroup == "-" {
+		rec.Group = ""
+		rec.GroupPriority = 0
+	} else if newGroup != "" {
+		rec.Group = newGroup
 	}
-	rec, found := db.GetByUUID(uuid)
-	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
+	if rec.Group != "" {
+		rec.GroupPriority = sys.InputInt(false, rec.GroupPriority, 0, 9999, MSG_ASK_GROUP_PRIORITY)
 	}
-	rec.RemoveDeadHosts()
-	fmt.Printf("%-34s%s\n", "UUID", rec.UUID)
-	fmt.Printf("%-34s%s\n", "MappedName", rec.MappedName)
-	fmt.Printf("%-34s%s\n", "Mount Point", rec.MountPoint)
-	fmt.Printf("%-34s%s\n", "Mount Options", rec.GetMountOptionStr())
-	fmt.Printf("%-34s%s\n", "Allowed Clients", rec.GetAllowedClients())
-	fmt.Printf("%-34s%d\n", "Maximum Computers", rec.MaxActive)
-	fmt.Printf("%-34s%s\n", "Auto Encryption", strconv.FormatBool(rec.AutoEncryption))
-	fmt.Printf("%-34s%s\n", "File System", rec.FileSystem)
-	fmt.Printf("%-34s%d\n", "Computer Keep-Alive Timeout (sec)", rec.AliveCount*rec.AliveIntervalSec)
-	fmt.Printf("%-34s%s (%s)\n", "Last Retrieved By", rec.LastRetrieval.IP, rec.LastRetrieval.Hostname)
-	outputTime := time.Unix(rec.LastRetrieval.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
-	fmt.Printf("%-34s%d\n", "Last Retrieved On in sec", rec.LastRetrieval.Timestamp)
-	fmt.Printf("%-34s%s\n", "Last Retrieved On", outputTime)
-	fmt.Printf("%-34s%d\n", "Current Active Computers", len(rec.AliveMessages))
-	fmt.Printf("%-34s[% x]\n", "Encryption Key", rec.Key)
-	if len(rec.AliveMessages) > 0 {
-		// Print alive message's details from each computer
-		for _, msgs := range rec.AliveMessages {
-			for _, msg := range msgs {
-				outputTime := time.Unix(msg.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
-				fmt.Printf("%-34s%s %s (%s)\n", "", outputTime, msg.IP, msg.Hostname)
-			}
+	for {
+		newBinds := sys.Input(false, rec.GetBindMountStr(), MSG_ASK_BIND_MOUNTS)
+		if newBinds == "" {
+			break
+		} else if newBinds == "-" {
+			rec.BindMounts = nil
+			break
 		}
-	}
-	fmt.Printf("%-34s%d\n", "Pending Commands", len(rec.PendingCommands))
+		binds, err := keydb.ParseBindMounts(newBinds)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		rec.BindMounts = binds
+		if err := rec.ValidateBindMounts(); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		break
+	}
+	for {
+		newTags := sys.Input(false, rec.GetTagStr(), MSG_ASK_TAGS)
+		if newTags == "" {
+			break
+		} else if newTags == "-" {
+			rec.Tags = nil
+			break
+		}
+		tags, err := keydb.ParseTags(newTags)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		rec.Tags = tags
+		break
+	}
+	for {
+		newPolicy := sys.Input(false, rec.FsckPolicy, MSG_ASK_FSCK_POLICY)
+		if newPolicy == "" {
+			break
+		}
+		if err := keydb.ValidateFsckPolicy(newPolicy); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		rec.FsckPolicy = newPolicy
+		break
+	}
+	for {
+		newUnlockAfter := sys.Input(false, rec.GetUnlockAfterStr(), MSG_ASK_UNLOCK_AFTER)
+		if newUnlockAfter == "" {
+			break
+		} else if newUnlockAfter == "-" {
+			rec.UnlockAfter = nil
+			break
+		}
+		rec.UnlockAfter = keydb.ParseUnlockAfter(newUnlockAfter)
+		if err := rec.ValidateUnlockAfter(); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if err := db.CheckUnlockAfter(rec); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		break
+	}
+	for {
+		newWindows := sys.Input(false, rec.GetUnlockWindowsStr(), MSG_ASK_UNLOCK_WINDOWS)
+		if newWindows == "" {
+			break
+		} else if newWindows == "-" {
+			rec.UnlockWindows = nil
+			rec.UmountAtWindowEnd = false
+			break
+		}
+		windows, err := keydb.ParseUnlockWindows(newWindows)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		rec.UnlockWindows = windows
+		break
+	}
+	if len(rec.UnlockWindows) > 0 {
+		rec.UmountAtWindowEnd = sys.InputBool(rec.UmountAtWindowEnd, MSG_ASK_UMOUNT_AT_WINDOW)
+	}
+
+	return UpdateRecord(db, rec, "EditKey")
+}
+
+/*
+Server - show key record details but hide key content. With history, show the versions kept of the record and its
+key retrieval history instead.
+*/
+func ShowKey(uuid, output string, history bool) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	if err := keydb.ValidateDeviceID(uuid); err != nil {
+		return err
+	}
+	if history {
+		return showKeyHistory(uuid, output)
+	}
+	db, err := OpenKeyDB(uuid)
+	if err != nil {
+		return err
+	}
+	rec, found := db.GetByUUID(uuid)
+	if !found {
+		return db.NotFoundError(uuid, nil)
+	}
+	rec.RemoveDeadHosts()
+	rec.RemoveExpiredPendingCommands()
+	effectiveClients := effectiveAllowedClients(db, rec)
+	warnMaintenance(db, output)
+	if output == OutputJSON {
+		info := newKeyInfo(rec)
+		info.EffectiveClients = effectiveClients
+		return printJSON(info)
+	}
+	fmt.Printf("%-34s%s\n", "UUID", rec.UUID)
+	fmt.Printf("%-34s%s\n", "MappedName", rec.MappedName)
+	fmt.Printf("%-34s%s\n", "Mount Point", rec.MountPoint)
+	fmt.Printf("%-34s%s\n", "Mount Options", rec.GetMountOptionStr())
+	fmt.Printf("%-34s%s\n", "Allowed Clients", rec.GetAllowedClients())
+	if effectiveClients != "" {
+		fmt.Printf("%-34s%s\n", "Effective Allowed Clients", effectiveClients)
+	}
+	fmt.Printf("%-34s%d\n", "Maximum Computers", rec.MaxActive)
+	fmt.Printf("%-34s%s\n", "Auto Encryption", strconv.FormatBool(rec.AutoEncryption))
+	if rec.AutoEncryptForce {
+		fmt.Printf("%-34s%s\n", "Auto Encrypt Non-Blank Disks", strconv.FormatBool(rec.AutoEncryptForce))
+	}
+	if rec.IsAutoEncrypted() {
+		fmt.Printf("%-34s%s on %s\n", "Auto Encrypted By", rec.AutoEncryptedBy.DescribeHost(),
+			time.Unix(rec.AutoEncryptedBy.Timestamp, 0).Format(TIME_OUTPUT_FORMAT))
+	}
+	fmt.Printf("%-34s%s\n", "File System", rec.FileSystem)
+	fmt.Printf("%-34s%s\n", "Encryption Options", rec.CryptOptions.String())
+	fmt.Printf("%-34s%s\n", "Seal Key in Client TPM2", strconv.FormatBool(rec.SealToTPM))
+	if rec.SealToTPM && rec.SealMaxHours > 0 {
+		fmt.Printf("%-34s%d\n", "Sealed Key Max Age (Hours)", rec.SealMaxHours)
+	}
+	if rec.Group != "" {
+		fmt.Printf("%-34s%s\n", "Consistency Group", rec.Group)
+		fmt.Printf("%-34s%d\n", "Group Priority", rec.GroupPriority)
+	}
+	for _, bind := range rec.BindMounts {
+		fmt.Printf("%-34s%s\n", "Bind-Mount", bind.String())
+	}
+	if len(rec.Tags) > 0 {
+		fmt.Printf("%-34s%s\n", "Tags", rec.GetTagStr())
+	}
+	if rec.Owner != "" {
+		fmt.Printf("%-34s%s\n", "Owner", rec.Owner)
+	}
+	fmt.Printf("%-34s%s\n", "File System Check", fsckPolicyOrDefault(rec.FsckPolicy))
+	if rec.TangURL != "" {
+		fmt.Printf("%-34s%s\n", "Tang Server", rec.TangURL)
+	}
+	if len(rec.UnlockAfter) > 0 {
+		fmt.Printf("%-34s%s\n", "Unlock After", rec.GetUnlockAfterStr())
+	}
+	if len(rec.UnlockWindows) > 0 {
+		fmt.Printf("%-34s%s (time zone %s)\n", "Unlock Windows", rec.GetUnlockWindowsStr(), time.Local)
+		fmt.Printf("%-34s%s\n", "Umount at Window End", strconv.FormatBool(rec.UmountAtWindowEnd))
+	}
+	fmt.Printf("%-34s%d\n", "Computer Keep-Alive Interval (sec)", rec.AliveIntervalSec)
+	fmt.Printf("%-34s%d\n", "Computer Keep-Alive Timeout (sec)", rec.AliveCount*rec.AliveIntervalSec)
+	fmt.Printf("%-34s%s\n", "Last Retrieved By", rec.LastRetrieval.DescribeHost())
+	outputTime := time.Unix(rec.LastRetrieval.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
+	fmt.Printf("%-34s%d\n", "Last Retrieved On in sec", rec.LastRetrieval.Timestamp)
+	fmt.Printf("%-34s%s\n", "Last Retrieved On", outputTime)
+	if !rec.RotationTime.IsZero() {
+		fmt.Printf("%-34s%s\n", "Key Rotated On", rec.RotationTime.Format(TIME_OUTPUT_FORMAT))
+	}
+	if rec.IsKeyForgotten() {
+		fmt.Printf("%-34s%s\n", "Key Destroyed On", rec.ForgetTime.Format(TIME_OUTPUT_FORMAT))
+	}
+	fmt.Printf("%-34s%d\n", "Current Active Computers", len(rec.AliveMessages))
+	fmt.Printf("%-34s[% x]\n", "Encryption Key", []byte(rec.Key))
+	if len(rec.AliveMessages) > 0 {
+		// Print alive message's details from each computer
+		for _, msgs := range rec.AliveMessages {
+			for _, msg := range msgs {
+				outputTime := time.Unix(msg.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
+				fmt.Printf("%-34s%s %s %s\n", "", outputTime, msg.DescribeHost(), msg.Health)
+			}
+		}
+	}
+	fmt.Printf("%-34s%d\n", "Client Errors", len(rec.ClientErrors))
+	for _, clientErr := range rec.ClientErrors {
+		lastSeen := time.Unix(clientErr.LastSeen, 0).Format(TIME_OUTPUT_FORMAT)
+		firstSeen := time.Unix(clientErr.FirstSeen, 0).Format(TIME_OUTPUT_FORMAT)
+		fmt.Printf("%-34s%s %s (%s) %s x%d since %s - %s\n", "", lastSeen, clientErr.Client, clientErr.Hostname,
+			clientErr.Class, clientErr.Count, firstSeen, clientErr.Message)
+	}
+	fmt.Printf("%-34s%d\n", "Lost Computers", len(rec.LostHosts))
+	for _, lost := range rec.LostHosts {
+		lastSeen := time.Unix(lost.LastSeen, 0).Format(TIME_OUTPUT_FORMAT)
+		lostAt := time.Unix(lost.LostAt, 0).Format(TIME_OUTPUT_FORMAT)
+		fmt.Printf("%-34s%s %s (%s) lost at %s, x%d\n", "", lastSeen, lost.IP, lost.Hostname, lostAt, lost.Count)
+	}
+	fmt.Printf("%-34s%d\n", "Evicted Computers", len(rec.Evictions))
+	for _, eviction := range rec.Evictions {
+		evictedAt := time.Unix(eviction.EvictedAt, 0).Format(TIME_OUTPUT_FORMAT)
+		fmt.Printf("%-34s%s %s (%s) evicted for %s by %s\n", "", evictedAt, eviction.IP, eviction.Hostname, eviction.ForHost, eviction.EvictedBy)
+	}
+	fmt.Printf("%-34s%d\n", "Rejected Retrievals", len(rec.Rejections))
+	for i, rej := range rec.Rejections {
+		if i == ShowKeyRejections {
+			fmt.Printf("%-34s... %d more, see -output=json\n", "", len(rec.Rejections)-ShowKeyRejections)
+			break
+		}
+		fmt.Printf("%-34s%s %s\n", "", time.Unix(rej.Time, 0).Format(TIME_OUTPUT_FORMAT), rej)
+	}
+	fmt.Printf("%-34s%d\n", "Unlock Tokens", len(rec.UnlockTokens))
+	for _, token := range rec.UnlockTokens {
+		desc := fmt.Sprintf("%s %s, expires %s", token.ID, token.StatusAt(time.Now()), token.ExpiresAt.Format(TIME_OUTPUT_FORMAT))
+		if token.Hostname != "" {
+			desc += ", only for " + token.Hostname
+		}
+		if token.IsUsed() {
+			desc += fmt.Sprintf(", used by %s on %s", token.UsedBy, token.UsedAt.Format(TIME_OUTPUT_FORMAT))
+		}
+		fmt.Printf("%-34s%s\n", "", desc)
+	}
+	fmt.Printf("%-34s%d\n", "Pending Commands", len(rec.PendingCommands))
 	if len(rec.PendingCommands) > 0 {
 		for ip, cmds := range rec.PendingCommands {
 			for _, cmd := range cmds {
 				validFromStr := cmd.ValidFrom.Format(TIME_OUTPUT_FORMAT)
 				validTillStr := cmd.ValidFrom.Add(cmd.Validity).Format(TIME_OUTPUT_FORMAT)
-				fmt.Printf("%45s\tValidFrom=\"%s\"\tValidTo=\"%s\"\tContent=\"%v\"\tFetched? %v\tResult=\"%v\"\n",
-					ip, validFromStr, validTillStr, cmd.Content, cmd.SeenByClient, cmd.ClientResult)
+				resultTimeStr := ""
+				if !cmd.ResultTime.IsZero() {
+					resultTimeStr = cmd.ResultTime.Format(TIME_OUTPUT_FORMAT)
+					if cmd.Duration > 0 {
+						resultTimeStr += fmt.Sprintf(" (took %s)", cmd.Duration.Round(time.Millisecond))
+					}
+				}
+				content := fmt.Sprint(cmd.Content)
+				if cmd.Confirmed {
+					content += " (confirmed)"
+				}
+				fmt.Printf("%45s\tValidFrom=\"%s\"\tValidTo=\"%s\"\tContent=\"%s\"\tGroup=\"%s\"\tFetched? %v\tStatus=%s\tResultTime=\"%s\"\tResult=\"%v\"\n",
+					ip, validFromStr, validTillStr, content, cmd.Group, cmd.SeenByClient, cmd.Status(), resultTimeStr, cmd.ClientResult)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PendingCommandInfo is a pending command of a record as presented by show-key in JSON.
+type PendingCommandInfo struct {
+	IP           string     `json:"ip"`                    // IP is the client computer's IP the command is issued to.
+	ValidFrom    time.Time  `json:"valid_from"`            // ValidFrom is the moment the command was issued.
+	ValidTo      time.Time  `json:"valid_to"`              // ValidTo is the moment the command expires.
+	Content      string     `json:"content"`               // Content is the command, e.g. "umount".
+	Group        string     `json:"group,omitempty"`       // Group is the consistency group the command was issued to.
+	Confirmed    bool       `json:"confirmed,omitempty"`   // Confirmed is true if the administrator confirmed a destructive command.
+	Fetched      bool       `json:"fetched"`               // Fetched is true once the client has fetched the command.
+	Status       string     `json:"status"`                // Status is one of the keydb.PendingCommandStatus* constants.
+	ResultTime   *time.Time `json:"result_time,omitempty"` // ResultTime is the moment client reported the result.
+	ClientResult string     `json:"result,omitempty"`      // ClientResult is the message reported by client.
+	DurationMS   int64      `json:"duration_ms,omitempty"` // DurationMS is how long the client took to carry out the command in milliseconds.
+}
+
+// UnlockTokenInfo is an unlock token of a record as presented by show-key in JSON, the token itself is never shown.
+type UnlockTokenInfo struct {
+	ID        string     `json:"id"`                 // ID identifies the token.
+	Hostname  string     `json:"hostname,omitempty"` // Hostname is the only computer that may use the token.
+	CreatedAt time.Time  `json:"created_at"`         // CreatedAt is the moment the token was created.
+	ExpiresAt time.Time  `json:"expires_at"`         // ExpiresAt is the moment the token can no longer be used.
+	Status    string     `json:"status"`             // Status is one of the keydb.UnlockTokenStatus* constants.
+	UsedAt    *time.Time `json:"used_at,omitempty"`  // UsedAt is the moment the token was used.
+	UsedBy    string     `json:"used_by,omitempty"`  // UsedBy is the computer that used the token.
+}
+
+// KeyInfo is a key record as presented by show-key in JSON. The encryption key itself is not included.
+type KeyInfo struct {
+	UUID             string                `json:"uuid"`
+	MappedName       string                `json:"mapped_name"`
+	MountPoint       string                `json:"mount_point"`
+	MountOptions     []string              `json:"mount_options"`
+	AllowedClients   string                `json:"allowed_clients"`
+	EffectiveClients string                `json:"effective_allowed_clients,omitempty"`
+	MaxActive        int                   `json:"max_active"`
+	AutoEncryption   bool                  `json:"auto_encryption"`
+	AutoEncryptForce bool                  `json:"auto_encrypt_force,omitempty"`
+	AutoEncryptedBy  string                `json:"auto_encrypted_by,omitempty"`
+	AutoEncryptedIP  string                `json:"auto_encrypted_ip,omitempty"`
+	AutoEncryptedOn  int64                 `json:"auto_encrypted_on,omitempty"`
+	FileSystem       string                `json:"file_system"`
+	CryptOptions     fs.CryptFormatOptions `json:"crypt_options"`
+	SealToTPM        bool                  `json:"seal_to_tpm"`
+	SealMaxHours     int                   `json:"seal_max_hours,omitempty"`
+	Group            string                `json:"group,omitempty"`
+	GroupPriority    int                   `json:"group_priority,omitempty"`
+	Tags             map[string]string     `json:"tags,omitempty"`
+	Owner            string                `json:"owner,omitempty"`
+	UnlockAfter      []string              `json:"unlock_after,omitempty"`
+	FsckPolicy       string                `json:"fsck_policy"`
+	TangURL          string                `json:"tang_url,omitempty"`
+	UnlockWindows    string                `json:"unlock_windows,omitempty"`
+	UmountAtWindow   bool                  `json:"umount_at_window_end,omitempty"`
+	KeepAliveSec     int                   `json:"keep_alive_timeout_sec"`
+	AliveInterval    int                   `json:"keep_alive_interval_sec"`
+	LastRetrievedBy  string                `json:"last_retrieved_by"`
+	LastRetrievedIP  string                `json:"last_retrieved_ip"`
+	LastRetrievedCN  string                `json:"last_retrieved_cert_name,omitempty"`
+	LastMismatch     bool                  `json:"last_retrieval_identity_mismatch,omitempty"`
+	LastRetrievedOn  int64                 `json:"last_retrieved_on"`
+	RotatedOn        *time.Time            `json:"rotated_on,omitempty"`
+	KeyDestroyedOn   *time.Time            `json:"key_destroyed_on,omitempty"`
+	AliveHosts       []keydb.AliveHost     `json:"alive_hosts"`
+	ClientErrors     []keydb.ClientError   `json:"client_errors"`
+	LostHosts        []keydb.LostHost      `json:"lost_hosts"`
+	Evictions        []keydb.Eviction      `json:"evictions"`
+	Rejections       []keydb.Rejection     `json:"rejections"`
+	Retrievals       []keydb.Retrieval     `json:"retrievals"`
+	PendingCommands  []PendingCommandInfo  `json:"pending_commands"`
+	UnlockTokens     []UnlockTokenInfo     `json:"unlock_tokens"`
+}
+
+// Convert a record into its presentation for show-key in JSON, pending commands are sorted by IP and then by age.
+func newKeyInfo(rec keydb.Record) KeyInfo {
+	info := KeyInfo{
+		UUID:             rec.UUID,
+		MappedName:       rec.MappedName,
+		MountPoint:       rec.MountPoint,
+		MountOptions:     rec.MountOptions,
+		AllowedClients:   rec.GetAllowedClients(),
+		MaxActive:        rec.MaxActive,
+		AutoEncryption:   rec.AutoEncryption,
+		AutoEncryptForce: rec.AutoEncryptForce,
+		AutoEncryptedBy:  rec.AutoEncryptedBy.Hostname,
+		AutoEncryptedIP:  rec.AutoEncryptedBy.IP,
+		AutoEncryptedOn:  rec.AutoEncryptedBy.Timestamp,
+		FileSystem:       rec.FileSystem,
+		CryptOptions:     rec.CryptOptions,
+		SealToTPM:        rec.SealToTPM,
+		SealMaxHours:     rec.SealMaxHours,
+		Group:            rec.Group,
+		GroupPriority:    rec.GroupPriority,
+		Tags:             rec.Tags,
+		Owner:            rec.Owner,
+		UnlockAfter:      rec.UnlockAfter,
+		FsckPolicy:       fsckPolicyOrDefault(rec.FsckPolicy),
+		TangURL:          rec.TangURL,
+		UnlockWindows:    rec.GetUnlockWindowsStr(),
+		UmountAtWindow:   rec.UmountAtWindowEnd,
+		KeepAliveSec:     rec.AliveCount * rec.AliveIntervalSec,
+		AliveInterval:    rec.AliveIntervalSec,
+		LastRetrievedBy:  rec.LastRetrieval.Hostname,
+		LastRetrievedIP:  rec.LastRetrieval.IP,
+		LastRetrievedCN:  rec.LastRetrieval.CertName,
+		LastMismatch:     rec.LastRetrieval.IdentityMismatch(),
+		LastRetrievedOn:  rec.LastRetrieval.Timestamp,
+		AliveHosts:       rec.ListAliveHosts(),
+		ClientErrors:     rec.ClientErrors,
+		LostHosts:        rec.LostHosts,
+		Evictions:        rec.Evictions,
+		Rejections:       rec.Rejections,
+		Retrievals:       rec.Retrievals,
+		PendingCommands:  make([]PendingCommandInfo, 0, len(rec.PendingCommands)),
+		UnlockTokens:     make([]UnlockTokenInfo, 0, len(rec.UnlockTokens)),
+	}
+	if !rec.RotationTime.IsZero() {
+		info.RotatedOn = &rec.RotationTime
+	}
+	if rec.IsKeyForgotten() {
+		info.KeyDestroyedOn = &rec.ForgetTime
+	}
+	ips := make([]string, 0, len(rec.PendingCommands))
+	for ip := range rec.PendingCommands {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		for _, cmd := range rec.PendingCommands[ip] {
+			cmdInfo := PendingCommandInfo{
+				IP:           ip,
+				ValidFrom:    cmd.ValidFrom,
+				ValidTo:      cmd.ValidFrom.Add(cmd.Validity),
+				Content:      fmt.Sprint(cmd.Content),
+				Group:        cmd.Group,
+				Confirmed:    cmd.Confirmed,
+				Fetched:      cmd.SeenByClient,
+				Status:       cmd.Status(),
+				ClientResult: cmd.ClientResult,
+				DurationMS:   cmd.Duration.Milliseconds(),
+			}
+			if !cmd.ResultTime.IsZero() {
+				resultTime := cmd.ResultTime
+				cmdInfo.ResultTime = &resultTime
+			}
+			info.PendingCommands = append(info.PendingCommands, cmdInfo)
+		}
+	}
+	now := time.Now()
+	for _, token := range rec.UnlockTokens {
+		tokenInfo := UnlockTokenInfo{
+			ID:        token.ID,
+			Hostname:  token.Hostname,
+			CreatedAt: token.CreatedAt,
+			ExpiresAt: token.ExpiresAt,
+			Status:    token.StatusAt(now),
+			UsedBy:    token.UsedBy,
+		}
+		if token.IsUsed() {
+			usedAt := token.UsedAt
+			tokenInfo.UsedAt = &usedAt
+		}
+		info.UnlockTokens = append(info.UnlockTokens, tokenInfo)
+	}
+	return info
+}
+
+/*
+Server - print one line for each computer that is currently using an encryption key. By default the key database
+directory is read; if live is true, the running key server is asked over its domain socket, it holds the most recent
+alive messages in memory.
+*/
+func ListAlive(uuid, host, output string, live bool) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	var hosts []keydb.AliveHost
+	if live {
+		client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+		if err != nil {
+			return err
+		}
+		password := inputServerPassword(true, "Enter key server's password (no echo)")
+		resp, err := client.ListAliveHosts(keyserv.ListAliveHostsReq{PlainPassword: password, UUID: uuid, Host: host})
+		if err != nil {
+			return err
+		}
+		hosts = resp.Hosts
+	} else {
+		db, err := OpenKeyDB("")
+		if err != nil {
+			return err
+		}
+		hosts = db.ListAliveHosts(uuid, host)
+	}
+	if output == OutputJSON {
+		return printJSON(hosts)
+	}
+	fmt.Printf("Total: %d computers (date and time are in zone %s)\n", len(hosts), time.Now().Format("MST"))
+	fmt.Println("UUID                                 IP              Last.Alive          Sec.Until.Dead Hostname         Health")
+	for _, aliveHost := range hosts {
+		fmt.Printf("%-36s %-15s %-19s %-14d %-16s %s\n",
+			aliveHost.UUID, aliveHost.IP, time.Unix(aliveHost.LastAlive, 0).Format(TIME_OUTPUT_FORMAT),
+			aliveHost.SecondsUntilDead, aliveHost.Hostname, aliveHost.Health)
+	}
+	return nil
+}
+
+// Open the disk inventory store configured for the key server, along with the age beyond which a report is stale.
+func openInventoryStore() (store *keyserv.InventoryStore, staleAge time.Duration, err error) {
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, true)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read configuration file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+	}
+	if !sysconf.GetBool(keyserv.SRV_CONF_INVENTORY_ENABLE, false) {
+		return nil, 0, fmt.Errorf("Disk inventory is disabled, set %s to \"yes\" in \"%s\" to enable it.", keyserv.SRV_CONF_INVENTORY_ENABLE, SERVER_CONFIG_PATH)
+	}
+	retention := time.Duration(sysconf.GetInt(keyserv.SRV_CONF_INVENTORY_RETENTION, keyserv.DefaultInventoryRetentionDays)) * 24 * time.Hour
+	staleAge = time.Duration(sysconf.GetInt(keyserv.SRV_CONF_INVENTORY_STALE, keyserv.DefaultInventoryStaleHours)) * time.Hour
+	store, err = keyserv.NewInventoryStore(sysconf.GetString(keyserv.SRV_CONF_INVENTORY_DIR, keyserv.DefaultInventoryDir), retention)
+	return
+}
+
+// Server - print the disk inventory reported by client computers, or by only one client if its name is given.
+func ListClientInventory(clientName, output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	store, _, err := openInventoryStore()
+	if err != nil {
+		return fmt.Errorf("ListClientInventory: %v", err)
+	}
+	reports := store.List(clientName)
+	if output == OutputJSON {
+		return printJSON(reports)
+	}
+	fmt.Printf("Total: %d clients (date and time are in zone %s)\n", len(reports), time.Now().Format("MST"))
+	fmt.Println("Client           Reported            Device           Type   File.System  Size.GB  Encrypted Serial               Mount.Point")
+	for _, report := range reports {
+		for _, disk := range report.Disks {
+			fmt.Printf("%-16s %-19s %-16s %-6s %-12s %-8.1f %-9s %-20s %s\n",
+				report.Client, report.Time.Local().Format(TIME_OUTPUT_FORMAT), disk.Path, disk.Type, disk.FileSystem,
+				float64(disk.SizeByte)/(1<<30), strconv.FormatBool(disk.Encrypted), disk.Serial, disk.MountPoint)
+		}
+	}
+	return nil
+}
+
+// ClientInfo is the presentation of a client computer's latest device inventory for show-client in JSON.
+type ClientInfo struct {
+	keyserv.InventoryReport
+	Stale bool `json:"stale"`
+}
+
+/*
+Server - print the latest device inventory of a client computer, identified by its certificate common name, host name,
+or IP. The inventory is flagged stale if it is older than the configured age, send the "inventory" command to the
+computer to get a fresh one.
+*/
+func ShowClient(clientName, output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	} else if clientName == "" {
+		return errors.New("Please specify the client computer in -client parameter")
+	}
+	store, staleAge, err := openInventoryStore()
+	if err != nil {
+		return fmt.Errorf("ShowClient: %v", err)
+	}
+	report, found := store.Find(clientName)
+	if !found {
+		return fmt.Errorf("Client \"%s\" has not reported its devices, send the \"%s\" command to it first.", clientName, PendingCommandInventory)
+	}
+	info := ClientInfo{InventoryReport: report, Stale: report.IsStale(staleAge)}
+	if output == OutputJSON {
+		return printJSON(info)
+	}
+	reported := report.Time.Local().Format(TIME_OUTPUT_FORMAT)
+	if info.Stale {
+		reported += fmt.Sprintf(" (stale, older than %s)", staleAge)
+	}
+	fmt.Printf("%-34s%s\n", "Client", report.Client)
+	fmt.Printf("%-34s%s\n", "Hostname", report.Hostname)
+	fmt.Printf("%-34s%s\n", "IP", report.IP)
+	fmt.Printf("%-34s%s\n", "Reported", reported)
+	fmt.Printf("%-34s%t\n", "Encrypted Devices Only", report.CryptOnly)
+	fmt.Println()
+	fmt.Println("Device           UUID                                 Label            Size.GB  Mapper                   Mount.Point")
+	for _, disk := range report.Disks {
+		if !disk.Encrypted {
+			continue
+		}
+		mapper := disk.MapperPath
+		if mapper == "" && disk.Type != "crypt" {
+			mapper = "(locked)"
+		}
+		fmt.Printf("%-16s %-36s %-16s %-8.1f %-24s %s\n",
+			disk.Path, disk.UUID, disk.Label, float64(disk.SizeByte)/(1<<30), mapper, disk.MountPoint)
+	}
+	return nil
+}
+
+/*
+Server - print the records that allow the client computer, given by DNS name or IP, with client groups, name patterns,
+and subnets resolved, and whether the computer is currently using each of them, e.g. to plan its re-registration
+before it is reinstalled. A DNS name is also looked up for its IPs, so that subnet entries match as well.
+*/
+func ListClientDevices(allowedClient, output string) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	allowedClient = strings.TrimSpace(allowedClient)
+	dnsName, ips := allowedClient, []string{}
+	if net.ParseIP(allowedClient) != nil {
+		dnsName, ips = "", []string{allowedClient}
+	} else if addrs, err := net.LookupHost(allowedClient); err == nil {
+		ips = addrs
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	devices := db.ListClientDevices(dnsName, ips)
+	if output == OutputJSON {
+		return printJSON(devices)
+	}
+	printClientDevices(devices)
+	return nil
+}
+
+// Print the records a client computer is allowed to unlock, one line each, mount point last.
+func printClientDevices(devices []keydb.ClientDevice) {
+	fmt.Printf("Total: %d records\n", len(devices))
+	fmt.Println("UUID                                 Mapped.Name                      Alive Allowed.By                     Mount.Point")
+	for _, dev := range devices {
+		fmt.Printf("%-36s %-32s %-5s %-30s %s\n", dev.UUID, dev.MappedName, strconv.FormatBool(dev.Alive), dev.Match, dev.MountPoint)
+	}
+}
+
+// PendingCommandContents are the commands understood by client computers, in the order they are offered to administrator.
+var PendingCommandContents = []string{PendingCommandMount, PendingCommandUmount, PendingCommandLock, PendingCommandErase,
+	PendingCommandRefreshStatus, PendingCommandFstrim, PendingCommandInventory, PendingCommandRemountRO, PendingCommandPurgeSealed}
+
+// IsPendingCommandContent returns true only if the text is one of the commands understood by client computers.
+func IsPendingCommandContent(content string) bool {
+	for _, known := range PendingCommandContents {
+		if content == known {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Server - print whether the running key server is healthy, asking it over its domain socket. Only the liveness status is
+printed by default; if detail is true, the password is asked for and the key database, KMIP, and mailer status are
+printed too. A degraded server is not an error, only a server that does not answer is.
+*/
+func ServerStatus(output string, detail bool) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return fmt.Errorf("Key server is not running - %v", err)
+	}
+	var req keyserv.HealthReq
+	if detail {
+		req.PlainPassword = inputServerPassword(true, "Enter key server's password (no echo)")
+	}
+	health, err := client.GetHealth(req)
+	if err != nil {
+		return fmt.Errorf("Key server did not answer - %v", err)
+	}
+	if output == OutputJSON {
+		return printJSON(health)
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Local().Format(TIME_OUTPUT_FORMAT)
+	}
+	fmt.Printf("%-34s%s\n", "Status", health.Status)
+	fmt.Printf("%-34s%s\n", "Started", formatTime(health.StartTime))
+	fmt.Printf("%-34s%s\n", "Uptime", time.Duration(health.UptimeSec)*time.Second)
+	fmt.Printf("%-34s%d\n", "Protocol Version", health.ProtocolVersion)
+	if !health.Detailed {
+		fmt.Printf("%-34s%s\n", "Maintenance Mode", strconv.FormatBool(health.Maintenance))
+		return nil
+	}
+	fmt.Printf("%-34s%s\n", "Maintenance Mode", health.MaintenanceMode)
+	fmt.Printf("%-34s%s\n", "Version", health.Version)
+	fmt.Printf("%-34s%s\n", "Key Database", health.KeyDBDir)
+	fmt.Printf("%-34s%d\n", "Records", health.NumRecords)
+	fmt.Printf("%-34s%s\n", "Key Database Writable", strconv.FormatBool(health.KeyDBWritable))
+	fmt.Printf("%-34s%s\n", "External KMIP Server", strconv.FormatBool(health.KMIPExternal))
+	fmt.Printf("%-34s%s\n", "KMIP Last Success", formatTime(health.KMIPLastSuccess))
+	fmt.Printf("%-34s%s\n", "KMIP Last Failure", formatTime(health.KMIPLastFailure))
+	fmt.Printf("%-34s%s\n", "Email Notifications", strconv.FormatBool(health.MailerConfigured && health.MailerError == ""))
+	fmt.Printf("%-34s%s\n", "TLS Listen Address", health.TLS.ListenAddress)
+	fmt.Printf("%-34s%s\n", "TLS Minimum Version", health.TLS.MinVersion)
+	cipherSuites := "default"
+	if len(health.TLS.CipherSuites) > 0 {
+		cipherSuites = strings.Join(health.TLS.CipherSuites, " ")
+	}
+	fmt.Printf("%-34s%s\n", "TLS Cipher Suites", cipherSuites)
+	fmt.Printf("%-34s%s\n", "Client Certificate Validation", strconv.FormatBool(health.TLS.ClientCertValidation))
+	fmt.Printf("%-34s%s\n", "CA Fingerprint (SHA256)", health.TLS.CAFingerprint)
+	for _, reason := range keydb.SortedRejectionReasons(health.Rejections) {
+		fmt.Printf("%-34s%d\n", "Rejected Retrievals ("+reason+")", health.Rejections[reason])
+	}
+	for _, warning := range health.Warnings {
+		fmt.Printf("%-34s%s\n", "Warning", warning)
+	}
+	return nil
+}
+
+// Warn that the key server does not hand out keys, the warning goes to stderr so that JSON output stays intact.
+func warnMaintenance(db *keydb.DB, output string) {
+	mode := db.GetMaintenance()
+	if !mode.IsActive() {
+		return
+	}
+	out := os.Stdout
+	if output == OutputJSON {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "WARNING: the key server is in maintenance mode and does not hand out keys - %s\n", mode)
+}
+
+/*
+Server - turn the running key server's maintenance mode "on" for the duration or "off", or show the mode if the state
+is empty. While the mode is on, the key server does not hand out any key, though it keeps on receiving alive reports.
+*/
+func SetMaintenanceMode(state string, duration time.Duration, reason string) error {
+	sys.LockMem()
+	if state == "" {
+		db, err := OpenKeyDB("")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Maintenance mode is %s.\n", db.GetMaintenance())
+		return nil
+	} else if state != "on" && state != "off" {
+		return fmt.Errorf("Maintenance mode state \"%s\" is not supported, use \"on\" or \"off\"", state)
+	}
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return fmt.Errorf("Key server is not running - %v", err)
+	}
+	if caps, err := client.GetCapabilities(); err != nil {
+		return fmt.Errorf("Key server did not answer - %v", err)
+	} else if !caps.Features[keyserv.FeatureMaintenance] {
+		return errors.New("The running key server does not support maintenance mode, please restart it.")
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	fmt.Println()
+	mode, err := client.SetMaintenance(keyserv.SetMaintenanceReq{PlainPassword: password, Enable: state == "on", Duration: duration, Reason: reason})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Maintenance mode is now %s.\n", mode)
+	return nil
+}
+
+/*
+Server - create a one-time unlock token of the disk for the running key server, optionally only for the host. The token
+is printed once and cannot be shown again.
+*/
+func CreateUnlockToken(uuid, host string, validity time.Duration) error {
+	sys.LockMem()
+	if err := keydb.ValidateDeviceID(uuid); err != nil {
+		return err
+	}
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return fmt.Errorf("Key server is not running - %v", err)
+	}
+	if caps, err := client.GetCapabilities(); err != nil {
+		return fmt.Errorf("Key server did not answer - %v", err)
+	} else if !caps.Features[keyserv.FeatureUnlockToken] {
+		return errors.New("The running key server does not support unlock tokens, please restart it.")
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	fmt.Println()
+	resp, err := client.CreateUnlockToken(keyserv.CreateUnlockTokenReq{PlainPassword: password, UUID: keydb.CanonicalRecordID(uuid), Hostname: host, Validity: validity})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-34s%s\n", "Unlock Token", resp.Token)
+	fmt.Printf("%-34s%s\n", "Token ID", resp.UnlockToken.ID)
+	fmt.Printf("%-34s%s\n", "Valid Until", resp.UnlockToken.ExpiresAt.Format(TIME_OUTPUT_FORMAT))
+	if resp.UnlockToken.Hostname != "" {
+		fmt.Printf("%-34s%s\n", "Only for Computer", resp.UnlockToken.Hostname)
+	}
+	fmt.Println("The token unlocks the disk once, it is not shown again. Pass it to online-unlock or auto-unlock by -token.")
+	return nil
+}
+
+/*
+Server - create a one-time enrollment token that lets a new client computer request its client certificate by
+register-client without the password, optionally only for the host name or IP given.
+*/
+func CreateEnrollmentToken(host string, validity time.Duration) error {
+	sys.LockMem()
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return fmt.Errorf("Key server is not running - %v", err)
+	}
+	if caps, err := client.GetCapabilities(); err != nil {
+		return fmt.Errorf("Key server did not answer - %v", err)
+	} else if !caps.Features[keyserv.FeatureEnrollment] {
+		return errors.New("The running key server does not issue client certificates, it needs the CA generated by init-server in its certificate directory.")
+	}
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
+	fmt.Println()
+	resp, err := client.CreateEnrollmentToken(keyserv.CreateEnrollmentTokenReq{PlainPassword: password, Hostname: host, Validity: validity})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-34s%s\n", "Enrollment Token", resp.Token)
+	fmt.Printf("%-34s%s\n", "Token ID", resp.EnrollmentToken.ID)
+	fmt.Printf("%-34s%s\n", "Valid Until", resp.EnrollmentToken.ExpiresAt.Format(TIME_OUTPUT_FORMAT))
+	if resp.EnrollmentToken.Hostname != "" {
+		fmt.Printf("%-34s%s\n", "Only for Computer", resp.EnrollmentToken.Hostname)
+	}
+	fmt.Println("The token enrolls one computer, it is not shown again. Pass it to register-client by -token.")
+	return nil
+}
+
+// KMIPStatus is printed by the kmip-status action.
+type KMIPStatus struct {
+	keyserv.KMIPServerInfo
+	RecordKMIPIDs map[string]string // RecordKMIPIDs are the KMIP object IDs of key records, keyed by record UUID.
+}
+
+/*
+Server - connect to the external KMIP server, run a query operation, and print the server that answered, along with
+its vendor, supported operations, and the KMIP object IDs created for the key records.
+*/
+func ShowKMIPStatus(output string) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	_, srvConf, _, err := readServerConfig()
+	if err != nil {
+		return err
+	}
+	if len(srvConf.KMIPAddresses) == 0 {
+		return fmt.Errorf("External KMIP server is not configured (%s), keys are stored in the built-in database", keyserv.SRV_CONF_KMIP_SERVER_ADDRS)
+	}
+	client, err := keyserv.NewExternalKMIPClient(srvConf)
+	if err != nil {
+		return err
+	}
+	info, err := client.Query()
+	if err != nil {
+		return fmt.Errorf("KMIP server did not answer the query - %v", err)
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	status := KMIPStatus{KMIPServerInfo: info, RecordKMIPIDs: make(map[string]string)}
+	recs := db.List()
+	for _, rec := range recs {
+		status.RecordKMIPIDs[rec.UUID] = rec.ID
+	}
+	if output == OutputJSON {
+		return printJSON(status)
+	}
+	fmt.Printf("%-34s%s\n", "KMIP Server", info.Address)
+	fmt.Printf("%-34s%s\n", "Vendor", info.Vendor)
+	fmt.Printf("%-34s%s\n", "Operations", strings.Join(info.Operations, ", "))
+	fmt.Printf("Total: %d records\n", len(recs))
+	fmt.Println("UUID                                 KMIP.ID")
+	for _, rec := range recs {
+		fmt.Printf("%-36s %s\n", rec.UUID, rec.ID)
+	}
+	return nil
+}
+
+/*
+Server - store, read back, and destroy a dummy key on each configured KMIP server with the CA, certificate, and
+credentials of the configuration, and print the outcome of each server. An error is returned if any of them fails.
+*/
+func TestKMIPServers(output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	_, srvConf, _, err := readServerConfig()
+	if err != nil {
+		return err
+	}
+	if len(srvConf.KMIPAddresses) == 0 {
+		return fmt.Errorf("External KMIP server is not configured (%s), keys are stored in the built-in database", keyserv.SRV_CONF_KMIP_SERVER_ADDRS)
+	}
+	results := keyserv.RoundTripKMIPServers(srvConf)
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if output == OutputJSON {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		for _, result := range results {
+			if result.Error == "" {
+				fmt.Printf("%-6s%-34s%s\n", "PASS", result.Address, result.Duration.Round(time.Millisecond))
+			} else {
+				fmt.Printf("%-6s%-34s%s\n", "FAIL", result.Address, result.Error)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d KMIP servers failed the test", failed, len(results))
+	}
+	return nil
+}
+
+/*
+Server - move the encryption keys between key database and the external KMIP server, direction is either
+keyserv.KeyMigrationToKMIP or keyserv.KeyMigrationToLocal. The migration refuses to run while the key server is serving,
+unless online is true, in which case the running key server changes the records on the migration's behalf.
+*/
+func MigrateKeys(direction string, online bool, output string) error {
+	sys.LockMem()
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	if direction != keyserv.KeyMigrationToKMIP && direction != keyserv.KeyMigrationToLocal {
+		return fmt.Errorf("Direction must be either \"%s\" or \"%s\"", keyserv.KeyMigrationToKMIP, keyserv.KeyMigrationToLocal)
+	}
+	_, srvConf, _, err := readServerConfig()
+	if err != nil {
+		return err
+	}
+	if len(srvConf.KMIPAddresses) == 0 {
+		return fmt.Errorf("External KMIP server is not configured (%s), configure it before migrating keys in either direction", keyserv.SRV_CONF_KMIP_SERVER_ADDRS)
+	}
+	kmipClient, err := keyserv.NewExternalKMIPClient(srvConf)
+	if err != nil {
+		return err
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	migrator := &keyserv.KeyMigrator{
+		KMIPClient: kmipClient,
+		DB:         db,
+		ReportPath: keyserv.GetKeyMigrationReportPath(srvConf.KeyDBDir),
+		Relocate:   db.RelocateKey,
+	}
+	rpcClient, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return err
+	}
+	if health, err := rpcClient.GetHealth(keyserv.HealthReq{}); err == nil {
+		if !online {
+			return errors.New("Key server is running, stop it first or use -online to let the running server change the records")
+		}
+		password := inputServerPassword(true, "Enter key server's password (no echo)")
+		if health, err = rpcClient.GetHealth(keyserv.HealthReq{PlainPassword: password}); err != nil {
+			return err
+		}
+		// Records that refer to KMIP objects are only served by a key server that has been started with KMIP settings.
+		if !health.KMIPExternal {
+			return errors.New("The running key server still uses the built-in KMIP server, restart it with the external KMIP settings first")
+		}
+		migrator.Relocate = func(uuid, expectedID, newID string, key []byte) (string, error) {
+			resp, err := rpcClient.RelocateKey(keyserv.RelocateKeyReq{
+				PlainPassword: password,
+				UUID:          uuid,
+				ExpectedID:    expectedID,
+				NewID:         newID,
+				Key:           key,
+			})
+			return resp.ID, err
+		}
+	} else if online {
+		return fmt.Errorf("Key server is not running - %v", err)
+	}
+	report, err := migrator.Migrate(direction)
+	if err != nil {
+		return err
+	}
+	if output == OutputJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		uuids := make([]string, 0, len(report.Entries))
+		for uuid := range report.Entries {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
+		fmt.Println("UUID                                 State       Old.ID -> New.ID")
+		for _, uuid := range uuids {
+			entry := report.Entries[uuid]
+			fmt.Printf("%-36s %-11s %s -> %s\n", uuid, entry.State, entry.OldID, entry.NewID)
+			if entry.Error != "" {
+				fmt.Printf("%-36s %s\n", "", entry.Error)
+			}
+		}
+		counts := report.Count()
+		fmt.Printf("Total: %d records, %d migrated, %d skipped, %d failed, %d unfinished\n", len(uuids), counts[keyserv.KeyMigrationDone],
+			counts[keyserv.KeyMigrationSkipped], counts[keyserv.KeyMigrationFailed],
+			counts[keyserv.KeyMigrationRegistered]+counts[keyserv.KeyMigrationRelocating])
+		fmt.Printf("The report is saved in %s\n", migrator.ReportPath)
+	}
+	if report.Unfinished() || report.Count()[keyserv.KeyMigrationFailed] > 0 {
+		return errors.New("Some keys could not be migrated, fix the problem and run the migration again")
+	}
+	if direction == keyserv.KeyMigrationToLocal {
+		fmt.Fprintf(os.Stderr, "All keys are now stored in the key database. Remove %s from %s and restart the key server to stop using the KMIP server.\n",
+			keyserv.SRV_CONF_KMIP_SERVER_ADDRS, SERVER_CONFIG_PATH)
+	}
+	return nil
+}
+
+// FsckResult is the outcome of checking one damaged record file.
+type FsckResult struct {
+	FileName    string // FileName is the name of the damaged record file.
+	Error       string // Error describes why the record could not be loaded.
+	Recoverable bool   // Recoverable is true if the previous version of the record is intact.
+	Restored    bool   // Restored is true if the record has been restored from its previous version.
+	Problem     string // Problem describes why the record cannot be restored.
+}
+
+/*
+Server - report the record files that cannot be loaded, and optionally restore them from their previous version.
+An error is returned if there is a damaged record that cannot be restored.
+*/
+func FsckKeyDB(restore bool, output string) error {
+	if output != "" && output != OutputText && output != OutputJSON {
+		return fmt.Errorf("Output format \"%s\" is not supported, use \"%s\" or \"%s\"", output, OutputText, OutputJSON)
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	results := make([]FsckResult, 0, len(db.LoadErrors))
+	unrecoverable, restored := 0, 0
+	// Restoring a record changes the list of load errors
+	loadErrors := append([]keydb.RecordLoadError{}, db.LoadErrors...)
+	for _, loadErr := range loadErrors {
+		result := FsckResult{FileName: loadErr.FileName, Error: loadErr.Error}
+		if _, err := db.CanRestore(loadErr.FileName); err != nil {
+			result.Problem = err.Error()
+			unrecoverable++
+		} else {
+			result.Recoverable = true
+			if restore {
+				if _, err := db.RestoreRecord(loadErr.FileName); err != nil {
+					result.Problem = err.Error()
+					unrecoverable++
+					auditAdminAction("FsckKeyDB", loadErr.FileName, keyserv.AuditResultFailed, err.Error())
+				} else {
+					result.Restored = true
+					restored++
+					auditAdminAction("FsckKeyDB", loadErr.FileName, keyserv.AuditResultGranted, "")
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	if output == OutputJSON {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		for _, result := range results {
+			fmt.Printf("%-34s%s\n", "Damaged record:", result.FileName)
+			fmt.Printf("%-34s%s\n", "Error:", result.Error)
+			switch {
+			case result.Restored:
+				fmt.Printf("%-34s%s\n", "Recovery:", "restored from the previous version")
+			case result.Recoverable && result.Problem == "":
+				fmt.Printf("%-34s%s\n", "Recovery:", "the previous version is intact, use -restore to restore it")
+			default:
+				fmt.Printf("%-34s%s\n", "Recovery:", result.Problem)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("Total: %d records loaded, %d damaged, %d restored, %d unrecoverable\n", len(db.RecordsByUUID), len(results), restored, unrecoverable)
+	}
+	if restored > 0 && sys.SystemctlIsRunning(SERVER_DAEMON) {
+		fmt.Println("Reloading key server...")
+		if err := sys.SystemctlReload(SERVER_DAEMON); err != nil {
+			return fmt.Errorf("Failed to reload key server, restart it to serve the restored records - %v", err)
+		}
+	}
+	if unrecoverable > 0 {
+		return fmt.Errorf("%d damaged records cannot be restored, restore them from a backup of %s", unrecoverable, db.Dir)
+	}
+	return nil
+}
+
+/*
+Server - set up key database master key from the configured source, back up the key database, and encrypt the key
+content of all records that still carry plain key content. The key server must not be running meanwhile.
+*/
+func MigrateKeyDBEncryption() error {
+	sys.LockMem()
+	sysconf, srvConf, _, err := readServerConfig()
+	if err != nil {
+		return err
+	}
+	if srvConf.KeyDBMasterKeySource == "" {
+		return fmt.Errorf("Key database master key source is not configured, set %s in %s first", keyserv.SRV_CONF_KEYDB_MASTER_KEY_SOURCE, SERVER_CONFIG_PATH)
+	}
+	if sys.SystemctlIsRunning(SERVER_DAEMON) {
+		return fmt.Errorf("Key server is running, stop it with \"systemctl stop %s\" first", SERVER_DAEMON)
+	}
+	if srvConf.KeyDBDir == "" {
+		return errors.New("Key database directory is not configured. Is the server initialised?")
+	}
+	if srvConf.KeyDBMasterKeyDigest == "" {
+		// Set up the master key for the first time
+		passphrase := ""
+		switch srvConf.KeyDBMasterKeySource {
+		case keyserv.MasterKeySourcePassphrase:
+			passphrase = sys.InputPassword(true, "", "New key database passphrase (min. %d chars, no echo)", MIN_PASSWORD_LEN)
+			if len(passphrase) < MIN_PASSWORD_LEN {
+				return fmt.Errorf("Passphrase must be at least %d characters long", MIN_PASSWORD_LEN)
+			} else if sys.InputPassword(true, "", "Confirm key database passphrase (no echo)") != passphrase {
+				return errors.New("Passphrases do not match")
 			}
+			srvConf.KeyDBMasterKeySalt = make([]byte, keyserv.MasterKeySaltLen)
+			if _, err := rand.Read(srvConf.KeyDBMasterKeySalt); err != nil {
+				return err
+			}
+			sysconf.Set(keyserv.SRV_CONF_KEYDB_MASTER_KEY_SALT, hex.EncodeToString(srvConf.KeyDBMasterKeySalt))
+		case keyserv.MasterKeySourceFile:
+			if _, err := os.Stat(srvConf.KeyDBMasterKeyFile); os.IsNotExist(err) {
+				newKey := make([]byte, keydb.MasterKeyLen)
+				if _, err := rand.Read(newKey); err != nil {
+					return err
+				}
+				if err := sys.ReplaceFile(srvConf.KeyDBMasterKeyFile, []byte(hex.EncodeToString(newKey)+"\n"), sys.SecureFileMode, true); err != nil {
+					return fmt.Errorf("Failed to write master key file - %v", err)
+				}
+				fmt.Printf("A new master key has been written into %s, keep a copy of it in a safe place.\n", srvConf.KeyDBMasterKeyFile)
+			}
+		case keyserv.MasterKeySourceKMIP:
+			if srvConf.KeyDBMasterKeyKMIPID == "" {
+				kmipClient, err := keyserv.NewExternalKMIPClient(srvConf)
+				if err != nil {
+					return err
+				}
+				if srvConf.KeyDBMasterKeyKMIPID, err = kmipClient.CreateKey(keyserv.KeyNamePrefix + "keydb-master-key"); err != nil {
+					return fmt.Errorf("Failed to create master key on KMIP server - %v", err)
+				}
+				sysconf.Set(keyserv.SRV_CONF_KEYDB_MASTER_KEY_KMIP_ID, srvConf.KeyDBMasterKeyKMIPID)
+			}
+		}
+		masterKey, err := keyserv.ReadKeyDBMasterKey(srvConf, passphrase)
+		if err != nil {
+			return err
 		}
+		srvConf.KeyDBMasterKeyDigest = keydb.MasterKeyDigest(masterKey)
+		sysconf.Set(keyserv.SRV_CONF_KEYDB_MASTER_KEY_DIGEST, srvConf.KeyDBMasterKeyDigest)
+		if err := sys.ReplaceFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), sys.SecureFileMode, true); err != nil {
+			return fmt.Errorf("Failed to save settings into %s - %v", SERVER_CONFIG_PATH, err)
+		}
+		srvConf.KeyDBMasterKey = masterKey
+	} else if srvConf.KeyDBMasterKey, err = loadKeyDBMasterKey(srvConf); err != nil {
+		return err
 	}
+	db, err := keydb.OpenDBWithMasterKey(srvConf.KeyDBDir, srvConf.KeyDBMasterKey)
+	if err != nil {
+		return fmt.Errorf("Failed to open key database - %v", err)
+	}
+	backupDir := fmt.Sprintf("%s.backup-%s", path.Clean(srvConf.KeyDBDir), time.Now().Format("20060102-150405"))
+	if err := db.Backup(backupDir); err != nil {
+		return err
+	}
+	fmt.Printf("Key database has been backed up to %s\n", backupDir)
+	rewritten, err := db.EncryptRecords()
+	if err != nil {
+		auditAdminAction("MigrateKeyDBEncryption", "", keyserv.AuditResultFailed, err.Error())
+		return fmt.Errorf("Failed to encrypt records, the original records can be restored from %s - %v", backupDir, err)
+	}
+	// Read all records back to make sure they can be decrypted
+	if _, err := keydb.OpenDBWithMasterKey(srvConf.KeyDBDir, srvConf.KeyDBMasterKey); err != nil {
+		auditAdminAction("MigrateKeyDBEncryption", "", keyserv.AuditResultFailed, err.Error())
+		return fmt.Errorf("Failed to read back the encrypted records, the original records can be restored from %s - %v", backupDir, err)
+	}
+	auditAdminAction("MigrateKeyDBEncryption", "", keyserv.AuditResultGranted, "")
+	fmt.Printf("Encrypted %d records, %d records in total.\n", rewritten, len(db.RecordsByUUID))
+	fmt.Fprintf(os.Stderr, "The backup in %s still carries plain key content, remove it with care once the key server runs well with the encrypted database.\n", backupDir)
+	return nil
+}
 
+/*
+Server - rewrite every record file at the current record version, so that records written by older versions of
+cryptctl2 no longer need to be upgraded whenever they are loaded. The key server must not be running meanwhile.
+Records written by a newer version of cryptctl2 are left as they are.
+*/
+func MigrateKeyDB() error {
+	if sys.SystemctlIsRunning(SERVER_DAEMON) {
+		return fmt.Errorf("Key server is running, stop it with \"systemctl stop %s\" first", SERVER_DAEMON)
+	}
+	db, err := OpenKeyDB("")
+	if err != nil {
+		return err
+	}
+	rewritten, err := db.RewriteRecords()
+	if err != nil {
+		auditAdminAction("MigrateKeyDB", "", keyserv.AuditResultFailed, err.Error())
+		return fmt.Errorf("Failed to rewrite records, the previous versions are kept next to them with the \".bak\" suffix - %v", err)
+	}
+	auditAdminAction("MigrateKeyDB", "", keyserv.AuditResultGranted, "")
+	readOnly := db.ReadOnlyRecords()
+	uuids := make([]string, 0, len(readOnly))
+	for uuid := range readOnly {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		fmt.Printf("%-34s%s (version %d, this cryptctl2 writes version %d)\n", "Left as it is:", uuid, readOnly[uuid], keydb.CurrentRecordVersion)
+	}
+	fmt.Printf("Rewrote %d records at version %d, %d records in total.\n", rewritten, keydb.CurrentRecordVersion, len(db.RecordsByUUID))
+	if len(uuids) > 0 {
+		fmt.Fprintf(os.Stderr, "%d records were written by a newer version of cryptctl2, they are served read-only until cryptctl2 is upgraded.\n", len(uuids))
+	}
+	if len(db.LoadErrors) > 0 {
+		return fmt.Errorf("%d damaged records could not be loaded, inspect them with \"cryptctl2 -action=fsck-keydb\"", len(db.LoadErrors))
+	}
 	return nil
 }
 
-// SendCommand is a server routine that saves a new pending command to database record.
-func SendCommand() error {
+/*
+SendCommand is a server routine that saves a new pending command to database record.
+If a consistency group is specified, the command is saved to all records of the group, so that the client carries
+it out on all group members in one go. If wait is true, the routine waits up to the timeout for the computer to report
+the result, and returns an error if the command did not succeed on every disk.
+The disk UUID, the comma separated receiving computers, the command, and its expiry in minutes are asked for unless they
+are given, so that the routine can be scripted. A value that is given but invalid is an error rather than a question.
+*/
+func SendCommand(uuid, targets, cmd string, expireMin int, group string, wait bool, timeoutSec int, ownerAcknowledged bool) error {
+	if uuid != "" && group != "" {
+		return errors.New("Give either the UUID of a disk or a consistency group, not both")
+	} else if cmd == PendingCommandRotate {
+		return fmt.Errorf("Command \"%s\" is sent by the key server itself, run \"cryptctl2 rotate-key -deviceID=UUID\" on the key server to rotate the key", cmd)
+	} else if cmd != "" && !IsPendingCommandContent(cmd) {
+		return fmt.Errorf("Command \"%s\" is not understood by client computers, use one of: %s", cmd, strings.Join(PendingCommandContents, ", "))
+	} else if expireMin != 0 && (expireMin < 1 || expireMin > CommandMaxExpireMin) {
+		return fmt.Errorf("The command must expire in 1 to %d minutes, %d is out of range", CommandMaxExpireMin, expireMin)
+	}
 	sys.LockMem()
 	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
 	if err != nil {
 		return err
 	}
-	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
 	// Test the connection and password
 	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
 		return err
 	}
+	useRecordDaemon(client, password)
 	// Interactively gather pending command details
-	uuid := sys.Input(true, "", "What is the UUID of disk affected by this command?")
-	db, err := OpenKeyDB(uuid)
+	var db *keydb.DB
+	var uuids, groupMembers []string
+	if group == "" {
+		if uuid == "" {
+			uuid = sys.Input(true, "", "What is the UUID of disk affected by this command?")
+		}
+		if db, err = OpenKeyDB(uuid); err != nil {
+			return err
+		}
+		uuids = []string{uuid}
+	} else {
+		if db, err = OpenKeyDB(""); err != nil {
+			return err
+		}
+		groupMembers = db.GetByGroup(group).GroupMemberUUIDs()
+		if len(groupMembers) == 0 {
+			return fmt.Errorf("Consistency group \"%s\" does not have any member", group)
+		}
+		fmt.Printf("Consistency group \"%s\" has %d members (in mount order): %s\n", group, len(groupMembers), strings.Join(groupMembers, " "))
+		uuids = groupMembers
+	}
+	var ips []string
+	if targets != "" {
+		if ips, err = resolveCommandTargetList(db, uuids, targets); err != nil {
+			return err
+		}
+	}
+	for len(ips) == 0 {
+		answer := sys.Input(true, "", "What is the IP address or host name of computer who will receive this command? (\"%s\" for all computers using the disk)", CommandTargetAll)
+		if ips, err = resolveCommandTargets(db, uuids, answer); err == nil {
+			break
+		} else if !sys.IsInteractive() {
+			return err
+		}
+		fmt.Println(err)
+	}
+	fmt.Printf("The command will be sent to %d computers: %s\n", len(ips), strings.Join(ips, " "))
+	for !IsPendingCommandContent(cmd) {
+		if cmd = sys.Input(false, PendingCommandUmount, "What should the computer do? (%s)", strings.Join(PendingCommandContents, "|")); cmd == "" {
+			cmd = PendingCommandUmount // default action is "umount"
+		} else if !IsPendingCommandContent(cmd) && !sys.IsInteractive() {
+			return fmt.Errorf("Command \"%s\" is not understood by client computers, use one of: %s", cmd, strings.Join(PendingCommandContents, ", "))
+		}
+	}
+	confirmed := false
+	if cmd == PendingCommandErase {
+		if group != "" {
+			return fmt.Errorf("Command \"%s\" cannot be sent to a consistency group, send it to each disk instead", cmd)
+		} else if len(ips) > 1 {
+			return fmt.Errorf("Command \"%s\" can only be sent to one computer", cmd)
+		}
+		rec, _ := db.GetByUUID(uuids[0])
+		if err := confirmOwner(rec, ownerAcknowledged); err != nil {
+			return err
+		}
+		fmt.Printf("The computer will destroy the encryption header of disk %s, after which its data can no longer be decrypted.\n", uuids[0])
+		if sys.Input(true, "", "To confirm, type the UUID of the disk again") != uuids[0] {
+			return errors.New("The UUID does not match, the command is not saved.")
+		}
+		confirmed = true
+	}
+	if expireMin == 0 {
+		expireMin = sys.InputInt(true, CommandDefaultExpireMin, 1, CommandMaxExpireMin, "In how many minutes does the command expire (including the result)?")
+	}
+	// Place the new pending command into database records
+	pendingCmd := keydb.PendingCommand{
+		ValidFrom:    time.Now(),
+		Validity:     time.Duration(expireMin) * time.Minute,
+		Content:      cmd,
+		Group:        group,
+		GroupMembers: groupMembers,
+		Confirmed:    confirmed,
+	}
+	storedCmds, err := addPendingCommand(db, uuids, ips, pendingCmd)
 	if err != nil {
 		return err
 	}
-	ip := sys.Input(true, "", "What is the IP address of computer who will receive this command?")
-	var cmd string
+	// Ask server to reload the records from disk
+	for _, uuid := range uuids {
+		client.ReloadRecord(keyserv.ReloadRecordReq{PlainPassword: password, UUID: uuid})
+	}
+	if !wait {
+		fmt.Printf("All done! Computer %s will be informed of the command when it comes online and polls from this server.\n", strings.Join(ips, ", "))
+		return nil
+	}
+	return waitCommandResult(db, uuids, ips, pendingCmd, storedCmds, time.Duration(timeoutSec)*time.Second)
+}
+
+/*
+resolveCommandTargets turns the administrator's answer into the IPs that receive a pending command. "all" stands for
+every computer currently using any of the disks. A host name is looked up among the computers using the disks first, as
+they report their own host names, and then in DNS. IPs are normalised into the form under which the server identifies
+the polling computer.
+*/
+func resolveCommandTargets(db *keydb.DB, uuids []string, answer string) ([]string, error) {
+	answer = strings.TrimSpace(answer)
+	aliveHosts := make([]keydb.AliveHost, 0, 8)
+	for _, uuid := range uuids {
+		if rec, found := db.GetByUUID(uuid); found {
+			aliveHosts = append(aliveHosts, rec.ListAliveHosts()...)
+		}
+	}
+	ips := make([]string, 0, len(aliveHosts))
+	addIP := func(ip string) {
+		ip = keyserv.NormaliseRemoteHost(ip)
+		for _, existing := range ips {
+			if existing == ip {
+				return
+			}
+		}
+		ips = append(ips, ip)
+	}
+	if answer == CommandTargetAll {
+		for _, aliveHost := range aliveHosts {
+			addIP(aliveHost.IP)
+		}
+		if len(ips) == 0 {
+			return nil, errors.New("None of the computers is currently using the disk.")
+		}
+		sort.Strings(ips)
+		return ips, nil
+	}
+	if net.ParseIP(answer) != nil {
+		return []string{keyserv.NormaliseRemoteHost(answer)}, nil
+	}
+	for _, aliveHost := range aliveHosts {
+		shortName := strings.SplitN(aliveHost.Hostname, ".", 2)[0]
+		if strings.EqualFold(aliveHost.Hostname, answer) || strings.EqualFold(shortName, answer) {
+			addIP(aliveHost.IP)
+		}
+	}
+	if len(ips) == 0 {
+		resolved, err := net.LookupHost(answer)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot find the IP address of \"%s\" - %v", answer, err)
+		}
+		for _, ip := range resolved {
+			addIP(ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// Resolve each of the comma separated receiving computers given on the command line, see resolveCommandTargets.
+func resolveCommandTargetList(db *keydb.DB, uuids []string, targets string) ([]string, error) {
+	ips := make([]string, 0, 4)
+	seen := make(map[string]bool)
+	for _, target := range strings.Split(targets, ",") {
+		if strings.TrimSpace(target) == "" {
+			continue
+		}
+		resolved, err := resolveCommandTargets(db, uuids, target)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range resolved {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("None of \"%s\" is a computer to receive the command", targets)
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+/*
+waitCommandResult reads the records from disk every couple of seconds until each computer has reported the result of
+the command on each of the records, or the command expired, or the timeout is reached. The stored commands, keyed by
+UUID and then IP, are matched by their ID. The results are printed, and an error is returned if the command did not
+succeed everywhere.
+*/
+func waitCommandResult(db *keydb.DB, uuids []string, ips []string, pendingCmd keydb.PendingCommand, storedCmds map[string]map[string]keydb.PendingCommand, timeout time.Duration) error {
+	fmt.Printf("Waiting up to %d seconds for %d computers to report the result...\n", int(timeout.Seconds()), len(ips))
+	deadline := time.Now().Add(timeout)
+	// Results are keyed by UUID and then IP
+	results := make(map[string]map[string]keydb.PendingCommand)
+	numResults := 0
 	for {
-		if cmd = sys.Input(false, "umount", "What should the computer do? (%s|%s)", PendingCommandMount, PendingCommandUmount); cmd == "" {
-			cmd = "umount" // default action is "umount"
+		for _, uuid := range uuids {
+			if len(results[uuid]) == len(ips) {
+				continue
+			}
+			if err := db.ReloadRecord(uuid); err != nil {
+				return err
+			}
+			rec, _ := db.GetByUUID(uuid)
+			for _, ip := range ips {
+				if _, done := results[uuid][ip]; done {
+					continue
+				}
+				stored := storedCmds[uuid][ip]
+				for _, cmd := range rec.PendingCommands[ip] {
+					if cmd.MatchesID(stored.ID, stored.ValidFrom, stored.Content) && (cmd.HasResult() || !cmd.IsValid()) {
+						if results[uuid] == nil {
+							results[uuid] = make(map[string]keydb.PendingCommand)
+						}
+						results[uuid][ip] = cmd
+						numResults++
+					}
+				}
+			}
 		}
-		if cmd == PendingCommandUmount {
+		if numResults == len(uuids)*len(ips) || !time.Now().Before(deadline) {
 			break
-		} else if cmd == PendingCommandMount {
-			break
-		} else {
-			continue
 		}
+		time.Sleep(CommandResultPollInterval)
 	}
-	expireMin := sys.InputInt(true, 10, 1, 10080, "In how many minutes does the command expire (including the result)?")
-	// Place the new pending command into database record
-	rec, _ := db.GetByUUID(uuid)
-	rec.AddPendingCommand(ip, keydb.PendingCommand{
-		ValidFrom: time.Now(),
-		Validity:  time.Duration(expireMin) * time.Minute,
-		Content:   cmd,
-	})
-	if _, err := db.Upsert(rec); err != nil {
-		return fmt.Errorf("Failed to update database record - %v", err)
+	numFailures := 0
+	for _, uuid := range uuids {
+		for _, ip := range ips {
+			cmd, done := results[uuid][ip]
+			if !done {
+				fmt.Printf("%-36s %-15s %-9s %s\n", uuid, ip, "timeout", "the computer has not reported the result in time")
+				numFailures++
+				continue
+			}
+			status := cmd.Status()
+			if status != keydb.PendingCommandStatusSucceeded {
+				numFailures++
+			}
+			fmt.Printf("%-36s %-15s %-9s %s\n", uuid, ip, status, cmd.ClientResult)
+		}
+	}
+	if numFailures > 0 {
+		return fmt.Errorf("Command \"%v\" did not succeed on %d out of %d disks and computers", pendingCmd.Content, numFailures, len(uuids)*len(ips))
 	}
-	// Ask server to reload the record from disk
-	client.ReloadRecord(keyserv.ReloadRecordReq{PlainPassword: password, UUID: uuid})
-	fmt.Printf("All done! Computer %s will be informed of the command when it comes online and polls from this server.\n", ip)
 	return nil
 }
 
-// ClearPendingCommands is a server routine that clears all pending commands in a database record.
-func ClearPendingCommands() error {
+/*
+addPendingCommand saves the pending command for each of the IPs into each of the records. Either all of the records
+receive the command, or the command is withdrawn from those that have already received it and an error is returned.
+An identical command that is still outstanding for an IP is not saved again. The commands as they are stored, keyed by
+UUID and then IP, are returned.
+*/
+func addPendingCommand(db *keydb.DB, uuids []string, ips []string, cmd keydb.PendingCommand) (map[string]map[string]keydb.PendingCommand, error) {
+	storedCmds := make(map[string]map[string]keydb.PendingCommand)
+	// IDs of the commands that were newly added, keyed by UUID and then IP
+	addedIDs := make(map[string]map[string]string)
+	saved := make([]keydb.Record, 0, len(uuids))
+	for _, uuid := range uuids {
+		rec, found := db.GetByUUID(uuid)
+		if !found {
+			err := db.NotFoundError(uuid, nil)
+			withdrawPendingCommand(db, saved, addedIDs)
+			return nil, err
+		}
+		storedCmds[uuid] = make(map[string]keydb.PendingCommand)
+		addedIDs[rec.UUID] = make(map[string]string)
+		for _, ip := range ips {
+			cmd.IP = ip
+			stored, added := rec.AddPendingCommand(ip, cmd)
+			if added {
+				addedIDs[rec.UUID][ip] = stored.ID
+			} else {
+				fmt.Printf("An identical command is already pending for %s on %s, it is not sent again.\n", ip, rec.UUID)
+			}
+			storedCmds[uuid][ip] = stored
+		}
+		if _, err := db.Upsert(rec); err != nil {
+			withdrawPendingCommand(db, saved, addedIDs)
+			return nil, fmt.Errorf("Failed to update database record - %v", err)
+		}
+		saved = append(saved, rec)
+	}
+	for i, rec := range saved {
+		for _, ip := range ips {
+			auditAdminAction("SendCommand", rec.UUID, keyserv.AuditResultGranted, fmt.Sprintf("command \"%v\" (ID %s) for %s", cmd.Content, storedCmds[uuids[i]][ip].ID, ip))
+		}
+	}
+	return storedCmds, nil
+}
+
+// withdrawPendingCommand removes the newly added pending commands, keyed by UUID and then IP, from each of the records.
+func withdrawPendingCommand(db *keydb.DB, recs []keydb.Record, addedIDs map[string]map[string]string) {
+	for _, rec := range recs {
+		for ip, id := range addedIDs[rec.UUID] {
+			if cmds := rec.PendingCommands[ip]; len(cmds) > 0 && cmds[len(cmds)-1].ID == id {
+				rec.PendingCommands[ip] = cmds[:len(cmds)-1]
+			}
+		}
+		if _, err := db.Upsert(rec); err != nil {
+			fmt.Printf("Failed to withdraw the command from record %s, please clear its pending commands - %v\n", rec.UUID, err)
+		}
+	}
+}
+
+/*
+ClearPendingCommands is a server routine that clears all pending commands in a database record, the disk UUID is asked
+for unless it is given. A record that has an owner is only cleared if the administrator acknowledges to act on behalf of
+the owner.
+*/
+func ClearPendingCommands(uuid string, ownerAcknowledged bool) error {
 	sys.LockMem()
 	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
 	if err != nil {
 		return err
 	}
-	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	password := inputServerPassword(true, "Enter key server's password (no echo)")
 	// Test the connection and password
 	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
 		return err
 	}
-	uuid := sys.Input(true, "", "What is the UUID of disk to be cleared of pending commands?")
+	useRecordDaemon(client, password)
+	if uuid == "" {
+		uuid = sys.Input(true, "", "What is the UUID of disk to be cleared of pending commands?")
+	}
 	db, err := OpenKeyDB(uuid)
 	if err != nil {
 		return err
 	}
 	rec, _ := db.GetByUUID(uuid)
+	if err := confirmOwner(rec, ownerAcknowledged); err != nil {
+		auditAdminAction("ClearPendingCommands", uuid, keyserv.AuditResultRejected, "owner did not acknowledge")
+		return err
+	}
 	rec.ClearPendingCommands()
-	if _, err := db.Upsert(rec); err != nil {
-		return fmt.Errorf("Failed to update database record - %v", err)
+	// Expired unlock tokens are of no use either, the running key server removes them by itself upon the update
+	if numTokens := rec.RemoveExpiredUnlockTokens(time.Now()); numTokens > 0 {
+		fmt.Printf("%d expired unlock tokens have been removed.\n", numTokens)
+	}
+	if runningDaemon != nil {
+		// Key server keeps the alive messages that arrived in the meantime
+		err = client.UpdateRecordFields(keyserv.UpdateRecordFieldsReq{PlainPassword: password, Record: rec, ReplacePendingCommands: true})
+		if err != nil {
+			return fmt.Errorf("Failed to update database record - %v", err)
+		}
+	} else {
+		if _, err := db.Upsert(rec); err != nil {
+			return fmt.Errorf("Failed to update database record - %v", err)
+		}
+		// Ask server to reload the record from disk
+		client.ReloadRecord(keyserv.ReloadRecordReq{PlainPassword: password, UUID: uuid})
 	}
-	// Ask server to reload the record from disk
-	client.ReloadRecord(keyserv.ReloadRecordReq{PlainPassword: password, UUID: uuid})
+	auditAdminAction("ClearPendingCommands", uuid, keyserv.AuditResultGranted, "")
 	fmt.Printf("All of %s's pending commands have been successfully cleared.\n", uuid)
 	return nil
 }
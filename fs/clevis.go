@@ -0,0 +1,96 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	BIN_CLEVIS = "/usr/bin/clevis"
+)
+
+var clevisListLine = regexp.MustCompile(`^([0-9]+):\s+(\S+)\s+'(.*)'$`) // a binding listed by "clevis luks list"
+
+// ClevisTangConfig returns the configuration of a clevis tang pin for the Tang server URL.
+func ClevisTangConfig(tangURL string) string {
+	config, _ := json.Marshal(map[string]string{"url": tangURL})
+	return string(config)
+}
+
+/*
+ClevisTangBind binds the LUKS device to the Tang server by an additional key slot, so that the device can also be
+unlocked while the Tang server answers. The existing key unlocks the device to add the slot, the advertisement of the
+Tang server is trusted without asking.
+*/
+func ClevisTangBind(key []byte, blockDev, tangURL string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil,
+		BIN_CLEVIS, "luks", "bind", "-y", "-k", "-", "-d", blockDev, "tang", ClevisTangConfig(tangURL))
+	if err != nil {
+		return fmt.Errorf("ClevisTangBind: failed to bind \"%s\" to tang server \"%s\" - %v %s %s", blockDev, tangURL, err, stdout, stderr)
+	}
+	return nil
+}
+
+// ClevisTangSlots returns the URLs of the Tang servers the LUKS device is bound to, by key slot.
+func ClevisTangSlots(blockDev string) (map[int]string, error) {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return nil, err
+	}
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CLEVIS, "luks", "list", "-d", blockDev)
+	if err != nil {
+		return nil, fmt.Errorf("ClevisTangSlots: failed to list clevis bindings of \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return parseClevisTangSlots(stdout), nil
+}
+
+// Return the Tang server URLs by key slot among the bindings listed by "clevis luks list".
+func parseClevisTangSlots(list string) map[int]string {
+	slots := make(map[int]string)
+	for _, line := range strings.Split(list, "\n") {
+		match := clevisListLine.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || match[2] != "tang" {
+			continue
+		}
+		slot, _ := strconv.Atoi(match[1])
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(match[3]), &config); err == nil {
+			url, _ := config["url"].(string)
+			slots[slot] = url
+		}
+	}
+	return slots
+}
+
+// ClevisTangUnbind removes the key slots of all Tang bindings from the LUKS device.
+func ClevisTangUnbind(blockDev string) error {
+	slots, err := ClevisTangSlots(blockDev)
+	if err != nil {
+		return err
+	}
+	for slot := range slots {
+		if _, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CLEVIS, "luks", "unbind", "-f", "-d", blockDev, "-s", strconv.Itoa(slot)); err != nil {
+			return fmt.Errorf("ClevisTangUnbind: failed to remove key slot %d of \"%s\" - %v %s %s", slot, blockDev, err, stdout, stderr)
+		}
+	}
+	return nil
+}
+
+// ClevisUnlock opens the LUKS device under the mapper name by any of its clevis bindings.
+func ClevisUnlock(blockDev, name string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	if _, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CLEVIS, "luks", "unlock", "-d", blockDev, "-n", name); err != nil {
+		return fmt.Errorf("ClevisUnlock: failed to unlock \"%s\" by clevis - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return nil
+}
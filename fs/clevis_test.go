@@ -0,0 +1,23 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseClevisTangSlots(t *testing.T) {
+	if config := ClevisTangConfig("http://tang.example.com"); config != `{"url":"http://tang.example.com"}` {
+		t.Fatal(config)
+	}
+	list := `1: tang '{"url":"http://tang.example.com"}'
+2: tpm2 '{"hash":"sha256","key":"ecc"}'
+3: tang '{"url":"http://tang2.example.com:7500","adv":{}}'
+garbage
+`
+	expected := map[int]string{1: "http://tang.example.com", 3: "http://tang2.example.com:7500"}
+	if slots := parseClevisTangSlots(list); !reflect.DeepEqual(slots, expected) {
+		t.Fatal(slots)
+	}
+}
@@ -3,11 +3,17 @@
 package fs
 
 import (
+	"bufio"
 	"bytes"
 	"cryptctl2/sys"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -18,29 +24,469 @@ const (
 	LUKS_HASH       = "sha512"
 	LUKS_KEY_SIZE_S = "512"
 	LUKS_KEY_SIZE_I = 512
+
+	LUKS_REENCRYPT_HEADER_SIZE  = "32M"            // space reserved at the beginning of the device for LUKS2 header on in-place encryption
+	LUKS_REENCRYPT_HEADER_BYTES = 32 * 1024 * 1024 // LUKS_REENCRYPT_HEADER_SIZE in bytes
+
+	LUKS1_MAX_KEY_SLOTS = 8 // LUKS1_MAX_KEY_SLOTS is the number of key slots in a LUKS1 header, LUKS2 has at least as many.
 )
 
-// Call cryptsetup luksFormat on the block device node.
-func CryptFormat(key []byte, blockDev, uuid string) error {
-	if err := CheckBlockDevice(blockDev); err != nil {
-		return err
+// LUKS2 in-place encryption (cryptsetup reencrypt) first appeared in this version of cryptsetup.
+var CryptReencryptMinVersion = []int{2, 2, 0}
+
+var (
+	cryptSetupVersion      = regexp.MustCompile(`cryptsetup (\d+)\.(\d+)\.(\d+)`)     // extract version number from cryptsetup --version
+	cryptReencryptProgress = regexp.MustCompile(`Progress:\s*([0-9]+(?:\.[0-9]+)?)%`) // extract percentage from cryptsetup reencrypt progress
+	cryptUnlockedSlot      = regexp.MustCompile(`Key slot (\d+) unlocked`)            // extract key slot number from cryptsetup -v open --test-passphrase
+	cryptLUKS1KeySlot      = regexp.MustCompile(`^Key Slot (\d+): ENABLED`)           // an active key slot in LUKS1 luksDump
+	cryptLUKS2KeySlot      = regexp.MustCompile(`^\s+(\d+): \S+`)                     // a key slot under "Keyslots:" section of LUKS2 luksDump
+)
+
+// PBKDF algorithms understood by cryptsetup luksFormat.
+const (
+	CryptPBKDF2   = "pbkdf2"
+	CryptArgon2i  = "argon2i"
+	CryptArgon2id = "argon2id"
+)
+
+// cryptCipherSpec matches a cipher specification such as "aes-xts-plain64" or "aes-cbc-essiv:sha256".
+var cryptCipherSpec = regexp.MustCompile(`^[a-z0-9]+-[a-z0-9]+(-[a-z0-9:]+)?$`)
+
+/*
+CryptFormatOptions are the parameters of a LUKS header created by CryptFormat. An empty value leaves the choice to
+cryptsetup's built-in defaults, except that LUKS version defaults to 2.
+*/
+type CryptFormatOptions struct {
+	LUKSVersion     int    `json:"luks_version,omitempty"`       // LUKSVersion is either 1 or 2.
+	Cipher          string `json:"cipher,omitempty"`             // Cipher is the cipher specification, e.g. aes-xts-plain64.
+	KeySizeBits     int    `json:"key_size_bits,omitempty"`      // KeySizeBits is the size of the volume key in bits, e.g. 512.
+	PBKDF           string `json:"pbkdf,omitempty"`              // PBKDF is the key slot key derivation function, one of the CryptPBKDF2/CryptArgon2* constants.
+	PBKDFIterTimeMS int    `json:"pbkdf_iter_time_ms,omitempty"` // PBKDFIterTimeMS is the time spent deriving the key slot key, in milliseconds.
+	PBKDFIterations int    `json:"pbkdf_iterations,omitempty"`   // PBKDFIterations is the fixed iteration count, it replaces PBKDFIterTimeMS.
+	PBKDFMemoryKB   int    `json:"pbkdf_memory_kb,omitempty"`    // PBKDFMemoryKB is the memory cost of argon2 in kilobytes.
+	SectorSize      int    `json:"sector_size,omitempty"`        // SectorSize is the encryption sector size in bytes, e.g. 4096 for 4K-native disks.
+}
+
+// Return the LUKS version the options ask for.
+func (opts CryptFormatOptions) luksVersion() int {
+	if opts.LUKSVersion == 0 {
+		return 2
+	}
+	return opts.LUKSVersion
+}
+
+// Validate returns an error if cryptsetup cannot create a LUKS header using the combination of options.
+func (opts CryptFormatOptions) Validate() error {
+	version := opts.luksVersion()
+	if version != 1 && version != 2 {
+		return fmt.Errorf("LUKS version must be either 1 or 2, but %d is given", opts.LUKSVersion)
+	}
+	if opts.Cipher != "" && !cryptCipherSpec.MatchString(opts.Cipher) {
+		return fmt.Errorf("Cipher \"%s\" does not look like a cipher specification such as \"aes-xts-plain64\"", opts.Cipher)
+	}
+	if opts.KeySizeBits < 0 || opts.KeySizeBits%8 != 0 || opts.KeySizeBits > 1024 {
+		return fmt.Errorf("Key size must be a multiple of 8 bits no larger than 1024, but %d is given", opts.KeySizeBits)
+	}
+	if opts.KeySizeBits != 0 && strings.Contains(opts.Cipher, "-xts-") && opts.KeySizeBits != 256 && opts.KeySizeBits != 512 {
+		return fmt.Errorf("Cipher \"%s\" only works with a key size of 256 or 512 bits, but %d is given", opts.Cipher, opts.KeySizeBits)
+	}
+	switch opts.PBKDF {
+	case "", CryptPBKDF2:
+	case CryptArgon2i, CryptArgon2id:
+		if version == 1 {
+			return fmt.Errorf("PBKDF %s requires LUKS2, LUKS1 only supports %s", opts.PBKDF, CryptPBKDF2)
+		}
+	default:
+		return fmt.Errorf("PBKDF must be one of %s, %s, %s, but \"%s\" is given", CryptPBKDF2, CryptArgon2i, CryptArgon2id, opts.PBKDF)
+	}
+	if opts.PBKDFIterTimeMS < 0 || opts.PBKDFIterations < 0 || opts.PBKDFMemoryKB < 0 {
+		return errors.New("PBKDF iteration time, iterations, and memory cost must not be negative")
+	}
+	if opts.PBKDFIterTimeMS > 0 && opts.PBKDFIterations > 0 {
+		return errors.New("PBKDF iteration time and a fixed number of iterations cannot be used together")
+	}
+	if opts.PBKDFMemoryKB > 0 && (version == 1 || opts.PBKDF == CryptPBKDF2) {
+		return fmt.Errorf("PBKDF memory cost only applies to %s and %s, which require LUKS2", CryptArgon2i, CryptArgon2id)
+	}
+	if opts.SectorSize != 0 {
+		if version == 1 {
+			return fmt.Errorf("Sector size %d requires LUKS2, LUKS1 always uses 512-byte sectors", opts.SectorSize)
+		}
+		if opts.SectorSize < 512 || opts.SectorSize > 4096 || opts.SectorSize&(opts.SectorSize-1) != 0 {
+			return fmt.Errorf("Sector size must be a power of two between 512 and 4096, but %d is given", opts.SectorSize)
+		}
+	}
+	return nil
+}
+
+// Return the cryptsetup luksFormat parameters corresponding to the options.
+func (opts CryptFormatOptions) cryptSetupArgs() []string {
+	args := []string{"--type", fmt.Sprintf("luks%d", opts.luksVersion())}
+	if opts.Cipher != "" {
+		args = append(args, "--cipher", opts.Cipher)
+	}
+	if opts.KeySizeBits != 0 {
+		args = append(args, "--key-size", strconv.Itoa(opts.KeySizeBits))
+	}
+	if opts.PBKDF != "" {
+		args = append(args, "--pbkdf", opts.PBKDF)
+	}
+	if opts.PBKDFIterTimeMS != 0 {
+		args = append(args, "--iter-time", strconv.Itoa(opts.PBKDFIterTimeMS))
+	}
+	if opts.PBKDFIterations != 0 {
+		args = append(args, "--pbkdf-force-iterations", strconv.Itoa(opts.PBKDFIterations))
+	}
+	if opts.PBKDFMemoryKB != 0 {
+		args = append(args, "--pbkdf-memory", strconv.Itoa(opts.PBKDFMemoryKB))
+	}
+	if opts.SectorSize != 0 {
+		args = append(args, "--sector-size", strconv.Itoa(opts.SectorSize))
+	}
+	return args
+}
+
+// String describes the options in a single line, leaving out those that are left to cryptsetup's defaults.
+func (opts CryptFormatOptions) String() string {
+	desc := []string{fmt.Sprintf("LUKS%d", opts.luksVersion())}
+	if opts.Cipher != "" {
+		desc = append(desc, "cipher "+opts.Cipher)
 	}
+	if opts.KeySizeBits != 0 {
+		desc = append(desc, fmt.Sprintf("%d-bit key", opts.KeySizeBits))
+	}
+	if opts.PBKDF != "" {
+		desc = append(desc, "PBKDF "+opts.PBKDF)
+	}
+	if opts.PBKDFIterTimeMS != 0 {
+		desc = append(desc, fmt.Sprintf("iteration time %dms", opts.PBKDFIterTimeMS))
+	}
+	if opts.PBKDFIterations != 0 {
+		desc = append(desc, fmt.Sprintf("%d iterations", opts.PBKDFIterations))
+	}
+	if opts.PBKDFMemoryKB != 0 {
+		desc = append(desc, fmt.Sprintf("memory cost %dKB", opts.PBKDFMemoryKB))
+	}
+	if opts.SectorSize != 0 {
+		desc = append(desc, fmt.Sprintf("%d-byte sectors", opts.SectorSize))
+	}
+	return strings.Join(desc, ", ")
+}
+
+// CryptFormatArgs returns the arguments of cryptsetup luksFormat run by CryptFormat, the key is read from stdin.
+func CryptFormatArgs(blockDev, uuid string, opts CryptFormatOptions) []string {
 	UUID := uuid
 	_, after, found := strings.Cut(uuid, ":")
 	if found {
 		UUID = after
 	}
 	//fmt.Printf("uuid:%s b:%s a:%s UUID:%s", uuid, before, after, UUID)
-	_, stdout, stderr, err := sys.Exec(bytes.NewReader(key), nil, nil,
-		BIN_CRYPTSETUP, "--batch-mode", "--type", "luks2", "luksFormat", "--key-file=-", blockDev, "--uuid", UUID)
+	args := append([]string{"--batch-mode"}, opts.cryptSetupArgs()...)
+	return append(args, "luksFormat", "--key-file=-", blockDev, "--uuid", UUID)
+}
+
+// Call cryptsetup luksFormat on the block device node, creating the LUKS header according to the options.
+func CryptFormat(key sys.SecureBytes, blockDev, uuid string, opts CryptFormatOptions) error {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("CryptFormat: %v", err)
+	}
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil, BIN_CRYPTSETUP, CryptFormatArgs(blockDev, uuid, opts)...)
 	if err != nil {
 		return fmt.Errorf("CryptFormat: failed to format \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
 	}
 	return nil
 }
 
+// Return the version number of cryptsetup in major, minor, and patch level.
+func CryptSetupVersion() ([]int, error) {
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CRYPTSETUP, "--version")
+	if err != nil {
+		return nil, fmt.Errorf("CryptSetupVersion: failed to execute cryptsetup - %v %s %s", err, stdout, stderr)
+	}
+	match := cryptSetupVersion.FindStringSubmatch(stdout)
+	if match == nil {
+		return nil, fmt.Errorf("CryptSetupVersion: cannot find version number in \"%s\"", strings.TrimSpace(stdout))
+	}
+	version := make([]int, 3)
+	for i := range version {
+		version[i], _ = strconv.Atoi(match[i+1])
+	}
+	return version, nil
+}
+
+// Return an error if cryptsetup is too old to encrypt a file system in-place.
+func CheckCryptReencryptSupport() error {
+	version, err := CryptSetupVersion()
+	if err != nil {
+		return err
+	}
+	for i, min := range CryptReencryptMinVersion {
+		if version[i] > min {
+			return nil
+		} else if version[i] < min {
+			return fmt.Errorf("CheckCryptReencryptSupport: cryptsetup %d.%d.%d is too old for in-place encryption, it needs %d.%d.%d or newer",
+				version[0], version[1], version[2], CryptReencryptMinVersion[0], CryptReencryptMinVersion[1], CryptReencryptMinVersion[2])
+		}
+	}
+	return nil
+}
+
+/*
+Call cryptsetup reencrypt to write a LUKS2 header onto the block device that carries an existing file system, without
+encrypting any data yet. The file system must already leave LUKS_REENCRYPT_HEADER_SIZE unused at the end of the device,
+as its data is shifted to make room for the header.
+After the header is written, call CryptReencryptResume to encrypt the data.
+*/
+func CryptReencryptInit(key []byte, blockDev, uuid string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	return cryptReencryptInit(key, blockDev, uuid)
+}
+
+// Write the LUKS2 header for in-place encryption onto the block device, which has been checked by the caller.
+func cryptReencryptInit(key []byte, blockDev, uuid string) error {
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "reencrypt", "--encrypt", "--init-only", "--type", "luks2",
+		"--reduce-device-size", LUKS_REENCRYPT_HEADER_SIZE, "--key-file=-", "--uuid", uuid, blockDev)
+	if err != nil {
+		return fmt.Errorf("CryptReencryptInit: failed to write LUKS header onto \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return nil
+}
+
+// Return the percentage found in a line of cryptsetup reencrypt progress output.
+func ParseCryptReencryptProgress(line string) (percent float64, found bool) {
+	match := cryptReencryptProgress.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+	percent, err := strconv.ParseFloat(match[1], 64)
+	return percent, err == nil
+}
+
+/*
+Call cryptsetup reencrypt to carry on with the encryption of the block device, whose LUKS2 header indicates that
+encryption is in progress. The function blocks until all data is encrypted, or until cryptsetup is interrupted, in
+which case calling it again resumes where it left off. The percentage of progress is handed to the progress function
+as cryptsetup reports it.
+*/
+func CryptReencryptResume(key []byte, blockDev string, progress func(percent float64)) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	cmd := exec.Command(BIN_CRYPTSETUP, "--batch-mode", "reencrypt", "--resume-only", "--progress-frequency", "1",
+		"--key-file=-", blockDev)
+	cmd.Stdin = bytes.NewReader(key)
+	outReader, outWriter := io.Pipe()
+	cmd.Stdout = outWriter
+	cmd.Stderr = outWriter
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("CryptReencryptResume: failed to start cryptsetup - %v", err)
+	}
+	// Progress lines are terminated by carriage return, the remaining output is kept for error message.
+	var output []string
+	scanDone := make(chan struct{})
+	go func() {
+		defer close(scanDone)
+		scanner := bufio.NewScanner(outReader)
+		scanner.Split(scanLinesOrCarriageReturn)
+		for scanner.Scan() {
+			if percent, found := ParseCryptReencryptProgress(scanner.Text()); found {
+				progress(percent)
+			} else if line := strings.TrimSpace(scanner.Text()); line != "" && len(output) < 32 {
+				output = append(output, line)
+			}
+		}
+		// Keep draining the pipe so that cryptsetup never blocks on writing
+		io.Copy(ioutil.Discard, outReader)
+	}()
+	err := cmd.Wait()
+	outWriter.Close()
+	<-scanDone
+	traceCmd(cmd, err, strings.Join(output, "\n"))
+	if err != nil {
+		return fmt.Errorf("CryptReencryptResume: failed to encrypt \"%s\" - %v %s", blockDev, err, strings.Join(output, " "))
+	}
+	return nil
+}
+
+// A bufio.SplitFunc that splits text into lines terminated by either line feed or carriage return.
+func scanLinesOrCarriageReturn(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+/*
+Return true if the block device carries a LUKS2 header that indicates an unfinished in-place encryption, that may be
+resumed by CryptReencryptResume. A device without LUKS header is not being encrypted.
+*/
+func CryptReencryptInProgress(blockDev string) (bool, error) {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return false, err
+	}
+	return cryptReencryptInProgress(blockDev)
+}
+
+// Tell whether the in-place encryption of the block device, which has been checked by the caller, is unfinished.
+func cryptReencryptInProgress(blockDev string) (bool, error) {
+	if status, _, _, _ := execProgram(nil, nil, nil, BIN_CRYPTSETUP, "isLuks", blockDev); status != 0 {
+		return false, nil
+	}
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CRYPTSETUP, "luksDump", blockDev)
+	if err != nil {
+		return false, fmt.Errorf("CryptReencryptInProgress: failed to read LUKS header of \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return IsCryptReencryptInProgress(stdout), nil
+}
+
+// Return true if the output of cryptsetup luksDump indicates an unfinished re-encryption.
+func IsCryptReencryptInProgress(luksDump string) bool {
+	// The in-progress re-encryption is a mandatory requirement that stops older cryptsetup from opening the device
+	return strings.Contains(luksDump, "online-reencrypt")
+}
+
+/*
+Return the number of the key slot that the key unlocks on the block device, without activating the device. The device
+may already be open.
+*/
+func CryptKeySlotOf(key []byte, blockDev string) (int, error) {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return -1, err
+	}
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "--verbose", "open", "--test-passphrase", "--key-file=-", blockDev)
+	if err != nil {
+		return -1, fmt.Errorf("CryptKeySlotOf: the key does not unlock \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	slot, found := ParseCryptUnlockedSlot(stdout + stderr)
+	if !found {
+		return -1, fmt.Errorf("CryptKeySlotOf: cannot tell the key slot unlocked on \"%s\" from output \"%s %s\"", blockDev, stdout, stderr)
+	}
+	return slot, nil
+}
+
+// Return the key slot number mentioned by the verbose output of cryptsetup open.
+func ParseCryptUnlockedSlot(txt string) (slot int, found bool) {
+	match := cryptUnlockedSlot.FindStringSubmatch(txt)
+	if len(match) < 2 {
+		return -1, false
+	}
+	slot, err := strconv.Atoi(match[1])
+	return slot, err == nil
+}
+
+// Return the numbers of key slots in use on the block device.
+func CryptActiveKeySlots(blockDev string) ([]int, error) {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return nil, err
+	}
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CRYPTSETUP, "luksDump", blockDev)
+	if err != nil {
+		return nil, fmt.Errorf("CryptActiveKeySlots: failed to read LUKS header of \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return ParseCryptActiveKeySlots(stdout), nil
+}
+
+// Return the numbers of key slots in use according to the output of cryptsetup luksDump of both LUKS1 and LUKS2.
+func ParseCryptActiveKeySlots(luksDump string) []int {
+	slots := make([]int, 0, LUKS1_MAX_KEY_SLOTS)
+	inLUKS2KeySlots := false
+	for _, line := range strings.Split(luksDump, "\n") {
+		if match := cryptLUKS1KeySlot.FindStringSubmatch(line); len(match) == 2 {
+			slot, _ := strconv.Atoi(match[1])
+			slots = append(slots, slot)
+			continue
+		}
+		if line == "Keyslots:" {
+			inLUKS2KeySlots = true
+			continue
+		} else if line != "" && line[0] != ' ' && line[0] != '\t' {
+			// Another section begins
+			inLUKS2KeySlots = false
+		}
+		if inLUKS2KeySlots {
+			if match := cryptLUKS2KeySlot.FindStringSubmatch(line); len(match) == 2 && !strings.HasPrefix(line, "\t") {
+				slot, _ := strconv.Atoi(match[1])
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots
+}
+
+/*
+Call cryptsetup luksAddKey to place the new key into the specified key slot, the existing key authorises the operation.
+The new key is handed over through a pipe so that it never touches a file.
+*/
+func CryptAddKey(existingKey, newKey []byte, blockDev string, slot int) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	keyReader, keyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("CryptAddKey: failed to create pipe - %v", err)
+	}
+	defer keyReader.Close()
+	// A key is far smaller than pipe buffer, hence it is written in full before cryptsetup starts.
+	_, err = keyWriter.Write(newKey)
+	keyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("CryptAddKey: failed to write key into pipe - %v", err)
+	}
+	cmd := exec.Command(BIN_CRYPTSETUP, "--batch-mode", "luksAddKey", "--key-file=-", "--key-slot", strconv.Itoa(slot), blockDev, "/dev/fd/3")
+	cmd.Stdin = bytes.NewReader(existingKey)
+	cmd.ExtraFiles = []*os.File{keyReader}
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("CryptAddKey: failed to add key into slot %d of \"%s\" - %v %s", slot, blockDev, err, out)
+	}
+	return nil
+}
+
+// Call cryptsetup luksKillSlot to remove the key slot, the key authorises the operation and must not be in that slot.
+func CryptKillSlot(key []byte, blockDev string, slot int) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "luksKillSlot", "--key-file=-", blockDev, strconv.Itoa(slot))
+	if err != nil {
+		return fmt.Errorf("CryptKillSlot: failed to remove slot %d of \"%s\" - %v %s %s", slot, blockDev, err, stdout, stderr)
+	}
+	return nil
+}
+
+/*
+Call cryptsetup luksRemoveKey to remove the key slot that the key unlocks, the other key slots are left intact. The key
+is handed over through stdin.
+*/
+func CryptRemoveKey(key []byte, blockDev string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "luksRemoveKey", "--key-file=-", blockDev)
+	if err != nil {
+		return fmt.Errorf("CryptRemoveKey: failed to remove the key from \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return nil
+}
+
+// CryptOpenArgs returns the arguments of cryptsetup luksOpen run by CryptOpen, the key is read from stdin.
+func CryptOpenArgs(blockDev, name string) []string {
+	return []string{"--batch-mode", "luksOpen", "--key-file=-", blockDev, name}
+}
+
 // Call cryptsetup luksOpen on the block device node.
-func CryptOpen(key []byte, blockDev, name string) error {
+func CryptOpen(key sys.SecureBytes, blockDev, name string) error {
 	if err := CheckBlockDevice(blockDev); err != nil {
 		return err
 	}
@@ -48,8 +494,7 @@ func CryptOpen(key []byte, blockDev, name string) error {
 	if err == nil {
 		return fmt.Errorf("CryptOpen: \"%s\" appears to have already been unlocked as \"%s\"", blockDev, name)
 	}
-	_, stdout, stderr, err := sys.Exec(bytes.NewReader(key), nil, nil,
-		BIN_CRYPTSETUP, "--batch-mode", "luksOpen", "--key-file=-", blockDev, name)
+	_, stdout, stderr, err := execProgram(bytes.NewReader(key), nil, nil, BIN_CRYPTSETUP, CryptOpenArgs(blockDev, name)...)
 	if err != nil {
 		return fmt.Errorf("CryptOpen: failed to open \"%s\" as \"%s\" - %v %s %s", blockDev, name, err, stdout, stderr)
 	}
@@ -61,7 +506,7 @@ func CryptErase(blockDev string) error {
 	if err := CheckBlockDevice(blockDev); err != nil {
 		return err
 	}
-	_, stdout, stderr, err := sys.Exec(nil, nil, nil, BIN_CRYPTSETUP, "--batch-mode", "luksErase", blockDev)
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_CRYPTSETUP, "--batch-mode", "luksErase", blockDev)
 	if err != nil {
 		return fmt.Errorf("CryptErase: failed to erase \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
 	}
@@ -87,7 +532,7 @@ func CryptErase(blockDev string) error {
 
 // Call cryptsetup luksClose on the mapped device node.
 func CryptClose(name string) error {
-	_, stdout, stderr, err := sys.Exec(nil, nil, nil,
+	_, stdout, stderr, err := execProgram(nil, nil, nil,
 		BIN_CRYPTSETUP, "--batch-mode", "luksClose", name)
 	if err != nil {
 		return fmt.Errorf("CryptClose: failed to close \"%s\" - %v %s %s", name, err, stdout, stderr)
@@ -135,7 +580,7 @@ func ParseCryptStatus(txt string) (mapping CryptMapping) {
 
 // Get luks device status. An error will be returned if the mapping status cannot be retrieved.
 func CryptStatus(name string) (mapping CryptMapping, err error) {
-	_, stdout, _, _ := sys.Exec(nil, nil, nil, BIN_CRYPTSETUP, "status", name)
+	_, stdout, _, _ := execProgram(nil, nil, nil, BIN_CRYPTSETUP, "status", name)
 	mapping = ParseCryptStatus(stdout)
 	if !mapping.IsValid() {
 		err = fmt.Errorf("CryptStatus: failed to retrieve a valid output for \"%s\", gathered information is: %+v", name, mapping)
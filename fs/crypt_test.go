@@ -2,11 +2,18 @@
 // This source code is licensed under GPL version 3 that can be found in LICENSE file.
 package fs
 
-import "testing"
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 // The unit test simply makes sure that the functions do not crash, it does not set up an encrypted device node.
 func TestCryptSetup(t *testing.T) {
-	if err := CryptFormat([]byte{}, "doesnotexist", "testuuid"); err == nil {
+	if err := CryptFormat([]byte{}, "doesnotexist", "testuuid", CryptFormatOptions{}); err == nil {
 		t.Fatal("did not error")
 	}
 	if err := CryptOpen([]byte{}, "doesnotexist", "doesnotexist"); err == nil {
@@ -65,3 +72,170 @@ Oops, secure memory pool already initialized
 		t.Fatalf("%+v", parsed)
 	}
 }
+
+func TestParseCryptReencryptProgress(t *testing.T) {
+	if percent, found := ParseCryptReencryptProgress("Progress:  42.7%, ETA 01:12, 1024 MiB written, speed 120.3 MiB/s"); !found || percent != 42.7 {
+		t.Fatal(percent, found)
+	}
+	if percent, found := ParseCryptReencryptProgress("Progress: 100%, ETA 00:00"); !found || percent != 100 {
+		t.Fatal(percent, found)
+	}
+	if _, found := ParseCryptReencryptProgress("Finished, time 01:23.456"); found {
+		t.Fatal("should not have found progress")
+	}
+}
+
+func TestIsCryptReencryptInProgress(t *testing.T) {
+	sample := `LUKS header information
+Version:        2
+Epoch:          5
+UUID:           9b6c3f1e-0c0a-4d4e-9b7a-6a4d0c7e2f10
+Requirements:   online-reencrypt
+`
+	if !IsCryptReencryptInProgress(sample) {
+		t.Fatal("did not detect re-encryption")
+	}
+	if IsCryptReencryptInProgress(`LUKS header information
+Version:        2
+Requirements:   (no requirements)
+`) {
+		t.Fatal("false positive")
+	}
+}
+
+// fakeExec stands in for sys.Exec, it answers each program by the outcome of its first argument and keeps the calls.
+type fakeExec struct {
+	calls   [][]string
+	stdins  []string
+	outputs map[string]string // outputs are the stdout of each first argument, the ones not found fail with status 1.
+}
+
+func (fake *fakeExec) exec(stdin io.Reader, stdout, stderr io.Writer, programName string, programArgs ...string) (int, string, string, error) {
+	fake.calls = append(fake.calls, append([]string{programName}, programArgs...))
+	in := ""
+	if stdin != nil {
+		content, _ := ioutil.ReadAll(stdin)
+		in = string(content)
+	}
+	fake.stdins = append(fake.stdins, in)
+	for _, arg := range programArgs {
+		if out, found := fake.outputs[arg]; found {
+			return 0, out, "", nil
+		}
+	}
+	return 1, "", "failed", errors.New("exit status 1")
+}
+
+// Replace sys.Exec by the fake until the test case ends.
+func useFakeExec(t *testing.T, outputs map[string]string) *fakeExec {
+	fake := &fakeExec{outputs: outputs}
+	sysExec = fake.exec
+	t.Cleanup(func() { sysExec = sysExecOrig })
+	return fake
+}
+
+var sysExecOrig = sysExec
+
+func TestCryptReencryptWithFakeExec(t *testing.T) {
+	// cryptsetup version decides whether in-place encryption is supported
+	useFakeExec(t, map[string]string{"--version": "cryptsetup 2.1.0\n"})
+	if err := CheckCryptReencryptSupport(); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Fatal(err)
+	}
+	useFakeExec(t, map[string]string{"--version": "cryptsetup 2.6.1 flags: UDEV BLKID KEYRING\n"})
+	if err := CheckCryptReencryptSupport(); err != nil {
+		t.Fatal(err)
+	}
+	// The header is written with the key on stdin and room left for it at the end of the device
+	fake := useFakeExec(t, map[string]string{"reencrypt": ""})
+	if err := cryptReencryptInit([]byte("secret"), "/dev/sdz1", "test-uuid"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{BIN_CRYPTSETUP, "--batch-mode", "reencrypt", "--encrypt", "--init-only", "--type", "luks2",
+		"--reduce-device-size", LUKS_REENCRYPT_HEADER_SIZE, "--key-file=-", "--uuid", "test-uuid", "/dev/sdz1"}
+	if len(fake.calls) != 1 || !reflect.DeepEqual(fake.calls[0], expected) || fake.stdins[0] != "secret" {
+		t.Fatal(fake.calls, fake.stdins)
+	}
+	useFakeExec(t, nil)
+	if err := cryptReencryptInit([]byte("secret"), "/dev/sdz1", "test-uuid"); err == nil || !strings.Contains(err.Error(), "/dev/sdz1") {
+		t.Fatal(err)
+	}
+	// A device without LUKS header is not being encrypted, and its header is not read
+	fake = useFakeExec(t, nil)
+	if inProgress, err := cryptReencryptInProgress("/dev/sdz1"); err != nil || inProgress || len(fake.calls) != 1 {
+		t.Fatal(inProgress, err, fake.calls)
+	}
+	useFakeExec(t, map[string]string{"isLuks": "", "luksDump": "Version: 2\nRequirements:   online-reencrypt\n"})
+	if inProgress, err := cryptReencryptInProgress("/dev/sdz1"); err != nil || !inProgress {
+		t.Fatal(inProgress, err)
+	}
+	useFakeExec(t, map[string]string{"isLuks": ""})
+	if _, err := cryptReencryptInProgress("/dev/sdz1"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestParseCryptUnlockedSlot(t *testing.T) {
+	if slot, found := ParseCryptUnlockedSlot("Key slot 3 unlocked.\nCommand successful.\n"); !found || slot != 3 {
+		t.Fatal(slot, found)
+	}
+	if _, found := ParseCryptUnlockedSlot("No key available with this passphrase.\n"); found {
+		t.Fatal("should not have found a slot")
+	}
+}
+
+func TestParseCryptActiveKeySlots(t *testing.T) {
+	luks2 := "LUKS header information\nVersion:       \t2\n\nData segments:\n  0: crypt\n\toffset: 16777216 [bytes]\n\n" +
+		"Keyslots:\n  0: luks2\n\tKey:        512 bits\n\tPBKDF:      argon2id\n\tDigest ID:  0\n" +
+		"  2: luks2\n\tKey:        512 bits\n\tArea offset:290816 [bytes]\n" +
+		"Tokens:\nDigests:\n  0: pbkdf2\n\tHash:       sha256\n"
+	if slots := ParseCryptActiveKeySlots(luks2); !reflect.DeepEqual(slots, []int{0, 2}) {
+		t.Fatal(slots)
+	}
+	luks1 := "LUKS header information for /dev/sdb1\n\nVersion:       \t1\n" +
+		"Key Slot 0: ENABLED\n\tIterations:         \t1000\nKey Slot 1: DISABLED\nKey Slot 2: ENABLED\nKey Slot 3: DISABLED\n"
+	if slots := ParseCryptActiveKeySlots(luks1); !reflect.DeepEqual(slots, []int{0, 2}) {
+		t.Fatal(slots)
+	}
+}
+
+func TestCryptFormatOptions(t *testing.T) {
+	if args := (CryptFormatOptions{}).cryptSetupArgs(); !reflect.DeepEqual(args, []string{"--type", "luks2"}) {
+		t.Fatal(args)
+	}
+	opts := CryptFormatOptions{LUKSVersion: 2, Cipher: "aes-xts-plain64", KeySizeBits: 512, PBKDF: CryptArgon2id, PBKDFIterTimeMS: 3000, PBKDFMemoryKB: 1048576, SectorSize: 4096}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if args := opts.cryptSetupArgs(); !reflect.DeepEqual(args, []string{"--type", "luks2", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--pbkdf", "argon2id", "--iter-time", "3000", "--pbkdf-memory", "1048576", "--sector-size", "4096"}) {
+		t.Fatal(args)
+	}
+	if s := opts.String(); s != "LUKS2, cipher aes-xts-plain64, 512-bit key, PBKDF argon2id, iteration time 3000ms, memory cost 1048576KB, 4096-byte sectors" {
+		t.Fatal(s)
+	}
+	if err := (CryptFormatOptions{LUKSVersion: 1, PBKDF: CryptPBKDF2, PBKDFIterations: 1000}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []CryptFormatOptions{
+		{LUKSVersion: 3},
+		{LUKSVersion: 1, PBKDF: CryptArgon2id},
+		{LUKSVersion: 1, PBKDFMemoryKB: 1024},
+		{PBKDF: CryptPBKDF2, PBKDFMemoryKB: 1024},
+		{PBKDF: "scrypt"},
+		{PBKDFIterTimeMS: 1000, PBKDFIterations: 1000},
+		{Cipher: "aes xts"},
+		{Cipher: "aes-xts-plain64", KeySizeBits: 128},
+		{KeySizeBits: 100},
+		{LUKSVersion: 1, SectorSize: 4096},
+		{SectorSize: 1000},
+		{SectorSize: 8192},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Fatalf("%+v did not error", bad)
+		}
+	}
+	if err := CryptFormat([]byte{}, "doesnotexist", "testuuid", CryptFormatOptions{LUKSVersion: 1, PBKDF: CryptArgon2id}); err == nil || !strings.Contains(err.Error(), "requires LUKS2") {
+		t.Fatal(err)
+	}
+}
@@ -121,7 +121,7 @@ func MirrorFiles(srcDir, destDir string, progressOut io.Writer) error {
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	return cmd.Wait()
+	return waitTraced(cmd)
 }
 
 // Count the total space usage of the specified path; the path can be either a file or a directory.
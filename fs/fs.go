@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,11 +16,24 @@ import (
 )
 
 const (
-	BIN_MKFS   = "/usr/sbin/mkfs"
-	BIN_LSBLK  = "/usr/bin/lsblk"
-	LSBLK_OPT  = "SERIAL,PTUUID,PARTUUID,UUID,NAME,TYPE,FSTYPE,MOUNTPOINT,SIZE,PKNAME"
-	BIN_MOUNT  = "/usr/bin/mount"
-	BIN_UMOUNT = "/usr/bin/umount"
+	BIN_MKFS      = "/usr/sbin/mkfs"
+	BIN_E2FSCK    = "/usr/sbin/e2fsck"
+	BIN_RESIZE2FS = "/usr/sbin/resize2fs"
+	BIN_LSBLK     = "/usr/bin/lsblk"
+	LSBLK_OPT     = "SERIAL,PTUUID,PARTUUID,UUID,NAME,TYPE,FSTYPE,MOUNTPOINT,SIZE,PKNAME,LABEL"
+	BIN_MOUNT     = "/usr/bin/mount"
+	BIN_UMOUNT    = "/usr/bin/umount"
+	BIN_FSTRIM    = "/usr/sbin/fstrim"
+)
+
+// Prefixes of device IDs in the form of "PREFIX:value". An ID without a known prefix is a file system UUID.
+const (
+	DeviceIDUUID     = "UUID"     // file system UUID, or LUKS header UUID of an encrypted device
+	DeviceIDLabel    = "LABEL"    // file system label
+	DeviceIDSerial   = "SERIAL"   // disk serial number
+	DeviceIDPath     = "PATH"     // device node or a symbolic link to it, e.g. /dev/disk/by-id/...
+	DeviceIDPTUUID   = "PTUUID"   // partition table identifier
+	DeviceIDPARTUUID = "PARTUUID" // partition UUID
 )
 
 var lsblkFields = regexp.MustCompile(`"((?:\\"|[^"])*)"`) // extract values from lsblk output
@@ -37,6 +51,7 @@ type BlockDevice struct {
 	MountPoint string
 	SizeByte   int64
 	PKName     string // PKName is the underlying block device's node name of a crypt block device
+	Label      string // Label is the file system label
 }
 
 // Return true if the block device is LUKS encrypted.
@@ -44,27 +59,102 @@ func (blkDev BlockDevice) IsLUKSEncrypted() bool {
 	return blkDev.FileSystem == "crypto_LUKS"
 }
 
+/*
+Return the stable ID of the block device that is used to identify it in key records: the file system UUID if it has
+one, otherwise the prefixed serial number, partition UUID, or partition table ID. Labels and device paths are never
+canonical as they may change or be reused by another device.
+*/
+func (blkDev BlockDevice) CanonicalID() string {
+	return blkDev.DeviceIDs()[0]
+}
+
+// Return all stable IDs of the block device, the canonical ID comes first. It is empty if the device has none.
+func (blkDev BlockDevice) DeviceIDs() []string {
+	ids := make([]string, 0, 4)
+	if blkDev.UUID != "" {
+		ids = append(ids, blkDev.UUID)
+	}
+	if blkDev.SERIAL != "" {
+		ids = append(ids, DeviceIDSerial+":"+blkDev.SERIAL)
+	}
+	if blkDev.PARTUUID != "" {
+		ids = append(ids, DeviceIDPARTUUID+":"+blkDev.PARTUUID)
+	}
+	if blkDev.PTUUID != "" {
+		ids = append(ids, DeviceIDPTUUID+":"+blkDev.PTUUID)
+	}
+	if len(ids) == 0 {
+		ids = append(ids, "")
+	}
+	return ids
+}
+
+/*
+Split a device ID in the form of "PREFIX:value" into its prefix (one of DeviceID* constants) and value. An ID without
+a known prefix is a file system UUID.
+*/
+func SplitDeviceID(id string) (prefix, value string) {
+	if colon := strings.Index(id, ":"); colon > 0 {
+		switch prefix := id[:colon]; prefix {
+		case DeviceIDUUID, DeviceIDLabel, DeviceIDSerial, DeviceIDPath, DeviceIDPTUUID, DeviceIDPARTUUID:
+			return prefix, id[colon+1:]
+		}
+	}
+	return DeviceIDUUID, id
+}
+
 // A list of block devices.
 type BlockDevices []BlockDevice
 
-// Find the first block device that satisfies the given criteria. If a criteria is empty, it is ignored.
+/*
+Find the block device identified by the device ID (see SplitDeviceID), return the device and its canonical ID.
+A device that does not carry any stable ID cannot be identified by a key record, and results in an error.
+*/
+func (blkDevs BlockDevices) ResolveDeviceID(id string) (blkDev BlockDevice, canonicalID string, err error) {
+	blkDev, found := blkDevs.GetByCriteria(id, "", "", "", "", "", "")
+	if !found {
+		return BlockDevice{}, "", fmt.Errorf("ResolveDeviceID: cannot find block device \"%s\"", id)
+	}
+	if canonicalID = blkDev.CanonicalID(); canonicalID == "" {
+		return BlockDevice{}, "", fmt.Errorf("ResolveDeviceID: block device \"%s\" (%s) does not have a UUID or serial number", id, blkDev.Path)
+	}
+	return
+}
+
+/*
+Find the first block device that satisfies the given criteria. If a criteria is empty, it is ignored.
+The uuid criteria is a device ID that may carry a prefix, see SplitDeviceID.
+*/
 func (blkDevs BlockDevices) GetByCriteria(uuid, devPath, devType, fileSystem, mountPoint, pkName, name string) (BlockDevice, bool) {
-	var serialId, partuuid, ptuuid, fsuuid = "", "", "", ""
-	realUuid := strings.Split(uuid, ":")
-	switch realUuid[0] {
-	case "SERIAL":
-		serialId = realUuid[1]
-	case "PTUUID":
-		ptuuid = realUuid[1]
-	case "PARTUUID":
-		partuuid = realUuid[1]
-	case "UUID":
-		fsuuid = realUuid[1]
-	default:
-		fsuuid = uuid
+	var serialId, partuuid, ptuuid, fsuuid, label, idPath, idRealPath = "", "", "", "", "", "", ""
+	if uuid != "" {
+		prefix, value := SplitDeviceID(uuid)
+		if value == "" {
+			return BlockDevice{}, false
+		}
+		switch prefix {
+		case DeviceIDSerial:
+			serialId = value
+		case DeviceIDPTUUID:
+			ptuuid = value
+		case DeviceIDPARTUUID:
+			partuuid = value
+		case DeviceIDLabel:
+			label = value
+		case DeviceIDPath:
+			// Links such as /dev/disk/by-id/... point to the device node
+			idPath, idRealPath = value, value
+			if realPath, err := filepath.EvalSymlinks(value); err == nil {
+				idRealPath = realPath
+			}
+		default:
+			fsuuid = value
+		}
 	}
 	for _, blkDev := range blkDevs {
 		if (serialId == "" || blkDev.SERIAL == serialId) &&
+			(label == "" || blkDev.Label == label) &&
+			(idPath == "" || blkDev.Path == idPath || blkDev.Path == idRealPath) &&
 			(partuuid == "" || blkDev.PARTUUID == partuuid) &&
 			(ptuuid == "" || blkDev.PTUUID == ptuuid) &&
 			(fsuuid == "" || blkDev.UUID == fsuuid) &&
@@ -114,6 +204,10 @@ func ParseBlockDevs(txt string) BlockDevices {
 			MountPoint: fields[7],
 			PKName:     fields[9],
 		}
+		// Label is the last column, it is missing from the output of older invocations
+		if len(fields) > 10 {
+			blkDev.Label = fields[10]
+		}
 		// Block device size can be empty
 		if fields[5] != "" {
 			iByte, intErr := strconv.ParseUint(fields[8], 10, 64)
@@ -136,7 +230,7 @@ func GetBlockDevices() BlockDevices {
 
 		The parser reads NAME instead of KNAME because KNAME does not apply for names under /dev/mapper.
 	*/
-	_, stdout, stderr, err := sys.Exec(nil, nil, nil, BIN_LSBLK, "-P", "-b", "-o", LSBLK_OPT)
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_LSBLK, "-P", "-b", "-o", LSBLK_OPT)
 	if err != nil {
 		panic(fmt.Errorf("GetBlockDevices: failed to execute lsblk - %v %s %s", err, stdout, stderr))
 	}
@@ -154,7 +248,7 @@ func GetBlockDevice(node string) (blkDev BlockDevice, found bool) {
 		-b - block device size is in bytes.
 		-o - choose output columns.
 	*/
-	_, stdout, _, _ := sys.Exec(nil, nil, nil, BIN_LSBLK, "-P", "-b", "-o", LSBLK_OPT, node)
+	_, stdout, _, _ := execProgram(nil, nil, nil, BIN_LSBLK, "-P", "-b", "-o", LSBLK_OPT, node)
 	blkDevs := ParseBlockDevs(stdout)
 	found = len(blkDevs) > 0
 	if found {
@@ -178,24 +272,68 @@ func CheckBlockDevice(filePath string) error {
 	return nil
 }
 
-// Call mkfs to make a new file system on the block device.
-func Format(blockDev, fsType string) error {
+// The file systems that ShrinkFileSystem knows how to shrink.
+var ShrinkableFileSystems = []string{"ext2", "ext3", "ext4"}
+
+/*
+Shrink the un-mounted file system on the block device so that it occupies no more than the number of bytes. The file
+system is checked before it is shrunk. Calling the function again with the same size leaves the file system as it is.
+*/
+func ShrinkFileSystem(blockDev, fsType string, maxSizeByte int64) error {
 	if err := CheckBlockDevice(blockDev); err != nil {
 		return err
 	}
-	cmd := exec.Command(BIN_MKFS, "-t", fsType, blockDev)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("Format: failed to format \"%s\" - %v %s", blockDev, err, out)
+	shrinkable := false
+	for _, name := range ShrinkableFileSystems {
+		shrinkable = shrinkable || name == fsType
+	}
+	if !shrinkable {
+		return fmt.Errorf("ShrinkFileSystem: shrinking file system \"%s\" is not supported, only %s can be shrunk",
+			fsType, strings.Join(ShrinkableFileSystems, ", "))
+	}
+	// resize2fs insists on a freshly checked file system. e2fsck exit status 1 means errors were corrected.
+	if status, stdout, stderr, err := execProgram(nil, nil, nil, BIN_E2FSCK, "-f", "-p", blockDev); err != nil && status != 1 {
+		return fmt.Errorf("ShrinkFileSystem: file system check on \"%s\" failed - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	sizeKB := strconv.FormatInt(maxSizeByte/1024, 10) + "K"
+	if _, stdout, stderr, err := execProgram(nil, nil, nil, BIN_RESIZE2FS, blockDev, sizeKB); err != nil {
+		return fmt.Errorf("ShrinkFileSystem: failed to shrink \"%s\" to %s - %v %s %s", blockDev, sizeKB, err, stdout, stderr)
 	}
 	return nil
 }
 
-// Call mount to mount a file system. The mounted file system will be exposed to all processes on the computer.
-func Mount(blockDev, fsType string, fsOptions []string, mountPoint string) error {
+/*
+The mkfs parameters used for each file system in addition to the type: ext file systems initialise their inode tables
+in the background, and none of them discards blocks, which takes long on a large disk and does not pass through the
+encryption layer unless the mapping allows it. A large new disk is then usable at once.
+*/
+var formatDefaults = map[string][]string{
+	"ext3":  {"-q", "-E", "nodiscard"},
+	"ext4":  {"-q", "-E", "lazy_itable_init=1,lazy_journal_init=1,nodiscard"},
+	"xfs":   {"-q", "-K"},
+	"btrfs": {"-q", "-K"},
+}
+
+// FormatArgs returns the arguments of mkfs run by Format.
+func FormatArgs(blockDev, fsType string) []string {
+	params := append([]string{"-t", fsType}, formatDefaults[fsType]...)
+	return append(params, blockDev)
+}
+
+// Call mkfs to make a new file system on the block device, using defaults suitable for a freshly encrypted disk.
+func Format(blockDev, fsType string) error {
 	if err := CheckBlockDevice(blockDev); err != nil {
 		return err
 	}
-	var cmd *exec.Cmd
+	cmd := exec.Command(BIN_MKFS, FormatArgs(blockDev, fsType)...)
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("Format: failed to format \"%s\" - %v %s", blockDev, err, out)
+	}
+	return nil
+}
+
+// MountArgs returns the arguments of mount run by Mount.
+func MountArgs(blockDev, fsType string, fsOptions []string, mountPoint string) []string {
 	params := make([]string, 0, 8)
 	params = append(params, "--make-shared")
 	if fsType != "" {
@@ -204,35 +342,85 @@ func Mount(blockDev, fsType string, fsOptions []string, mountPoint string) error
 	if fsOptions != nil && len(fsOptions) > 0 {
 		params = append(params, "-o", strings.Join(fsOptions, ","))
 	}
-	params = append(params, blockDev, mountPoint)
-	cmd = exec.Command(BIN_MOUNT, params...)
-	if out, err := cmd.CombinedOutput(); err != nil {
+	return append(params, blockDev, mountPoint)
+}
+
+// Call mount to mount a file system. The mounted file system will be exposed to all processes on the computer.
+func Mount(blockDev, fsType string, fsOptions []string, mountPoint string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	cmd := exec.Command(BIN_MOUNT, MountArgs(blockDev, fsType, fsOptions, mountPoint)...)
+	if out, err := combinedOutput(cmd); err != nil {
 		return fmt.Errorf("Mount: failed to mount \"%s\" on \"%s\" using options \"%s\" - %v %s", blockDev, mountPoint, strings.Join(fsOptions, ","), err, out)
 	}
 	return nil
 }
 
-// GetSystemdMountNameForDir returns systemd's mount unit associated with the directory, supposedly a mount point.
-func GetSystemdMountNameForDir(dirPath string) string {
+/*
+SystemdEscape escapes the string for use in a unit name, the same way as "systemd-escape" does: slashes become dashes,
+letters, digits, colons, underscores, and non-leading dots are kept, every other byte is written as "\xNN".
+*/
+func SystemdEscape(in string) string {
 	var ret bytes.Buffer
-	for i, ch := range dirPath {
-		if i == 0 && ch == '/' {
-			continue
-		} else if ch == '/' {
-			ret.WriteRune('-')
-		} else if ch >= 48 && ch <= 57 || ch >= 65 && ch <= 90 || ch >= 97 && ch <= 122 {
-			ret.WriteRune(ch)
+	for i := 0; i < len(in); i++ {
+		ch := in[i]
+		if ch == '/' {
+			ret.WriteByte('-')
+		} else if ch >= '0' && ch <= '9' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch == ':' || ch == '_' || ch == '.' && i > 0 {
+			ret.WriteByte(ch)
 		} else {
-			ret.WriteString(fmt.Sprintf("\\x%x", ch))
+			ret.WriteString(fmt.Sprintf("\\x%02x", ch))
+		}
+	}
+	return ret.String()
+}
+
+/*
+SystemdEscapePath escapes the path for use in a unit name, the same way as "systemd-escape --path" does: redundant
+slashes are removed before escaping, and the root directory becomes a single dash.
+*/
+func SystemdEscapePath(dirPath string) string {
+	dirPath = strings.Trim(filepath.Clean("/"+dirPath), "/")
+	if dirPath == "" {
+		return "-"
+	}
+	return SystemdEscape(dirPath)
+}
+
+// GetSystemdMountNameForDir returns systemd's mount unit associated with the directory, supposedly a mount point.
+func GetSystemdMountNameForDir(dirPath string) string {
+	return SystemdEscapePath(dirPath) + ".mount"
+}
+
+/*
+Bind-mount the source directory onto the target directory. Mount options such as "ro" are applied by remounting the
+bind-mount, and the propagation type (e.g. "rshared") is changed afterwards if it is given.
+*/
+func BindMount(source, target string, options []string, propagation string) error {
+	if out, err := combinedOutput(exec.Command(BIN_MOUNT, "--bind", source, target)); err != nil {
+		return fmt.Errorf("BindMount: failed to bind-mount \"%s\" on \"%s\" - %v %s", source, target, err, out)
+	}
+	if len(options) > 0 {
+		remountOpts := append([]string{"remount", "bind"}, options...)
+		if out, err := combinedOutput(exec.Command(BIN_MOUNT, "-o", strings.Join(remountOpts, ","), target)); err != nil {
+			combinedOutput(exec.Command(BIN_UMOUNT, target))
+			return fmt.Errorf("BindMount: failed to apply options \"%s\" to \"%s\" - %v %s", strings.Join(options, ","), target, err, out)
 		}
 	}
-	return ret.String() + ".mount"
+	if propagation != "" {
+		if out, err := combinedOutput(exec.Command(BIN_MOUNT, "--make-"+propagation, target)); err != nil {
+			combinedOutput(exec.Command(BIN_UMOUNT, target))
+			return fmt.Errorf("BindMount: failed to make \"%s\" %s - %v %s", target, propagation, err, out)
+		}
+	}
+	return nil
 }
 
 // Umount un-mounts a file system by interacting with systemd.
 func Umount(mountPoint string) error {
 	err1 := sys.SystemctlStop(GetSystemdMountNameForDir(mountPoint))
-	out, err2 := exec.Command(BIN_UMOUNT, mountPoint).CombinedOutput()
+	out, err2 := combinedOutput(exec.Command(BIN_UMOUNT, mountPoint))
 	devs := GetBlockDevices()
 	if _, found := devs.GetByCriteria("", "", "", "", mountPoint, "", ""); !found {
 		return nil
@@ -240,6 +428,24 @@ func Umount(mountPoint string) error {
 	return fmt.Errorf("Umount: first attempt failed with error \"%v\", and second attempt failed with output \"%s\" and error \"%v\"", err1, out, err2)
 }
 
+// Remount applies the mount options (e.g. "ro") to the file system mounted on the directory without un-mounting it.
+func Remount(mountPoint string, options []string) error {
+	remountOpts := append([]string{"remount"}, options...)
+	if out, err := combinedOutput(exec.Command(BIN_MOUNT, "-o", strings.Join(remountOpts, ","), mountPoint)); err != nil {
+		return fmt.Errorf("Remount: failed to apply options \"%s\" to \"%s\" - %v %s", strings.Join(options, ","), mountPoint, err, out)
+	}
+	return nil
+}
+
+// Fstrim discards unused blocks of the file system mounted on the directory, return the summary printed by fstrim.
+func Fstrim(mountPoint string) (string, error) {
+	_, stdout, stderr, err := execProgram(nil, nil, nil, BIN_FSTRIM, "--verbose", mountPoint)
+	if err != nil {
+		return "", fmt.Errorf("Fstrim: failed to trim \"%s\" - %v %s %s", mountPoint, err, stdout, stderr)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
 // Return amount of free space available on the disk where input paths is mounted on.
 func FreeSpace(paths string) (int64, error) {
 	var stats syscall.Statfs_t
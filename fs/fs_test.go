@@ -10,20 +10,20 @@ import (
 
 func TestParseBlockDevs(t *testing.T) {
 	sample := `
-UUID="" NAME="sda" TYPE="disk" FSTYPE="" MOUNTPOINT="" SIZE="42949672960" PKNAME=""
-UUID="5719d731-61a1-485e-98c9-49969d66c210" NAME="sda1" TYPE="part" FSTYPE="ext4" MOUNTPOINT="/" SIZE="42943138304" PKNAME=""
-UUID="68a72d63-b256-450e-b648-44782057153e" NAME="loop0" TYPE="loop" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="12582912000" PKNAME="loop0"
-UUID="7d5ad550-8e81-45a9-895f-90bff713c63c" NAME="dm00" TYPE="crypt" FSTYPE="ext4" MOUNTPOINT="/home/howard" SIZE="12580814848" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="" NAME="sda" TYPE="disk" FSTYPE="" MOUNTPOINT="" SIZE="42949672960" PKNAME=""
+SERIAL="" PTUUID="" PARTUUID="" UUID="5719d731-61a1-485e-98c9-49969d66c210" NAME="sda1" TYPE="part" FSTYPE="ext4" MOUNTPOINT="/" SIZE="42943138304" PKNAME=""
+SERIAL="" PTUUID="" PARTUUID="" UUID="68a72d63-b256-450e-b648-44782057153e" NAME="loop0" TYPE="loop" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="12582912000" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="7d5ad550-8e81-45a9-895f-90bff713c63c" NAME="dm00" TYPE="crypt" FSTYPE="ext4" MOUNTPOINT="/home/howard" SIZE="12580814848" PKNAME="loop0"
 
-UUID="" NAME="sr0" TYPE="rom" FSTYPE="" MOUNTPOINT="" SIZE="1073741312" PKNAME=""
-UUID="" NAME="vda" TYPE="disk" FSTYPE="" MOUNTPOINT="" SIZE="68719476736" PKNAME=""
+SERIAL="" PTUUID="" PARTUUID="" UUID="" NAME="sr0" TYPE="rom" FSTYPE="" MOUNTPOINT="" SIZE="1073741312" PKNAME=""
+SERIAL="" PTUUID="" PARTUUID="" UUID="" NAME="vda" TYPE="disk" FSTYPE="" MOUNTPOINT="" SIZE="68719476736" PKNAME=""
 
-UUID="e3e82520-5123-490c-a01f-1b6226e770c2" NAME="vda1" TYPE="part" FSTYPE="swap" MOUNTPOINT="[SWAP]" SIZE="2153775104" PKNAME="loop0"
-UUID="2a2e9ce7-6cd2-48ca-b932-37800eef51a2" NAME="vda2" TYPE="part" FSTYPE="xfs" MOUNTPOINT="/" SIZE="66564653056" PKNAME="loop0"
-UUID="" NAME="vdb" TYPE="disk" FSTYPE="" MOUNTPOINT="" SIZE="8589934592" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="e3e82520-5123-490c-a01f-1b6226e770c2" NAME="vda1" TYPE="part" FSTYPE="swap" MOUNTPOINT="[SWAP]" SIZE="2153775104" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="2a2e9ce7-6cd2-48ca-b932-37800eef51a2" NAME="vda2" TYPE="part" FSTYPE="xfs" MOUNTPOINT="/" SIZE="66564653056" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="" NAME="vdb" TYPE="disk" FSTYPE="" MOUNTPOINT="" SIZE="8589934592" PKNAME="loop0"
 
-UUID="9edcdeb9-86bd-4602-be5d-7a45a29fefc0" NAME="vdc" TYPE="disk" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="9663676416" PKNAME="loop0"
-UUID="80c51aec-15e1-42ea-8520-1d6c707cd8e6" NAME="dm00" TYPE="crypt" FSTYPE="ext4" MOUNTPOINT="/mnt" SIZE="9661579264" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="9edcdeb9-86bd-4602-be5d-7a45a29fefc0" NAME="vdc" TYPE="disk" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="9663676416" PKNAME="loop0"
+SERIAL="" PTUUID="" PARTUUID="" UUID="80c51aec-15e1-42ea-8520-1d6c707cd8e6" NAME="dm00" TYPE="crypt" FSTYPE="ext4" MOUNTPOINT="/mnt" SIZE="9661579264" PKNAME="loop0"
 `
 	ret := ParseBlockDevs(sample)
 	expected := BlockDevices{
@@ -111,4 +111,56 @@ func TestGetSystemdMountNameForDir(t *testing.T) {
 	if ret := GetSystemdMountNameForDir(in); ret != out {
 		t.Fatal(ret)
 	}
+	// Samples are verified against systemd-escape --path
+	for in, out := range map[string]string{
+		"/":                     "-.mount",
+		"//srv//data/":          "srv-data.mount",
+		"/srv/my_data:1/.cache": "srv-my_data:1-.cache.mount",
+		"/.hidden":              `\x2ehidden.mount`,
+		"/srv/daten-ä":          `srv-daten\x2d\xc3\xa4.mount`,
+	} {
+		if ret := GetSystemdMountNameForDir(in); ret != out {
+			t.Fatal(in, ret)
+		}
+	}
+	if ret := SystemdEscape("cryptctl2-unlocked-sdb1"); ret != `cryptctl2\x2dunlocked\x2dsdb1` {
+		t.Fatal(ret)
+	}
+}
+
+func TestResolveDeviceID(t *testing.T) {
+	devs := BlockDevices{
+		{SERIAL: "3600140585b053f00", Name: "sdb", Path: "/dev/sdb", Type: "disk"},
+		{PARTUUID: "0d5a1b7e-01", UUID: "9edcdeb9-86bd-4602-be5d-7a45a29fefc0", Name: "sdb1", Path: "/dev/sdb1", Type: "part", FileSystem: "crypto_LUKS", Label: "data"},
+		{Name: "sdc", Path: "/dev/sdc", Type: "disk"},
+	}
+	// All aliases of the partition resolve to the same canonical ID
+	for _, id := range []string{"9edcdeb9-86bd-4602-be5d-7a45a29fefc0", "UUID:9edcdeb9-86bd-4602-be5d-7a45a29fefc0", "LABEL:data", "PATH:/dev/sdb1", "PARTUUID:0d5a1b7e-01"} {
+		dev, canonicalID, err := devs.ResolveDeviceID(id)
+		if err != nil || dev.Path != "/dev/sdb1" || canonicalID != "9edcdeb9-86bd-4602-be5d-7a45a29fefc0" {
+			t.Fatal(id, dev, canonicalID, err)
+		}
+	}
+	// A disk without file system UUID is identified by its serial number
+	if dev, canonicalID, err := devs.ResolveDeviceID("PATH:/dev/sdb"); err != nil || dev.Path != "/dev/sdb" || canonicalID != "SERIAL:3600140585b053f00" {
+		t.Fatal(dev, canonicalID, err)
+	}
+	// A device without stable ID cannot be used
+	if _, _, err := devs.ResolveDeviceID("PATH:/dev/sdc"); err == nil {
+		t.Fatal("did not error")
+	}
+	for _, id := range []string{"LABEL:nodata", "LABEL:", "PATH:/dev/sdd", "doesnotexist"} {
+		if _, _, err := devs.ResolveDeviceID(id); err == nil {
+			t.Fatal("did not error", id)
+		}
+	}
+	if prefix, value := SplitDeviceID("PATH:/dev/disk/by-path/pci-0000:00:1f.2-ata-1"); prefix != DeviceIDPath || value != "/dev/disk/by-path/pci-0000:00:1f.2-ata-1" {
+		t.Fatal(prefix, value)
+	}
+	if prefix, value := SplitDeviceID("BOGUS:x"); prefix != DeviceIDUUID || value != "BOGUS:x" {
+		t.Fatal(prefix, value)
+	}
+	if ids := devs[1].DeviceIDs(); !reflect.DeepEqual(ids, []string{"9edcdeb9-86bd-4602-be5d-7a45a29fefc0", "PARTUUID:0d5a1b7e-01"}) {
+		t.Fatal(ids)
+	}
 }
@@ -0,0 +1,76 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	BIN_BLKID      = "/usr/sbin/blkid"
+	BIN_XFS_REPAIR = "/usr/sbin/xfs_repair"
+	BIN_BTRFS      = "/usr/sbin/btrfs"
+)
+
+/*
+ProbeFileSystem reads the superblock of the block device and returns the type of its file system, or an empty string
+if the device does not have a file system blkid recognises.
+*/
+func ProbeFileSystem(blockDev string) (string, error) {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return "", err
+	}
+	// Probe the device itself rather than trusting the blkid cache, exit status 2 means nothing was found.
+	status, stdout, stderr, err := execProgram(nil, nil, nil, BIN_BLKID, "-p", "-s", "TYPE", "-o", "value", blockDev)
+	if status == 2 {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("ProbeFileSystem: failed to probe \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+/*
+CheckFileSystem checks the un-mounted file system on the block device before it is mounted, and returns the output of
+the checker. A preen check (force is false) automatically repairs what is safe to repair and leaves a clean ext file
+system alone, xfs is only checked without modification (its problems are reported but do not fail), and btrfs is left to repair itself on mount. A forced check
+examines the file system regardless of its clean flag, btrfs included. An error is returned if the file system has
+errors that were not repaired; file systems without a known checker are not checked.
+*/
+func CheckFileSystem(blockDev, fsType string, force bool) (string, error) {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return "", err
+	}
+	var status int
+	var stdout, stderr string
+	var err error
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		args := []string{"-p", blockDev}
+		if force {
+			args = []string{"-f", "-p", blockDev}
+		}
+		// e2fsck exit status 1 and 2 mean errors were corrected
+		if status, stdout, stderr, err = execProgram(nil, nil, nil, BIN_E2FSCK, args...); err != nil && status < 4 {
+			err = nil
+		}
+	case "xfs":
+		// A dirty log after an unclean shutdown fails the check too, but mounting replays the log.
+		if status, stdout, stderr, err = execProgram(nil, nil, nil, BIN_XFS_REPAIR, "-n", blockDev); err != nil && !force {
+			return strings.TrimSpace(stdout + stderr + "\nxfs_repair found problems, mounting regardless"), nil
+		}
+	case "btrfs":
+		if !force {
+			return "", nil
+		}
+		status, stdout, stderr, err = execProgram(nil, nil, nil, BIN_BTRFS, "check", "--readonly", blockDev)
+	default:
+		return "", nil
+	}
+	output := strings.TrimSpace(stdout + stderr)
+	if err != nil {
+		return output, fmt.Errorf("CheckFileSystem: %s file system on \"%s\" has errors (exit status %d) - %v", fsType, blockDev, status, err)
+	}
+	return output, nil
+}
@@ -0,0 +1,312 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	MigrationJournalFileMode = 0600        // MigrationJournalFileMode is the permission of migration journal file.
+	MigrationProgressPeriod  = time.Second // MigrationProgressPeriod is the minimum interval between two progress reports.
+
+	// Ask rsync to print item type, size, and name of each file. The %b escape delays the output until the file is transferred.
+	rsyncMigrateOutFormat = "%i|%b|%l|%n"
+)
+
+// MigrationJournalHeader is the first line of a migration journal, it describes the migration.
+type MigrationJournalHeader struct {
+	Source      string            `json:"source"`      // Source is the directory to copy from.
+	Destination string            `json:"destination"` // Destination is the directory to copy into.
+	Meta        map[string]string `json:"meta"`        // Meta carries the caller's details needed to resume the migration.
+}
+
+// MigratedFile is a journal entry of a file that has been completely copied.
+type MigratedFile struct {
+	Path    string `json:"path"`  // Path is relative to source and destination directories.
+	Size    int64  `json:"size"`  // Size is the file size in bytes.
+	ModTime int64  `json:"mtime"` // ModTime is the file modification time in unix nanoseconds.
+}
+
+// Return true if the file at the path still has the size and modification time as in the journal entry.
+func (file MigratedFile) Matches(filePath string) bool {
+	st, err := os.Lstat(filePath)
+	return err == nil && st.Mode().IsRegular() && st.Size() == file.Size && st.ModTime().UnixNano() == file.ModTime
+}
+
+/*
+MigrationJournal records the files copied by MigrateFiles in JSON lines format, so that an interrupted migration can be
+resumed without copying the files all over again. Every entry is flushed to disk before the file counts as copied.
+*/
+type MigrationJournal struct {
+	Path   string                  // Path is the location of journal file.
+	Header MigrationJournalHeader  // Header describes the migration.
+	Done   map[string]MigratedFile // Done are the files copied so far, keyed by their relative paths.
+	fh     *os.File
+}
+
+// CreateMigrationJournal creates a new journal file that must not already exist, and writes the header into it.
+func CreateMigrationJournal(journalPath string, header MigrationJournalHeader) (*MigrationJournal, error) {
+	fh, err := os.OpenFile(journalPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, MigrationJournalFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("CreateMigrationJournal: failed to create \"%s\" - %v", journalPath, err)
+	}
+	journal := &MigrationJournal{Path: journalPath, Header: header, Done: make(map[string]MigratedFile), fh: fh}
+	if err := journal.writeLine(header); err != nil {
+		fh.Close()
+		os.Remove(journalPath)
+		return nil, err
+	}
+	return journal, nil
+}
+
+/*
+OpenMigrationJournal reads the header and entries of an existing journal file, and opens it for more entries to be added.
+A line cut short by an interruption is ignored, the file it describes is copied again.
+*/
+func OpenMigrationJournal(journalPath string) (*MigrationJournal, error) {
+	fh, err := os.OpenFile(journalPath, os.O_RDWR|os.O_APPEND, MigrationJournalFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("OpenMigrationJournal: failed to open \"%s\" - %v", journalPath, err)
+	}
+	journal := &MigrationJournal{Path: journalPath, Done: make(map[string]MigratedFile), fh: fh}
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &journal.Header) != nil {
+		fh.Close()
+		return nil, fmt.Errorf("OpenMigrationJournal: \"%s\" does not begin with a valid header", journalPath)
+	}
+	for scanner.Scan() {
+		var file MigratedFile
+		if err := json.Unmarshal(scanner.Bytes(), &file); err != nil || file.Path == "" {
+			continue
+		}
+		journal.Done[file.Path] = file
+	}
+	if err := scanner.Err(); err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("OpenMigrationJournal: failed to read \"%s\" - %v", journalPath, err)
+	}
+	return journal, nil
+}
+
+// Write a JSON line into the journal and flush it to disk.
+func (journal *MigrationJournal) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("MigrationJournal: failed to serialise entry - %v", err)
+	}
+	if _, err := journal.fh.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("MigrationJournal: failed to write \"%s\" - %v", journal.Path, err)
+	}
+	if err := journal.fh.Sync(); err != nil {
+		return fmt.Errorf("MigrationJournal: failed to sync \"%s\" - %v", journal.Path, err)
+	}
+	return nil
+}
+
+// Add records a copied file in the journal, the entry is on disk by the time the function returns.
+func (journal *MigrationJournal) Add(file MigratedFile) error {
+	if err := journal.writeLine(file); err != nil {
+		return err
+	}
+	journal.Done[file.Path] = file
+	return nil
+}
+
+// Close closes the journal file.
+func (journal *MigrationJournal) Close() error {
+	return journal.fh.Close()
+}
+
+/*
+Verify that the files recorded in the journal are identical in size and modification time in both source and
+destination. Entries that do not match are forgotten, the files are then copied again. Return the total size of
+the verified files.
+*/
+func (journal *MigrationJournal) Verify(srcDir, destDir string) (verifiedBytes int64) {
+	for relPath, file := range journal.Done {
+		if file.Matches(path.Join(srcDir, relPath)) && file.Matches(path.Join(destDir, relPath)) {
+			verifiedBytes += file.Size
+		} else {
+			delete(journal.Done, relPath)
+		}
+	}
+	return
+}
+
+// Format the number of bytes in a human readable unit.
+func formatBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// CopyProgress reports bytes copied, percentage, and estimated time remaining, at most once per MigrationProgressPeriod.
+type CopyProgress struct {
+	Out          io.Writer // Out receives the progress reports, nil discards them.
+	Total        int64     // Total is the number of bytes to copy.
+	Copied       int64     // Copied is the number of bytes copied so far, including those copied before resuming.
+	start        time.Time
+	startCopied  int64
+	lastReported time.Time
+}
+
+// NewCopyProgress starts measuring the speed of a copy, of which so many bytes have already been copied.
+func NewCopyProgress(out io.Writer, total, copied int64) *CopyProgress {
+	return &CopyProgress{Out: out, Total: total, Copied: copied, start: time.Now(), startCopied: copied}
+}
+
+// String returns the progress as in "1.5 GiB of 3.0 GiB (50.0%), ETA 00:01:30".
+func (progress *CopyProgress) String() string {
+	return progress.format(time.Now())
+}
+
+func (progress *CopyProgress) format(now time.Time) string {
+	percent := 100.0
+	if progress.Total > 0 {
+		percent = float64(progress.Copied) * 100 / float64(progress.Total)
+	}
+	if percent > 100 {
+		// Files may grow while being copied
+		percent = 100
+	}
+	eta := "unknown"
+	elapsed := now.Sub(progress.start)
+	if copiedNow := progress.Copied - progress.startCopied; copiedNow > 0 && elapsed > 0 {
+		remaining := progress.Total - progress.Copied
+		if remaining < 0 {
+			remaining = 0
+		}
+		left := time.Duration(float64(elapsed) * float64(remaining) / float64(copiedNow)).Round(time.Second)
+		eta = fmt.Sprintf("%02d:%02d:%02d", int(left.Hours()), int(left.Minutes())%60, int(left.Seconds())%60)
+	}
+	return fmt.Sprintf("%s of %s (%.1f%%), ETA %s", formatBytes(progress.Copied), formatBytes(progress.Total), percent, eta)
+}
+
+// Add counts the bytes as copied, and reports the progress unless it was reported less than a period ago.
+func (progress *CopyProgress) Add(n int64) {
+	progress.add(n, time.Now())
+}
+
+func (progress *CopyProgress) add(n int64, now time.Time) {
+	progress.Copied += n
+	if progress.Out != nil && now.Sub(progress.lastReported) >= MigrationProgressPeriod {
+		fmt.Fprintf(progress.Out, "\r  %s", progress.format(now))
+		progress.lastReported = now
+	}
+}
+
+// Finish reports the final progress regardless of when the progress was last reported.
+func (progress *CopyProgress) Finish() {
+	if progress.Out != nil {
+		fmt.Fprintf(progress.Out, "\r  %s\n", progress.String())
+	}
+}
+
+/*
+Parse a line of rsync output printed in rsyncMigrateOutFormat. Return the relative path of a file that has been
+transferred, or an empty string if the line does not describe a transferred regular file.
+*/
+func parseRsyncMigratedItem(line string) string {
+	fields := strings.SplitN(line, "|", 4)
+	if len(fields) != 4 || !strings.HasPrefix(fields[0], ">f") {
+		return ""
+	}
+	if _, err := strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return ""
+	}
+	return fields[3]
+}
+
+/*
+Call rsync to recursively copy all files under source directory into destination directory, in the same way as
+MirrorFiles. Each copied file is recorded in the journal, and the progress is reported to the output stream.
+Files already recorded in the journal are verified by size and modification time and are not copied again; rsync
+skips them on its own as they are identical in size and modification time.
+*/
+func MigrateFiles(srcDir, destDir string, journal *MigrationJournal, progressOut io.Writer) error {
+	srcDir = path.Clean(srcDir)
+	destDir = path.Clean(destDir)
+	if len(srcDir) < 2 || srcDir[0] != '/' {
+		return fmt.Errorf("MigrateFiles: source \"%s\" should not be / and must be an absolute path", srcDir)
+	} else if len(destDir) < 2 || destDir[0] != '/' {
+		return fmt.Errorf("MigrateFiles: destination \"%s\" should not be / and must be an absolute path", destDir)
+	} else if strings.HasPrefix(destDir+"/", srcDir+"/") || strings.HasPrefix(srcDir+"/", destDir+"/") {
+		return fmt.Errorf("MigrateFiles: source \"%s\" and destination \"%s\" directory should not overlap", srcDir, destDir)
+	} else if journal == nil {
+		return errors.New("MigrateFiles: journal must not be nil")
+	}
+	if err := IsDir(srcDir); err != nil {
+		return fmt.Errorf("MigrateFiles: %v", err)
+	} else if err := IsDir(destDir); err != nil {
+		return fmt.Errorf("MigrateFiles: %v", err)
+	}
+	total, err := FileSpaceUsage(srcDir)
+	if err != nil {
+		return fmt.Errorf("MigrateFiles: failed to calculate size of \"%s\" - %v", srcDir, err)
+	}
+	progress := NewCopyProgress(progressOut, total, journal.Verify(srcDir, destDir))
+	// Enhance storage persistence before and after the operation
+	syscall.Sync()
+	defer syscall.Sync()
+	// The options are identical to those of MirrorFiles, except that the progress is reported instead of verbose output.
+	cmd := exec.Command(BIN_RSYNC, "-aHAXxSW", "--out-format="+rsyncMigrateOutFormat, srcDir+"/", destDir+"/")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var journalErr error
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		relPath := parseRsyncMigratedItem(scanner.Text())
+		if relPath == "" {
+			continue
+		}
+		// Record the file as rsync left it, its attributes have been copied from source by the time it is reported.
+		st, err := os.Lstat(path.Join(destDir, relPath))
+		if err != nil {
+			continue
+		}
+		if journalErr = journal.Add(MigratedFile{Path: relPath, Size: st.Size(), ModTime: st.ModTime().UnixNano()}); journalErr != nil {
+			// Without the journal the copy cannot be resumed, there is no point in carrying on.
+			cmd.Process.Kill()
+			break
+		}
+		progress.Add(st.Size())
+	}
+	io.Copy(io.Discard, stdout)
+	if err := waitTraced(cmd); journalErr != nil {
+		return journalErr
+	} else if err != nil {
+		return fmt.Errorf("MigrateFiles: rsync failed - %v", err)
+	}
+	// Files that were copied right before an interruption are skipped by rsync without being recorded, yet they are complete.
+	if progress.Copied < progress.Total {
+		progress.Copied = progress.Total
+	}
+	progress.Finish()
+	return nil
+}
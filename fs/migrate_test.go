@@ -0,0 +1,143 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrationJournal(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	MakeTestFile(tmpDir, "Source", "Dir A", "File 1")
+	MakeTestFile(tmpDir, "Source", "Dir A", "File 2")
+	MakeTestFile(tmpDir, "Destination", "Dir A", "File 1")
+	MakeTestFile(tmpDir, "Destination", "Dir A", "File 2")
+	srcDir, destDir := path.Join(tmpDir, "Source"), path.Join(tmpDir, "Destination")
+	// Give both copies of the files identical modification time
+	mtime := time.Unix(1500000000, 123)
+	for _, dir := range []string{srcDir, destDir} {
+		for _, name := range []string{"File 1", "File 2"} {
+			if err := os.Chtimes(path.Join(dir, "Dir A", name), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	journalPath := path.Join(tmpDir, "journal")
+	header := MigrationJournalHeader{Source: srcDir, Destination: destDir, Meta: map[string]string{"uuid": "abc"}}
+	journal, err := CreateMigrationJournal(journalPath, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"File 1", "File 2"} {
+		if err := journal.Add(MigratedFile{Path: "Dir A/" + name, Size: int64(len(TEST_FILE_CONTENT)), ModTime: mtime.UnixNano()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The journal must not be created over an existing one
+	if _, err := CreateMigrationJournal(journalPath, header); err == nil {
+		t.Fatal("did not error")
+	}
+	// A line cut short by interruption is ignored
+	fh, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(`{"path":"Dir A/File 3","si`)
+	fh.Close()
+	if st, err := os.Stat(journalPath); err != nil || st.Mode().Perm() != MigrationJournalFileMode {
+		t.Fatal(err, st)
+	}
+
+	journal, err = OpenMigrationJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if journal.Header.Source != srcDir || journal.Header.Destination != destDir || journal.Header.Meta["uuid"] != "abc" {
+		t.Fatalf("%+v", journal.Header)
+	}
+	if len(journal.Done) != 2 {
+		t.Fatalf("%+v", journal.Done)
+	}
+	// Both files are identical in source and destination
+	if verified := journal.Verify(srcDir, destDir); verified != int64(2*len(TEST_FILE_CONTENT)) || len(journal.Done) != 2 {
+		t.Fatal(verified, journal.Done)
+	}
+	// The destination file that differs in modification time must be copied again
+	if err := os.Chtimes(path.Join(destDir, "Dir A", "File 2"), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if verified := journal.Verify(srcDir, destDir); verified != int64(len(TEST_FILE_CONTENT)) || len(journal.Done) != 1 {
+		t.Fatal(verified, journal.Done)
+	}
+	if _, found := journal.Done["Dir A/File 1"]; !found {
+		t.Fatalf("%+v", journal.Done)
+	}
+
+	// Open a journal without header
+	if err := ioutil.WriteFile(journalPath, []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMigrationJournal(journalPath); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestCopyProgress(t *testing.T) {
+	var out bytes.Buffer
+	progress := NewCopyProgress(&out, 4*1024*1024*1024, 1024*1024*1024)
+	start := progress.start
+	if s := progress.format(start); s != "1.0 GiB of 4.0 GiB (25.0%), ETA unknown" {
+		t.Fatal(s)
+	}
+	// Another GiB copied in 10 seconds leaves 20 seconds for the remaining 2 GiB
+	progress.add(1024*1024*1024, start.Add(10*time.Second))
+	if s := out.String(); s != "\r  2.0 GiB of 4.0 GiB (50.0%), ETA 00:00:20" {
+		t.Fatal(s)
+	}
+	// Progress is reported at most once a second
+	progress.add(1024, start.Add(10*time.Second+500*time.Millisecond))
+	if strings.Count(out.String(), "\r") != 1 {
+		t.Fatal(out.String())
+	}
+	progress.add(1024, start.Add(11*time.Second))
+	if strings.Count(out.String(), "\r") != 2 {
+		t.Fatal(out.String())
+	}
+	progress.Finish()
+	if !strings.HasSuffix(out.String(), "\n") {
+		t.Fatal(out.String())
+	}
+	// Nothing to copy
+	if s := NewCopyProgress(nil, 0, 0).String(); s != "0 B of 0 B (100.0%), ETA unknown" {
+		t.Fatal(s)
+	}
+}
+
+func TestParseRsyncMigratedItem(t *testing.T) {
+	if name := parseRsyncMigratedItem(">f+++++++++|4|4|Dir A/File 1"); name != "Dir A/File 1" {
+		t.Fatal(name)
+	}
+	if name := parseRsyncMigratedItem(">f.st......|10|10|a|b"); name != "a|b" {
+		t.Fatal(name)
+	}
+	for _, line := range []string{"cd+++++++++|0|4096|Dir A/", "cL+++++++++|0|5|link -> target", "sending incremental file list", ""} {
+		if name := parseRsyncMigratedItem(line); name != "" {
+			t.Fatal(line, name)
+		}
+	}
+}
@@ -38,6 +38,18 @@ func (mount1 MountPoint) Equals(mount2 MountPoint) bool {
 	return reflect.DeepEqual(mount1, mount2)
 }
 
+// Remove btrfs sub-volume options (subvol, subvolid) from mount options, so that the file system is mounted at its top level.
+func (mount *MountPoint) DiscardBtrfsSubvolume() {
+	options := make([]string, 0, len(mount.Options))
+	for _, opt := range mount.Options {
+		if ignoreMountOptions[equalsSign.Split(opt, 2)[0]] {
+			continue
+		}
+		options = append(options, opt)
+	}
+	mount.Options = options
+}
+
 // Return the total size of the file system in Bytes.
 func (mount MountPoint) GetFileSystemSizeByte() (int64, error) {
 	fs := syscall.Statfs_t{}
@@ -0,0 +1,102 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/*
+Mount options understood by mount(8) regardless of file system, and those specific to each file system. An option
+that takes a value is listed with a trailing equals sign.
+*/
+var (
+	genericMountOptions = mountOptionSet(`async atime auto comment= context= defaults defcontext= dev diratime dirsync
+		exec fscontext= group iversion lazytime loud mand noatime noauto nodev nodiratime noexec nofail noiversion nolazytime
+		nomand norelatime nostrictatime nosuid nouser owner relatime ro rootcontext= rw silent strictatime suid sync user
+		users _netdev`)
+	fsMountOptions = map[string]map[string]bool{
+		"ext4": mountOptionSet(`acl auto_da_alloc barrier barrier= commit= data= data_err= dax delalloc discard errors=
+			grpjquota= grpquota init_itable init_itable= inode_readahead_blks= journal_async_commit journal_checksum
+			journal_ioprio= jqfmt= max_batch_time= min_batch_time= noacl noauto_da_alloc nobarrier nodelalloc nodiscard
+			noinit_itable noload nombcache noquota nouser_xattr prjquota quota resgid= resuid= sb= stripe= user_xattr
+			usrjquota= usrquota`),
+		"xfs": mountOptionSet(`allocsize= attr2 bsdgroups dax dax= discard filestreams gqnoenforce gquota grpid grpquota
+			ikeep inode32 inode64 largeio logbsize= logbufs= logdev= noalign noattr2 nodiscard nogrpid noikeep nolargeio
+			norecovery nouuid noquota pqnoenforce pquota prjquota qnoenforce quota rtdev= sunit= swalloc swidth=
+			sysvgroups uqnoenforce uquota usrquota wsync`),
+		"btrfs": mountOptionSet(`autodefrag barrier clear_cache commit= compress compress= compress-force
+			compress-force= datacow datasum degraded device= discard discard= enospc_debug fatal_errors= flushoncommit
+			max_inline= metadata_ratio= noautodefrag nobarrier nodatacow nodatasum nodiscard noenospc_debug
+			noflushoncommit norecovery nospace_cache nossd notreelog rescan_uuid_tree rescue= skip_balance space_cache
+			space_cache= ssd ssd_spread subvol= subvolid= thread_pool= treelog user_subvol_rm_allowed`),
+	}
+)
+
+// Return the set of options listed in the space-separated text.
+func mountOptionSet(options string) map[string]bool {
+	set := make(map[string]bool)
+	for _, option := range strings.Fields(options) {
+		set[option] = true
+	}
+	return set
+}
+
+// Return true if the option is known to mount(8) in general or to the file system (any known one if it is empty).
+func isKnownMountOption(fsType, option string) bool {
+	// Options for user space helpers such as "x-systemd.device-timeout=10s" are not interpreted by mount
+	if strings.HasPrefix(option, "x-") {
+		return true
+	}
+	name := option
+	if i := strings.IndexRune(option, '='); i != -1 {
+		name = option[:i+1]
+	}
+	if genericMountOptions[name] {
+		return true
+	}
+	if fsOptions, found := fsMountOptions[fsType]; found {
+		return fsOptions[name]
+	}
+	if fsType == "" {
+		for _, fsOptions := range fsMountOptions {
+			if fsOptions[name] {
+				return true
+			}
+		}
+	}
+	// Without a table for the file system, its options are given the benefit of doubt
+	return fsType != ""
+}
+
+// ParseMountOptions splits comma-separated mount options, spaces around the options and empty options are left out.
+func ParseMountOptions(in string) []string {
+	options := make([]string, 0)
+	for _, option := range mountOptionSeparator.Split(strings.TrimSpace(in), -1) {
+		if option != "" {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+/*
+ValidateMountOptions returns an error if an option contains whitespace or comma, which would not survive being joined
+and split by commas again. Otherwise it returns the options that are neither generic nor known to the file system (any
+file system supported by the table if fsType is empty); the caller may warn about them, as they are not necessarily
+wrong.
+*/
+func ValidateMountOptions(fsType string, options []string) (unknown []string, err error) {
+	unknown = make([]string, 0)
+	for _, option := range options {
+		if strings.IndexFunc(option, unicode.IsSpace) != -1 || strings.ContainsRune(option, ',') {
+			return nil, fmt.Errorf("Mount option \"%s\" must not contain whitespace or comma", option)
+		}
+		if option != "" && !isKnownMountOption(fsType, option) {
+			unknown = append(unknown, option)
+		}
+	}
+	return unknown, nil
+}
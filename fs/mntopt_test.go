@@ -0,0 +1,44 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	for in, expected := range map[string][]string{
+		"":                                  {},
+		"noatime":                           {"noatime"},
+		" rw , noatime,,errors=remount-ro ": {"rw", "noatime", "errors=remount-ro"},
+	} {
+		if options := ParseMountOptions(in); !reflect.DeepEqual(options, expected) {
+			t.Fatal(in, options)
+		}
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	for _, test := range []struct {
+		fsType  string
+		options []string
+		unknown []string
+		bad     bool
+	}{
+		{"ext4", []string{"rw", "noatime", "data=ordered", "x-systemd.device-timeout=10s", ""}, []string{}, false},
+		{"ext4", []string{"noatim", "compress=zstd"}, []string{"noatim", "compress=zstd"}, false},
+		{"btrfs", []string{"compress=zstd", "subvol=@/data", "_netdev"}, []string{}, false},
+		{"xfs", []string{"inode64", "logbsize=256k", "data=ordered"}, []string{"data=ordered"}, false},
+		{"", []string{"inode64", "compress=zstd", "nosuchoption"}, []string{"nosuchoption"}, false},
+		{"vfat", []string{"umask=077"}, []string{}, false},
+		{"ext4", []string{"rw noatime"}, nil, true},
+		{"ext4", []string{"rw,noatime"}, nil, true},
+		{"ext4", []string{"comment=a\tb"}, nil, true},
+	} {
+		unknown, err := ValidateMountOptions(test.fsType, test.options)
+		if (err != nil) != test.bad || !reflect.DeepEqual(unknown, test.unknown) {
+			t.Fatal(test, unknown, err)
+		}
+	}
+}
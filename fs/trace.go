@@ -0,0 +1,125 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"cryptctl2/sys"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TRACE_OUTPUT_MAX_LEN = 512 // TRACE_OUTPUT_MAX_LEN is the number of bytes of program error output kept in a trace line.
+)
+
+var (
+	traceOut  io.Writer  // traceOut receives the trace lines of external programs, tracing is off if it is nil.
+	traceLock sync.Mutex // traceLock protects traceOut and keeps the lines of programs run in parallel apart.
+
+	sysExec = sys.Exec // sysExec runs the external programs of execProgram, test cases replace it by a fake.
+)
+
+/*
+SetTrace makes the package log every external program it runs to the writer, along with the exit status and trimmed
+error output of the program. Key material is handed to the programs over stdin and extra file descriptors, the trace
+tells that they were given but never their content. A nil writer turns the trace off.
+*/
+func SetTrace(out io.Writer) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	traceOut = out
+}
+
+// FormatCommand returns the program and its arguments as they would be typed into a shell.
+func FormatCommand(programName string, programArgs ...string) string {
+	words := make([]string, 0, len(programArgs)+1)
+	for _, word := range append([]string{programName}, programArgs...) {
+		if word == "" || strings.ContainsAny(word, " \t\n\"'\\$`*?;&|<>(){}") {
+			word = strconv.Quote(word)
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// Return the error output in a single line, cut short if it is too long to be useful in a trace.
+func trimTraceOutput(output string) string {
+	lines := strings.FieldsFunc(strings.TrimSpace(output), func(r rune) bool {
+		return r == '\n' || r == '\r'
+	})
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	trimmed := strings.Join(lines, " | ")
+	if len(trimmed) > TRACE_OUTPUT_MAX_LEN {
+		trimmed = trimmed[:TRACE_OUTPUT_MAX_LEN] + "..."
+	}
+	return trimmed
+}
+
+/*
+Write the trace line of a program that has finished. The number of extra files tells how many file descriptors after
+stderr were handed to the program, they and stdin are redacted because they carry keys.
+*/
+func traceProgram(programName string, programArgs []string, hasStdin bool, extraFiles int, exitStatus int, err error, output string) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	if traceOut == nil {
+		return
+	}
+	line := "fs: " + FormatCommand(programName, programArgs...)
+	redacted := make([]string, 0, extraFiles+1)
+	if hasStdin {
+		redacted = append(redacted, "stdin")
+	}
+	for fd := 3; fd < 3+extraFiles; fd++ {
+		redacted = append(redacted, "fd "+strconv.Itoa(fd))
+	}
+	if len(redacted) > 0 {
+		line += " <" + strings.Join(redacted, ", ") + " redacted>"
+	}
+	if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+		line += fmt.Sprintf(" - failed to run: %v", err)
+	} else {
+		line += fmt.Sprintf(" - exit status %d", exitStatus)
+	}
+	if trimmed := trimTraceOutput(output); trimmed != "" {
+		line += " - " + trimmed
+	}
+	fmt.Fprintln(traceOut, line)
+}
+
+// Trace the command that has finished, the output is the error output of the program if it was captured.
+func traceCmd(cmd *exec.Cmd, err error, output string) {
+	exitStatus := -1
+	if cmd.ProcessState != nil {
+		exitStatus = cmd.ProcessState.ExitCode()
+	}
+	traceProgram(cmd.Args[0], cmd.Args[1:], cmd.Stdin != nil, len(cmd.ExtraFiles), exitStatus, err, output)
+}
+
+// Run an external program by sys.Exec (or its fake in test cases) and trace it.
+func execProgram(stdin io.Reader, stdout, stderr io.Writer, programName string, programArgs ...string) (exitStatus int,
+	stdoutStr, stderrStr string, execErr error) {
+	exitStatus, stdoutStr, stderrStr, execErr = sysExec(stdin, stdout, stderr, programName, programArgs...)
+	traceProgram(programName, programArgs, stdin != nil, 0, exitStatus, execErr, stderrStr)
+	return
+}
+
+// Run the command, return its combined stdout and stderr like exec.Cmd.CombinedOutput does, and trace it.
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	out, err := cmd.CombinedOutput()
+	traceCmd(cmd, err, string(out))
+	return out, err
+}
+
+// Wait for the command that has been started to finish, and trace it.
+func waitTraced(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	traceCmd(cmd, err, "")
+	return err
+}
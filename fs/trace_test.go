@@ -0,0 +1,67 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestFormatCommand(t *testing.T) {
+	if cmd := FormatCommand(BIN_MOUNT, "-o", "ro,noatime", "/dev/mapper/a", "/mnt/my data", ""); cmd != `/usr/bin/mount -o ro,noatime /dev/mapper/a "/mnt/my data" ""` {
+		t.Fatal(cmd)
+	}
+	if trimmed := trimTraceOutput("\n  line one  \r\nline two\n\n"); trimmed != "line one | line two" {
+		t.Fatal(trimmed)
+	}
+	if trimmed := trimTraceOutput(strings.Repeat("a", TRACE_OUTPUT_MAX_LEN+10)); len(trimmed) != TRACE_OUTPUT_MAX_LEN+3 {
+		t.Fatal(len(trimmed))
+	}
+}
+
+func TestSetTrace(t *testing.T) {
+	var trace bytes.Buffer
+	SetTrace(&trace)
+	defer SetTrace(nil)
+	// The key on stdin never appears in the trace
+	status, _, stderr, err := execProgram(bytes.NewReader([]byte("secret-key")), nil, nil, "sh", "-c", "cat >/dev/null; echo oops >&2; exit 3")
+	if status != 3 || stderr != "oops\n" || err == nil {
+		t.Fatal(status, stderr, err)
+	}
+	if line := trace.String(); line != "fs: sh -c \"cat >/dev/null; echo oops >&2; exit 3\" <stdin redacted> - exit status 3 - oops\n" {
+		t.Fatal(line)
+	}
+	trace.Reset()
+	keyReader, keyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyReader.Close()
+	keyWriter.Write([]byte("new-key"))
+	keyWriter.Close()
+	cmd := exec.Command("cmp", "-s", "/dev/fd/3", "-")
+	cmd.Stdin = bytes.NewReader([]byte("old-key"))
+	cmd.ExtraFiles = []*os.File{keyReader}
+	if _, err := combinedOutput(cmd); err == nil {
+		t.Fatal("did not error")
+	}
+	if line := trace.String(); line != "fs: cmp -s /dev/fd/3 - <stdin, fd 3 redacted> - exit status 1\n" {
+		t.Fatal(line)
+	}
+	// A program that cannot be started
+	trace.Reset()
+	execProgram(nil, nil, nil, "/does/not/exist")
+	if line := trace.String(); !strings.HasPrefix(line, "fs: /does/not/exist - failed to run: ") {
+		t.Fatal(line)
+	}
+	// Nothing is written once tracing is off
+	SetTrace(nil)
+	trace.Reset()
+	execProgram(nil, nil, nil, "true")
+	if trace.Len() != 0 {
+		t.Fatal(trace.String())
+	}
+}
@@ -4,6 +4,7 @@ package helper
 
 import (
 	"crypto/tls"
+	"net"
 )
 
 /*
@@ -35,7 +36,13 @@ Delivers the DNSName and IPAddress from a tls certificate
 Only the first element of both array are trated
 */
 func GetCertificatInfo(conn *tls.Conn) (DNSName, IPAddress string) {
-	state := conn.ConnectionState()
+	return GetStateCertificatInfo(conn.ConnectionState())
+}
+
+/*
+Delivers the DNSName and IPAddress from the tls certificate of a connection state, e.g. that of an HTTP request
+*/
+func GetStateCertificatInfo(state tls.ConnectionState) (DNSName, IPAddress string) {
 	for _, cert := range state.PeerCertificates {
 		if len(cert.DNSNames) != 0 {
 			DNSName = cert.DNSNames[0]
@@ -46,3 +53,38 @@ func GetCertificatInfo(conn *tls.Conn) (DNSName, IPAddress string) {
 	}
 	return
 }
+
+/*
+Delivers the IPAddress from the tls certificate of a connection state that equals the peer's IP, as a certificate may
+carry e.g. both the IPv4 and IPv6 address of a computer. Otherwise it is the IPAddress delivered by GetStateCertificatInfo
+*/
+func GetStateCertificatIPAddress(state tls.ConnectionState, peerIP string) string {
+	if peer := net.ParseIP(peerIP); peer != nil {
+		for _, cert := range state.PeerCertificates {
+			for _, ip := range cert.IPAddresses {
+				if ip.Equal(peer) {
+					return ip.String()
+				}
+			}
+		}
+	}
+	_, IPAddress := GetStateCertificatInfo(state)
+	return IPAddress
+}
+
+/*
+Delivers the common name of the certificate presented by the peer of a tls connection
+*/
+func GetCertificateCommonName(conn *tls.Conn) string {
+	return GetStateCertificateCommonName(conn.ConnectionState())
+}
+
+/*
+Delivers the common name of the certificate presented by the peer in a tls connection state
+*/
+func GetStateCertificateCommonName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
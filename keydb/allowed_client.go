@@ -0,0 +1,192 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// Types of allowed client entries.
+const (
+	AllowedClientExact = "exact" // AllowedClientExact is a DNS name or IP that must equal the client's.
+	AllowedClientGlob  = "glob"  // AllowedClientGlob is a DNS name pattern such as "node-*.hpc.example.com".
+	AllowedClientCIDR  = "cidr"  // AllowedClientCIDR is a subnet such as "10.20.0.0/16" that must contain the client's IP.
+)
+
+// AllowedClientType returns the type of an allowed client entry, which is told apart by its form.
+func AllowedClientType(entry string) string {
+	if strings.HasPrefix(entry, ClientGroupPrefix) {
+		return AllowedClientGroup
+	} else if strings.Contains(entry, "/") {
+		return AllowedClientCIDR
+	} else if strings.ContainsAny(entry, "*?[") {
+		return AllowedClientGlob
+	}
+	return AllowedClientExact
+}
+
+// ValidateAllowedClient returns an error if the allowed client entry is a malformed pattern or subnet.
+func ValidateAllowedClient(entry string) error {
+	switch AllowedClientType(entry) {
+	case AllowedClientGroup:
+		if !RegexClientGroupName.MatchString(strings.TrimPrefix(entry, ClientGroupPrefix)) {
+			return fmt.Errorf("Allowed client \"%s\" is not a valid client group reference", entry)
+		}
+	case AllowedClientCIDR:
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("Allowed client \"%s\" is not a valid subnet - %v", entry, err)
+		}
+	case AllowedClientGlob:
+		if _, err := path.Match(globDNSName(entry), ""); err != nil {
+			return fmt.Errorf("Allowed client \"%s\" is not a valid pattern - %v", entry, err)
+		}
+	}
+	return nil
+}
+
+/*
+Return the DNS name or pattern in lower case with its dots turned into slashes, so that path.Match never lets a
+wildcard match across a dot: "node-*.hpc.example.com" matches "node-1.hpc.example.com" but not
+"node-1.evil.hpc.example.com".
+*/
+func globDNSName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSuffix(name, ".")), ".", "/")
+}
+
+// Return true if the exact entry is the client's DNS name (regardless of case) or IP.
+func matchExactClient(entry, DNSName, IPAddress string) bool {
+	if DNSName != "" && strings.EqualFold(strings.TrimSuffix(entry, "."), strings.TrimSuffix(DNSName, ".")) {
+		return true
+	}
+	entryIP, clientIP := net.ParseIP(entry), net.ParseIP(IPAddress)
+	return entryIP != nil && clientIP != nil && entryIP.Equal(clientIP)
+}
+
+/*
+MatchAllowedClient returns the allowed client entry that grants access to the client identified by its certificate
+DNS name and IP. Exact entries take precedence, then patterns in the order they are listed, then the most specific
+subnet. If the record does not restrict its clients, the entry is empty and the client is allowed. Client group
+references are not resolved here and match nobody, see DB.IsClientAllowed.
+*/
+func (rec *Record) MatchAllowedClient(DNSName, IPAddress string) (entry string, allowed bool) {
+	entries := make([]string, 0, len(rec.AllowedClients))
+	for _, entry := range rec.AllowedClients {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return "", true
+	}
+	for _, entry := range entries {
+		if AllowedClientType(entry) == AllowedClientExact && matchExactClient(entry, DNSName, IPAddress) {
+			return entry, true
+		}
+	}
+	if DNSName != "" {
+		for _, entry := range entries {
+			if AllowedClientType(entry) != AllowedClientGlob {
+				continue
+			}
+			if matched, _ := path.Match(globDNSName(entry), globDNSName(DNSName)); matched {
+				return entry, true
+			}
+		}
+	}
+	clientIP := net.ParseIP(IPAddress)
+	if clientIP == nil {
+		return "", false
+	}
+	bestOnes := -1
+	for _, candidate := range entries {
+		if AllowedClientType(candidate) != AllowedClientCIDR {
+			continue
+		}
+		if _, subnet, err := net.ParseCIDR(candidate); err == nil && subnet.Contains(clientIP) {
+			if ones, _ := subnet.Mask.Size(); ones > bestOnes {
+				entry, bestOnes = candidate, ones
+			}
+		}
+	}
+	return entry, bestOnes >= 0
+}
+
+// ErrLastAllowedClient is returned for removing the last allowed client of a record, which would let any computer retrieve its key.
+var ErrLastAllowedClient = errors.New("the record would be left without allowed clients, which lets any computer retrieve its key")
+
+/*
+RemoveAllowedClients returns the allowed clients without the entries, given in the same form they were added. As a
+record without allowed clients may be retrieved by any computer, removing its last allowed clients is refused by
+ErrLastAllowedClient, unless force is true.
+*/
+func RemoveAllowedClients(allowed, entries []string, force bool) ([]string, error) {
+	remaining := append([]string{}, allowed...)
+	for _, entry := range entries {
+		remaining = removeEntry(remaining, strings.TrimSpace(entry))
+	}
+	if !force && hasAllowedClients(allowed) && !hasAllowedClients(remaining) {
+		return allowed, ErrLastAllowedClient
+	}
+	return remaining, nil
+}
+
+/*
+AddAllowedClient appends the entry to the allowed clients of the record and saves the record as a new version. A client
+group must exist to be referred to. Return false if the record already has the entry.
+*/
+func (db *DB) AddAllowedClient(uuid, entry string) (added bool, err error) {
+	entry = strings.TrimSpace(entry)
+	if err := ValidateAllowedClient(entry); err != nil {
+		return false, err
+	}
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return false, fmt.Errorf("AddAllowedClient: record \"%s\" does not exist", uuid)
+	}
+	if AllowedClientType(entry) == AllowedClientGroup {
+		if _, found := db.ClientGroups[strings.TrimPrefix(entry, ClientGroupPrefix)]; !found {
+			return false, fmt.Errorf("AddAllowedClient: client group \"%s\" does not exist", entry)
+		}
+	}
+	for _, existing := range rec.AllowedClients {
+		if strings.TrimSpace(existing) == entry {
+			return false, nil
+		}
+	}
+	rec.AllowedClients = append(append(make([]string, 0, len(rec.AllowedClients)+1), rec.AllowedClients...), entry)
+	if _, err := db.upsertVersioned(rec); err != nil {
+		return false, fmt.Errorf("AddAllowedClient: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return true, nil
+}
+
+/*
+RemoveAllowedClient removes the entry, given in the same form it was added, from the allowed clients of the record and
+saves the record as a new version. Return false if the record does not have the entry. The last allowed client of the
+record is only removed with force, see RemoveAllowedClients.
+*/
+func (db *DB) RemoveAllowedClient(uuid, entry string, force bool) (removed bool, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return false, fmt.Errorf("RemoveAllowedClient: record \"%s\" does not exist", uuid)
+	}
+	remaining, err := RemoveAllowedClients(rec.AllowedClients, []string{entry}, force)
+	if err != nil {
+		return false, fmt.Errorf("RemoveAllowedClient: \"%s\" is the last allowed client of \"%s\" - %w", strings.TrimSpace(entry), uuid, err)
+	} else if len(remaining) == len(rec.AllowedClients) {
+		return false, nil
+	}
+	rec.AllowedClients = remaining
+	if _, err := db.upsertVersioned(rec); err != nil {
+		return false, fmt.Errorf("RemoveAllowedClient: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,141 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedClientType(t *testing.T) {
+	for entry, expected := range map[string]string{
+		"node-1.hpc.example.com":  AllowedClientExact,
+		"10.20.0.1":               AllowedClientExact,
+		"node-*.hpc.example.com":  AllowedClientGlob,
+		"node-?.hpc.example.com":  AllowedClientGlob,
+		"10.20.0.0/16":            AllowedClientCIDR,
+		"fd00::/8":                AllowedClientCIDR,
+		"node-[0-9].example.com":  AllowedClientGlob,
+		"node-[0-9.example.com":   AllowedClientGlob,
+		"10.20.0.0/33":            AllowedClientCIDR,
+		"node-*.hpc.example.com.": AllowedClientGlob,
+	} {
+		if typ := AllowedClientType(entry); typ != expected {
+			t.Fatal(entry, typ)
+		}
+	}
+	for _, bad := range []string{"node-[0-9.example.com", "10.20.0.0/33", "a/b"} {
+		if ValidateAllowedClient(bad) == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	for _, good := range []string{"", "node-*.hpc.example.com", "10.20.0.0/16", "fd00::/8", "host"} {
+		if err := ValidateAllowedClient(good); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecord_MatchAllowedClient(t *testing.T) {
+	rec := Record{AllowedClients: []string{""}}
+	if entry, allowed := rec.MatchAllowedClient("any", "1.1.1.1"); !allowed || entry != "" {
+		t.Fatal(entry, allowed)
+	}
+	rec.AllowedClients = []string{"10.0.0.0/8", "10.20.0.0/16", "node-*.HPC.example.com", "Node-7.hpc.example.com", "192.168.1.1"}
+	for _, c := range []struct {
+		dnsName, ip, entry string
+		allowed            bool
+	}{
+		// Exact entries take precedence regardless of case
+		{"node-7.hpc.example.com", "10.20.0.7", "Node-7.hpc.example.com", true},
+		{"node-7.hpc.example.com.", "", "Node-7.hpc.example.com", true},
+		{"", "192.168.1.1", "192.168.1.1", true},
+		// Patterns come before subnets, and wildcards do not match across dots
+		{"NODE-8.hpc.example.com", "10.20.0.8", "node-*.HPC.example.com", true},
+		{"node-8.evil.hpc.example.com", "", "", false},
+		{"node-8.evil.hpc.example.com", "10.20.0.8", "10.20.0.0/16", true},
+		// The most specific subnet matches
+		{"", "10.30.0.1", "10.0.0.0/8", true},
+		{"other.example.com", "172.16.0.1", "", false},
+		{"", "", "", false},
+	} {
+		if entry, allowed := rec.MatchAllowedClient(c.dnsName, c.ip); entry != c.entry || allowed != c.allowed {
+			t.Fatal(c, entry, allowed)
+		}
+		if rec.IsClientAllowed(c.dnsName, c.ip) != c.allowed {
+			t.Fatal(c)
+		}
+	}
+}
+
+func TestDB_AddAllowedClient(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{Version: CurrentRecordVersion, UUID: "a", Key: []byte("key"), AllowedClients: []string{"10.0.0.1"}, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"10.20.0.0/33", "@missing"} {
+		if _, err := db.AddAllowedClient("a", bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if _, err := db.AddAllowedClient("b", "10.0.0.2"); err == nil {
+		t.Fatal("did not error on missing record")
+	}
+	if added, err := db.AddAllowedClient("a", " 10.20.0.0/16 "); !added || err != nil {
+		t.Fatal(added, err)
+	}
+	if added, err := db.AddAllowedClient("a", "10.0.0.1"); added || err != nil {
+		t.Fatal(added, err)
+	}
+	if removed, err := db.RemoveAllowedClient("a", "10.0.0.1", false); !removed || err != nil {
+		t.Fatal(removed, err)
+	}
+	if removed, err := db.RemoveAllowedClient("a", "10.0.0.1", false); removed || err != nil {
+		t.Fatal(removed, err)
+	}
+	// The last allowed client is kept, as the record would otherwise be open to any computer
+	if removed, err := db.RemoveAllowedClient("a", "10.20.0.0/16", false); removed || !errors.Is(err, ErrLastAllowedClient) {
+		t.Fatal(removed, err)
+	}
+	// Each change is saved as a new version
+	if rec, _ := db.GetByUUID("a"); !reflect.DeepEqual(rec.AllowedClients, []string{"10.20.0.0/16"}) {
+		t.Fatal(rec.AllowedClients)
+	}
+	if versions, err := db.ListVersions("a"); err != nil || len(versions) != 3 {
+		t.Fatal(versions, err)
+	}
+	// With force the last allowed client goes too
+	if removed, err := db.RemoveAllowedClient("a", "10.20.0.0/16", true); !removed || err != nil {
+		t.Fatal(removed, err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.AllowedClients) != 0 {
+		t.Fatal(rec.AllowedClients)
+	}
+}
+
+func TestRemoveAllowedClients(t *testing.T) {
+	allowed := []string{"10.0.0.1", " @hpc ", ""}
+	if remaining, err := RemoveAllowedClients(allowed, []string{"@hpc", "10.0.0.2"}, false); err != nil || !reflect.DeepEqual(remaining, []string{"10.0.0.1", ""}) {
+		t.Fatal(remaining, err)
+	}
+	if remaining, err := RemoveAllowedClients(allowed, []string{"@hpc", " 10.0.0.1"}, false); err != ErrLastAllowedClient || !reflect.DeepEqual(remaining, allowed) {
+		t.Fatal(remaining, err)
+	}
+	if remaining, err := RemoveAllowedClients(allowed, []string{"@hpc", "10.0.0.1"}, true); err != nil || !reflect.DeepEqual(remaining, []string{""}) {
+		t.Fatal(remaining, err)
+	}
+	// A record that does not restrict its clients has nothing to lose
+	if remaining, err := RemoveAllowedClients(nil, []string{"10.0.0.1"}, false); err != nil || len(remaining) != 0 {
+		t.Fatal(remaining, err)
+	}
+	if !reflect.DeepEqual(allowed, []string{"10.0.0.1", " @hpc ", ""}) {
+		t.Fatal("input was modified", allowed)
+	}
+}
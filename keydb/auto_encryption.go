@@ -0,0 +1,33 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+)
+
+// IsAutoEncrypted returns true if a client computer has encrypted the blank disk of the record on its own.
+func (rec *Record) IsAutoEncrypted() bool {
+	return rec.AutoEncryptedBy.Timestamp != 0
+}
+
+/*
+SetAutoEncryptedBy writes down the computer that has encrypted the blank disk of the record on its own, and writes the
+record file right away. Only a record that allows automatic encryption may be encrypted that way. Return the record as
+it is saved.
+*/
+func (db *DB) SetAutoEncryptedBy(uuid string, by AliveMessage) (Record, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return rec, fmt.Errorf("SetAutoEncryptedBy: record \"%s\" does not exist", uuid)
+	} else if !rec.AutoEncryption {
+		return rec, fmt.Errorf("SetAutoEncryptedBy: record \"%s\" does not allow automatic encryption", uuid)
+	}
+	rec.AutoEncryptedBy = by
+	if _, err := db.upsert(rec, true); err != nil {
+		return rec, fmt.Errorf("SetAutoEncryptedBy: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return rec, nil
+}
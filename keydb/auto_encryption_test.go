@@ -0,0 +1,54 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDB_SetAutoEncryptedBy(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{UUID: "a", Key: []byte("key a"), MountPoint: "/a", AutoEncryption: true, FileSystem: "ext4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{UUID: "b", Key: []byte("key b"), MountPoint: "/b"}); err != nil {
+		t.Fatal(err)
+	}
+	by := AliveMessage{Hostname: "host1", IP: "10.0.0.1", Timestamp: 1234}
+	if _, err := db.SetAutoEncryptedBy("b", by); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := db.SetAutoEncryptedBy("c", by); err == nil {
+		t.Fatal("did not error")
+	}
+	if rec, err := db.SetAutoEncryptedBy("a", by); err != nil || !rec.IsAutoEncrypted() {
+		t.Fatal(rec, err)
+	}
+	// Editing the record keeps the computer that encrypted it, and it survives reloading
+	rec, _ := db.GetByUUID("a")
+	rec.AutoEncryptedBy = AliveMessage{}
+	rec.MountPoint = "/a2"
+	if saved, err := db.UpdateFields(rec, false); err != nil || saved.AutoEncryptedBy != by {
+		t.Fatal(saved.AutoEncryptedBy, err)
+	}
+	if db, err = OpenDB(TestDBDir); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); rec.AutoEncryptedBy != by {
+		t.Fatal(rec.AutoEncryptedBy)
+	}
+	if rec, _ := db.GetByUUID("b"); rec.IsAutoEncrypted() {
+		t.Fatal(rec.AutoEncryptedBy)
+	}
+	// Clients are told which of their disks they may encrypt on their own
+	devices := db.ListClientDevices("host1", []string{"10.0.0.1"})
+	if len(devices) != 2 || !devices[0].AutoEncryption || devices[1].AutoEncryption {
+		t.Fatalf("%+v", devices)
+	}
+}
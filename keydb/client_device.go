@@ -0,0 +1,81 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"sort"
+)
+
+/*
+ClientDevice is a record that a client computer is allowed to unlock, as listed by list-client-devices. It carries
+neither the key nor the other record details, so that listing thousands of records stays cheap.
+*/
+type ClientDevice struct {
+	UUID         string `json:"uuid"`         // UUID is the UUID of the record.
+	MappedName   string `json:"mapped_name"`  // MappedName is the device mapper name the client opens the disk under.
+	MountPoint   string `json:"mount_point"`  // MountPoint is where the client mounts the file system.
+	Match        string `json:"match"`        // Match explains which allowed client entry grants access to the client.
+	Unrestricted bool   `json:"unrestricted"` // Unrestricted is true if the record allows any client rather than listing this one.
+	Alive        bool   `json:"alive"`        // Alive is true if the client is currently using the disk according to its alive messages.
+
+	AutoEncryption   bool `json:"auto_encryption,omitempty"`    // AutoEncryption is true if the client may encrypt the blank disk on its own.
+	AutoEncryptForce bool `json:"auto_encrypt_force,omitempty"` // AutoEncryptForce is true if the client may also encrypt a disk that is not blank.
+}
+
+/*
+ListClientDevices returns the records that allow the client given by its DNS name and any of its IPs, with client
+groups, name patterns, and subnets resolved, sorted by UUID. The client is alive on a record if its alive messages come
+from any of the IPs, from any of the aliveFrom IPs, or carry its DNS name, their validated certificate's name taking
+precedence over the reported one.
+*/
+func (db *DB) ListClientDevices(DNSName string, IPAddresses []string, aliveFrom ...string) []ClientDevice {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	if len(IPAddresses) == 0 {
+		IPAddresses = []string{""}
+	}
+	devices := make([]ClientDevice, 0, 8)
+	for _, rec := range db.RecordsByUUID {
+		var entry, from string
+		allowed := false
+		for _, ip := range IPAddresses {
+			if entry, from, allowed, _ = db.matchAllowedClient(rec, DNSName, ip); allowed {
+				break
+			}
+		}
+		if !allowed {
+			continue
+		}
+		device := ClientDevice{UUID: rec.UUID, MappedName: rec.MappedName, MountPoint: rec.MountPoint, Unrestricted: entry == "",
+			AutoEncryption: rec.AutoEncryption, AutoEncryptForce: rec.AutoEncryptForce}
+		switch {
+		case entry == "":
+			device.Match = "the record does not restrict its clients"
+		case from != "":
+			device.Match = entry + " (client group " + from + ")"
+		default:
+			device.Match = entry
+		}
+		for ip := range rec.AliveMessages {
+			alive, finalMessage := rec.IsHostAlive(ip)
+			if alive && (containsString(IPAddresses, ip) || containsString(aliveFrom, ip) || (DNSName != "" && finalMessage.Identity() == DNSName)) {
+				device.Alive = true
+			}
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].UUID < devices[j].UUID
+	})
+	return devices
+}
+
+// Return true if the string is among the list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDB_ListClientDevices(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveClientGroup(ClientGroup{Name: "hpc", Members: []string{"node-*.hpc.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for _, rec := range []Record{
+		{UUID: "d", MountPoint: "/d", AllowedClients: []string{"other.example.com"}},
+		{UUID: "c", MountPoint: "/c", AllowedClients: []string{"10.20.0.0/16"}},
+		{UUID: "b", MountPoint: "/b", AllowedClients: []string{"@hpc"},
+			AliveMessages: map[string][]AliveMessage{"10.20.3.4": {{Hostname: "node-1.hpc.example.com", IP: "10.20.3.4", Timestamp: now}}}},
+		{UUID: "a", MountPoint: "/a", MappedName: "data"},
+	} {
+		rec.Version = CurrentRecordVersion
+		rec.Key = []byte("secret key")
+		rec.AliveIntervalSec = 1
+		rec.AliveCount = 4
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices := db.ListClientDevices("node-1.hpc.example.com", []string{"10.20.3.4"})
+	if len(devices) != 3 || devices[0].UUID != "a" || devices[1].UUID != "b" || devices[2].UUID != "c" {
+		t.Fatalf("%+v", devices)
+	}
+	if !devices[0].Unrestricted || devices[0].MappedName != "data" || devices[0].Alive {
+		t.Fatalf("%+v", devices[0])
+	}
+	if devices[1].Unrestricted || !devices[1].Alive || devices[1].MountPoint != "/b" || !strings.Contains(devices[1].Match, "hpc") {
+		t.Fatalf("%+v", devices[1])
+	}
+	if devices[2].Match != "10.20.0.0/16" || devices[2].Alive {
+		t.Fatalf("%+v", devices[2])
+	}
+	// The host name alone suffices to tell the client is alive, and the listing never carries a key
+	devices = db.ListClientDevices("node-1.hpc.example.com", nil)
+	if len(devices) != 2 || !devices[1].Alive {
+		t.Fatalf("%+v", devices)
+	}
+	if content, _ := json.Marshal(devices); strings.Contains(string(content), "secret") {
+		t.Fatal(string(content))
+	}
+	if devices := db.ListClientDevices("unknown.example.com", []string{"192.168.0.1"}); len(devices) != 1 || devices[0].UUID != "a" {
+		t.Fatalf("%+v", devices)
+	}
+}
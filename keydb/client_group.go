@@ -0,0 +1,362 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/sys"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ClientGroupsFileName = "groups.json" // ClientGroupsFileName is the file in database directory that stores client groups.
+	ClientGroupPrefix    = "@"           // ClientGroupPrefix marks an allowed client entry that refers to a client group.
+	AllowedClientGroup   = "group"       // AllowedClientGroup is the type of allowed client entry that refers to a client group.
+)
+
+// RegexClientGroupName matches the names of client groups.
+var RegexClientGroupName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+/*
+ClientGroup is a named list of allowed client entries shared by many records. A record refers to the group by an
+allowed client entry "@name", and the group is resolved whenever a client's access is checked. A group may refer to
+other groups too.
+*/
+type ClientGroup struct {
+	Name    string   `json:"name"`    // Name identifies the group, it is referred to as "@name".
+	Members []string `json:"members"` // Members are allowed client entries, such as DNS names, patterns, subnets, and other groups.
+}
+
+// Return the path of the file that stores client groups.
+func (db *DB) clientGroupsPath() string {
+	return path.Join(db.Dir, ClientGroupsFileName)
+}
+
+// Read client groups from database directory, a database without client groups does not have the file. Caller must hold the lock.
+func (db *DB) loadClientGroups() {
+	db.ClientGroups = make(map[string]ClientGroup)
+	content, err := ioutil.ReadFile(db.clientGroupsPath())
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("DB.loadClientGroups: failed to read client groups, records referring to them allow no client - %v", err)
+		return
+	}
+	groups := make([]ClientGroup, 0, 8)
+	if err := json.Unmarshal(content, &groups); err != nil {
+		log.Printf("DB.loadClientGroups: failed to decode client groups, records referring to them allow no client - %v", err)
+		return
+	}
+	for _, group := range groups {
+		db.ClientGroups[group.Name] = group
+	}
+}
+
+// Write all client groups into database directory. Caller must hold the lock.
+func (db *DB) saveClientGroups() error {
+	content, err := json.MarshalIndent(db.listClientGroups(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode client groups - %v", err)
+	}
+	return sys.ReplaceFile(db.clientGroupsPath(), content, DB_REC_FILE_MODE, true)
+}
+
+// Return client groups sorted by name. Caller must hold the lock.
+func (db *DB) listClientGroups() []ClientGroup {
+	groups := make([]ClientGroup, 0, len(db.ClientGroups))
+	for _, group := range db.ClientGroups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// ListClientGroups returns client groups sorted by name.
+func (db *DB) ListClientGroups() []ClientGroup {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return db.listClientGroups()
+}
+
+/*
+Expand client group references among allowed client entries into the members of those groups, recursively. Return the
+expanded entries along with the group each of them came from. A reference to a missing group expands to nothing, and
+a group that refers back to itself, directly or through other groups, is an error. Caller must hold the lock.
+*/
+func (db *DB) expandAllowedClients(entries []string, via string, visiting map[string]bool) (expanded []string, origin map[string]string, err error) {
+	expanded = make([]string, 0, len(entries))
+	origin = make(map[string]string)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		} else if AllowedClientType(entry) != AllowedClientGroup {
+			expanded = append(expanded, entry)
+			if via != "" {
+				origin[entry] = via
+			}
+			continue
+		}
+		name := strings.TrimPrefix(entry, ClientGroupPrefix)
+		if visiting[name] {
+			return nil, nil, fmt.Errorf("client group \"%s\" refers to itself", name)
+		}
+		group, found := db.ClientGroups[name]
+		if !found {
+			continue
+		}
+		visiting[name] = true
+		members, memberOrigin, err := db.expandAllowedClients(group.Members, entry, visiting)
+		delete(visiting, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		expanded = append(expanded, members...)
+		for member, from := range memberOrigin {
+			if _, exists := origin[member]; !exists {
+				origin[member] = from
+			}
+		}
+	}
+	return
+}
+
+// ExpandAllowedClients returns the allowed client entries of the record with client groups resolved into their members.
+func (db *DB) ExpandAllowedClients(rec Record) ([]string, error) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	expanded, _, err := db.expandAllowedClients(rec.AllowedClients, "", map[string]bool{})
+	return expanded, err
+}
+
+/*
+Find the allowed client entry of the record that grants access to the client, with client groups resolved. A record
+that only refers to empty or missing groups allows no client, and a cyclic group reference denies access. The entry
+is described along with the group it came from. Caller must hold the lock.
+*/
+func (db *DB) matchAllowedClient(rec Record, DNSName, IPAddress string) (entry, from string, allowed bool, err error) {
+	expanded, origin, err := db.expandAllowedClients(rec.AllowedClients, "", map[string]bool{})
+	if err != nil {
+		return "", "", false, err
+	}
+	effective := Record{AllowedClients: expanded}
+	if len(expanded) == 0 && hasEntries(rec.AllowedClients) {
+		return "", "", false, nil
+	}
+	entry, allowed = effective.MatchAllowedClient(DNSName, IPAddress)
+	return entry, origin[entry], allowed, nil
+}
+
+// Return true if any of the entries is an allowed client.
+func hasEntries(entries []string) bool {
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the record allows the client, with client groups resolved. Caller must hold the lock.
+func (db *DB) isClientAllowed(rec Record, DNSName, IPAddress string) bool {
+	_, _, allowed, err := db.matchAllowedClient(rec, DNSName, IPAddress)
+	if err != nil {
+		log.Printf("DB.isClientAllowed: record %s allows no client - %v", rec.UUID, err)
+	}
+	return allowed
+}
+
+// IsClientAllowed returns true if the record does not restrict its clients, or the client is allowed with client groups resolved.
+func (db *DB) IsClientAllowed(rec Record, DNSName, IPAddress string) bool {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return db.isClientAllowed(rec, DNSName, IPAddress)
+}
+
+// DescribeClientMatch explains in a sentence which allowed client entry of the record grants access to the client, or that none does.
+func (db *DB) DescribeClientMatch(rec Record, DNSName, IPAddress string) string {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	entry, from, allowed, err := db.matchAllowedClient(rec, DNSName, IPAddress)
+	if err != nil {
+		return fmt.Sprintf("no client is allowed because %v", err)
+	} else if !allowed {
+		return fmt.Sprintf("no allowed client entry matches DNS name \"%s\" or IP \"%s\" of the client certificate", DNSName, IPAddress)
+	} else if entry == "" {
+		return "the record does not restrict its clients"
+	} else if from != "" {
+		return fmt.Sprintf("allowed client entry \"%s\" (%s) of client group %s matches", entry, AllowedClientType(entry), from)
+	}
+	return fmt.Sprintf("allowed client entry \"%s\" (%s) matches", entry, AllowedClientType(entry))
+}
+
+/*
+SaveClientGroup creates a client group or replaces the members of an existing one, and persists client groups
+immediately. The members must be valid allowed client entries, and the groups they refer to must exist and must not
+lead back to this group.
+*/
+func (db *DB) SaveClientGroup(group ClientGroup) error {
+	if !RegexClientGroupName.MatchString(group.Name) {
+		return fmt.Errorf("SaveClientGroup: group name \"%s\" should be made of letters, digits, underscores, and hyphens", group.Name)
+	}
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		if member = strings.TrimSpace(member); member == "" {
+			continue
+		} else if err := ValidateAllowedClient(member); err != nil {
+			return fmt.Errorf("SaveClientGroup: %v", err)
+		}
+		members = append(members, member)
+	}
+	group.Members = members
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for _, member := range group.Members {
+		if AllowedClientType(member) != AllowedClientGroup {
+			continue
+		} else if _, found := db.ClientGroups[strings.TrimPrefix(member, ClientGroupPrefix)]; !found {
+			return fmt.Errorf("SaveClientGroup: client group \"%s\" does not exist", member)
+		}
+	}
+	previous, existed := db.ClientGroups[group.Name]
+	db.ClientGroups[group.Name] = group
+	if _, _, err := db.expandAllowedClients([]string{ClientGroupPrefix + group.Name}, "", map[string]bool{}); err != nil {
+		db.restoreClientGroup(group.Name, previous, existed)
+		return fmt.Errorf("SaveClientGroup: %v", err)
+	}
+	if err := db.saveClientGroups(); err != nil {
+		db.restoreClientGroup(group.Name, previous, existed)
+		return fmt.Errorf("SaveClientGroup: %v", err)
+	}
+	return nil
+}
+
+// Put back a client group as it was before a failed change. Caller must hold the lock.
+func (db *DB) restoreClientGroup(name string, previous ClientGroup, existed bool) {
+	if existed {
+		db.ClientGroups[name] = previous
+	} else {
+		delete(db.ClientGroups, name)
+	}
+}
+
+/*
+ClientGroupReferences returns the UUIDs of records and the names of other client groups that refer to the client group
+directly, both sorted.
+*/
+func (db *DB) ClientGroupReferences(name string) (uuids, groups []string) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return db.clientGroupReferences(name)
+}
+
+// Caller must hold the lock.
+func (db *DB) clientGroupReferences(name string) (uuids, groups []string) {
+	uuids = make([]string, 0, 8)
+	groups = make([]string, 0, 8)
+	for uuid, rec := range db.RecordsByUUID {
+		if containsEntry(rec.AllowedClients, ClientGroupPrefix+name) {
+			uuids = append(uuids, uuid)
+		}
+	}
+	for other, group := range db.ClientGroups {
+		if other != name && containsEntry(group.Members, ClientGroupPrefix+name) {
+			groups = append(groups, other)
+		}
+	}
+	sort.Strings(uuids)
+	sort.Strings(groups)
+	return
+}
+
+// Return true if the entries contain the entry.
+func containsEntry(entries []string, entry string) bool {
+	for _, candidate := range entries {
+		if strings.TrimSpace(candidate) == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if any of the entries is not blank, a record without such entries may be retrieved by any computer.
+func hasAllowedClients(entries []string) bool {
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the entries without the entry.
+func removeEntry(entries []string, entry string) []string {
+	remaining := make([]string, 0, len(entries))
+	for _, candidate := range entries {
+		if strings.TrimSpace(candidate) != entry {
+			remaining = append(remaining, candidate)
+		}
+	}
+	return remaining
+}
+
+/*
+DeleteClientGroup removes a client group. A group that is still referred to by records or other groups is only removed
+if force is true, and then the references are removed too, the records are saved as new versions. Even with force, a
+group that is the only allowed client of a record is not removed, as the record would then be retrieved by any computer.
+Return the UUIDs of records that no longer refer to the group. Only the records loaded into memory are searched for
+references, the database should be fully loaded.
+*/
+func (db *DB) DeleteClientGroup(name string, force bool) ([]string, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	if _, found := db.ClientGroups[name]; !found {
+		return nil, fmt.Errorf("DeleteClientGroup: client group \"%s\" does not exist", name)
+	}
+	uuids, groups := db.clientGroupReferences(name)
+	if !force && (len(uuids) > 0 || len(groups) > 0) {
+		return nil, fmt.Errorf("DeleteClientGroup: client group \"%s\" is still referred to by records (%s) and client groups (%s)",
+			name, strings.Join(uuids, " "), strings.Join(groups, " "))
+	}
+	exposed := make([]string, 0)
+	for _, uuid := range uuids {
+		if !hasAllowedClients(removeEntry(db.RecordsByUUID[uuid].AllowedClients, ClientGroupPrefix+name)) {
+			exposed = append(exposed, uuid)
+		}
+	}
+	if len(exposed) > 0 {
+		return nil, fmt.Errorf("DeleteClientGroup: client group \"%s\" is the only allowed client of records (%s), which any computer could retrieve without it, give them other allowed clients first",
+			name, strings.Join(exposed, " "))
+	}
+	for _, uuid := range uuids {
+		rec := db.RecordsByUUID[uuid]
+		rec.AllowedClients = removeEntry(rec.AllowedClients, ClientGroupPrefix+name)
+		if _, err := db.upsertVersioned(rec); err != nil {
+			return nil, fmt.Errorf("DeleteClientGroup: failed to remove reference from record \"%s\" - %v", uuid, err)
+		}
+	}
+	before := make(map[string]ClientGroup, len(db.ClientGroups))
+	for other, group := range db.ClientGroups {
+		before[other] = group
+	}
+	for _, other := range groups {
+		group := db.ClientGroups[other]
+		group.Members = removeEntry(group.Members, ClientGroupPrefix+name)
+		db.ClientGroups[other] = group
+	}
+	delete(db.ClientGroups, name)
+	if err := db.saveClientGroups(); err != nil {
+		db.ClientGroups = before
+		return nil, fmt.Errorf("DeleteClientGroup: %v", err)
+	}
+	return uuids, nil
+}
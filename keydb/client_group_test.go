@@ -0,0 +1,108 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDB_ClientGroups(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveClientGroup(ClientGroup{Name: "bad name"}); err == nil {
+		t.Fatal("did not error on bad name")
+	}
+	if err := db.SaveClientGroup(ClientGroup{Name: "all", Members: []string{"@missing"}}); err == nil {
+		t.Fatal("did not error on missing group")
+	}
+	if err := db.SaveClientGroup(ClientGroup{Name: "hpc", Members: []string{"node-*.hpc.example.com", " 10.20.0.0/16 ", ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveClientGroup(ClientGroup{Name: "all", Members: []string{"@hpc", "db-1.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	// A group may not lead back to itself
+	if err := db.SaveClientGroup(ClientGroup{Name: "hpc", Members: []string{"@all"}}); err == nil {
+		t.Fatal("did not error on cyclic group")
+	}
+	rec := Record{Version: CurrentRecordVersion, UUID: "a", Key: []byte("key"), AllowedClients: []string{"@all"}, AliveIntervalSec: 1, AliveCount: 4}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if expanded, err := db.ExpandAllowedClients(rec); err != nil || !reflect.DeepEqual(expanded, []string{"node-*.hpc.example.com", "10.20.0.0/16", "db-1.example.com"}) {
+		t.Fatal(expanded, err)
+	}
+	if !db.IsClientAllowed(rec, "node-1.hpc.example.com", "") || !db.IsClientAllowed(rec, "", "10.20.3.4") || db.IsClientAllowed(rec, "db-2.example.com", "") {
+		t.Fatal("wrong access")
+	}
+	if desc := db.DescribeClientMatch(rec, "node-1.hpc.example.com", ""); desc != `allowed client entry "node-*.hpc.example.com" (glob) of client group @hpc matches` {
+		t.Fatal(desc)
+	}
+	if found, rejected, _ := db.Select(AliveMessage{IP: "1.1.1.1"}, true, "db-2.example.com", "", "a"); len(found) != 0 || len(rejected) != 1 {
+		t.Fatal(found, rejected)
+	}
+	// Groups are persisted and a change affects the records right away
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.ListClientGroups()) != 2 {
+		t.Fatal(db.ListClientGroups())
+	}
+	if err := db.SaveClientGroup(ClientGroup{Name: "hpc"}); err != nil {
+		t.Fatal(err)
+	}
+	if db.IsClientAllowed(rec, "node-1.hpc.example.com", "") || !db.IsClientAllowed(rec, "db-1.example.com", "") {
+		t.Fatal("wrong access after edit")
+	}
+	// A record that only refers to empty groups allows nobody
+	rec.AllowedClients = []string{"@hpc"}
+	if db.IsClientAllowed(rec, "anybody", "1.1.1.1") {
+		t.Fatal("empty group allowed a client")
+	}
+	// A cyclic reference that made its way into the file denies access
+	db.ClientGroups["hpc"] = ClientGroup{Name: "hpc", Members: []string{"@hpc"}}
+	if db.IsClientAllowed(rec, "anybody", "1.1.1.1") {
+		t.Fatal("cyclic group allowed a client")
+	}
+	db.ClientGroups["hpc"] = ClientGroup{Name: "hpc"}
+	// Referenced groups are only deleted with force
+	if uuids, groups := db.ClientGroupReferences("hpc"); len(uuids) != 0 || !reflect.DeepEqual(groups, []string{"all"}) {
+		t.Fatal(uuids, groups)
+	}
+	if _, err := db.DeleteClientGroup("all", false); err == nil {
+		t.Fatal("deleted referenced group")
+	}
+	// Not even with force is a group deleted that a record depends on alone, the record would be open to any computer
+	if _, err := db.DeleteClientGroup("all", true); err == nil || !strings.Contains(err.Error(), "(a)") {
+		t.Fatal(err)
+	}
+	if _, found := db.ClientGroups["all"]; !found {
+		t.Fatal("deleted the only allowed client of a record")
+	}
+	if rec, _ := db.GetByUUID("a"); !reflect.DeepEqual(rec.AllowedClients, []string{"@all"}) || db.IsClientAllowed(rec, "unrelated.example.com", "192.0.2.1") {
+		t.Fatal(rec.AllowedClients)
+	}
+	if _, err := db.AddAllowedClient("a", "db-1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if uuids, err := db.DeleteClientGroup("all", true); err != nil || !reflect.DeepEqual(uuids, []string{"a"}) {
+		t.Fatal(uuids, err)
+	}
+	if rec, _ := db.GetByUUID("a"); !reflect.DeepEqual(rec.AllowedClients, []string{"db-1.example.com"}) ||
+		db.IsClientAllowed(rec, "unrelated.example.com", "192.0.2.1") || !db.IsClientAllowed(rec, "db-1.example.com", "") {
+		t.Fatal(rec.AllowedClients)
+	}
+	if _, err := db.DeleteClientGroup("hpc", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil || len(db.ClientGroups) != 0 {
+		t.Fatal(db.ClientGroups, err)
+	}
+}
@@ -3,8 +3,8 @@
 package keydb
 
 import (
-	"cryptctl2/fs"
-	"cryptctl2/helper"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -30,77 +30,173 @@ All exported functions are safe for concurrent usage.
 */
 type DB struct {
 	Dir             string
-	RecordsByUUID   map[string]Record // key is record UUID string
-	RecordsByID     map[string]Record // when saved by built-in KMIP server, the ID is a sequence number; otherwise it can be anything.
-	LastSequenceNum int64             // the last sequence number currently in-use
-	Lock            *sync.RWMutex     // prevent concurrent access to records
+	RecordsByUUID   map[string]Record                    // key is record UUID string
+	RecordsByID     map[string]Record                    // when saved by built-in KMIP server, the ID is a sequence number; otherwise it can be anything.
+	LastSequenceNum int64                                // the last sequence number currently in-use
+	Lock            *sync.RWMutex                        // prevent concurrent access to records
+	MasterKey       []byte                               // encrypts key content of the record files, nil if the key content is stored in plain
+	LoadErrors      []RecordLoadError                    // record files that could not be loaded by the most recent reload
+	VersionsKept    int                                  // number of versions kept of each record changed by Upsert, 0 to keep none
+	ClientGroups    map[string]ClientGroup               // client groups referred to by allowed clients of records, keyed by name
+	Maintenance     MaintenanceMode                      // while in effect the server does not hand out keys
+	SealedPurges    map[string]map[string]PendingCommand // UUID - IP - command to remove the sealed copy of an erased record
+
+	rejectionCounts map[string]uint64 // number of rejected key retrievals by reason since the database was opened
+	readOnly        map[string]int    // UUID - on-disk version of the records that are served but never written, protected by Lock
+
+	writeShards        [recordWriteShards]recordWriteShard // record files are written under the lock of their shard
+	writeSeq           uint64                              // increases with each record content taken for a write, protected by Lock
+	reloadSeq          uint64                              // writes taken before the most recent reload are skipped, protected by all shard locks
+	aliveDirty         map[string]struct{}                 // UUIDs of records whose alive messages are not yet on disk, protected by Lock
+	aliveFlushInterval time.Duration                       // alive messages are flushed this often, 0 writes them upon each report, protected by Lock
+	aliveFlushLock     sync.Mutex                          // protects the channels of the alive flush timer
+	aliveFlushStop     chan struct{}                       // closed to stop the alive flush timer
+	aliveFlushDone     chan struct{}                       // closed once the alive flush timer has stopped
 }
 
 // Open a key database directory and read all key records into memory. Caller should consider to lock memory.
 func OpenDB(dir string) (db *DB, err error) {
+	return OpenDBWithMasterKey(dir, nil)
+}
+
+/*
+Open a key database directory and read all key records into memory, the master key decrypts the records that are
+encrypted and encrypts all records written from now on. Records that are not yet encrypted are read as usual.
+Caller should consider to lock memory.
+*/
+func OpenDBWithMasterKey(dir string, masterKey []byte) (db *DB, err error) {
+	if masterKey != nil {
+		if err := ValidateMasterKey(masterKey); err != nil {
+			return nil, err
+		}
+	}
 	if err := os.MkdirAll(dir, DB_DIR_FILE_MODE); err != nil {
 		return nil, fmt.Errorf("OpenDB: failed to make db directory \"%s\" - %v", dir, err)
 	}
-	db = &DB{Dir: dir, Lock: new(sync.RWMutex)}
+	db = &DB{Dir: dir, Lock: new(sync.RWMutex), MasterKey: masterKey, VersionsKept: DefaultRecordVersionsKept}
 	err = db.ReloadDB()
 	return
 }
 
 /*
 Open a key database directory but only load a single record into memory.
-If the specified record is not found in file system, an error is returned
+If the specified record is not found in file system, an error is returned, suggesting similar records if there are any.
 Caller should consider ot lock memory.
 */
 func OpenDBOneRecord(dir, recordUUID string) (db *DB, err error) {
+	return OpenDBOneRecordWithMasterKey(dir, recordUUID, nil)
+}
+
+// Open a key database directory but only load a single record into memory, see also OpenDBWithMasterKey.
+func OpenDBOneRecordWithMasterKey(dir, recordUUID string, masterKey []byte) (db *DB, err error) {
 	if err = ValidateUUID(recordUUID); err != nil {
 		return
 	}
+	if masterKey != nil {
+		if err = ValidateMasterKey(masterKey); err != nil {
+			return
+		}
+	}
 	if err := os.MkdirAll(dir, DB_DIR_FILE_MODE); err != nil {
 		return nil, fmt.Errorf("OpenDBOneRecord: failed to make db directory \"%s\" - %v", dir, err)
 	}
-	db = &DB{Dir: dir, Lock: new(sync.RWMutex), RecordsByUUID: map[string]Record{}, RecordsByID: map[string]Record{}}
+	db = &DB{Dir: dir, Lock: new(sync.RWMutex), RecordsByUUID: map[string]Record{}, RecordsByID: map[string]Record{}, MasterKey: masterKey,
+		VersionsKept: DefaultRecordVersionsKept}
+	db.loadClientGroups()
+	recordUUID = CanonicalRecordID(recordUUID)
 	keyRecord, err := db.ReadRecord(path.Join(dir, recordUUID))
-	if err == nil {
-		db.RecordsByUUID[recordUUID] = keyRecord
-		db.RecordsByID[keyRecord.ID] = keyRecord
+	if os.IsNotExist(err) {
+		return db, db.NotFoundError(recordUUID, nil)
+	} else if err == nil {
+		err = db.upgradeRecord(keyRecord, false)
 	}
 	return
 }
 
-// Read and deserialise a key record from file system.
+// Read and deserialise a key record from file system, and decrypt its key content if the record is encrypted.
 func (db *DB) ReadRecord(absPath string) (keyRecord Record, err error) {
 	keyRecordContent, err := ioutil.ReadFile(absPath)
 	if err != nil {
 		return
 	}
-	err = keyRecord.Deserialise(keyRecordContent)
+	return db.DecodeRecord(keyRecordContent)
+}
+
+// DecodeRecord deserialises the content of a record file, and decrypts its key content if the record is encrypted.
+func (db *DB) DecodeRecord(content []byte) (keyRecord Record, err error) {
+	if err = keyRecord.Deserialise(content); err != nil || len(keyRecord.SealedKey) == 0 {
+		return
+	}
+	if db.MasterKey == nil {
+		return keyRecord, ErrMasterKeyRequired
+	}
+	if keyRecord.Key, err = unsealKey(db.MasterKey, keyRecord.UUID, keyRecord.SealedKey); err != nil {
+		return
+	}
+	keyRecord.SealedKey = nil
+	if len(keyRecord.SealedPrev) > 0 {
+		if keyRecord.PreviousKey, err = unsealKey(db.MasterKey, previousKeyAAD(keyRecord.UUID), keyRecord.SealedPrev); err != nil {
+			return
+		}
+		keyRecord.SealedPrev = nil
+	}
 	return
 }
 
+// Serialise the record for its file, the key content is encrypted if the database has a master key.
+func (db *DB) serialiseRecord(rec *Record) ([]byte, error) {
+	rec.FillBlanks()
+	if db.MasterKey == nil || len(rec.Key) == 0 {
+		return rec.Serialise(), nil
+	}
+	sealed := *rec
+	var err error
+	if sealed.SealedKey, err = sealKey(db.MasterKey, rec.UUID, rec.Key); err != nil {
+		return nil, fmt.Errorf("failed to encrypt the key - %v", err)
+	}
+	sealed.Key = nil
+	if len(rec.PreviousKey) > 0 {
+		if sealed.SealedPrev, err = sealKey(db.MasterKey, previousKeyAAD(rec.UUID), rec.PreviousKey); err != nil {
+			return nil, fmt.Errorf("failed to encrypt the previous key - %v", err)
+		}
+		sealed.PreviousKey = nil
+	}
+	return sealed.Serialise(), nil
+}
+
 /*
 ReloadRecord reads the latest record content corresponding to the UUID from disk file and loads it into memory.
-The function panics if the record version is not the latest.
+A record of an older version is upgraded as by UpgradeRecord.
 */
 func (db *DB) ReloadRecord(uuid string) error {
 	if err := ValidateUUID(uuid); err != nil {
 		return err
 	}
-	rec, err := db.ReadRecord(path.Join(db.Dir, uuid))
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	// The record on disk takes precedence over the alive messages not yet flushed
+	rec, err := db.readRecordFileForReload(uuid)
 	if err != nil {
 		return err
 	}
-	db.RecordsByUUID[uuid] = rec
-	db.RecordsByID[rec.ID] = rec
-	return nil
+	delete(db.readOnly, uuid)
+	return db.UpgradeRecord(rec)
 }
 
 // (Re)load database records.
 func (db *DB) ReloadDB() error {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
+	// The records on disk take precedence over the alive messages not yet flushed
+	db.supersedeAllWrites()
 
 	db.RecordsByUUID = make(map[string]Record)
 	db.RecordsByID = make(map[string]Record)
+	db.LoadErrors = make([]RecordLoadError, 0)
+	db.readOnly = nil
+	db.loadClientGroups()
+	db.loadMaintenance()
+	db.loadSealedPurges()
 	keyFiles, err := ioutil.ReadDir(db.Dir)
 	if err != nil {
 		return fmt.Errorf("DB.ReloadDB: failed to read directory \"%s\" - %v", db.Dir, err)
@@ -110,25 +206,34 @@ func (db *DB) ReloadDB() error {
 	recordsToUpgrade := make([]Record, 0, 0)
 	// Read and deserialise each record file while finding out the last sequence number
 	for _, fileInfo := range keyFiles {
+		if isNotRecordFile(fileInfo.Name()) {
+			// Skip temporary files left behind by an interrupted write, and the previous versions of records.
+			continue
+		}
 		filePath := path.Join(db.Dir, fileInfo.Name())
 		if keyRecord, err := db.ReadRecord(filePath); err == nil {
+			/*
+				If the record was created by built-in KMIP server, the key is a sequence number.
+				Otherwise, it can be anything such as a number or ID or string.
+			*/
+			idSeq, _ := strconv.ParseInt(keyRecord.ID, 10, 64)
+			if idSeq > lastSequenceNum {
+				lastSequenceNum = idSeq
+			}
 			if keyRecord.Version == CurrentRecordVersion {
 				db.RecordsByUUID[keyRecord.UUID] = keyRecord
 				db.RecordsByID[keyRecord.ID] = keyRecord
-				/*
-					If the record was created by built-in KMIP server, the key is a sequence number.
-					Otherwise, it can be anything such as a number or ID or string.
-				*/
-				idSeq, _ := strconv.ParseInt(keyRecord.ID, 10, 64)
-				if idSeq > lastSequenceNum {
-					lastSequenceNum = idSeq
-				}
 			} else {
 				// Upgrade the record and place them into maps later
 				recordsToUpgrade = append(recordsToUpgrade, keyRecord)
 			}
+		} else if err == ErrMasterKeyRequired || err == ErrMasterKeyWrong {
+			// Carrying on without the record would serve an empty key
+			return fmt.Errorf("DB.ReloadDB: failed to read record \"%s\" - %v", filePath, err)
 		} else {
-			log.Printf("DB.ReloadDB: non-fatal failure occured when reading record \"%s\" - %v", filePath, err)
+			// A damaged record must not prevent the other records from being served
+			log.Printf("DB.ReloadDB: !!! record \"%s\" is damaged and has NOT been loaded, run \"cryptctl2 -action=fsck-keydb\" to inspect it - %v", filePath, err)
+			db.LoadErrors = append(db.LoadErrors, RecordLoadError{FileName: fileInfo.Name(), Error: err.Error()})
 		}
 	}
 	db.LastSequenceNum = lastSequenceNum
@@ -137,47 +242,17 @@ func (db *DB) ReloadDB() error {
 		 the upgrade from version 0 to 1 involves assigning records a sequence number that can only be determined
 		 after having read all records.
 	*/
+	sort.Slice(recordsToUpgrade, func(i, j int) bool { return recordsToUpgrade[i].UUID < recordsToUpgrade[j].UUID })
 	for _, record := range recordsToUpgrade {
 		if err := db.UpgradeRecord(record); err != nil {
 			return err
 		}
 	}
-	log.Printf("DB.ReloadDB: successfully loaded database of %d records", len(db.RecordsByUUID))
-	return nil
-}
-
-// Upgrade a record to the latest version.
-func (db *DB) UpgradeRecord(record Record) error {
-	switch record.Version {
-	case 0:
-		return db.UpgradeRecordToVersion1(record)
-	case 1:
-		// Version 2 brings PendingCommands map
-		record.Version = 2
-		record.PendingCommands = make(map[string][]PendingCommand)
-		if _, err := db.upsert(record, true); err != nil {
-			return err
-		}
-	default:
+	if len(db.LoadErrors) > 0 {
+		log.Printf("DB.ReloadDB: loaded database of %d records, %d records are damaged", len(db.RecordsByUUID), len(db.LoadErrors))
 		return nil
 	}
-	return nil
-}
-
-/*
-Record version 0 was the first version prior and equal to cryptctl2 1.99 pre-release.
-Version number 1 gives each record a KMIP key ID, a creation time, and knows whether key content is located on external KMIP server.
-*/
-func (db *DB) UpgradeRecordToVersion1(record Record) error {
-	/*
-		By contract, upsert assigns a record a sequence number if it does not yet have one.
-		After successful update, the record is updated in both RecordsByUUID and RecordsByID.
-	*/
-	_, err := db.upsert(record, true)
-	if err != nil {
-		return err
-	}
-	log.Printf("DB.UpgradeRecordToVersion1: just upgraded record \"%s\"", record.UUID)
+	log.Printf("DB.ReloadDB: successfully loaded database of %d records", len(db.RecordsByUUID))
 	return nil
 }
 
@@ -206,58 +281,117 @@ func (db *DB) upsert(rec Record, doSync bool) (string, error) {
 		db.LastSequenceNum++
 		rec.ID = strconv.FormatInt(db.LastSequenceNum, 10)
 	}
-	fh, err := os.OpenFile(path.Join(db.Dir, rec.UUID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DB_REC_FILE_MODE)
-	if err == nil {
-		defer fh.Close()
-	} else {
+	w, err := db.prepareWrite(&rec, doSync)
+	if err != nil {
 		return "", db.logIOFailure(rec, err)
 	}
-	if _, err := fh.Write(rec.Serialise()); err != nil {
+	if err := db.writeRecordFile(w, true); err != nil {
 		return "", db.logIOFailure(rec, err)
 	}
-	if doSync {
-		if err := fh.Sync(); err != nil {
-			return "", db.logIOFailure(rec, err)
-		}
-	}
-	// The in-memory copy of record is kept up to date with the copy on disk.
+	// The in-memory copy of record is kept up to date with the copy on disk, which now carries the alive messages too.
 	db.RecordsByUUID[rec.UUID] = rec
 	db.RecordsByID[rec.ID] = rec
-	return rec.ID, err
+	delete(db.aliveDirty, rec.UUID)
+	return rec.ID, nil
 }
 
-// Create/update and immediately persist a key record. IO errors are returned and logged to stderr.
+/*
+Create/update and immediately persist a key record, and keep its details as a new version. IO errors are returned and
+logged to stderr.
+*/
 func (db *DB) Upsert(rec Record) (kmipID string, err error) {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
-	return db.upsert(rec, true)
+	return db.upsertVersioned(rec)
 }
 
-// Retrieve a key record by its KMIP ID.
-func (db *DB) GetByID(id string) (rec Record, found bool) {
+/*
+ImportRecord creates or replaces the record as a whole and persists it immediately, e.g. to restore it from a backup.
+The record keeps its ID, and the sequence number moves past the ID so that new records do not reuse it.
+*/
+func (db *DB) ImportRecord(rec Record) error {
+	if err := ValidateUUID(rec.UUID); err != nil {
+		return err
+	} else if rec.ID == "" {
+		return fmt.Errorf("ImportRecord: record \"%s\" does not have an ID", rec.UUID)
+	}
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
+	if existing, found := db.RecordsByUUID[rec.UUID]; found {
+		delete(db.RecordsByID, existing.ID)
+	}
+	if idSeq, _ := strconv.ParseInt(rec.ID, 10, 64); idSeq > db.LastSequenceNum {
+		db.LastSequenceNum = idSeq
+	}
+	_, err := db.upsert(rec, true)
+	return err
+}
+
+/*
+UpdateFields persists the administrator's changes to a record without losing what has changed by itself since the
+administrator read the record. The key, its ID and rotation, and the record usage - client errors, lost hosts,
+evictions, rejections, last retrieval, and alive messages - are taken from the record as it is now. Pending commands are taken
+from the record as it is now too, unless replacePendingCommands is true. Unlock tokens are always taken from the
+record as it is now, so that a used token never becomes usable again, and the expired ones are removed. A record that does not exist yet is created
+as it is. The function returns the record as it is saved.
+*/
+func (db *DB) UpdateFields(rec Record, replacePendingCommands bool) (Record, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec.UUID = CanonicalRecordID(rec.UUID)
+	if current, found := db.RecordsByUUID[rec.UUID]; found {
+		rec.ID = current.ID
+		rec.Version = current.Version
+		rec.Key = current.Key
+		rec.SealedKey = current.SealedKey
+		rec.PreviousKey = current.PreviousKey
+		rec.SealedPrev = current.SealedPrev
+		rec.RotationTime = current.RotationTime
+		rec.ClientErrors = current.ClientErrors
+		rec.LostHosts = current.LostHosts
+		rec.Evictions = current.Evictions
+		rec.Rejections = current.Rejections
+		rec.Retrievals = current.Retrievals
+		rec.LastRetrieval = current.LastRetrieval
+		rec.AutoEncryptedBy = current.AutoEncryptedBy
+		rec.AliveMessages = current.AliveMessages
+		if !replacePendingCommands {
+			rec.PendingCommands = current.PendingCommands
+		}
+		rec.UnlockTokens = current.UnlockTokens
+		rec.RemoveExpiredUnlockTokens(time.Now())
+	}
+	if _, err := db.upsertVersioned(rec); err != nil {
+		return Record{}, err
+	}
+	return db.RecordsByUUID[rec.UUID], nil
+}
+
+// Retrieve a key record by its KMIP ID.
+func (db *DB) GetByID(id string) (rec Record, found bool) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
 	rec, found = db.RecordsByID[id]
 	return
 }
 
-// Retrieve a key record by its disk UUID.
+// Retrieve a key record by its disk UUID, which may carry the "UUID:" prefix.
 func (db *DB) GetByUUID(uuid string) (rec Record, found bool) {
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-	rec, found = db.RecordsByUUID[uuid]
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	rec, found = db.RecordsByUUID[CanonicalRecordID(uuid)]
 	return
 }
 
-// Record and immediately persist alive message that came from a host.
+// Record alive message that came from a host, it is persisted by the next alive flush or right away, see StartAliveFlush.
 func (db *DB) UpdateAliveMessage(latest AliveMessage, uuids ...string) (rejected []string) {
 	rejected = make([]string, 0, 8)
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 	for _, uuid := range uuids {
-		if record, exists := db.RecordsByUUID[uuid]; exists {
+		if record, exists := db.RecordsByUUID[CanonicalRecordID(uuid)]; exists {
 			if record.UpdateAliveMessage(latest) {
-				db.upsert(record, false) // IO error is logged
+				db.upsertAlive(record)
 			} else {
 				// Host is no longer considered to be alive
 				rejected = append(rejected, uuid)
@@ -270,24 +404,133 @@ func (db *DB) UpdateAliveMessage(latest AliveMessage, uuids ...string) (rejected
 	return
 }
 
-// Retrieve key records that belong to those UUIDs, and immediately persist last-retrieval information on those records.
+/*
+Record a client error on the record and persist it. Return true only if none of the clients has reported an error of
+this class before. An error is returned if the record does not exist.
+*/
+func (db *DB) AddClientError(uuid string, report ClientError) (newClass bool, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return false, fmt.Errorf("AddClientError: record \"%s\" does not exist", uuid)
+	}
+	newClass = rec.AddClientError(report)
+	_, err = db.upsert(rec, false)
+	return
+}
+
+// ErrKeyChanged is returned by UpdateKey if the record's key is no longer the one the caller expects to replace.
+var ErrKeyChanged = errors.New("the encryption key has been changed by someone else in the meantime")
+
+/*
+UpdateKey replaces the encryption key of the record and persists it immediately, all other record details remain in
+place. The key is only replaced if its SHA-256 digest is the expected one, so that of two concurrent rotations one
+fails rather than silently overwriting the other.
+*/
+func (db *DB) UpdateKey(uuid string, expectedDigest, newKey []byte) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return fmt.Errorf("UpdateKey: record \"%s\" does not exist", uuid)
+	}
+	if digest := sha256.Sum256(rec.Key); !bytes.Equal(digest[:], expectedDigest) {
+		return ErrKeyChanged
+	} else if rec.IsKeyRotationPending() {
+		return ErrKeyRotationPending
+	}
+	rec.Key = newKey
+	rec.RotationTime = time.Now()
+	if _, err := db.upsert(rec, true); err != nil {
+		return fmt.Errorf("UpdateKey: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
+
+// ErrKeyRelocated is returned by RelocateKey if the record no longer refers to the key ID the caller expects to replace.
+var ErrKeyRelocated = errors.New("the key reference has been changed by someone else in the meantime")
+
+/*
+RelocateKey changes where the encryption key of the record is stored and persists the record immediately, all other
+record details remain in place. The new ID refers to the key on a KMIP server, in which case the key content should be
+nil; or the key content is placed in the record itself, in which case an empty new ID assigns the next sequence number.
+The record is only changed if it still refers to the expected ID. The function returns the record's new ID.
+*/
+func (db *DB) RelocateKey(uuid, expectedID, newID string, key []byte) (string, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return "", fmt.Errorf("RelocateKey: record \"%s\" does not exist", uuid)
+	}
+	if rec.ID != expectedID {
+		return "", ErrKeyRelocated
+	}
+	oldRec := rec
+	rec.ID = newID
+	rec.Key = key
+	delete(db.RecordsByID, oldRec.ID)
+	id, err := db.upsert(rec, true)
+	if err != nil {
+		db.RecordsByID[oldRec.ID] = oldRec
+		return "", fmt.Errorf("RelocateKey: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return id, nil
+}
+
+/*
+Retrieve key records that belong to those UUIDs, and immediately persist last-retrieval information on those records.
+The records are written once the database lock is released, so that other retrievals do not wait for the disk, and IO
+errors are logged.
+*/
 func (db *DB) Select(aliveMessage AliveMessage, checkMaxActive bool, DNSName, IPAddress string, uuids ...string) (found map[string]Record, rejected, missing []string) {
 	found = make(map[string]Record)
 	rejected = make([]string, 0, 8)
 	missing = make([]string, 0, 8)
+	writes := make([]recordWrite, 0, len(uuids))
+	defer func() {
+		for _, w := range writes {
+			if err := db.writeRecordFile(w, true); err != nil {
+				db.logIOFailure(found[w.uuid], err)
+			}
+		}
+	}()
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 	for _, uuid := range uuids {
-		if record, exists := db.RecordsByUUID[uuid]; exists {
+		if record, exists := db.RecordsByUUID[CanonicalRecordID(uuid)]; exists {
+			if record.IsKeyForgotten() {
+				rejected = append(rejected, uuid)
+				continue
+			}
 			// Log dead hosts
-			ok1, deadFinalMessage := record.UpdateLastRetrieval(aliveMessage, checkMaxActive)
+			// Dead hosts are kept as lost, so that the administrator learns of them even if they expire upon retrieval.
+			deadFinalMessage := record.expireDeadHosts()
+			ok1, _ := record.UpdateLastRetrieval(aliveMessage, checkMaxActive)
 			if len(deadFinalMessage) > 0 {
 				log.Printf("DB.Select: record %s has not heard %d from these hosts: %+v", uuid, time.Now().Unix(), deadFinalMessage)
 			}
 			// Check if host is allowed to connect the record
-			ok2 := helper.IsEmpty(record.AllowedClients) || helper.Contains(record.AllowedClients, DNSName) || helper.Contains(record.AllowedClients, IPAddress)
+			ok2 := db.isClientAllowed(record, DNSName, IPAddress)
 			if ok1 && ok2 {
-				db.upsert(record, true) // IO error is logged
+				// A computer that unlocks the disk during a rotation helps to carry it out
+				record.queueKeyRotation(aliveMessage.IP, time.Now())
+			}
+			if _, readOnly := db.readOnly[record.UUID]; ok1 && ok2 && readOnly {
+				// The last retrieval of a read-only record is only kept in memory
+				db.RecordsByUUID[record.UUID] = record
+				db.RecordsByID[record.ID] = record
+				found[record.UUID] = record
+			} else if ok1 && ok2 {
+				if w, err := db.prepareWrite(&record, true); err != nil {
+					db.logIOFailure(record, err)
+				} else {
+					writes = append(writes, w)
+				}
+				db.RecordsByUUID[record.UUID] = record
+				db.RecordsByID[record.ID] = record
+				delete(db.aliveDirty, record.UUID)
 				found[record.UUID] = record
 			} else {
 				if !ok1 {
@@ -298,6 +541,9 @@ func (db *DB) Select(aliveMessage AliveMessage, checkMaxActive bool, DNSName, IP
 				}
 				// Too many active hosts
 				rejected = append(rejected, uuid)
+				if len(deadFinalMessage) > 0 {
+					db.upsertAlive(record)
+				}
 			}
 		} else {
 			missing = append(missing, uuid)
@@ -314,13 +560,73 @@ func (db *DB) List() (sortedRecords RecordSlice) {
 	for _, rec := range db.RecordsByUUID {
 		// Do not return encryption key
 		rec.Key = nil
+		rec.PreviousKey = nil
 		sortedRecords = append(sortedRecords, rec)
 	}
 	sort.Sort(sortedRecords)
 	return
 }
 
-// Erase a record from both memory and disk.
+/*
+GetByGroup returns all records (not including key content) that belong to the consistency group, sorted in the order
+they should be mounted - ascending group priority, and then UUID.
+*/
+func (db *DB) GetByGroup(group string) (members RecordSlice) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	members = make([]Record, 0, 8)
+	if group == "" {
+		return
+	}
+	for _, rec := range db.RecordsByUUID {
+		if rec.Group == group {
+			// Do not return encryption key
+			rec.Key = nil
+			rec.PreviousKey = nil
+			members = append(members, rec)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].GroupPriority != members[j].GroupPriority {
+			return members[i].GroupPriority < members[j].GroupPriority
+		}
+		return members[i].UUID < members[j].UUID
+	})
+	return
+}
+
+/*
+ListAliveHosts removes dead hosts from the records and returns the computers currently using their keys, sorted by
+record UUID and then IP. If UUID is not empty, only that record is looked at; if host is not empty, only the computers
+whose IP or host name match are returned.
+*/
+func (db *DB) ListAliveHosts(uuid, host string) (hosts []AliveHost) {
+	// Removing dead hosts modifies records, hence the write lock.
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	hosts = make([]AliveHost, 0, 8)
+	uuids := make([]string, 0, len(db.RecordsByUUID))
+	for recUUID := range db.RecordsByUUID {
+		if uuid == "" || recUUID == uuid {
+			uuids = append(uuids, recUUID)
+		}
+	}
+	sort.Strings(uuids)
+	for _, recUUID := range uuids {
+		rec := db.RecordsByUUID[recUUID]
+		for _, aliveHost := range rec.ListAliveHosts() {
+			if host == "" || aliveHost.IP == host || aliveHost.Hostname == host || aliveHost.CertName == host {
+				hosts = append(hosts, aliveHost)
+			}
+		}
+	}
+	return
+}
+
+/*
+Erase a record from both memory and disk. The computers that may keep a TPM-sealed copy of the record receive the
+purge-sealed command when they poll for commands next time.
+*/
 func (db *DB) Erase(uuid string) error {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
@@ -328,29 +634,43 @@ func (db *DB) Erase(uuid string) error {
 	if !exists {
 		return fmt.Errorf("DB.Erase: record '%s' does not exist", uuid)
 	}
+	// Computers that may keep a sealed copy of the record are told to remove it once they poll for commands
+	if purges := sealedPurgesOf(rec, time.Now()); len(purges) > 0 {
+		allPurges := db.copySealedPurges()
+		allPurges[rec.UUID] = purges
+		if err := db.saveSealedPurges(allPurges); err != nil {
+			return fmt.Errorf("DB.Erase: the record is not erased - %v", err)
+		}
+	}
 	delete(db.RecordsByUUID, uuid)
 	delete(db.RecordsByID, rec.ID)
-	if err := fs.SecureErase(path.Join(db.Dir, uuid), true); err != nil {
+	if err := db.eraseRecordFile(uuid); err != nil {
 		return fmt.Errorf("DB.Erase: failed to delete db record for %s - %v", uuid, err)
 	}
+	if err := db.eraseBackup(uuid); err != nil {
+		return fmt.Errorf("DB.Erase: failed to delete the backup of db record for %s - %v", uuid, err)
+	}
+	if err := db.eraseVersions(uuid); err != nil {
+		return fmt.Errorf("DB.Erase: failed to delete the versions of db record for %s - %v", uuid, err)
+	}
 	return nil
 }
 
 /*
 UpdateSeenFlag updates "seen" flag of a pending command to true.
-The flag is updated by looking for a command record matched to the specified IP, array index, and content.
-If a matching record is not found, the function will do nothing.
+The flag is updated by looking for a command record matched to the specified IP and ID, or the content if the ID is
+empty. If a matching record is not found, the function will do nothing.
 */
-func (db *DB) UpdateSeenFlag(uuid, ip string, content interface{}) {
+func (db *DB) UpdateSeenFlag(uuid, ip, id string, content interface{}) {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
-	rec, found := db.RecordsByUUID[uuid]
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
 	if !found {
 		return
 	}
 	cmds, found := rec.PendingCommands[ip]
 	for i, cmd := range cmds {
-		if reflect.DeepEqual(cmd.Content, content) {
+		if (id != "" && cmd.ID == id) || (id == "" && reflect.DeepEqual(cmd.Content, content)) {
 			cmds[i].SeenByClient = true
 			break
 		}
@@ -366,7 +686,7 @@ If a matching record is not found, the function will do nothing.
 func (db *DB) UpdateCommandResult(uuid, ip string, content interface{}, result string) {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
-	rec, found := db.RecordsByUUID[uuid]
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
 	if !found {
 		return
 	}
@@ -375,8 +695,38 @@ func (db *DB) UpdateCommandResult(uuid, ip string, content interface{}, result s
 		if cmd.Content == content {
 			cmds[i].SeenByClient = true
 			cmds[i].ClientResult = result
+			// Older clients only tell success by the result text
+			cmds[i].Succeeded = result == "Success"
+			cmds[i].ResultTime = time.Now()
 			break
 		}
 	}
 	db.upsert(rec, false)
 }
+
+/*
+SetCommandResult saves whether a pending command succeeded along with the client's message and how long it took, and
+persists the record immediately. The pending command is matched by record UUID, IP, and command ID, or the moment it was issued and content
+if the ID is empty. Return false if a matching command is not found.
+*/
+func (db *DB) SetCommandResult(uuid, ip, id string, validFrom time.Time, content interface{}, succeeded bool, message string, duration time.Duration) bool {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return false
+	}
+	cmds := rec.PendingCommands[ip]
+	for i, cmd := range cmds {
+		if cmd.MatchesID(id, validFrom, content) {
+			cmds[i].SeenByClient = true
+			cmds[i].Succeeded = succeeded
+			cmds[i].ClientResult = message
+			cmds[i].Duration = duration
+			cmds[i].ResultTime = time.Now()
+			db.upsert(rec, true)
+			return true
+		}
+	}
+	return false
+}
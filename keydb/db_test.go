@@ -3,8 +3,12 @@
 package keydb
 
 import (
+	"crypto/sha256"
+	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -64,17 +68,17 @@ func TestRecordCRUD(t *testing.T) {
 	rec2.ID = "2"
 	rec2Alive.ID = "2"
 	// Select one record and then select both records
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "doesnotexist"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive}) ||
+	if found, rejected, missing := db.Select(aliveMsg, true, "", "", "1", "doesnotexist"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive}) ||
 		!reflect.DeepEqual(rejected, []string{}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatalf("\n%+v\n%+v\n%+v\n%+v\n", found, map[string]Record{rec1.UUID: rec1Alive}, rejected, missing)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec2.UUID: rec2Alive}) ||
+	if found, rejected, missing := db.Select(aliveMsg, true, "", "", "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec2.UUID: rec2Alive}) ||
 		!reflect.DeepEqual(rejected, []string{"1"}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatal(found, rejected, missing)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, false, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive, rec2.UUID: rec2Alive}) ||
+	if found, rejected, missing := db.Select(aliveMsg, false, "", "", "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive, rec2.UUID: rec2Alive}) ||
 		!reflect.DeepEqual(rejected, []string{}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatal(found, rejected, missing)
@@ -101,7 +105,7 @@ func TestRecordCRUD(t *testing.T) {
 	if err := db.Erase(rec1.UUID); err != nil {
 		t.Fatal(err)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1"); len(found) != 0 ||
+	if found, rejected, missing := db.Select(aliveMsg, true, "", "", "1"); len(found) != 0 ||
 		!reflect.DeepEqual(rejected, []string{}) ||
 		!reflect.DeepEqual(missing, []string{"1"}) {
 		t.Fatal(found, rejected, missing)
@@ -111,7 +115,7 @@ func TestRecordCRUD(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "2"); len(found) != 0 ||
+	if found, rejected, missing := db.Select(aliveMsg, true, "", "", "1", "2"); len(found) != 0 ||
 		!reflect.DeepEqual(rejected, []string{"2"}) ||
 		!reflect.DeepEqual(missing, []string{"1"}) {
 		t.Fatal(found, missing)
@@ -295,13 +299,15 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 		Validity:  10 * time.Hour,
 		IP:        "1.1.1.1",
 		Content:   "1st command",
+		ID:        "1st",
 	})
-	// Record 2 is expired
+	// Record 2 is expired and no longer retained
 	recA.AddPendingCommand("1.1.1.1", PendingCommand{
-		ValidFrom: start.Add(-11 * time.Hour),
+		ValidFrom: start.Add(-101 * time.Hour),
 		Validity:  10 * time.Hour,
 		IP:        "1.1.1.1",
 		Content:   "2nd command",
+		ID:        "2nd",
 	})
 	// Record 3 is valid
 	recA.AddPendingCommand("2.2.2.2", PendingCommand{
@@ -309,10 +315,11 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 		Validity:  10 * time.Hour,
 		IP:        "2.2.2.2",
 		Content:   "3rd command",
+		ID:        "3rd",
 	})
 	db.RecordsByUUID["a"] = recA
 
-	db.UpdateSeenFlag("a", "1.1.1.1", "1st command")
+	db.UpdateSeenFlag("a", "1.1.1.1", "", "1st command")
 	db.UpdateCommandResult("a", "1.1.1.1", "2nd command", "success")
 	db.UpdateCommandResult("a", "2.2.2.2", "3rd command", "failure")
 
@@ -324,6 +331,7 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 				IP:           "1.1.1.1",
 				Content:      "1st command",
 				SeenByClient: true,
+				ID:           "1st",
 			},
 		},
 		"2.2.2.2": {
@@ -333,10 +341,17 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 				IP:           "2.2.2.2",
 				Content:      "3rd command",
 				SeenByClient: true,
+				ID:           "3rd",
 				ClientResult: "failure",
 			},
 		},
 	}
+	// The moment of result is recorded
+	resultCmd := &db.RecordsByUUID["a"].PendingCommands["2.2.2.2"][0]
+	if resultCmd.ResultTime.IsZero() || resultCmd.Succeeded {
+		t.Fatalf("%+v", resultCmd)
+	}
+	resultCmd.ResultTime = time.Time{}
 	if !reflect.DeepEqual(expected, db.RecordsByUUID["a"].PendingCommands) {
 		t.Fatalf("\n%+v\n%+v\n", expected, db.RecordsByUUID["a"].PendingCommands)
 	}
@@ -344,3 +359,297 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 		t.Fatalf("\n%+v\n%+v\n", expected, db.RecordsByID["id1"].PendingCommands)
 	}
 }
+
+func TestDB_SetCommandResult(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	rec := Record{UUID: "a", Key: []byte{}, PendingCommands: make(map[string][]PendingCommand)}
+	// The same command issued again after the first one was carried out, only the later one is reported
+	rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: start.Add(-time.Minute), Validity: time.Hour, Content: "umount", Succeeded: true, ResultTime: start})
+	rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: start, Validity: time.Hour, Content: "umount"})
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if db.SetCommandResult("a", "1.1.1.1", "", start.Add(time.Second), "umount", true, "", 0) ||
+		db.SetCommandResult("a", "2.2.2.2", "", start, "umount", true, "", 0) ||
+		db.SetCommandResult("b", "1.1.1.1", "", start, "umount", true, "", 0) {
+		t.Fatal("should not have matched")
+	}
+	if !db.SetCommandResult("UUID:a", "1.1.1.1", "", start, "umount", false, "target is busy", 3*time.Second) {
+		t.Fatal("did not match")
+	}
+	// The result must survive reloading the database
+	db, err = OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := db.RecordsByUUID["a"].PendingCommands["1.1.1.1"]
+	if cmds[0].Status() != PendingCommandStatusSucceeded {
+		t.Fatalf("%+v", cmds[0])
+	}
+	if cmds[1].Status() != PendingCommandStatusFailed || cmds[1].ClientResult != "target is busy" || !cmds[1].SeenByClient ||
+		cmds[1].ResultTime.IsZero() || cmds[1].Duration != 3*time.Second {
+		t.Fatalf("%+v", cmds[1])
+	}
+	// A client that knows the command ID is matched by the ID alone
+	if db.SetCommandResult("a", "1.1.1.1", "not an ID", start, "umount", true, "", 0) {
+		t.Fatal("should not have matched")
+	}
+	if !db.SetCommandResult("a", "1.1.1.1", cmds[0].ID, time.Time{}, nil, true, "done again", 0) {
+		t.Fatal("did not match")
+	}
+	if cmds := db.RecordsByUUID["a"].PendingCommands["1.1.1.1"]; cmds[0].ClientResult != "done again" || cmds[1].ClientResult != "target is busy" {
+		t.Fatalf("%+v", cmds)
+	}
+}
+
+func TestDB_GetByGroup(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []Record{
+		{UUID: "data", Key: []byte{1}, Group: "db1", GroupPriority: 2},
+		{UUID: "log", Key: []byte{2}, Group: "db1", GroupPriority: 1},
+		{UUID: "index", Key: []byte{3}, Group: "db1", GroupPriority: 2},
+		{UUID: "other", Key: []byte{4}, Group: "db2"},
+		{UUID: "single", Key: []byte{5}},
+	} {
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := db.GetByGroup("db1")
+	if uuids := members.GroupMemberUUIDs(); !reflect.DeepEqual(uuids, []string{"log", "data", "index"}) {
+		t.Fatal(uuids)
+	}
+	for _, member := range members {
+		if member.Key != nil {
+			t.Fatal("key content should not be returned")
+		}
+	}
+	if members := db.GetByGroup("doesnotexist"); len(members) != 0 {
+		t.Fatal(members)
+	}
+	if members := db.GetByGroup(""); len(members) != 0 {
+		t.Fatal(members)
+	}
+}
+
+func TestDB_ListAliveHosts(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for _, rec := range []Record{
+		{UUID: "b", Key: []byte{1}, AliveIntervalSec: 10, AliveCount: 3, AliveMessages: map[string][]AliveMessage{
+			"ip2": {{Hostname: "host2", IP: "ip2", Timestamp: now - 5}},
+			"ip1": {{Hostname: "host1", IP: "ip1", Timestamp: now - 100}, {Hostname: "host1", IP: "ip1", Timestamp: now - 10}},
+			"ip3": {{Hostname: "dead", IP: "ip3", Timestamp: now - 31}},
+		}},
+		{UUID: "a", Key: []byte{2}, AliveIntervalSec: 1, AliveCount: 2, AliveMessages: map[string][]AliveMessage{
+			"ip1": {{Hostname: "host1", IP: "ip1", Timestamp: now}},
+		}},
+	} {
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts := db.ListAliveHosts("", "")
+	expected := []AliveHost{
+		{UUID: "a", Hostname: "host1", IP: "ip1", LastAlive: now, SecondsUntilDead: 2},
+		{UUID: "b", Hostname: "host1", IP: "ip1", LastAlive: now - 10, SecondsUntilDead: 20},
+		{UUID: "b", Hostname: "host2", IP: "ip2", LastAlive: now - 5, SecondsUntilDead: 25},
+	}
+	// Tolerate a slow test run crossing a second boundary
+	for i := range hosts {
+		if diff := expected[i].SecondsUntilDead - hosts[i].SecondsUntilDead; diff == 1 {
+			hosts[i].SecondsUntilDead = expected[i].SecondsUntilDead
+		}
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("\n%+v\n%+v\n", hosts, expected)
+	}
+	if _, dead := db.RecordsByUUID["b"].AliveMessages["ip3"]; dead {
+		t.Fatal("did not remove dead host")
+	}
+	if hosts := db.ListAliveHosts("b", "host2"); len(hosts) != 1 || hosts[0].IP != "ip2" {
+		t.Fatal(hosts)
+	}
+	if hosts := db.ListAliveHosts("", "ip1"); len(hosts) != 2 {
+		t.Fatal(hosts)
+	}
+	if hosts := db.ListAliveHosts("doesnotexist", ""); len(hosts) != 0 {
+		t.Fatal(hosts)
+	}
+}
+
+func TestDB_UpdateKey(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{UUID: "a", Key: []byte("old key"), MountPoint: "/a", AllowedClients: []string{"host"}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	oldDigest := sha256.Sum256([]byte("old key"))
+	if err := db.UpdateKey("b", oldDigest[:], []byte("new key")); err == nil {
+		t.Fatal("did not error")
+	}
+	wrongDigest := sha256.Sum256([]byte("wrong key"))
+	if err := db.UpdateKey("a", wrongDigest[:], []byte("new key")); err != ErrKeyChanged {
+		t.Fatal(err)
+	}
+	if err := db.UpdateKey("UUID:a", oldDigest[:], []byte("new key")); err != nil {
+		t.Fatal(err)
+	}
+	// The old key may not be replaced twice
+	if err := db.UpdateKey("a", oldDigest[:], []byte("another key")); err != ErrKeyChanged {
+		t.Fatal(err)
+	}
+	// The new key must survive reloading the database, and other record details stay in place.
+	db, err = OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := db.RecordsByUUID["a"]
+	if string(updated.Key) != "new key" || updated.RotationTime.IsZero() || updated.MountPoint != "/a" ||
+		!reflect.DeepEqual(updated.AllowedClients, []string{"host"}) {
+		t.Fatalf("%+v", updated)
+	}
+	if found, _ := db.GetByID(updated.ID); string(found.Key) != "new key" {
+		t.Fatalf("%+v", found)
+	}
+	// Temporary files of an interrupted write are not mistaken for records
+	leftover := Record{Version: CurrentRecordVersion, ID: "99", UUID: "b"}
+	if err := ioutil.WriteFile(path.Join(TestDBDir, ".b.123"), leftover.Serialise(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TestDBDir); err != nil || len(db.RecordsByUUID) != 1 {
+		t.Fatal(err, db.RecordsByUUID)
+	}
+}
+
+func TestDB_RelocateKey(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localID, err := db.Upsert(Record{UUID: "a", Key: []byte("local key"), MountPoint: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RelocateKey("b", localID, "kmip-1", nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := db.RelocateKey("a", "wrong id", "kmip-1", nil); err != ErrKeyRelocated {
+		t.Fatal(err)
+	}
+	// Move the key to a KMIP server
+	if id, err := db.RelocateKey("UUID:a", localID, "kmip-1", nil); err != nil || id != "kmip-1" {
+		t.Fatal(id, err)
+	}
+	if _, found := db.GetByID(localID); found {
+		t.Fatal("old ID is still present")
+	}
+	if rec, found := db.GetByID("kmip-1"); !found || len(rec.Key) != 0 || rec.MountPoint != "/a" {
+		t.Fatalf("%+v", rec)
+	}
+	// Bring the key back, it receives the next sequence number.
+	id, err := db.RelocateKey("a", "kmip-1", "", []byte("local key"))
+	if err != nil || id == localID || id == "kmip-1" {
+		t.Fatal(id, err)
+	}
+	db, err = OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, found := db.GetByID(id); !found || string(rec.Key) != "local key" || rec.MountPoint != "/a" || len(db.RecordsByID) != 1 {
+		t.Fatalf("%+v %+v", rec, db.RecordsByID)
+	}
+}
+
+func TestDB_UpdateFields(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}
+	rec := Record{UUID: "a", Key: []byte("key"), MountPoint: "/a", AliveCount: 1000, AliveMessages: make(map[string][]AliveMessage)}
+	for _, ip := range ips {
+		rec.AliveMessages[ip] = []AliveMessage{{IP: ip, Timestamp: 0}}
+	}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	// The administrator edits a copy read before the computers keep reporting alive
+	stale, _ := db.GetByUUID("a")
+	const numReports = 50
+	done := make(chan struct{})
+	for _, ip := range ips {
+		go func(ip string) {
+			for i := 1; i <= numReports; i++ {
+				db.UpdateAliveMessage(AliveMessage{IP: ip, Timestamp: int64(i)}, "a")
+			}
+			done <- struct{}{}
+		}(ip)
+	}
+	for i := 0; i < 20; i++ {
+		stale.MountPoint = "/edited" + strconv.Itoa(i)
+		stale.Key = nil
+		stale.AliveMessages = nil
+		if _, err := db.UpdateFields(stale, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range ips {
+		<-done
+	}
+	// Neither the edits nor the alive messages are lost, in memory and on disk
+	db, err = OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, _ := db.GetByUUID("a")
+	if updated.MountPoint != "/edited19" || string(updated.Key) != "key" {
+		t.Fatalf("%+v", updated)
+	}
+	for _, ip := range ips {
+		if beats := updated.AliveMessages[ip]; len(beats) != numReports+1 || beats[numReports].Timestamp != numReports {
+			t.Fatal(ip, beats)
+		}
+	}
+	// Pending commands are only replaced on request
+	updated.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, Content: "umount"})
+	if _, err := db.Upsert(updated); err != nil {
+		t.Fatal(err)
+	}
+	stale.PendingCommands = nil
+	if saved, err := db.UpdateFields(stale, false); err != nil || len(saved.PendingCommands["1.1.1.1"]) != 1 {
+		t.Fatal(err, saved.PendingCommands)
+	}
+	if saved, err := db.UpdateFields(stale, true); err != nil || len(saved.PendingCommands["1.1.1.1"]) != 0 {
+		t.Fatal(err, saved.PendingCommands)
+	}
+	// A new record is created as it is
+	if saved, err := db.UpdateFields(Record{UUID: "UUID:b", Key: []byte("key b"), MountPoint: "/b"}, false); err != nil || saved.UUID != "b" || string(saved.Key) != "key b" {
+		t.Fatalf("%+v %v", saved, err)
+	}
+}
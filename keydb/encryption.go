@@ -0,0 +1,172 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/sys"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	MasterKeyLen        = 32     // MasterKeyLen is the length in bytes of the AES-256 key that encrypts key content on disk.
+	MasterKeyIterations = 200000 // MasterKeyIterations is the number of PBKDF2 iterations that derive a master key from passphrase.
+	masterKeyDigestText = "cryptctl2 key database master key"
+)
+
+var (
+	// ErrMasterKeyRequired is returned when an encrypted record is read without a master key.
+	ErrMasterKeyRequired = errors.New("the record is encrypted but no master key is configured for the key database")
+	// ErrMasterKeyWrong is returned when an encrypted record cannot be decrypted with the master key.
+	ErrMasterKeyWrong = errors.New("the record cannot be decrypted with the master key of the key database")
+)
+
+// ValidateMasterKey returns an error if the master key is not of the expected length.
+func ValidateMasterKey(masterKey []byte) error {
+	if len(masterKey) != MasterKeyLen {
+		return fmt.Errorf("ValidateMasterKey: master key must be %d bytes long, but it is %d bytes long", MasterKeyLen, len(masterKey))
+	}
+	return nil
+}
+
+/*
+MasterKeyDigest returns a hex-encoded HMAC of a constant text keyed by the master key. The digest is kept in server
+configuration to tell a wrong passphrase or key file apart before any record is read or written.
+*/
+func MasterKeyDigest(masterKey []byte) string {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(masterKeyDigestText))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeriveMasterKey derives a master key from the passphrase and salt using PBKDF2 with HMAC-SHA256.
+func DeriveMasterKey(passphrase string, salt []byte) []byte {
+	return PBKDF2Key(sha256.New, []byte(passphrase), salt, MasterKeyIterations, MasterKeyLen)
+}
+
+// Encrypt key content using AES-GCM. The record UUID is authenticated along, so that keys cannot be swapped among records.
+func sealKey(masterKey []byte, uuid string, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The sealed key is the nonce followed by cipher text
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(key)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, []byte(uuid)), nil
+}
+
+// Decrypt key content sealed by sealKey.
+func unsealKey(masterKey []byte, uuid string, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrMasterKeyWrong
+	}
+	key, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(uuid))
+	if err != nil {
+		return nil, ErrMasterKeyWrong
+	}
+	return key, nil
+}
+
+/*
+Backup copies all record files exactly as they are on disk into the directory, which must not exist yet. The copies of
+records that are not yet encrypted carry plain key content, so the backup directory is only accessible by its owner.
+*/
+func (db *DB) Backup(destDir string) error {
+	files, err := db.RecordFiles()
+	if err != nil {
+		return fmt.Errorf("Backup: %v", err)
+	}
+	if err := os.Mkdir(destDir, DB_DIR_FILE_MODE); err != nil {
+		return fmt.Errorf("Backup: failed to make backup directory - %v", err)
+	}
+	for name, content := range files {
+		if err := sys.ReplaceFile(path.Join(destDir, name), content, DB_REC_FILE_MODE, true); err != nil {
+			return fmt.Errorf("Backup: failed to copy record \"%s\" - %v", name, err)
+		}
+	}
+	return nil
+}
+
+/*
+RecordFiles returns the content of all record files exactly as they are on disk, by file name. The previous versions of
+records are left out. The records cannot be changed while their files are being read.
+*/
+func (db *DB) RecordFiles() (map[string][]byte, error) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	keyFiles, err := ioutil.ReadDir(db.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory \"%s\" - %v", db.Dir, err)
+	}
+	files := make(map[string][]byte)
+	for _, fileInfo := range keyFiles {
+		if isNotRecordFile(fileInfo.Name()) || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(db.Dir, fileInfo.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record \"%s\" - %v", fileInfo.Name(), err)
+		}
+		files[fileInfo.Name()] = content
+	}
+	return files, nil
+}
+
+/*
+EncryptRecords rewrites the records whose files still carry plain key content, so that their key content is encrypted
+by the master key. It returns the number of records rewritten.
+*/
+func (db *DB) EncryptRecords() (rewritten int, err error) {
+	if db.MasterKey == nil {
+		return 0, errors.New("EncryptRecords: the key database does not have a master key")
+	}
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for uuid, rec := range db.RecordsByUUID {
+		content, err := ioutil.ReadFile(path.Join(db.Dir, uuid))
+		if err != nil {
+			return rewritten, fmt.Errorf("EncryptRecords: failed to read record \"%s\" - %v", uuid, err)
+		}
+		var onDisk Record
+		if err := onDisk.Deserialise(content); err != nil {
+			return rewritten, fmt.Errorf("EncryptRecords: failed to read record \"%s\" - %v", uuid, err)
+		}
+		if len(onDisk.Key) == 0 {
+			// Already encrypted, or the key is stored on KMIP server
+			continue
+		}
+		if _, err := db.upsert(rec, true); err != nil {
+			return rewritten, err
+		}
+		// The previous version of the record still carries plain key content
+		if err := db.eraseBackup(uuid); err != nil {
+			return rewritten, fmt.Errorf("EncryptRecords: failed to erase the backup of record \"%s\" - %v", uuid, err)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,114 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors of RFC 7914 section 11
+	if out := hex.EncodeToString(PBKDF2Key(sha256.New, []byte("passwd"), []byte("salt"), 1, MasterKeyLen)); out != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" {
+		t.Fatal(out)
+	}
+	if out := hex.EncodeToString(PBKDF2Key(sha256.New, []byte("Password"), []byte("NaCl"), 80000, MasterKeyLen)); out != "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" {
+		t.Fatal(out)
+	}
+	if len(DeriveMasterKey("pass", []byte("salt"))) != MasterKeyLen {
+		t.Fatal("wrong length")
+	}
+	if MasterKeyDigest([]byte("a")) == MasterKeyDigest([]byte("b")) {
+		t.Fatal("same digest")
+	}
+}
+
+func TestDB_Encryption(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	defer os.RemoveAll(TestDBDir + ".backup")
+	os.RemoveAll(TestDBDir + ".backup")
+	masterKey := bytes.Repeat([]byte{7}, MasterKeyLen)
+	if _, err := OpenDBWithMasterKey(TestDBDir, []byte("short")); err == nil {
+		t.Fatal("did not error")
+	}
+	// Start with a legacy plain record
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{Version: CurrentRecordVersion, UUID: "plain", Key: []byte("plain key"), MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{Version: CurrentRecordVersion, UUID: "external", ID: "kmip-1", MountPoint: "/b"}); err != nil {
+		t.Fatal(err)
+	}
+	// The master key reads plain records as usual, and encrypts new ones.
+	if db, err = OpenDBWithMasterKey(TestDBDir, masterKey); err != nil || len(db.RecordsByUUID) != 2 {
+		t.Fatal(err, db.RecordsByUUID)
+	}
+	if _, err := db.Upsert(Record{Version: CurrentRecordVersion, UUID: "new", Key: []byte("new key"), MountPoint: "/c"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path.Join(TestDBDir, "new"))
+	if err != nil || bytes.Contains(content, []byte("new key")) {
+		t.Fatal(err, string(content))
+	}
+	if err := db.Backup(TestDBDir + ".backup"); err != nil {
+		t.Fatal(err)
+	}
+	if rewritten, err := db.EncryptRecords(); err != nil || rewritten != 1 {
+		t.Fatal(rewritten, err)
+	}
+	if content, err := ioutil.ReadFile(path.Join(TestDBDir, "plain")); err != nil || bytes.Contains(content, []byte("plain key")) {
+		t.Fatal(err, string(content))
+	}
+	// The backup still carries the plain record
+	if content, err := ioutil.ReadFile(path.Join(TestDBDir+".backup", "plain")); err != nil || !bytes.Contains(content, []byte("plain key")) {
+		t.Fatal(err, string(content))
+	}
+	if rewritten, err := db.EncryptRecords(); err != nil || rewritten != 0 {
+		t.Fatal(rewritten, err)
+	}
+
+	// Encrypted records are decrypted upon reading
+	if db, err = OpenDBWithMasterKey(TestDBDir, masterKey); err != nil {
+		t.Fatal(err)
+	}
+	for uuid, key := range map[string]string{"plain": "plain key", "new": "new key", "external": ""} {
+		if rec, found := db.GetByUUID(uuid); !found || string(rec.Key) != key || len(rec.SealedKey) != 0 {
+			t.Fatalf("%+v", rec)
+		}
+	}
+	if db, err = OpenDBOneRecordWithMasterKey(TestDBDir, "new", masterKey); err != nil || string(db.RecordsByUUID["new"].Key) != "new key" {
+		t.Fatal(err, db)
+	}
+	// Without the master key or with a wrong one the database refuses to open
+	if _, err := OpenDB(TestDBDir); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := OpenDBOneRecord(TestDBDir, "new"); err != ErrMasterKeyRequired {
+		t.Fatal(err)
+	}
+	if _, err := OpenDBWithMasterKey(TestDBDir, bytes.Repeat([]byte{8}, MasterKeyLen)); err == nil {
+		t.Fatal("did not error")
+	}
+	// A sealed key cannot be moved to another record
+	plainContent, _ := ioutil.ReadFile(path.Join(TestDBDir, "plain"))
+	var moved Record
+	if err := moved.Deserialise(plainContent); err != nil {
+		t.Fatal(err)
+	}
+	moved.UUID = "moved"
+	if err := ioutil.WriteFile(path.Join(TestDBDir, "moved"), moved.Serialise(), DB_REC_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ReadRecord(path.Join(TestDBDir, "moved")); err != ErrMasterKeyWrong {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/sys"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	EnrollmentFileName = "enrollment.json" // EnrollmentFileName is the file in database directory that stores the enrollment tokens.
+)
+
+// ErrEnrollmentTokenInvalid is returned for an enrollment token that is unknown, used, expired, or for another computer.
+var ErrEnrollmentTokenInvalid = errors.New("the enrollment token is not valid")
+
+// Return the path of the file that stores the enrollment tokens.
+func (db *DB) enrollmentPath() string {
+	return path.Join(db.Dir, EnrollmentFileName)
+}
+
+/*
+Read the enrollment tokens from database directory, a database that never had a token does not have the file. Caller
+must hold the lock.
+*/
+func (db *DB) loadEnrollmentTokens() (tokens []UnlockToken, err error) {
+	content, err := ioutil.ReadFile(db.enrollmentPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("DB.loadEnrollmentTokens: failed to read enrollment tokens - %v", err)
+	}
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return nil, fmt.Errorf("DB.loadEnrollmentTokens: failed to decode enrollment tokens - %v", err)
+	}
+	return tokens, nil
+}
+
+// Save the enrollment tokens into database directory, the tokens that expired by now are left out. Caller must hold the lock.
+func (db *DB) saveEnrollmentTokens(tokens []UnlockToken) error {
+	now := time.Now()
+	remaining := make([]UnlockToken, 0, len(tokens))
+	for _, token := range tokens {
+		if now.Before(token.ExpiresAt) {
+			remaining = append(remaining, token)
+		}
+	}
+	content, err := json.MarshalIndent(remaining, "", "  ")
+	if err != nil {
+		return fmt.Errorf("DB.saveEnrollmentTokens: failed to encode enrollment tokens - %v", err)
+	}
+	if err := sys.ReplaceFile(db.enrollmentPath(), content, DB_REC_FILE_MODE, true); err != nil {
+		return fmt.Errorf("DB.saveEnrollmentTokens: failed to save enrollment tokens - %v", err)
+	}
+	return nil
+}
+
+/*
+AddEnrollmentToken stores the token, which lets a new client computer enroll once without the password. Enrollment
+tokens are made by NewUnlockToken and work alike, though they belong to the server instead of a record.
+*/
+func (db *DB) AddEnrollmentToken(token UnlockToken) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	tokens, err := db.loadEnrollmentTokens()
+	if err != nil {
+		return err
+	}
+	return db.saveEnrollmentTokens(append(tokens, token))
+}
+
+// ListEnrollmentTokens returns the enrollment tokens that have not expired yet, used or not.
+func (db *DB) ListEnrollmentTokens() ([]UnlockToken, error) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	tokens, err := db.loadEnrollmentTokens()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	remaining := make([]UnlockToken, 0, len(tokens))
+	for _, token := range tokens {
+		if now.Before(token.ExpiresAt) {
+			remaining = append(remaining, token)
+		}
+	}
+	return remaining, nil
+}
+
+/*
+UseEnrollmentToken looks for the outstanding enrollment token, marks it used by the requester, and persists it before
+returning. The names (the host name the certificate is for, IP, etc.) are checked against the host restriction of the
+token. ErrEnrollmentTokenInvalid is returned if the token is not outstanding, the detail explains why for the log.
+*/
+func (db *DB) UseEnrollmentToken(secret, usedBy string, names ...string) (token UnlockToken, detail string, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	tokens, err := db.loadEnrollmentTokens()
+	if err != nil {
+		return UnlockToken{}, "", err
+	}
+	now := time.Now()
+	for i, existing := range tokens {
+		if secret == "" || !existing.matches(secret) {
+			continue
+		}
+		if status := existing.StatusAt(now); status != UnlockTokenStatusOutstanding {
+			return existing, fmt.Sprintf("enrollment token %s is %s", existing.ID, status), ErrEnrollmentTokenInvalid
+		}
+		if !existing.allowsHost(names...) {
+			return existing, fmt.Sprintf("enrollment token %s is only for %s", existing.ID, existing.Hostname), ErrEnrollmentTokenInvalid
+		}
+		existing.UsedAt = now
+		existing.UsedBy = usedBy
+		tokens[i] = existing
+		// The token must be known to be used before the certificate is handed out
+		if err := db.saveEnrollmentTokens(tokens); err != nil {
+			return existing, "", err
+		}
+		return existing, "", nil
+	}
+	return UnlockToken{}, "no such enrollment token", ErrEnrollmentTokenInvalid
+}
@@ -0,0 +1,62 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_UseEnrollmentToken(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens, err := db.ListEnrollmentTokens(); err != nil || len(tokens) != 0 {
+		t.Fatal(tokens, err)
+	}
+	token, tokenRec := NewUnlockToken("", time.Hour)
+	hostToken, hostTokenRec := NewUnlockToken("node1", time.Hour)
+	expiredToken, expiredRec := NewUnlockToken("", time.Hour)
+	expiredRec.ExpiresAt = time.Now().Add(-time.Second)
+	for _, rec := range []UnlockToken{expiredRec, tokenRec, hostTokenRec} {
+		if err := db.AddEnrollmentToken(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The expired token is removed once the next one is added
+	if tokens, err := db.ListEnrollmentTokens(); err != nil || len(tokens) != 2 {
+		t.Fatal(tokens, err)
+	}
+	for _, bad := range []string{"", "wrong", expiredToken} {
+		if _, _, err := db.UseEnrollmentToken(bad, "10.0.0.1", "node2"); err != ErrEnrollmentTokenInvalid {
+			t.Fatal(bad, err)
+		}
+	}
+	// The host restriction applies to any of the names
+	if _, detail, err := db.UseEnrollmentToken(hostToken, "10.0.0.1", "node2", "10.0.0.1"); err != ErrEnrollmentTokenInvalid || detail == "" {
+		t.Fatal(detail, err)
+	}
+	if used, _, err := db.UseEnrollmentToken(hostToken, "10.0.0.1 (node1)", "node1", "10.0.0.1"); err != nil || used.ID != hostTokenRec.ID || !used.IsUsed() {
+		t.Fatal(used, err)
+	}
+	if used, _, err := db.UseEnrollmentToken(token, "10.0.0.2 (node2)", "node2"); err != nil || used.UsedBy != "10.0.0.2 (node2)" {
+		t.Fatal(used, err)
+	}
+	// The tokens are used up, also after the database is opened again
+	db, err = OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, used := range []string{token, hostToken} {
+		if _, _, err := db.UseEnrollmentToken(used, "10.0.0.1", "node1"); err != ErrEnrollmentTokenInvalid {
+			t.Fatal(err)
+		}
+	}
+	if tokens, err := db.ListEnrollmentTokens(); err != nil || len(tokens) != 2 || !tokens[0].IsUsed() || !tokens[1].IsUsed() {
+		t.Fatal(tokens, err)
+	}
+}
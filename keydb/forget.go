@@ -0,0 +1,49 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/sys"
+	"fmt"
+	"time"
+)
+
+// IsKeyForgotten returns true if the key of the record has been destroyed, the record no longer hands out a key.
+func (rec *Record) IsKeyForgotten() bool {
+	return !rec.ForgetTime.IsZero()
+}
+
+/*
+ForgetKey destroys the key content of the record and keeps the record itself, along with its allowed clients, owner,
+and other details for audit. The record file is rewritten without the key, and the previous content of the file is
+shredded, so is its backup. A key stored on an external KMIP server is left for the caller to destroy there. Return the
+record as it was before the key was forgotten, forgetting a key twice is not an error.
+*/
+func (db *DB) ForgetKey(uuid string) (Record, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return rec, fmt.Errorf("ForgetKey: record \"%s\" does not exist", uuid)
+	}
+	if rec.IsKeyForgotten() {
+		return rec, nil
+	}
+	forgotten := rec
+	forgotten.Key = nil
+	forgotten.SealedKey = nil
+	forgotten.PreviousKey = nil
+	forgotten.SealedPrev = nil
+	forgotten.ForgetTime = time.Now()
+	if _, err := db.upsertVersioned(forgotten); err != nil {
+		return rec, fmt.Errorf("ForgetKey: failed to save record \"%s\" - %v", uuid, err)
+	}
+	// The backup is a link to the previous content of the record file, which still carries the key.
+	if err := db.eraseBackup(rec.UUID); err != nil {
+		return rec, fmt.Errorf("ForgetKey: the key of \"%s\" is forgotten, but its previous record file cannot be shredded - %v", uuid, err)
+	}
+	rec.Key.Wipe()
+	rec.PreviousKey.Wipe()
+	sys.SecureBytes(rec.SealedKey).Wipe()
+	return rec, nil
+}
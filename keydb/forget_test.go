@@ -0,0 +1,71 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDB_ForgetKey(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{UUID: "a", Key: []byte("secret-key-content"), MountPoint: "/a", Owner: "storage-team", AllowedClients: []string{"1.1.1.1"}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	// Change the record once more so that its backup carries the key
+	rec.MountPoint = "/b"
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ForgetKey("does-not-exist"); err == nil {
+		t.Fatal("did not error")
+	}
+	before, err := db.ForgetKey("a")
+	if err != nil || string(before.Key) != string(make([]byte, len("secret-key-content"))) {
+		t.Fatal(before.Key, err)
+	}
+	// The record details are kept, the key is gone from memory and disk
+	forgotten, found := db.GetByUUID("a")
+	if !found || !forgotten.IsKeyForgotten() || len(forgotten.Key) != 0 || forgotten.Owner != "storage-team" || len(forgotten.AllowedClients) != 1 || forgotten.MountPoint != "/b" {
+		t.Fatalf("%+v", forgotten)
+	}
+	if onDisk, err := db.ReadRecord(path.Join(db.Dir, "a")); err != nil || len(onDisk.Key) != 0 || !onDisk.IsKeyForgotten() {
+		t.Fatal(onDisk, err)
+	}
+	if _, err := os.Stat(db.backupPath("a")); !os.IsNotExist(err) {
+		t.Fatal("backup carrying the key was kept", err)
+	}
+	files, _ := ioutil.ReadDir(db.Dir)
+	for _, file := range files {
+		if content, _ := ioutil.ReadFile(path.Join(db.Dir, file.Name())); bytes.Contains(content, []byte("secret-key-content")) {
+			t.Fatal("key content remains in", file.Name())
+		}
+	}
+	// Forgetting again is not an error
+	if _, err := db.ForgetKey("a"); err != nil {
+		t.Fatal(err)
+	}
+	// The record no longer hands out a key
+	if found, rejected, _ := db.Select(AliveMessage{IP: "1.1.1.1"}, false, "", "1.1.1.1", "a"); len(found) != 0 || len(rejected) != 1 {
+		t.Fatal(found, rejected)
+	}
+	if found, _, rejected, _ := db.ForceSelect(AliveMessage{IP: "1.1.1.1"}, "password", "", "1.1.1.1", "a"); len(found) != 0 || len(rejected) != 1 {
+		t.Fatal(found, rejected)
+	}
+	// Reloading keeps the forgotten state
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := db.GetByUUID("a"); !reloaded.IsKeyForgotten() || reloaded.Owner != "storage-team" {
+		t.Fatalf("%+v", reloaded)
+	}
+}
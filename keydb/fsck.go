@@ -0,0 +1,116 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/fs"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RecordBackupSuffix is appended to a record file name to form the name of the previous version of that record.
+const RecordBackupSuffix = ".bak"
+
+// RecordLoadError describes a record file that could not be loaded.
+type RecordLoadError struct {
+	FileName string // FileName is the name of the record file in database directory, it is normally the record UUID.
+	Error    string // Error describes why the record could not be loaded.
+}
+
+// Return the path of the previous version of the record file.
+func (db *DB) backupPath(fileName string) string {
+	return path.Join(db.Dir, fileName+RecordBackupSuffix)
+}
+
+/*
+Keep the record file that is about to be replaced as the previous version of that record. The backup is a hard link
+to the file, and replacing the record places a new file in its stead, so the backup costs neither copy nor extra space.
+*/
+func (db *DB) keepBackup(fileName string) {
+	recPath := path.Join(db.Dir, fileName)
+	if _, err := os.Stat(recPath); err != nil {
+		// A new record does not have a previous version
+		return
+	}
+	bakPath := db.backupPath(fileName)
+	if err := os.Remove(bakPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("DB.keepBackup: failed to remove old backup \"%s\" - %v", bakPath, err)
+		return
+	}
+	if err := os.Link(recPath, bakPath); err != nil {
+		log.Printf("DB.keepBackup: failed to back up \"%s\" - %v", recPath, err)
+	}
+}
+
+// Erase the backup of a record, it carries key content too.
+func (db *DB) eraseBackup(fileName string) error {
+	bakPath := db.backupPath(fileName)
+	if _, err := os.Stat(bakPath); os.IsNotExist(err) {
+		return nil
+	}
+	return fs.SecureErase(bakPath, true)
+}
+
+/*
+CanRestore returns nil if the previous version of the record that failed to load is intact and can be restored,
+otherwise it returns the reason why the record cannot be restored.
+*/
+func (db *DB) CanRestore(fileName string) (Record, error) {
+	rec, err := db.ReadRecord(db.backupPath(fileName))
+	if os.IsNotExist(err) {
+		return rec, fmt.Errorf("there is no backup of \"%s\"", fileName)
+	} else if err != nil {
+		return rec, fmt.Errorf("the backup of \"%s\" is not usable either - %v", fileName, err)
+	} else if rec.UUID != fileName {
+		return rec, fmt.Errorf("the backup of \"%s\" carries a different record \"%s\"", fileName, rec.UUID)
+	}
+	return rec, nil
+}
+
+/*
+RestoreRecord replaces a record file that failed to load with the previous version of that record, and loads the
+restored record into memory. Changes made to the record since the previous version are lost.
+*/
+func (db *DB) RestoreRecord(fileName string) (Record, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, err := db.CanRestore(fileName)
+	if err != nil {
+		return rec, fmt.Errorf("RestoreRecord: %v", err)
+	}
+	content, err := ioutil.ReadFile(db.backupPath(fileName))
+	if err != nil {
+		return rec, fmt.Errorf("RestoreRecord: failed to read backup - %v", err)
+	}
+	// The corrupted file is replaced without becoming the backup
+	db.writeSeq++
+	if err := db.writeRecordFile(recordWrite{uuid: fileName, content: content, seq: db.writeSeq, doSync: true}, false); err != nil {
+		return rec, fmt.Errorf("RestoreRecord: %v", err)
+	}
+	db.RecordsByUUID[rec.UUID] = rec
+	db.RecordsByID[rec.ID] = rec
+	if idSeq, _ := strconv.ParseInt(rec.ID, 10, 64); idSeq > db.LastSequenceNum {
+		db.LastSequenceNum = idSeq
+	}
+	remaining := make([]RecordLoadError, 0, len(db.LoadErrors))
+	for _, loadErr := range db.LoadErrors {
+		if loadErr.FileName != fileName {
+			remaining = append(remaining, loadErr)
+		}
+	}
+	db.LoadErrors = remaining
+	return rec, nil
+}
+
+/*
+Return true if the file in database directory is not a record, such as a temporary file, record backup, or record
+version. Record file names never contain a dot, as UUIDs cannot.
+*/
+func isNotRecordFile(fileName string) bool {
+	return strings.Contains(fileName, ".")
+}
@@ -0,0 +1,78 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDB_LoadErrorsAndRestore(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"a", "b", "c"} {
+		if _, err := db.Upsert(Record{Version: CurrentRecordVersion, UUID: uuid, Key: []byte("key " + uuid), MountPoint: "/old"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A new record does not have a backup, an updated record does.
+	if _, err := os.Stat(path.Join(TestDBDir, "a"+RecordBackupSuffix)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"a", "b"} {
+		rec, _ := db.GetByUUID(uuid)
+		rec.MountPoint = "/new"
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Damage all three records, "c" does not have a backup to restore from.
+	for _, uuid := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(path.Join(TestDBDir, uuid), []byte("half-written"), DB_REC_FILE_MODE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Upsert(Record{Version: CurrentRecordVersion, UUID: "d", Key: []byte("key d"), MountPoint: "/d"}); err != nil {
+		t.Fatal(err)
+	}
+	// The intact record loads along while the damaged ones are noted
+	if db, err = OpenDB(TestDBDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.RecordsByUUID) != 1 || len(db.LoadErrors) != 3 {
+		t.Fatalf("%+v %+v", db.RecordsByUUID, db.LoadErrors)
+	}
+	if rec, err := db.CanRestore("a"); err != nil || rec.MountPoint != "/old" {
+		t.Fatal(rec, err)
+	}
+	if _, err := db.CanRestore("c"); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := db.RestoreRecord("c"); err == nil {
+		t.Fatal("did not error")
+	}
+	for _, uuid := range []string{"a", "b"} {
+		if rec, err := db.RestoreRecord(uuid); err != nil || string(rec.Key) != "key "+uuid {
+			t.Fatal(rec, err)
+		}
+	}
+	if len(db.LoadErrors) != 1 || db.LoadErrors[0].FileName != "c" {
+		t.Fatalf("%+v", db.LoadErrors)
+	}
+	if db, err = OpenDB(TestDBDir); err != nil || len(db.RecordsByUUID) != 3 || len(db.LoadErrors) != 1 {
+		t.Fatal(err, db.RecordsByUUID, db.LoadErrors)
+	}
+	// Erasing a record erases its backup too
+	if err := db.Erase("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(TestDBDir, "a"+RecordBackupSuffix)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
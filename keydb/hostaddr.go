@@ -0,0 +1,50 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+CanonicalHost returns the IP address in its canonical text form, so that e.g. "2001:DB8:0:0::1", "[2001:db8::1]", and
+"2001:db8::1" are all the same computer, and an IPv4-mapped IPv6 address is the IPv4 address. A DNS name or anything
+else is returned as-is, without surrounding spaces.
+*/
+func CanonicalHost(host string) string {
+	host = strings.TrimSpace(host)
+	bare := host
+	if strings.HasPrefix(bare, "[") && strings.HasSuffix(bare, "]") {
+		bare = bare[1 : len(bare)-1]
+	}
+	if ip := net.ParseIP(bare); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// SameHost returns true if both are the same IP address, or the same DNS name regardless of case.
+func SameHost(a, b string) bool {
+	return a != "" && b != "" && strings.EqualFold(CanonicalHost(a), CanonicalHost(b))
+}
+
+/*
+ParseIPList parses IP addresses separated by comma or space, e.g. the IPv4 and IPv6 addresses a certificate is issued
+for. An empty list is not an error, a malformed address is.
+*/
+func ParseIPList(ips string) ([]net.IP, error) {
+	entries := strings.FieldsFunc(ips, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	ret := make([]net.IP, 0, len(entries))
+	for _, entry := range entries {
+		ip := net.ParseIP(CanonicalHost(entry))
+		if ip == nil {
+			return nil, fmt.Errorf("ParseIPList: \"%s\" is not an IP address", entry)
+		}
+		ret = append(ret, ip)
+	}
+	return ret, nil
+}
@@ -0,0 +1,67 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCanonicalHost(t *testing.T) {
+	for host, canonical := range map[string]string{
+		" 10.0.0.1 ":          "10.0.0.1",
+		"::ffff:10.0.0.1":     "10.0.0.1",
+		"2001:DB8:0:0::1":     "2001:db8::1",
+		"[2001:db8::1]":       "2001:db8::1",
+		"::":                  "::",
+		"Node1.example.com":   "Node1.example.com",
+		"[node1.example.com]": "[node1.example.com]",
+		"":                    "",
+	} {
+		if got := CanonicalHost(host); got != canonical {
+			t.Fatal(host, got)
+		}
+	}
+	// The canonical form survives a round trip through host:port
+	for _, host := range []string{"10.0.0.1", "2001:db8::1", "::1", "node1.example.com"} {
+		joined := net.JoinHostPort(CanonicalHost(host), "3737")
+		if split, port, err := net.SplitHostPort(joined); err != nil || split != host || port != "3737" || CanonicalHost(split) != host {
+			t.Fatal(joined, split, port, err)
+		}
+	}
+	if !SameHost("2001:db8::1", "[2001:DB8:0::1]") || !SameHost("NODE1", "node1") || SameHost("2001:db8::1", "2001:db8::2") || SameHost("", "") {
+		t.Fatal("wrong comparison")
+	}
+}
+
+func TestParseIPList(t *testing.T) {
+	ips, err := ParseIPList(" 10.0.0.1, 2001:db8::1 [2001:db8::2]")
+	if err != nil || len(ips) != 3 || ips[0].String() != "10.0.0.1" || ips[1].String() != "2001:db8::1" || ips[2].String() != "2001:db8::2" {
+		t.Fatal(ips, err)
+	}
+	if ips, err := ParseIPList(""); err != nil || len(ips) != 0 {
+		t.Fatal(ips, err)
+	}
+	for _, bad := range []string{"10.0.0.256", "10.0.0.1,node1", "[2001:db8::1]:3737"} {
+		if _, err := ParseIPList(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestIPv6AllowedClientsAndTokens(t *testing.T) {
+	rec := Record{AllowedClients: []string{"2001:DB8:0::10", "2001:db8:1::/48"}}
+	for _, ip := range []string{"2001:db8::10", "2001:DB8:0:0::10", "2001:db8:1:2::3"} {
+		if !rec.IsClientAllowed("", ip) {
+			t.Fatal("not allowed", ip)
+		}
+	}
+	if rec.IsClientAllowed("", "2001:db8:2::3") || rec.IsClientAllowed("", "10.0.0.1") {
+		t.Fatal("wrongly allowed")
+	}
+	_, token := NewUnlockToken("[2001:DB8::10]", time.Hour)
+	if token.Hostname != "2001:db8::10" || !token.allowsHost("2001:db8:0::10") || token.allowsHost("2001:db8::11") {
+		t.Fatal(token.Hostname)
+	}
+}
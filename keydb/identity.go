@@ -0,0 +1,55 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+HostnamesAgree returns true if the host name reported by a client computer is the one its certificate is issued for.
+A short host name agrees with a fully qualified name of the same first label, e.g. "node1" with "node1.example.com",
+as the computer usually reports its host name without domain.
+*/
+func HostnamesAgree(claimed, verified string) bool {
+	claimed, verified = strings.TrimSuffix(claimed, "."), strings.TrimSuffix(verified, ".")
+	if claimed == "" || verified == "" || SameHost(claimed, verified) {
+		return true
+	}
+	claimedLabel, claimedDomain := splitFirstLabel(claimed)
+	verifiedLabel, verifiedDomain := splitFirstLabel(verified)
+	return strings.EqualFold(claimedLabel, verifiedLabel) && (claimedDomain == "" || verifiedDomain == "")
+}
+
+// Return the first label of the host name and the remaining domain.
+func splitFirstLabel(host string) (label, domain string) {
+	if dot := strings.IndexByte(host, '.'); dot >= 0 {
+		return host[:dot], host[dot+1:]
+	}
+	return host, ""
+}
+
+/*
+Identity returns the host name that identifies the client computer: the one of its validated certificate if there is
+one, otherwise the host name it reported itself.
+*/
+func (msg AliveMessage) Identity() string {
+	if msg.CertName != "" {
+		return msg.CertName
+	}
+	return msg.Hostname
+}
+
+// IdentityMismatch returns true if the host name reported by the client computer disagrees with its validated certificate.
+func (msg AliveMessage) IdentityMismatch() bool {
+	return !HostnamesAgree(msg.Hostname, msg.CertName)
+}
+
+// DescribeHost returns the IP and host name of the client computer for display, along with its certificate's name if they disagree.
+func (msg AliveMessage) DescribeHost() string {
+	if msg.IdentityMismatch() {
+		return fmt.Sprintf("%s (%s, IDENTITY MISMATCH: certificate is for %s)", msg.IP, msg.Hostname, msg.CertName)
+	}
+	return fmt.Sprintf("%s (%s)", msg.IP, msg.Identity())
+}
@@ -0,0 +1,43 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import "testing"
+
+func TestHostnamesAgree(t *testing.T) {
+	for _, agree := range [][2]string{
+		{"node1", "node1.example.com"},
+		{"NODE1.example.com", "node1.example.com."},
+		{"node1.example.com", "node1"},
+		{"", "node1.example.com"},
+		{"node1", ""},
+	} {
+		if !HostnamesAgree(agree[0], agree[1]) {
+			t.Fatal(agree)
+		}
+	}
+	for _, disagree := range [][2]string{
+		{"node1", "node2.example.com"},
+		{"node1.other.com", "node1.example.com"},
+	} {
+		if HostnamesAgree(disagree[0], disagree[1]) {
+			t.Fatal(disagree)
+		}
+	}
+}
+
+func TestAliveMessage_Identity(t *testing.T) {
+	msg := AliveMessage{IP: "10.0.0.1", Hostname: "node1"}
+	if msg.Identity() != "node1" || msg.IdentityMismatch() || msg.DescribeHost() != "10.0.0.1 (node1)" {
+		t.Fatalf("%+v", msg)
+	}
+	msg.CertName = "node1.example.com"
+	if msg.Identity() != "node1.example.com" || msg.IdentityMismatch() || msg.DescribeHost() != "10.0.0.1 (node1.example.com)" {
+		t.Fatalf("%+v", msg)
+	}
+	msg.CertName = "node2.example.com"
+	if msg.Identity() != "node2.example.com" || !msg.IdentityMismatch() ||
+		msg.DescribeHost() != "10.0.0.1 (node1, IDENTITY MISMATCH: certificate is for node2.example.com)" {
+		t.Fatal(msg.DescribeHost())
+	}
+}
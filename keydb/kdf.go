@@ -0,0 +1,135 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// PBKDF2Key derives a key of the length from the password using PBKDF2 (RFC 8018) with HMAC of the hash function.
+func PBKDF2Key(newHash func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	key := make([]byte, 0, keyLen+prf.Size())
+	var blockIndex [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockIndex[:], block)
+		prf.Write(blockIndex[:])
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+/*
+ScryptKey derives a key of the length from the password using scrypt (RFC 7914) of CPU and memory cost n, block size r and
+parallelisation p. The function needs 128*r*n bytes of memory. The caller makes sure that n is a power of two greater
+than 1, and that r and p are positive and small enough for the memory to be allocated.
+*/
+func ScryptKey(password, salt []byte, n, r, p, keyLen int) []byte {
+	blockLen := 128 * r
+	b := PBKDF2Key(sha256.New, password, salt, 1, p*blockLen)
+	x := make([]uint32, 32*r)
+	tmp := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*n)
+	for i := 0; i < p; i++ {
+		scryptROMix(b[i*blockLen:(i+1)*blockLen], x, tmp, v, n, r)
+	}
+	return PBKDF2Key(sha256.New, password, b, 1, keyLen)
+}
+
+// Mix the block of 128*r bytes in place by the sequential memory-hard function of scrypt, using x, tmp and v as buffers.
+func scryptROMix(block []byte, x, tmp, v []uint32, n, r int) {
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+	words := 32 * r
+	for i := 0; i < n; i++ {
+		copy(v[i*words:], x)
+		scryptBlockMix(x, tmp, r)
+	}
+	for i := 0; i < n; i++ {
+		// Integerify takes the first word of the last 64-byte sub-block, n is a power of two
+		j := int(x[words-16] & uint32(n-1))
+		for k, word := range v[j*words : (j+1)*words] {
+			x[k] ^= word
+		}
+		scryptBlockMix(x, tmp, r)
+	}
+	for i, word := range x {
+		binary.LittleEndian.PutUint32(block[i*4:], word)
+	}
+}
+
+// Mix the 2*r sub-blocks of x in place by Salsa20/8, placing the even output sub-blocks before the odd ones.
+func scryptBlockMix(x, tmp []uint32, r int) {
+	var sub [16]uint32
+	copy(sub[:], x[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range sub {
+			sub[k] ^= x[i*16+k]
+		}
+		salsa208(&sub)
+		// Sub-block i goes to position i/2, or to r+i/2 if i is odd
+		copy(tmp[((i&1)*r+i/2)*16:], sub[:])
+	}
+	copy(x, tmp)
+}
+
+// Apply the Salsa20/8 core to the 64-byte block in place.
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		// Column round
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+		// Row round
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
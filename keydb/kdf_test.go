@@ -0,0 +1,35 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2Key(t *testing.T) {
+	// The key spans two blocks of HMAC-SHA256, the test vector is from RFC 7914
+	key := PBKDF2Key(sha256.New, []byte("passwd"), []byte("salt"), 1, 64)
+	if hex.EncodeToString(key) != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783" {
+		t.Fatal(hex.EncodeToString(key))
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	// Test vectors are from RFC 7914
+	for _, vector := range []struct {
+		password, salt string
+		n, r, p        int
+		expected       string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1, "7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+	} {
+		key := ScryptKey([]byte(vector.password), []byte(vector.salt), vector.n, vector.r, vector.p, 64)
+		if hex.EncodeToString(key) != vector.expected {
+			t.Fatal(vector.password, hex.EncodeToString(key))
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// MaxLostHostsPerRecord is the number of most recently lost computers kept on a record.
+const MaxLostHostsPerRecord = 10
+
+/*
+LostHost is a computer that stopped sending alive messages while it was holding the key of a record, its encrypted disk
+may still be left unlocked. A computer that keeps coming and going is kept once, along with the number of times it has
+been lost.
+*/
+type LostHost struct {
+	Hostname   string `json:"hostname"`    // Hostname is the host name reported by the computer in its final alive message.
+	IP         string `json:"ip"`          // IP is the computer's IP as seen by cryptctl2 server.
+	LastSeen   int64  `json:"last_seen"`   // LastSeen is the timestamp of the final alive message.
+	LostAt     int64  `json:"lost_at"`     // LostAt is the timestamp at which the computer was most recently considered lost.
+	Count      int    `json:"count"`       // Count is the number of times the computer has been lost.
+	Notified   bool   `json:"notified"`    // Notified is true if the administrator has been notified since the computer was most recently lost.
+	NotifiedAt int64  `json:"notified_at"` // NotifiedAt is the timestamp of the most recent notification, 0 if none has been sent.
+}
+
+// Keep the computer that sent the final alive message as lost, the most recently lost computer comes first.
+func (rec *Record) AddLostHost(final AliveMessage, now int64) {
+	lost := LostHost{Hostname: final.Hostname, IP: final.IP, LastSeen: final.Timestamp, LostAt: now, Count: 1}
+	// Work on a copy, the slice may be shared by copies of the record.
+	hosts := make([]LostHost, 0, len(rec.LostHosts)+1)
+	for _, existing := range rec.LostHosts {
+		if existing.IP == lost.IP {
+			lost.Count += existing.Count
+			lost.NotifiedAt = existing.NotifiedAt
+			continue
+		}
+		hosts = append(hosts, existing)
+	}
+	hosts = append([]LostHost{lost}, hosts...)
+	if len(hosts) > MaxLostHostsPerRecord {
+		hosts = hosts[:MaxLostHostsPerRecord]
+	}
+	rec.LostHosts = hosts
+}
+
+// Remove dead hosts from the record and keep them as lost, return the final alive message of each dead host.
+func (rec *Record) expireDeadHosts() (deadFinalMessage map[string]AliveMessage) {
+	deadFinalMessage = rec.RemoveDeadHosts()
+	now := time.Now().Unix()
+	for _, final := range deadFinalMessage {
+		rec.AddLostHost(final, now)
+	}
+	return
+}
+
+/*
+ExpireDeadHosts removes the computers that stopped sending alive messages from all records, keeps them as lost hosts on
+their records, and persists the records. Return the lost computers of each record UUID.
+*/
+func (db *DB) ExpireDeadHosts() (lost map[string][]AliveMessage) {
+	lost = make(map[string][]AliveMessage)
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for uuid, rec := range db.RecordsByUUID {
+		deadFinalMessage := rec.expireDeadHosts()
+		if len(deadFinalMessage) == 0 {
+			continue
+		}
+		for _, final := range deadFinalMessage {
+			lost[uuid] = append(lost[uuid], final)
+		}
+		sort.Slice(lost[uuid], func(i, j int) bool {
+			return lost[uuid][i].IP < lost[uuid][j].IP
+		})
+		if _, err := db.upsert(rec, false); err != nil {
+			log.Printf("DB.ExpireDeadHosts: failed to save record \"%s\" - %v", uuid, err)
+		}
+	}
+	return
+}
+
+/*
+TakeLostHostsToNotify returns the lost computers of each record UUID that the administrator has not been notified of,
+and marks them notified. A computer notified within the debounce period is left for later, so that a computer that
+keeps coming and going does not cause a notification each time.
+*/
+func (db *DB) TakeLostHostsToNotify(debounce time.Duration) (notify map[string][]LostHost) {
+	notify = make(map[string][]LostHost)
+	now := time.Now().Unix()
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for uuid, rec := range db.RecordsByUUID {
+		hosts := make([]LostHost, len(rec.LostHosts))
+		copy(hosts, rec.LostHosts)
+		for i, lost := range hosts {
+			if lost.Notified || now-lost.NotifiedAt < int64(debounce/time.Second) {
+				continue
+			}
+			hosts[i].Notified = true
+			hosts[i].NotifiedAt = now
+			notify[uuid] = append(notify[uuid], hosts[i])
+		}
+		if len(notify[uuid]) == 0 {
+			continue
+		}
+		rec.LostHosts = hosts
+		if _, err := db.upsert(rec, false); err != nil {
+			log.Printf("DB.TakeLostHostsToNotify: failed to save record \"%s\" - %v", uuid, err)
+		}
+	}
+	return
+}
+
+/*
+AddPendingCommand saves a pending command for the computer into the record and persists the record. An identical
+command that is still outstanding for the computer is not saved again, and that command is returned along with false.
+*/
+func (db *DB) AddPendingCommand(uuid, ip string, cmd PendingCommand) (stored PendingCommand, added bool, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return PendingCommand{}, false, fmt.Errorf("AddPendingCommand: record \"%s\" does not exist", uuid)
+	}
+	cmd.IP = ip
+	if stored, added = rec.AddPendingCommand(ip, cmd); !added {
+		return stored, false, nil
+	}
+	if _, err = db.upsert(rec, false); err != nil {
+		return PendingCommand{}, false, err
+	}
+	return stored, true, nil
+}
+
+// MaxEvictionsPerRecord is the number of most recent evictions kept on a record.
+const MaxEvictionsPerRecord = 10
+
+// Eviction is a computer that was removed from the active users of a record to make room for a forced key retrieval.
+type Eviction struct {
+	Hostname  string `json:"hostname"`   // Hostname is the host name reported by the evicted computer in its final alive message.
+	IP        string `json:"ip"`         // IP is the evicted computer's IP as seen by cryptctl2 server.
+	LastSeen  int64  `json:"last_seen"`  // LastSeen is the timestamp of the evicted computer's final alive message.
+	EvictedAt int64  `json:"evicted_at"` // EvictedAt is the moment of eviction.
+	EvictedBy string `json:"evicted_by"` // EvictedBy is the administrator identity that authorised the forced retrieval.
+	ForHost   string `json:"for_host"`   // ForHost is the IP and host name of the computer that the key was forcibly given to.
+}
+
+/*
+Evict the computer that has not sent an alive message for the longest time, unless the computer making the request is
+already among the active users or there is room for it. Return the eviction, or nil if no computer was evicted.
+*/
+func (rec *Record) evictStalestHost(requester AliveMessage, evictedBy string) *Eviction {
+	if rec.MaxActive <= 0 || len(rec.AliveMessages) < rec.MaxActive {
+		return nil
+	} else if _, found := rec.AliveMessages[requester.IP]; found {
+		return nil
+	}
+	var stalest AliveMessage
+	for ip := range rec.AliveMessages {
+		_, final := rec.IsHostAlive(ip)
+		if stalest.IP == "" || final.Timestamp < stalest.Timestamp || (final.Timestamp == stalest.Timestamp && ip < stalest.IP) {
+			stalest = final
+			stalest.IP = ip
+		}
+	}
+	delete(rec.AliveMessages, stalest.IP)
+	eviction := Eviction{
+		Hostname:  stalest.Hostname,
+		IP:        stalest.IP,
+		LastSeen:  stalest.Timestamp,
+		EvictedAt: requester.Timestamp,
+		EvictedBy: evictedBy,
+		ForHost:   fmt.Sprintf("%s (%s)", requester.IP, requester.Hostname),
+	}
+	// Work on a copy, the slice may be shared by copies of the record.
+	rec.Evictions = append([]Eviction{eviction}, rec.Evictions...)
+	if len(rec.Evictions) > MaxEvictionsPerRecord {
+		rec.Evictions = rec.Evictions[:MaxEvictionsPerRecord]
+	}
+	return &eviction
+}
+
+/*
+ForceSelect retrieves key records of those UUIDs like Select does, but if a record has as many active users as it
+allows, the computer that has not sent an alive message for the longest time is evicted to make room for the requester.
+The evictions are kept on the records along with the administrator identity that authorised them. Clients that are not
+allowed to use a record are still rejected.
+*/
+func (db *DB) ForceSelect(aliveMessage AliveMessage, evictedBy, DNSName, IPAddress string, uuids ...string) (found map[string]Record, evicted map[string]Eviction, rejected, missing []string) {
+	found = make(map[string]Record)
+	evicted = make(map[string]Eviction)
+	rejected = make([]string, 0, 8)
+	missing = make([]string, 0, 8)
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for _, uuid := range uuids {
+		record, exists := db.RecordsByUUID[CanonicalRecordID(uuid)]
+		if !exists {
+			missing = append(missing, uuid)
+			continue
+		}
+		if !db.isClientAllowed(record, DNSName, IPAddress) || record.IsKeyForgotten() {
+			rejected = append(rejected, uuid)
+			continue
+		}
+		record.expireDeadHosts()
+		if eviction := record.evictStalestHost(aliveMessage, evictedBy); eviction != nil {
+			evicted[record.UUID] = *eviction
+		}
+		if ok, _ := record.UpdateLastRetrieval(aliveMessage, false); ok {
+			db.upsert(record, true) // IO error is logged
+			found[record.UUID] = record
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecord_AddLostHost(t *testing.T) {
+	rec := Record{}
+	rec.AddLostHost(AliveMessage{Hostname: "a", IP: "1.1.1.1", Timestamp: 1}, 10)
+	rec.AddLostHost(AliveMessage{Hostname: "b", IP: "2.2.2.2", Timestamp: 2}, 20)
+	rec.LostHosts[1].NotifiedAt = 15
+	rec.AddLostHost(AliveMessage{Hostname: "a", IP: "1.1.1.1", Timestamp: 3}, 30)
+	if len(rec.LostHosts) != 2 {
+		t.Fatal(rec.LostHosts)
+	}
+	if lost := rec.LostHosts[0]; lost.IP != "1.1.1.1" || lost.Count != 2 || lost.LastSeen != 3 || lost.LostAt != 30 || lost.NotifiedAt != 15 || lost.Notified {
+		t.Fatal(lost)
+	}
+	for i := 0; i < MaxLostHostsPerRecord*2; i++ {
+		rec.AddLostHost(AliveMessage{IP: string(rune('a' + i))}, int64(i))
+	}
+	if len(rec.LostHosts) != MaxLostHostsPerRecord {
+		t.Fatal(len(rec.LostHosts))
+	}
+}
+
+func TestDB_ExpireDeadHosts(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	rec := Record{Version: CurrentRecordVersion, UUID: "a", Key: []byte("key"), AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]AliveMessage{
+			"1.1.1.1": {{Hostname: "dead", IP: "1.1.1.1", Timestamp: now - 100}},
+			"2.2.2.2": {{Hostname: "alive", IP: "2.2.2.2", Timestamp: now}},
+		}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	lost := db.ExpireDeadHosts()
+	if len(lost) != 1 || len(lost["a"]) != 1 || lost["a"][0].Hostname != "dead" {
+		t.Fatal(lost)
+	}
+	if lost := db.ExpireDeadHosts(); len(lost) != 0 {
+		t.Fatal(lost)
+	}
+	// The lost computer is notified once, and not again within the debounce period
+	notify := db.TakeLostHostsToNotify(time.Hour)
+	if len(notify) != 1 || notify["a"][0].IP != "1.1.1.1" || notify["a"][0].LastSeen != now-100 {
+		t.Fatal(notify)
+	}
+	if notify := db.TakeLostHostsToNotify(time.Hour); len(notify) != 0 {
+		t.Fatal(notify)
+	}
+	rec, _ = db.GetByUUID("a")
+	rec.AliveMessages["1.1.1.1"] = []AliveMessage{{Hostname: "dead", IP: "1.1.1.1", Timestamp: now - 50}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if lost := db.ExpireDeadHosts(); len(lost) != 1 {
+		t.Fatal(lost)
+	}
+	if notify := db.TakeLostHostsToNotify(time.Hour); len(notify) != 0 {
+		t.Fatal(notify)
+	}
+	if notify := db.TakeLostHostsToNotify(0); len(notify) != 1 || notify["a"][0].Count != 2 {
+		t.Fatal(notify)
+	}
+	// Lost computers are persisted
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.LostHosts) != 1 || len(rec.AliveMessages) != 1 || !rec.LostHosts[0].Notified {
+		t.Fatal(rec)
+	}
+	cmd := PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, Content: "umount"}
+	if stored, added, err := db.AddPendingCommand("a", "1.1.1.1", cmd); !added || err != nil || stored.ID == "" {
+		t.Fatal(stored, added, err)
+	}
+	if _, added, err := db.AddPendingCommand("a", "1.1.1.1", cmd); added || err != nil {
+		t.Fatal(added, err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.PendingCommands["1.1.1.1"]) != 1 || rec.PendingCommands["1.1.1.1"][0].IP != "1.1.1.1" {
+		t.Fatal(rec.PendingCommands)
+	}
+	if _, _, err := db.AddPendingCommand("b", "1.1.1.1", PendingCommand{}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestDB_ForceSelect(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	rec := Record{Version: CurrentRecordVersion, UUID: "a", Key: []byte("key"), MaxActive: 2, AliveIntervalSec: 10, AliveCount: 4,
+		AliveMessages: map[string][]AliveMessage{
+			"1.1.1.1": {{Hostname: "stale", IP: "1.1.1.1", Timestamp: now - 20}},
+			"2.2.2.2": {{Hostname: "fresh", IP: "2.2.2.2", Timestamp: now - 5}},
+		}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	requester := AliveMessage{Hostname: "new", IP: "3.3.3.3", Timestamp: now}
+	if found, rejected, _ := db.Select(requester, true, "", "", "a"); len(found) != 0 || len(rejected) != 1 {
+		t.Fatal(found, rejected)
+	}
+	found, evicted, rejected, missing := db.ForceSelect(requester, "password", "", "", "a", "b")
+	if len(found) != 1 || len(rejected) != 0 || len(missing) != 1 || missing[0] != "b" {
+		t.Fatal(found, rejected, missing)
+	}
+	if eviction := evicted["a"]; eviction.IP != "1.1.1.1" || eviction.Hostname != "stale" || eviction.EvictedBy != "password" || eviction.LastSeen != now-20 {
+		t.Fatal(evicted)
+	}
+	// The requester is now an active user, forcing again does not evict anybody
+	if _, evicted, _, _ := db.ForceSelect(requester, "password", "", "", "a"); len(evicted) != 0 {
+		t.Fatal(evicted)
+	}
+	// Evictions are persisted
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = db.GetByUUID("a")
+	if _, alive := rec.AliveMessages["1.1.1.1"]; alive || len(rec.AliveMessages) != 2 || len(rec.Evictions) != 1 || rec.Evictions[0].ForHost != "3.3.3.3 (new)" {
+		t.Fatal(rec.AliveMessages, rec.Evictions)
+	}
+}
@@ -0,0 +1,101 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/sys"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	MaintenanceFileName = "maintenance.json" // MaintenanceFileName is the file in database directory that stores the maintenance mode.
+)
+
+/*
+MaintenanceMode stops the server from handing out any key, e.g. during a security incident, while it keeps on running
+and answering alive reports. The mode ends by itself at the moment given by Until.
+*/
+type MaintenanceMode struct {
+	Enabled bool      `json:"enabled"` // Enabled is true if the mode has been turned on.
+	Since   time.Time `json:"since"`   // Since is the moment the mode was turned on.
+	Until   time.Time `json:"until"`   // Until is the moment the mode ends by itself.
+	Reason  string    `json:"reason"`  // Reason is the administrator's explanation.
+	By      string    `json:"by"`      // By describes who turned the mode on.
+}
+
+// IsActiveAt returns true only if the mode has been turned on and has not ended by the moment.
+func (mode MaintenanceMode) IsActiveAt(moment time.Time) bool {
+	return mode.Enabled && moment.Before(mode.Until)
+}
+
+// IsActive returns true only if the mode is in effect now.
+func (mode MaintenanceMode) IsActive() bool {
+	return mode.IsActiveAt(time.Now())
+}
+
+// String describes the mode in a sentence.
+func (mode MaintenanceMode) String() string {
+	if !mode.IsActive() {
+		return "off"
+	}
+	desc := fmt.Sprintf("on since %s until %s", mode.Since.Format(time.RFC3339), mode.Until.Format(time.RFC3339))
+	if mode.By != "" {
+		desc += fmt.Sprintf(" by %s", mode.By)
+	}
+	if mode.Reason != "" {
+		desc += fmt.Sprintf(" (%s)", mode.Reason)
+	}
+	return desc
+}
+
+// Return the path of the file that stores the maintenance mode.
+func (db *DB) maintenancePath() string {
+	return path.Join(db.Dir, MaintenanceFileName)
+}
+
+/*
+Read the maintenance mode from database directory, a database never put into maintenance does not have the file.
+Caller must hold the lock. If the file cannot be read, the mode is on, so that keys are not handed out by mistake.
+*/
+func (db *DB) loadMaintenance() {
+	db.Maintenance = MaintenanceMode{}
+	content, err := ioutil.ReadFile(db.maintenancePath())
+	if os.IsNotExist(err) {
+		return
+	} else if err == nil {
+		err = json.Unmarshal(content, &db.Maintenance)
+	}
+	if err != nil {
+		log.Printf("DB.loadMaintenance: failed to read maintenance mode, keys are not handed out until it is turned off - %v", err)
+		now := time.Now()
+		db.Maintenance = MaintenanceMode{Enabled: true, Since: now, Until: now.Add(100 * 365 * 24 * time.Hour), Reason: "the maintenance mode file is damaged"}
+	}
+}
+
+// GetMaintenance returns the maintenance mode as it is now.
+func (db *DB) GetMaintenance() MaintenanceMode {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return db.Maintenance
+}
+
+// SetMaintenance saves the maintenance mode into database directory, so that it survives a restart of the server.
+func (db *DB) SetMaintenance(mode MaintenanceMode) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	content, err := json.MarshalIndent(mode, "", "  ")
+	if err != nil {
+		return fmt.Errorf("DB.SetMaintenance: failed to encode maintenance mode - %v", err)
+	}
+	if err := sys.ReplaceFile(db.maintenancePath(), content, DB_REC_FILE_MODE, true); err != nil {
+		return fmt.Errorf("DB.SetMaintenance: failed to save maintenance mode - %v", err)
+	}
+	db.Maintenance = mode
+	return nil
+}
@@ -0,0 +1,47 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDB_Maintenance(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := db.GetMaintenance(); mode.IsActive() || mode.String() != "off" {
+		t.Fatal(mode)
+	}
+	now := time.Now()
+	if err := db.SetMaintenance(MaintenanceMode{Enabled: true, Since: now, Until: now.Add(time.Hour), Reason: "incident", By: "root"}); err != nil {
+		t.Fatal(err)
+	}
+	// The maintenance file is not mistaken for a record
+	if db, err = OpenDB(TestDBDir); err != nil || len(db.LoadErrors) != 0 {
+		t.Fatal(db.LoadErrors, err)
+	}
+	if mode := db.GetMaintenance(); !mode.IsActive() || mode.Reason != "incident" || !mode.IsActiveAt(now.Add(59*time.Minute)) || mode.IsActiveAt(now.Add(time.Hour)) {
+		t.Fatal(mode)
+	}
+	// A damaged maintenance file keeps the keys from being handed out
+	if err := ioutil.WriteFile(path.Join(TestDBDir, MaintenanceFileName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil || !db.GetMaintenance().IsActive() {
+		t.Fatal(db.GetMaintenance(), err)
+	}
+	if err := db.SetMaintenance(MaintenanceMode{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil || db.GetMaintenance().IsActive() {
+		t.Fatal(db.GetMaintenance(), err)
+	}
+}
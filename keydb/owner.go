@@ -0,0 +1,37 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	MaxOwnerLen = 128 // MaxOwnerLen is the maximum length of a record owner.
+)
+
+/*
+ValidateOwner returns an error if the record owner is too long or carries control characters, as the owner appears in
+list-keys and in the subject of notification emails. An empty owner is not an error, the record has no owner then.
+*/
+func ValidateOwner(owner string) error {
+	if len(owner) > MaxOwnerLen {
+		return fmt.Errorf("Owner \"%s\" is longer than %d characters", owner, MaxOwnerLen)
+	}
+	if strings.TrimSpace(owner) != owner {
+		return fmt.Errorf("Owner \"%s\" must not begin or end with a space", owner)
+	}
+	for _, r := range owner {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("Owner \"%s\" must not contain control characters", owner)
+		}
+	}
+	return nil
+}
+
+// IsOwnedBy returns true if the owner of the record is the owner, regardless of case.
+func (rec *Record) IsOwnedBy(owner string) bool {
+	return rec.Owner != "" && strings.EqualFold(rec.Owner, owner)
+}
@@ -0,0 +1,53 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateOwner(t *testing.T) {
+	for _, good := range []string{"", "storage-team", "Jane Doe <jane@example.com>"} {
+		if err := ValidateOwner(good); err != nil {
+			t.Fatal(good, err)
+		}
+	}
+	for _, bad := range []string{" storage", "storage ", "storage\nteam", "storage\tteam", strings.Repeat("a", MaxOwnerLen+1)} {
+		if err := ValidateOwner(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	rec := Record{Owner: "Storage-Team"}
+	if !rec.IsOwnedBy("storage-team") || rec.IsOwnedBy("db-team") || (&Record{}).IsOwnedBy("") {
+		t.Fatal("wrong ownership")
+	}
+	if attrs := rec.FormatAttrs("|"); !strings.HasSuffix(attrs, `|Owner="Storage-Team"`) {
+		t.Fatal(attrs)
+	}
+}
+
+func TestDB_RevertKeepsOwner(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid := "aaaa-bbbb"
+	rec := Record{Version: CurrentRecordVersion, UUID: uuid, Key: []byte("key"), MountPoint: "/a", MountOptions: []string{}, Owner: "storage-team"}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	rec.MountPoint = "/b"
+	rec.Owner = "db-team"
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	// The mount point comes back, the owner stays
+	reverted, err := db.RevertRecord(uuid, 1)
+	if err != nil || reverted.MountPoint != "/a" || reverted.Owner != "db-team" {
+		t.Fatal(reverted, err)
+	}
+}
@@ -4,20 +4,83 @@ package keydb
 
 import (
 	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/sys"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
+	"path"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 const (
-	CurrentRecordVersion = 3 // CurrentRecordVersion is the version of new database records to be created by cryptctl2.
+	CurrentRecordVersion     = 3  // CurrentRecordVersion is the version of new database records to be created by cryptctl2.
+	MaxClientErrorsPerRecord = 32 // MaxClientErrorsPerRecord is the number of distinct client errors kept in a record, the least recent are forgotten.
 )
 
 var RegexUUID = regexp.MustCompile("^[a-zA-Z0-9-:_]+$") // RegexUUID matches characters that are allowed in a UUID
 
+/*
+CanonicalRecordID removes the redundant "UUID:" prefix from a device ID, as records of file system UUIDs are stored
+without it. Other prefixed IDs (e.g. "SERIAL:...") are returned as they are.
+*/
+func CanonicalRecordID(id string) string {
+	return strings.TrimPrefix(id, "UUID:")
+}
+
+// Ways of checking a file system before it is mounted by the client.
+const (
+	FsckOff   = "off"   // FsckOff mounts the file system without checking it.
+	FsckPreen = "preen" // FsckPreen repairs what is safe to repair automatically, the default.
+	FsckForce = "force" // FsckForce checks the file system even if it is marked clean.
+)
+
+// Return an error if the file system check policy is not one of the supported ones, empty means FsckPreen.
+func ValidateFsckPolicy(policy string) error {
+	switch policy {
+	case "", FsckOff, FsckPreen, FsckForce:
+		return nil
+	}
+	return fmt.Errorf("File system check policy \"%s\" is not supported, use %s, %s, or %s", policy, FsckOff, FsckPreen, FsckForce)
+}
+
+// FileSystems are the file systems a record may ask to be created on the disk.
+var FileSystems = []string{"ext4", "ext3", "xfs", "btrfs"}
+
+// Return an error if the file system is not one of FileSystems. Empty file system is only accepted without auto encryption.
+func ValidateFileSystem(fsType string, autoEncryption bool) error {
+	if fsType == "" {
+		if autoEncryption {
+			return errors.New("Auto encryption requires a file system to be created, use one of " + strings.Join(FileSystems, ", "))
+		}
+		return nil
+	}
+	for _, supported := range FileSystems {
+		if fsType == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("File system \"%s\" is not supported, use one of %s", fsType, strings.Join(FileSystems, ", "))
+}
+
+// Return an error if the Tang server URL is neither empty nor an http(s) URL with a host.
+func ValidateTangURL(tangURL string) error {
+	if tangURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(tangURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Tang server URL \"%s\" must look like http://tang.example.com", tangURL)
+	}
+	return nil
+}
+
 /*
 ValidateUUID returns an error only if the input string is empty, or if there are illegal
 characters among the input.
@@ -37,53 +100,265 @@ using an encryption key - i.e. the encrypted disk is currently unlocked and onli
 */
 type AliveMessage struct {
 	Hostname  string // Hostname is the host name reported by client computer itself.
+	CertName  string // CertName is the host name of the client's validated certificate, empty if the server does not validate client certificates.
 	IP        string // IP is the client computer's IP as seen by cryptctl2 server.
 	Timestamp int64  // Timestamp is the moment the message arrived at cryptctl2 server.
+	Health    string // Health describes the problems reported by client computer (e.g. failed bind-mounts), empty if healthy.
+}
+
+// Mount propagation types accepted by bind-mounts, see mount(8).
+var BindPropagations = []string{"shared", "rshared", "slave", "rslave", "private", "rprivate", "unbindable", "runbindable"}
+
+// BindMount is an additional location where the unlocked file system is bind-mounted after it is mounted.
+type BindMount struct {
+	Target      string   // Target is the absolute path of the directory to bind-mount the file system onto.
+	Options     []string // Options are the additional mount options of the bind-mount, e.g. "ro".
+	Propagation string   // Propagation is one of BindPropagations, or empty to leave it at system default.
+}
+
+// Validate returns an error if the target is not a sane absolute path or the propagation type is unknown.
+func (bind BindMount) Validate() error {
+	if !path.IsAbs(bind.Target) || path.Clean(bind.Target) != bind.Target || bind.Target == "/" {
+		return fmt.Errorf("Bind-mount target \"%s\" should be a clean absolute path other than /", bind.Target)
+	}
+	if strings.ContainsAny(bind.Target, ":, \t\n") {
+		return fmt.Errorf("Bind-mount target \"%s\" must not contain colon, comma, or spaces", bind.Target)
+	}
+	if bind.Propagation != "" {
+		known := false
+		for _, propagation := range BindPropagations {
+			known = known || bind.Propagation == propagation
+		}
+		if !known {
+			return fmt.Errorf("Bind-mount propagation \"%s\" should be one of %s", bind.Propagation, strings.Join(BindPropagations, ", "))
+		}
+	}
+	return nil
 }
 
+// String returns the bind-mount in the format of "target:propagation:option1,option2".
+func (bind BindMount) String() string {
+	return strings.Join([]string{bind.Target, bind.Propagation, strings.Join(bind.Options, ",")}, ":")
+}
+
+/*
+ParseBindMounts parses space-separated bind-mounts in the format of "target[:propagation[:option1,option2]]" and
+validates each of them.
+*/
+func ParseBindMounts(in string) (binds []BindMount, err error) {
+	binds = make([]BindMount, 0, 4)
+	for _, field := range strings.Fields(in) {
+		parts := strings.SplitN(field, ":", 3)
+		bind := BindMount{Target: parts[0], Options: []string{}}
+		if len(parts) > 1 {
+			bind.Propagation = parts[1]
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			bind.Options = strings.Split(parts[2], ",")
+		}
+		if err = bind.Validate(); err != nil {
+			return nil, err
+		}
+		binds = append(binds, bind)
+	}
+	return
+}
+
+/*
+ClientError is a persistent failure reported by a client computer after it has exhausted its local retries, e.g. it
+cannot mount the file system. Repeated reports of the same class from the same client are counted rather than kept
+individually.
+*/
+type ClientError struct {
+	Client    string `json:"client"`     // Client is the identity of the reporting computer - certificate common name, or IP.
+	Hostname  string `json:"hostname"`   // Hostname is the host name reported by the computer itself.
+	IP        string `json:"ip"`         // IP is the computer's IP as seen by cryptctl2 server.
+	Class     string `json:"class"`      // Class is a short category of the failure, e.g. "mount".
+	Message   string `json:"message"`    // Message is the human readable description that came with the most recent report.
+	Count     int    `json:"count"`      // Count is the number of times the failure has been reported.
+	FirstSeen int64  `json:"first_seen"` // FirstSeen is the timestamp of the first report.
+	LastSeen  int64  `json:"last_seen"`  // LastSeen is the timestamp of the most recent report.
+}
+
+const (
+	PendingCommandExpired         = "EXPIRED" // PendingCommandExpired is the ClientResult of a command that expired before client fetched it.
+	PendingCommandRetentionFactor = 10        // PendingCommandRetentionFactor is how many times its validity period a command and its result are kept.
+
+	// Status of a pending command as told by PendingCommand.Status.
+	PendingCommandStatusPending   = "pending"   // the command has not yet been fetched by client
+	PendingCommandStatusFetched   = "fetched"   // the client has fetched the command but not reported its result
+	PendingCommandStatusSucceeded = "succeeded" // the client carried out the command successfully
+	PendingCommandStatusFailed    = "failed"    // the client failed to carry out the command
+	PendingCommandStatusExpired   = "expired"   // the command expired before client fetched it
+)
+
 // PendingCommand is a time-restricted command issued by cryptctl2 server administrator to be polled by a client.
 type PendingCommand struct {
 	ValidFrom    time.Time     // ValidFrom is the timestamp at which moment the command was created.
-	Validity     time.Duration // Validity determines the point in time the command expires. Expired commands disappear almost immediately.
+	Validity     time.Duration // Validity determines the point in time the command expires. Expired commands are kept for 10x validity period.
 	IP           string        // IP is the client computer's IP the command is issued to.
 	Content      interface{}   // Content is the command content, serialised and transmitted between server and client.
 	SeenByClient bool          // SeenByClient is updated to true via RPC once the client has seen this command.
 	ClientResult string        // ClientResult is updated via RPC once client has finished executing this command.
+	Group        string        // Group is the consistency group the command was issued to, empty if the command concerns only one disk.
+	GroupMembers []string      // GroupMembers are the UUIDs of all group members in mount order, the command is carried out on all or none of them.
+	Succeeded    bool          // Succeeded is true if the client reported that the command was carried out successfully.
+	ResultTime   time.Time     // ResultTime is the moment client reported the execution result, zero if it has not.
+	Confirmed    bool          // Confirmed is true if the administrator confirmed a destructive command by typing the UUID again.
+	ID           string        // ID uniquely identifies the command, so that client carries it out once. Commands of older versions have none.
+	Duration     time.Duration // Duration is how long the client took to carry out the command, zero if the client did not tell.
+}
+
+// NewPendingCommandID returns a random ID for a new pending command.
+func NewPendingCommandID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Errorf("NewPendingCommandID: failed to read random bytes - %v", err))
+	}
+	return hex.EncodeToString(id)
 }
 
 // IsValid returns true only if the command has not expired.
 func (cmd *PendingCommand) IsValid() bool {
-	return cmd.ValidFrom.Add(cmd.Validity).Unix() > time.Now().Unix()
+	return cmd.IsValidAt(time.Now())
+}
+
+// IsValidAt returns true only if the command has not expired at the moment, e.g. as of the clock of the server.
+func (cmd *PendingCommand) IsValidAt(moment time.Time) bool {
+	return cmd.ValidFrom.Add(cmd.Validity).Unix() > moment.Unix()
+}
+
+// IsRetained returns true only if the command and its result are still kept, which lasts beyond the command's expiry.
+func (cmd *PendingCommand) IsRetained() bool {
+	return cmd.ValidFrom.Add(cmd.Validity*PendingCommandRetentionFactor).Unix() > time.Now().Unix()
+}
+
+// HasResult returns true only if client has reported the execution result, or the command expired before being fetched.
+func (cmd *PendingCommand) HasResult() bool {
+	return !cmd.ResultTime.IsZero() || cmd.ClientResult != ""
+}
+
+// Status returns one of PendingCommandStatus* constants that describes the progress of the command.
+func (cmd *PendingCommand) Status() string {
+	if cmd.ClientResult == PendingCommandExpired {
+		return PendingCommandStatusExpired
+	} else if cmd.HasResult() {
+		if cmd.Succeeded {
+			return PendingCommandStatusSucceeded
+		}
+		return PendingCommandStatusFailed
+	} else if cmd.SeenByClient {
+		return PendingCommandStatusFetched
+	} else if !cmd.IsValid() {
+		return PendingCommandStatusExpired
+	}
+	return PendingCommandStatusPending
+}
+
+// Matches returns true only if the command was issued at the moment and carries the content.
+func (cmd *PendingCommand) Matches(validFrom time.Time, content interface{}) bool {
+	return cmd.ValidFrom.Equal(validFrom) && reflect.DeepEqual(cmd.Content, content)
+}
+
+/*
+MatchesID returns true only if the command carries the ID. Clients of older versions do not know the ID, in which case
+(an empty ID) the command has to match the moment and content instead.
+*/
+func (cmd *PendingCommand) MatchesID(id string, validFrom time.Time, content interface{}) bool {
+	if id != "" {
+		return cmd.ID == id
+	}
+	return cmd.Matches(validFrom, content)
+}
+
+// IsDuplicateOf returns true only if the other command is still outstanding and would do exactly the same.
+func (cmd *PendingCommand) IsDuplicateOf(other PendingCommand) bool {
+	return other.IsValid() && !other.HasResult() && cmd.Group == other.Group &&
+		reflect.DeepEqual(cmd.GroupMembers, other.GroupMembers) && reflect.DeepEqual(cmd.Content, other.Content)
 }
 
 /*
 A key record that knows all about the encrypted file system, its mount point, and unlocking keys.
 When stored on disk, the record resides in a file encoded in gob.
 The binary encoding method is intentionally chosen to deter users from manually editing the files on disk.
+The key material is left out of the record's JSON encoding, so that a record presented as JSON never carries its key.
 */
 type Record struct {
-	ID           string    // ID is assigned by KMIP server for the encryption key.
-	Version      int       // Version is the version number of this record. Outdated records are automatically upgraded.
-	CreationTime time.Time // CreationTime is the timestamp at which the record was created.
-	Key          []byte    // Key is the disk encryption key if the key is not stored on an external KMIP server.
+	ID           string          // ID is assigned by KMIP server for the encryption key.
+	Version      int             // Version is the version number of this record. Outdated records are automatically upgraded.
+	CreationTime time.Time       // CreationTime is the timestamp at which the record was created.
+	Key          sys.SecureBytes `json:"-"` // Key is the disk encryption key if the key is not stored on an external KMIP server.
+	RotationTime time.Time       // RotationTime is the moment the encryption key was most recently replaced, zero if it never was.
+	ForgetTime   time.Time       // ForgetTime is the moment the key was destroyed while the record was kept, zero if it never was.
+	SealedKey    []byte          `json:"-"` // SealedKey is Key encrypted by the master key, the record file carries it instead of Key if the key database is encrypted.
+	PreviousKey  sys.SecureBytes `json:"-"` // PreviousKey is the key replaced by a rotation the server started, kept until a computer confirms the rotation (see StartKeyRotation).
+	SealedPrev   []byte          `json:"-"` // SealedPrev is PreviousKey encrypted by the master key, the record file carries it instead of PreviousKey if the key database is encrypted.
 
 	UUID         string   // UUID is the block device UUID of the file system.
 	MappedName   string   // The mapped name which will be used when opening the device. If empty the device uuid name will be used.
 	MountPoint   string   // MountPoint is the location (directory) where this file system is expected to be mounted to.
 	MountOptions []string // MountOptions is a string array of mount options specific to the file system.
 
-	MaxActive        int      // MaxActive is the maximum simultaneous number of online users (computers) for the key, or <=0 for unlimited.
-	AllowedClients   []string // Array of DNS-names of clients which have access to the device. The client must use certificate containing the DNS-name in this case
-	AliveIntervalSec int      // AliveIntervalSec is interval in seconds that all key users (computers) should report they're online.
-	AliveCount       int      // AliveCount is number of times a key user (computer) can miss regular report and be considered offline.
-	AutoEncryption   bool     // If it is true automatic encryption is allowed when the first client detects this device and the device is not already encypted.
-	FileSystem       string   // The filesystem on this device. Used only if AutoEncryption is true
+	MaxActive        int               // MaxActive is the maximum simultaneous number of online users (computers) for the key, or <=0 for unlimited.
+	AllowedClients   []string          // Array of DNS-names, DNS-name patterns, IPs, and subnets of clients which have access to the device. The client must use certificate containing the DNS-name or IP in this case
+	AliveIntervalSec int               // AliveIntervalSec is interval in seconds that all key users (computers) should report they're online.
+	AliveCount       int               // AliveCount is number of times a key user (computer) can miss regular report and be considered offline.
+	AutoEncryption   bool              // If it is true automatic encryption is allowed when the first client detects this device and the device is not already encypted.
+	FileSystem       string            // The filesystem on this device. Used only if AutoEncryption is true
+	AutoEncryptForce bool              // AutoEncryptForce lets automatic encryption format a device that carries a file system, partition table, or other signature, destroying its content.
+	Group            string            // Group is the name of consistency group, all members of a group are mounted and umounted together.
+	GroupPriority    int               // GroupPriority determines the order in which group members are mounted (ascending) and umounted (descending).
+	BindMounts       []BindMount       // BindMounts are bind-mounted in order after the file system is mounted, and umounted in reverse order.
+	UnlockAfter      []string          // UnlockAfter are the UUIDs of records whose disks are unlocked and mounted before this one's, e.g. the disk hosting its LVM volume.
+	TangURL          string            // TangURL is the Tang server the disk is also bound to by a clevis pin, as a fallback for when key server is unreachable.
+	FsckPolicy       string            // FsckPolicy is FsckOff, FsckPreen (also if empty), or FsckForce for checking the file system before it is mounted.
+	Tags             map[string]string // Tags are free-form name-value pairs such as "cluster=ceph-prod" that list-keys can filter by.
+	Owner            string            // Owner is the team or administrator responsible for the disk, destructive actions must be acknowledged on its behalf.
+
+	UnlockWindows     []UnlockWindow // UnlockWindows are the only periods of time during which the key is handed out for auto-unlock, empty for any time.
+	UmountAtWindowEnd bool           // UmountAtWindowEnd tells the server to issue an umount command to the computers using the disk once a window ends.
+	UnlockTokens      []UnlockToken  // UnlockTokens let a computer retrieve the key once without the password, only their digests are kept.
+
+	CryptOptions fs.CryptFormatOptions // CryptOptions are the LUKS header parameters used when the device is formatted, they cannot change afterwards.
+	SealToTPM    bool                  // SealToTPM allows client computers to keep the key sealed by their TPM2 for unlocking without network.
+	SealMaxHours int                   // SealMaxHours is how long a sealed key may be used before key server must hand it out again, 0 for no limit.
+
+	ClientErrors []ClientError // ClientErrors are the failures reported by client computers, the most recent first.
+	LostHosts    []LostHost    // LostHosts are the computers that stopped sending alive messages, the most recently lost first.
+	Evictions    []Eviction    // Evictions are the computers removed to make room for forced key retrievals, the most recent first.
+	Rejections   []Rejection   // Rejections are the key retrievals the server refused, the most recent first.
+	Retrievals   []Retrieval   // Retrievals are the decisions on key retrievals, granted or not, the most recent first.
 
 	LastRetrieval   AliveMessage                // LastRetrieval is the computer who most recently successfully retrieved the key.
+	AutoEncryptedBy AliveMessage                // AutoEncryptedBy is the computer that encrypted the blank disk on its own, see AutoEncryption.
 	AliveMessages   map[string][]AliveMessage   // AliveMessages are the most recent alive reports in IP - message array pairs.
 	PendingCommands map[string][]PendingCommand // PendingCommands are some command to be periodcally polled by clients carrying the IP address (keys).
 }
 
+// Return an error if any bind-mount is invalid or coincides with the mount point or another bind-mount.
+func (rec *Record) ValidateBindMounts() error {
+	seen := map[string]bool{path.Clean(rec.MountPoint): true}
+	for _, bind := range rec.BindMounts {
+		if err := bind.Validate(); err != nil {
+			return err
+		}
+		if seen[bind.Target] {
+			return fmt.Errorf("Bind-mount target \"%s\" is used more than once or is the mount point itself", bind.Target)
+		}
+		seen[bind.Target] = true
+	}
+	return nil
+}
+
+// Return bind-mounts in a single space-separated string, as accepted by ParseBindMounts.
+func (rec *Record) GetBindMountStr() string {
+	binds := make([]string, 0, len(rec.BindMounts))
+	for _, bind := range rec.BindMounts {
+		binds = append(binds, bind.String())
+	}
+	return strings.Join(binds, " ")
+}
+
 // Return mount options in a single string, as accepted by mount command.
 func (rec *Record) GetMountOptionStr() string {
 	return strings.Join(rec.MountOptions, ",")
@@ -94,6 +369,12 @@ func (rec *Record) GetAllowedClients() string {
 	return strings.Join(rec.AllowedClients, " ")
 }
 
+// IsClientAllowed returns true if the record does not restrict its clients, or the client's certificate DNS name or IP is allowed.
+func (rec *Record) IsClientAllowed(DNSName, IPAddress string) bool {
+	_, allowed := rec.MatchAllowedClient(DNSName, IPAddress)
+	return allowed
+}
+
 // Determine whether a host is still alive according to recent alive messages.
 func (rec *Record) IsHostAlive(hostIP string) (alive bool, finalMessage AliveMessage) {
 	if beat, found := rec.AliveMessages[hostIP]; found {
@@ -107,6 +388,79 @@ func (rec *Record) IsHostAlive(hostIP string) (alive bool, finalMessage AliveMes
 	return
 }
 
+// AliveHost is a computer that is currently using the encryption key of a record, as seen from its alive messages.
+type AliveHost struct {
+	UUID             string `json:"uuid"`                        // UUID is the UUID of the record whose key is being used.
+	Hostname         string `json:"hostname"`                    // Hostname is the host name reported by the computer in its most recent alive message.
+	CertName         string `json:"cert_name,omitempty"`         // CertName is the host name of the computer's validated certificate.
+	IdentityMismatch bool   `json:"identity_mismatch,omitempty"` // IdentityMismatch is true if the reported host name disagrees with the certificate.
+	IP               string `json:"ip"`                          // IP is the computer's IP as seen by cryptctl2 server.
+	LastAlive        int64  `json:"last_alive"`                  // LastAlive is the timestamp of the most recent alive message.
+	SecondsUntilDead int64  `json:"seconds_until_dead"`          // SecondsUntilDead is the number of seconds until the computer is considered offline.
+	Health           string `json:"health,omitempty"`            // Health describes the problems reported by the computer, empty if healthy.
+}
+
+/*
+Remove all dead hosts from alive message history, and then return the remaining hosts along with the number of seconds
+until each of them would be considered dead. The hosts are sorted by IP.
+*/
+func (rec *Record) ListAliveHosts() (hosts []AliveHost) {
+	rec.RemoveDeadHosts()
+	now := time.Now().Unix()
+	hosts = make([]AliveHost, 0, len(rec.AliveMessages))
+	for hostIP := range rec.AliveMessages {
+		if alive, finalMessage := rec.IsHostAlive(hostIP); alive {
+			hosts = append(hosts, AliveHost{
+				UUID:             rec.UUID,
+				Hostname:         finalMessage.Hostname,
+				CertName:         finalMessage.CertName,
+				IdentityMismatch: finalMessage.IdentityMismatch(),
+				IP:               hostIP,
+				LastAlive:        finalMessage.Timestamp,
+				SecondsUntilDead: finalMessage.Timestamp + int64(rec.AliveIntervalSec*rec.AliveCount) - now,
+				Health:           finalMessage.Health,
+			})
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].IP < hosts[j].IP
+	})
+	return
+}
+
+/*
+Record a client error, or count it toward an existing error of the same client and class. Return true only if none
+of the clients has reported an error of this class before.
+*/
+func (rec *Record) AddClientError(report ClientError) (newClass bool) {
+	newClass = true
+	if report.Count < 1 {
+		report.Count = 1
+	}
+	// Work on a copy, the slice may be shared by copies of the record.
+	errs := make([]ClientError, 0, len(rec.ClientErrors)+1)
+	for _, existing := range rec.ClientErrors {
+		if existing.Class == report.Class {
+			newClass = false
+			if existing.Client == report.Client {
+				report.Count += existing.Count
+				report.FirstSeen = existing.FirstSeen
+				continue
+			}
+		}
+		errs = append(errs, existing)
+	}
+	if report.FirstSeen == 0 {
+		report.FirstSeen = report.LastSeen
+	}
+	errs = append([]ClientError{report}, errs...)
+	if len(errs) > MaxClientErrorsPerRecord {
+		errs = errs[:MaxClientErrorsPerRecord]
+	}
+	rec.ClientErrors = errs
+	return
+}
+
 // Remove all dead hosts from alive message history, return each dead host's final alive .
 func (rec *Record) RemoveDeadHosts() (deadFinalMessage map[string]AliveMessage) {
 	deadFinalMessage = make(map[string]AliveMessage)
@@ -124,15 +478,22 @@ func (rec *Record) RemoveDeadHosts() (deadFinalMessage map[string]AliveMessage)
 	return
 }
 
-// RemoveDeadPendingCommands removes pending commands and results that were made 10x validity period in the past.
+/*
+RemoveExpiredPendingCommands marks the commands that expired before client fetched them as EXPIRED, and removes
+pending commands and results that were made 10x validity period in the past.
+*/
 func (rec *Record) RemoveExpiredPendingCommands() {
 	ipToDelete := make([]string, 0, 0)
 	for ip, commands := range rec.PendingCommands {
 		remainingCommands := make([]PendingCommand, 0, len(commands))
 		for _, cmd := range commands {
-			if cmd.IsValid() {
-				remainingCommands = append(remainingCommands, cmd)
+			if !cmd.IsRetained() {
+				continue
 			}
+			if !cmd.IsValid() && !cmd.SeenByClient && !cmd.HasResult() {
+				cmd.ClientResult = PendingCommandExpired
+			}
+			remainingCommands = append(remainingCommands, cmd)
 		}
 		if len(remainingCommands) > 0 {
 			rec.PendingCommands[ip] = remainingCommands
@@ -145,13 +506,26 @@ func (rec *Record) RemoveExpiredPendingCommands() {
 	}
 }
 
-// AddPendingCommand stores a command associated to the input IP address, and clears expired pending commands along the way.
-func (rec *Record) AddPendingCommand(ip string, cmd PendingCommand) {
+/*
+AddPendingCommand stores a command associated to the input IP address, and clears expired pending commands along the way.
+The command is given a new ID if it has none. If an identical command is still outstanding for the IP address, the
+command is not stored again, and the outstanding command is returned along with false.
+*/
+func (rec *Record) AddPendingCommand(ip string, cmd PendingCommand) (stored PendingCommand, added bool) {
 	rec.RemoveExpiredPendingCommands()
 	if _, found := rec.PendingCommands[ip]; !found {
 		rec.PendingCommands[ip] = make([]PendingCommand, 0, 4)
 	}
+	for _, existing := range rec.PendingCommands[ip] {
+		if cmd.IsDuplicateOf(existing) {
+			return existing, false
+		}
+	}
+	if cmd.ID == "" {
+		cmd.ID = NewPendingCommandID()
+	}
 	rec.PendingCommands[ip] = append(rec.PendingCommands[ip], cmd)
+	return cmd, true
 }
 
 // ClearPendingCommands removes all pending commands, and clears expired pending commands along the way.
@@ -220,6 +594,35 @@ func (rec *Record) Validate() error {
 	if rec.AliveCount < 1 {
 		return fmt.Errorf("AliveCount is %d but it should be a positive integer", rec.AliveCount)
 	}
+	if err := rec.ValidateBindMounts(); err != nil {
+		return err
+	}
+	if err := rec.ValidateTags(); err != nil {
+		return err
+	}
+	if err := ValidateOwner(rec.Owner); err != nil {
+		return err
+	}
+	if err := rec.ValidateUnlockAfter(); err != nil {
+		return err
+	}
+	if err := ValidateFsckPolicy(rec.FsckPolicy); err != nil {
+		return err
+	}
+	if err := rec.ValidateUnlockWindows(); err != nil {
+		return err
+	}
+	if err := ValidateTangURL(rec.TangURL); err != nil {
+		return err
+	}
+	for _, entry := range rec.AllowedClients {
+		if err := ValidateAllowedClient(strings.TrimSpace(entry)); err != nil {
+			return err
+		}
+	}
+	if err := rec.CryptOptions.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -258,7 +661,7 @@ func (rec *Record) Deserialise(in []byte) error {
 
 // Format all attributes (except the binary key) for pretty printing, using the specified separator.
 func (rec *Record) FormatAttrs(separator string) string {
-	return fmt.Sprintf(`Timestamp="%d"%sIP="%s"%sHostname="%s"%sFileSystemUUID="%s"%sKMIPID="%s"%sMountPoint="%s"%sMountOptions="%s"`,
+	attrs := fmt.Sprintf(`Timestamp="%d"%sIP="%s"%sHostname="%s"%sFileSystemUUID="%s"%sKMIPID="%s"%sMountPoint="%s"%sMountOptions="%s"`,
 		rec.LastRetrieval.Timestamp, separator,
 		rec.LastRetrieval.IP, separator,
 		rec.LastRetrieval.Hostname, separator,
@@ -266,6 +669,10 @@ func (rec *Record) FormatAttrs(separator string) string {
 		rec.ID, separator,
 		strings.Replace(rec.MountPoint, `"`, `\"`, -1), separator,
 		rec.GetMountOptionStr())
+	if rec.Owner != "" {
+		attrs += fmt.Sprintf(`%sOwner="%s"`, separator, strings.Replace(rec.Owner, `"`, `\"`, -1))
+	}
+	return attrs
 }
 
 type RecordSlice []Record // a slice of key database records that can be sorted by latest usage.
@@ -282,3 +689,12 @@ func (r RecordSlice) Less(i, j int) bool {
 func (r RecordSlice) Swap(i, j int) {
 	r[i], r[j] = r[j], r[i]
 }
+
+// GroupMemberUUIDs returns UUIDs of the records in their present order.
+func (r RecordSlice) GroupMemberUUIDs() []string {
+	uuids := make([]string, 0, len(r))
+	for _, rec := range r {
+		uuids = append(uuids, rec.UUID)
+	}
+	return uuids
+}
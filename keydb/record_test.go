@@ -3,7 +3,11 @@
 package keydb
 
 import (
+	"cryptctl2/fs"
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -87,6 +91,11 @@ func TestRecordValidate(t *testing.T) {
 	if rec.Validate() == nil {
 		t.Fatal("did not error")
 	}
+	rec.AliveCount = 1
+	rec.CryptOptions = fs.CryptFormatOptions{LUKSVersion: 1, PBKDF: fs.CryptArgon2id}
+	if rec.Validate() == nil {
+		t.Fatal("did not error")
+	}
 }
 
 func TestRecordAliveMessage1(t *testing.T) {
@@ -390,29 +399,209 @@ func TestRecord_RemoveExpiredPendingCommands(t *testing.T) {
 		PendingCommands:  make(map[string][]PendingCommand),
 	}
 	rec.AddPendingCommand("1.1.1.1", PendingCommand{
-		// Expired right away
-		ValidFrom: time.Now().Add(-1 * time.Second),
+		// Expired long enough ago to be forgotten
+		ValidFrom: time.Now().Add(-11 * time.Second),
+		Validity:  1 * time.Second,
+	})
+	rec.AddPendingCommand("1.1.1.1", PendingCommand{
+		// Expired right away but the result is kept for a while
+		ValidFrom:    time.Now().Add(-2 * time.Second),
+		Validity:     1 * time.Second,
+		SeenByClient: true,
+		ClientResult: "Success",
+		Succeeded:    true,
+		ResultTime:   time.Now(),
+	})
+	rec.AddPendingCommand("1.1.1.1", PendingCommand{
+		// Expired without being fetched
+		ValidFrom: time.Now().Add(-2 * time.Second),
 		Validity:  1 * time.Second,
 	})
 	rec.AddPendingCommand("1.1.1.1", PendingCommand{
 		// Expiring in a minute
 		ValidFrom: time.Now(),
 		Validity:  1 * time.Minute,
+		Content:   "umount",
 	})
 	rec.AddPendingCommand("1.1.1.1", PendingCommand{
 		// Not expiring anytime soon
 		ValidFrom: time.Now(),
 		Validity:  1 * time.Hour,
+		Content:   "mount",
 	})
 	rec.AddPendingCommand("2.2.2.2", PendingCommand{
-		// Expired right away
-		ValidFrom: time.Now().Add(-1 * time.Second),
+		// Expired long enough ago to be forgotten
+		ValidFrom: time.Now().Add(-11 * time.Second),
 		Validity:  1 * time.Second,
 	})
 	rec.RemoveExpiredPendingCommands()
-	// 1.1.1.1 has one command remaining
+	// 1.1.1.1 has four commands remaining
 	// 2.2.2.2 is removed because there are no more commands in history
-	if len(rec.PendingCommands) != 1 || len(rec.PendingCommands["1.1.1.1"]) != 2 {
+	if len(rec.PendingCommands) != 1 || len(rec.PendingCommands["1.1.1.1"]) != 4 {
+		t.Fatalf("%+v", rec.PendingCommands)
+	}
+	cmds := rec.PendingCommands["1.1.1.1"]
+	if cmds[0].Status() != PendingCommandStatusSucceeded || cmds[0].ClientResult != "Success" {
+		t.Fatalf("%+v", cmds[0])
+	}
+	if cmds[1].Status() != PendingCommandStatusExpired || cmds[1].ClientResult != PendingCommandExpired {
+		t.Fatalf("%+v", cmds[1])
+	}
+	if cmds[2].Status() != PendingCommandStatusPending || cmds[3].Status() != PendingCommandStatusPending {
+		t.Fatalf("%+v", cmds)
+	}
+}
+
+func TestPendingCommand_Status(t *testing.T) {
+	cmd := PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "umount"}
+	if s := cmd.Status(); s != PendingCommandStatusPending {
+		t.Fatal(s)
+	}
+	cmd.SeenByClient = true
+	if s := cmd.Status(); s != PendingCommandStatusFetched {
+		t.Fatal(s)
+	}
+	cmd.ClientResult = "device is busy"
+	cmd.ResultTime = time.Now()
+	if s := cmd.Status(); s != PendingCommandStatusFailed {
+		t.Fatal(s)
+	}
+	cmd.Succeeded = true
+	if s := cmd.Status(); s != PendingCommandStatusSucceeded {
+		t.Fatal(s)
+	}
+	if !cmd.Matches(cmd.ValidFrom, "umount") || cmd.Matches(cmd.ValidFrom.Add(time.Second), "umount") || cmd.Matches(cmd.ValidFrom, "mount") {
+		t.Fatal("wrong match")
+	}
+	cmd.ID = "abc"
+	if !cmd.MatchesID("abc", time.Time{}, nil) || cmd.MatchesID("def", cmd.ValidFrom, "umount") || !cmd.MatchesID("", cmd.ValidFrom, "umount") {
+		t.Fatal("wrong match by ID")
+	}
+}
+
+func TestRecord_AddPendingCommand_Duplicate(t *testing.T) {
+	rec := Record{PendingCommands: make(map[string][]PendingCommand)}
+	first, added := rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "umount"})
+	if !added || first.ID == "" {
+		t.Fatalf("%v %+v", added, first)
+	}
+	// An identical command issued again while the first one is outstanding is not stored
+	if again, added := rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "umount"}); added || again.ID != first.ID {
+		t.Fatalf("%v %+v", added, again)
+	}
+	// Commands of another content, another host, or another group are stored
+	if other, added := rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "mount"}); !added || other.ID == first.ID {
+		t.Fatalf("%v %+v", added, other)
+	}
+	if _, added := rec.AddPendingCommand("2.2.2.2", PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "umount"}); !added {
+		t.Fatal("did not add command of another host")
+	}
+	if _, added := rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "umount", Group: "g"}); !added {
+		t.Fatal("did not add command of a group")
+	}
+	// Once the first command has a result, the same command may be issued again
+	rec.PendingCommands["1.1.1.1"][0].ResultTime = time.Now()
+	if again, added := rec.AddPendingCommand("1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Minute, Content: "umount", ID: "given"}); !added || again.ID != "given" {
+		t.Fatalf("%v %+v", added, again)
+	}
+	if len(rec.PendingCommands["1.1.1.1"]) != 4 {
 		t.Fatalf("%+v", rec.PendingCommands)
 	}
+	// A command is valid only until it expires by the clock in question
+	cmd := PendingCommand{ValidFrom: time.Now(), Validity: time.Minute}
+	if !cmd.IsValidAt(time.Now().Add(30*time.Second)) || cmd.IsValidAt(time.Now().Add(2*time.Minute)) {
+		t.Fatal("wrong validity")
+	}
+}
+
+func TestParseBindMounts(t *testing.T) {
+	binds, err := ParseBindMounts(" /var/lib/docker/data  /srv/containers/data:rshared:ro,noexec /a/b: ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BindMount{
+		{Target: "/var/lib/docker/data", Options: []string{}},
+		{Target: "/srv/containers/data", Propagation: "rshared", Options: []string{"ro", "noexec"}},
+		{Target: "/a/b", Options: []string{}},
+	}
+	if !reflect.DeepEqual(binds, expected) {
+		t.Fatalf("\n%+v\n%+v\n", binds, expected)
+	}
+	rec := Record{MountPoint: "/data", BindMounts: binds}
+	if err := rec.ValidateBindMounts(); err != nil {
+		t.Fatal(err)
+	}
+	if str := rec.GetBindMountStr(); str != "/var/lib/docker/data:: /srv/containers/data:rshared:ro,noexec /a/b::" {
+		t.Fatal(str)
+	}
+	if reparsed, err := ParseBindMounts(rec.GetBindMountStr()); err != nil || !reflect.DeepEqual(reparsed, expected) {
+		t.Fatal(reparsed, err)
+	}
+	for _, bad := range []string{"relative/path", "/", "/a/../b", "/a/", "/a:bogus"} {
+		if binds, err := ParseBindMounts(bad); err == nil {
+			t.Fatal("did not error", bad, binds)
+		}
+	}
+	rec.BindMounts = append(rec.BindMounts, BindMount{Target: "/data"})
+	if err := rec.ValidateBindMounts(); err == nil {
+		t.Fatal("did not error on bind-mount over the mount point")
+	}
+	rec.BindMounts = []BindMount{{Target: "/a"}, {Target: "/a"}}
+	if err := rec.ValidateBindMounts(); err == nil {
+		t.Fatal("did not error on duplicated bind-mount")
+	}
+}
+
+func TestRecord_AddClientError(t *testing.T) {
+	rec := Record{}
+	if !rec.AddClientError(ClientError{Client: "a", Class: "mount", Message: "first", LastSeen: 1}) {
+		t.Fatal("should be a new class")
+	}
+	if rec.AddClientError(ClientError{Client: "a", Class: "mount", Message: "second", LastSeen: 2}) {
+		t.Fatal("should not be a new class")
+	}
+	if rec.AddClientError(ClientError{Client: "b", Class: "mount", Message: "other client", LastSeen: 3}) {
+		t.Fatal("should not be a new class")
+	}
+	if !rec.AddClientError(ClientError{Client: "a", Class: "open", Message: "another class", LastSeen: 4}) {
+		t.Fatal("should be a new class")
+	}
+	if len(rec.ClientErrors) != 3 {
+		t.Fatalf("%+v", rec.ClientErrors)
+	}
+	mountErr := rec.ClientErrors[2]
+	if mountErr.Client != "a" || mountErr.Count != 2 || mountErr.FirstSeen != 1 || mountErr.LastSeen != 2 || mountErr.Message != "second" {
+		t.Fatalf("%+v", mountErr)
+	}
+	if rec.ClientErrors[0].Class != "open" || rec.ClientErrors[1].Client != "b" {
+		t.Fatalf("%+v", rec.ClientErrors)
+	}
+	// The least recent errors are forgotten
+	for i := 0; i < MaxClientErrorsPerRecord; i++ {
+		rec.AddClientError(ClientError{Client: "c", Class: fmt.Sprintf("class%d", i), LastSeen: int64(10 + i)})
+	}
+	if len(rec.ClientErrors) != MaxClientErrorsPerRecord || rec.ClientErrors[MaxClientErrorsPerRecord-1].Class != "class0" {
+		t.Fatalf("%+v", rec.ClientErrors)
+	}
+}
+
+func TestRecord_JSONLeavesOutKey(t *testing.T) {
+	rec := Record{UUID: "a", Key: []byte("plain-key-content"), SealedKey: []byte("sealed-key-content"), MountPoint: "/a"}
+	content, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"plain-key", "sealed-key", "cGxhaW4ta2V5", "c2VhbGVkLWtleQ", `"Key"`, `"SealedKey"`} {
+		if strings.Contains(string(content), leaked) {
+			t.Fatal(string(content))
+		}
+	}
+	if !strings.Contains(string(content), `"MountPoint":"/a"`) {
+		t.Fatal(string(content))
+	}
+	// The record file still carries the key
+	var decoded Record
+	if err := decoded.Deserialise(rec.Serialise()); err != nil || string(decoded.Key) != "plain-key-content" {
+		t.Fatal(decoded, err)
+	}
 }
@@ -0,0 +1,104 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	RejectionNotAllowed   = "not-allowed"   // RejectionNotAllowed means the computer is not an allowed client of the record.
+	RejectionMaxActive    = "max-active"    // RejectionMaxActive means the record is already used by as many computers as it allows.
+	RejectionMaintenance  = "maintenance"   // RejectionMaintenance means the server was in maintenance mode.
+	RejectionUnlockWindow = "unlock-window" // RejectionUnlockWindow means none of the unlock windows of the record was open.
+	RejectionUnlockToken  = "unlock-token"  // RejectionUnlockToken means the unlock token was unknown, used, expired, or for another computer.
+	RejectionKeyForgotten = "key-forgotten" // RejectionKeyForgotten means the key of the record has been destroyed and only the record is kept.
+
+	MaxRejectionsPerRecord = 50 // MaxRejectionsPerRecord is the number of most recent rejections kept on a record.
+)
+
+// RejectionReasons are the reasons a key retrieval may be rejected for, in the order they are presented.
+var RejectionReasons = []string{RejectionNotAllowed, RejectionMaxActive, RejectionMaintenance, RejectionUnlockWindow, RejectionUnlockToken, RejectionKeyForgotten}
+
+// Rejection is a key retrieval of the record that the server refused.
+type Rejection struct {
+	Time     int64  `json:"time"`             // Time is the moment of rejection.
+	Event    string `json:"event"`            // Event is the request that was rejected, e.g. AutoRetrieveKey.
+	Hostname string `json:"hostname"`         // Hostname is the host name reported by the computer itself.
+	IP       string `json:"ip"`               // IP is the computer's IP as seen by cryptctl2 server.
+	Reason   string `json:"reason"`           // Reason is one of the Rejection* constants.
+	Detail   string `json:"detail,omitempty"` // Detail explains the rejection further, e.g. when the next unlock window opens.
+}
+
+// String returns the rejection in a line of text without its time.
+func (rej Rejection) String() string {
+	desc := fmt.Sprintf("%s (%s) %s: %s", rej.IP, rej.Hostname, rej.Event, rej.Reason)
+	if rej.Detail != "" {
+		desc += " - " + rej.Detail
+	}
+	return desc
+}
+
+/*
+AddRejection keeps the rejection on the record, the most recent first, and drops the oldest ones beyond
+MaxRejectionsPerRecord so that a computer retrying over and over does not grow the record without bound.
+*/
+func (rec *Record) AddRejection(rej Rejection) {
+	// Work on a copy, the slice may be shared by copies of the record.
+	limit := len(rec.Rejections) + 1
+	if limit > MaxRejectionsPerRecord {
+		limit = MaxRejectionsPerRecord
+	}
+	rejections := make([]Rejection, 0, limit)
+	rejections = append(rejections, rej)
+	rec.Rejections = append(rejections, rec.Rejections[:limit-1]...)
+}
+
+/*
+AddRejection keeps the rejection on the record in memory and counts it by its reason, the record file is written
+(without waiting for the disk) only if persist is true. Rejections of a record that does not exist are not counted.
+*/
+func (db *DB) AddRejection(uuid string, rej Rejection, persist bool) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return
+	}
+	if db.rejectionCounts == nil {
+		db.rejectionCounts = make(map[string]uint64)
+	}
+	db.rejectionCounts[rej.Reason]++
+	rec.AddRejection(rej)
+	if persist {
+		db.upsert(rec, false) // IO error is logged
+	} else {
+		db.RecordsByUUID[rec.UUID] = rec
+		db.RecordsByID[rec.ID] = rec
+	}
+}
+
+// RejectionCounts returns the number of rejections by reason since the database was opened, all reasons are present.
+func (db *DB) RejectionCounts() map[string]uint64 {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	counts := make(map[string]uint64, len(RejectionReasons))
+	for _, reason := range RejectionReasons {
+		counts[reason] = 0
+	}
+	for reason, count := range db.rejectionCounts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// SortedRejectionReasons returns the reasons of the counts sorted alphabetically.
+func SortedRejectionReasons(counts map[string]uint64) []string {
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
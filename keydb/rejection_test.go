@@ -0,0 +1,83 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRecord_AddRejection(t *testing.T) {
+	rec := Record{}
+	for i := 0; i < MaxRejectionsPerRecord+5; i++ {
+		rec.AddRejection(Rejection{Time: int64(i), Reason: RejectionMaxActive})
+	}
+	if len(rec.Rejections) != MaxRejectionsPerRecord || rec.Rejections[0].Time != MaxRejectionsPerRecord+4 || rec.Rejections[MaxRejectionsPerRecord-1].Time != 5 {
+		t.Fatal(len(rec.Rejections), rec.Rejections[0], rec.Rejections[len(rec.Rejections)-1])
+	}
+	// A copy of the record is not affected
+	copied := rec
+	rec.AddRejection(Rejection{Time: 100})
+	if copied.Rejections[0].Time != MaxRejectionsPerRecord+4 {
+		t.Fatal(copied.Rejections[0])
+	}
+	rej := Rejection{IP: "10.0.0.1", Hostname: "host1", Event: "AutoRetrieveKey", Reason: RejectionUnlockWindow, Detail: "next window opens at 22:00"}
+	if s := rej.String(); s != "10.0.0.1 (host1) AutoRetrieveKey: unlock-window - next window opens at 22:00" {
+		t.Fatal(s)
+	}
+}
+
+func TestDB_AddRejection(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte("key " + uuid), MountPoint: "/" + uuid, MaxActive: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := db.RejectionCounts(); len(counts) != len(RejectionReasons) || counts[RejectionNotAllowed] != 0 {
+		t.Fatal(counts)
+	}
+	// Rejections of an unknown record are neither kept nor counted
+	db.AddRejection("c", Rejection{Reason: RejectionNotAllowed}, true)
+	for i := 0; i < 3; i++ {
+		db.AddRejection("a", Rejection{Time: int64(i), IP: "10.0.0." + strconv.Itoa(i), Reason: RejectionNotAllowed}, true)
+	}
+	db.AddRejection("b", Rejection{Reason: RejectionMaintenance}, false)
+	expected := map[string]uint64{RejectionNotAllowed: 3, RejectionMaxActive: 0, RejectionMaintenance: 1, RejectionUnlockWindow: 0, RejectionUnlockToken: 0, RejectionKeyForgotten: 0}
+	if counts := db.RejectionCounts(); !reflect.DeepEqual(counts, expected) {
+		t.Fatal(counts)
+	}
+	if reasons := SortedRejectionReasons(expected); !reflect.DeepEqual(reasons, []string{"key-forgotten", "maintenance", "max-active", "not-allowed", "unlock-token", "unlock-window"}) {
+		t.Fatal(reasons)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Rejections) != 1 {
+		t.Fatal(rec.Rejections)
+	}
+	// Editing the record keeps the rejections, and they are not versioned
+	rec, _ := db.GetByUUID("a")
+	rec.Rejections = nil
+	rec.MountPoint = "/a2"
+	if saved, err := db.UpdateFields(rec, false); err != nil || len(saved.Rejections) != 3 || saved.Rejections[0].IP != "10.0.0.2" {
+		t.Fatal(saved.Rejections, err)
+	}
+	// Only persisted rejections survive reloading, the counters start over
+	if db, err = OpenDB(TestDBDir); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.Rejections) != 3 {
+		t.Fatal(rec.Rejections)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Rejections) != 0 {
+		t.Fatal(rec.Rejections)
+	}
+	if counts := db.RejectionCounts(); counts[RejectionNotAllowed] != 0 {
+		t.Fatal(counts)
+	}
+}
@@ -0,0 +1,74 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import "fmt"
+
+const (
+	DefaultMaxRetrievalsPerRecord = 100 // DefaultMaxRetrievalsPerRecord is the default number of most recent key retrievals kept on a record.
+)
+
+/*
+Retrieval is a decision the server made on a key retrieval of the record, granted or not. Unlike LastRetrieval, the
+retrievals are kept as a history, so that the computers that fetched the key over a period of time can be told after
+an incident.
+*/
+type Retrieval struct {
+	Time     int64  `json:"time"`             // Time is the moment of the decision.
+	Event    string `json:"event"`            // Event is the request, e.g. AutoRetrieveKey or ManualRetrieveKey.
+	Hostname string `json:"hostname"`         // Hostname is the host name reported by the computer itself.
+	IP       string `json:"ip"`               // IP is the computer's IP as seen by cryptctl2 server.
+	Granted  bool   `json:"granted"`          // Granted is true if the key was handed out.
+	Reason   string `json:"reason,omitempty"` // Reason explains why the key was not handed out.
+}
+
+// String returns the retrieval in a line of text without its time.
+func (ret Retrieval) String() string {
+	result := "granted"
+	if !ret.Granted {
+		result = "rejected"
+	}
+	desc := fmt.Sprintf("%s (%s) %s: %s", ret.IP, ret.Hostname, ret.Event, result)
+	if ret.Reason != "" {
+		desc += " - " + ret.Reason
+	}
+	return desc
+}
+
+/*
+AddRetrieval keeps the retrieval on the record, the most recent first, and drops the oldest ones beyond the limit so
+that the record file does not grow without bound. A limit below 1 keeps no retrievals at all.
+*/
+func (rec *Record) AddRetrieval(ret Retrieval, limit int) {
+	if limit < 1 {
+		rec.Retrievals = nil
+		return
+	}
+	// Work on a copy, the slice may be shared by copies of the record.
+	if len(rec.Retrievals)+1 < limit {
+		limit = len(rec.Retrievals) + 1
+	}
+	retrievals := make([]Retrieval, 0, limit)
+	retrievals = append(retrievals, ret)
+	rec.Retrievals = append(retrievals, rec.Retrievals[:limit-1]...)
+}
+
+/*
+AddRetrieval keeps the retrieval on the record in memory, the record file is written (without waiting for the disk)
+only if persist is true. Retrievals of a record that does not exist are ignored.
+*/
+func (db *DB) AddRetrieval(uuid string, ret Retrieval, limit int, persist bool) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return
+	}
+	rec.AddRetrieval(ret, limit)
+	if persist {
+		db.upsert(rec, false) // IO error is logged
+	} else {
+		db.RecordsByUUID[rec.UUID] = rec
+		db.RecordsByID[rec.ID] = rec
+	}
+}
@@ -0,0 +1,105 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"testing"
+)
+
+func TestRecord_AddRetrieval(t *testing.T) {
+	rec := Record{}
+	for i := 0; i < 15; i++ {
+		rec.AddRetrieval(Retrieval{Time: int64(i), Granted: true}, 10)
+	}
+	if len(rec.Retrievals) != 10 || rec.Retrievals[0].Time != 14 || rec.Retrievals[9].Time != 5 {
+		t.Fatal(len(rec.Retrievals), rec.Retrievals[0], rec.Retrievals[len(rec.Retrievals)-1])
+	}
+	// A copy of the record is not affected
+	copied := rec
+	rec.AddRetrieval(Retrieval{Time: 100}, 10)
+	if copied.Retrievals[0].Time != 14 || rec.Retrievals[0].Time != 100 {
+		t.Fatal(copied.Retrievals[0], rec.Retrievals[0])
+	}
+	// A smaller limit trims the oldest ones
+	rec.AddRetrieval(Retrieval{Time: 101}, 3)
+	if len(rec.Retrievals) != 3 || rec.Retrievals[2].Time != 14 {
+		t.Fatal(rec.Retrievals)
+	}
+	if rec.AddRetrieval(Retrieval{Time: 102}, 0); rec.Retrievals != nil {
+		t.Fatal(rec.Retrievals)
+	}
+	ret := Retrieval{IP: "10.0.0.1", Hostname: "host1", Event: "AutoRetrieveKey", Reason: "max-active"}
+	if s := ret.String(); s != "10.0.0.1 (host1) AutoRetrieveKey: rejected - max-active" {
+		t.Fatal(s)
+	}
+	ret = Retrieval{IP: "10.0.0.1", Hostname: "host1", Event: "ManualRetrieveKey", Granted: true}
+	if s := ret.String(); s != "10.0.0.1 (host1) ManualRetrieveKey: granted" {
+		t.Fatal(s)
+	}
+}
+
+func TestDB_AddRetrieval(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte("key " + uuid), MountPoint: "/" + uuid, MaxActive: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Retrievals of an unknown record are ignored
+	db.AddRetrieval("c", Retrieval{Granted: true}, 5, true)
+	for i := 0; i < 7; i++ {
+		db.AddRetrieval("a", Retrieval{Time: int64(i), Granted: i%2 == 0, Reason: "not-allowed"}, 5, true)
+	}
+	db.AddRetrieval("b", Retrieval{Granted: true}, 5, false)
+	// Editing the record keeps the retrievals, and they are not versioned
+	rec, _ := db.GetByUUID("a")
+	rec.Retrievals = nil
+	rec.MountPoint = "/a2"
+	if saved, err := db.UpdateFields(rec, false); err != nil || len(saved.Retrievals) != 5 || saved.Retrievals[0].Time != 6 {
+		t.Fatal(saved.Retrievals, err)
+	}
+	if versions, err := db.ListVersions("a"); err != nil || len(versions) == 0 || versions[len(versions)-1].Record.Retrievals != nil {
+		t.Fatal(versions, err)
+	}
+	// Only persisted retrievals survive reloading
+	if db, err = OpenDB(TestDBDir); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.Retrievals) != 5 || rec.Retrievals[0].Time != 6 || !rec.Retrievals[0].Granted || rec.Retrievals[4].Time != 2 {
+		t.Fatal(rec.Retrievals)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Retrievals) != 0 {
+		t.Fatal(rec.Retrievals)
+	}
+}
+
+func TestRetrievalRecordCompatibility(t *testing.T) {
+	// A record written without retrieval history loads without it
+	fixture, err := os.ReadFile("record_v3_test.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec Record
+	if err := rec.Deserialise(fixture); err != nil || len(rec.Retrievals) != 0 || rec.UUID == "" {
+		t.Fatal(rec, err)
+	}
+	// A record with retrieval history can be read by a version that does not know of it
+	rec.AddRetrieval(Retrieval{Time: 1, Granted: true, Hostname: "host1"}, DefaultMaxRetrievalsPerRecord)
+	type recordWithoutRetrievals struct {
+		UUID       string
+		MountPoint string
+		Key        []byte
+	}
+	var old recordWithoutRetrievals
+	if err := gob.NewDecoder(bytes.NewReader(rec.Serialise())).Decode(&old); err != nil || old.UUID != rec.UUID || old.MountPoint != rec.MountPoint {
+		t.Fatal(old, err)
+	}
+}
@@ -0,0 +1,98 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	KeyRotationCommand         = "rotate"           // KeyRotationCommand is the pending command that tells a computer to carry out the rotation of a record.
+	KeyRotationCommandValidity = 7 * 24 * time.Hour // KeyRotationCommandValidity is how long a computer has to carry out the rotation.
+)
+
+// ErrKeyRotationPending is returned if the key of a record is replaced while a rotation started by the server is not yet confirmed.
+var ErrKeyRotationPending = errors.New("a rotation of the encryption key is in progress and has not been confirmed by a computer yet")
+
+// Return the additional data that authenticates the sealed previous key, so that it cannot be swapped with the current key.
+func previousKeyAAD(uuid string) string {
+	return uuid + "/previous"
+}
+
+// IsKeyRotationPending returns true if the server has started a rotation of the key that no computer has confirmed yet.
+func (rec *Record) IsKeyRotationPending() bool {
+	return len(rec.PreviousKey) > 0
+}
+
+// Give the computer a rotate command while a rotation is pending, unless it already has one to carry out.
+func (rec *Record) queueKeyRotation(ip string, now time.Time) {
+	if !rec.IsKeyRotationPending() || ip == "" {
+		return
+	}
+	if rec.PendingCommands == nil {
+		rec.PendingCommands = make(map[string][]PendingCommand)
+	}
+	rec.AddPendingCommand(ip, PendingCommand{ValidFrom: now, Validity: KeyRotationCommandValidity, IP: ip, Content: KeyRotationCommand})
+}
+
+/*
+StartKeyRotation replaces the encryption key of the record by the new key and keeps the replaced key as PreviousKey,
+then gives a rotate command to each computer currently holding the disk. Until a computer confirms the rotation, the
+record hands out both keys, so that a computer can unlock the disk whichever of the two its encryption header carries,
+and each computer that retrieves the key receives a rotate command too. It returns the IPs of the computers holding the
+disk, which may be none.
+*/
+func (db *DB) StartKeyRotation(uuid string, newKey []byte) (holders []string, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return nil, fmt.Errorf("StartKeyRotation: record \"%s\" does not exist", uuid)
+	} else if len(rec.Key) == 0 {
+		return nil, fmt.Errorf("StartKeyRotation: record \"%s\" does not carry its encryption key", uuid)
+	} else if rec.IsKeyRotationPending() {
+		return nil, ErrKeyRotationPending
+	}
+	rec.PreviousKey = rec.Key
+	rec.Key = newKey
+	rec.RotationTime = time.Now()
+	holders = make([]string, 0, len(rec.AliveMessages))
+	for _, host := range rec.ListAliveHosts() {
+		rec.queueKeyRotation(host.IP, rec.RotationTime)
+		holders = append(holders, host.IP)
+	}
+	sort.Strings(holders)
+	if _, err := db.upsert(rec, true); err != nil {
+		return nil, fmt.Errorf("StartKeyRotation: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return holders, nil
+}
+
+/*
+ConfirmKeyRotation drops the previous key of the record once a computer has replaced it by the current key in the
+encryption header, the current key is given by its SHA-256 digest. Confirming a rotation that is no longer pending
+is not an error.
+*/
+func (db *DB) ConfirmKeyRotation(uuid string, keyDigest []byte) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return fmt.Errorf("ConfirmKeyRotation: record \"%s\" does not exist", uuid)
+	}
+	if digest := sha256.Sum256(rec.Key); !bytes.Equal(digest[:], keyDigest) {
+		return ErrKeyChanged
+	} else if !rec.IsKeyRotationPending() {
+		return nil
+	}
+	rec.PreviousKey = nil
+	if _, err := db.upsert(rec, true); err != nil {
+		return fmt.Errorf("ConfirmKeyRotation: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Return the rotate commands of the record by IP.
+func rotateCommands(rec Record) map[string]int {
+	cmds := make(map[string]int)
+	for ip, ipCmds := range rec.PendingCommands {
+		for _, cmd := range ipCmds {
+			if cmd.Content == KeyRotationCommand {
+				cmds[ip]++
+			}
+		}
+	}
+	return cmds
+}
+
+func TestDB_KeyRotation(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDBWithMasterKey(TestDBDir, bytes.Repeat([]byte{7}, MasterKeyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	rec := Record{UUID: "a", Key: []byte("old key"), AliveIntervalSec: 10, AliveCount: 4, AliveMessages: map[string][]AliveMessage{
+		"10.0.0.1": {{IP: "10.0.0.1", Timestamp: now}},
+		"10.0.0.2": {{IP: "10.0.0.2", Timestamp: now}},
+		"10.0.0.9": {{IP: "10.0.0.9", Timestamp: now - 3600}},
+	}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.StartKeyRotation("doesnotexist", []byte("new key")); err == nil {
+		t.Fatal("did not error")
+	}
+	// Each computer holding the disk is told to rotate
+	holders, err := db.StartKeyRotation("a", []byte("new key"))
+	if err != nil || !reflect.DeepEqual(holders, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatal(holders, err)
+	}
+	if _, err := db.StartKeyRotation("a", []byte("newer key")); err != ErrKeyRotationPending {
+		t.Fatal(err)
+	}
+	oldDigest := sha256.Sum256([]byte("old key"))
+	if err := db.UpdateKey("a", oldDigest[:], []byte("client key")); err != ErrKeyChanged {
+		t.Fatal(err)
+	}
+	newDigest := sha256.Sum256([]byte("new key"))
+	if err := db.UpdateKey("a", newDigest[:], []byte("client key")); err != ErrKeyRotationPending {
+		t.Fatal(err)
+	}
+	// Both keys are encrypted on disk and survive a reload
+	content, err := ioutil.ReadFile(path.Join(TestDBDir, "a"))
+	if err != nil || bytes.Contains(content, []byte("old key")) || bytes.Contains(content, []byte("new key")) {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	rotating, _ := db.GetByUUID("a")
+	if string(rotating.Key) != "new key" || string(rotating.PreviousKey) != "old key" || rotating.RotationTime.IsZero() ||
+		!reflect.DeepEqual(rotateCommands(rotating), map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}) {
+		t.Fatalf("%+v", rotating)
+	}
+	if listed := db.List(); len(listed) != 1 || listed[0].PreviousKey != nil {
+		t.Fatalf("%+v", listed)
+	}
+	// A computer retrieving the key during the rotation receives both keys and a rotate command, once
+	for i := 0; i < 2; i++ {
+		found, rejected, _ := db.Select(AliveMessage{IP: "10.0.0.3", Timestamp: time.Now().Unix()}, true, "", "10.0.0.3", "a")
+		if len(rejected) != 0 || string(found["a"].Key) != "new key" || string(found["a"].PreviousKey) != "old key" {
+			t.Fatal(found, rejected)
+		}
+	}
+	rotating, _ = db.GetByUUID("a")
+	if cmds := rotateCommands(rotating); cmds["10.0.0.3"] != 1 {
+		t.Fatal(cmds)
+	}
+	// The rotation is confirmed by the digest of the new key
+	if err := db.ConfirmKeyRotation("a", oldDigest[:]); err != ErrKeyChanged {
+		t.Fatal(err)
+	}
+	if err := db.ConfirmKeyRotation("a", newDigest[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ConfirmKeyRotation("a", newDigest[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := db.GetByUUID("a")
+	if string(rotated.Key) != "new key" || rotated.IsKeyRotationPending() {
+		t.Fatalf("%+v", rotated)
+	}
+	// Computers retrieving the key afterwards are not told to rotate
+	db.Select(AliveMessage{IP: "10.0.0.4", Timestamp: time.Now().Unix()}, true, "", "10.0.0.4", "a")
+	rotated, _ = db.GetByUUID("a")
+	if cmds := rotateCommands(rotated); cmds["10.0.0.4"] != 0 {
+		t.Fatal(cmds)
+	}
+	if err := db.UpdateKey("a", newDigest[:], []byte("client key")); err != nil {
+		t.Fatal(err)
+	}
+}
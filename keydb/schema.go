@@ -0,0 +1,137 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// ErrRecordReadOnly is returned when a record that is served read-only would be written, see DB.ReadOnlyRecords.
+var ErrRecordReadOnly = errors.New("the record is read-only, it was written by a newer version of cryptctl2 or needs migrate-keydb to be upgraded")
+
+/*
+recordMigration upgrades a record loaded from disk by one version, in memory. It returns true if the upgraded record
+must be written right away rather than by its next change.
+*/
+type recordMigration func(db *DB, rec *Record) (persist bool)
+
+// recordMigrations upgrade a record from the version of its index to the next version.
+var recordMigrations = []recordMigration{
+	0: func(db *DB, rec *Record) bool {
+		/*
+			Version 0 was the first version prior and equal to cryptctl2 1.99 pre-release. Version 1 gives each record
+			a sequence number as KMIP key ID, which must not change once assigned, hence the record is written right
+			away.
+		*/
+		if rec.ID == "" {
+			db.LastSequenceNum++
+			rec.ID = strconv.FormatInt(db.LastSequenceNum, 10)
+		}
+		return true
+	},
+	1: func(db *DB, rec *Record) bool {
+		// Version 2 brings PendingCommands map
+		if rec.PendingCommands == nil {
+			rec.PendingCommands = make(map[string][]PendingCommand)
+		}
+		return false
+	},
+	2: func(db *DB, rec *Record) bool {
+		// Version 3 brings allowed clients, mapped name, and automatic encryption, which older records go without.
+		return false
+	},
+}
+
+/*
+UpgradeRecord brings a record loaded from disk up to the current version in memory and places it in the database. The
+record file keeps its version until the record is changed next time or migrate-keydb rewrites it, unless a migration
+asks for it to be written right away. Records of a newer version than this one are served as they are but never
+written, so that a server not yet upgraded keeps working during a staged upgrade; fields it does not know of are left
+out when the record is decoded. Caller must hold the database lock.
+*/
+func (db *DB) UpgradeRecord(record Record) error {
+	return db.upgradeRecord(record, true)
+}
+
+/*
+Upgrade the record and place it in the database. If persisting a migration is not allowed, e.g. as the database only
+holds a single record and cannot assign sequence numbers, the record is served read-only instead.
+*/
+func (db *DB) upgradeRecord(record Record, canPersist bool) error {
+	if record.Version > CurrentRecordVersion {
+		log.Printf("DB.UpgradeRecord: record \"%s\" is of version %d written by a newer cryptctl2 (this one writes version %d), it is served read-only",
+			record.UUID, record.Version, CurrentRecordVersion)
+		db.markReadOnly(record)
+		return nil
+	}
+	if record.Version < 0 {
+		return fmt.Errorf("DB.UpgradeRecord: record \"%s\" has an invalid version %d", record.UUID, record.Version)
+	}
+	if record.Version == 0 && !canPersist {
+		// Assigning a sequence number requires the whole database
+		db.markReadOnly(record)
+		return nil
+	}
+	loadedVersion, persist := record.Version, false
+	for record.Version < CurrentRecordVersion {
+		if recordMigrations[record.Version](db, &record) {
+			persist = true
+		}
+		record.Version++
+	}
+	record.FillBlanks()
+	if persist {
+		if _, err := db.upsert(record, true); err != nil {
+			return err
+		}
+		log.Printf("DB.UpgradeRecord: upgraded record \"%s\" from version %d and saved it", record.UUID, loadedVersion)
+		return nil
+	}
+	db.RecordsByUUID[record.UUID] = record
+	db.RecordsByID[record.ID] = record
+	return nil
+}
+
+// Place the record in the database as it is, it is never written. Caller must hold the database lock.
+func (db *DB) markReadOnly(record Record) {
+	if db.readOnly == nil {
+		db.readOnly = make(map[string]int)
+	}
+	db.readOnly[record.UUID] = record.Version
+	db.RecordsByUUID[record.UUID] = record
+	db.RecordsByID[record.ID] = record
+}
+
+// ReadOnlyRecords returns the UUIDs and on-disk versions of the records that are served read-only.
+func (db *DB) ReadOnlyRecords() map[string]int {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	ret := make(map[string]int, len(db.readOnly))
+	for uuid, version := range db.readOnly {
+		ret[uuid] = version
+	}
+	return ret
+}
+
+/*
+RewriteRecords writes every record file at the current record version, so that the records upgraded in memory no longer
+depend on the migrations. The records that are served read-only are left as they are. Return the number of records
+rewritten.
+*/
+func (db *DB) RewriteRecords() (rewritten int, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for uuid, rec := range db.RecordsByUUID {
+		if _, readOnly := db.readOnly[uuid]; readOnly {
+			continue
+		}
+		if _, err := db.upsert(rec, true); err != nil {
+			return rewritten, fmt.Errorf("RewriteRecords: %v", err)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,170 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// The record files written by each historical version of cryptctl2, named after the UUID of the record they carry.
+var recordFixtures = map[string]string{
+	"rec-v0":     "record_v0_test.gob",
+	"rec-v1":     "record_v1_test.gob",
+	"rec-v2":     "record_v2_test.gob",
+	"rec-v3":     "record_v3_test.gob",
+	"rec-future": "record_future_test.gob",
+}
+
+// Copy the record fixtures into a fresh database directory.
+func copyRecordFixtures(t *testing.T) {
+	os.RemoveAll(TestDBDir)
+	if err := os.MkdirAll(TestDBDir, DB_DIR_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+	for uuid, fixture := range recordFixtures {
+		content, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(TestDBDir, uuid), content, DB_REC_FILE_MODE); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Return the version of the record file on disk.
+func versionOnDisk(t *testing.T, db *DB, uuid string) int {
+	rec, err := db.ReadRecord(path.Join(db.Dir, uuid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Version
+}
+
+func TestRecordMigrations(t *testing.T) {
+	if len(recordMigrations) != CurrentRecordVersion {
+		t.Fatalf("there are %d migrations for record version %d", len(recordMigrations), CurrentRecordVersion)
+	}
+	for version, migration := range recordMigrations {
+		if migration == nil {
+			t.Fatal("missing migration from version", version)
+		}
+	}
+}
+
+func TestDB_LoadHistoricalRecords(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	copyRecordFixtures(t)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.RecordsByUUID) != len(recordFixtures) || len(db.LoadErrors) != 0 {
+		t.Fatal(db.RecordsByUUID, db.LoadErrors)
+	}
+	for uuid := range recordFixtures {
+		rec, found := db.GetByUUID(uuid)
+		if !found || string(rec.Key) == "" || rec.MountPoint == "" || len(rec.AliveMessages["10.0.0.1"]) != 1 {
+			t.Fatalf("%s: %+v", uuid, rec)
+		}
+	}
+	// Old records are upgraded in memory
+	for _, uuid := range []string{"rec-v0", "rec-v1", "rec-v2", "rec-v3"} {
+		if rec, _ := db.GetByUUID(uuid); rec.Version != CurrentRecordVersion || rec.PendingCommands == nil {
+			t.Fatalf("%s: %+v", uuid, rec)
+		}
+	}
+	if rec, _ := db.GetByUUID("rec-v2"); len(rec.PendingCommands["10.0.0.1"]) != 1 || rec.PendingCommands["10.0.0.1"][0].Content != "umount" {
+		t.Fatal(rec.PendingCommands)
+	}
+	if rec, _ := db.GetByUUID("rec-v3"); !rec.AutoEncryption || rec.FileSystem != "xfs" || len(rec.AllowedClients) != 1 {
+		t.Fatalf("%+v", rec)
+	}
+	// A record of version 0 gets the next sequence number and is written right away, the others by their next change
+	if rec, _ := db.GetByUUID("rec-v0"); rec.ID != "11" {
+		t.Fatal(rec.ID)
+	}
+	if v0, v1 := versionOnDisk(t, db, "rec-v0"), versionOnDisk(t, db, "rec-v1"); v0 != CurrentRecordVersion || v1 != 1 {
+		t.Fatal(v0, v1)
+	}
+	rec, _ := db.GetByUUID("rec-v1")
+	rec.MountPoint = "/v1-edited"
+	if _, err := db.Upsert(rec); err != nil || versionOnDisk(t, db, "rec-v1") != CurrentRecordVersion {
+		t.Fatal(err)
+	}
+	// A record of a newer version is served, but never written
+	future, _ := db.GetByUUID("rec-future")
+	if future.Version != 99 || future.Owner != "storage-team" || string(future.Key) != "key-of-future-version" {
+		t.Fatalf("%+v", future)
+	}
+	if readOnly := db.ReadOnlyRecords(); len(readOnly) != 1 || readOnly["rec-future"] != 99 {
+		t.Fatal(readOnly)
+	}
+	futureContent, _ := ioutil.ReadFile(path.Join(TestDBDir, "rec-future"))
+	if _, err := db.Upsert(future); err == nil {
+		t.Fatal("did not error")
+	}
+	db.UpdateAliveMessage(AliveMessage{IP: "10.0.0.1", Timestamp: 1}, "rec-future")
+	if inMem, _ := db.GetByUUID("rec-future"); len(inMem.AliveMessages["10.0.0.1"]) != 2 {
+		t.Fatalf("%+v", inMem)
+	}
+	if found, rejected, _ := db.Select(AliveMessage{IP: "10.0.0.2", Timestamp: 2}, false, "", "", "rec-future"); len(found) != 1 || len(rejected) != 0 {
+		t.Fatal(found, rejected)
+	}
+	if inMem, _ := db.GetByUUID("rec-future"); inMem.LastRetrieval.IP != "10.0.0.2" {
+		t.Fatalf("%+v", inMem)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(TestDBDir, "rec-future")); !bytes.Equal(content, futureContent) {
+		t.Fatal("read-only record was written")
+	}
+	// Rewriting the database brings all but the newer record to the current version
+	if rewritten, err := db.RewriteRecords(); err != nil || rewritten != 4 {
+		t.Fatal(rewritten, err)
+	}
+	for _, uuid := range []string{"rec-v0", "rec-v1", "rec-v2", "rec-v3"} {
+		if version := versionOnDisk(t, db, uuid); version != CurrentRecordVersion {
+			t.Fatal(uuid, version)
+		}
+	}
+	if content, _ := ioutil.ReadFile(path.Join(TestDBDir, "rec-future")); !bytes.Equal(content, futureContent) {
+		t.Fatal("read-only record was written")
+	}
+	// Erasing a read-only record is still possible
+	if err := db.Erase("rec-future"); err != nil || len(db.ReadOnlyRecords()) != 0 {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenDBOneRecord_Historical(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	copyRecordFixtures(t)
+	db, err := OpenDBOneRecord(TestDBDir, "rec-v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, found := db.GetByUUID("rec-v1"); !found || rec.Version != CurrentRecordVersion || rec.PendingCommands == nil || len(db.ReadOnlyRecords()) != 0 {
+		t.Fatalf("%+v", rec)
+	}
+	// The sequence number of a record of version 0 can only be assigned with the whole database at hand
+	db, err = OpenDBOneRecord(TestDBDir, "rec-v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, found := db.GetByUUID("rec-v0"); !found || rec.ID != "" || db.ReadOnlyRecords()["rec-v0"] != 0 || len(db.ReadOnlyRecords()) != 1 {
+		t.Fatalf("%+v", rec)
+	}
+	if versionOnDisk(t, db, "rec-v0") != 0 {
+		t.Fatal("record was written")
+	}
+	db, err = OpenDBOneRecord(TestDBDir, "rec-future")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, found := db.GetByUUID("rec-future"); !found || rec.Version != 99 || db.ReadOnlyRecords()["rec-future"] != 99 {
+		t.Fatalf("%+v", rec)
+	}
+}
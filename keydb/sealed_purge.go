@@ -0,0 +1,147 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/sys"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	SealedPurgesFileName = "purges.json"  // SealedPurgesFileName is the file in database directory that stores the purge commands of erased records.
+	PurgeSealedCommand   = "purge-sealed" // PurgeSealedCommand is the pending command that tells a computer to remove the TPM-sealed copy of a record.
+	SealedPurgeValidity  = 30 * 24 * time.Hour
+)
+
+/*
+Return the purge commands for the computers that may keep a TPM-sealed copy of the record, which are those reporting
+alive and the one that retrieved the key most recently. A sealed copy that expires sooner than SealedPurgeValidity
+does not need the command for longer.
+*/
+func sealedPurgesOf(rec Record, now time.Time) map[string]PendingCommand {
+	validity := SealedPurgeValidity
+	if maxAge := time.Duration(rec.SealMaxHours) * time.Hour; rec.SealMaxHours > 0 && maxAge < validity {
+		validity = maxAge
+	}
+	purges := make(map[string]PendingCommand)
+	addHost := func(ip string) {
+		if _, exists := purges[ip]; ip != "" && !exists {
+			purges[ip] = PendingCommand{ValidFrom: now, Validity: validity, IP: ip, Content: PurgeSealedCommand, ID: NewPendingCommandID()}
+		}
+	}
+	for ip := range rec.AliveMessages {
+		addHost(ip)
+	}
+	addHost(rec.LastRetrieval.IP)
+	return purges
+}
+
+// Return the path of the file that stores the purge commands of erased records.
+func (db *DB) sealedPurgesPath() string {
+	return path.Join(db.Dir, SealedPurgesFileName)
+}
+
+/*
+Read the purge commands of erased records from database directory, a database that never erased a record does not
+have the file. Caller must hold the lock. If the file cannot be read, the commands are lost, the sealed copies then
+remain usable until they expire.
+*/
+func (db *DB) loadSealedPurges() {
+	db.SealedPurges = make(map[string]map[string]PendingCommand)
+	content, err := ioutil.ReadFile(db.sealedPurgesPath())
+	if os.IsNotExist(err) {
+		return
+	} else if err == nil {
+		err = json.Unmarshal(content, &db.SealedPurges)
+	}
+	if err != nil {
+		log.Printf("DB.loadSealedPurges: failed to read purge commands of erased records, computers are not told to remove their sealed copies - %v", err)
+		db.SealedPurges = make(map[string]map[string]PendingCommand)
+	}
+}
+
+// Save the purge commands of erased records into database directory after leaving out the expired ones. Caller must hold the lock.
+func (db *DB) saveSealedPurges(purges map[string]map[string]PendingCommand) error {
+	now := time.Now()
+	kept := make(map[string]map[string]PendingCommand, len(purges))
+	for uuid, cmds := range purges {
+		for ip, cmd := range cmds {
+			if cmd.IsValidAt(now) {
+				if _, exists := kept[uuid]; !exists {
+					kept[uuid] = make(map[string]PendingCommand)
+				}
+				kept[uuid][ip] = cmd
+			}
+		}
+	}
+	content, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return fmt.Errorf("DB.saveSealedPurges: failed to encode purge commands - %v", err)
+	}
+	if err := sys.ReplaceFile(db.sealedPurgesPath(), content, DB_REC_FILE_MODE, true); err != nil {
+		return fmt.Errorf("DB.saveSealedPurges: failed to save purge commands - %v", err)
+	}
+	db.SealedPurges = kept
+	return nil
+}
+
+// Return a copy of the purge commands of erased records, to be changed and saved. Caller must hold the lock.
+func (db *DB) copySealedPurges() map[string]map[string]PendingCommand {
+	purges := make(map[string]map[string]PendingCommand, len(db.SealedPurges)+1)
+	for uuid, cmds := range db.SealedPurges {
+		purges[uuid] = make(map[string]PendingCommand, len(cmds))
+		for ip, cmd := range cmds {
+			purges[uuid][ip] = cmd
+		}
+	}
+	return purges
+}
+
+/*
+PollSealedPurge returns the purge command of the erased record for the computer if it has not yet seen the command,
+and marks the command as seen.
+*/
+func (db *DB) PollSealedPurge(uuid, ip string, now time.Time) (cmd PendingCommand, found bool) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	cmd, found = db.SealedPurges[CanonicalRecordID(uuid)][ip]
+	if !found || cmd.SeenByClient || !cmd.IsValidAt(now) {
+		return PendingCommand{}, false
+	}
+	purges := db.copySealedPurges()
+	seen := cmd
+	seen.SeenByClient = true
+	purges[CanonicalRecordID(uuid)][ip] = seen
+	if err := db.saveSealedPurges(purges); err != nil {
+		log.Printf("DB.PollSealedPurge: %v", err)
+	}
+	return cmd, true
+}
+
+/*
+SetSealedPurgeResult saves the outcome of the purge command of the erased record, the command is removed once the
+computer has carried it out. Return false if the computer does not have the command.
+*/
+func (db *DB) SetSealedPurgeResult(uuid, ip, id string, succeeded bool) bool {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	cmd, found := db.SealedPurges[CanonicalRecordID(uuid)][ip]
+	if !found || (id != "" && cmd.ID != id) {
+		return false
+	}
+	if !succeeded {
+		return true
+	}
+	purges := db.copySealedPurges()
+	delete(purges[CanonicalRecordID(uuid)], ip)
+	if err := db.saveSealedPurges(purges); err != nil {
+		log.Printf("DB.SetSealedPurgeResult: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDB_SealedPurges(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rec := Record{UUID: "a", Key: []byte{1}, AliveIntervalSec: 1, AliveCount: 4, SealToTPM: true, SealMaxHours: 2,
+		LastRetrieval: AliveMessage{IP: "10.0.0.2", Timestamp: now.Unix()},
+		AliveMessages: map[string][]AliveMessage{"10.0.0.1": {{IP: "10.0.0.1", Timestamp: now.Unix()}}}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{UUID: "b", Key: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Erase("a"); err != nil {
+		t.Fatal(err)
+	}
+	// A record that nobody used does not leave purge commands behind
+	if err := db.Erase("b"); err != nil {
+		t.Fatal(err)
+	}
+	// The purge file is not mistaken for a record
+	if db, err = OpenDB(TestDBDir); err != nil || len(db.LoadErrors) != 0 || len(db.RecordsByUUID) != 0 {
+		t.Fatal(db.LoadErrors, err)
+	}
+	if len(db.SealedPurges) != 1 || len(db.SealedPurges["a"]) != 2 {
+		t.Fatal(db.SealedPurges)
+	}
+	// The command lasts as long as the sealed copy may be used
+	cmd, found := db.PollSealedPurge("a", "10.0.0.1", now)
+	if !found || cmd.Content != PurgeSealedCommand || cmd.Validity != 2*time.Hour || cmd.SeenByClient {
+		t.Fatalf("%+v", cmd)
+	}
+	if _, found := db.PollSealedPurge("a", "10.0.0.1", now); found {
+		t.Fatal("delivered twice")
+	}
+	if _, found := db.PollSealedPurge("a", "10.0.0.2", now.Add(3*time.Hour)); found {
+		t.Fatal("delivered an expired command")
+	}
+	if _, found := db.PollSealedPurge("b", "10.0.0.1", now); found {
+		t.Fatal("wrong record")
+	}
+	if db.SetSealedPurgeResult("a", "10.0.0.1", "wrong-id", true) || db.SetSealedPurgeResult("a", "10.0.0.3", "", true) {
+		t.Fatal("wrong command")
+	}
+	if !db.SetSealedPurgeResult("a", "10.0.0.1", cmd.ID, false) {
+		t.Fatal("did not find the command")
+	}
+	if !db.SetSealedPurgeResult("a", "10.0.0.1", cmd.ID, true) || db.SetSealedPurgeResult("a", "10.0.0.1", cmd.ID, true) {
+		t.Fatal("did not remove the command")
+	}
+	if err := db.ReloadDB(); err != nil || len(db.SealedPurges["a"]) != 1 {
+		t.Fatal(db.SealedPurges, err)
+	}
+	if cmd := db.SealedPurges["a"]["10.0.0.2"]; !cmd.IsValidAt(now) || cmd.SeenByClient {
+		t.Fatalf("%+v", cmd)
+	}
+	// A damaged purge file does not stop the database from being loaded
+	if err := ioutil.WriteFile(path.Join(TestDBDir, SealedPurgesFileName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil || len(db.SealedPurges) != 0 {
+		t.Fatal(db.SealedPurges, err)
+	}
+}
@@ -0,0 +1,176 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/fs"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	MaxSuggestions            = 3 // MaxSuggestions is the number of similar records suggested for a record that is not found.
+	suggestionMinCommonPrefix = 8 // suggestionMinCommonPrefix is the number of leading hex digits a similar record ID has in common.
+	suggestionMaxDistance     = 2 // suggestionMaxDistance is the number of typing mistakes a similar record ID may be away.
+)
+
+var (
+	// RegexFSUUID matches the file system UUIDs that identify records: the usual form, and those of FAT and NTFS.
+	RegexFSUUID = regexp.MustCompile(`^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{4}-[0-9a-fA-F]{4}|[0-9a-fA-F]{16})$`)
+	// RegexPartitionID matches partition and partition table identifiers, either a UUID or an MBR signature such as "1a2b3c4d-01".
+	RegexPartitionID = regexp.MustCompile(`^[0-9a-fA-F][0-9a-fA-F-]*$`)
+)
+
+/*
+ValidateDeviceID returns an error if the device ID given by the administrator is neither a file system UUID (with or
+without the "UUID:" prefix) nor one of the other supported device IDs: "SERIAL:", "LABEL:", "PATH:", "PTUUID:", or
+"PARTUUID:" followed by a value.
+*/
+func ValidateDeviceID(id string) error {
+	if id == "" {
+		return fmt.Errorf("Device ID must not be empty")
+	}
+	prefix, value := fs.SplitDeviceID(id)
+	valid := false
+	switch prefix {
+	case fs.DeviceIDUUID:
+		valid = RegexFSUUID.MatchString(value)
+	case fs.DeviceIDPTUUID, fs.DeviceIDPARTUUID:
+		valid = RegexPartitionID.MatchString(value)
+	case fs.DeviceIDPath:
+		valid = strings.HasPrefix(value, "/")
+	case fs.DeviceIDSerial, fs.DeviceIDLabel:
+		valid = strings.TrimSpace(value) != ""
+	}
+	if !valid {
+		return fmt.Errorf("\"%s\" is neither a UUID nor a device ID in the form of SERIAL:, LABEL:, PATH:, PTUUID:, or PARTUUID: followed by its value", id)
+	}
+	return nil
+}
+
+// Return the number of single-character insertions, deletions, and substitutions turning one string into the other.
+func levenshtein(a, b string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Return the number of hex digits in the prefix the two IDs have in common, dashes do not count.
+func commonHexPrefix(a, b string) (digits int) {
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		if c := a[i]; (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') {
+			digits++
+		} else if c != '-' {
+			break
+		}
+	}
+	return
+}
+
+/*
+SuggestRecords returns the UUIDs of records that are similar to the ID that cannot be found, most similar first: those
+sharing a prefix of at least 8 hex digits, or a couple of typing mistakes away. Only the records the visible function
+accepts are suggested, e.g. those a client may use. If visible is nil, the caller may see all records, and the record
+files in the database directory are considered too, so that a database holding only one record still makes
+suggestions.
+*/
+func (db *DB) SuggestRecords(id string, visible func(Record) bool) []string {
+	id = strings.ToLower(CanonicalRecordID(id))
+	db.Lock.RLock()
+	recs := make([]Record, 0, len(db.RecordsByUUID))
+	for _, rec := range db.RecordsByUUID {
+		recs = append(recs, rec)
+	}
+	db.Lock.RUnlock()
+	uuids := make(map[string]bool)
+	for _, rec := range recs {
+		if visible == nil || visible(rec) {
+			uuids[rec.UUID] = true
+		}
+	}
+	if visible == nil {
+		if files, err := ioutil.ReadDir(db.Dir); err == nil {
+			for _, file := range files {
+				if !file.IsDir() && !isNotRecordFile(file.Name()) {
+					uuids[file.Name()] = true
+				}
+			}
+		}
+	}
+	type match struct {
+		uuid     string
+		distance int
+	}
+	matches := make([]match, 0, MaxSuggestions)
+	for uuid := range uuids {
+		candidate := strings.ToLower(uuid)
+		if candidate == id {
+			continue
+		}
+		// IDs of rather different lengths are surely more than a couple of mistakes away
+		distance := suggestionMaxDistance + 1
+		if diff := len(id) - len(candidate); diff >= -suggestionMaxDistance && diff <= suggestionMaxDistance {
+			distance = levenshtein(id, candidate)
+		}
+		if distance <= suggestionMaxDistance || commonHexPrefix(id, candidate) >= suggestionMinCommonPrefix {
+			matches = append(matches, match{uuid, distance})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].uuid < matches[j].uuid
+	})
+	suggestions := make([]string, 0, MaxSuggestions)
+	for i := 0; i < len(matches) && i < MaxSuggestions; i++ {
+		suggestions = append(suggestions, matches[i].uuid)
+	}
+	return suggestions
+}
+
+// DidYouMean phrases the suggested record UUIDs as the end of an error message, it is empty if there is no suggestion.
+func DidYouMean(suggestions []string) string {
+	if len(suggestions) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", strings.Join(suggestions, " or "))
+}
+
+// RecordNotFoundError is the error of a record that cannot be found, it carries the similar records to suggest.
+type RecordNotFoundError struct {
+	ID          string   // ID is the record ID that was asked for.
+	Suggestions []string // Suggestions are the UUIDs of similar records, see SuggestRecords.
+}
+
+func (err RecordNotFoundError) Error() string {
+	return fmt.Sprintf("Cannot find record for UUID %s%s", err.ID, DidYouMean(err.Suggestions))
+}
+
+// NotFoundError returns the error of a record that cannot be found, along with the suggestions of SuggestRecords.
+func (db *DB) NotFoundError(id string, visible func(Record) bool) error {
+	return RecordNotFoundError{ID: id, Suggestions: db.SuggestRecords(id, visible)}
+}
@@ -0,0 +1,71 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateDeviceID(t *testing.T) {
+	for _, id := range []string{"6f5d1a36-6d5c-4a4f-8e3b-0c6d2b2e5f10", "UUID:6F5D1A36-6D5C-4A4F-8E3B-0C6D2B2E5F10", "ABCD-1234",
+		"0123456789abcdef", "SERIAL:WD-WCC4N5XYZ", "LABEL:my data", "PATH:/dev/disk/by-id/ata-x", "PARTUUID:1a2b3c4d-01",
+		"PTUUID:1a2b3c4d"} {
+		if err := ValidateDeviceID(id); err != nil {
+			t.Fatal(id, err)
+		}
+	}
+	for _, id := range []string{"", "6f5d1a36-6d5c-4a4f-8e3b-0c6d2b2e5f1", "6f5d1a36", "SERAIL:WD-WCC4N5XYZ", "SERIAL:", "PATH:dev/sda",
+		"PARTUUID:xyz", "UUID:../etc/passwd"} {
+		if err := ValidateDeviceID(id); err == nil {
+			t.Fatal("did not error", id)
+		}
+	}
+}
+
+func TestSuggestRecords(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := []string{"6f5d1a36-6d5c-4a4f-8e3b-0c6d2b2e5f10", "6f5d1a36-0000-4a4f-8e3b-0c6d2b2e5f10", "0c6d2b2e-6d5c-4a4f-8e3b-6f5d1a365f10"}
+	for _, uuid := range uuids {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte("key"), MountPoint: "/a", AllowedClients: []string{"host-" + uuid[:4]}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A typing mistake comes first, then the common prefix
+	typo := "6f5d1a36-6d5c-4a4f-8e3b-0c6d2b2e5f1O"
+	if suggestions := db.SuggestRecords(typo, nil); !reflect.DeepEqual(suggestions, uuids[:2]) {
+		t.Fatal(suggestions)
+	}
+	if suggestions := db.SuggestRecords("UUID:"+strings.ToUpper(uuids[0][:8])+"-ffff-ffff-ffff-ffffffffffff", nil); len(suggestions) != 2 ||
+		suggestions[0] == uuids[2] || suggestions[1] == uuids[2] {
+		t.Fatal(suggestions)
+	}
+	if suggestions := db.SuggestRecords("11111111-2222-3333-4444-555555555555", nil); len(suggestions) != 0 {
+		t.Fatal(suggestions)
+	}
+	// Records the client may not use are never suggested
+	visible := func(rec Record) bool { return db.IsClientAllowed(rec, "host-6f5d", "") }
+	if suggestions := db.SuggestRecords(typo, visible); !reflect.DeepEqual(suggestions, uuids[:2]) {
+		t.Fatal(suggestions)
+	}
+	visible = func(rec Record) bool { return db.IsClientAllowed(rec, "host-0c6d", "") }
+	if suggestions := db.SuggestRecords(typo, visible); len(suggestions) != 0 {
+		t.Fatal(suggestions)
+	}
+	// Opening one record that does not exist suggests the other record files, without revealing the directory
+	_, err = OpenDBOneRecord(TestDBDir, "UUID:"+typo)
+	if notFound, ok := err.(RecordNotFoundError); !ok || !reflect.DeepEqual(notFound.Suggestions, uuids[:2]) ||
+		strings.Contains(err.Error(), TestDBDir) || !strings.Contains(err.Error(), "did you mean "+uuids[0]+" or "+uuids[1]) {
+		t.Fatal(err)
+	}
+	if _, err := OpenDBOneRecord(TestDBDir, "UUID:"+uuids[2]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,215 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways to sort the records listed by list-keys.
+const (
+	SortByLastRetrieval = "last-retrieval" // SortByLastRetrieval puts the most recently retrieved records first.
+	SortByUUID          = "uuid"           // SortByUUID sorts records by UUID in ascending order.
+	SortByMountPoint    = "mountpoint"     // SortByMountPoint sorts records by mount point in ascending order.
+	SortByActive        = "active"         // SortByActive puts the records used by the most computers first, then by last retrieval.
+	SortByLastAccess    = "lastaccess"     // SortByLastAccess is another name of SortByLastRetrieval.
+)
+
+var RegexTagName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`) // RegexTagName matches the valid names of record tags.
+
+/*
+ParseTags parses tags separated by comma or space in the format of "name=value", such as "cluster=ceph-prod". A value
+may be empty but must not contain comma or space.
+*/
+func ParseTags(in string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, field := range strings.FieldsFunc(in, func(r rune) bool { return r == ',' || r == ' ' }) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || !RegexTagName.MatchString(parts[0]) {
+			return nil, fmt.Errorf("Tag \"%s\" must be in the format of name=value, the name may consist of letters, digits, and _.-", field)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// Return an error if any tag has an invalid name or value.
+func (rec *Record) ValidateTags() error {
+	for name, value := range rec.Tags {
+		if !RegexTagName.MatchString(name) {
+			return fmt.Errorf("Tag name \"%s\" may only consist of letters, digits, and _.-", name)
+		}
+		if strings.ContainsAny(value, ", ") {
+			return fmt.Errorf("Value of tag \"%s\" must not contain comma or space", name)
+		}
+	}
+	return nil
+}
+
+// GetTagStr returns the tags as comma-separated name=value pairs sorted by name.
+func (rec *Record) GetTagStr() string {
+	pairs := make([]string, 0, len(rec.Tags))
+	for name, value := range rec.Tags {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// RecordFilter selects records by conditions that must all be met.
+type RecordFilter struct {
+	Tags       map[string]string // Tags must all be present on the record with the same value.
+	UUIDPrefix string            // UUIDPrefix must begin the record UUID.
+	Client     string            // Client is a host name or IP that the record's allowed clients explicitly grant access to, or that is using the record.
+	MountPoint string            // MountPoint must begin the record's mount point.
+	StaleDays  int               // StaleDays selects records that have not been retrieved for at least as many days, 0 to ignore.
+	StaleFor   time.Duration     // StaleFor selects records that have neither been retrieved nor kept alive for at least as long, 0 to ignore.
+	Unused     bool              // Unused selects records that no computer is using according to its alive messages.
+	Owner      string            // Owner must be the record owner regardless of case.
+}
+
+/*
+ParseRecordFilter parses a comma-separated list of conditions, the record must meet all of them:
+tag.NAME=VALUE, uuid=PREFIX, client=HOST, mount=PREFIX, stale=DAYS or stale=DURATION (e.g. 72h), owner=OWNER.
+*/
+func ParseRecordFilter(in string) (filter RecordFilter, err error) {
+	filter.Tags = make(map[string]string)
+	for _, term := range strings.Split(in, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 {
+			return filter, fmt.Errorf("Filter \"%s\" must be in the format of name=value", term)
+		}
+		name, value := parts[0], parts[1]
+		switch {
+		case strings.HasPrefix(name, "tag.") && RegexTagName.MatchString(strings.TrimPrefix(name, "tag.")):
+			filter.Tags[strings.TrimPrefix(name, "tag.")] = value
+		case name == "uuid":
+			filter.UUIDPrefix = value
+		case name == "client":
+			filter.Client = value
+		case name == "mount":
+			filter.MountPoint = value
+		case name == "owner":
+			filter.Owner = value
+		case name == "stale":
+			if days, atoiErr := strconv.Atoi(value); atoiErr == nil && days > 0 {
+				filter.StaleDays = days
+			} else if filter.StaleFor, err = time.ParseDuration(value); atoiErr == nil || err != nil || filter.StaleFor <= 0 {
+				return filter, fmt.Errorf("Filter \"%s\" needs a number of days greater than 0, or a duration such as 72h", term)
+			}
+		default:
+			return filter, fmt.Errorf("Filter \"%s\" is not supported, use tag.NAME, uuid, client, mount, stale, or owner", term)
+		}
+	}
+	return filter, nil
+}
+
+/*
+Match returns true if the record meets all conditions of the filter. Client groups referred to by the record are
+resolved from the database, though a record that does not restrict its clients does not match a client condition.
+*/
+func (filter RecordFilter) Match(db *DB, rec Record, now time.Time) bool {
+	for name, value := range filter.Tags {
+		if actual, found := rec.Tags[name]; !found || actual != value {
+			return false
+		}
+	}
+	if !strings.HasPrefix(strings.ToLower(rec.UUID), strings.ToLower(filter.UUIDPrefix)) {
+		return false
+	}
+	if !strings.HasPrefix(rec.MountPoint, filter.MountPoint) {
+		return false
+	}
+	if filter.Owner != "" && !rec.IsOwnedBy(filter.Owner) {
+		return false
+	}
+	if filter.Client != "" && !rec.isHeldBy(filter.Client, now) {
+		if len(rec.AllowedClients) == 0 || !db.IsClientAllowed(rec, filter.Client, filter.Client) {
+			return false
+		}
+	}
+	if filter.StaleDays > 0 && rec.LastRetrieval.Timestamp != 0 &&
+		now.Sub(time.Unix(rec.LastRetrieval.Timestamp, 0)) < time.Duration(filter.StaleDays)*24*time.Hour {
+		return false
+	}
+	if lastActive := rec.lastActivity(); filter.StaleFor > 0 && lastActive != 0 && now.Sub(time.Unix(lastActive, 0)) < filter.StaleFor {
+		return false
+	}
+	if filter.Unused && len(rec.aliveAt(now)) > 0 {
+		return false
+	}
+	return true
+}
+
+// Return the final alive messages of the computers using the record at the moment, keyed by IP. The record is not changed.
+func (rec *Record) aliveAt(now time.Time) map[string]AliveMessage {
+	alive := make(map[string]AliveMessage)
+	for ip, beat := range rec.AliveMessages {
+		if len(beat) > 0 && beat[len(beat)-1].Timestamp >= now.Unix()-int64(rec.AliveIntervalSec*rec.AliveCount) {
+			alive[ip] = beat[len(beat)-1]
+		}
+	}
+	return alive
+}
+
+// Return true if the computer given by IP or host name is using the record at the moment.
+func (rec *Record) isHeldBy(host string, now time.Time) bool {
+	for ip, final := range rec.aliveAt(now) {
+		shortName := strings.SplitN(final.Hostname, ".", 2)[0]
+		if SameHost(ip, host) || SameHost(final.Hostname, host) || SameHost(final.CertName, host) || strings.EqualFold(shortName, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the timestamp of the most recent retrieval or alive message of the record, 0 if there is neither.
+func (rec *Record) lastActivity() int64 {
+	latest := rec.LastRetrieval.Timestamp
+	for _, beat := range rec.AliveMessages {
+		for _, msg := range beat {
+			if msg.Timestamp > latest {
+				latest = msg.Timestamp
+			}
+		}
+	}
+	return latest
+}
+
+// Filter returns the records that match the filter in their present order.
+func (r RecordSlice) Filter(db *DB, filter RecordFilter, now time.Time) RecordSlice {
+	matched := make(RecordSlice, 0, len(r))
+	for _, rec := range r {
+		if filter.Match(db, rec, now) {
+			matched = append(matched, rec)
+		}
+	}
+	return matched
+}
+
+// SortBy sorts the records in place by last retrieval (the default), UUID, mount point, or number of computers using them.
+func (r RecordSlice) SortBy(order string) error {
+	switch order {
+	case "", SortByLastRetrieval, SortByLastAccess:
+		sort.Stable(r)
+	case SortByUUID:
+		sort.SliceStable(r, func(i, j int) bool { return r[i].UUID < r[j].UUID })
+	case SortByMountPoint:
+		sort.SliceStable(r, func(i, j int) bool { return r[i].MountPoint < r[j].MountPoint })
+	case SortByActive:
+		now := time.Now()
+		sort.Stable(r)
+		sort.SliceStable(r, func(i, j int) bool { return len(r[i].aliveAt(now)) > len(r[j].aliveAt(now)) })
+	default:
+		return fmt.Errorf("Sort order \"%s\" is not supported, use %s, %s, %s, or %s", order, SortByLastRetrieval, SortByUUID, SortByMountPoint, SortByActive)
+	}
+	return nil
+}
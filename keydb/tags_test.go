@@ -0,0 +1,136 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags("cluster=ceph-prod, owner=storage,empty=")
+	if err != nil || !reflect.DeepEqual(tags, map[string]string{"cluster": "ceph-prod", "owner": "storage", "empty": ""}) {
+		t.Fatal(tags, err)
+	}
+	rec := Record{Tags: tags}
+	if str := rec.GetTagStr(); str != "cluster=ceph-prod,empty=,owner=storage" {
+		t.Fatal(str)
+	}
+	for _, bad := range []string{"cluster", "=value", "bad name=x", "a/b=c"} {
+		if _, err := ParseTags(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestRecordFilter(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	recs := RecordSlice{
+		{UUID: "b-uuid", MountPoint: "/srv/ceph", Tags: map[string]string{"cluster": "ceph-prod"}, AllowedClients: []string{"10.0.0.0/8"},
+			LastRetrieval: AliveMessage{Timestamp: now.Add(-time.Hour).Unix()}},
+		{UUID: "a-uuid", MountPoint: "/data", Tags: map[string]string{"cluster": "ceph-test"},
+			LastRetrieval: AliveMessage{Timestamp: now.Add(-100 * 24 * time.Hour).Unix()}},
+		{UUID: "c-uuid", MountPoint: "/srv/db", Owner: "Storage-Team"},
+	}
+	for expr, uuids := range map[string][]string{
+		"":                              {"b-uuid", "a-uuid", "c-uuid"},
+		"tag.cluster=ceph-prod":         {"b-uuid"},
+		"tag.missing=ceph-prod":         {},
+		"tag.cluster=ceph-prod,mount=/": {"b-uuid"},
+		"mount=/srv":                    {"b-uuid", "c-uuid"},
+		"uuid=A":                        {"a-uuid"},
+		"client=10.1.2.3":               {"b-uuid"},
+		"client=192.168.1.1":            {},
+		"stale=30":                      {"a-uuid", "c-uuid"},
+		"stale=30,mount=/srv":           {"c-uuid"},
+		"owner=storage-team":            {"c-uuid"},
+		"owner=db-team":                 {},
+	} {
+		filter, err := ParseRecordFilter(expr)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		if matched := recs.Filter(db, filter, now).GroupMemberUUIDs(); !reflect.DeepEqual(matched, uuids) {
+			t.Fatal(expr, matched)
+		}
+	}
+	for _, bad := range []string{"stale=0", "stale=x", "owner", "colour=red"} {
+		if _, err := ParseRecordFilter(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if err := recs.SortBy(SortByUUID); err != nil || !reflect.DeepEqual(recs.GroupMemberUUIDs(), []string{"a-uuid", "b-uuid", "c-uuid"}) {
+		t.Fatal(recs.GroupMemberUUIDs(), err)
+	}
+	if err := recs.SortBy(SortByMountPoint); err != nil || !reflect.DeepEqual(recs.GroupMemberUUIDs(), []string{"a-uuid", "b-uuid", "c-uuid"}) {
+		t.Fatal(recs.GroupMemberUUIDs(), err)
+	}
+	if err := recs.SortBy(SortByLastRetrieval); err != nil || recs[0].UUID != "b-uuid" {
+		t.Fatal(recs.GroupMemberUUIDs(), err)
+	}
+	if err := recs.SortBy("size"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestRecordFilter_Activity(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	recs := RecordSlice{
+		{UUID: "idle-uuid", MountPoint: "/idle", AliveIntervalSec: 10, AliveCount: 4,
+			LastRetrieval: AliveMessage{Timestamp: now.Add(-200 * time.Hour).Unix()},
+			AliveMessages: map[string][]AliveMessage{"10.0.0.9": {{IP: "10.0.0.9", Timestamp: now.Add(-100 * time.Hour).Unix()}}}},
+		{UUID: "busy-uuid", MountPoint: "/busy", AliveIntervalSec: 10, AliveCount: 4,
+			LastRetrieval: AliveMessage{Timestamp: now.Add(-300 * time.Hour).Unix()},
+			AliveMessages: map[string][]AliveMessage{
+				"10.0.0.1": {{IP: "10.0.0.1", Hostname: "db1.example.com", Timestamp: now.Unix()}},
+				"10.0.0.2": {{IP: "10.0.0.2", Hostname: "db2.example.com", Timestamp: now.Unix()}},
+			}},
+		{UUID: "one-uuid", MountPoint: "/one", AliveIntervalSec: 10, AliveCount: 4,
+			LastRetrieval: AliveMessage{Timestamp: now.Add(-time.Hour).Unix()},
+			AliveMessages: map[string][]AliveMessage{"10.0.0.3": {{IP: "10.0.0.3", Hostname: "web1", Timestamp: now.Unix()}}}},
+	}
+	for expr, uuids := range map[string][]string{
+		"stale=72h":              {"idle-uuid"},
+		"stale=30m":              {"idle-uuid"},
+		"stale=300h":             {},
+		"client=10.0.0.2":        {"busy-uuid"},
+		"client=db1":             {"busy-uuid"},
+		"client=web1":            {"one-uuid"},
+		"client=10.0.0.9":        {},
+		"client=db1.example.com": {"busy-uuid"},
+	} {
+		filter, err := ParseRecordFilter(expr)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		if matched := recs.Filter(db, filter, now).GroupMemberUUIDs(); !reflect.DeepEqual(matched, uuids) {
+			t.Fatal(expr, matched)
+		}
+	}
+	if matched := recs.Filter(db, RecordFilter{Unused: true}, now).GroupMemberUUIDs(); !reflect.DeepEqual(matched, []string{"idle-uuid"}) {
+		t.Fatal(matched)
+	}
+	if _, err := ParseRecordFilter("stale=-1h"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := recs.SortBy(SortByActive); err != nil || !reflect.DeepEqual(recs.GroupMemberUUIDs(), []string{"busy-uuid", "one-uuid", "idle-uuid"}) {
+		t.Fatal(recs.GroupMemberUUIDs(), err)
+	}
+	if err := recs.SortBy(SortByLastAccess); err != nil || !reflect.DeepEqual(recs.GroupMemberUUIDs(), []string{"one-uuid", "idle-uuid", "busy-uuid"}) {
+		t.Fatal(recs.GroupMemberUUIDs(), err)
+	}
+}
@@ -0,0 +1,113 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseUnlockAfter parses record UUIDs separated by comma or space, the "UUID:" prefix is optional.
+func ParseUnlockAfter(in string) []string {
+	uuids := make([]string, 0)
+	for _, field := range strings.FieldsFunc(in, func(r rune) bool { return r == ',' || r == ' ' }) {
+		uuids = append(uuids, CanonicalRecordID(field))
+	}
+	return uuids
+}
+
+// GetUnlockAfterStr returns the UUIDs of records to unlock before this one separated by comma.
+func (rec *Record) GetUnlockAfterStr() string {
+	return strings.Join(rec.UnlockAfter, ",")
+}
+
+// Return an error if any of the records to unlock before this one is not a valid UUID or is the record itself.
+func (rec *Record) ValidateUnlockAfter() error {
+	for _, uuid := range rec.UnlockAfter {
+		if err := ValidateUUID(uuid); err != nil {
+			return fmt.Errorf("UnlockAfter \"%s\" - %v", uuid, err)
+		}
+		if CanonicalRecordID(uuid) == rec.UUID {
+			return fmt.Errorf("Record \"%s\" cannot be unlocked after itself", rec.UUID)
+		}
+	}
+	return nil
+}
+
+/*
+FindUnlockAfterCycle returns the UUIDs of records that wait for each other to be unlocked in a cycle, beginning and
+ending with the same UUID, or nil if there is no cycle. Records referred to but not among the records are ignored.
+*/
+func FindUnlockAfterCycle(recs []Record) []string {
+	after := make(map[string][]string, len(recs))
+	known := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		known[rec.UUID] = true
+		for _, uuid := range rec.UnlockAfter {
+			after[rec.UUID] = append(after[rec.UUID], CanonicalRecordID(uuid))
+		}
+	}
+	// Depth-first search, a record on the current path that is visited again closes a cycle.
+	const (
+		unvisited = iota
+		onPath
+		finished
+	)
+	state := make(map[string]int, len(recs))
+	path := make([]string, 0, len(recs))
+	var visit func(uuid string) []string
+	visit = func(uuid string) []string {
+		state[uuid] = onPath
+		path = append(path, uuid)
+		for _, next := range after[uuid] {
+			if !known[next] {
+				continue
+			}
+			switch state[next] {
+			case onPath:
+				for i, onPathUUID := range path {
+					if onPathUUID == next {
+						return append(append([]string{}, path[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[uuid] = finished
+		return nil
+	}
+	for _, rec := range recs {
+		if state[rec.UUID] == unvisited {
+			if cycle := visit(rec.UUID); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+/*
+CheckUnlockAfter returns an error if the record, as it would be saved, makes records in the database wait for each
+other to be unlocked in a cycle.
+*/
+func (db *DB) CheckUnlockAfter(rec Record) error {
+	recs := db.List()
+	for i := range recs {
+		if recs[i].UUID == rec.UUID {
+			recs[i] = rec
+			rec.UUID = ""
+			break
+		}
+	}
+	if rec.UUID != "" {
+		recs = append(recs, rec)
+	}
+	if cycle := FindUnlockAfterCycle(recs); cycle != nil {
+		return fmt.Errorf("Records cannot be unlocked after each other in a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
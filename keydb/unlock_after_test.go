@@ -0,0 +1,69 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidateUnlockAfter(t *testing.T) {
+	if uuids := ParseUnlockAfter("UUID:a-uuid, b-uuid"); !reflect.DeepEqual(uuids, []string{"a-uuid", "b-uuid"}) {
+		t.Fatal(uuids)
+	}
+	rec := Record{UUID: "c-uuid", UnlockAfter: []string{"a-uuid", "b-uuid"}}
+	if err := rec.ValidateUnlockAfter(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]string{{"c-uuid"}, {"UUID:c-uuid"}, {"a uuid"}, {""}} {
+		rec.UnlockAfter = bad
+		if err := rec.ValidateUnlockAfter(); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestFindUnlockAfterCycle(t *testing.T) {
+	recs := []Record{
+		{UUID: "a", UnlockAfter: []string{"b", "missing"}},
+		{UUID: "b", UnlockAfter: []string{"c"}},
+		{UUID: "c"},
+	}
+	if cycle := FindUnlockAfterCycle(recs); cycle != nil {
+		t.Fatal(cycle)
+	}
+	recs[2].UnlockAfter = []string{"UUID:a"}
+	if cycle := FindUnlockAfterCycle(recs); !reflect.DeepEqual(cycle, []string{"a", "b", "c", "a"}) {
+		t.Fatal(cycle)
+	}
+}
+
+func TestCheckUnlockAfter(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []Record{
+		{UUID: "1", Key: []byte{0, 1, 2, 3}, UnlockAfter: []string{"2"}},
+		{UUID: "2", Key: []byte{0, 1, 2, 3}},
+	} {
+		rec.AliveIntervalSec, rec.AliveCount = 1, 4
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An existing record is replaced by its new version
+	if err := db.CheckUnlockAfter(Record{UUID: "2", UnlockAfter: []string{"3"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckUnlockAfter(Record{UUID: "2", UnlockAfter: []string{"1"}}); err == nil {
+		t.Fatal("did not error")
+	}
+	// So is a new record added to them
+	if err := db.CheckUnlockAfter(Record{UUID: "3", UnlockAfter: []string{"1"}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,178 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	UnlockTokenStatusOutstanding = "outstanding" // UnlockTokenStatusOutstanding is the status of a token that may still be used.
+	UnlockTokenStatusUsed        = "used"        // UnlockTokenStatusUsed is the status of a token that has been used.
+	UnlockTokenStatusExpired     = "expired"     // UnlockTokenStatusExpired is the status of a token that expired before it was used.
+)
+
+// ErrUnlockTokenInvalid is returned for a token that is unknown, used, expired, or presented by another computer.
+var ErrUnlockTokenInvalid = errors.New("the unlock token is not valid for the disk")
+
+/*
+UnlockToken lets a computer retrieve the key of one disk exactly once, without the password and regardless of allowed
+clients, e.g. for a technician during the administrator's absence. Only the SHA256 digest of the token is kept, the
+token itself is shown once when it is created.
+*/
+type UnlockToken struct {
+	ID        string    // ID identifies the token in listings and audit log, it does not reveal the token.
+	Hash      string    // Hash is the hex-encoded SHA256 digest of the token.
+	Hostname  string    // Hostname is the only computer that may use the token, empty for any computer.
+	CreatedAt time.Time // CreatedAt is the moment the token was created.
+	ExpiresAt time.Time // ExpiresAt is the moment the token can no longer be used.
+	UsedAt    time.Time // UsedAt is the moment the token was used, zero if it has not been used yet.
+	UsedBy    string    // UsedBy describes the computer that used the token.
+}
+
+// Return the hex-encoded SHA256 digest of the token.
+func hashUnlockToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+/*
+NewUnlockToken returns a new random token that is valid for the duration, along with the record of it. The hostname
+restricts the computer that may use the token, it may be empty.
+*/
+func NewUnlockToken(hostname string, validity time.Duration) (token string, rec UnlockToken) {
+	secret := make([]byte, 32)
+	id := make([]byte, 6)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Errorf("NewUnlockToken: failed to read random bytes - %v", err))
+	}
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Errorf("NewUnlockToken: failed to read random bytes - %v", err))
+	}
+	token = hex.EncodeToString(secret)
+	now := time.Now()
+	rec = UnlockToken{
+		ID:        hex.EncodeToString(id),
+		Hash:      hashUnlockToken(token),
+		Hostname:  CanonicalHost(hostname),
+		CreatedAt: now,
+		ExpiresAt: now.Add(validity),
+	}
+	return
+}
+
+// IsUsed returns true only if the token has been used.
+func (token UnlockToken) IsUsed() bool {
+	return !token.UsedAt.IsZero()
+}
+
+// StatusAt returns one of UnlockTokenStatus* constants as of the moment.
+func (token UnlockToken) StatusAt(moment time.Time) string {
+	if token.IsUsed() {
+		return UnlockTokenStatusUsed
+	} else if !moment.Before(token.ExpiresAt) {
+		return UnlockTokenStatusExpired
+	}
+	return UnlockTokenStatusOutstanding
+}
+
+// Return true only if the token is the one this record stands for, the comparison takes constant time.
+func (token UnlockToken) matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashUnlockToken(secret))) == 1
+}
+
+// Return true only if the token has no host restriction, or one of the names of the requester (IP, DNS name, etc.) is the host.
+func (token UnlockToken) allowsHost(names ...string) bool {
+	if token.Hostname == "" {
+		return true
+	}
+	for _, name := range names {
+		if SameHost(name, token.Hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveExpiredUnlockTokens removes the tokens that have expired by the moment, used or not, return the number removed.
+func (rec *Record) RemoveExpiredUnlockTokens(moment time.Time) int {
+	remaining := make([]UnlockToken, 0, len(rec.UnlockTokens))
+	for _, token := range rec.UnlockTokens {
+		if moment.Before(token.ExpiresAt) {
+			remaining = append(remaining, token)
+		}
+	}
+	removed := len(rec.UnlockTokens) - len(remaining)
+	if len(remaining) == 0 {
+		remaining = nil
+	}
+	rec.UnlockTokens = remaining
+	return removed
+}
+
+// AddUnlockToken stores the token on the record and persists it, expired tokens are removed along the way.
+func (db *DB) AddUnlockToken(uuid string, token UnlockToken) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return fmt.Errorf("AddUnlockToken: record \"%s\" does not exist", uuid)
+	}
+	rec.RemoveExpiredUnlockTokens(time.Now())
+	rec.UnlockTokens = append(rec.UnlockTokens, token)
+	if _, err := db.upsert(rec, true); err != nil {
+		return fmt.Errorf("AddUnlockToken: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
+
+/*
+UseUnlockToken looks for an outstanding token among the records of the UUIDs, marks it used, writes down the retrieval
+by the requester, and persists the record before returning it. The names of the requester (IP, DNS name, etc.) are
+checked against the host restriction of the token. A token is only ever found on the record it was created for,
+ErrUnlockTokenInvalid is returned if none of the records has it outstanding. The detail explains why for the log.
+*/
+func (db *DB) UseUnlockToken(secret string, requester AliveMessage, names []string, uuids ...string) (rec Record, token UnlockToken, detail string, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	now := time.Now()
+	detail = "no record carries the token"
+	for _, uuid := range uuids {
+		candidate, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+		if !found || secret == "" {
+			continue
+		}
+		for i, existing := range candidate.UnlockTokens {
+			if !existing.matches(secret) {
+				continue
+			}
+			if status := existing.StatusAt(now); status != UnlockTokenStatusOutstanding {
+				return Record{}, existing, fmt.Sprintf("token %s of %s is %s", existing.ID, candidate.UUID, status), ErrUnlockTokenInvalid
+			}
+			if !existing.allowsHost(names...) {
+				return Record{}, existing, fmt.Sprintf("token %s of %s is only for %s", existing.ID, candidate.UUID, existing.Hostname), ErrUnlockTokenInvalid
+			}
+			existing.UsedAt = now
+			existing.UsedBy = fmt.Sprintf("%s (%s)", requester.IP, requester.Hostname)
+			// Copy the tokens so that the record in memory stays as it is should the record fail to save
+			tokens := make([]UnlockToken, len(candidate.UnlockTokens))
+			copy(tokens, candidate.UnlockTokens)
+			tokens[i] = existing
+			candidate.UnlockTokens = tokens
+			candidate.expireDeadHosts()
+			candidate.UpdateLastRetrieval(requester, false)
+			// The token must be known to be used before the key is handed out
+			if _, err := db.upsert(candidate, true); err != nil {
+				return Record{}, existing, "", fmt.Errorf("UseUnlockToken: failed to save record \"%s\" - %v", candidate.UUID, err)
+			}
+			return db.RecordsByUUID[candidate.UUID], existing, "", nil
+		}
+	}
+	return Record{}, UnlockToken{}, detail, ErrUnlockTokenInvalid
+}
@@ -0,0 +1,100 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUnlockToken(t *testing.T) {
+	token, rec := NewUnlockToken(" tech.example.com ", time.Hour)
+	if len(token) != 64 || rec.ID == "" || rec.Hostname != "tech.example.com" || strings.Contains(rec.Hash, token) || !rec.matches(token) || rec.matches(token[1:]) {
+		t.Fatal(token, rec)
+	}
+	if status := rec.StatusAt(time.Now()); status != UnlockTokenStatusOutstanding {
+		t.Fatal(status)
+	}
+	if status := rec.StatusAt(rec.ExpiresAt); status != UnlockTokenStatusExpired {
+		t.Fatal(status)
+	}
+	if another, _ := NewUnlockToken("", time.Hour); another == token {
+		t.Fatal("token is not random")
+	}
+	if !rec.allowsHost("10.0.0.1", "TECH.example.com") || rec.allowsHost("10.0.0.1", "") {
+		t.Fatal("wrong host restriction")
+	}
+}
+
+func TestDB_UseUnlockToken(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte("key " + uuid), MountPoint: "/" + uuid, MaxActive: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddUnlockToken("c", UnlockToken{}); err == nil {
+		t.Fatal("did not error")
+	}
+	token, tokenRec := NewUnlockToken("", time.Hour)
+	hostToken, hostTokenRec := NewUnlockToken("tech", time.Hour)
+	_, expiredRec := NewUnlockToken("", time.Hour)
+	expiredRec.ExpiresAt = time.Now().Add(-time.Second)
+	for _, rec := range []UnlockToken{expiredRec, tokenRec, hostTokenRec} {
+		if err := db.AddUnlockToken("a", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The expired token is removed once the next one is added
+	if rec, _ := db.GetByUUID("a"); len(rec.UnlockTokens) != 2 {
+		t.Fatal(rec.UnlockTokens)
+	}
+	requester := AliveMessage{IP: "10.0.0.1", Hostname: "tech", Timestamp: time.Now().Unix()}
+	// The token is only good for the record it was created for
+	if _, _, _, err := db.UseUnlockToken(token, requester, []string{"10.0.0.1"}, "b", "c"); err != ErrUnlockTokenInvalid {
+		t.Fatal(err)
+	}
+	if _, _, _, err := db.UseUnlockToken("", requester, []string{"10.0.0.1"}, "a"); err != ErrUnlockTokenInvalid {
+		t.Fatal(err)
+	}
+	// The host restriction is checked against the names given, not the host name the requester claims
+	if _, _, detail, err := db.UseUnlockToken(hostToken, requester, []string{"10.0.0.1"}, "a"); err != ErrUnlockTokenInvalid || !strings.Contains(detail, "only for tech") {
+		t.Fatal(detail, err)
+	}
+	rec, used, _, err := db.UseUnlockToken(token, requester, []string{"10.0.0.1"}, "b", "a")
+	if err != nil || rec.UUID != "a" || used.ID != tokenRec.ID || !used.IsUsed() || rec.LastRetrieval.IP != "10.0.0.1" {
+		t.Fatal(rec, used, err)
+	}
+	// The token can be used only once, also after the database is reloaded
+	if _, _, detail, err := db.UseUnlockToken(token, requester, []string{"10.0.0.1"}, "a"); err != ErrUnlockTokenInvalid || !strings.Contains(detail, UnlockTokenStatusUsed) {
+		t.Fatal(detail, err)
+	}
+	if db, err = OpenDB(TestDBDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := db.UseUnlockToken(token, requester, []string{"10.0.0.1"}, "a"); err != ErrUnlockTokenInvalid {
+		t.Fatal(err)
+	}
+	if _, _, _, err := db.UseUnlockToken(hostToken, requester, []string{"10.0.0.1", "tech"}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// Editing the record never brings a used token back
+	stale := rec
+	stale.UnlockTokens = []UnlockToken{tokenRec}
+	stale.MountPoint = "/a2"
+	if saved, err := db.UpdateFields(stale, false); err != nil || len(saved.UnlockTokens) != 2 || !saved.UnlockTokens[0].IsUsed() || saved.MountPoint != "/a2" {
+		t.Fatal(saved.UnlockTokens, err)
+	}
+	// Expired tokens are removed
+	rec, _ = db.GetByUUID("a")
+	if removed := rec.RemoveExpiredUnlockTokens(time.Now().Add(2 * time.Hour)); removed != 2 || rec.UnlockTokens != nil {
+		t.Fatal(removed, rec.UnlockTokens)
+	}
+}
@@ -0,0 +1,229 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UnlockWindowSeparator = ";"     // UnlockWindowSeparator separates the windows written in text.
+	UnlockWindowEveryDay  = "daily" // UnlockWindowEveryDay stands for all days of the week.
+)
+
+// The days of week by their abbreviation in text, in the order of time.Weekday.
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+/*
+UnlockWindow is a recurring period of time during which a disk may be unlocked, e.g. "Mon-Fri 22:00-04:00". Start and
+end are wall clock times in the server's time zone. A window whose end is not after its start ends on the next day, the
+days of week are those the window begins on.
+*/
+type UnlockWindow struct {
+	Days     []time.Weekday // Days are the days of week the window begins on.
+	StartMin int            // StartMin is the number of minutes since midnight at which the window begins.
+	EndMin   int            // EndMin is the number of minutes since midnight at which the window ends.
+}
+
+// Return the abbreviation of the day of week, accepting any letter case.
+func parseWeekday(name string) (time.Weekday, error) {
+	for i, dayName := range weekdayNames {
+		if strings.EqualFold(dayName, name) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day of week \"%s\", use Mon, Tue, Wed, Thu, Fri, Sat, or Sun", name)
+}
+
+// Return the minutes since midnight of "HH:MM".
+func parseClock(clock string) (int, error) {
+	fields := strings.Split(clock, ":")
+	if len(fields) != 2 || len(fields[1]) != 2 {
+		return 0, fmt.Errorf("time \"%s\" should be in the form of HH:MM", clock)
+	}
+	hour, errHour := strconv.Atoi(fields[0])
+	minute, errMinute := strconv.Atoi(fields[1])
+	if errHour != nil || errMinute != nil || hour < 0 || hour > 24 || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("time \"%s\" should be between 00:00 and 24:00", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+/*
+ParseUnlockWindows parses the windows separated by semicolon, each window is written as "DAYS HH:MM-HH:MM". Days are
+separated by comma, a range such as "Mon-Fri" stands for the days in between, and "daily" stands for all days. An empty
+text means no window, i.e. the disk may be unlocked at any time.
+*/
+func ParseUnlockWindows(in string) ([]UnlockWindow, error) {
+	windows := make([]UnlockWindow, 0)
+	for _, text := range strings.Split(in, UnlockWindowSeparator) {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" should be in the form of \"DAYS HH:MM-HH:MM\"", text)
+		}
+		window := UnlockWindow{}
+		seen := make(map[time.Weekday]bool)
+		for _, daySpec := range strings.Split(fields[0], ",") {
+			first, last := daySpec, daySpec
+			if strings.EqualFold(daySpec, UnlockWindowEveryDay) {
+				first, last = weekdayNames[time.Sunday], weekdayNames[time.Saturday]
+			} else if dash := strings.Index(daySpec, "-"); dash != -1 {
+				first, last = daySpec[:dash], daySpec[dash+1:]
+			}
+			firstDay, err := parseWeekday(first)
+			if err != nil {
+				return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" - %v", text, err)
+			}
+			lastDay, err := parseWeekday(last)
+			if err != nil {
+				return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" - %v", text, err)
+			}
+			// A range may wrap around the end of the week, e.g. "Sat-Mon"
+			for day := firstDay; ; day = (day + 1) % 7 {
+				if !seen[day] {
+					seen[day] = true
+					window.Days = append(window.Days, day)
+				}
+				if day == lastDay {
+					break
+				}
+			}
+		}
+		clocks := strings.Split(fields[1], "-")
+		if len(clocks) != 2 {
+			return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" should be in the form of \"DAYS HH:MM-HH:MM\"", text)
+		}
+		var err error
+		if window.StartMin, err = parseClock(clocks[0]); err != nil {
+			return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" - %v", text, err)
+		}
+		if window.EndMin, err = parseClock(clocks[1]); err != nil {
+			return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" - %v", text, err)
+		}
+		if window.StartMin == 24*60 {
+			return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" cannot begin at 24:00", text)
+		}
+		if window.StartMin == window.EndMin {
+			return nil, fmt.Errorf("ParseUnlockWindows: window \"%s\" has no duration", text)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// String returns the window in the form understood by ParseUnlockWindows.
+func (window UnlockWindow) String() string {
+	days := make([]string, 0, len(window.Days))
+	for _, day := range window.Days {
+		days = append(days, weekdayNames[day])
+	}
+	if len(days) == 7 {
+		days = []string{UnlockWindowEveryDay}
+	}
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d", strings.Join(days, ","),
+		window.StartMin/60, window.StartMin%60, window.EndMin/60, window.EndMin%60)
+}
+
+/*
+Return the moments the window begins and ends if it begins on the day of the date. The moments are calculated from the
+wall clock in the location, hence a window across a daylight saving time transition lasts an hour longer or shorter.
+*/
+func (window UnlockWindow) onDay(year int, month time.Month, day int, loc *time.Location) (start, end time.Time, found bool) {
+	start = time.Date(year, month, day, window.StartMin/60, window.StartMin%60, 0, 0, loc)
+	weekday := time.Date(year, month, day, 12, 0, 0, 0, loc).Weekday()
+	for _, windowDay := range window.Days {
+		if windowDay == weekday {
+			found = true
+		}
+	}
+	if window.EndMin > window.StartMin {
+		end = time.Date(year, month, day, window.EndMin/60, window.EndMin%60, 0, 0, loc)
+	} else {
+		end = time.Date(year, month, day+1, window.EndMin/60, window.EndMin%60, 0, 0, loc)
+	}
+	return
+}
+
+// Return an error if an unlock window of the record does not make sense.
+func (rec *Record) ValidateUnlockWindows() error {
+	for _, window := range rec.UnlockWindows {
+		if len(window.Days) == 0 {
+			return fmt.Errorf("Unlock window \"%s\" does not have any day of week", window)
+		}
+		for _, day := range window.Days {
+			if day < time.Sunday || day > time.Saturday {
+				return fmt.Errorf("Unlock window has an unknown day of week %d", day)
+			}
+		}
+		if window.StartMin < 0 || window.StartMin >= 24*60 || window.EndMin < 0 || window.EndMin > 24*60 || window.StartMin == window.EndMin {
+			return fmt.Errorf("Unlock window \"%s\" has an invalid time range", window)
+		}
+	}
+	if rec.UmountAtWindowEnd && len(rec.UnlockWindows) == 0 {
+		return errors.New("Umount at the end of unlock window requires an unlock window")
+	}
+	return nil
+}
+
+// GetUnlockWindowsStr returns the windows of the record in the form understood by ParseUnlockWindows.
+func (rec *Record) GetUnlockWindowsStr() string {
+	texts := make([]string, 0, len(rec.UnlockWindows))
+	for _, window := range rec.UnlockWindows {
+		texts = append(texts, window.String())
+	}
+	return strings.Join(texts, UnlockWindowSeparator+" ")
+}
+
+/*
+IsUnlockWindowOpen returns true if the record has no unlock window, or the moment is within one of its windows as
+seen on the wall clock of the location.
+*/
+func (rec *Record) IsUnlockWindowOpen(moment time.Time, loc *time.Location) bool {
+	if len(rec.UnlockWindows) == 0 {
+		return true
+	}
+	local := moment.In(loc)
+	for _, window := range rec.UnlockWindows {
+		// A window that began on the previous day may still be open
+		for dayOffset := -1; dayOffset <= 0; dayOffset++ {
+			start, end, found := window.onDay(local.Year(), local.Month(), local.Day()+dayOffset, loc)
+			if found && !moment.Before(start) && moment.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+NextUnlockWindow returns the moment the record's next window begins after the moment, found is false if the record has
+no window.
+*/
+func (rec *Record) NextUnlockWindow(moment time.Time, loc *time.Location) (next time.Time, found bool) {
+	local := moment.In(loc)
+	for _, window := range rec.UnlockWindows {
+		for dayOffset := 0; dayOffset <= 7; dayOffset++ {
+			start, _, onDay := window.onDay(local.Year(), local.Month(), local.Day()+dayOffset, loc)
+			if onDay && start.After(moment) && (!found || start.Before(next)) {
+				next, found = start, true
+			}
+		}
+	}
+	return
+}
+
+// DescribeUnlockWindows explains when the record's disk may be unlocked, e.g. for a rejected key retrieval.
+func (rec *Record) DescribeUnlockWindows(moment time.Time, loc *time.Location) string {
+	desc := fmt.Sprintf("the disk may only be unlocked during its unlock windows (%s, time zone %s)", rec.GetUnlockWindowsStr(), loc)
+	if next, found := rec.NextUnlockWindow(moment, loc); found {
+		desc += fmt.Sprintf(", the next one begins at %s", next.Format(time.RFC3339))
+	}
+	return desc
+}
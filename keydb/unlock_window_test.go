@@ -0,0 +1,132 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUnlockWindows(t *testing.T) {
+	if windows, err := ParseUnlockWindows(" "); err != nil || len(windows) != 0 {
+		t.Fatal(windows, err)
+	}
+	windows, err := ParseUnlockWindows("Mon-Fri 22:00-04:00; sat,SUN 20:30-24:00;daily 12:00-13:00; Fri-Mon 01:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []UnlockWindow{
+		{Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, StartMin: 22 * 60, EndMin: 4 * 60},
+		{Days: []time.Weekday{time.Saturday, time.Sunday}, StartMin: 20*60 + 30, EndMin: 24 * 60},
+		{Days: []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}, StartMin: 12 * 60, EndMin: 13 * 60},
+		{Days: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, StartMin: 60, EndMin: 120},
+	}
+	if !reflect.DeepEqual(windows, expected) {
+		t.Fatal(windows)
+	}
+	rec := Record{UnlockWindows: windows}
+	if str := rec.GetUnlockWindowsStr(); str != "Mon,Tue,Wed,Thu,Fri 22:00-04:00; Sat,Sun 20:30-24:00; daily 12:00-13:00; Fri,Sat,Sun,Mon 01:00-02:00" {
+		t.Fatal(str)
+	}
+	if again, err := ParseUnlockWindows(rec.GetUnlockWindowsStr()); err != nil || !reflect.DeepEqual(again, windows) {
+		t.Fatal(again, err)
+	}
+	for _, bad := range []string{"Mon", "Mon 22:00", "Mon 22:00-", "Xyz 01:00-02:00", "Mon-Xyz 01:00-02:00", "Mon 25:00-02:00",
+		"Mon 01:60-02:00", "Mon 1:5-02:00", "Mon 24:00-02:00", "Mon 02:00-02:00", "Mon 01:00-02:00 03:00"} {
+		if _, err := ParseUnlockWindows(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestRecord_ValidateUnlockWindows(t *testing.T) {
+	if err := (&Record{}).ValidateUnlockWindows(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Record{UmountAtWindowEnd: true}).ValidateUnlockWindows(); err == nil {
+		t.Fatal("did not error")
+	}
+	for _, bad := range []UnlockWindow{
+		{StartMin: 60, EndMin: 120},
+		{Days: []time.Weekday{7}, StartMin: 60, EndMin: 120},
+		{Days: []time.Weekday{time.Monday}, StartMin: 24 * 60, EndMin: 120},
+		{Days: []time.Weekday{time.Monday}, StartMin: 60, EndMin: 60},
+	} {
+		if err := (&Record{UnlockWindows: []UnlockWindow{bad}}).ValidateUnlockWindows(); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestRecord_IsUnlockWindowOpen(t *testing.T) {
+	loc := time.FixedZone("test", 3600)
+	// Everything is allowed without a window
+	if !(&Record{}).IsUnlockWindowOpen(time.Now(), loc) {
+		t.Fatal("no window is not open")
+	}
+	windows, err := ParseUnlockWindows("Mon-Fri 22:00-04:00; Sat 10:00-12:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{UnlockWindows: windows}
+	// 2023-01-02 is a Monday
+	for clock, open := range map[string]bool{
+		"2023-01-02 21:59": false,
+		"2023-01-02 22:00": true,
+		"2023-01-03 03:59": true, // the window that began on Monday is still open
+		"2023-01-03 04:00": false,
+		"2023-01-02 03:00": false, // no window began on Sunday
+		"2023-01-07 03:00": true,  // the window that began on Friday ends on Saturday
+		"2023-01-07 11:00": true,
+		"2023-01-07 23:00": false,
+	} {
+		moment, err := time.ParseInLocation("2006-01-02 15:04", clock, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.IsUnlockWindowOpen(moment, loc) != open {
+			t.Fatal(clock, open)
+		}
+		// The wall clock of the location decides, not that of the moment
+		if rec.IsUnlockWindowOpen(moment.UTC(), loc) != open {
+			t.Fatal(clock, open)
+		}
+	}
+	moment := time.Date(2023, 1, 3, 5, 0, 0, 0, loc)
+	if next, found := rec.NextUnlockWindow(moment, loc); !found || !next.Equal(time.Date(2023, 1, 3, 22, 0, 0, 0, loc)) {
+		t.Fatal(next, found)
+	}
+	moment = time.Date(2023, 1, 7, 12, 0, 0, 0, loc)
+	if next, found := rec.NextUnlockWindow(moment, loc); !found || !next.Equal(time.Date(2023, 1, 9, 22, 0, 0, 0, loc)) {
+		t.Fatal(next, found)
+	}
+	if _, found := (&Record{}).NextUnlockWindow(moment, loc); found {
+		t.Fatal("found a window")
+	}
+}
+
+func TestRecord_IsUnlockWindowOpen_DST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database is not available", err)
+	}
+	windows, err := ParseUnlockWindows("daily 01:00-04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{UnlockWindows: windows}
+	// On 2023-03-26 the clock jumps from 02:00 to 03:00, the window lasts two hours
+	start := time.Date(2023, 3, 26, 1, 0, 0, 0, loc)
+	if !rec.IsUnlockWindowOpen(start, loc) || !rec.IsUnlockWindowOpen(start.Add(119*time.Minute), loc) || rec.IsUnlockWindowOpen(start.Add(2*time.Hour), loc) {
+		t.Fatal("wrong window on DST start")
+	}
+	// On 2023-10-29 the clock goes back from 03:00 to 02:00, the window lasts four hours
+	start = time.Date(2023, 10, 29, 1, 0, 0, 0, loc)
+	if !rec.IsUnlockWindowOpen(start.Add(239*time.Minute), loc) || rec.IsUnlockWindowOpen(start.Add(4*time.Hour), loc) {
+		t.Fatal("wrong window on DST end")
+	}
+	if next, found := rec.NextUnlockWindow(time.Date(2023, 10, 28, 12, 0, 0, 0, loc), loc); !found || !next.Equal(start) {
+		t.Fatal(next, found)
+	}
+}
@@ -0,0 +1,258 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/sys"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRecordVersionsKept = 5    // DefaultRecordVersionsKept is the default number of versions kept of each record.
+	RecordVersionInfix        = ".v" // RecordVersionInfix separates record UUID and version number in the name of a version file.
+)
+
+/*
+Record details that change by themselves while the record is in use, they are neither kept in versions nor reverted.
+The key content is only kept as a digest.
+*/
+var unversionedRecordFields = map[string]bool{
+	"Key": true, "SealedKey": true, "ClientErrors": true, "LostHosts": true, "Evictions": true, "LastRetrieval": true, "AutoEncryptedBy": true, "AliveMessages": true,
+	"PendingCommands": true, "UnlockTokens": true, "Rejections": true, "Retrievals": true, "PreviousKey": true, "SealedPrev": true,
+}
+
+/*
+RecordVersion is a record as it was after one of its changes. It carries the record details the administrator may
+edit, the key content itself is not kept.
+*/
+type RecordVersion struct {
+	Number    int       // Number counts up from 1 with each version of the record.
+	Time      time.Time // Time is the moment the version was saved.
+	KeyDigest []byte    // KeyDigest is the SHA-256 digest of key content, nil if the key is stored on KMIP server.
+	Record    Record    // Record carries the record details without key content and usage.
+}
+
+// Return the version of the record with the unversioned details removed.
+func newRecordVersion(rec Record) RecordVersion {
+	ver := RecordVersion{Time: time.Now()}
+	if len(rec.Key) > 0 {
+		digest := sha256.Sum256(rec.Key)
+		ver.KeyDigest = digest[:]
+	}
+	rec.Key = nil
+	rec.SealedKey = nil
+	rec.PreviousKey = nil
+	rec.SealedPrev = nil
+	rec.ClientErrors = nil
+	rec.LostHosts = nil
+	rec.Evictions = nil
+	rec.Rejections = nil
+	rec.Retrievals = nil
+	rec.LastRetrieval = AliveMessage{}
+	rec.AutoEncryptedBy = AliveMessage{}
+	rec.AliveMessages = nil
+	rec.PendingCommands = nil
+	rec.UnlockTokens = nil
+	ver.Record = rec
+	return ver
+}
+
+// Changes returns the names of record details that are different in the other version, sorted alphabetically.
+func (ver RecordVersion) Changes(other RecordVersion) []string {
+	changes := make([]string, 0, 4)
+	if !bytes.Equal(ver.KeyDigest, other.KeyDigest) {
+		changes = append(changes, "Key")
+	}
+	this, that := reflect.ValueOf(ver.Record), reflect.ValueOf(other.Record)
+	for i := 0; i < this.NumField(); i++ {
+		name := this.Type().Field(i).Name
+		if !unversionedRecordFields[name] && !reflect.DeepEqual(this.Field(i).Interface(), that.Field(i).Interface()) {
+			changes = append(changes, name)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// Return the path of the file of a record version.
+func (db *DB) versionPath(uuid string, number int) string {
+	return path.Join(db.Dir, uuid+RecordVersionInfix+strconv.Itoa(number))
+}
+
+// Return the version numbers of the record in ascending order.
+func (db *DB) versionNumbers(uuid string) ([]int, error) {
+	files, err := ioutil.ReadDir(db.Dir)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, 8)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), uuid+RecordVersionInfix) {
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimPrefix(file.Name(), uuid+RecordVersionInfix)); err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// Read a record version from its file.
+func (db *DB) readVersion(uuid string, number int) (ver RecordVersion, err error) {
+	content, err := ioutil.ReadFile(db.versionPath(uuid, number))
+	if err != nil {
+		return
+	}
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&ver); err != nil {
+		return ver, fmt.Errorf("failed to decode version %d of record \"%s\" - %v", number, uuid, err)
+	}
+	return
+}
+
+/*
+Save the record as its next version unless it is identical to the latest version, and remove the oldest versions
+beyond the number to keep. Failures are logged, they do not fail the change of record itself.
+*/
+func (db *DB) saveVersion(rec Record) {
+	if db.VersionsKept <= 0 {
+		return
+	}
+	numbers, err := db.versionNumbers(rec.UUID)
+	if err != nil {
+		log.Printf("DB.saveVersion: failed to list versions of record \"%s\" - %v", rec.UUID, err)
+		return
+	}
+	ver := newRecordVersion(rec)
+	ver.Number = 1
+	if len(numbers) > 0 {
+		ver.Number = numbers[len(numbers)-1] + 1
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ver); err != nil {
+		log.Printf("DB.saveVersion: failed to encode version of record \"%s\" - %v", rec.UUID, err)
+		return
+	}
+	if len(numbers) > 0 {
+		// Compare the version as it would be read back, gob does not tell empty slices and maps apart from nil.
+		var encoded RecordVersion
+		latest, err := db.readVersion(rec.UUID, numbers[len(numbers)-1])
+		if err == nil && gob.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&encoded) == nil && len(encoded.Changes(latest)) == 0 {
+			return
+		}
+	}
+	if err := sys.ReplaceFile(db.versionPath(rec.UUID, ver.Number), buf.Bytes(), DB_REC_FILE_MODE, true); err != nil {
+		log.Printf("DB.saveVersion: %v", err)
+		return
+	}
+	numbers = append(numbers, ver.Number)
+	for i := 0; i < len(numbers)-db.VersionsKept; i++ {
+		if err := os.Remove(db.versionPath(rec.UUID, numbers[i])); err != nil {
+			log.Printf("DB.saveVersion: failed to remove old version - %v", err)
+		}
+	}
+}
+
+// Erase all versions of the record.
+func (db *DB) eraseVersions(uuid string) error {
+	numbers, err := db.versionNumbers(uuid)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if err := fs.SecureErase(db.versionPath(uuid, number), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListVersions returns the versions kept of the record, the oldest first.
+func (db *DB) ListVersions(uuid string) ([]RecordVersion, error) {
+	if err := ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	numbers, err := db.versionNumbers(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("ListVersions: %v", err)
+	}
+	versions := make([]RecordVersion, 0, len(numbers))
+	for _, number := range numbers {
+		ver, err := db.readVersion(uuid, number)
+		if err != nil {
+			return nil, fmt.Errorf("ListVersions: %v", err)
+		}
+		versions = append(versions, ver)
+	}
+	return versions, nil
+}
+
+/*
+RevertRecord brings back the record details of the version and persists the record immediately, the revert itself
+becomes the next version. The key content, its ID, and the record usage remain as they are now, hence a version made
+before the key was replaced only brings back the other details. The function returns the reverted record.
+*/
+func (db *DB) RevertRecord(uuid string, number int) (Record, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	current, found := db.RecordsByUUID[CanonicalRecordID(uuid)]
+	if !found {
+		return Record{}, fmt.Errorf("RevertRecord: record \"%s\" does not exist", uuid)
+	}
+	ver, err := db.readVersion(current.UUID, number)
+	if os.IsNotExist(err) {
+		return Record{}, fmt.Errorf("RevertRecord: version %d of record \"%s\" does not exist", number, uuid)
+	} else if err != nil {
+		return Record{}, fmt.Errorf("RevertRecord: %v", err)
+	}
+	reverted := ver.Record
+	reverted.ID = current.ID
+	reverted.Version = current.Version
+	reverted.Key = current.Key
+	reverted.PreviousKey = current.PreviousKey
+	reverted.RotationTime = current.RotationTime
+	reverted.ClientErrors = current.ClientErrors
+	reverted.LostHosts = current.LostHosts
+	reverted.Evictions = current.Evictions
+	reverted.Rejections = current.Rejections
+	reverted.Retrievals = current.Retrievals
+	reverted.LastRetrieval = current.LastRetrieval
+	reverted.AutoEncryptedBy = current.AutoEncryptedBy
+	reverted.AliveMessages = current.AliveMessages
+	reverted.PendingCommands = current.PendingCommands
+	reverted.UnlockTokens = current.UnlockTokens
+	// The owner only ever changes on purpose
+	reverted.Owner = current.Owner
+	if _, err := db.upsertVersioned(reverted); err != nil {
+		return Record{}, fmt.Errorf("RevertRecord: failed to save record \"%s\" - %v", uuid, err)
+	}
+	return reverted, nil
+}
+
+// Persist the record and keep its details as a new version, the record as it was is kept too if it has no version yet.
+func (db *DB) upsertVersioned(rec Record) (string, error) {
+	if existing, found := db.RecordsByUUID[rec.UUID]; found {
+		db.saveVersion(existing)
+	}
+	id, err := db.upsert(rec, true)
+	if err != nil {
+		return "", err
+	}
+	db.saveVersion(db.RecordsByUUID[rec.UUID])
+	return id, nil
+}
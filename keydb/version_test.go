@@ -0,0 +1,78 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDB_VersionsAndRevert(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.VersionsKept = 3
+	uuid := "aaaa-bbbb"
+	rec := Record{Version: CurrentRecordVersion, UUID: uuid, Key: []byte("old key"), MountPoint: "/a", MountOptions: []string{}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	// A change of record usage alone does not make a new version
+	rec, _ = db.GetByUUID(uuid)
+	rec.AliveMessages = map[string][]AliveMessage{"1.1.1.1": {{Hostname: "host", IP: "1.1.1.1", Timestamp: 1}}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := db.ListVersions(uuid); err != nil || len(versions) != 1 || versions[0].Number != 1 {
+		t.Fatal(versions, err)
+	}
+	for _, mountPoint := range []string{"/b", "/c", "/d"} {
+		rec, _ = db.GetByUUID(uuid)
+		rec.MountPoint = mountPoint
+		if mountPoint == "/d" {
+			rec.Key = []byte("new key")
+		}
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the latest three versions are kept
+	versions, err := db.ListVersions(uuid)
+	if err != nil || len(versions) != 3 || versions[0].Number != 2 || versions[2].Number != 4 {
+		t.Fatal(versions, err)
+	}
+	if changes := versions[2].Changes(versions[1]); !reflect.DeepEqual(changes, []string{"Key", "MountPoint"}) {
+		t.Fatal(changes)
+	}
+	if versions[2].Record.Key != nil || len(versions[2].KeyDigest) != 32 {
+		t.Fatal(versions[2])
+	}
+	// Revert brings back the mount point but keeps the new key
+	reverted, err := db.RevertRecord(uuid, 2)
+	if err != nil || reverted.MountPoint != "/b" || string(reverted.Key) != "new key" {
+		t.Fatal(reverted, err)
+	}
+	if _, err := db.RevertRecord(uuid, 1); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID(uuid); rec.MountPoint != "/b" || string(rec.Key) != "new key" || len(rec.AliveMessages) != 1 {
+		t.Fatal(rec)
+	}
+	if versions, err := db.ListVersions(uuid); err != nil || len(versions) != 3 || versions[2].Number != 5 || versions[2].Record.MountPoint != "/b" {
+		t.Fatal(versions, err)
+	}
+	// Erasing the record erases its versions too
+	if err := db.Erase(uuid); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := db.ListVersions(uuid); err != nil || len(versions) != 0 {
+		t.Fatal(versions, err)
+	}
+}
@@ -0,0 +1,243 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/sys"
+	"hash/fnv"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAliveFlushInterval = 5 * time.Second // DefaultAliveFlushInterval bounds the alive messages lost to a crash of the key server.
+	recordWriteShards         = 64              // recordWriteShards is the number of locks the writes of record files are spread over.
+)
+
+/*
+recordWriteShard orders the writes of the record files whose UUIDs hash to it. A record file is written under the lock
+of its shard rather than the database lock, so that retrieving keys does not wait for the disk.
+*/
+type recordWriteShard struct {
+	lock    sync.Mutex
+	written map[string]uint64 // write sequence number of the content most recently written to each record file
+}
+
+// recordWrite is the serialised content of a record, taken under the database lock and yet to be written to its file.
+type recordWrite struct {
+	uuid    string
+	content []byte
+	seq     uint64 // the write sequence number of the database at the moment the content was taken
+	doSync  bool
+}
+
+// Return the shard of the record file.
+func (db *DB) writeShard(uuid string) *recordWriteShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(uuid))
+	return &db.writeShards[hash.Sum32()%recordWriteShards]
+}
+
+// Serialise the record for a write to its file. Caller must hold the database lock.
+func (db *DB) prepareWrite(rec *Record, doSync bool) (recordWrite, error) {
+	if _, readOnly := db.readOnly[rec.UUID]; readOnly {
+		return recordWrite{}, ErrRecordReadOnly
+	}
+	content, err := db.serialiseRecord(rec)
+	if err != nil {
+		return recordWrite{}, err
+	}
+	db.writeSeq++
+	return recordWrite{uuid: rec.UUID, content: content, seq: db.writeSeq, doSync: doSync}, nil
+}
+
+/*
+Write the record content to its file, keeping the previous content as backup if asked to. The write is skipped if the
+file already has newer content, or if the record has been erased or reloaded from disk since the content was taken.
+The database lock may or may not be held by the caller.
+*/
+func (db *DB) writeRecordFile(w recordWrite, backup bool) error {
+	shard := db.writeShard(w.uuid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if w.seq <= shard.written[w.uuid] || w.seq <= db.reloadSeq {
+		return nil
+	}
+	// The record file is replaced as a whole, so that an interrupted write never leaves a truncated record behind.
+	if backup {
+		db.keepBackup(w.uuid)
+	}
+	if err := sys.ReplaceFile(path.Join(db.Dir, w.uuid), w.content, DB_REC_FILE_MODE, w.doSync); err != nil {
+		return err
+	}
+	db.markWritten(shard, w.uuid, w.seq)
+	return nil
+}
+
+// Remember the write sequence number of the record file's content. Caller must hold the shard lock.
+func (db *DB) markWritten(shard *recordWriteShard, uuid string, seq uint64) {
+	if shard.written == nil {
+		shard.written = make(map[string]uint64)
+	}
+	shard.written[uuid] = seq
+}
+
+/*
+Erase the record file, writes of the record that are still on their way are skipped from now on. Caller must hold the
+database lock.
+*/
+func (db *DB) eraseRecordFile(uuid string) error {
+	db.writeSeq++
+	delete(db.aliveDirty, uuid)
+	delete(db.readOnly, uuid)
+	shard := db.writeShard(uuid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	db.markWritten(shard, uuid, db.writeSeq)
+	return fs.SecureErase(path.Join(db.Dir, uuid), true)
+}
+
+/*
+Read the record file for a reload, writes of the record that are still on their way are skipped from now on so that
+they do not overwrite the file that was changed on disk. Caller must hold the database lock.
+*/
+func (db *DB) readRecordFileForReload(uuid string) (Record, error) {
+	db.writeSeq++
+	delete(db.aliveDirty, uuid)
+	shard := db.writeShard(uuid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	db.markWritten(shard, uuid, db.writeSeq)
+	return db.ReadRecord(path.Join(db.Dir, uuid))
+}
+
+/*
+Make writes of all records that are still on their way skip, ahead of reloading the whole database from disk. Caller
+must hold the database lock.
+*/
+func (db *DB) supersedeAllWrites() {
+	db.writeSeq++
+	db.aliveDirty = nil
+	for i := range db.writeShards {
+		db.writeShards[i].lock.Lock()
+	}
+	db.reloadSeq = db.writeSeq
+	for i := range db.writeShards {
+		db.writeShards[i].lock.Unlock()
+	}
+}
+
+/*
+Keep the record that has received an alive message in memory, and write it to disk by the next flush. Without alive
+flush in effect the record is written right away. Caller must hold the database lock.
+*/
+func (db *DB) upsertAlive(rec Record) {
+	if _, readOnly := db.readOnly[rec.UUID]; readOnly {
+		// The alive messages of a read-only record are only kept in memory
+		db.RecordsByUUID[rec.UUID] = rec
+		db.RecordsByID[rec.ID] = rec
+		return
+	} else if db.aliveFlushInterval <= 0 {
+		db.upsert(rec, false) // IO error is logged
+		return
+	}
+	if db.aliveDirty == nil {
+		db.aliveDirty = make(map[string]struct{})
+	}
+	db.RecordsByUUID[rec.UUID] = rec
+	db.RecordsByID[rec.ID] = rec
+	db.aliveDirty[rec.UUID] = struct{}{}
+}
+
+/*
+FlushAliveMessages writes the records whose alive messages have not yet been written to disk. The records are written
+without waiting for the disk, and those that fail to be written are tried again by the next flush. Return the first IO
+error, all of them are logged.
+*/
+func (db *DB) FlushAliveMessages() error {
+	db.Lock.Lock()
+	writes := make([]recordWrite, 0, len(db.aliveDirty))
+	for uuid := range db.aliveDirty {
+		if rec, exists := db.RecordsByUUID[uuid]; exists {
+			if w, err := db.prepareWrite(&rec, false); err != nil {
+				log.Printf("DB.FlushAliveMessages: failed to serialise record %s - %v", uuid, err)
+			} else {
+				writes = append(writes, w)
+			}
+		}
+	}
+	db.aliveDirty = nil
+	db.Lock.Unlock()
+
+	var firstErr error
+	for _, w := range writes {
+		if err := db.writeRecordFile(w, true); err != nil {
+			log.Printf("DB.FlushAliveMessages: failed to write db record file for %s, will try again later - %v", w.uuid, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			db.Lock.Lock()
+			if _, exists := db.RecordsByUUID[w.uuid]; exists {
+				if db.aliveDirty == nil {
+					db.aliveDirty = make(map[string]struct{})
+				}
+				db.aliveDirty[w.uuid] = struct{}{}
+			}
+			db.Lock.Unlock()
+		}
+	}
+	return firstErr
+}
+
+/*
+StartAliveFlush keeps alive messages in memory and writes them to disk at the interval, rather than writing the record
+upon each alive report. A crash loses at most the alive messages of an interval, changes to keys, access control, and
+other record details are still written right away. A zero interval writes alive messages upon each report.
+*/
+func (db *DB) StartAliveFlush(interval time.Duration) {
+	db.StopAliveFlush()
+	if interval <= 0 {
+		return
+	}
+	db.Lock.Lock()
+	db.aliveFlushInterval = interval
+	db.Lock.Unlock()
+	db.aliveFlushLock.Lock()
+	defer db.aliveFlushLock.Unlock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	db.aliveFlushStop, db.aliveFlushDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.FlushAliveMessages() // IO error is logged
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+StopAliveFlush stops the timer started by StartAliveFlush and writes the alive messages that are still in memory,
+alive messages are written upon each report from now on. Return the first IO error of the final flush.
+*/
+func (db *DB) StopAliveFlush() error {
+	db.aliveFlushLock.Lock()
+	if db.aliveFlushStop != nil {
+		close(db.aliveFlushStop)
+		<-db.aliveFlushDone
+		db.aliveFlushStop, db.aliveFlushDone = nil, nil
+	}
+	db.aliveFlushLock.Unlock()
+	db.Lock.Lock()
+	db.aliveFlushInterval = 0
+	db.Lock.Unlock()
+	return db.FlushAliveMessages()
+}
@@ -0,0 +1,222 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return the number of alive messages from the IP in the record file on disk.
+func aliveOnDisk(t testing.TB, db *DB, uuid, ip string) int {
+	rec, err := db.ReadRecord(path.Join(db.Dir, uuid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(rec.AliveMessages[ip])
+}
+
+func TestDB_AliveFlush(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{UUID: "a", Key: []byte("key"), MountPoint: "/a", AliveCount: 10,
+		AliveMessages: map[string][]AliveMessage{"1.1.1.1": {{IP: "1.1.1.1"}}}}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	// Without alive flush every report is written right away
+	db.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: 1}, "a")
+	if n := aliveOnDisk(t, db, "a", "1.1.1.1"); n != 2 {
+		t.Fatal(n)
+	}
+	// With alive flush the reports stay in memory until the flush
+	db.StartAliveFlush(time.Hour)
+	db.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: 2}, "a")
+	if inMem, _ := db.GetByUUID("a"); len(inMem.AliveMessages["1.1.1.1"]) != 3 {
+		t.Fatal(inMem.AliveMessages)
+	}
+	if n := aliveOnDisk(t, db, "a", "1.1.1.1"); n != 2 {
+		t.Fatal(n)
+	}
+	if err := db.FlushAliveMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if n := aliveOnDisk(t, db, "a", "1.1.1.1"); n != 3 {
+		t.Fatal(n)
+	}
+	// Record details are still written right away, along with the alive messages held in memory
+	db.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: 3}, "a")
+	digest := sha256.Sum256([]byte("key"))
+	if err := db.UpdateKey("a", digest[:], []byte("newkey")); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, err := db.ReadRecord(path.Join(db.Dir, "a")); err != nil || string(onDisk.Key) != "newkey" || len(onDisk.AliveMessages["1.1.1.1"]) != 4 {
+		t.Fatal(onDisk, err)
+	}
+	// Stopping the flush writes the remaining alive messages
+	db.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: 4}, "a")
+	if err := db.StopAliveFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := aliveOnDisk(t, db, "a", "1.1.1.1"); n != 5 {
+		t.Fatal(n)
+	}
+	db.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: 5}, "a")
+	if n := aliveOnDisk(t, db, "a", "1.1.1.1"); n != 6 {
+		t.Fatal(n)
+	}
+	// The timer flushes on its own
+	db.StartAliveFlush(10 * time.Millisecond)
+	defer db.StopAliveFlush()
+	db.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: 6}, "a")
+	for i := 0; aliveOnDisk(t, db, "a", "1.1.1.1") != 7; i++ {
+		if i > 500 {
+			t.Fatal("alive messages were not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDB_StaleWriteSkipped(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{UUID: "a", Key: []byte("key"), MountPoint: "/a"}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	// Content taken before a newer write must not overwrite it
+	db.Lock.Lock()
+	stale, err := db.prepareWrite(&rec, false)
+	db.Lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.MountPoint = "/b"
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.writeRecordFile(stale, true); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, err := db.ReadRecord(path.Join(db.Dir, "a")); err != nil || onDisk.MountPoint != "/b" {
+		t.Fatal(onDisk, err)
+	}
+	// Nor bring back an erased record
+	db.Lock.Lock()
+	stale, _ = db.prepareWrite(&rec, false)
+	db.Lock.Unlock()
+	if err := db.Erase("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.writeRecordFile(stale, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(db.Dir, "a")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Nor overwrite a record file that was changed on disk and reloaded
+	rec.UUID = "b"
+	rec.ID = ""
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	db.StartAliveFlush(time.Hour)
+	defer db.StopAliveFlush()
+	db.Lock.Lock()
+	stale, _ = db.prepareWrite(&rec, false)
+	db.Lock.Unlock()
+	edited := rec
+	edited.MountPoint = "/edited"
+	content, _ := db.serialiseRecord(&edited)
+	if err := ioutil.WriteFile(path.Join(db.Dir, "b"), content, DB_REC_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.writeRecordFile(stale, true); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, err := db.ReadRecord(path.Join(db.Dir, "b")); err != nil || onDisk.MountPoint != "/edited" {
+		t.Fatal(onDisk, err)
+	}
+}
+
+/*
+Measure key retrieval while the other records receive an alive message every millisecond each. Besides the mean, the
+99th percentile of retrieval latency is reported, as retrievals are held up by the alive messages written under the
+database lock.
+*/
+func benchmarkRetrievalWithAliveTraffic(b *testing.B, flushInterval time.Duration) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	const numRecords = 64
+	for i := 0; i < numRecords; i++ {
+		ip := "10.0.0." + strconv.Itoa(i)
+		rec := Record{UUID: "rec" + strconv.Itoa(i), Key: []byte("key"), MountPoint: "/a", AliveCount: 4,
+			AliveMessages: map[string][]AliveMessage{ip: {{IP: ip}}}}
+		if _, err := db.Upsert(rec); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.StartAliveFlush(flushInterval)
+	defer db.StopAliveFlush()
+	stop := make(chan struct{})
+	var reporters sync.WaitGroup
+	for i := 1; i < numRecords; i++ {
+		reporters.Add(1)
+		go func(i int) {
+			defer reporters.Done()
+			uuid, ip := "rec"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i)
+			for ts := int64(1); ; ts++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+					db.UpdateAliveMessage(AliveMessage{IP: ip, Timestamp: ts}, uuid)
+				}
+			}
+		}(i)
+	}
+	latencies := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		if _, found := db.GetByUUID("rec0"); !found {
+			b.Fatal("not found")
+		}
+		latencies[i] = time.Since(start)
+	}
+	b.StopTimer()
+	close(stop)
+	reporters.Wait()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkDB_GetByUUID_AliveWrittenUponReport(b *testing.B) {
+	benchmarkRetrievalWithAliveTraffic(b, 0)
+}
+
+func BenchmarkDB_GetByUUID_AliveFlushed(b *testing.B) {
+	benchmarkRetrievalWithAliveTraffic(b, DefaultAliveFlushInterval)
+}
@@ -0,0 +1,203 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_AUDIT_LOG = "AUDIT_LOG_PATH"
+
+	DefaultAuditLogPath = "/var/log/cryptctl2/audit.log" // DefaultAuditLogPath is the audit log location if configuration does not specify one.
+
+	AuditLogFileMode  = 0600 // AuditLogFileMode is the permission of newly created audit log file.
+	AuditLogQueueSize = 1024 // AuditLogQueueSize is the number of audit events buffered in memory until they are written.
+
+	AuditResultGranted  = "granted"  // AuditResultGranted means that a key or an action was handed out/performed.
+	AuditResultRejected = "rejected" // AuditResultRejected means that a key or an action was refused.
+	AuditResultMissing  = "missing"  // AuditResultMissing means that the requested record does not exist.
+	AuditResultFailed   = "failed"   // AuditResultFailed means that the action was allowed but did not succeed.
+)
+
+// AuditEvent is a single entry of the audit log, stored as one line of JSON.
+type AuditEvent struct {
+	Time             time.Time `json:"time"`                        // Time is the moment the event took place.
+	Event            string    `json:"event"`                       // Event is the name of the RPC call or administrative action.
+	IP               string    `json:"ip"`                          // IP is the peer IP as seen by the server, or "@" for the local domain socket.
+	CertCN           string    `json:"cert_cn"`                     // CertCN is the common name of certificate presented by the peer.
+	Hostname         string    `json:"hostname"`                    // Hostname is the host name reported by the peer itself.
+	UUID             string    `json:"uuid"`                        // UUID is the UUID of the key record concerned.
+	Result           string    `json:"result"`                      // Result is the outcome, one of AuditResult* constants.
+	Reason           string    `json:"reason,omitempty"`            // Reason is an optional human readable explanation of the outcome.
+	Peer             string    `json:"peer,omitempty"`              // Peer is the process, user, and group ID of the local peer connected via the domain socket.
+	IdentityMismatch bool      `json:"identity_mismatch,omitempty"` // IdentityMismatch is true if the host name reported by the peer disagrees with its validated certificate.
+}
+
+/*
+AuditLog appends audit events to a file in JSON lines format.
+Events are queued in memory and written by a background goroutine, so that RPC handling never waits for disk IO.
+Write failures (such as a full disk) are logged and tolerated.
+*/
+type AuditLog struct {
+	Path    string          // Path is the location of audit log file.
+	queue   chan AuditEvent // queue holds events that are yet to be written
+	done    chan struct{}   // done is closed once the background writer quits
+	closeMu sync.Mutex      // closeMu prevents events from being queued while the log is closing
+	closed  bool
+}
+
+/*
+NewAuditLog opens (or creates) the audit log file for appending and starts the background writer.
+If the path is empty, audit logging is disabled and nil is returned without an error; a nil audit log discards events.
+*/
+func NewAuditLog(logPath string) (*AuditLog, error) {
+	if logPath == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(path.Dir(logPath), 0700); err != nil {
+		return nil, fmt.Errorf("NewAuditLog: failed to make directory for \"%s\" - %v", logPath, err)
+	}
+	fh, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, AuditLogFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("NewAuditLog: failed to open \"%s\" - %v", logPath, err)
+	}
+	audit := &AuditLog{
+		Path:  logPath,
+		queue: make(chan AuditEvent, AuditLogQueueSize),
+		done:  make(chan struct{}),
+	}
+	go audit.writeLoop(fh)
+	return audit, nil
+}
+
+// writeLoop writes queued audit events into the file until the queue is closed.
+func (audit *AuditLog) writeLoop(fh *os.File) {
+	defer close(audit.done)
+	defer fh.Close()
+	writer := bufio.NewWriter(fh)
+	failing := false
+	for evt := range audit.queue {
+		line, err := json.Marshal(evt)
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		// Flush whenever the queue is drained so that the file is up to date during quiet periods
+		if err == nil && len(audit.queue) == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
+			if !failing {
+				log.Printf("AuditLog.writeLoop: failed to write audit log \"%s\", events are being lost - %v", audit.Path, err)
+			}
+			failing = true
+			// Discard the unwritten content and carry on writing the next event
+			writer.Reset(fh)
+		} else if failing {
+			log.Printf("AuditLog.writeLoop: audit log \"%s\" is being written again", audit.Path)
+			failing = false
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("AuditLog.writeLoop: failed to flush audit log \"%s\" - %v", audit.Path, err)
+	}
+}
+
+/*
+Record queues an audit event to be written. The timestamp is filled in if it is missing.
+The function never blocks - should the queue be full, the event is dropped and the loss is logged.
+*/
+func (audit *AuditLog) Record(evt AuditEvent) {
+	if audit == nil {
+		return
+	}
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+	audit.closeMu.Lock()
+	defer audit.closeMu.Unlock()
+	if audit.closed {
+		return
+	}
+	select {
+	case audit.queue <- evt:
+	default:
+		log.Printf("AuditLog.Record: audit queue is full, dropping event %+v", evt)
+	}
+}
+
+// Close writes all queued events into the file and stops the background writer.
+func (audit *AuditLog) Close() {
+	if audit == nil {
+		return
+	}
+	audit.closeMu.Lock()
+	if audit.closed {
+		audit.closeMu.Unlock()
+		return
+	}
+	audit.closed = true
+	close(audit.queue)
+	audit.closeMu.Unlock()
+	<-audit.done
+}
+
+// AuditFilter selects audit events, empty attributes match all events.
+type AuditFilter struct {
+	UUID  string    // UUID matches record UUID.
+	Host  string    // Host matches either the peer IP, certificate common name, or reported host name.
+	Since time.Time // Since matches events that took place at or after the moment.
+	Until time.Time // Until matches events that took place at or before the moment.
+}
+
+// Match returns true only if the audit event satisfies all filter criteria.
+func (filter AuditFilter) Match(evt AuditEvent) bool {
+	if filter.UUID != "" && evt.UUID != filter.UUID {
+		return false
+	}
+	if filter.Host != "" && evt.IP != filter.Host && evt.CertCN != filter.Host && evt.Hostname != filter.Host {
+		return false
+	}
+	if !filter.Since.IsZero() && evt.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && evt.Time.After(filter.Until) {
+		return false
+	}
+	return true
+}
+
+/*
+ReadAuditLog reads the audit log file and returns events that match the filter in chronological order.
+Lines that cannot be decoded (e.g. a line cut short by a full disk) are skipped.
+*/
+func ReadAuditLog(logPath string, filter AuditFilter) ([]AuditEvent, error) {
+	fh, err := os.Open(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAuditLog: failed to open \"%s\" - %v", logPath, err)
+	}
+	defer fh.Close()
+	events := make([]AuditEvent, 0, 64)
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var evt AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			continue
+		}
+		if filter.Match(evt) {
+			events = append(events, evt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return events, fmt.Errorf("ReadAuditLog: failed to read \"%s\" - %v", logPath, err)
+	}
+	return events, nil
+}
@@ -0,0 +1,93 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-audittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "audit", "audit.log")
+	// Disabled audit log discards everything
+	disabled, err := NewAuditLog("")
+	if err != nil || disabled != nil {
+		t.Fatal(disabled, err)
+	}
+	disabled.Record(AuditEvent{Event: "Ping"})
+	disabled.Close()
+	// Write some events in two sessions
+	begin := time.Now().Add(-time.Hour)
+	audit, err := NewAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Record(AuditEvent{Time: begin, Event: "AutoRetrieveKey", IP: "1.1.1.1", UUID: "a", Result: AuditResultGranted})
+	audit.Record(AuditEvent{Event: "AutoRetrieveKey", IP: "2.2.2.2", CertCN: "host2", UUID: "a", Result: AuditResultRejected})
+	audit.Close()
+	audit.Close()
+	audit.Record(AuditEvent{Event: "discarded after close"})
+	audit, err = NewAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Record(AuditEvent{Event: "EraseKey", IP: "1.1.1.1", Hostname: "host1", UUID: "b", Result: AuditResultGranted})
+	audit.Close()
+	// Read them back using filters
+	if events, err := ReadAuditLog(logPath, AuditFilter{}); err != nil || len(events) != 3 ||
+		events[0].Event != "AutoRetrieveKey" || events[2].Event != "EraseKey" {
+		t.Fatal(events, err)
+	}
+	if events, err := ReadAuditLog(logPath, AuditFilter{UUID: "a"}); err != nil || len(events) != 2 {
+		t.Fatal(events, err)
+	}
+	if events, err := ReadAuditLog(logPath, AuditFilter{Host: "host2"}); err != nil || len(events) != 1 || events[0].IP != "2.2.2.2" {
+		t.Fatal(events, err)
+	}
+	if events, err := ReadAuditLog(logPath, AuditFilter{Host: "1.1.1.1", Since: begin.Add(time.Minute)}); err != nil || len(events) != 1 || events[0].UUID != "b" {
+		t.Fatal(events, err)
+	}
+	if events, err := ReadAuditLog(logPath, AuditFilter{Until: begin}); err != nil || len(events) != 1 || events[0].UUID != "a" {
+		t.Fatal(events, err)
+	}
+	if _, err := ReadAuditLog(path.Join(dir, "doesnotexist"), AuditFilter{}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestAuditLogDoesNotBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-audittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := NewAuditLog(path.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recording many more events than the queue holds must not block the caller
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < AuditLogQueueSize*4; i++ {
+			audit.Record(AuditEvent{Event: "ReportAlive"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("recording audit events blocked")
+	}
+	audit.Close()
+	if events, err := ReadAuditLog(audit.Path, AuditFilter{}); err != nil || len(events) == 0 {
+		t.Fatal(len(events), err)
+	}
+}
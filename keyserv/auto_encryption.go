@@ -0,0 +1,44 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ReportAutoEncryptionReq tells the server that a client has encrypted the blank disk of a record on its own.
+type ReportAutoEncryptionReq struct {
+	Hostname string // Hostname is the host name reported by the computer itself.
+	UUID     string // UUID is the record of the disk.
+	Device   string // Device is the block device that was encrypted (for logging only).
+}
+
+/*
+ReportAutoEncryption writes down on the record and in the audit log that the client has encrypted the blank disk of the
+record, after retrieving its key by AutoRetrieveKey. Only the computer that most recently retrieved the key may report
+the encryption, and only if the record allows automatic encryption.
+*/
+func (rpcConn *CryptServiceConn) ReportAutoEncryption(req ReportAutoEncryptionReq, _ *DummyAttr) error {
+	if err := keydb.ValidateDeviceID(req.UUID); err != nil {
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		rpcConn.audit("AutoEncryption", req.Hostname, req.UUID, AuditResultMissing, "")
+		return fmt.Errorf("ReportAutoEncryption: record \"%s\" does not exist", req.UUID)
+	} else if rec.LastRetrieval.IP != rpcConn.RemoteHost {
+		rpcConn.audit("AutoEncryption", req.Hostname, req.UUID, AuditResultRejected, "the computer did not retrieve the key")
+		return fmt.Errorf("ReportAutoEncryption: %s is not the computer that most recently retrieved the key of \"%s\"", rpcConn.RemoteHost, req.UUID)
+	}
+	by := keydb.AliveMessage{Hostname: req.Hostname, CertName: rpcConn.CertCN, IP: rpcConn.RemoteHost, Timestamp: time.Now().Unix()}
+	if _, err := rpcConn.Svc.KeyDB.SetAutoEncryptedBy(rec.UUID, by); err != nil {
+		rpcConn.audit("AutoEncryption", req.Hostname, rec.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	rpcConn.audit("AutoEncryption", req.Hostname, rec.UUID, AuditResultGranted, "encrypted "+req.Device)
+	log.Printf("CryptServiceConn.ReportAutoEncryption: %s (%s) has encrypted the blank disk %s of %s", rpcConn.RemoteHost, req.Hostname, req.Device, rec.UUID)
+	return nil
+}
@@ -0,0 +1,50 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReportAutoEncryption(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "SERIAL:blank1", Key: []byte("key a"), MountPoint: "/a", AutoEncryption: true, FileSystem: "ext4", AliveIntervalSec: 10, AliveCount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}, Metrics: NewMetrics(db, false)}
+	client := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+	other := &CryptServiceConn{RemoteHost: "10.0.0.2", Svc: srv}
+	req := ReportAutoEncryptionReq{Hostname: "host1", UUID: "SERIAL:blank1", Device: "/dev/sdb"}
+	// Only the computer that retrieved the key may report the encryption
+	if err := client.ReportAutoEncryption(req, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	var resp AutoRetrieveKeyResp
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"SERIAL:blank1"}, Hostname: "host1"}, &resp); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(resp, err)
+	}
+	if err := other.ReportAutoEncryption(req, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ReportAutoEncryption(ReportAutoEncryptionReq{UUID: "SERIAL:unknown"}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ReportAutoEncryption(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("SERIAL:blank1"); !rec.IsAutoEncrypted() || rec.AutoEncryptedBy.IP != "10.0.0.1" || rec.AutoEncryptedBy.Hostname != "host1" {
+		t.Fatal(rec.AutoEncryptedBy)
+	}
+}
@@ -0,0 +1,534 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_BACKUP_DIR             = "KEYDB_BACKUP_DIR"
+	SRV_CONF_BACKUP_INTERVAL_HOURS  = "KEYDB_BACKUP_INTERVAL_HOURS"
+	SRV_CONF_BACKUP_KEEP            = "KEYDB_BACKUP_KEEP"
+	SRV_CONF_BACKUP_PUBLIC_KEY      = "KEYDB_BACKUP_PUBLIC_KEY_PEM"
+	SRV_CONF_BACKUP_MAIL_ON_FAILURE = "KEYDB_BACKUP_MAIL_ON_FAILURE"
+
+	DefaultBackupIntervalHours = 24 // DefaultBackupIntervalHours is the default number of hours between two scheduled backups.
+	DefaultBackupKeep          = 7  // DefaultBackupKeep is the default number of scheduled backups to keep.
+
+	BackupFilePrefix = "cryptctl2-keydb-" // BackupFilePrefix begins the name of each scheduled backup file.
+	BackupFileSuffix = ".tar.gz.enc"      // BackupFileSuffix ends the name of each scheduled backup file.
+
+	backupMagic            = "cryptctl2-keydb-backup-1\n"
+	backupMethodPassphrase = 'p' // backups of earlier versions derive the key from passphrase by PBKDF2
+	backupMethodScrypt     = 's'
+	backupMethodPublicKey  = 'k'
+	backupScryptCost       = 1 << 15
+	backupScryptBlockSize  = 8
+	backupPathSysconfig    = "sysconfig/cryptctl2-server"
+	backupPathRecords      = "keydb/"
+	backupRedacted         = "REDACTED"
+)
+
+/*
+BackupArchive is the content of a key database backup: the record files exactly as they are on disk, and the server
+configuration without mailer password. Records encrypted by key database master key remain encrypted in the archive,
+unless DecodeKeys has decrypted them.
+*/
+type BackupArchive struct {
+	Time      time.Time         // Time is the moment the backup was made.
+	Records   map[string][]byte // Records are the record file contents by file name.
+	Sysconfig string            // Sysconfig is the text of server configuration file.
+}
+
+// NewBackupArchive takes a snapshot of the key database and the server configuration text.
+func NewBackupArchive(db *keydb.DB, sysconfigText string) (BackupArchive, error) {
+	archive := BackupArchive{Time: time.Now()}
+	sysconf, err := sys.ParseSysconfig(sysconfigText)
+	if err != nil {
+		return archive, fmt.Errorf("NewBackupArchive: failed to parse server configuration - %v", err)
+	}
+	if sysconf.GetString(SRV_CONF_MAIL_AGENT_PASSWORD, "") != "" {
+		sysconf.Set(SRV_CONF_MAIL_AGENT_PASSWORD, backupRedacted)
+	}
+	archive.Sysconfig = sysconf.ToText()
+	if archive.Records, err = db.RecordFiles(); err != nil {
+		return archive, fmt.Errorf("NewBackupArchive: %v", err)
+	}
+	return archive, nil
+}
+
+/*
+DecodeKeys replaces each record file of the archive by the record carrying its key in plain, decrypted by the master key
+of the key database, so that the backup can be restored without the master key.
+*/
+func (archive *BackupArchive) DecodeKeys(db *keydb.DB) error {
+	for name, content := range archive.Records {
+		rec, err := db.DecodeRecord(content)
+		if err != nil {
+			return fmt.Errorf("DecodeKeys: failed to read record \"%s\" - %v", name, err)
+		}
+		archive.Records[name] = rec.Serialise()
+	}
+	return nil
+}
+
+// Derive the key of a backup from the passphrase and salt using scrypt.
+func backupPassphraseKey(passphrase string, salt []byte) []byte {
+	return keydb.ScryptKey([]byte(passphrase), salt, backupScryptCost, backupScryptBlockSize, 1, keydb.MasterKeyLen)
+}
+
+// Pack the archive into tar.gz.
+func (archive BackupArchive) pack() ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(archive.Records))
+	for name := range archive.Records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	add := func(name string, content []byte) error {
+		hdr := &tar.Header{Name: name, Mode: int64(keydb.DB_REC_FILE_MODE), Size: int64(len(content)), ModTime: archive.Time}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := add(backupPathSysconfig, []byte(archive.Sysconfig)); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := add(backupPathRecords+name, archive.Records[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unpack a tar.gz archive and make sure each record file can be deserialised and belongs to the record of its name.
+func unpackBackupArchive(packed []byte) (archive BackupArchive, err error) {
+	archive.Records = make(map[string][]byte)
+	gz, err := gzip.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		return archive, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return archive, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return archive, err
+		}
+		switch {
+		case hdr.Name == backupPathSysconfig:
+			archive.Sysconfig = string(content)
+			archive.Time = hdr.ModTime
+		case strings.HasPrefix(hdr.Name, backupPathRecords):
+			name := strings.TrimPrefix(hdr.Name, backupPathRecords)
+			if err := keydb.ValidateUUID(name); err != nil {
+				return archive, fmt.Errorf("record file \"%s\" has an illegal name", hdr.Name)
+			}
+			var rec keydb.Record
+			if err := rec.Deserialise(content); err != nil {
+				return archive, fmt.Errorf("record file \"%s\" is damaged - %v", hdr.Name, err)
+			} else if rec.UUID != name {
+				return archive, fmt.Errorf("record file \"%s\" carries a different record \"%s\"", hdr.Name, rec.UUID)
+			}
+			archive.Records[name] = content
+		default:
+			return archive, fmt.Errorf("unexpected file \"%s\"", hdr.Name)
+		}
+	}
+	if archive.Sysconfig == "" {
+		return archive, errors.New("server configuration is missing")
+	}
+	return archive, nil
+}
+
+// Encrypt the content with a random key using AES-GCM, the header is authenticated along.
+func sealBackup(header, key, content []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, header...), nonce...)
+	return gcm.Seal(sealed, nonce, content, header), nil
+}
+
+/*
+EncryptBackup packs the archive and encrypts it using AES-GCM, either with a key derived from the passphrase by scrypt,
+or with a random key that is in turn encrypted by the RSA public key. The public key is used if it is not nil.
+*/
+func EncryptBackup(archive BackupArchive, passphrase string, publicKey *rsa.PublicKey) ([]byte, error) {
+	packed, err := archive.pack()
+	if err != nil {
+		return nil, fmt.Errorf("EncryptBackup: failed to pack archive - %v", err)
+	}
+	header := []byte(backupMagic)
+	var key []byte
+	if publicKey != nil {
+		key = make([]byte, keydb.MasterKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, []byte(backupMagic))
+		if err != nil {
+			return nil, fmt.Errorf("EncryptBackup: failed to encrypt with public key - %v", err)
+		}
+		header = append(header, backupMethodPublicKey, 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(wrapped)))
+		header = append(header, wrapped...)
+	} else {
+		if passphrase == "" {
+			return nil, errors.New("EncryptBackup: either passphrase or public key is required")
+		}
+		salt := make([]byte, MasterKeySaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		key = backupPassphraseKey(passphrase, salt)
+		header = append(append(header, backupMethodScrypt), salt...)
+	}
+	return sealBackup(header, key, packed)
+}
+
+// BackupNeedsPrivateKey returns true if the encrypted backup can only be decrypted by a private key.
+func BackupNeedsPrivateKey(sealed []byte) (bool, error) {
+	if !bytes.HasPrefix(sealed, []byte(backupMagic)) || len(sealed) <= len(backupMagic) {
+		return false, errors.New("BackupNeedsPrivateKey: the file is not a cryptctl2 key database backup")
+	}
+	return sealed[len(backupMagic)] == backupMethodPublicKey, nil
+}
+
+/*
+DecryptBackup decrypts the backup with either the passphrase or the private key, unpacks it, and validates each record
+file in it. Passphrase backups made by earlier versions are decrypted too.
+*/
+func DecryptBackup(sealed []byte, passphrase string, privateKey *rsa.PrivateKey) (archive BackupArchive, err error) {
+	needsPrivateKey, err := BackupNeedsPrivateKey(sealed)
+	if err != nil {
+		return
+	}
+	pos := len(backupMagic) + 1
+	var key []byte
+	if needsPrivateKey {
+		if privateKey == nil {
+			return archive, errors.New("DecryptBackup: the backup is encrypted by a public key, its private key is required")
+		} else if len(sealed) < pos+2 {
+			return archive, errors.New("DecryptBackup: the backup is truncated")
+		}
+		wrappedLen := int(binary.BigEndian.Uint16(sealed[pos : pos+2]))
+		pos += 2
+		if len(sealed) < pos+wrappedLen {
+			return archive, errors.New("DecryptBackup: the backup is truncated")
+		}
+		if key, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, sealed[pos:pos+wrappedLen], []byte(backupMagic)); err != nil {
+			return archive, errors.New("DecryptBackup: the backup cannot be decrypted by the private key")
+		}
+		pos += wrappedLen
+	} else {
+		if len(sealed) < pos+MasterKeySaltLen {
+			return archive, errors.New("DecryptBackup: the backup is truncated")
+		}
+		switch salt := sealed[pos : pos+MasterKeySaltLen]; sealed[pos-1] {
+		case backupMethodScrypt:
+			key = backupPassphraseKey(passphrase, salt)
+		case backupMethodPassphrase:
+			key = keydb.DeriveMasterKey(passphrase, salt)
+		default:
+			return archive, errors.New("DecryptBackup: the backup is encrypted by an unknown method")
+		}
+		pos += MasterKeySaltLen
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+	if len(sealed) < pos+gcm.NonceSize() {
+		return archive, errors.New("DecryptBackup: the backup is truncated")
+	}
+	packed, err := gcm.Open(nil, sealed[pos:pos+gcm.NonceSize()], sealed[pos+gcm.NonceSize():], sealed[:pos])
+	if err != nil {
+		return archive, errors.New("DecryptBackup: the backup cannot be decrypted, is the passphrase correct?")
+	}
+	if archive, err = unpackBackupArchive(packed); err != nil {
+		return archive, fmt.Errorf("DecryptBackup: the backup is not valid - %v", err)
+	}
+	return archive, nil
+}
+
+// ReadBackupPublicKey reads an RSA public key from a PEM-encoded public key or certificate file.
+func ReadBackupPublicKey(pemFile string) (*rsa.PublicKey, error) {
+	content, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, fmt.Errorf("ReadBackupPublicKey: failed to read \"%s\" - %v", pemFile, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("ReadBackupPublicKey: \"%s\" is not PEM-encoded", pemFile)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("ReadBackupPublicKey: failed to parse certificate - %v", err)
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		if key, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("ReadBackupPublicKey: failed to parse public key - %v", err)
+		}
+	default:
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("ReadBackupPublicKey: failed to parse public key - %v", err)
+		}
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("ReadBackupPublicKey: \"%s\" does not carry an RSA public key", pemFile)
+	}
+	return rsaKey, nil
+}
+
+// ReadBackupPrivateKey reads an RSA private key from a PEM-encoded PKCS#1 or PKCS#8 file.
+func ReadBackupPrivateKey(pemFile string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, fmt.Errorf("ReadBackupPrivateKey: failed to read \"%s\" - %v", pemFile, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("ReadBackupPrivateKey: \"%s\" is not PEM-encoded", pemFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ReadBackupPrivateKey: failed to parse private key - %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("ReadBackupPrivateKey: \"%s\" does not carry an RSA private key", pemFile)
+	}
+	return rsaKey, nil
+}
+
+// BackupDiff tells what restoring a backup would change in the key database, each list carries record UUIDs.
+type BackupDiff struct {
+	New         []string // New records do not exist in the key database.
+	SameKey     []string // SameKey records exist with the same ID and key, restoring them only reverts their details.
+	Conflicting []string // Conflicting records exist with a different ID or key.
+}
+
+/*
+Compare the archive against the key database. The records of the archive are decrypted by the master key of the key
+database if they are encrypted, hence an error is returned if the archive was made with a different master key.
+*/
+func (archive BackupArchive) Compare(db *keydb.DB) (diff BackupDiff, err error) {
+	diff = BackupDiff{New: []string{}, SameKey: []string{}, Conflicting: []string{}}
+	for name, content := range archive.Records {
+		archived, err := db.DecodeRecord(content)
+		if err != nil {
+			return diff, fmt.Errorf("Compare: failed to read record \"%s\" of the backup - %v", name, err)
+		}
+		existing, found := db.GetByUUID(name)
+		if !found {
+			diff.New = append(diff.New, name)
+		} else if existing.ID == archived.ID && bytes.Equal(existing.Key, archived.Key) {
+			diff.SameKey = append(diff.SameKey, name)
+		} else {
+			diff.Conflicting = append(diff.Conflicting, name)
+		}
+	}
+	sort.Strings(diff.New)
+	sort.Strings(diff.SameKey)
+	sort.Strings(diff.Conflicting)
+	return
+}
+
+/*
+BackupScheduler periodically writes an encrypted backup of the key database into a directory, and removes the oldest
+backups beyond the number to keep. Scheduled backups are encrypted by a public key, so that they can be made without a
+passphrase.
+*/
+type BackupScheduler struct {
+	Dir           string         // Dir is the directory that receives the backups.
+	Interval      time.Duration  // Interval is the time between two backups.
+	Keep          int            // Keep is the number of most recent backups to keep.
+	PublicKey     *rsa.PublicKey // PublicKey encrypts the backups.
+	SysconfigPath string         // SysconfigPath is the location of server configuration file that goes into the backups.
+
+	srv  *CryptServer
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+/*
+StartBackupSchedule starts making backups periodically if a backup directory is configured, the first backup is made
+right away. The server configuration file at the path goes into each backup.
+*/
+func (srv *CryptServer) StartBackupSchedule(sysconfigPath string) error {
+	if srv.Config.BackupDir == "" {
+		return nil
+	}
+	publicKey, err := ReadBackupPublicKey(srv.Config.BackupPublicKeyPEM)
+	if err != nil {
+		return err
+	}
+	if err := sys.MkdirSecure(srv.Config.BackupDir); err != nil {
+		return fmt.Errorf("StartBackupSchedule: failed to make backup directory - %v", err)
+	}
+	srv.Backups = &BackupScheduler{
+		Dir:           srv.Config.BackupDir,
+		Interval:      time.Duration(srv.Config.BackupIntervalHours) * time.Hour,
+		Keep:          srv.Config.BackupKeep,
+		PublicKey:     publicKey,
+		SysconfigPath: sysconfigPath,
+		srv:           srv,
+		stop:          make(chan struct{}),
+	}
+	srv.Backups.done.Add(1)
+	go srv.Backups.run()
+	log.Printf("CryptServer.StartBackupSchedule: key database will be backed up into %s every %s", srv.Config.BackupDir, srv.Backups.Interval)
+	return nil
+}
+
+// Make a backup, then make another one after each interval until stopped.
+func (sched *BackupScheduler) run() {
+	defer sched.done.Done()
+	for {
+		sched.backupAndNotify()
+		select {
+		case <-sched.stop:
+			return
+		case <-time.After(sched.Interval):
+		}
+	}
+}
+
+// Make a backup and log the outcome, a failure is notified by email if it is enabled.
+func (sched *BackupScheduler) backupAndNotify() {
+	backupPath, err := sched.Backup()
+	if err == nil {
+		log.Printf("BackupScheduler: key database has been backed up to %s", backupPath)
+		return
+	}
+	log.Printf("BackupScheduler: failed to back up key database - %v", err)
+	sched.srv.configLock.RLock()
+	mailOnFailure := sched.srv.Config.BackupMailOnFailure
+	mailer := *sched.srv.Mailer
+	sched.srv.configLock.RUnlock()
+	if mailOnFailure && mailer.ValidateConfig() == nil {
+		text := fmt.Sprintf("The key server has failed to back up its key database into %s:\r\n\r\n%v\r\n", sched.Dir, err)
+		if err := mailer.Send("The key database could not be backed up", text); err != nil {
+			sched.srv.Metrics.CountMailerError()
+			log.Printf("BackupScheduler: failed to send email notification - %v", err)
+		}
+	}
+}
+
+// Backup writes a new backup into the directory and removes the oldest backups beyond the number to keep.
+func (sched *BackupScheduler) Backup() (backupPath string, err error) {
+	sysconfigText, err := ioutil.ReadFile(sched.SysconfigPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read server configuration - %v", err)
+	}
+	archive, err := NewBackupArchive(sched.srv.KeyDB, string(sysconfigText))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := EncryptBackup(archive, "", sched.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	backupPath = path.Join(sched.Dir, BackupFilePrefix+archive.Time.Format("20060102-150405")+BackupFileSuffix)
+	if err := sys.ReplaceFile(backupPath, sealed, sys.SecureFileMode, true); err != nil {
+		return "", err
+	}
+	return backupPath, sched.removeOldBackups()
+}
+
+// Remove the oldest scheduled backups beyond the number to keep.
+func (sched *BackupScheduler) removeOldBackups() error {
+	files, err := ioutil.ReadDir(sched.Dir)
+	if err != nil {
+		return err
+	}
+	backups := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), BackupFilePrefix) && strings.HasSuffix(file.Name(), BackupFileSuffix) {
+			backups = append(backups, file.Name())
+		}
+	}
+	// The names carry the time of backup, hence the oldest sort first.
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-sched.Keep; i++ {
+		if err := os.Remove(path.Join(sched.Dir, backups[i])); err != nil {
+			return fmt.Errorf("failed to remove old backup - %v", err)
+		}
+	}
+	return nil
+}
+
+// Stop making backups and wait for the backup in progress to finish. It does nothing if backup schedule is not enabled.
+func (sched *BackupScheduler) Stop() {
+	if sched == nil {
+		return
+	}
+	select {
+	case <-sched.stop:
+	default:
+		close(sched.stop)
+	}
+	sched.done.Wait()
+}
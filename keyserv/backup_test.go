@@ -0,0 +1,224 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := db.Upsert(keydb.Record{UUID: uuid, Key: []byte("key " + uuid), MountPoint: "/" + uuid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive, err := NewBackupArchive(db, "EMAIL_AGENT_PASSWORD=\"secret\"\nKEYDB_DIR=\"/a\"\n")
+	if err != nil || len(archive.Records) != 2 || strings.Contains(archive.Sysconfig, "secret") || !strings.Contains(archive.Sysconfig, "/a") {
+		t.Fatalf("%+v %v", archive, err)
+	}
+
+	// Passphrase
+	sealed, err := EncryptBackup(archive, "pass", nil)
+	if err != nil || bytes.Contains(sealed, []byte("key a")) {
+		t.Fatal(err)
+	}
+	if needs, err := BackupNeedsPrivateKey(sealed); needs || err != nil {
+		t.Fatal(needs, err)
+	}
+	if _, err := DecryptBackup(sealed, "wrong", nil); err == nil {
+		t.Fatal("did not error")
+	}
+	restored, err := DecryptBackup(sealed, "pass", nil)
+	if err != nil || !bytes.Equal(restored.Records["a"], archive.Records["a"]) || restored.Sysconfig != archive.Sysconfig {
+		t.Fatalf("%+v %v", restored, err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := DecryptBackup(sealed, "pass", nil); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Public key
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyDER, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKeyFile := path.Join(tmpDir, "public.pem")
+	privateKeyFile := path.Join(tmpDir, "private.pem")
+	ioutil.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER}), 0600)
+	ioutil.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600)
+	publicKey, err := ReadBackupPublicKey(publicKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readPrivateKey, err := ReadBackupPrivateKey(privateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed, err = EncryptBackup(archive, "", publicKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptBackup(sealed, "", nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if restored, err = DecryptBackup(sealed, "", readPrivateKey); err != nil || len(restored.Records) != 2 {
+		t.Fatal(err)
+	}
+
+	// Compare and import
+	rec, _ := db.GetByUUID("a")
+	rec.Key = []byte("rotated")
+	db.Upsert(rec)
+	db.Erase("b")
+	diff, err := restored.Compare(db)
+	if err != nil || len(diff.New) != 1 || diff.New[0] != "b" || len(diff.Conflicting) != 1 || len(diff.SameKey) != 0 {
+		t.Fatalf("%+v %v", diff, err)
+	}
+	b, err := db.DecodeRecord(restored.Records["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ImportRecord(b); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := db.GetByUUID("b"); string(found.Key) != "key b" {
+		t.Fatalf("%+v", found)
+	}
+	if diff, err = restored.Compare(db); err != nil || len(diff.SameKey) != 1 || len(diff.New) != 0 {
+		t.Fatalf("%+v %v", diff, err)
+	}
+}
+
+func TestBackupPlainKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDBWithMasterKey(path.Join(tmpDir, "keydb"), bytes.Repeat([]byte{7}, keydb.MasterKeyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := []string{"a", "b", "c"}
+	for _, uuid := range uuids {
+		if _, err := db.Upsert(keydb.Record{UUID: uuid, Key: []byte("key " + uuid), MountPoint: "/" + uuid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive, err := NewBackupArchive(db, "KEYDB_DIR=\"/a\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.DecodeKeys(db); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := EncryptBackup(archive, "passphrase", nil)
+	if err != nil || bytes.Contains(sealed, []byte("key a")) || sealed[len(backupMagic)] != backupMethodScrypt {
+		t.Fatal(err)
+	}
+	if _, err := DecryptBackup(sealed, "wrong passphrase", nil); err == nil || !strings.Contains(err.Error(), "passphrase") {
+		t.Fatal(err)
+	}
+	restored, err := DecryptBackup(sealed, "passphrase", nil)
+	if err != nil || len(restored.Records) != len(uuids) {
+		t.Fatal(err)
+	}
+	// The keys are restored into a database of a different master key
+	otherDB, err := keydb.OpenDBWithMasterKey(path.Join(tmpDir, "otherdb"), bytes.Repeat([]byte{8}, keydb.MasterKeyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range uuids {
+		rec, err := otherDB.DecodeRecord(restored.Records[uuid])
+		if err != nil {
+			t.Fatal(uuid, err)
+		}
+		if err := otherDB.ImportRecord(rec); err != nil {
+			t.Fatal(uuid, err)
+		}
+		original, _ := db.GetByUUID(uuid)
+		if found, _ := otherDB.GetByUUID(uuid); string(found.Key) != "key "+uuid || found.ID != original.ID || found.MountPoint != "/"+uuid {
+			t.Fatalf("%+v", found)
+		}
+	}
+
+	// A backup of an earlier version derives its key by PBKDF2
+	packed, err := archive.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := bytes.Repeat([]byte{1}, MasterKeySaltLen)
+	header := append(append([]byte(backupMagic), backupMethodPassphrase), salt...)
+	if sealed, err = sealBackup(header, keydb.DeriveMasterKey("passphrase", salt), packed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptBackup(sealed, "wrong passphrase", nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if restored, err = DecryptBackup(sealed, "passphrase", nil); err != nil || len(restored.Records) != len(uuids) {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupScheduler(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	tmpDir, err := ioutil.TempDir("", "cryptctl2-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sysconfigPath := path.Join(tmpDir, "sysconfig")
+	ioutil.WriteFile(sysconfigPath, []byte("KEYDB_DIR=\"/a\"\n"), 0600)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: "aaa", MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	sched := &BackupScheduler{Dir: tmpDir, Interval: time.Hour, Keep: 2, PublicKey: &privateKey.PublicKey, SysconfigPath: sysconfigPath, srv: server}
+	// Old backups beyond the number to keep are removed
+	for _, name := range []string{"20000101-000000", "20000102-000000"} {
+		ioutil.WriteFile(path.Join(tmpDir, BackupFilePrefix+name+BackupFileSuffix), []byte("old"), 0600)
+	}
+	backupPath, err := sched.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(tmpDir)
+	if len(files) != 3 {
+		t.Fatal(files)
+	}
+	if _, err := os.Stat(path.Join(tmpDir, BackupFilePrefix+"20000101-000000"+BackupFileSuffix)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	sealed, _ := ioutil.ReadFile(backupPath)
+	if archive, err := DecryptBackup(sealed, "", privateKey); err != nil || len(archive.Records) != 1 {
+		t.Fatal(err)
+	}
+	// Restoring over the network is refused even with the correct password
+	if err := client.ImportRecords(ImportRecordsReq{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+}
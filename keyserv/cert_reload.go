@@ -0,0 +1,138 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_TLS_CERT_WARN_DAYS = "TLS_CERT_EXPIRY_WARN_DAYS"
+
+	DefaultCertExpiryWarnDays = 30             // DefaultCertExpiryWarnDays is how many days before expiry of TLS certificate a warning is logged.
+	CertExpiryWarnInterval    = 24 * time.Hour // CertExpiryWarnInterval is the interval between two warnings of the same expiring certificate.
+)
+
+/*
+LoadServerCertificate reads the TLS certificate chain (the certificate followed by its intermediate CA certificates, all
+of which are presented to clients) and its private key. It returns an error if the key does not belong to the
+certificate, or the certificate is not yet or no longer valid.
+*/
+func LoadServerCertificate(certPath, keyPath string) (cert tls.Certificate, err error) {
+	if cert, err = tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		return cert, fmt.Errorf("LoadServerCertificate: failed to load TLS certificate \"%s\" and key \"%s\" - %v", certPath, keyPath, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return cert, fmt.Errorf("LoadServerCertificate: failed to parse TLS certificate \"%s\" - %v", certPath, err)
+	}
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return cert, fmt.Errorf("LoadServerCertificate: TLS certificate \"%s\" has expired on %s", certPath, cert.Leaf.NotAfter.Format(time.RFC3339))
+	} else if now.Before(cert.Leaf.NotBefore) {
+		return cert, fmt.Errorf("LoadServerCertificate: TLS certificate \"%s\" is not valid until %s", certPath, cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+/*
+CertReloader hands out the server's TLS certificate to each handshake, and reads the certificate and key again once
+either file has been modified, so that a renewed certificate takes effect without restarting the server. If the new
+files cannot be used, e.g. while only one of them has been replaced, the previous certificate is still handed out.
+*/
+type CertReloader struct {
+	CertPath string // CertPath is the PEM file of the certificate chain.
+	KeyPath  string // KeyPath is the PEM file of the private key.
+	WarnDays int    // WarnDays is how many days before expiry a warning is logged, 0 to never warn.
+
+	mutex          sync.Mutex
+	cert           *tls.Certificate
+	certModTime    time.Time // modification time of the certificate file as of the most recent attempt to load it
+	keyModTime     time.Time // modification time of the key file as of the most recent attempt to load it
+	lastExpiryWarn time.Time
+}
+
+// NewCertReloader loads the certificate and key for the first time, an error is returned if they are unusable.
+func NewCertReloader(certPath, keyPath string, warnDays int) (*CertReloader, error) {
+	reloader := &CertReloader{CertPath: certPath, KeyPath: keyPath, WarnDays: warnDays}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Return the modification time of the certificate and key files.
+func (reloader *CertReloader) modTimes() (certModTime, keyModTime time.Time, err error) {
+	certInfo, err := os.Stat(reloader.CertPath)
+	if err != nil {
+		return
+	}
+	keyInfo, err := os.Stat(reloader.KeyPath)
+	if err != nil {
+		return
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// Reload reads the certificate and key regardless of their modification time, e.g. upon SIGHUP.
+func (reloader *CertReloader) Reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	certModTime, keyModTime, _ := reloader.modTimes()
+	return reloader.load(certModTime, keyModTime)
+}
+
+// Load the certificate and key and remember the modification times they were loaded at. Caller must hold the lock.
+func (reloader *CertReloader) load(certModTime, keyModTime time.Time) error {
+	reloader.certModTime, reloader.keyModTime = certModTime, keyModTime
+	cert, err := LoadServerCertificate(reloader.CertPath, reloader.KeyPath)
+	if err != nil {
+		return err
+	}
+	if reloader.cert != nil {
+		log.Printf("CertReloader: now using TLS certificate \"%s\" (serial %s) valid until %s",
+			reloader.CertPath, cert.Leaf.SerialNumber, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	reloader.cert = &cert
+	reloader.lastExpiryWarn = time.Time{}
+	reloader.warnExpiry()
+	return nil
+}
+
+// Log a warning if the certificate is about to expire, at most once a day. Caller must hold the lock.
+func (reloader *CertReloader) warnExpiry() {
+	if reloader.WarnDays < 1 || time.Since(reloader.lastExpiryWarn) < CertExpiryWarnInterval {
+		return
+	}
+	if remaining := time.Until(reloader.cert.Leaf.NotAfter); remaining < time.Duration(reloader.WarnDays)*24*time.Hour {
+		log.Printf("CertReloader: WARNING - TLS certificate \"%s\" expires in %d days on %s, renew it soon",
+			reloader.CertPath, int(remaining.Hours()/24), reloader.cert.Leaf.NotAfter.Format(time.RFC3339))
+		reloader.lastExpiryWarn = time.Now()
+	}
+}
+
+// Certificate returns the certificate currently handed out to clients.
+func (reloader *CertReloader) Certificate() *tls.Certificate {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.cert
+}
+
+// GetCertificate is called by each TLS handshake, it loads the certificate again if the files have been modified since.
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	certModTime, keyModTime, err := reloader.modTimes()
+	if err == nil && (!certModTime.Equal(reloader.certModTime) || !keyModTime.Equal(reloader.keyModTime)) {
+		if err := reloader.load(certModTime, keyModTime); err != nil {
+			log.Printf("CertReloader: keep using the previous TLS certificate - %v", err)
+		}
+	}
+	reloader.warnExpiry()
+	return reloader.cert, nil
+}
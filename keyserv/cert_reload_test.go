@@ -0,0 +1,157 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Return a PEM-encoded certificate signed by the parent (self-signed if nil), and its PEM-encoded key.
+func makeTestCert(t *testing.T, serial int64, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (certPEM, keyPEM []byte, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), cert, key
+}
+
+// Write the files and give them a modification time that is certainly different from the previous one.
+func writeTestCert(t *testing.T, certPath string, certPEM []byte, keyPath string, keyPEM []byte, modTime time.Time) {
+	for name, content := range map[string][]byte{certPath: certPEM, keyPath: keyPEM} {
+		if err := ioutil.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Connect to the TLS listener and return the certificate chain it presents.
+func handshakeChain(t *testing.T, addr string) []*x509.Certificate {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates
+}
+
+func TestLoadServerCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	// Expired certificate
+	certPEM, keyPEM, _, _ := makeTestCert(t, 1, time.Now().Add(-time.Minute), nil, nil)
+	writeTestCert(t, certPath, certPEM, keyPath, keyPEM, time.Now())
+	if _, err := LoadServerCertificate(certPath, keyPath); err == nil {
+		t.Fatal("did not error on expired certificate")
+	}
+	// Key of another certificate
+	certPEM, _, _, _ = makeTestCert(t, 2, time.Now().Add(time.Hour), nil, nil)
+	writeTestCert(t, certPath, certPEM, keyPath, keyPEM, time.Now())
+	if _, err := LoadServerCertificate(certPath, keyPath); err == nil {
+		t.Fatal("did not error on mismatching key")
+	}
+	if _, err := NewCertReloader(certPath, keyPath, 0); err == nil {
+		t.Fatal("did not error on mismatching key")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	// The first certificate is issued by an intermediate CA, and the file carries the chain
+	_, _, caCert, caKey := makeTestCert(t, 10, time.Now().Add(48*time.Hour), nil, nil)
+	leafPEM, leafKeyPEM, _, _ := makeTestCert(t, 11, time.Now().Add(24*time.Hour), caCert, caKey)
+	chainPEM := append(leafPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCert(t, certPath, chainPEM, keyPath, leafKeyPEM, modTime)
+	reloader, err := NewCertReloader(certPath, keyPath, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: reloader.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+	if chain := handshakeChain(t, addr); len(chain) != 2 || chain[0].SerialNumber.Int64() != 11 || chain[1].SerialNumber.Int64() != 10 {
+		t.Fatal(chain)
+	}
+	// Only the certificate has been replaced so far, the previous one is still presented
+	renewedPEM, renewedKeyPEM, _, _ := makeTestCert(t, 12, time.Now().Add(24*time.Hour), nil, nil)
+	writeTestCert(t, certPath, renewedPEM, keyPath, leafKeyPEM, modTime.Add(time.Minute))
+	if chain := handshakeChain(t, addr); chain[0].SerialNumber.Int64() != 11 {
+		t.Fatal(chain[0].SerialNumber)
+	}
+	// Once the key follows, new handshakes get the renewed certificate without restart
+	writeTestCert(t, certPath, renewedPEM, keyPath, renewedKeyPEM, modTime.Add(2*time.Minute))
+	if chain := handshakeChain(t, addr); len(chain) != 1 || chain[0].SerialNumber.Int64() != 12 {
+		t.Fatal(chain)
+	}
+	if reloader.Certificate().Leaf.SerialNumber.Int64() != 12 {
+		t.Fatal(reloader.Certificate().Leaf.SerialNumber)
+	}
+	// A forced reload reads the files even if they seem unmodified
+	writeTestCert(t, certPath, leafPEM, keyPath, leafKeyPEM, modTime.Add(2*time.Minute))
+	if err := reloader.Reload(); err != nil || reloader.Certificate().Leaf.SerialNumber.Int64() != 11 {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_MAIL_CLIENT_ERROR      = "EMAIL_CLIENT_ERROR_NOTIFICATION"
+	SRV_CONF_MAIL_CLIENT_ERROR_SUBJ = "EMAIL_CLIENT_ERROR_SUBJECT"
+
+	MaxClientErrorClassLen   = 64   // MaxClientErrorClassLen is the maximum length of the class of a client error.
+	MaxClientErrorMessageLen = 1024 // MaxClientErrorMessageLen is the maximum length of a client error message, longer messages are cut short.
+	ClientErrorRateLimit     = 20   // ClientErrorRateLimit is the number of client errors accepted from one client in each period.
+	ClientErrorRatePeriodSec = 3600 // ClientErrorRatePeriodSec is the period of ClientErrorRateLimit.
+)
+
+// ErrClientErrorRateLimited is returned to a client that reports more errors than ClientErrorRateLimit allows.
+var ErrClientErrorRateLimited = errors.New("too many error reports, the report has been discarded")
+
+// RegexClientErrorClass matches a valid class of client error, e.g. "mount" or "device-not-found".
+var RegexClientErrorClass = regexp.MustCompile("^[a-z0-9-]+$")
+
+/*
+RateLimiter admits up to a number of events from each identity within a sliding period. Identities that have not
+been seen for longer than the period are forgotten.
+*/
+type RateLimiter struct {
+	Limit  int           // Limit is the number of events admitted from one identity in each period.
+	Period time.Duration // Period is the length of the sliding period.
+	lock   *sync.Mutex
+	events map[string][]time.Time
+}
+
+// NewRateLimiter returns a rate limiter that admits limit number of events from each identity in each period.
+func NewRateLimiter(limit int, period time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Period: period, lock: new(sync.Mutex), events: make(map[string][]time.Time)}
+}
+
+// Allow returns true and counts the event only if the identity has not yet used up its limit in the current period.
+func (limiter *RateLimiter) Allow(identity string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	for id := range limiter.events {
+		limiter.events[id] = limiter.recent(id, now)
+		if len(limiter.events[id]) == 0 {
+			delete(limiter.events, id)
+		}
+	}
+	if len(limiter.events[identity]) >= limiter.Limit {
+		return false
+	}
+	limiter.events[identity] = append(limiter.events[identity], now)
+	return true
+}
+
+// Return the events of the identity that still fall within the period. Caller must hold the lock.
+func (limiter *RateLimiter) recent(identity string, now time.Time) []time.Time {
+	events := limiter.events[identity]
+	for len(events) > 0 && now.Sub(events[0]) >= limiter.Period {
+		events = events[1:]
+	}
+	return events
+}
@@ -0,0 +1,30 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(2, time.Second)
+	if !limiter.Allow("a") || !limiter.Allow("a") {
+		t.Fatal("should have allowed")
+	}
+	if limiter.Allow("a") {
+		t.Fatal("should not have allowed")
+	}
+	// Identities are limited independently
+	if !limiter.Allow("b") {
+		t.Fatal("should have allowed")
+	}
+	// The limit is lifted after the period
+	time.Sleep(1100 * time.Millisecond)
+	if !limiter.Allow("a") {
+		t.Fatal("should have allowed")
+	}
+	if _, found := limiter.events["b"]; found {
+		t.Fatal("did not forget idle identity")
+	}
+}
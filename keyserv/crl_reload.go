@@ -0,0 +1,138 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ParseRevocationList parses the PEM (or DER) certificate revocation list and verifies its signature by the CA
+certificates whose subject issued it. The CRLs of CAs generated before the CA certificate carried the CRL signing key
+usage are accepted as long as their signature is good.
+*/
+func ParseRevocationList(crlContent []byte, caCerts []*x509.Certificate) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(crlContent); block != nil {
+		crlContent = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(crlContent)
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range caCerts {
+		if !bytes.Equal(ca.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		// RevocationList.CheckSignatureFrom would insist on the CRL signing key usage
+		if err := ca.CheckSignature(crl.SignatureAlgorithm, crl.RawTBSRevocationList, crl.Signature); err != nil {
+			return nil, fmt.Errorf("the signature of the revocation list is invalid - %v", err)
+		}
+		return crl, nil
+	}
+	return nil, errors.New("the revocation list is not issued by the certificate authority")
+}
+
+/*
+CRLReloader turns away the client certificates revoked by a certificate revocation list, and reads the list again once
+its file has been modified, so that a revocation takes effect without restarting the server. A missing file revokes
+nothing, and if the new list cannot be used, the previous one stays in effect.
+*/
+type CRLReloader struct {
+	CRLPath string // CRLPath is the PEM file of the certificate revocation list.
+	CAPath  string // CAPath is the PEM file of the certificate authorities that issue client certificates and the list.
+
+	mutex   sync.Mutex
+	modTime time.Time           // modification time of the list file as of the most recent attempt to load it
+	revoked map[string]struct{} // serial numbers of the revoked certificates in decimal
+}
+
+// NewCRLReloader loads the revocation list for the first time, an error is returned if the list exists but is unusable.
+func NewCRLReloader(crlPath, caPath string) (*CRLReloader, error) {
+	reloader := &CRLReloader{CRLPath: crlPath, CAPath: caPath, revoked: map[string]struct{}{}}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the revocation list regardless of its modification time, e.g. upon SIGHUP.
+func (reloader *CRLReloader) Reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	var modTime time.Time
+	if info, err := os.Stat(reloader.CRLPath); err == nil {
+		modTime = info.ModTime()
+	}
+	return reloader.load(modTime)
+}
+
+// Load the revocation list and remember the modification time it was loaded at. Caller must hold the lock.
+func (reloader *CRLReloader) load(modTime time.Time) error {
+	reloader.modTime = modTime
+	crlContent, err := os.ReadFile(reloader.CRLPath)
+	if os.IsNotExist(err) {
+		reloader.revoked = map[string]struct{}{}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("CRLReloader: failed to read revocation list \"%s\" - %v", reloader.CRLPath, err)
+	}
+	caContent, err := os.ReadFile(reloader.CAPath)
+	if err != nil {
+		return fmt.Errorf("CRLReloader: failed to read certificate authority \"%s\" - %v", reloader.CAPath, err)
+	}
+	var caCerts []*x509.Certificate
+	for block, rest := pem.Decode(caContent); block != nil; block, rest = pem.Decode(rest) {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			caCerts = append(caCerts, cert)
+		}
+	}
+	crl, err := ParseRevocationList(crlContent, caCerts)
+	if err != nil {
+		return fmt.Errorf("CRLReloader: revocation list \"%s\" is unusable - %v", reloader.CRLPath, err)
+	}
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificates))
+	for _, entry := range crl.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+	if len(revoked) != len(reloader.revoked) {
+		log.Printf("CRLReloader: now turning away %d revoked client certificates listed by \"%s\"", len(revoked), reloader.CRLPath)
+	}
+	reloader.revoked = revoked
+	return nil
+}
+
+// IsRevoked returns true if the certificate of the serial number is revoked, it loads the list again if the file has been modified since.
+func (reloader *CRLReloader) IsRevoked(serial *big.Int) bool {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	var modTime time.Time
+	if info, err := os.Stat(reloader.CRLPath); err == nil {
+		modTime = info.ModTime()
+	}
+	if !modTime.Equal(reloader.modTime) {
+		if err := reloader.load(modTime); err != nil {
+			log.Printf("CRLReloader: keep using the previous revocation list - %v", err)
+		}
+	}
+	_, revoked := reloader.revoked[serial.String()]
+	return revoked
+}
+
+// VerifyPeerCertificate is called by each TLS handshake after the client certificate is verified, it refuses a revoked certificate.
+func (reloader *CRLReloader) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if len(chain) > 0 && reloader.IsRevoked(chain[0].SerialNumber) {
+			return fmt.Errorf("client certificate \"%s\" (serial %s) has been revoked", chain[0].Subject.CommonName, chain[0].SerialNumber)
+		}
+	}
+	return nil
+}
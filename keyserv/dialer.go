@@ -0,0 +1,268 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"cryptctl2/sys"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	CLIENT_CONF_BIND_ADDRESS = "KEY_SERVER_BIND_ADDRESS"
+	CLIENT_CONF_PROXY        = "KEY_SERVER_PROXY"
+)
+
+/*
+ConnectionSettings are the client's settings of reaching the key servers over TCP. On a multi-homed computer the bind
+address makes the connections originate from the interface the key server firewall expects, which is also the IP the
+key server records for the computer. A proxy is contacted from the bind address in place of the key server.
+*/
+type ConnectionSettings struct {
+	BindAddress string // BindAddress is the local IP connections originate from, empty to let the kernel choose.
+	Proxy       string // Proxy is "socks5://[user:pass@]host:port" or "http://[user:pass@]host:port" (CONNECT), empty to connect directly.
+}
+
+// ConnectionSettingsFromSysconfig reads the settings of reaching the key servers from client sysconfig.
+func ConnectionSettingsFromSysconfig(sysconf *sys.Sysconfig) ConnectionSettings {
+	return ConnectionSettings{
+		BindAddress: sysconf.GetString(CLIENT_CONF_BIND_ADDRESS, ""),
+		Proxy:       sysconf.GetString(CLIENT_CONF_PROXY, ""),
+	}
+}
+
+// Return an error if the IP is not assigned to any network interface of this computer.
+func checkLocalAddress(ip net.IP) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list network interface addresses - %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("bind address %s is not present on any network interface of this computer", ip)
+}
+
+/*
+SetConnection changes how the client reaches the key servers over TCP, see ConnectionSettings. A bind address that is
+not present on any network interface, or a malformed proxy, is an error right away rather than on the first RPC.
+*/
+func (client *CryptClient) SetConnection(settings ConnectionSettings) error {
+	client.localAddr = nil
+	client.proxy = nil
+	if settings.BindAddress != "" {
+		ip := net.ParseIP(settings.BindAddress)
+		if ip == nil {
+			return fmt.Errorf("SetConnection: bind address \"%s\" is not an IP address", settings.BindAddress)
+		}
+		if err := checkLocalAddress(ip); err != nil {
+			return fmt.Errorf("SetConnection: %v", err)
+		}
+		client.localAddr = &net.TCPAddr{IP: ip}
+	}
+	if settings.Proxy != "" {
+		proxy, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return fmt.Errorf("SetConnection: failed to parse proxy \"%s\" - %v", settings.Proxy, err)
+		}
+		if proxy.Scheme != "socks5" && proxy.Scheme != "http" {
+			return fmt.Errorf("SetConnection: proxy \"%s\" must begin with socks5:// or http://", settings.Proxy)
+		}
+		if _, port, err := net.SplitHostPort(proxy.Host); err != nil || port == "" {
+			return fmt.Errorf("SetConnection: proxy \"%s\" lacks the port number", settings.Proxy)
+		}
+		client.proxy = proxy
+	}
+	return nil
+}
+
+// LocalAddress returns the bind address TCP connections originate from, or an empty string if the kernel chooses it.
+func (client *CryptClient) LocalAddress() string {
+	if client.localAddr == nil {
+		return ""
+	}
+	return client.localAddr.IP.String()
+}
+
+// Establish a TLS connection to the key server at the address, from the bind address and via the proxy if they are set.
+func (client *CryptClient) dialTCP(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second}
+	if client.localAddr != nil {
+		dialer.LocalAddr = client.localAddr
+	}
+	if client.proxy == nil {
+		return tls.DialWithDialer(dialer, "tcp", address, client.tlsConfigFor(address))
+	}
+	conn, err := dialer.Dial("tcp", client.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s - %v", client.proxy.Host, err)
+	}
+	// The proxy handshake and TLS handshake share the dial timeout
+	conn.SetDeadline(time.Now().Add(RPC_DIAL_TIMEOUT_SEC * time.Second))
+	if client.proxy.Scheme == "socks5" {
+		err = socks5Connect(conn, address, client.proxy.User)
+	} else {
+		conn, err = httpConnect(conn, address, client.proxy.User)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s failed to connect to %s - %v", client.proxy.Host, address, err)
+	}
+	tlsConn := tls.Client(conn, client.tlsConfigFor(address))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+/*
+Return the TLS settings of a connection to the key server at the address, which verify the server by the host name or IP
+it is contacted by unless the settings name the server. The name is given to the replacement of the built-in
+verification too, as the connection state does not tell an IP.
+*/
+func (client *CryptClient) tlsConfigFor(address string) *tls.Config {
+	tlsConfig := client.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConfig.ServerName = host
+	}
+	if verify := client.verifyServer; verify != nil {
+		host := tlsConfig.ServerName
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verify(state, host)
+		}
+	}
+	return tlsConfig
+}
+
+// Ask the SOCKS5 proxy on the connection to connect to the address (RFC 1928), with user name and password (RFC 1929) if given.
+func socks5Connect(conn net.Conn, address string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	method := byte(0x00) // no authentication
+	if user != nil {
+		method = 0x02 // user name and password
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("SOCKS5 proxy does not accept the authentication method")
+	}
+	if user != nil {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 user name or password is too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 proxy rejected the user name and password")
+		}
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name is too long for SOCKS5")
+		}
+		// The proxy resolves the host name
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	// The reply carries the bound address, which is of no interest
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy replied with error code %d", head[1])
+	}
+	var boundLen int
+	switch head[3] {
+	case 0x01:
+		boundLen = net.IPv4len
+	case 0x04:
+		boundLen = net.IPv6len
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return err
+		}
+		boundLen = int(lenByte[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy replied with unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundLen+2))
+	return err
+}
+
+// bufferedConn reads what the HTTP response reader has buffered before reading from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// Ask the HTTP proxy on the connection to connect to the address by the CONNECT method, return the tunnelled connection.
+func httpConnect(conn net.Conn, address string, user *url.Userinfo) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if user != nil {
+		password, _ := user.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return conn, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("HTTP proxy replied %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
@@ -0,0 +1,242 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	DoctorPass = "PASS" // DoctorPass means the check found nothing wrong.
+	DoctorWarn = "WARN" // DoctorWarn means the check found something that works for now but deserves attention.
+	DoctorFail = "FAIL" // DoctorFail means the check found something that stops cryptctl2 from working.
+
+	DoctorCertExpiryWarning = 30 * 24 * time.Hour // DoctorCertExpiryWarning is how long before its expiry a certificate is warned of.
+)
+
+// DoctorFinding is the outcome of one check of the doctor action.
+type DoctorFinding struct {
+	Check  string `json:"check"`          // Check names what was checked.
+	Result string `json:"result"`         // Result is DoctorPass, DoctorWarn, or DoctorFail.
+	Detail string `json:"detail"`         // Detail tells what was found.
+	Hint   string `json:"hint,omitempty"` // Hint tells how to remedy a warning or failure.
+}
+
+// NewDoctorFinding returns a finding of the check, the hint is only kept for a warning or failure.
+func NewDoctorFinding(check, result, detail, hint string) DoctorFinding {
+	if result == DoctorPass {
+		hint = ""
+	}
+	return DoctorFinding{Check: check, Result: result, Detail: detail, Hint: hint}
+}
+
+// DoctorFailed returns true if any of the findings is a failure.
+func DoctorFailed(findings []DoctorFinding) bool {
+	for _, finding := range findings {
+		if finding.Result == DoctorFail {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+DiagnoseCertificate checks that the certificate and key files make a pair, and that the certificate is valid at the
+moment and does not expire soon. The key file may be empty to only check a CA certificate.
+*/
+func DiagnoseCertificate(check, certPath, keyPath string, now time.Time) DoctorFinding {
+	var cert *x509.Certificate
+	if keyPath != "" {
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" and \"%s\" cannot be used together - %v", certPath, keyPath, err),
+				"make sure the key file is the one the certificate was issued for, both in PEM format")
+		}
+		if cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" cannot be parsed - %v", certPath, err), "replace the certificate")
+		}
+	} else if notAfter := getCertNotAfter(certPath); notAfter.IsZero() {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" does not carry a readable certificate", certPath), "replace the certificate")
+	} else {
+		cert = &x509.Certificate{NotAfter: notAfter}
+	}
+	switch {
+	case !cert.NotBefore.IsZero() && now.Before(cert.NotBefore):
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" is not valid until %s", certPath, cert.NotBefore.Format(time.RFC3339)),
+			"check the clock of this computer, or wait until the certificate becomes valid")
+	case now.After(cert.NotAfter):
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" expired on %s", certPath, cert.NotAfter.Format(time.RFC3339)), "renew the certificate")
+	case cert.NotAfter.Sub(now) < DoctorCertExpiryWarning:
+		return NewDoctorFinding(check, DoctorWarn, fmt.Sprintf("\"%s\" expires on %s", certPath, cert.NotAfter.Format(time.RFC3339)), "renew the certificate soon")
+	}
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("\"%s\" is valid until %s", certPath, cert.NotAfter.Format(time.RFC3339)), "")
+}
+
+/*
+DiagnoseKeyDBFiles checks that the key database directory exists, belongs to the user running the check, can be
+written, and is not accessible by other users.
+*/
+func DiagnoseKeyDBFiles(dir string) DoctorFinding {
+	const check = "key database permissions"
+	st, err := os.Stat(dir)
+	if err != nil {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("cannot inspect \"%s\" - %v", dir, err), "run init-server, or correct "+SRV_CONF_KEYDB_DIR)
+	} else if !st.IsDir() {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" is not a directory", dir), "correct "+SRV_CONF_KEYDB_DIR)
+	}
+	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok && int(sysStat.Uid) != os.Geteuid() {
+		return NewDoctorFinding(check, DoctorWarn, fmt.Sprintf("\"%s\" belongs to user ID %d rather than %d", dir, sysStat.Uid, os.Geteuid()),
+			fmt.Sprintf("run chown -R %d \"%s\" so that the key server is able to write the records", os.Geteuid(), dir))
+	}
+	if probe, err := ioutil.TempFile(dir, ".doctor-"); err != nil {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("\"%s\" cannot be written - %v", dir, err),
+			"make the directory writable by the user that runs the key server, and check that its file system is not read-only")
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	loose, err := sys.FindLooseFileModes(dir, sys.SecureFileMode, sys.SecureDirMode)
+	if err != nil {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("cannot inspect the files of \"%s\" - %v", dir, err), "check that the directory is readable")
+	} else if len(loose) > 0 {
+		return NewDoctorFinding(check, DoctorWarn, fmt.Sprintf("%d files of \"%s\" are accessible by other users, e.g. \"%s\"", len(loose), dir, loose[0]),
+			fmt.Sprintf("run chmod -R go-rwx \"%s\"", dir))
+	}
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("\"%s\" is only accessible by its owner", dir), "")
+}
+
+// DiagnoseKeyDB checks that all records of the opened key database have been loaded and can be written.
+func DiagnoseKeyDB(db *keydb.DB) []DoctorFinding {
+	const check = "key database records"
+	findings := make([]DoctorFinding, 0, 2)
+	if len(db.LoadErrors) > 0 {
+		for _, loadErr := range db.LoadErrors {
+			findings = append(findings, NewDoctorFinding(check, DoctorFail, fmt.Sprintf("record file \"%s\" cannot be loaded - %s", loadErr.FileName, loadErr.Error),
+				"run fsck-keydb, and fsck-keydb -restore to bring back the previous version of the record"))
+		}
+	} else {
+		findings = append(findings, NewDoctorFinding(check, DoctorPass, fmt.Sprintf("%d records are loaded", len(db.RecordsByUUID)), ""))
+	}
+	if readOnly := db.ReadOnlyRecords(); len(readOnly) > 0 {
+		findings = append(findings, NewDoctorFinding(check, DoctorWarn, fmt.Sprintf("%d records are served read-only", len(readOnly)),
+			"run migrate-keydb once all key servers run this version of cryptctl2"))
+	}
+	return findings
+}
+
+// DiagnoseMailer checks that the mailer settings are either complete or absent, without sending an email.
+func DiagnoseMailer(mailer Mailer) DoctorFinding {
+	const check = "email notification"
+	if len(mailer.Recipients) == 0 && mailer.AgentAddressPort == "" {
+		return NewDoctorFinding(check, DoctorWarn, "email notification is not configured", "run init-server to have key events notified by email")
+	} else if err := mailer.ValidateConfig(); err != nil {
+		return NewDoctorFinding(check, DoctorFail, err.Error(), "correct the email settings in "+SRV_CONF_MAIL_RECIPIENTS+" and the related settings")
+	}
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("notifications are sent via %s to %d recipients", mailer.AgentAddressPort, len(mailer.Recipients)), "")
+}
+
+// DiagnoseMailAgent connects to the mail agent and logs in the way notifications are sent, without sending an email.
+func DiagnoseMailAgent(mailer Mailer) DoctorFinding {
+	const check = "mail agent"
+	if err := mailer.Probe(); err != nil {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("%s cannot be used - %v", mailer.AgentAddressPort, err),
+			"check that the mail agent is reachable, and that the TLS mode, CA, and credentials match its settings")
+	}
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("%s accepts the connection", mailer.AgentAddressPort), "")
+}
+
+/*
+DiagnoseListenPort checks that the key server is able to listen on its address and port. A port taken by another
+program is only warned of, as it is most likely taken by the key server that is already running.
+*/
+func DiagnoseListenPort(address string, port int) DoctorFinding {
+	const check = "listen port"
+	addrPort := net.JoinHostPort(address, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addrPort)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return NewDoctorFinding(check, DoctorWarn, fmt.Sprintf("%s is already in use", addrPort),
+			"that is fine if the key server is running, otherwise find the program using the port with \"ss -ltnp\"")
+	} else if err != nil {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("cannot listen on %s - %v", addrPort, err),
+			"correct "+SRV_CONF_LISTEN_ADDR+" and "+SRV_CONF_LISTEN_PORT)
+	}
+	listener.Close()
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("%s is free to listen on", addrPort), "")
+}
+
+// DiagnoseKMIP checks that the external KMIP server, if one is configured, answers a query.
+func DiagnoseKMIP(conf CryptServiceConfig) DoctorFinding {
+	const check = "KMIP server"
+	if len(conf.KMIPAddresses) == 0 {
+		return NewDoctorFinding(check, DoctorPass, "keys are stored by the built-in KMIP server", "")
+	}
+	client, err := NewExternalKMIPClient(conf)
+	if err != nil {
+		return NewDoctorFinding(check, DoctorFail, err.Error(), "correct the KMIP settings, such as "+SRV_CONF_KMIP_SERVER_ADDRS)
+	}
+	info, err := client.Query()
+	if err != nil {
+		return NewDoctorFinding(check, DoctorFail, fmt.Sprintf("KMIP server did not answer - %v", err),
+			"check that the KMIP server is running and reachable through the firewall, and that its CA and credentials are correct")
+	}
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("%s (%s) answers", info.Address, info.Vendor), "")
+}
+
+// DiagnoseServerConfig checks that the key server configuration is complete and the initial setup has been done.
+func DiagnoseServerConfig(conf CryptServiceConfig) DoctorFinding {
+	const check = "server configuration"
+	if err := conf.Validate(); err != nil {
+		return NewDoctorFinding(check, DoctorFail, err.Error(), "run init-server, or correct the setting in the configuration file")
+	} else if err := checkPasswordParams(conf.PasswordSalt, conf.PasswordHash); err != nil {
+		return NewDoctorFinding(check, DoctorFail, err.Error(), "run init-server to set the access password")
+	}
+	return NewDoctorFinding(check, DoctorPass, fmt.Sprintf("listens on %s:%d, keeps keys in \"%s\"", conf.Address, conf.Port, conf.KeyDBDir), "")
+}
+
+/*
+DiagnoseServer runs all checks of the key server configuration, the certificates, the key database, the listen port,
+the KMIP server, and the email notification, without contacting the running key server. The key database is opened by the master key in
+the configuration, if there is one.
+*/
+func DiagnoseServer(conf CryptServiceConfig, mailer Mailer, now time.Time) []DoctorFinding {
+	findings := []DoctorFinding{DiagnoseServerConfig(conf)}
+	if conf.CertPEM != "" && conf.KeyPEM != "" {
+		findings = append(findings, DiagnoseCertificate("server certificate", conf.CertPEM, conf.KeyPEM, now))
+	}
+	if conf.CertAuthorityPEM != "" {
+		findings = append(findings, DiagnoseCertificate("CA certificate", conf.CertAuthorityPEM, "", now))
+	}
+	if conf.KeyDBDir != "" {
+		dbFiles := DiagnoseKeyDBFiles(conf.KeyDBDir)
+		findings = append(findings, dbFiles)
+		if dbFiles.Result != DoctorFail {
+			if db, err := keydb.OpenDBWithMasterKey(conf.KeyDBDir, conf.KeyDBMasterKey); err != nil {
+				findings = append(findings, NewDoctorFinding("key database records", DoctorFail, err.Error(),
+					"check the key database master key settings, and run fsck-keydb"))
+			} else {
+				findings = append(findings, DiagnoseKeyDB(db)...)
+			}
+		}
+	}
+	if conf.Port != 0 {
+		findings = append(findings, DiagnoseListenPort(conf.Address, conf.Port))
+	}
+	findings = append(findings, DiagnoseKMIP(conf))
+	if mailFinding := DiagnoseMailer(mailer); mailFinding.Result == DoctorPass {
+		findings = append(findings, mailFinding, DiagnoseMailAgent(mailer))
+	} else {
+		findings = append(findings, mailFinding)
+	}
+	return findings
+}
@@ -0,0 +1,170 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	certPath, keyPath, otherKeyPath := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem"), path.Join(dir, "other.pem")
+	certPEM, keyPEM, _, _ := makeTestCert(t, 1, now.Add(365*24*time.Hour), nil, nil)
+	writeTestCert(t, certPath, certPEM, keyPath, keyPEM, now)
+	if finding := DiagnoseCertificate("cert", certPath, keyPath, now); finding.Result != DoctorPass || finding.Hint != "" {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseCertificate("cert", certPath, "", now); finding.Result != DoctorPass {
+		t.Fatalf("%+v", finding)
+	}
+	// The certificate expires soon
+	if finding := DiagnoseCertificate("cert", certPath, keyPath, now.Add(350*24*time.Hour)); finding.Result != DoctorWarn || finding.Hint == "" {
+		t.Fatalf("%+v", finding)
+	}
+	// The certificate has expired
+	if finding := DiagnoseCertificate("cert", certPath, "", now.Add(400*24*time.Hour)); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+	// The key does not belong to the certificate
+	_, otherKeyPEM, _, _ := makeTestCert(t, 2, now.Add(time.Hour), nil, nil)
+	if err := ioutil.WriteFile(otherKeyPath, otherKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if finding := DiagnoseCertificate("cert", certPath, otherKeyPath, now); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseCertificate("cert", path.Join(dir, "missing"), "", now); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+}
+
+func TestDiagnoseKeyDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbDir := path.Join(dir, "keydb")
+	db, err := keydb.OpenDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "a", Key: []byte("key"), MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if finding := DiagnoseKeyDBFiles(dbDir); finding.Result != DoctorPass {
+		t.Fatalf("%+v", finding)
+	}
+	if findings := DiagnoseKeyDB(db); len(findings) != 1 || findings[0].Result != DoctorPass || DoctorFailed(findings) {
+		t.Fatalf("%+v", findings)
+	}
+	// A record file readable by others is warned of
+	if err := os.Chmod(path.Join(dbDir, "a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if finding := DiagnoseKeyDBFiles(dbDir); finding.Result != DoctorWarn || finding.Hint == "" {
+		t.Fatalf("%+v", finding)
+	}
+	// A damaged record file fails
+	if err := ioutil.WriteFile(path.Join(dbDir, "b"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if findings := DiagnoseKeyDB(db); !DoctorFailed(findings) {
+		t.Fatalf("%+v", findings)
+	}
+	// A directory that cannot be written fails, root writes regardless of the mode
+	if os.Geteuid() != 0 {
+		if err := os.Chmod(dbDir, 0500); err != nil {
+			t.Fatal(err)
+		}
+		finding := DiagnoseKeyDBFiles(dbDir)
+		os.Chmod(dbDir, 0700)
+		if finding.Result != DoctorFail || finding.Hint == "" {
+			t.Fatalf("%+v", finding)
+		}
+	}
+	if finding := DiagnoseKeyDBFiles(path.Join(dir, "missing")); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+}
+
+func TestDiagnoseMailer(t *testing.T) {
+	if finding := DiagnoseMailer(Mailer{}); finding.Result != DoctorWarn {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseMailer(Mailer{Recipients: []string{"a@b.c"}, AgentAddressPort: "a.example:25"}); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+	mailer := Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "a.example:25"}
+	if finding := DiagnoseMailer(mailer); finding.Result != DoctorPass {
+		t.Fatalf("%+v", finding)
+	}
+}
+
+func TestDiagnoseMailAgent(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(path.Join(PkgInGopath, "keyserv", "rpc_test.crt"), path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The mail agent is logged into over TLS, and no email is sent
+	commands := make(chan []string, 1)
+	go serveSMTPStub(t, tls.NewListener(listener, tlsConf), tlsConf, false, commands)
+	mailer := Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: listener.Addr().String(),
+		AuthUsername: "user", AuthPassword: "pass", TLSMode: MailTLSSMTPS, TLSSkipVerify: true}
+	if finding := DiagnoseMailAgent(mailer); finding.Result != DoctorPass {
+		t.Fatalf("%+v", finding)
+	}
+	if received := <-commands; !reflect.DeepEqual(received, []string{"TLS EHLO", "TLS AUTH", "TLS NOOP", "TLS QUIT"}) {
+		t.Fatal(received)
+	}
+	// A mail agent that does not speak TLS fails the check
+	go serveSMTPStub(t, listener, tlsConf, false, commands)
+	if finding := DiagnoseMailAgent(mailer); finding.Result != DoctorFail || finding.Hint == "" {
+		t.Fatalf("%+v", finding)
+	}
+	<-commands
+	listener.Close()
+	if finding := DiagnoseMailAgent(mailer); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+}
+
+func TestDiagnoseListenPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if finding := DiagnoseListenPort("127.0.0.1", port); finding.Result != DoctorWarn || finding.Hint == "" {
+		t.Fatalf("%+v", finding)
+	}
+	listener.Close()
+	if finding := DiagnoseListenPort("127.0.0.1", port); finding.Result != DoctorPass {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseListenPort("192.0.2.1", port); finding.Result != DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+}
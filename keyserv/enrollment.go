@@ -0,0 +1,145 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"time"
+)
+
+const (
+	MaxEnrollmentTokenValidity = 30 * 24 * time.Hour // MaxEnrollmentTokenValidity is the longest time an enrollment token may stay valid.
+)
+
+// RegexEnrollHostname matches the host names a client certificate may be issued for, the name becomes a file name on the server.
+var RegexEnrollHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// CreateEnrollmentTokenReq asks for a new one-time enrollment token.
+type CreateEnrollmentTokenReq struct {
+	PlainPassword string        // PlainPassword is the access password.
+	Hostname      string        // Hostname optionally restricts the host name or IP the certificate may be issued for.
+	Validity      time.Duration // Validity is how long the token may be used, up to MaxEnrollmentTokenValidity.
+}
+
+// CreateEnrollmentTokenResp carries the token, which is never shown again, along with its record.
+type CreateEnrollmentTokenResp struct {
+	Token           string            // Token is the secret to be handed to the new client computer.
+	EnrollmentToken keydb.UnlockToken // EnrollmentToken is the token as it is kept by the server.
+}
+
+/*
+CreateEnrollmentToken makes a new random token that lets a new client computer enroll once without the password, so
+that the password never has to be present on the client. Only the digest of the token is kept. It may only be called
+via the domain socket.
+*/
+func (rpcConn *CryptServiceConn) CreateEnrollmentToken(req CreateEnrollmentTokenReq, resp *CreateEnrollmentTokenResp) error {
+	if rpcConn.RemoteHost != "@" {
+		rpcConn.audit("CreateEnrollmentToken", req.Hostname, "", AuditResultRejected, "not connected via domain socket")
+		return errors.New("CreateEnrollmentToken: enrollment tokens may only be created via the domain socket")
+	}
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("CreateEnrollmentToken", req.Hostname, "", AuditResultRejected, err.Error())
+		return err
+	}
+	if req.Validity <= 0 || req.Validity > MaxEnrollmentTokenValidity {
+		return fmt.Errorf("CreateEnrollmentToken: the validity must be between 1 second and %s", MaxEnrollmentTokenValidity)
+	}
+	token, tokenRec := keydb.NewUnlockToken(req.Hostname, req.Validity)
+	if err := rpcConn.Svc.KeyDB.AddEnrollmentToken(tokenRec); err != nil {
+		rpcConn.audit("CreateEnrollmentToken", req.Hostname, "", AuditResultFailed, err.Error())
+		return err
+	}
+	detail := fmt.Sprintf("token %s valid until %s", tokenRec.ID, tokenRec.ExpiresAt.Format(time.RFC3339))
+	if tokenRec.Hostname != "" {
+		detail += " for " + tokenRec.Hostname
+	}
+	log.Printf("CryptServiceConn.CreateEnrollmentToken: %s has created enrollment %s", rpcConn.requester(), detail)
+	rpcConn.audit("CreateEnrollmentToken", req.Hostname, "", AuditResultGranted, detail)
+	resp.Token = token
+	resp.EnrollmentToken = tokenRec
+	return nil
+}
+
+// EnrollClientReq asks for a client certificate of a new client computer, by either the password or an enrollment token.
+type EnrollClientReq struct {
+	PlainPassword string // PlainPassword is the access password, leave empty to enroll by Token.
+	Token         string // Token is the secret of an enrollment token, used in place of the password.
+	Hostname      string // Hostname is the DNS name the certificate is issued for.
+}
+
+// EnrollClientResp carries the new client certificate and the CA that issued it, all PEM-encoded.
+type EnrollClientResp struct {
+	CertPEM []byte // CertPEM is the client certificate.
+	KeyPEM  []byte // KeyPEM is the private key of the client certificate.
+	CAPEM   []byte // CAPEM is the certificate of the CA that issued both the client and server certificates.
+	IP      string // IP is the IP address the certificate is issued for, which is the one the server sees the client connect from.
+}
+
+/*
+EnrollClient issues a client certificate for the host name of the requester and the IP it connects from, by either the
+password or an enrollment token, which is used up. Each enrollment, successful or not, is audited, and the
+administrator is notified of a successful one.
+*/
+func (rpcConn *CryptServiceConn) EnrollClient(req EnrollClientReq, resp *EnrollClientResp) error {
+	if rpcConn.Svc.IssueClientCert == nil {
+		return errors.New("EnrollClient: the key server does not issue client certificates")
+	}
+	if !RegexEnrollHostname.MatchString(req.Hostname) || len(req.Hostname) > 253 {
+		rpcConn.audit("EnrollClient", req.Hostname, "", AuditResultRejected, "invalid host name")
+		return fmt.Errorf("EnrollClient: \"%s\" is not a valid host name", req.Hostname)
+	}
+	ip := ""
+	if net.ParseIP(rpcConn.RemoteHost) != nil {
+		ip = rpcConn.RemoteHost
+	}
+	var by string
+	if req.PlainPassword != "" {
+		if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+			rpcConn.audit("EnrollClient", req.Hostname, "", AuditResultRejected, err.Error())
+			return err
+		}
+		by = "password"
+	} else {
+		// The token's host restriction is satisfied by the host name the certificate is for, or the IP
+		token, detail, err := rpcConn.Svc.KeyDB.UseEnrollmentToken(req.Token, fmt.Sprintf("%s (%s)", rpcConn.RemoteHost, req.Hostname), req.Hostname, ip)
+		if err != nil {
+			log.Printf("CryptServiceConn.EnrollClient: rejected enrollment token from %s (%s) - %s %v", rpcConn.RemoteHost, req.Hostname, detail, err)
+			rpcConn.audit("EnrollClient", req.Hostname, "", AuditResultRejected, detail)
+			return err
+		}
+		by = "enrollment token " + token.ID
+	}
+	certPEM, keyPEM, caPEM, err := rpcConn.Svc.IssueClientCert(req.Hostname, ip)
+	if err != nil {
+		rpcConn.audit("EnrollClient", req.Hostname, "", AuditResultFailed, err.Error())
+		return fmt.Errorf("EnrollClient: failed to issue certificate for %s - %v", req.Hostname, err)
+	}
+	resp.CertPEM, resp.KeyPEM, resp.CAPEM, resp.IP = certPEM, keyPEM, caPEM, ip
+	log.Printf("CryptServiceConn.EnrollClient: %s (%s) has been issued a client certificate by %s", rpcConn.RemoteHost, req.Hostname, by)
+	rpcConn.audit("EnrollClient", req.Hostname, "", AuditResultGranted, "client certificate issued by "+by)
+	rpcConn.notifyEnrollment(req.Hostname, by)
+	return nil
+}
+
+// Send optional notification email of an enrolled client computer in background, it is never put into a digest.
+func (rpcConn *CryptServiceConn) notifyEnrollment(hostname, by string) {
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	ip := rpcConn.RemoteHost
+	now := time.Now()
+	go func() {
+		subject := fmt.Sprintf("Client enrolled: %s (%s)", ip, hostname)
+		text := fmt.Sprintf("A client certificate for %s has been issued to %s on %s, authorised by %s. "+
+			"Add the computer to the allowed clients of its disks to let it unlock them.\r\n", hostname, ip, now.Format(time.RFC3339), by)
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("CryptServiceConn.EnrollClient: failed to send email notification - %v", err)
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestEnrollClient(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := NewSalt()
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordHash = HashPassword(salt, "pass")
+	admin := &CryptServiceConn{RemoteHost: "@", Peer: &PeerCred{UID: 0}, Svc: srv}
+	node := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+
+	// Without a CA to issue certificates the server does not enroll
+	var resp EnrollClientResp
+	if err := node.EnrollClient(EnrollClientReq{PlainPassword: "pass", Hostname: "node1"}, &resp); err == nil {
+		t.Fatal("did not error")
+	}
+	var issued []string
+	srv.IssueClientCert = func(dnsName, ipAddress string) ([]byte, []byte, []byte, error) {
+		issued = append(issued, dnsName+" "+ipAddress)
+		return []byte("cert " + dnsName), []byte("key " + dnsName), []byte("ca"), nil
+	}
+
+	// Only the domain socket may create a token, and only with the correct password and a sensible validity
+	req := CreateEnrollmentTokenReq{PlainPassword: "pass", Hostname: "node2", Validity: time.Hour}
+	var created CreateEnrollmentTokenResp
+	if err := node.CreateEnrollmentToken(req, &created); err == nil {
+		t.Fatal("did not reject TCP client")
+	}
+	for _, bad := range []CreateEnrollmentTokenReq{
+		{PlainPassword: "wrong", Validity: time.Hour},
+		{PlainPassword: "pass"},
+		{PlainPassword: "pass", Validity: MaxEnrollmentTokenValidity + time.Second},
+	} {
+		if err := admin.CreateEnrollmentToken(bad, &created); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if err := admin.CreateEnrollmentToken(req, &created); err != nil || created.Token == "" || created.EnrollmentToken.Hostname != "node2" {
+		t.Fatal(created, err)
+	}
+
+	// A host name that is not a plain DNS name is refused before anything else
+	for _, bad := range []string{"", "../x", "node1/x", "-node1", "node1."} {
+		if err := node.EnrollClient(EnrollClientReq{PlainPassword: "pass", Hostname: bad}, &resp); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if err := node.EnrollClient(EnrollClientReq{PlainPassword: "wrong", Hostname: "node1"}, &resp); err == nil {
+		t.Fatal("accepted wrong password")
+	}
+	// Enroll by password, the certificate carries the IP the server sees
+	if err := node.EnrollClient(EnrollClientReq{PlainPassword: "pass", Hostname: "node1"}, &resp); err != nil ||
+		string(resp.CertPEM) != "cert node1" || string(resp.KeyPEM) != "key node1" || string(resp.CAPEM) != "ca" || resp.IP != "10.0.0.1" {
+		t.Fatal(resp, err)
+	}
+	// Enroll by token, which is only good for the host name it was created for, and only once
+	if err := node.EnrollClient(EnrollClientReq{Token: created.Token, Hostname: "node3"}, &resp); err == nil {
+		t.Fatal("accepted token for another host")
+	}
+	if err := node.EnrollClient(EnrollClientReq{Token: created.Token, Hostname: "node2"}, &resp); err != nil || string(resp.CertPEM) != "cert node2" {
+		t.Fatal(resp, err)
+	}
+	if err := node.EnrollClient(EnrollClientReq{Token: created.Token, Hostname: "node2"}, &resp); err == nil {
+		t.Fatal("accepted token twice")
+	}
+	if len(issued) != 2 || issued[0] != "node1 10.0.0.1" || issued[1] != "node2 10.0.0.1" {
+		t.Fatal(issued)
+	}
+}
@@ -0,0 +1,90 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+)
+
+/*
+ParseServerAddresses turns the key server host setting into "host:port" addresses in order of preference. The setting
+lists one or more servers separated by comma or space, each either "host" or "host:port", the port number defaults to
+defaultPort. An IPv6 address is given either bare ("2001:db8::1") or in brackets ("[2001:db8::1]:3737"), the addresses
+returned carry it in brackets.
+*/
+func ParseServerAddresses(hosts string, defaultPort int) ([]string, error) {
+	entries := strings.FieldsFunc(hosts, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(entries) == 0 {
+		return nil, errors.New("ParseServerAddresses: key server host is empty")
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		host, port := entry, defaultPort
+		if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+			host = entry[1 : len(entry)-1]
+		} else if strings.HasPrefix(entry, "[") || strings.Count(entry, ":") == 1 {
+			var portStr string
+			var err error
+			if host, portStr, err = net.SplitHostPort(entry); err != nil {
+				return nil, fmt.Errorf("ParseServerAddresses: \"%s\" is not a valid key server address - %v", entry, err)
+			}
+			if port, err = strconv.Atoi(portStr); err != nil {
+				return nil, fmt.Errorf("ParseServerAddresses: port number is not a valid integer in \"%s\"", entry)
+			}
+		}
+		// Otherwise the entry is a host name, IPv4 address, or bare IPv6 address without port
+		if host == "" || strings.ContainsAny(host, "[]") || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("ParseServerAddresses: \"%s\" is not a valid key server address", entry)
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addrs, nil
+}
+
+// CurrentAddress returns the address of the key server that most recently answered, or the preferred one if none has.
+func (client *CryptClient) CurrentAddress() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Addresses[client.current]
+}
+
+/*
+Invoke the RPC on the key server that most recently answered, and should it be unreachable or the connection break
+during the call, on the remaining servers in order of preference. The server that answers is remembered for the
+subsequent calls, so that an unreachable server is not probed on every call.
+*/
+func (client *CryptClient) doRPCWithFailover(fun func(*rpc.Client) error) (err error) {
+	client.mutex.Lock()
+	current := client.current
+	client.mutex.Unlock()
+	order := make([]int, 0, len(client.Addresses))
+	order = append(order, current)
+	for i := range client.Addresses {
+		if i != current {
+			order = append(order, i)
+		}
+	}
+	for attempt, idx := range order {
+		var failover bool
+		if failover, err = client.doRPCOn(client.Addresses[idx], fun); !failover {
+			if idx != current {
+				client.mutex.Lock()
+				client.current = idx
+				client.mutex.Unlock()
+			}
+			break
+		}
+		if attempt+1 < len(order) {
+			log.Printf("CryptClient.DoRPC: failing over from key server %s to %s - %v", client.Addresses[idx], client.Addresses[order[attempt+1]], err)
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// failoverTestSvc stands in for CryptServiceConn in the failover test, it counts the calls it serves.
+type failoverTestSvc struct {
+	calls int32
+}
+
+func (svc *failoverTestSvc) Ping(req PingRequest, _ *DummyAttr) error {
+	atomic.AddInt32(&svc.calls, 1)
+	if req.PlainPassword != TEST_RPC_PASS {
+		return errors.New("incorrect password")
+	}
+	return nil
+}
+
+// Serve the test service over TLS on a random local port until the listener is closed.
+func startFailoverTestServer(t *testing.T) (*failoverTestSvc, net.Listener) {
+	cert, err := tls.LoadX509KeyPair("rpc_test.crt", "rpc_test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := new(failoverTestSvc)
+	server := rpc.NewServer()
+	if err := server.RegisterName(reflect.TypeOf(CryptServiceConn{}).Name(), svc); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+	return svc, listener
+}
+
+func TestParseServerAddresses(t *testing.T) {
+	addrs, err := ParseServerAddresses(" keysrv1, keysrv2:3738 10.0.0.3 ", 3737)
+	if err != nil || !reflect.DeepEqual(addrs, []string{"keysrv1:3737", "keysrv2:3738", "10.0.0.3:3737"}) {
+		t.Fatal(addrs, err)
+	}
+	// IPv6 addresses, bare or in brackets, come out in brackets and survive another round
+	addrs, err = ParseServerAddresses("2001:db8::1 [2001:db8::2] [2001:db8::3]:3738,[::1]:3739", 3737)
+	if err != nil || !reflect.DeepEqual(addrs, []string{"[2001:db8::1]:3737", "[2001:db8::2]:3737", "[2001:db8::3]:3738", "[::1]:3739"}) {
+		t.Fatal(addrs, err)
+	}
+	if again, err := ParseServerAddresses(strings.Join(addrs, ","), 1); err != nil || !reflect.DeepEqual(again, addrs) {
+		t.Fatal(again, err)
+	}
+	for _, addr := range addrs {
+		if host, port, err := net.SplitHostPort(addr); err != nil || net.JoinHostPort(host, port) != addr {
+			t.Fatal(addr, err)
+		}
+	}
+	for _, bad := range []string{"", " , ", "keysrv1:abc", "keysrv1,:3737", "keysrv1:70000", "[2001:db8::1", "[2001:db8::1]:", "[]:3737", "[[::1]]"} {
+		if _, err := ParseServerAddresses(bad, 3737); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestCryptClient_Failover(t *testing.T) {
+	backup, backupListener := startFailoverTestServer(t)
+	defer backupListener.Close()
+	// Nothing listens on the first address
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := unused.Addr().String()
+	unused.Close()
+	client, err := NewCryptClient("tcp", down+","+backupListener.Addr().String(), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.tlsConfig.InsecureSkipVerify = true
+	if client.Address != down || client.CurrentAddress() != down || len(client.Addresses) != 2 {
+		t.Fatal(client.Address, client.Addresses)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	// The server that answered is remembered
+	if client.CurrentAddress() != backupListener.Addr().String() || atomic.LoadInt32(&backup.calls) != 1 {
+		t.Fatal(client.CurrentAddress(), backup.calls)
+	}
+	// An error returned by the server is not retried elsewhere
+	if err := client.Ping(PingRequest{PlainPassword: "wrong"}); err == nil || atomic.LoadInt32(&backup.calls) != 2 {
+		t.Fatal(err, backup.calls)
+	}
+	// Once the remembered server goes down too, every server is tried
+	backupListener.Close()
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+	// A single server works as before
+	single, err := NewCryptClient("tcp", down, nil, "", "")
+	if err != nil || len(single.Addresses) != 1 || single.Ping(PingRequest{}) == nil {
+		t.Fatal(single.Addresses, err)
+	}
+}
@@ -0,0 +1,106 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"fmt"
+	"log"
+)
+
+/*
+ForgetKey destroys the encryption key of a record and keeps the record, so that its allowed clients, owner, and other
+details remain for audit. The key content is shredded from the key database, and a key stored on an external KMIP
+server is revoked and destroyed there. Unlike EraseKey, the record is kept if the KMIP server fails to destroy the key,
+so that the request may be repeated. A record that has an owner only forgets its key on the owner's behalf.
+*/
+func (rpcConn *CryptServiceConn) ForgetKey(req EraseKeyReq, _ *DummyAttr) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultMissing, "")
+		return fmt.Errorf("ForgetKey: record \"%s\" does not exist", req.UUID)
+	}
+	if err := checkOwnerAcknowledged(rec, req.OwnerAcknowledged); err != nil {
+		rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultRejected, "owner did not acknowledge")
+		return fmt.Errorf("ForgetKey: %v", err)
+	}
+	if rec.IsKeyForgotten() {
+		rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultGranted, "the key was already destroyed")
+		return nil
+	}
+	detail := "key content shredded from key database"
+	if rpcConn.Svc.BuiltInKMIPServer == nil && len(rec.Key) == 0 {
+		// KMIP servers only destroy a key that is no longer active
+		if err := rpcConn.Svc.KMIPClient.RevokeKey(rec.ID); err != nil {
+			rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultFailed, "KMIP did not revoke the key - "+err.Error())
+			return fmt.Errorf("ForgetKey: KMIP server did not revoke key %s, the record is left intact - %v", rec.ID, err)
+		}
+		if err := rpcConn.Svc.KMIPClient.DestroyKey(rec.ID); err != nil {
+			rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultFailed, "KMIP revoked but did not destroy the key - "+err.Error())
+			return fmt.Errorf("ForgetKey: KMIP server revoked key %s but did not destroy it, the record is left intact - %v", rec.ID, err)
+		}
+		detail = fmt.Sprintf("KMIP key %s revoked and destroyed", rec.ID)
+	}
+	if _, err := rpcConn.Svc.KeyDB.ForgetKey(req.UUID); err != nil {
+		rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultFailed, err.Error())
+		return err
+	}
+	rpcConn.audit("ForgetKey", req.Hostname, req.UUID, AuditResultGranted, detail)
+	log.Printf("CryptServiceConn.ForgetKey: %s (%s) has destroyed the key of %s and kept its record (%s)", rpcConn.RemoteHost, req.Hostname, req.UUID, detail)
+	rpcConn.notifyForget(req.Hostname, rec)
+	return nil
+}
+
+// Send optional notification email of a destroyed key in background, it is never put into a digest.
+func (rpcConn *CryptServiceConn) notifyForget(hostname string, rec keydb.Record) {
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	go func() {
+		subject := fmt.Sprintf("Destroyed: key of %s (%s)%s has been destroyed by %s (%s)", rec.UUID, rec.MountPoint, ownerNote(rec.Owner), rpcConn.RemoteHost, hostname)
+		text := fmt.Sprintf("The key server has destroyed the encryption key of the following file system on request of %s (%s), its record is kept:\r\n\r\n%s - %s%s\r\n",
+			rpcConn.RemoteHost, hostname, rec.UUID, rec.MountPoint, ownerNote(rec.Owner))
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("CryptServiceConn.ForgetKey: failed to send email notification after destroying key of %s - %v", rec.UUID, err)
+		}
+	}()
+}
+
+// KeySlotRemovedReq tells the server that a client has removed the key slot of a disk and kept its other key slots.
+type KeySlotRemovedReq struct {
+	PlainPassword     string // PlainPassword grants access.
+	Hostname          string // Hostname is the client's host name (for logging only).
+	UUID              string // UUID is the disk whose key slot was removed.
+	OwnerAcknowledged bool   // OwnerAcknowledged is true if the requester acts on behalf of the record owner.
+	Device            string // Device is the block device the key slot was removed from (for logging only).
+	KeySlot           int    // KeySlot is the number of the removed key slot (for logging only).
+}
+
+/*
+ReportKeySlotRemoved writes down in the audit log that a client has removed the key slot the key of a record unlocks,
+the record and its key are left alone. The client reports only after verifying that the key no longer unlocks the disk.
+*/
+func (rpcConn *CryptServiceConn) ReportKeySlotRemoved(req KeySlotRemovedReq, _ *DummyAttr) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("RemoveKeySlot", req.Hostname, req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		rpcConn.audit("RemoveKeySlot", req.Hostname, req.UUID, AuditResultMissing, "")
+		return nil
+	}
+	if err := checkOwnerAcknowledged(rec, req.OwnerAcknowledged); err != nil {
+		rpcConn.audit("RemoveKeySlot", req.Hostname, req.UUID, AuditResultRejected, "owner did not acknowledge")
+		return fmt.Errorf("ReportKeySlotRemoved: %v", err)
+	}
+	detail := fmt.Sprintf("key slot %d of %s removed", req.KeySlot, req.Device)
+	rpcConn.audit("RemoveKeySlot", req.Hostname, req.UUID, AuditResultGranted, detail)
+	log.Printf("CryptServiceConn.ReportKeySlotRemoved: %s (%s) has removed the key of %s from the disk (%s)", rpcConn.RemoteHost, req.Hostname, req.UUID, detail)
+	return nil
+}
@@ -0,0 +1,111 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestForgetKey(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []keydb.Record{
+		{ID: "1", Version: keydb.CurrentRecordVersion, UUID: "owned", Key: []byte("key"), MountPoint: "/a", Owner: "storage-team", AllowedClients: []string{"10.0.0.1"}},
+		{ID: "2", Version: keydb.CurrentRecordVersion, UUID: "unowned", Key: []byte("key"), MountPoint: "/b"},
+	} {
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit, err := NewAuditLog(path.Join(tmpDir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := NewSalt()
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}, Audit: audit}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordHash = HashPassword(salt, "pass")
+	conn := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+
+	if err := conn.ForgetKey(EraseKeyReq{PlainPassword: "wrong", UUID: "unowned"}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := conn.ForgetKey(EraseKeyReq{PlainPassword: "pass", UUID: "missing"}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := conn.ForgetKey(EraseKeyReq{PlainPassword: "pass", UUID: "owned"}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := conn.ReportKeySlotRemoved(KeySlotRemovedReq{PlainPassword: "pass", UUID: "owned", Device: "/dev/sdb", KeySlot: 1}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if rec, _ := db.GetByUUID("owned"); rec.IsKeyForgotten() {
+		t.Fatal("forgot the key without owner's acknowledgement")
+	}
+	// Removing the key slot leaves the record alone
+	if err := conn.ReportKeySlotRemoved(KeySlotRemovedReq{PlainPassword: "pass", UUID: "owned", OwnerAcknowledged: true, Device: "/dev/sdb", KeySlot: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("owned"); rec.IsKeyForgotten() || string(rec.Key) != "key" {
+		t.Fatalf("%+v", rec)
+	}
+	// Forgetting the key keeps the record and its details
+	if err := conn.ForgetKey(EraseKeyReq{PlainPassword: "pass", UUID: "owned", OwnerAcknowledged: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec, found := db.GetByUUID("owned")
+	if !found || !rec.IsKeyForgotten() || len(rec.Key) != 0 || rec.Owner != "storage-team" || len(rec.AllowedClients) != 1 {
+		t.Fatalf("%+v", rec)
+	}
+	if err := conn.ForgetKey(EraseKeyReq{PlainPassword: "pass", UUID: "owned", OwnerAcknowledged: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The key is no longer handed out
+	var autoResp AutoRetrieveKeyResp
+	if err := conn.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"owned"}}, &autoResp); err != nil || len(autoResp.Granted) != 0 || len(autoResp.Rejected) != 1 || autoResp.RejectReasons["owned"] == "" {
+		t.Fatal(autoResp, err)
+	}
+	var manualResp ManualRetrieveKeyResp
+	if err := conn.ManualRetrieveKey(ManualRetrieveKeyReq{PlainPassword: "pass", UUIDs: []string{"owned"}}, &manualResp); err != nil || len(manualResp.Granted) != 0 {
+		t.Fatal(manualResp, err)
+	}
+	if _, err := conn.askForKeyContent(rec); err == nil {
+		t.Fatal("did not error")
+	}
+	// Every request is in the audit log
+	audit.Close()
+	forget, err := ReadAuditLog(audit.Path, AuditFilter{UUID: "owned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]string, 0, len(forget))
+	for _, event := range forget {
+		if event.Event == "ForgetKey" || event.Event == "RemoveKeySlot" {
+			results = append(results, event.Event+" "+event.Result)
+			if event.Time.IsZero() || event.IP != "10.0.0.1" {
+				t.Fatalf("%+v", event)
+			}
+		}
+	}
+	expected := []string{"ForgetKey " + AuditResultRejected, "RemoveKeySlot " + AuditResultRejected, "RemoveKeySlot " + AuditResultGranted,
+		"ForgetKey " + AuditResultGranted, "ForgetKey " + AuditResultGranted}
+	if len(results) != len(expected) {
+		t.Fatal(results)
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Fatal(results)
+		}
+	}
+}
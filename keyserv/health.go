@@ -0,0 +1,153 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"fmt"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+const (
+	HealthStatusOK       = "ok"       // HealthStatusOK means that the server is fully functional.
+	HealthStatusDegraded = "degraded" // HealthStatusDegraded means that the server answers but some functions may fail, see the warnings.
+)
+
+// BuildVersion is the version of the program, it is set at build time by -ldflags "-X cryptctl2/keyserv.BuildVersion=...".
+var BuildVersion = ""
+
+// GetBuildVersion returns BuildVersion, or the VCS revision recorded by Go compiler if BuildVersion is not set.
+func GetBuildVersion() string {
+	if BuildVersion != "" {
+		return BuildVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+		if info.Main.Version != "" {
+			return info.Main.Version
+		}
+	}
+	return "unknown"
+}
+
+// A request to check the health of the server.
+type HealthReq struct {
+	PlainPassword string // the details are only reported after the correct password is given, leave empty for liveness only
+}
+
+/*
+Health describes whether the server is fully functional. The liveness attributes (Status, ProtocolVersion, StartTime,
+and UptimeSec) are reported without a password, the details and warnings only with the correct password.
+A degraded server still answers the request successfully, so that a failed request always means the server is down.
+*/
+type Health struct {
+	Status          string    // Status is either HealthStatusOK or HealthStatusDegraded.
+	ProtocolVersion int       // ProtocolVersion is the version of RPC protocol spoken by the server.
+	StartTime       time.Time // StartTime is the moment the server started.
+	UptimeSec       int64     // UptimeSec is the number of seconds since the server started.
+	Maintenance     bool      // Maintenance is true if the server is in maintenance mode and does not hand out keys.
+
+	Detailed         bool       // Detailed is true if the attributes below are filled in.
+	Version          string     // Version is the build version of the server program.
+	Warnings         []string   // Warnings describe the degraded conditions.
+	KeyDBDir         string     // KeyDBDir is the key database directory.
+	NumRecords       int        // NumRecords is the number of records in the key database.
+	KeyDBWritable    bool       // KeyDBWritable is true if the key database directory can be written to.
+	KMIPExternal     bool       // KMIPExternal is true if keys are stored on an external KMIP server.
+	KMIPLastSuccess  time.Time  // KMIPLastSuccess is the most recent successful conversation with KMIP server, zero if none yet.
+	KMIPLastFailure  time.Time  // KMIPLastFailure is the most recent failed conversation with KMIP server, zero if none yet.
+	KMIPLastError    string     // KMIPLastError is the reason of the most recent failed conversation with KMIP server.
+	MailerConfigured bool       // MailerConfigured is true if email notification settings are present.
+	MailerError      string     // MailerError describes the problem of email notification settings, empty if they are valid.
+	TLS              TLSSummary // TLS describes the TLS settings of the server, such as its minimum version and client certificate validation.
+
+	MaintenanceMode keydb.MaintenanceMode // MaintenanceMode tells since when, until when, and why the server does not hand out keys.
+	Rejections      map[string]uint64     // Rejections is the number of key retrievals rejected since the server started, by reason.
+}
+
+// Check the key database, KMIP connection, and mailer, and return the health with details.
+func (srv *CryptServer) checkHealth() Health {
+	now := time.Now()
+	health := Health{
+		Status:          HealthStatusOK,
+		Version:         GetBuildVersion(),
+		ProtocolVersion: ProtocolVersion,
+		StartTime:       srv.StartTime,
+		UptimeSec:       int64(now.Sub(srv.StartTime).Seconds()),
+		Detailed:        true,
+		Warnings:        []string{},
+		KeyDBDir:        srv.Config.KeyDBDir,
+		KMIPExternal:    len(srv.Config.KMIPAddresses) > 0,
+		TLS:             srv.Config.GetTLSSummary(),
+	}
+	if err := srv.CheckInitialSetup(); err != nil {
+		health.Warnings = append(health.Warnings, "the server has not been set up yet, run \"cryptctl2 -action=init-server\"")
+	}
+	health.NumRecords = len(srv.KeyDB.List())
+	health.Rejections = srv.KeyDB.RejectionCounts()
+	if mode := srv.KeyDB.GetMaintenance(); mode.IsActive() {
+		health.Maintenance, health.MaintenanceMode = true, mode
+		health.Warnings = append(health.Warnings, fmt.Sprintf("the server is in maintenance mode and does not hand out keys until %s", mode.Until.Format(time.RFC3339)))
+	}
+	const wOK, xOK = 2, 1
+	if err := syscall.Access(srv.Config.KeyDBDir, wOK|xOK); err == nil {
+		health.KeyDBWritable = true
+	} else {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("key database directory \"%s\" is not writable - %v", srv.Config.KeyDBDir, err))
+	}
+	if srv.KMIPClient != nil {
+		var lastErr error
+		health.KMIPLastSuccess, health.KMIPLastFailure, lastErr = srv.KMIPClient.LastConversation()
+		if lastErr != nil {
+			health.KMIPLastError = lastErr.Error()
+		}
+		if health.KMIPLastFailure.After(health.KMIPLastSuccess) {
+			health.Warnings = append(health.Warnings, fmt.Sprintf("KMIP server has been unreachable since %s - %s",
+				health.KMIPLastFailure.Format(time.RFC3339), health.KMIPLastError))
+		}
+	}
+	mailer := srv.Mailer
+	health.MailerConfigured = len(mailer.Recipients) > 0 || mailer.FromAddress != "" || mailer.AgentAddressPort != ""
+	if err := mailer.ValidateConfig(); err != nil {
+		health.MailerError = err.Error()
+		// Leaving email notifications unconfigured is fine, configuring them incorrectly is not.
+		if health.MailerConfigured {
+			health.Warnings = append(health.Warnings, fmt.Sprintf("email notifications cannot be sent - %v", err))
+		}
+	}
+	if len(health.Warnings) > 0 {
+		health.Status = HealthStatusDegraded
+	}
+	return health
+}
+
+/*
+GetHealth reports whether the server is fully functional. Without a password only the liveness attributes are
+reported, with the correct password the details and warnings are reported too.
+*/
+func (rpcConn *CryptServiceConn) GetHealth(req HealthReq, health *Health) error {
+	if req.PlainPassword != "" {
+		if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+			return err
+		}
+	}
+	full := rpcConn.Svc.checkHealth()
+	if req.PlainPassword != "" {
+		*health = full
+		return nil
+	}
+	*health = Health{
+		Status:          full.Status,
+		ProtocolVersion: full.ProtocolVersion,
+		StartTime:       full.StartTime,
+		UptimeSec:       full.UptimeSec,
+		Maintenance:     full.Maintenance,
+	}
+	return nil
+}
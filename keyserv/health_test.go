@@ -0,0 +1,48 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetHealth(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: "aaa", MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// Liveness is reported without password
+	health, err := client.GetHealth(HealthReq{})
+	if err != nil || health.Status != HealthStatusOK || health.Detailed || health.KeyDBDir != "" || health.Version != "" || health.StartTime.IsZero() {
+		t.Fatalf("%+v %v", health, err)
+	}
+	if _, err := client.GetHealth(HealthReq{PlainPassword: "wrong password"}); err == nil {
+		t.Fatal("did not reject wrong password")
+	}
+	health, err = client.GetHealth(HealthReq{PlainPassword: TEST_RPC_PASS})
+	if err != nil || health.Status != HealthStatusOK || !health.Detailed || health.KeyDBDir != server.Config.KeyDBDir ||
+		health.NumRecords != 1 || !health.KeyDBWritable || health.KMIPExternal || health.KMIPLastSuccess.IsZero() ||
+		health.MailerConfigured || len(health.Warnings) != 0 || health.Version == "" {
+		t.Fatalf("%+v %v", health, err)
+	}
+
+	// An unreachable KMIP server and incomplete mail settings degrade the server, which still answers.
+	server.KMIPClient.mutex.Lock()
+	server.KMIPClient.lastFailure = time.Now().Add(time.Second)
+	server.KMIPClient.lastErr = errors.New("connection refused")
+	server.KMIPClient.mutex.Unlock()
+	server.Mailer.FromAddress = "root@localhost"
+	health, err = client.GetHealth(HealthReq{})
+	if err != nil || health.Status != HealthStatusDegraded || len(health.Warnings) != 0 {
+		t.Fatalf("%+v %v", health, err)
+	}
+	health, err = client.GetHealth(HealthReq{PlainPassword: TEST_RPC_PASS})
+	if err != nil || health.Status != HealthStatusDegraded || len(health.Warnings) != 2 || health.KMIPLastError != "connection refused" ||
+		!strings.Contains(health.Warnings[0], "KMIP") || !strings.Contains(health.Warnings[1], "email") {
+		t.Fatalf("%+v %v", health, err)
+	}
+}
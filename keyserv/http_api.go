@@ -0,0 +1,476 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/helper"
+	"cryptctl2/keydb"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SRV_CONF_HTTP_API_ADDRESS = "HTTP_API_LISTEN_ADDRESS"
+	SRV_CONF_HTTP_API_PORT    = "HTTP_API_LISTEN_PORT"
+
+	DefaultHTTPAPIPort        = 3740   // DefaultHTTPAPIPort is the port of JSON API listener if configuration does not specify one.
+	HTTPAPIPrefix             = "/v1/" // HTTPAPIPrefix is the URL path under which version 1 of the JSON API is served.
+	HTTPAPIContentType        = "application/json; charset=utf-8"
+	HTTPAPIMaxRequestSize     = 64 * 1024   // HTTPAPIMaxRequestSize is the maximum size in bytes of a request body.
+	HTTPAPIDefaultValidityMin = 10          // HTTPAPIDefaultValidityMin is the validity of a pending command if the request does not specify one.
+	HTTPAPIMaxValidityMin     = 7 * 24 * 60 // HTTPAPIMaxValidityMin is the longest validity of a pending command, same as send-command.
+)
+
+/*
+HTTPAPICommandContents are the pending commands that may be created over the JSON API. "erase" is left out on purpose,
+as it destroys the data on the disk and requires the administrator to confirm it in send-command.
+*/
+var HTTPAPICommandContents = []string{"mount", "umount", "lock", "refresh-status", "fstrim", "inventory", "remount-ro"}
+
+// APIRecord is a key record as presented by the JSON API, it never carries the key.
+type APIRecord struct {
+	UUID             string            `json:"uuid"`
+	CreationTime     time.Time         `json:"creation_time"`
+	MappedName       string            `json:"mapped_name"`
+	MountPoint       string            `json:"mount_point"`
+	MountOptions     []string          `json:"mount_options"`
+	MaxActive        int               `json:"max_active"`
+	AllowedClients   []string          `json:"allowed_clients"`
+	AliveIntervalSec int               `json:"alive_interval_sec"`
+	AliveCount       int               `json:"alive_count"`
+	Group            string            `json:"group"`
+	Tags             map[string]string `json:"tags"`
+	Owner            string            `json:"owner"`
+	LastRetrievedBy  string            `json:"last_retrieved_by"`
+	LastRetrievedIP  string            `json:"last_retrieved_ip"`
+	LastRetrievedOn  int64             `json:"last_retrieved_on"`
+	NumAliveHosts    int               `json:"num_alive_hosts"`
+}
+
+// APIRecordDetail is a key record along with its computers and pending commands, it never carries the key.
+type APIRecordDetail struct {
+	APIRecord
+	AliveHosts      []keydb.AliveHost `json:"alive_hosts"`
+	PendingCommands []APICommand      `json:"pending_commands"`
+}
+
+// APICommand is a pending command as presented by the JSON API.
+type APICommand struct {
+	ID         string     `json:"id"`
+	UUID       string     `json:"uuid"`
+	IP         string     `json:"ip"`
+	Content    string     `json:"content"`
+	ValidFrom  time.Time  `json:"valid_from"`
+	ValidTo    time.Time  `json:"valid_to"`
+	Group      string     `json:"group,omitempty"`
+	Status     string     `json:"status"`
+	ResultTime *time.Time `json:"result_time,omitempty"`
+	Result     string     `json:"result,omitempty"`
+	DurationMS int64      `json:"duration_ms,omitempty"`
+}
+
+// APICommandReq asks for a new pending command for a computer.
+type APICommandReq struct {
+	IP          string `json:"ip"`           // IP is the computer that receives the command.
+	Content     string `json:"content"`      // Content is one of HTTPAPICommandContents.
+	ValidityMin int    `json:"validity_min"` // ValidityMin is the number of minutes until the command expires, HTTPAPIDefaultValidityMin if 0.
+}
+
+// APIAllowedClientReq asks for a new allowed client entry.
+type APIAllowedClientReq struct {
+	Entry string `json:"entry"` // Entry is a DNS name, DNS name pattern, IP, subnet, or client group "@name".
+}
+
+// APIAllowedClients are the allowed client entries of a record after a change.
+type APIAllowedClients struct {
+	UUID           string   `json:"uuid"`
+	AllowedClients []string `json:"allowed_clients"`
+	Changed        bool     `json:"changed"`
+}
+
+// APIError is the body of an unsuccessful response.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// Convert a record into its presentation for the JSON API.
+func newAPIRecord(rec keydb.Record) APIRecord {
+	ret := APIRecord{
+		UUID:             rec.UUID,
+		CreationTime:     rec.CreationTime,
+		MappedName:       rec.MappedName,
+		MountPoint:       rec.MountPoint,
+		MountOptions:     rec.MountOptions,
+		MaxActive:        rec.MaxActive,
+		AllowedClients:   rec.AllowedClients,
+		AliveIntervalSec: rec.AliveIntervalSec,
+		AliveCount:       rec.AliveCount,
+		Group:            rec.Group,
+		Tags:             rec.Tags,
+		Owner:            rec.Owner,
+		LastRetrievedBy:  rec.LastRetrieval.Hostname,
+		LastRetrievedIP:  rec.LastRetrieval.IP,
+		LastRetrievedOn:  rec.LastRetrieval.Timestamp,
+		NumAliveHosts:    len(rec.AliveMessages),
+	}
+	// Clients of the API are better off with empty arrays and objects than with nulls
+	if ret.MountOptions == nil {
+		ret.MountOptions = []string{}
+	}
+	if ret.AllowedClients == nil {
+		ret.AllowedClients = []string{}
+	}
+	if ret.Tags == nil {
+		ret.Tags = map[string]string{}
+	}
+	return ret
+}
+
+// Convert a pending command into its presentation for the JSON API.
+func newAPICommand(uuid string, cmd keydb.PendingCommand) APICommand {
+	ret := APICommand{
+		ID:         cmd.ID,
+		UUID:       uuid,
+		IP:         cmd.IP,
+		Content:    fmt.Sprint(cmd.Content),
+		ValidFrom:  cmd.ValidFrom,
+		ValidTo:    cmd.ValidFrom.Add(cmd.Validity),
+		Group:      cmd.Group,
+		Status:     cmd.Status(),
+		Result:     cmd.ClientResult,
+		DurationMS: cmd.Duration.Milliseconds(),
+	}
+	if !cmd.ResultTime.IsZero() {
+		resultTime := cmd.ResultTime
+		ret.ResultTime = &resultTime
+	}
+	return ret
+}
+
+// Return the pending commands of the record sorted by IP and then by age.
+func apiCommands(rec keydb.Record) []APICommand {
+	ret := make([]APICommand, 0, len(rec.PendingCommands))
+	for _, ip := range sortedCommandIPs(rec) {
+		for _, cmd := range rec.PendingCommands[ip] {
+			if cmd.IP == "" {
+				cmd.IP = ip
+			}
+			ret = append(ret, newAPICommand(rec.UUID, cmd))
+		}
+	}
+	return ret
+}
+
+// Return the IPs that have pending commands in the record, sorted.
+func sortedCommandIPs(rec keydb.Record) []string {
+	ips := make([]string, 0, len(rec.PendingCommands))
+	for ip := range rec.PendingCommands {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+/*
+HTTPAPI serves a JSON API over HTTPS for programs not written in Go, e.g. a web portal. The API reads records (never
+their keys), alive computers and pending commands, and changes allowed clients and creates pending commands. Each
+request is authorised by the password given as HTTP basic authentication (the user name is ignored), or by the
+certificate of an administrator client, just like the RPC functions, and changes are written to the audit log.
+Addr and Shutdown of a nil HTTPAPI do nothing.
+*/
+type HTTPAPI struct {
+	srv          *CryptServer
+	httpListener net.Listener
+	httpServer   *http.Server
+}
+
+// NewHTTPAPI returns a JSON API of the server, it does not listen yet.
+func NewHTTPAPI(srv *CryptServer) *HTTPAPI {
+	return &HTTPAPI{srv: srv}
+}
+
+// Listen starts the HTTPS listener of the JSON API on the address and port, with the TLS settings of the RPC server.
+func (api *HTTPAPI) Listen(address string, port int, tlsConfig *tls.Config) (err error) {
+	if api.httpListener, err = tls.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)), tlsConfig); err != nil {
+		return fmt.Errorf("HTTPAPI.Listen: failed to listen on %s:%d - %v", address, port, err)
+	}
+	api.httpServer = &http.Server{Handler: api, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("HTTPAPI.Listen: serving JSON API on https://%s%s", api.httpListener.Addr().String(), HTTPAPIPrefix)
+	return nil
+}
+
+// Addr returns the address of the HTTPS listener, or nil if it is not listening.
+func (api *HTTPAPI) Addr() net.Addr {
+	if api == nil || api.httpListener == nil {
+		return nil
+	}
+	return api.httpListener.Addr()
+}
+
+// HandleConnections serves HTTPS requests on the listener. Blocks caller until the listener closes.
+func (api *HTTPAPI) HandleConnections() {
+	if err := api.httpServer.Serve(api.httpListener); err != nil && err != http.ErrServerClosed {
+		log.Printf("HTTPAPI.HandleConnections: quit now - %v", err)
+	}
+}
+
+// Shutdown closes the HTTPS listener, it does nothing if the listener was not started.
+func (api *HTTPAPI) Shutdown() {
+	if api == nil || api.httpServer == nil {
+		return
+	}
+	api.httpServer.Close()
+}
+
+// Identify the peer of the request the same way ServeConn identifies the peer of an RPC connection.
+func (api *HTTPAPI) conn(r *http.Request) *CryptServiceConn {
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteHost = r.RemoteAddr
+	}
+	conn := &CryptServiceConn{RemoteHost: NormaliseRemoteHost(remoteHost), Svc: api.srv}
+	if r.TLS != nil {
+		conn.CertDNSName, _ = helper.GetStateCertificatInfo(*r.TLS)
+		conn.CertIPAddress = helper.GetStateCertificatIPAddress(*r.TLS, conn.RemoteHost)
+		conn.CertCN = helper.GetStateCertificateCommonName(*r.TLS)
+	}
+	return conn
+}
+
+// Write the value as the JSON body of the response.
+func writeAPIResponse(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", HTTPAPIContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("HTTPAPI: failed to write response - %v", err)
+	}
+}
+
+// Write an error response.
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cryptctl2"`)
+	}
+	writeAPIResponse(w, status, APIError{Error: err.Error()})
+}
+
+// Decode the JSON body of the request into the value, unknown attributes are rejected.
+func readAPIRequest(w http.ResponseWriter, r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, HTTPAPIMaxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("malformed request - %v", err)
+	}
+	return nil
+}
+
+/*
+ServeHTTP serves the JSON API:
+GET /v1/records - list records
+GET /v1/records/UUID - show a record along with its alive computers and pending commands
+GET /v1/alive-hosts[?uuid=UUID&host=HOST] - list computers currently using the records
+GET /v1/records/UUID/commands - list pending commands of a record
+POST /v1/records/UUID/commands - create a pending command (APICommandReq)
+POST /v1/records/UUID/allowed-clients - add an allowed client entry (APIAllowedClientReq)
+DELETE /v1/records/UUID/allowed-clients/ENTRY - remove an allowed client entry, "/" of a subnet written as %2F
+*/
+func (api *HTTPAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// Configuration and records are not reloaded in the middle of a request, just like an RPC call
+	api.srv.configLock.RLock()
+	defer api.srv.configLock.RUnlock()
+	route, segments, err := apiRoute(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	defer func() { api.srv.Metrics.ObserveRPC("HTTPAPI."+route, time.Since(start)) }()
+	conn := api.conn(r)
+	uuid := ""
+	if len(segments) > 1 {
+		uuid = segments[1]
+	}
+	_, password, _ := r.BasicAuth()
+	identity, err := conn.adminIdentity(password)
+	if err != nil {
+		conn.audit("HTTPAPI."+route, "", uuid, AuditResultRejected, err.Error())
+		writeAPIError(w, http.StatusUnauthorized, errors.New("the password is incorrect"))
+		return
+	}
+	switch route {
+	case "ListRecords":
+		records := make([]APIRecord, 0, 64)
+		for _, rec := range api.srv.KeyDB.List() {
+			records = append(records, newAPIRecord(rec))
+		}
+		writeAPIResponse(w, http.StatusOK, map[string][]APIRecord{"records": records})
+		return
+	case "ListAliveHosts":
+		query := r.URL.Query()
+		hosts := api.srv.KeyDB.ListAliveHosts(query.Get("uuid"), query.Get("host"))
+		if hosts == nil {
+			hosts = []keydb.AliveHost{}
+		}
+		writeAPIResponse(w, http.StatusOK, map[string][]keydb.AliveHost{"alive_hosts": hosts})
+		return
+	}
+	rec, found := api.srv.KeyDB.GetByUUID(uuid)
+	if !found {
+		writeAPIError(w, http.StatusNotFound, api.srv.KeyDB.NotFoundError(uuid, nil))
+		return
+	}
+	switch route {
+	case "GetRecord":
+		detail := APIRecordDetail{APIRecord: newAPIRecord(rec), AliveHosts: rec.ListAliveHosts(), PendingCommands: apiCommands(rec)}
+		if detail.AliveHosts == nil {
+			detail.AliveHosts = []keydb.AliveHost{}
+		}
+		writeAPIResponse(w, http.StatusOK, detail)
+	case "ListPendingCommands":
+		writeAPIResponse(w, http.StatusOK, map[string][]APICommand{"pending_commands": apiCommands(rec)})
+	case "SendCommand":
+		api.sendCommand(w, r, conn, identity, rec.UUID)
+	case "AddAllowedClient":
+		var req APIAllowedClientReq
+		if err := readAPIRequest(w, r, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		api.changeAllowedClient(w, conn, identity, route, rec.UUID, req.Entry)
+	case "DeleteAllowedClient":
+		api.changeAllowedClient(w, conn, identity, route, rec.UUID, segments[3])
+	}
+}
+
+/*
+Return the name of the route that serves the request along with the unescaped segments of its path after the version
+prefix, or an error if there is no such route.
+*/
+func apiRoute(r *http.Request) (route string, segments []string, err error) {
+	escaped := r.URL.EscapedPath()
+	if !strings.HasPrefix(escaped, HTTPAPIPrefix) {
+		return "", nil, fmt.Errorf("%s is not served, the API is under %s", r.URL.Path, HTTPAPIPrefix)
+	}
+	for _, segment := range strings.Split(strings.Trim(strings.TrimPrefix(escaped, HTTPAPIPrefix), "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", nil, fmt.Errorf("malformed path %s - %v", escaped, err)
+		}
+		segments = append(segments, unescaped)
+	}
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	switch {
+	case len(segments) == 1 && segments[0] == "records" && method == http.MethodGet:
+		route = "ListRecords"
+	case len(segments) == 1 && segments[0] == "alive-hosts" && method == http.MethodGet:
+		route = "ListAliveHosts"
+	case len(segments) == 2 && segments[0] == "records" && method == http.MethodGet:
+		route = "GetRecord"
+	case len(segments) == 3 && segments[0] == "records" && segments[2] == "commands" && method == http.MethodGet:
+		route = "ListPendingCommands"
+	case len(segments) == 3 && segments[0] == "records" && segments[2] == "commands" && method == http.MethodPost:
+		route = "SendCommand"
+	case len(segments) == 3 && segments[0] == "records" && segments[2] == "allowed-clients" && method == http.MethodPost:
+		route = "AddAllowedClient"
+	case len(segments) == 4 && segments[0] == "records" && segments[2] == "allowed-clients" && method == http.MethodDelete:
+		route = "DeleteAllowedClient"
+	default:
+		return "", nil, fmt.Errorf("%s %s is not served", r.Method, r.URL.Path)
+	}
+	return
+}
+
+// Add or remove an allowed client entry of the record, the change is written to the audit log.
+func (api *HTTPAPI) changeAllowedClient(w http.ResponseWriter, conn *CryptServiceConn, identity, route, uuid, entry string) {
+	var changed bool
+	var err error
+	if route == "AddAllowedClient" {
+		changed, err = api.srv.KeyDB.AddAllowedClient(uuid, entry)
+	} else {
+		changed, err = api.srv.KeyDB.RemoveAllowedClient(uuid, entry, false)
+	}
+	if errors.Is(err, keydb.ErrLastAllowedClient) {
+		conn.audit("HTTPAPI."+route, "", uuid, AuditResultRejected, err.Error())
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		conn.audit("HTTPAPI."+route, "", uuid, AuditResultFailed, err.Error())
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	rec, _ := api.srv.KeyDB.GetByUUID(uuid)
+	resp := APIAllowedClients{UUID: uuid, AllowedClients: newAPIRecord(rec).AllowedClients, Changed: changed}
+	if !changed {
+		if route == "DeleteAllowedClient" {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("allowed client \"%s\" is not an entry of %s", entry, uuid))
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, resp)
+		return
+	}
+	log.Printf("HTTPAPI: %s (authorised by %s) has changed allowed clients of %s: %s \"%s\"", conn.requester(), identity, uuid, route, entry)
+	conn.audit("HTTPAPI."+route, "", uuid, AuditResultGranted, fmt.Sprintf("\"%s\" authorised by %s", entry, identity))
+	status := http.StatusOK
+	if route == "AddAllowedClient" {
+		status = http.StatusCreated
+	}
+	writeAPIResponse(w, status, resp)
+}
+
+// Create a pending command for a computer using the record, the command is written to the audit log.
+func (api *HTTPAPI) sendCommand(w http.ResponseWriter, r *http.Request, conn *CryptServiceConn, identity, uuid string) {
+	var req APICommandReq
+	if err := readAPIRequest(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if net.ParseIP(req.IP) == nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("\"%s\" is not an IP address", req.IP))
+		return
+	}
+	known := false
+	for _, content := range HTTPAPICommandContents {
+		known = known || content == req.Content
+	}
+	if !known {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("command \"%s\" must be one of %s", req.Content, strings.Join(HTTPAPICommandContents, ", ")))
+		return
+	}
+	if req.ValidityMin == 0 {
+		req.ValidityMin = HTTPAPIDefaultValidityMin
+	} else if req.ValidityMin < 0 || req.ValidityMin > HTTPAPIMaxValidityMin {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("the validity must be between 1 and %d minutes", HTTPAPIMaxValidityMin))
+		return
+	}
+	ip := NormaliseRemoteHost(req.IP)
+	stored, added, err := api.srv.KeyDB.AddPendingCommand(uuid, ip, keydb.PendingCommand{
+		ValidFrom: time.Now(),
+		Validity:  time.Duration(req.ValidityMin) * time.Minute,
+		Content:   req.Content,
+	})
+	if err != nil {
+		conn.audit("HTTPAPI.SendCommand", "", uuid, AuditResultFailed, err.Error())
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !added {
+		writeAPIResponse(w, http.StatusOK, newAPICommand(uuid, stored))
+		return
+	}
+	log.Printf("HTTPAPI: %s (authorised by %s) has sent command \"%s\" (ID %s) for %s to %s", conn.requester(), identity, req.Content, stored.ID, uuid, ip)
+	conn.audit("HTTPAPI.SendCommand", "", uuid, AuditResultGranted, fmt.Sprintf("command \"%s\" (ID %s) for %s authorised by %s", req.Content, stored.ID, ip, identity))
+	writeAPIResponse(w, http.StatusCreated, newAPICommand(uuid, stored))
+}
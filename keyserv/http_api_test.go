@@ -0,0 +1,146 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Make a request to the JSON API and return the response.
+func apiRequest(api *HTTPAPI, method, target, password, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:40000"
+	if password != "" {
+		req.SetBasicAuth("admin", password)
+	}
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestHTTPAPI(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "a", Key: []byte("secret key content"), MountPoint: "/a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]keydb.AliveMessage{"10.0.0.1": {{IP: "10.0.0.1", Hostname: "host1", Timestamp: time.Now().Unix()}}}}); err != nil {
+		t.Fatal(err)
+	}
+	salt := NewSalt()
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordHash = HashPassword(salt, "pass")
+	api := NewHTTPAPI(srv)
+
+	// Every request requires the password
+	if resp := apiRequest(api, http.MethodGet, "/v1/records", "", ""); resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(api, http.MethodGet, "/v1/records", "wrong", ""); resp.Code != http.StatusUnauthorized {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	for _, target := range []string{"/records", "/v1/keys", "/v1/records/a/key", "/v2/records"} {
+		if resp := apiRequest(api, http.MethodGet, target, "pass", ""); resp.Code != http.StatusNotFound {
+			t.Fatal(target, resp.Code, resp.Body.String())
+		}
+	}
+	// Records are listed and shown without their keys
+	resp := apiRequest(api, http.MethodGet, "/v1/records", "pass", "")
+	var list map[string][]APIRecord
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil || resp.Code != http.StatusOK || len(list["records"]) != 1 || list["records"][0].MountPoint != "/a" {
+		t.Fatal(resp.Code, resp.Body.String(), err)
+	}
+	resp = apiRequest(api, http.MethodGet, "/v1/records/a", "pass", "")
+	var detail APIRecordDetail
+	if err := json.Unmarshal(resp.Body.Bytes(), &detail); err != nil || resp.Code != http.StatusOK || len(detail.AliveHosts) != 1 || detail.NumAliveHosts != 1 {
+		t.Fatal(resp.Code, resp.Body.String(), err)
+	}
+	if body := resp.Body.String(); strings.Contains(body, "c2VjcmV0") || strings.Contains(body, "secret") {
+		t.Fatal("key is handed out", body)
+	}
+	if resp := apiRequest(api, http.MethodGet, "/v1/records/b", "pass", ""); resp.Code != http.StatusNotFound {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	resp = apiRequest(api, http.MethodGet, "/v1/alive-hosts?uuid=a", "pass", "")
+	var hosts map[string][]keydb.AliveHost
+	if err := json.Unmarshal(resp.Body.Bytes(), &hosts); err != nil || len(hosts["alive_hosts"]) != 1 || hosts["alive_hosts"][0].Hostname != "host1" {
+		t.Fatal(resp.Code, resp.Body.String(), err)
+	}
+
+	// Allowed clients are added and removed, a subnet is removed by escaping its slash
+	for _, bad := range []string{`{"entry": "10.20.0.0/33"}`, `{"entry": "@missing"}`, `{"client": "10.0.0.1"}`, `not json`} {
+		if resp := apiRequest(api, http.MethodPost, "/v1/records/a/allowed-clients", "pass", bad); resp.Code != http.StatusBadRequest {
+			t.Fatal(bad, resp.Code, resp.Body.String())
+		}
+	}
+	if resp := apiRequest(api, http.MethodPost, "/v1/records/a/allowed-clients", "pass", `{"entry": "10.20.0.0/16"}`); resp.Code != http.StatusCreated {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(api, http.MethodPost, "/v1/records/a/allowed-clients", "pass", `{"entry": "10.20.0.0/16"}`); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if rec, _ := db.GetByUUID("a"); !reflect.DeepEqual(rec.AllowedClients, []string{"10.20.0.0/16"}) {
+		t.Fatal(rec.AllowedClients)
+	}
+	// The last allowed client cannot be removed, the record would be open to any computer
+	if resp := apiRequest(api, http.MethodDelete, "/v1/records/a/allowed-clients/10.20.0.0%2F16", "pass", ""); resp.Code != http.StatusConflict {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if rec, _ := db.GetByUUID("a"); !reflect.DeepEqual(rec.AllowedClients, []string{"10.20.0.0/16"}) || db.IsClientAllowed(rec, "unrelated.example.com", "192.0.2.1") {
+		t.Fatal(rec.AllowedClients)
+	}
+	if resp := apiRequest(api, http.MethodPost, "/v1/records/a/allowed-clients", "pass", `{"entry": "db-1.example.com"}`); resp.Code != http.StatusCreated {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(api, http.MethodDelete, "/v1/records/a/allowed-clients/10.20.0.0%2F16", "pass", ""); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(api, http.MethodDelete, "/v1/records/a/allowed-clients/10.20.0.0%2F16", "pass", ""); resp.Code != http.StatusNotFound {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if rec, _ := db.GetByUUID("a"); !reflect.DeepEqual(rec.AllowedClients, []string{"db-1.example.com"}) {
+		t.Fatal(rec.AllowedClients)
+	}
+
+	// Pending commands are created, an identical one is not created twice, and erase is refused
+	for _, bad := range []string{`{"ip": "10.0.0.1", "content": "erase"}`, `{"ip": "host1", "content": "umount"}`, `{"ip": "10.0.0.1", "content": "umount", "validity_min": -1}`} {
+		if resp := apiRequest(api, http.MethodPost, "/v1/records/a/commands", "pass", bad); resp.Code != http.StatusBadRequest {
+			t.Fatal(bad, resp.Code, resp.Body.String())
+		}
+	}
+	resp = apiRequest(api, http.MethodPost, "/v1/records/a/commands", "pass", `{"ip": "10.0.0.1", "content": "umount"}`)
+	var cmd APICommand
+	if err := json.Unmarshal(resp.Body.Bytes(), &cmd); err != nil || resp.Code != http.StatusCreated || cmd.ID == "" || cmd.Status != keydb.PendingCommandStatusPending ||
+		cmd.ValidTo.Sub(cmd.ValidFrom) != HTTPAPIDefaultValidityMin*time.Minute {
+		t.Fatal(resp.Code, resp.Body.String(), err)
+	}
+	resp = apiRequest(api, http.MethodPost, "/v1/records/a/commands", "pass", `{"ip": "10.0.0.1", "content": "umount", "validity_min": 60}`)
+	var again APICommand
+	if err := json.Unmarshal(resp.Body.Bytes(), &again); err != nil || resp.Code != http.StatusOK || again.ID != cmd.ID {
+		t.Fatal(resp.Code, resp.Body.String(), err)
+	}
+	resp = apiRequest(api, http.MethodGet, "/v1/records/a/commands", "pass", "")
+	var cmds map[string][]APICommand
+	if err := json.Unmarshal(resp.Body.Bytes(), &cmds); err != nil || len(cmds["pending_commands"]) != 1 || cmds["pending_commands"][0].IP != "10.0.0.1" {
+		t.Fatal(resp.Code, resp.Body.String(), err)
+	}
+	if resp := apiRequest(api, http.MethodPut, "/v1/records/a/commands", "pass", ""); resp.Code != http.StatusNotFound {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,87 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestVerifiedIdentity(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{ID: "1", Version: keydb.CurrentRecordVersion, UUID: "a", Key: []byte("key"), MountPoint: "/a", MaxActive: 2}); err != nil {
+		t.Fatal(err)
+	}
+	audit, err := NewAuditLog(path.Join(tmpDir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}, Audit: audit}
+	impostor := &CryptServiceConn{RemoteHost: "10.0.0.2", CertDNSName: "node2.example.com", CertCN: "node2", Svc: srv}
+
+	// Without validation the names in the certificate are not trusted
+	if requester := impostor.newRequester("node1"); requester.CertName != "" || requester.IdentityMismatch() || requester.Identity() != "node1" {
+		t.Fatalf("%+v", requester)
+	}
+	// With validation the certificate tells who the client is
+	srv.Config.ValidateClientCert = true
+	var resp AutoRetrieveKeyResp
+	if err := impostor.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "node1", UUIDs: []string{"a"}}, &resp); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(resp, err)
+	}
+	rec, _ := db.GetByUUID("a")
+	if rec.LastRetrieval.Hostname != "node1" || rec.LastRetrieval.CertName != "node2.example.com" || !rec.LastRetrieval.IdentityMismatch() {
+		t.Fatalf("%+v", rec.LastRetrieval)
+	}
+	var rejected []string
+	if err := impostor.ReportAlive(ReportAliveReq{Hostname: "node1", UUIDs: []string{"a"}}, &rejected); err != nil || len(rejected) != 0 {
+		t.Fatal(rejected, err)
+	}
+	if hosts := rec.ListAliveHosts(); len(hosts) != 1 || hosts[0].CertName != "node2.example.com" || !hosts[0].IdentityMismatch {
+		t.Fatalf("%+v", hosts)
+	}
+	// A client that tells its short host name agrees with its certificate
+	honest := &CryptServiceConn{RemoteHost: "10.0.0.3", CertDNSName: "node3.example.com", Svc: srv}
+	if err := honest.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "node3", UUIDs: []string{"a"}}, &resp); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(resp, err)
+	}
+	if rec, _ := db.GetByUUID("a"); rec.LastRetrieval.IdentityMismatch() || rec.LastRetrieval.Identity() != "node3.example.com" {
+		t.Fatalf("%+v", rec.LastRetrieval)
+	}
+	// Claiming another host name does not evade the maximum number of active users, which counts the peers' IPs
+	if err := impostor.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "node4", UUIDs: []string{"a"}}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.AliveMessages) != 2 {
+		t.Fatalf("%+v", rec.AliveMessages)
+	}
+	// The audit log flags the mismatches
+	audit.Close()
+	events, err := ReadAuditLog(audit.Path, AuditFilter{UUID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatches := 0
+	for _, event := range events {
+		if event.IdentityMismatch {
+			mismatches++
+			if event.IP != "10.0.0.2" {
+				t.Fatalf("%+v", event)
+			}
+		}
+	}
+	if mismatches != 2 {
+		t.Fatal(events)
+	}
+}
@@ -0,0 +1,242 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/sys"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_INVENTORY_ENABLE    = "INVENTORY_ENABLE"
+	SRV_CONF_INVENTORY_DIR       = "INVENTORY_DIR"
+	SRV_CONF_INVENTORY_RETENTION = "INVENTORY_RETENTION_DAYS"
+	SRV_CONF_INVENTORY_STALE     = "INVENTORY_STALE_HOURS"
+
+	CLIENT_CONF_INVENTORY_ENABLE  = "INVENTORY_REPORT_ENABLE"
+	CLIENT_CONF_INVENTORY_EXCLUDE = "INVENTORY_EXCLUDE_PATHS"
+
+	DefaultInventoryDir           = "/var/lib/cryptctl2/inventory" // DefaultInventoryDir is the inventory store location if configuration does not specify one.
+	DefaultInventoryRetentionDays = 30                             // DefaultInventoryRetentionDays is the number of days a client's report is kept after it stops reporting.
+	InventoryReportIntervalSec    = 24 * 3600                      // InventoryReportIntervalSec is the interval at which client daemon reports its disks.
+	DefaultInventoryStaleHours    = 48                             // DefaultInventoryStaleHours is the age in hours beyond which a report is shown as stale.
+	MaxInventoryDisks             = 1024                           // MaxInventoryDisks is the maximum number of disks accepted in a single report.
+	MaxInventoryFieldLen          = 256                            // MaxInventoryFieldLen is the maximum length of each text detail of a reported disk.
+	InventoryFileMode             = sys.SecureFileMode             // InventoryFileMode is the permission of inventory report files.
+)
+
+// ErrInventoryDisabled is returned to a client that reports its inventory while the server does not accept reports.
+var ErrInventoryDisabled = errors.New("disk inventory reports are not enabled on this server")
+
+// RegexInventoryFileName matches characters that may not appear in an inventory report file name.
+var RegexInventoryFileName = regexp.MustCompile("[^a-zA-Z0-9._-]")
+
+// InventoryDisk describes a block device found on a client computer.
+type InventoryDisk struct {
+	Serial     string `json:"serial"`                // Serial is the disk serial number.
+	Path       string `json:"path"`                  // Path is the device node, e.g. /dev/sdb1.
+	Type       string `json:"type"`                  // Type is the device type reported by lsblk, e.g. disk or part.
+	FileSystem string `json:"file_system"`           // FileSystem is the file system type, empty if unformatted.
+	SizeByte   int64  `json:"size_byte"`             // SizeByte is the device size in bytes.
+	Encrypted  bool   `json:"encrypted"`             // Encrypted is true if the device holds a LUKS header.
+	MountPoint string `json:"mount_point,omitempty"` // MountPoint is where the device is mounted, left out for excluded paths.
+	UUID       string `json:"uuid,omitempty"`        // UUID is the file system UUID, which is the record UUID of an encrypted disk.
+	Label      string `json:"label,omitempty"`       // Label is the file system label.
+	MapperPath string `json:"mapper_path,omitempty"` // MapperPath is the unlocked device mapper node of a LUKS device, empty if it is locked.
+}
+
+// Return the disk with each text detail cut down to the maximum length.
+func (disk InventoryDisk) bounded() InventoryDisk {
+	for _, field := range []*string{&disk.Serial, &disk.Path, &disk.Type, &disk.FileSystem, &disk.MountPoint, &disk.UUID, &disk.Label, &disk.MapperPath} {
+		if len(*field) > MaxInventoryFieldLen {
+			*field = (*field)[:MaxInventoryFieldLen]
+		}
+	}
+	return disk
+}
+
+// InventoryReport is the list of block devices reported by a client computer.
+type InventoryReport struct {
+	Client    string          `json:"client"`               // Client is the identity of the reporting computer - certificate common name, or host name.
+	Hostname  string          `json:"hostname"`             // Hostname is the host name reported by the computer itself.
+	IP        string          `json:"ip"`                   // IP is the computer's IP as seen by cryptctl2 server.
+	Time      time.Time       `json:"time"`                 // Time is the moment the report arrived at the server.
+	Disks     []InventoryDisk `json:"disks"`                // Disks are the block devices found on the computer.
+	CryptOnly bool            `json:"crypt_only,omitempty"` // CryptOnly is true if the report only carries LUKS and crypt devices.
+}
+
+// IsStale returns true if the report arrived longer than the maximum age ago, a maximum age of 0 never makes it stale.
+func (report InventoryReport) IsStale(maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(report.Time) > maxAge
+}
+
+/*
+NewInventoryDisks converts block devices into a disk inventory. The mount point of a device is left out if it is
+located under any of the excluded paths; the inventory never carries file contents.
+*/
+func NewInventoryDisks(blkDevs fs.BlockDevices, excludePaths []string) []InventoryDisk {
+	disks := make([]InventoryDisk, 0, len(blkDevs))
+	for _, blkDev := range blkDevs {
+		disk := InventoryDisk{
+			Serial:     blkDev.SERIAL,
+			Path:       blkDev.Path,
+			Type:       blkDev.Type,
+			FileSystem: blkDev.FileSystem,
+			SizeByte:   blkDev.SizeByte,
+			Encrypted:  blkDev.IsLUKSEncrypted() || blkDev.Type == "crypt",
+			MountPoint: blkDev.MountPoint,
+			UUID:       blkDev.UUID,
+			Label:      blkDev.Label,
+		}
+		if blkDev.IsLUKSEncrypted() {
+			if cryptDev, found := blkDevs.GetByCriteria("", "", "crypt", "", "", blkDev.Name, ""); found {
+				disk.MapperPath = cryptDev.Path
+			}
+		}
+		for _, exclude := range excludePaths {
+			exclude = strings.TrimRight(exclude, "/")
+			if disk.MountPoint == exclude || strings.HasPrefix(disk.MountPoint, exclude+"/") || exclude == "" {
+				disk.MountPoint = ""
+				break
+			}
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+/*
+NewCryptInventoryDisks converts block devices into a disk inventory like NewInventoryDisks does, but only LUKS devices
+and their unlocked crypt devices are kept. The inventory carries device details only and never key material.
+*/
+func NewCryptInventoryDisks(blkDevs fs.BlockDevices, excludePaths []string) []InventoryDisk {
+	disks := make([]InventoryDisk, 0, 8)
+	for _, disk := range NewInventoryDisks(blkDevs, excludePaths) {
+		if disk.Encrypted {
+			disks = append(disks, disk)
+		}
+	}
+	return disks
+}
+
+/*
+InventoryStore keeps the most recent inventory report of each client computer in a directory, one JSON file per client.
+Reports of clients that have not reported for longer than the retention period are removed.
+*/
+type InventoryStore struct {
+	Dir       string        // Dir is the directory where reports are stored.
+	Retention time.Duration // Retention is how long a report is kept after it arrived.
+	lock      *sync.Mutex
+}
+
+// NewInventoryStore creates the inventory directory if it does not yet exist.
+func NewInventoryStore(dir string, retention time.Duration) (*InventoryStore, error) {
+	if err := sys.MkdirSecure(dir); err != nil {
+		return nil, err
+	}
+	return &InventoryStore{Dir: dir, Retention: retention, lock: new(sync.Mutex)}, nil
+}
+
+// Return the file that stores report of the client.
+func (store *InventoryStore) reportPath(client string) string {
+	return path.Join(store.Dir, RegexInventoryFileName.ReplaceAllString(client, "_")+".json")
+}
+
+// Save overwrites the client's previous report with the new one, and then removes expired reports.
+func (store *InventoryStore) Save(report InventoryReport) error {
+	if report.Client == "" {
+		return errors.New("InventoryStore.Save: client identity must not be empty")
+	}
+	if len(report.Disks) > MaxInventoryDisks {
+		return fmt.Errorf("InventoryStore.Save: report contains %d disks, the maximum is %d", len(report.Disks), MaxInventoryDisks)
+	}
+	bounded := make([]InventoryDisk, 0, len(report.Disks))
+	for _, disk := range report.Disks {
+		bounded = append(bounded, disk.bounded())
+	}
+	report.Disks = bounded
+	content, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("InventoryStore.Save: failed to serialise report - %v", err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := sys.ReplaceFile(store.reportPath(report.Client), content, InventoryFileMode, false); err != nil {
+		return fmt.Errorf("InventoryStore.Save: failed to write report of \"%s\" - %v", report.Client, err)
+	}
+	store.removeExpired()
+	return nil
+}
+
+// Remove reports that are older than the retention period. Caller must hold the lock.
+func (store *InventoryStore) removeExpired() {
+	for _, report := range store.readAll() {
+		if store.Retention > 0 && time.Since(report.Time) > store.Retention {
+			os.Remove(store.reportPath(report.Client))
+		}
+	}
+}
+
+// Read all reports from the directory, skipping those that cannot be read.
+func (store *InventoryStore) readAll() []InventoryReport {
+	reports := make([]InventoryReport, 0, 16)
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		return reports
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(store.Dir, file.Name()))
+		if err != nil {
+			continue
+		}
+		var report InventoryReport
+		if err := json.Unmarshal(content, &report); err != nil {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// List returns the unexpired reports sorted by client identity. If client is not empty, only its report is returned.
+func (store *InventoryStore) List(client string) []InventoryReport {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	reports := make([]InventoryReport, 0, 16)
+	for _, report := range store.readAll() {
+		if store.Retention > 0 && time.Since(report.Time) > store.Retention {
+			continue
+		}
+		if client == "" || report.Client == client {
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Client < reports[j].Client
+	})
+	return reports
+}
+
+// Find returns the unexpired report of the client identified by its identity, host name, or IP.
+func (store *InventoryStore) Find(client string) (InventoryReport, bool) {
+	for _, report := range store.List("") {
+		if report.Client == client || report.Hostname == client || report.IP == client {
+			return report, true
+		}
+	}
+	return InventoryReport{}, false
+}
@@ -0,0 +1,104 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/sys"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewInventoryDisks(t *testing.T) {
+	devs := fs.BlockDevices{
+		{SERIAL: "s1", Path: "/dev/sda1", Type: "part", FileSystem: "ext4", SizeByte: 100, MountPoint: "/srv/secret/db"},
+		{SERIAL: "s2", Path: "/dev/sdb", Type: "disk", FileSystem: "crypto_LUKS", SizeByte: 200},
+		{Path: "/dev/sdc", Type: "disk", FileSystem: "xfs", MountPoint: "/srv/secretive"},
+	}
+	disks := NewInventoryDisks(devs, []string{"/srv/secret/"})
+	expected := []InventoryDisk{
+		{Serial: "s1", Path: "/dev/sda1", Type: "part", FileSystem: "ext4", SizeByte: 100},
+		{Serial: "s2", Path: "/dev/sdb", Type: "disk", FileSystem: "crypto_LUKS", SizeByte: 200, Encrypted: true},
+		{Path: "/dev/sdc", Type: "disk", FileSystem: "xfs", MountPoint: "/srv/secretive"},
+	}
+	if !reflect.DeepEqual(disks, expected) {
+		t.Fatalf("\n%+v\n%+v\n", disks, expected)
+	}
+}
+
+func TestNewCryptInventoryDisks(t *testing.T) {
+	devs := fs.BlockDevices{
+		{Name: "sda1", Path: "/dev/sda1", Type: "part", FileSystem: "ext4", UUID: "plain"},
+		{Name: "sdb", Path: "/dev/sdb", Type: "disk", FileSystem: "crypto_LUKS", UUID: "locked"},
+		{Name: "sdc", Path: "/dev/sdc", Type: "disk", FileSystem: "crypto_LUKS", UUID: "unlocked", Label: "data"},
+		{Name: "cryptctl2-unlocked-sdc", Path: "/dev/mapper/cryptctl2-unlocked-sdc", Type: "crypt", FileSystem: "xfs", PKName: "sdc", MountPoint: "/data"},
+	}
+	disks := NewCryptInventoryDisks(devs, nil)
+	if len(disks) != 3 || disks[0].UUID != "locked" || disks[0].MapperPath != "" ||
+		disks[1].Label != "data" || disks[1].MapperPath != "/dev/mapper/cryptctl2-unlocked-sdc" || disks[2].MountPoint != "/data" {
+		t.Fatalf("%+v", disks)
+	}
+}
+
+func TestInventoryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-inventorytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewInventoryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(InventoryReport{Time: time.Now()}); err == nil {
+		t.Fatal("did not error on missing client")
+	}
+	if err := store.Save(InventoryReport{Client: "big", Time: time.Now(), Disks: make([]InventoryDisk, MaxInventoryDisks+1)}); err == nil {
+		t.Fatal("did not error on oversized report")
+	}
+	for _, report := range []InventoryReport{
+		{Client: "host2", Time: time.Now(), Disks: []InventoryDisk{{Path: "/dev/old"}}},
+		{Client: "host2", Time: time.Now(), Disks: []InventoryDisk{{Path: "/dev/new"}}},
+		{Client: "../host1", Time: time.Now()},
+		{Client: "expired", Time: time.Now().Add(-2 * time.Hour)},
+	} {
+		if err := store.Save(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reports := store.List("")
+	if len(reports) != 2 || reports[0].Client != "../host1" || reports[1].Client != "host2" ||
+		len(reports[1].Disks) != 1 || reports[1].Disks[0].Path != "/dev/new" {
+		t.Fatalf("%+v", reports)
+	}
+	if reports := store.List("host2"); len(reports) != 1 {
+		t.Fatalf("%+v", reports)
+	}
+	// Reports are found by host name or IP too, and text details are cut down to size
+	if err := store.Save(InventoryReport{Client: "cn", Hostname: "host3", IP: "3.3.3.3", Time: time.Now().Add(-time.Minute),
+		Disks: []InventoryDisk{{Label: strings.Repeat("a", MaxInventoryFieldLen+1)}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cn", "host3", "3.3.3.3"} {
+		if report, found := store.Find(name); !found || report.Client != "cn" || len(report.Disks[0].Label) != MaxInventoryFieldLen {
+			t.Fatal(name, report, found)
+		}
+	}
+	if _, found := store.Find("expired"); found {
+		t.Fatal("found expired report")
+	}
+	if report, _ := store.Find("cn"); !report.IsStale(time.Second) || report.IsStale(time.Hour) || report.IsStale(0) {
+		t.Fatal("wrong staleness")
+	}
+	// Expired report is removed upon the next save
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 3 {
+		t.Fatal(files, err)
+	}
+	if loose, err := sys.FindLooseFileModes(dir, sys.SecureFileMode, sys.SecureDirMode); err != nil || len(loose) != 0 {
+		t.Fatal(loose, err)
+	}
+}
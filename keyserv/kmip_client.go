@@ -14,6 +14,7 @@ import (
 	"io"
 	"log"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -21,7 +22,7 @@ const (
 	KMIPTimeoutSec = 30 // timeout in seconds
 	/*
 		Both server and client refuse to accept a structure larger than this number. The number is
-		reasonable and big enough for all three operations supported by server and client: create, get, and destroy.
+		reasonable and big enough for all operations supported by server and client: create, register, get, destroy, and query.
 	*/
 	MaxKMIPStructLen   = 65536
 	KMIPAESKeySizeBits = 256 // The only kind of AES encryption key the KMIP server and client will expect to use
@@ -29,7 +30,7 @@ const (
 )
 
 /*
-Implement a KMIP client that supports three operations - create, get, destroy.
+Implement a KMIP client that supports these operations - create, register, get, destroy, and query.
 The client is designed to interoperate not only with KMIPServer that comes with cryptctl2, but also with
 KMIP servers implemented by other vendors.
 */
@@ -37,11 +38,18 @@ type KMIPClient struct {
 	ServerAddrs        []string
 	Username, Password string
 	TLSConfig          *tls.Config
+
+	mutex       sync.Mutex
+	lastSuccess time.Time // lastSuccess is the time of the most recent successful conversation with a server
+	lastFailure time.Time // lastFailure is the time of the most recent conversation that failed with all servers
+	lastErr     error     // lastErr is the reason of the most recent failure
+	lastAddr    string    // lastAddr is the server address of the most recent successful conversation
 }
 
 /*
 Initialise a KMIP client.
-The function does not immediately establish a connection to server.
+The function does not immediately establish a connection to server. If both username and password are empty, requests
+do not carry credential, and the server authenticates the client by its TLS certificate only.
 */
 func NewKMIPClient(addrs []string, username, password string, caCertPEM []byte, certFilePath, certKeyPath string) (*KMIPClient, error) {
 	client := &KMIPClient{
@@ -70,6 +78,22 @@ func NewKMIPClient(addrs []string, username, password string, caCertPEM []byte,
 	return client, nil
 }
 
+// Return an explanation of a failure to connect to KMIP server, it points out TLS certificate problems in particular.
+func describeKMIPDialError(addr string, err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidHostname x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("TLS certificate of KMIP server %s is not signed by the configured CA (%s) - %v", addr, SRV_CONF_KMIP_SERVER_TLS_CA, err)
+	case errors.As(err, &invalidHostname):
+		return fmt.Errorf("TLS certificate of KMIP server %s does not match its host name - %v", addr, err)
+	case errors.As(err, &invalidCert):
+		return fmt.Errorf("TLS certificate of KMIP server %s is not valid - %v", addr, err)
+	}
+	return fmt.Errorf("failed to connect to KMIP server %s - %v", addr, err)
+}
+
 // Read an entire TTLV structure from reader's input and return.
 func ReadFullTTLV(reader io.Reader) (ttlv.Item, error) {
 	var structLen int32
@@ -118,7 +142,8 @@ func (client *KMIPClient) ConverseWithRetry(request structure.SerialisedItem) (t
 		var conn *tls.Conn
 		conn, err = tls.Dial("tcp", addr, client.TLSConfig)
 		if err != nil {
-			log.Printf("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server %s", addr)
+			err = describeKMIPDialError(addr, err)
+			log.Printf("KMIPClient.ConverseWithRetry: %v", err)
 			continue
 		}
 		if _, err = conn.Write(encodedRequest); err != nil {
@@ -134,9 +159,36 @@ func (client *KMIPClient) ConverseWithRetry(request structure.SerialisedItem) (t
 			continue
 		}
 		conn.Close()
+		client.mutex.Lock()
+		client.lastSuccess = time.Now()
+		client.lastAddr = addr
+		client.mutex.Unlock()
 		return ttlvResp, nil
 	}
-	return nil, fmt.Errorf("KMIPClient.ConverseWithRetry: ultimately failed in all attempts at conversing with server - %v", err)
+	err = fmt.Errorf("KMIPClient.ConverseWithRetry: ultimately failed in all attempts at conversing with server - %v", err)
+	client.mutex.Lock()
+	client.lastFailure = time.Now()
+	client.lastErr = err
+	client.mutex.Unlock()
+	return nil, err
+}
+
+/*
+LastConversation returns the time of the most recent successful conversation with a server, and the time and reason
+of the most recent conversation that failed with all servers. The times are zero if there has not been such a
+conversation yet.
+*/
+func (client *KMIPClient) LastConversation() (lastSuccess, lastFailure time.Time, lastErr error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.lastSuccess, client.lastFailure, client.lastErr
+}
+
+// ActiveServer returns the address of the server that answered the most recent successful conversation, or empty.
+func (client *KMIPClient) ActiveServer() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.lastAddr
 }
 
 /*
@@ -153,10 +205,16 @@ func (client *KMIPClient) MakeRequest(request structure.SerialisedItem) (structu
 	switch request.(type) {
 	case *structure.SCreateRequest:
 		respItem = &structure.SCreateResponse{}
+	case *structure.SRegisterRequest:
+		respItem = &structure.SRegisterResponse{}
 	case *structure.SGetRequest:
 		respItem = &structure.SGetResponse{}
 	case *structure.SDestroyRequest:
 		respItem = &structure.SDestroyResponse{}
+	case *structure.SQueryRequest:
+		respItem = &structure.SQueryResponse{}
+	case *structure.SRevokeRequest:
+		respItem = &structure.SRevokeResponse{}
 	default:
 		return nil, fmt.Errorf("KMIPClient.MakeRequest: does not understand the request type \"%s\"", reflect.TypeOf(request).String())
 	}
@@ -166,14 +224,20 @@ func (client *KMIPClient) MakeRequest(request structure.SerialisedItem) (structu
 	return respItem, err
 }
 
-// Return a SRequestHeader structure that has client's protocol version and user credentials.
+/*
+Return a SRequestHeader structure that has client's protocol version and user credentials. The credential is left out
+if username is empty, so that servers doing TLS-only authentication do not see an empty credential.
+*/
 func (client *KMIPClient) GetRequestHeader() structure.SRequestHeader {
-	return structure.SRequestHeader{
+	header := structure.SRequestHeader{
 		SProtocolVersion: structure.SProtocolVersion{
 			IMajor: ttlv.Integer{Value: structure.ValProtocolVersionMajorKMIP1_3},
 			IMinor: ttlv.Integer{Value: structure.ValProtocolVersionMinorKMIP1_3},
 		},
-		SAuthentication: structure.SAuthentication{
+		IBatchCount: ttlv.Integer{Value: 1},
+	}
+	if client.Username != "" {
+		header.SAuthentication = structure.SAuthentication{
 			SCredential: structure.SCredential{
 				ICredentialType: ttlv.Enumeration{Value: structure.ValCredentialTypeUsernamePassword},
 				SCredentialValue: structure.SCredentialValueUsernamePassword{
@@ -181,9 +245,25 @@ func (client *KMIPClient) GetRequestHeader() structure.SRequestHeader {
 					TPassword: ttlv.Text{Value: client.Password},
 				},
 			},
-		},
-		IBatchCount: ttlv.Integer{Value: 1},
+		}
 	}
+	return header
+}
+
+// KMIPResponseError is the error result of a KMIP operation reported by server.
+type KMIPResponseError struct {
+	Status, Reason int32
+	Message        string
+}
+
+func (err KMIPResponseError) Error() string {
+	return fmt.Sprintf("KMIP response error: status %d, reason %d, message %s.", err.Status, err.Reason, err.Message)
+}
+
+// IsKMIPNotFound returns true if the error is a KMIP server's response saying that the object does not exist.
+func IsKMIPNotFound(err error) bool {
+	var respErr KMIPResponseError
+	return errors.As(err, &respErr) && respErr.Reason == structure.ValResultReasonNotFound
 }
 
 // If KMIP response item contains an error, return the error, otherwise return nil.
@@ -191,8 +271,41 @@ func ResponseItemToError(resp structure.SResponseBatchItem) error {
 	if resp.EResultStatus.Value == structure.ValResultStatusSuccess {
 		return nil
 	}
-	return fmt.Errorf("KMIP response error: status %d, reason %d, message %s.",
-		resp.EResultStatus.Value, resp.EResultReason.Value, resp.EResultMessage.Value)
+	return KMIPResponseError{Status: resp.EResultStatus.Value, Reason: resp.EResultReason.Value, Message: resp.EResultMessage.Value}
+}
+
+// Return the template attributes that describe a disk encryption key of the length (in bits) and name.
+func keyTemplateAttributes(keyName string, keySizeBits int32) []structure.SAttribute {
+	return []structure.SAttribute{
+		{
+			TAttributeName: ttlv.Text{Value: structure.ValAttributeNameCryptoAlg},
+			AttributeValue: &ttlv.Enumeration{
+				TTL:   ttlv.TTL{Tag: structure.TagAttributeValue},
+				Value: structure.ValCryptoAlgoAES,
+			},
+		},
+		{
+			TAttributeName: ttlv.Text{Value: structure.ValAttributeNameCryptoLen},
+			AttributeValue: &ttlv.Integer{
+				TTL:   ttlv.TTL{Tag: structure.TagAttributeValue},
+				Value: keySizeBits, // keep in mind that key size is in bits
+			},
+		},
+		{
+			TAttributeName: ttlv.Text{Value: structure.ValAttributeNameCryptoUsageMask},
+			AttributeValue: &ttlv.Integer{
+				TTL:   ttlv.TTL{Tag: structure.TagAttributeValue},
+				Value: structure.MaskCryptoUsageEncrypt | structure.MaskCryptoUsageDecrypt,
+			},
+		},
+		{
+			TAttributeName: ttlv.Text{Value: structure.ValAttributeNameKeyName},
+			AttributeValue: structure.SCreateRequestNameAttributeValue{
+				TKeyName: ttlv.Text{Value: keyName},
+				EKeyType: ttlv.Enumeration{Value: structure.ValObjectTypeSymmetricKey},
+			}.SerialiseToTTLV(), // TODO: get rid of this ugly call to SerialiseToTTLV()
+		},
+	}
 }
 
 // Create a new disk encryption key and return its KMIP ID.
@@ -210,39 +323,8 @@ func (client *KMIPClient) CreateKey(keyName string) (id string, err error) {
 		SRequestBatchItem: structure.SRequestBatchItem{
 			EOperation: ttlv.Enumeration{Value: structure.ValOperationCreate},
 			SRequestPayload: &structure.SRequestPayloadCreate{
-				EObjectType: ttlv.Enumeration{Value: structure.ValObjectTypeSymmetricKey},
-				STemplateAttribute: structure.STemplateAttribute{
-					Attributes: []structure.SAttribute{
-						{
-							TAttributeName: ttlv.Text{Value: structure.ValAttributeNameCryptoAlg},
-							AttributeValue: &ttlv.Enumeration{
-								TTL:   ttlv.TTL{Tag: structure.TagAttributeValue},
-								Value: structure.ValCryptoAlgoAES,
-							},
-						},
-						{
-							TAttributeName: ttlv.Text{Value: structure.ValAttributeNameCryptoLen},
-							AttributeValue: &ttlv.Integer{
-								TTL:   ttlv.TTL{Tag: structure.TagAttributeValue},
-								Value: KMIPAESKeySizeBits, // keep in mind that key size is in bits
-							},
-						},
-						{
-							TAttributeName: ttlv.Text{Value: structure.ValAttributeNameCryptoUsageMask},
-							AttributeValue: &ttlv.Integer{
-								TTL:   ttlv.TTL{Tag: structure.TagAttributeValue},
-								Value: structure.MaskCryptoUsageEncrypt | structure.MaskCryptoUsageDecrypt,
-							},
-						},
-						{
-							TAttributeName: ttlv.Text{Value: structure.ValAttributeNameKeyName},
-							AttributeValue: structure.SCreateRequestNameAttributeValue{
-								TKeyName: ttlv.Text{Value: keyName},
-								EKeyType: ttlv.Enumeration{Value: structure.ValObjectTypeSymmetricKey},
-							}.SerialiseToTTLV(), // TODO: get rid of this ugly call to SerialiseToTTLV()
-						},
-					},
-				},
+				EObjectType:        ttlv.Enumeration{Value: structure.ValObjectTypeSymmetricKey},
+				STemplateAttribute: structure.STemplateAttribute{Attributes: keyTemplateAttributes(keyName, KMIPAESKeySizeBits)},
 			},
 		},
 	})
@@ -260,6 +342,52 @@ func (client *KMIPClient) CreateKey(keyName string) (id string, err error) {
 	return
 }
 
+/*
+Store an existing disk encryption key on the server and return its KMIP ID. Unlike CreateKey, the key content is
+supplied by the caller, which is how keys kept in the key database move to a KMIP server.
+*/
+func (client *KMIPClient) RegisterKey(keyName string, key []byte) (id string, err error) {
+	defer func() {
+		// In the unlikely case that a misbehaving server causes client to crash.
+		if r := recover(); r != nil {
+			msg := fmt.Sprintf("KMIPClient.RegisterKey: the function crashed due to programming error - %v", r)
+			log.Print(msg)
+			err = errors.New(msg)
+		}
+	}()
+	keySizeBits := int32(len(key) * 8)
+	resp, err := client.MakeRequest(&structure.SRegisterRequest{
+		SRequestHeader: client.GetRequestHeader(),
+		SRequestBatchItem: structure.SRequestBatchItem{
+			EOperation: ttlv.Enumeration{Value: structure.ValOperationRegister},
+			SRequestPayload: &structure.SRequestPayloadRegister{
+				EObjectType:        ttlv.Enumeration{Value: structure.ValObjectTypeSymmetricKey},
+				STemplateAttribute: structure.STemplateAttribute{Attributes: keyTemplateAttributes(keyName, keySizeBits)},
+				SSymmetricKey: structure.SSymmetricKey{
+					SKeyBlock: structure.SKeyBlock{
+						EFormatType:      ttlv.Enumeration{Value: structure.ValKeyFormatTypeRaw},
+						SKeyValue:        structure.SKeyValue{BKeyMaterial: ttlv.Bytes{Value: key}},
+						ECryptoAlgorithm: ttlv.Enumeration{Value: structure.ValCryptoAlgoAES},
+						ECryptoLen:       ttlv.Integer{Value: keySizeBits},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	typedResp := resp.(*structure.SRegisterResponse)
+	if err = ResponseItemToError(typedResp.SResponseBatchItem); err != nil {
+		return
+	}
+	id = typedResp.SResponseBatchItem.SResponsePayload.(*structure.SResponsePayloadRegister).TUniqueID.Value
+	if id == "" {
+		err = errors.New("KMIPClient.RegisterKey: server did not return a key ID")
+	}
+	return
+}
+
 // Retrieve a disk encryption key by its ID.
 func (client *KMIPClient) GetKey(id string) (key []byte, err error) {
 	defer func() {
@@ -287,7 +415,8 @@ func (client *KMIPClient) GetKey(id string) (key []byte, err error) {
 		return
 	}
 	key = typedResp.SResponseBatchItem.SResponsePayload.(*structure.SResponsePayloadGet).SSymmetricKey.SKeyBlock.SKeyValue.BKeyMaterial.Value
-	if key == nil || len(key) != KMIPAESKeySizeBits/8 {
+	// Keys created by KMIP are always of the same size, but a rotated key moved onto KMIP server may be of any size.
+	if len(key) < MinRotatedKeyLen {
 		err = fmt.Errorf("KMIPClient.GetKey: (ID %s) key content looks wrong (%d)", id, len(key))
 	}
 	return
@@ -317,3 +446,93 @@ func (client *KMIPClient) DestroyKey(id string) (err error) {
 	}
 	return ResponseItemToError(resp.(*structure.SDestroyResponse).SResponseBatchItem)
 }
+
+/*
+Revoke a key so that the KMIP server no longer hands it out, with the reason of cessation of operation. KMIP servers
+refuse to destroy an active key, hence a key is revoked before it is destroyed.
+*/
+func (client *KMIPClient) RevokeKey(id string) (err error) {
+	defer func() {
+		// In the unlikely case that a misbehaving server causes client to crash.
+		if r := recover(); r != nil {
+			msg := fmt.Sprintf("KMIPClient.RevokeKey: (ID %s) the function crashed due to programming error - %v", id, r)
+			log.Print(msg)
+			err = errors.New(msg)
+		}
+	}()
+	resp, err := client.MakeRequest(&structure.SRevokeRequest{
+		SRequestHeader: client.GetRequestHeader(),
+		SRequestBatchItem: structure.SRequestBatchItem{
+			EOperation: ttlv.Enumeration{Value: structure.ValOperationRevoke},
+			SRequestPayload: &structure.SRequestPayloadRevoke{
+				TUniqueID: ttlv.Text{Value: id},
+				SRevocationReason: structure.SRevocationReason{
+					ERevocationReasonCode: ttlv.Enumeration{Value: structure.ValRevocationReasonCessationOfOperation},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	return ResponseItemToError(resp.(*structure.SRevokeResponse).SResponseBatchItem)
+}
+
+// KMIPServerInfo is the outcome of a query operation.
+type KMIPServerInfo struct {
+	Address    string   // Address is the server that answered the query.
+	Vendor     string   // Vendor is the vendor identification reported by server, it may be empty.
+	Operations []string // Operations are the names of KMIP operations supported by server.
+}
+
+// Names of the KMIP operations that may appear in a query response.
+var kmipOperationNames = map[int32]string{
+	1: "Create", 2: "Create Key Pair", 3: "Register", 4: "Re-key", 5: "Derive Key", 6: "Certify", 7: "Re-certify",
+	8: "Locate", 9: "Check", 10: "Get", 11: "Get Attributes", 12: "Get Attribute List", 13: "Add Attribute",
+	14: "Modify Attribute", 15: "Delete Attribute", 16: "Obtain Lease", 17: "Get Usage Allocation", 18: "Activate",
+	19: "Revoke", 20: "Destroy", 21: "Archive", 22: "Recover", 23: "Validate", 24: "Query", 25: "Cancel", 26: "Poll",
+	27: "Notify", 28: "Put", 29: "Re-key Key Pair", 30: "Discover Versions",
+}
+
+// Query asks a server for its supported operations and vendor identification, which also proves the connectivity.
+func (client *KMIPClient) Query() (info KMIPServerInfo, err error) {
+	defer func() {
+		// In the unlikely case that a misbehaving server causes client to crash.
+		if r := recover(); r != nil {
+			msg := fmt.Sprintf("KMIPClient.Query: the function crashed due to programming error - %v", r)
+			log.Print(msg)
+			err = errors.New(msg)
+		}
+	}()
+	resp, err := client.MakeRequest(&structure.SQueryRequest{
+		SRequestHeader: client.GetRequestHeader(),
+		SRequestBatchItem: structure.SRequestBatchItem{
+			EOperation: ttlv.Enumeration{Value: structure.ValOperationQuery},
+			SRequestPayload: &structure.SRequestPayloadQuery{
+				EQueryFunctions: []ttlv.Enumeration{
+					{Value: structure.ValQueryFunctionOperations},
+					{Value: structure.ValQueryFunctionServerInformation},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	typedResp := resp.(*structure.SQueryResponse)
+	if err = ResponseItemToError(typedResp.SResponseBatchItem); err != nil {
+		return
+	}
+	payload := typedResp.SResponseBatchItem.SResponsePayload.(*structure.SResponsePayloadQuery)
+	info.Address = client.ActiveServer()
+	info.Vendor = payload.TVendorIdentification.Value
+	info.Operations = make([]string, 0, len(payload.EOperations))
+	for _, op := range payload.EOperations {
+		name, found := kmipOperationNames[op.Value]
+		if !found {
+			name = fmt.Sprintf("unknown (%d)", op.Value)
+		}
+		info.Operations = append(info.Operations, name)
+	}
+	return
+}
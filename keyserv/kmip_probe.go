@@ -0,0 +1,64 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const KMIPRoundTripKeyName = KeyNamePrefix + "kmip-test" // KMIPRoundTripKeyName is the name of the dummy key stored by the round trip.
+
+// KMIPRoundTrip is the outcome of storing, reading back, and removing a dummy key on one of the KMIP servers.
+type KMIPRoundTrip struct {
+	Address  string        `json:"address"`         // Address is the KMIP server's address and port.
+	Duration time.Duration `json:"duration"`        // Duration is how long the round trip took.
+	Error    string        `json:"error,omitempty"` // Error tells the operation that failed, empty if the round trip succeeded.
+}
+
+/*
+RoundTripKMIPServers registers a random dummy key on each of the configured KMIP servers in turn, reads it back, and
+destroys it, using the CA, client certificate, and credentials of the configuration. A server that refuses to destroy
+an active key gets the key revoked first. No key of records is involved, so the check is safe to run before the
+configuration takes effect.
+*/
+func RoundTripKMIPServers(conf CryptServiceConfig) []KMIPRoundTrip {
+	results := make([]KMIPRoundTrip, 0, len(conf.KMIPAddresses))
+	for _, addr := range conf.KMIPAddresses {
+		addrConf := conf
+		addrConf.KMIPAddresses = []string{addr}
+		start := time.Now()
+		result := KMIPRoundTrip{Address: addr}
+		if err := roundTripKMIPServer(addrConf); err != nil {
+			result.Error = err.Error()
+		}
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Register, get, and destroy a dummy key on the only KMIP server of the configuration.
+func roundTripKMIPServer(conf CryptServiceConfig) error {
+	client, err := NewExternalKMIPClient(conf)
+	if err != nil {
+		return err
+	}
+	key := GetNewDiskEncryptionKeyBits()
+	id, err := client.RegisterKey(KMIPRoundTripKeyName, key)
+	if err != nil {
+		return fmt.Errorf("register failed - %v", err)
+	}
+	if readBack, err := client.GetKey(id); err != nil {
+		err = fmt.Errorf("get failed - %v", err)
+	} else if !bytes.Equal(readBack, key) {
+		err = fmt.Errorf("get returned a different key of %d bytes", len(readBack))
+	}
+	if destroyErr := client.DestroyKey(id); destroyErr != nil {
+		if revokeErr := client.RevokeKey(id); revokeErr != nil || client.DestroyKey(id) != nil {
+			return fmt.Errorf("destroy failed, dummy key \"%s\" (ID %s) is left on the server - %v", KMIPRoundTripKeyName, id, destroyErr)
+		}
+	}
+	return err
+}
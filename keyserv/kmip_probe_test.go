@@ -0,0 +1,64 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestRoundTripKMIPServers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2-kmip-probe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// The built-in KMIP server with its own database plays the external KMIP appliance
+	applianceDB, err := keydb.OpenDB(path.Join(tmpDir, "appliance"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appliance, err := NewKMIPServer(applianceDB, path.Join(PkgInGopath, "keyserv", "rpc_test.crt"), path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appliance.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go appliance.HandleConnections()
+	defer appliance.Shutdown()
+	// Nothing listens on the port of a closed listener
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	conf := CryptServiceConfig{
+		KMIPAddresses: []string{"localhost:" + strconv.Itoa(appliance.GetPort()), closed.Addr().String()},
+		KMIPUser:      "username-does-not-matter",
+		KMIPPass:      string(appliance.PasswordChallenge),
+	}
+	results := RoundTripKMIPServers(conf)
+	if len(results) != 2 || results[0].Address != conf.KMIPAddresses[0] || results[0].Error != "" || results[0].Duration <= 0 {
+		t.Fatalf("%+v", results)
+	}
+	if results[1].Address != conf.KMIPAddresses[1] || results[1].Error == "" {
+		t.Fatalf("%+v", results)
+	}
+	// The dummy key is stored under its own name, the built-in server answers destroy without removing the record
+	if recs := applianceDB.List(); len(recs) != 1 || KeyNamePrefix+recs[0].UUID != KMIPRoundTripKeyName {
+		t.Fatalf("%+v", recs)
+	}
+	// A wrong password fails the round trip
+	conf.KMIPAddresses = conf.KMIPAddresses[:1]
+	conf.KMIPPass = "wrong"
+	if results := RoundTripKMIPServers(conf); len(results) != 1 || results[0].Error == "" {
+		t.Fatalf("%+v", results)
+	}
+}
@@ -118,7 +118,8 @@ func (srv *KMIPServer) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 	var err error
 	var successfulDecodeAttempt structure.SerialisedItem
-	decodeAttempts := []structure.SerialisedItem{&structure.SCreateRequest{}, &structure.SGetRequest{}, &structure.SDestroyRequest{}}
+	decodeAttempts := []structure.SerialisedItem{&structure.SCreateRequest{}, &structure.SRegisterRequest{}, &structure.SGetRequest{},
+		&structure.SDestroyRequest{}, &structure.SQueryRequest{}}
 	log.Printf("KMIPServer.HandleConnection: connected from %s", conn.RemoteAddr().String())
 	ttlvItem, err := ReadFullTTLV(conn)
 	if err != nil {
@@ -173,6 +174,10 @@ func (srv *KMIPServer) HandleRequest(req structure.SerialisedItem, conn net.Conn
 		if err = srv.CheckPassword(t.SRequestHeader); err == nil {
 			resp, err = srv.HandleCreateRequest(t)
 		}
+	case *structure.SRegisterRequest:
+		if err = srv.CheckPassword(t.SRequestHeader); err == nil {
+			resp, err = srv.HandleRegisterRequest(t)
+		}
 	case *structure.SGetRequest:
 		if err := srv.CheckPassword(t.SRequestHeader); err == nil {
 			resp, err = srv.HandleGetRequest(t)
@@ -181,6 +186,10 @@ func (srv *KMIPServer) HandleRequest(req structure.SerialisedItem, conn net.Conn
 		if err := srv.CheckPassword(t.SRequestHeader); err == nil {
 			resp, err = srv.HandleDestroyRequest(t)
 		}
+	case *structure.SQueryRequest:
+		if err = srv.CheckPassword(t.SRequestHeader); err == nil {
+			resp = srv.HandleQueryRequest(t)
+		}
 	default:
 		err = fmt.Errorf("KMIPServer.HandleRequest: unknown request type %s", reflect.TypeOf(req).String())
 	}
@@ -240,6 +249,49 @@ func (srv *KMIPServer) HandleCreateRequest(req *structure.SCreateRequest) (*stru
 	return &ret, nil
 }
 
+// Handle a KMIP register request by placing the key supplied by client in a database record.
+func (srv *KMIPServer) HandleRegisterRequest(req *structure.SRegisterRequest) (*structure.SRegisterResponse, error) {
+	payload := req.SRequestBatchItem.SRequestPayload.(*structure.SRequestPayloadRegister)
+	var keyName string
+	for _, attr := range payload.STemplateAttribute.Attributes {
+		if attr.TAttributeName.Value == structure.ValAttributeNameKeyName {
+			keyName = attr.AttributeValue.(*ttlv.Structure).Items[0].(*ttlv.Text).Value
+		}
+	}
+	key := payload.SSymmetricKey.SKeyBlock.SKeyValue.BKeyMaterial.Value
+	if len(key) < MinRotatedKeyLen {
+		return nil, fmt.Errorf("KMIPServer.HandleRegisterRequest: key \"%s\" is too short (%d)", keyName, len(key))
+	}
+	creationTime := time.Now()
+	kmipID, err := srv.DB.Upsert(keydb.Record{
+		UUID:         strings.TrimPrefix(keyName, KeyNamePrefix),
+		CreationTime: creationTime,
+		Key:          key,
+	})
+	log.Printf("KMIPServer.HandleRegisterRequest: just registered a key named \"%s\" ID \"%s\"", keyName, kmipID)
+	if err != nil {
+		return nil, err
+	}
+	ret := structure.SRegisterResponse{
+		SResponseHeader: structure.SResponseHeader{
+			SVersion: structure.SProtocolVersion{
+				IMajor: ttlv.Integer{Value: structure.ValProtocolVersionMajorKMIP1_3},
+				IMinor: ttlv.Integer{Value: structure.ValProtocolVersionMinorKMIP1_3},
+			},
+			TTimestamp:  ttlv.DateTime{Time: creationTime},
+			IBatchCount: ttlv.Integer{Value: 1},
+		},
+		SResponseBatchItem: structure.SResponseBatchItem{
+			EOperation:    ttlv.Enumeration{Value: structure.ValOperationRegister},
+			EResultStatus: ttlv.Enumeration{Value: structure.ValResultStatusSuccess},
+			SResponsePayload: &structure.SResponsePayloadRegister{
+				TUniqueID: ttlv.Text{Value: kmipID},
+			},
+		},
+	}
+	return &ret, nil
+}
+
 // Handle a KMIP get request by responding with key content.
 func (srv *KMIPServer) HandleGetRequest(req *structure.SGetRequest) (*structure.SGetResponse, error) {
 	kmipID := req.SRequestBatchItem.SRequestPayload.(*structure.SRequestPayloadGet).TUniqueID.Value
@@ -338,3 +390,36 @@ func (srv *KMIPServer) HandleDestroyRequest(req *structure.SDestroyRequest) (*st
 	}
 	return ret, nil
 }
+
+// Handle a KMIP query request by responding with the operations supported by this server.
+func (srv *KMIPServer) HandleQueryRequest(req *structure.SQueryRequest) *structure.SQueryResponse {
+	payload := &structure.SResponsePayloadQuery{}
+	for _, function := range req.SRequestBatchItem.SRequestPayload.(*structure.SRequestPayloadQuery).EQueryFunctions {
+		switch function.Value {
+		case structure.ValQueryFunctionOperations:
+			payload.EOperations = []ttlv.Enumeration{
+				{Value: structure.ValOperationCreate}, {Value: structure.ValOperationRegister}, {Value: structure.ValOperationGet},
+				{Value: structure.ValOperationDestroy}, {Value: structure.ValOperationQuery},
+			}
+		case structure.ValQueryFunctionObjects:
+			payload.EObjectTypes = []ttlv.Enumeration{{Value: structure.ValObjectTypeSymmetricKey}}
+		case structure.ValQueryFunctionServerInformation:
+			payload.TVendorIdentification = ttlv.Text{Value: "cryptctl2 built-in KMIP server"}
+		}
+	}
+	return &structure.SQueryResponse{
+		SResponseHeader: structure.SResponseHeader{
+			SVersion: structure.SProtocolVersion{
+				IMajor: ttlv.Integer{Value: structure.ValProtocolVersionMajorKMIP1_3},
+				IMinor: ttlv.Integer{Value: structure.ValProtocolVersionMinorKMIP1_3},
+			},
+			TTimestamp:  ttlv.DateTime{Time: time.Now()},
+			IBatchCount: ttlv.Integer{Value: 1},
+		},
+		SResponseBatchItem: structure.SResponseBatchItem{
+			EOperation:       ttlv.Enumeration{Value: structure.ValOperationQuery},
+			EResultStatus:    ttlv.Enumeration{Value: structure.ValResultStatusSuccess},
+			SResponsePayload: payload,
+		},
+	}
+}
@@ -4,12 +4,15 @@ package keyserv
 
 import (
 	"cryptctl2/keydb"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -92,6 +95,64 @@ func TestKMIP(t *testing.T) {
 	server.Shutdown()
 }
 
+func TestKMIPQuery(t *testing.T) {
+	keydbDir, err := ioutil.TempDir("", "cryptctl2-kmip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keydbDir)
+	db, err := keydb.OpenDB(keydbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewKMIPServer(db, path.Join(PkgInGopath, "keyserv", "rpc_test.crt"), path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go server.HandleConnections()
+	defer server.Shutdown()
+	addr := "localhost:" + strconv.Itoa(server.GetPort())
+	client, err := NewKMIPClient([]string{addr}, "username-does-not-matter", string(server.PasswordChallenge), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TLSConfig.InsecureSkipVerify = true
+	if client.ActiveServer() != "" {
+		t.Fatal(client.ActiveServer())
+	}
+	info, err := client.Query()
+	if err != nil || info.Address != addr || info.Vendor == "" || !reflect.DeepEqual(info.Operations, []string{"Create", "Register", "Get", "Destroy", "Query"}) {
+		t.Fatalf("%+v %v", info, err)
+	}
+	if lastSuccess, _, _ := client.LastConversation(); lastSuccess.IsZero() {
+		t.Fatal("did not record success")
+	}
+
+	// Without username and password the credential is left out entirely
+	tlsOnly, err := NewKMIPClient([]string{addr}, "", "", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := tlsOnly.GetRequestHeader(); header.SAuthentication.SCredential.ICredentialType.Value != 0 {
+		t.Fatalf("%+v", header)
+	}
+}
+
+func TestDescribeKMIPDialError(t *testing.T) {
+	if err := describeKMIPDialError("a:1", x509.UnknownAuthorityError{}); !strings.Contains(err.Error(), "not signed by the configured CA") {
+		t.Fatal(err)
+	}
+	if err := describeKMIPDialError("a:1", x509.HostnameError{Host: "a"}); !strings.Contains(err.Error(), "host name") {
+		t.Fatal(err)
+	}
+	if err := describeKMIPDialError("a:1", errors.New("connection refused")); !strings.Contains(err.Error(), "failed to connect to KMIP server a:1") {
+		t.Fatal(err)
+	}
+}
+
 func TestKMIPAgainstPyKMIP(t *testing.T) {
 	/*
 			A PyKMIP server can be started using the python code below:
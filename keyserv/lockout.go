@@ -0,0 +1,212 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_AUTH_MAX_FAILURES    = "AUTH_MAX_FAILURES"
+	SRV_CONF_AUTH_LOCKOUT_MINUTES = "AUTH_LOCKOUT_MINUTES"
+	SRV_CONF_CLIENT_CALLS_PER_MIN = "CLIENT_CALLS_PER_MINUTE"
+	SRV_CONF_MAIL_LOCKOUT_SUBJ    = "EMAIL_LOCKOUT_SUBJECT"
+
+	DefaultAuthMaxFailures    = 5   // DefaultAuthMaxFailures is the number of consecutive wrong passwords that locks out an IP.
+	DefaultAuthLockoutMinutes = 15  // DefaultAuthLockoutMinutes is the length of the first lockout of an IP.
+	DefaultClientCallsPerMin  = 120 // DefaultClientCallsPerMin is the number of AutoRetrieveKey and ReportAlive calls admitted from a client per minute.
+	MaxAuthLockout            = 24 * time.Hour
+)
+
+// ErrClientCallRateLimited is returned to a client that calls AutoRetrieveKey or ReportAlive more often than allowed.
+var ErrClientCallRateLimited = errors.New("too many requests from this computer, try again later")
+
+// The failed password attempts of one IP.
+type authFailures struct {
+	failures    int       // failures is the number of consecutive wrong passwords since the last lockout.
+	lockouts    int       // lockouts is the number of lockouts so far, each one lasts twice as long as the previous.
+	lockedUntil time.Time // lockedUntil is the end of the current lockout.
+	lastFailure time.Time
+}
+
+/*
+PasswordLockout counts consecutive wrong passwords from each IP. Once an IP has given MaxFailures wrong passwords in a
+row, its password is refused without being checked for the lockout period, which doubles with each further lockout up
+to MaxAuthLockout. A correct password resets the count of the IP. The state is kept in memory only.
+A nil PasswordLockout, or one of MaxFailures 0, never locks out.
+*/
+type PasswordLockout struct {
+	MaxFailures int
+	Lockout     time.Duration // Lockout is the length of the first lockout.
+
+	mutex sync.Mutex
+	hosts map[string]*authFailures
+	now   func() time.Time
+}
+
+// NewPasswordLockout returns a lockout that locks out an IP for the period after so many consecutive wrong passwords.
+func NewPasswordLockout(maxFailures int, lockout time.Duration) *PasswordLockout {
+	return &PasswordLockout{MaxFailures: maxFailures, Lockout: lockout, hosts: make(map[string]*authFailures), now: time.Now}
+}
+
+// LockedFor returns how much longer the IP stays locked out, zero if it is not locked out.
+func (lockout *PasswordLockout) LockedFor(ip string) time.Duration {
+	if lockout == nil || lockout.MaxFailures < 1 {
+		return 0
+	}
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	if host, found := lockout.hosts[ip]; found {
+		if remaining := host.lockedUntil.Sub(lockout.now()); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// Failed counts a wrong password from the IP, and returns the length of the lockout that it starts, zero if none.
+func (lockout *PasswordLockout) Failed(ip string) time.Duration {
+	if lockout == nil || lockout.MaxFailures < 1 {
+		return 0
+	}
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	return lockout.countFailure(ip, lockout.now())
+}
+
+/*
+Attempt counts a password attempt of the IP as a wrong password before the password is checked, so that concurrent
+attempts cannot get past the lockout while their passwords are being checked. If the IP is locked out, the attempt is
+not counted and the remaining lockout is returned, the password must then be refused without being checked. Otherwise
+the period of the lockout started by the attempt is returned, zero if none; Succeeded rolls back both once the password
+turns out correct.
+*/
+func (lockout *PasswordLockout) Attempt(ip string) (remaining, period time.Duration) {
+	if lockout == nil || lockout.MaxFailures < 1 {
+		return 0, 0
+	}
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	now := lockout.now()
+	if host, found := lockout.hosts[ip]; found {
+		if remaining := host.lockedUntil.Sub(now); remaining > 0 {
+			return remaining, 0
+		}
+	}
+	return 0, lockout.countFailure(ip, now)
+}
+
+// Count a wrong password from the IP, and return the length of the lockout that it starts. Caller must hold the mutex.
+func (lockout *PasswordLockout) countFailure(ip string, now time.Time) time.Duration {
+	// IPs that have not failed for a day are forgotten
+	for otherIP, host := range lockout.hosts {
+		if now.Sub(host.lastFailure) > MaxAuthLockout && now.After(host.lockedUntil) {
+			delete(lockout.hosts, otherIP)
+		}
+	}
+	host, found := lockout.hosts[ip]
+	if !found {
+		host = &authFailures{}
+		lockout.hosts[ip] = host
+	}
+	host.lastFailure = now
+	host.failures++
+	if host.failures < lockout.MaxFailures {
+		return 0
+	}
+	period := lockout.Lockout
+	for i := 0; i < host.lockouts && period < MaxAuthLockout; i++ {
+		period *= 2
+	}
+	if period > MaxAuthLockout {
+		period = MaxAuthLockout
+	}
+	host.failures = 0
+	host.lockouts++
+	host.lockedUntil = now.Add(period)
+	return period
+}
+
+// Succeeded forgets the wrong passwords and lockouts of the IP.
+func (lockout *PasswordLockout) Succeeded(ip string) {
+	if lockout == nil || lockout.MaxFailures < 1 {
+		return
+	}
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	delete(lockout.hosts, ip)
+}
+
+/*
+Check the password given by the peer of the connection, unless the peer's IP is locked out after too many wrong
+passwords, in which case the password is refused without being checked. The attempt is counted before the password is
+checked, so that no more than the permitted number of concurrent guesses are ever checked. The local domain socket is
+never locked out, as only root and the domain socket group may connect to it. A password refused for lack of a free
+password check slot is not counted as an attempt.
+*/
+func (rpcConn *CryptServiceConn) checkPasswordWithLockout(plainPassword string) error {
+	lockout := rpcConn.Svc.PasswordLockout
+	if rpcConn.RemoteHost == "@" {
+		lockout = nil
+	}
+	release, err := acquirePasswordCheck()
+	if err != nil {
+		log.Printf("<4>CryptServiceConn.validatePassword: refused the password of %s - %v", rpcConn.RemoteHost, err)
+		return err
+	}
+	defer release()
+	remaining, period := lockout.Attempt(rpcConn.RemoteHost)
+	if remaining > 0 {
+		return fmt.Errorf("validatePassword: %s is locked out after too many incorrect passwords, try again in %s",
+			rpcConn.RemoteHost, remaining.Round(time.Second))
+	}
+	if err := rpcConn.Svc.validatePlainPassword(plainPassword); err != nil {
+		if period > 0 {
+			rpcConn.notifyLockout(period)
+		}
+		return err
+	}
+	lockout.Succeeded(rpcConn.RemoteHost)
+	return nil
+}
+
+// Log and audit the lockout of the peer's IP, and send a notification email if the mailer is configured.
+func (rpcConn *CryptServiceConn) notifyLockout(period time.Duration) {
+	hostname := rpcConn.verifiedHostname()
+	log.Printf("<4>CryptServiceConn.validatePassword: %s (%s) is locked out for %s after %d incorrect passwords",
+		rpcConn.RemoteHost, hostname, period, rpcConn.Svc.PasswordLockout.MaxFailures)
+	rpcConn.audit("PasswordLockout", hostname, "", AuditResultRejected,
+		fmt.Sprintf("locked out for %s after %d incorrect passwords", period, rpcConn.Svc.PasswordLockout.MaxFailures))
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	go func() {
+		event := MailEvent{Hostname: hostname, IP: rpcConn.RemoteHost, Time: time.Now()}
+		subject := mailSubject(rpcConn.Svc.Config.LockoutSubject, event, rpcConn.RemoteHost)
+		text := fmt.Sprintf("IP: %s\r\nCertificate host name: %s\r\nIncorrect passwords: %d\r\nLocked out until: %s\r\n",
+			rpcConn.RemoteHost, hostname, rpcConn.Svc.PasswordLockout.MaxFailures, time.Now().Add(period).Format(time.RFC3339))
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("<3>CryptServiceConn.validatePassword: failed to send email notification about the lockout of %s - %v", rpcConn.RemoteHost, err)
+		}
+	}()
+}
+
+/*
+Return ErrClientCallRateLimited if the peer has called the method more often in the last minute than the client call
+limit admits. Clients are told apart by IP and the host name of their validated certificate, never by the host name
+they report, as a client could otherwise escape the limit by reporting a different name with each call.
+*/
+func (rpcConn *CryptServiceConn) limitClientCalls(method string) error {
+	if rpcConn.Svc.ClientCallLimit == nil || rpcConn.RemoteHost == "@" {
+		return nil
+	}
+	if !rpcConn.Svc.ClientCallLimit.Allow(method + " " + rpcConn.RemoteHost + " " + rpcConn.verifiedHostname()) {
+		return ErrClientCallRateLimited
+	}
+	return nil
+}
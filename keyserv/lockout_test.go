@@ -0,0 +1,255 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to, shared by the test and the RPC server.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestPasswordLockout(t *testing.T) {
+	var nilLockout *PasswordLockout
+	if nilLockout.Failed("a") != 0 || nilLockout.LockedFor("a") != 0 {
+		t.Fatal("nil lockout locked out")
+	}
+	nilLockout.Succeeded("a")
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	lockout := NewPasswordLockout(3, time.Minute)
+	lockout.now = clock.Now
+	// Each lockout lasts twice as long as the previous one, up to a day
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		for i := 0; i < 2; i++ {
+			if period := lockout.Failed("a"); period != 0 {
+				t.Fatal(i, period)
+			}
+		}
+		if period := lockout.Failed("a"); period != expected {
+			t.Fatal(period, expected)
+		}
+		if lockout.LockedFor("a") != expected || lockout.LockedFor("b") != 0 {
+			t.Fatal(lockout.LockedFor("a"), lockout.LockedFor("b"))
+		}
+		clock.Advance(expected)
+		if lockout.LockedFor("a") != 0 {
+			t.Fatal(lockout.LockedFor("a"))
+		}
+	}
+	lockout.hosts["a"].lockouts = 20
+	lockout.Failed("a")
+	lockout.Failed("a")
+	if period := lockout.Failed("a"); period != MaxAuthLockout {
+		t.Fatal(period)
+	}
+	// A correct password forgets the lockouts
+	clock.Advance(MaxAuthLockout)
+	lockout.Succeeded("a")
+	lockout.Failed("a")
+	lockout.Failed("a")
+	if period := lockout.Failed("a"); period != time.Minute {
+		t.Fatal(period)
+	}
+	// IPs that have not failed for a day are forgotten
+	clock.Advance(MaxAuthLockout + time.Second)
+	lockout.Failed("b")
+	if _, found := lockout.hosts["a"]; found {
+		t.Fatal("did not forget")
+	}
+}
+
+func TestPasswordLockout_Attempt(t *testing.T) {
+	var nilLockout *PasswordLockout
+	if remaining, period := nilLockout.Attempt("a"); remaining != 0 || period != 0 {
+		t.Fatal(remaining, period)
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	lockout := NewPasswordLockout(3, time.Minute)
+	lockout.now = clock.Now
+	// Attempts count as wrong passwords before they are checked, the last one permitted starts the lockout
+	for i := 0; i < 2; i++ {
+		if remaining, period := lockout.Attempt("a"); remaining != 0 || period != 0 {
+			t.Fatal(i, remaining, period)
+		}
+	}
+	if remaining, period := lockout.Attempt("a"); remaining != 0 || period != time.Minute {
+		t.Fatal(remaining, period)
+	}
+	clock.Advance(time.Second)
+	if remaining, period := lockout.Attempt("a"); remaining != time.Minute-time.Second || period != 0 {
+		t.Fatal(remaining, period)
+	}
+	// The refused attempt is not counted, and a correct password rolls back the lockout
+	if lockout.hosts["a"].failures != 0 || lockout.hosts["a"].lockouts != 1 {
+		t.Fatalf("%+v", lockout.hosts["a"])
+	}
+	lockout.Succeeded("a")
+	if remaining, period := lockout.Attempt("a"); remaining != 0 || period != 0 {
+		t.Fatal(remaining, period)
+	}
+}
+
+func TestConcurrentPasswordGuesses(t *testing.T) {
+	salt := NewSalt()
+	kdf := DefaultPasswordKDF()
+	srv := &CryptServer{Mailer: &Mailer{}, PasswordLockout: NewPasswordLockout(DefaultAuthMaxFailures, time.Minute)}
+	srv.Config.PasswordSalt, srv.Config.PasswordHash, srv.Config.PasswordKDF = salt, kdf.Hash(salt, TEST_RPC_PASS), kdf
+	conn := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+	// Guesses made at once while the first of them are being checked still run into the lockout
+	const numGuesses = 4 * DefaultAuthMaxFailures
+	errs := make(chan error, numGuesses)
+	var wg sync.WaitGroup
+	for i := 0; i < numGuesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := conn.checkPasswordWithLockout("wrong password")
+			for ; err == ErrPasswordCheckBusy; err = conn.checkPasswordWithLockout("wrong password") {
+				time.Sleep(time.Millisecond)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	checked := 0
+	for err := range errs {
+		if err == nil {
+			t.Fatal("did not error")
+		} else if !strings.Contains(err.Error(), "locked out") {
+			checked++
+		}
+	}
+	if checked != DefaultAuthMaxFailures {
+		t.Fatal(checked)
+	}
+	if err := conn.checkPasswordWithLockout(TEST_RPC_PASS); err == nil || !strings.Contains(err.Error(), "locked out") {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordCheckBusy(t *testing.T) {
+	salt := NewSalt()
+	kdf := DefaultPasswordKDF()
+	srv := &CryptServer{Mailer: &Mailer{}, PasswordLockout: NewPasswordLockout(1, time.Minute)}
+	srv.Config.PasswordSalt, srv.Config.PasswordHash, srv.Config.PasswordKDF = salt, kdf.Hash(salt, TEST_RPC_PASS), kdf
+	conn := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+	releases := make([]func(), 0, MaxConcurrentPasswordChecks)
+	for i := 0; i < MaxConcurrentPasswordChecks; i++ {
+		release, err := acquirePasswordCheck()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		releases = append(releases, release)
+	}
+	// All slots are taken, passwords are refused right away
+	if err := srv.ValidatePlainPassword(TEST_RPC_PASS); err != ErrPasswordCheckBusy {
+		t.Fatal(err)
+	}
+	if err := conn.checkPasswordWithLockout("wrong password"); err != ErrPasswordCheckBusy {
+		t.Fatal(err)
+	}
+	// The refused password did not count towards the lockout
+	if remaining := srv.PasswordLockout.LockedFor("10.0.0.1"); remaining != 0 {
+		t.Fatal(remaining)
+	}
+	releases[0]()
+	if err := conn.checkPasswordWithLockout(TEST_RPC_PASS); err != nil {
+		t.Fatal(err)
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+	if len(passwordCheckSlots) != 0 {
+		t.Fatal(len(passwordCheckSlots))
+	}
+}
+
+func TestServerPasswordLockout(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	clock := &fakeClock{now: time.Now()}
+	server.PasswordLockout.now = clock.Now
+	lockoutPeriod := time.Duration(DefaultAuthLockoutMinutes) * time.Minute
+
+	// A correct password resets the count of incorrect ones
+	for round := 0; round < 2; round++ {
+		for i := 0; i < DefaultAuthMaxFailures-1; i++ {
+			if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil {
+				t.Fatal("did not error")
+			}
+		}
+		if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+			t.Fatal(round, err)
+		}
+	}
+	// Too many incorrect passwords lock out even the correct one
+	for i := 0; i < DefaultAuthMaxFailures; i++ {
+		if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil {
+			t.Fatal("did not error")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil || !strings.Contains(err.Error(), "locked out") {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "aaa", MountPoint: "/a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err == nil {
+		t.Fatal("did not error")
+	}
+	clock.Advance(lockoutPeriod - time.Second)
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The correct password is accepted again after the lockout
+	clock.Advance(time.Second)
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "aaa", MountPoint: "/a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerClientCallLimit(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	server.ClientCallLimit = NewRateLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := client.ReportAlive(ReportAliveReq{Hostname: "host1", UUIDs: []string{"aaa"}}); err != nil {
+			t.Fatal(i, err)
+		}
+		if _, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "host1", UUIDs: []string{"aaa"}}); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if _, err := client.ReportAlive(ReportAliveReq{Hostname: "host1", UUIDs: []string{"aaa"}}); err == nil || !strings.Contains(err.Error(), ErrClientCallRateLimited.Error()) {
+		t.Fatal(err)
+	}
+	if _, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "host1", UUIDs: []string{"aaa"}}); err == nil || !strings.Contains(err.Error(), ErrClientCallRateLimited.Error()) {
+		t.Fatal(err)
+	}
+	// Reporting another host name does not escape the limit, as the server does not validate client certificates
+	if _, err := client.ReportAlive(ReportAliveReq{Hostname: "host2", UUIDs: []string{"aaa"}}); err == nil || !strings.Contains(err.Error(), ErrClientCallRateLimited.Error()) {
+		t.Fatal(err)
+	}
+}
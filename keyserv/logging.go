@@ -0,0 +1,140 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_LOG_LEVEL = "LOG_LEVEL"
+
+	// Priorities of log messages, the same as syslog's. A message may start with "<N>" to carry priority N.
+	LogPriorityErr     = 3
+	LogPriorityWarning = 4
+	LogPriorityNotice  = 5
+	LogPriorityInfo    = 6
+	LogPriorityDebug   = 7
+
+	DefaultLogLevel = "info" // DefaultLogLevel lets every message through but debug messages.
+)
+
+// LogLevels are the names of log levels as they are configured, each lets through the messages of its priority and more urgent.
+var LogLevels = map[string]int{
+	"error":   LogPriorityErr,
+	"warning": LogPriorityWarning,
+	"notice":  LogPriorityNotice,
+	"info":    LogPriorityInfo,
+	"debug":   LogPriorityDebug,
+}
+
+// ParseLogLevel returns the priority of the log level name, an empty name is DefaultLogLevel.
+func ParseLogLevel(name string) (int, error) {
+	if name == "" {
+		name = DefaultLogLevel
+	}
+	priority, found := LogLevels[strings.ToLower(name)]
+	if !found {
+		return 0, fmt.Errorf("ParseLogLevel: log level \"%s\" is not one of error, warning, notice, info, debug", name)
+	}
+	return priority, nil
+}
+
+/*
+LogWriter is the output of the standard logger of the key server. A message may start with a "<N>" priority prefix,
+messages without one are of info priority. Messages less urgent than the level are dropped, audit events are never
+dropped. If the output is the system journal, the prefix is handed to it, so that the journal knows the priority of
+each message and adds its own timestamp; otherwise the prefix is replaced by a timestamp.
+*/
+type LogWriter struct {
+	Out     io.Writer
+	Level   int  // Level is the least urgent priority that is written.
+	Journal bool // Journal is true if the output goes to the system journal, which understands the priority prefix.
+
+	mutex sync.Mutex
+}
+
+// Split the priority prefix from the message, a message without valid prefix is of info priority.
+func splitLogPriority(msg string) (priority int, rest string) {
+	if len(msg) >= 3 && msg[0] == '<' && msg[2] == '>' && msg[1] >= '0' && msg[1] <= '7' {
+		return int(msg[1] - '0'), msg[3:]
+	}
+	return LogPriorityInfo, msg
+}
+
+// Write writes one log message (the standard logger writes each message at once), or drops it if it is not urgent enough.
+func (writer *LogWriter) Write(msg []byte) (int, error) {
+	priority, rest := splitLogPriority(string(msg))
+	if priority > writer.Level {
+		return len(msg), nil
+	}
+	writer.write(priority, rest)
+	return len(msg), nil
+}
+
+// Write the message of the priority regardless of the level.
+func (writer *LogWriter) write(priority int, msg string) {
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.Journal {
+		fmt.Fprintf(writer.Out, "<%d>%s", priority, msg)
+	} else {
+		fmt.Fprintf(writer.Out, "%s %s", time.Now().Format("2006/01/02 15:04:05"), msg)
+	}
+}
+
+var daemonLog *LogWriter // daemonLog is set up by SetupDaemonLogging, audit events are only logged once it is.
+
+/*
+SetupDaemonLogging makes the standard logger write through a LogWriter of the log level onto standard error, which
+goes to the system journal if the system journal is connected to it. Audit events are written to the log from then on.
+*/
+func SetupDaemonLogging(level string) error {
+	priority, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	daemonLog = &LogWriter{Out: os.Stderr, Level: priority, Journal: os.Getenv("JOURNAL_STREAM") != ""}
+	log.SetFlags(0)
+	log.SetOutput(daemonLog)
+	return nil
+}
+
+// Return the log priority of an audit event, rejections are warnings and failures are errors.
+func auditPriority(result string) int {
+	switch result {
+	case AuditResultRejected, AuditResultMissing:
+		return LogPriorityWarning
+	case AuditResultFailed:
+		return LogPriorityErr
+	}
+	return LogPriorityNotice
+}
+
+// FormatAuditLogLine returns the audit event as a log message of consistent fields.
+func FormatAuditLogLine(evt AuditEvent) string {
+	line := fmt.Sprintf("audit: event=%s uuid=%q hostname=%q ip=%s cert_cn=%q result=%s", evt.Event, evt.UUID, evt.Hostname, evt.IP, evt.CertCN, evt.Result)
+	if evt.Reason != "" {
+		line += fmt.Sprintf(" reason=%q", evt.Reason)
+	}
+	if evt.IdentityMismatch {
+		line += " identity_mismatch=true"
+	}
+	return line
+}
+
+// Write the audit event to the daemon log at the priority of its result, regardless of the log level.
+func logAuditEvent(evt AuditEvent) {
+	if daemonLog != nil {
+		daemonLog.write(auditPriority(evt.Result), FormatAuditLogLine(evt))
+	}
+}
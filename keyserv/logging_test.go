@@ -0,0 +1,60 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	if priority, err := ParseLogLevel(""); err != nil || priority != LogPriorityInfo {
+		t.Fatal(priority, err)
+	}
+	if priority, err := ParseLogLevel("Warning"); err != nil || priority != LogPriorityWarning {
+		t.Fatal(priority, err)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	writer := &LogWriter{Out: &out, Level: LogPriorityInfo, Journal: true}
+	for _, msg := range []string{"<7>connection arrived\n", "listening\n", "<3>failed to send email\n", "<x>odd"} {
+		if n, err := writer.Write([]byte(msg)); err != nil || n != len(msg) {
+			t.Fatal(n, err)
+		}
+	}
+	if out.String() != "<6>listening\n<3>failed to send email\n<6><x>odd\n" {
+		t.Fatal(out.String())
+	}
+
+	out.Reset()
+	writer = &LogWriter{Out: &out, Level: LogPriorityErr}
+	writer.Write([]byte("<4>TLS handshake failed\n"))
+	writer.Write([]byte("<3>failed to send email\n"))
+	if strings.Count(out.String(), "\n") != 1 || !strings.HasSuffix(out.String(), " failed to send email\n") || strings.HasPrefix(out.String(), "<") {
+		t.Fatal(out.String())
+	}
+}
+
+func TestLogAuditEvent(t *testing.T) {
+	var out bytes.Buffer
+	daemonLog = &LogWriter{Out: &out, Level: LogPriorityErr, Journal: true}
+	defer func() {
+		daemonLog = nil
+	}()
+	logAuditEvent(AuditEvent{Event: "RetrieveKey", UUID: "uuid1", Hostname: "host1", IP: "1.2.3.4", Result: AuditResultGranted})
+	logAuditEvent(AuditEvent{Event: "RetrieveKey", UUID: "uuid2", Hostname: "host2", IP: "1.2.3.5", Result: AuditResultRejected, Reason: "max active users reached"})
+	logAuditEvent(AuditEvent{Event: "EraseKey", UUID: "uuid3", IP: "1.2.3.6", Result: AuditResultFailed, IdentityMismatch: true})
+	expected := `<5>audit: event=RetrieveKey uuid="uuid1" hostname="host1" ip=1.2.3.4 cert_cn="" result=granted
+<4>audit: event=RetrieveKey uuid="uuid2" hostname="host2" ip=1.2.3.5 cert_cn="" result=rejected reason="max active users reached"
+<3>audit: event=EraseKey uuid="uuid3" hostname="" ip=1.2.3.6 cert_cn="" result=failed identity_mismatch=true
+`
+	if out.String() != expected {
+		t.Fatal(out.String())
+	}
+}
@@ -0,0 +1,140 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_MAIL_LOST_HOST          = "EMAIL_LOST_HOST_NOTIFICATION"
+	SRV_CONF_MAIL_LOST_HOST_SUBJ     = "EMAIL_LOST_HOST_SUBJECT"
+	SRV_CONF_MAIL_LOST_HOST_DEBOUNCE = "EMAIL_LOST_HOST_DEBOUNCE_MINUTES"
+	SRV_CONF_LOST_HOST_UMOUNT        = "LOST_HOST_UMOUNT"
+	SRV_CONF_LOST_HOST_UMOUNT_HOURS  = "LOST_HOST_UMOUNT_VALIDITY_HOURS"
+
+	LostHostCheckIntervalSec       = 30       // LostHostCheckIntervalSec is the interval at which records are checked for lost computers.
+	DefaultLostHostDebounceMinutes = 60       // DefaultLostHostDebounceMinutes is the default minimum time between two notifications of the same computer.
+	DefaultLostHostUmountHours     = 24       // DefaultLostHostUmountHours is the default validity of the umount command issued to a lost computer.
+	LostHostUmountCommand          = "umount" // LostHostUmountCommand is the pending command content that tells a computer to umount the disk.
+)
+
+/*
+LostHostMonitor periodically looks for computers that stopped sending alive messages while holding a key, keeps them
+as lost hosts on their record, notifies the administrator by email, and optionally tells them to umount the disk when
+they come back. Without the monitor, such computers would only be dropped silently upon the next key retrieval.
+*/
+type LostHostMonitor struct {
+	Interval time.Duration // Interval is the time between two checks.
+
+	srv  *CryptServer
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// StartLostHostMonitor starts looking for lost computers periodically.
+func (srv *CryptServer) StartLostHostMonitor() {
+	srv.LostHosts = &LostHostMonitor{
+		Interval: LostHostCheckIntervalSec * time.Second,
+		srv:      srv,
+		stop:     make(chan struct{}),
+	}
+	srv.LostHosts.done.Add(1)
+	go srv.LostHosts.run()
+}
+
+// Check for lost computers after each interval until stopped.
+func (monitor *LostHostMonitor) run() {
+	defer monitor.done.Done()
+	for {
+		select {
+		case <-monitor.stop:
+			return
+		case <-time.After(monitor.Interval):
+			monitor.Check()
+		}
+	}
+}
+
+/*
+Check keeps the computers that stopped sending alive messages as lost hosts on their records, issues umount commands
+to them if enabled, and notifies the administrator of the lost computers that have not been notified recently.
+*/
+func (monitor *LostHostMonitor) Check() {
+	monitor.srv.configLock.RLock()
+	conf := monitor.srv.Config
+	mailer := *monitor.srv.Mailer
+	monitor.srv.configLock.RUnlock()
+	lost := monitor.srv.KeyDB.ExpireDeadHosts()
+	for uuid, finalMessages := range lost {
+		for _, final := range finalMessages {
+			log.Printf("LostHostMonitor: %s (%s) has stopped sending alive messages for %s, last seen at %s",
+				final.IP, final.Hostname, uuid, time.Unix(final.Timestamp, 0).Format(time.RFC3339))
+			if !conf.LostHostUmount {
+				continue
+			}
+			cmd := keydb.PendingCommand{
+				ValidFrom: time.Now(),
+				Validity:  time.Duration(conf.LostHostUmountHours) * time.Hour,
+				Content:   LostHostUmountCommand,
+			}
+			if _, _, err := monitor.srv.KeyDB.AddPendingCommand(uuid, final.IP, cmd); err != nil {
+				log.Printf("LostHostMonitor: failed to save umount command for %s - %v", final.IP, err)
+			}
+		}
+	}
+	if !conf.LostHostMail || mailer.ValidateConfig() != nil {
+		return
+	}
+	notify := monitor.srv.KeyDB.TakeLostHostsToNotify(time.Duration(conf.LostHostDebounceMinutes) * time.Minute)
+	if len(notify) == 0 {
+		return
+	}
+	owners := make(map[string]string)
+	for uuid := range notify {
+		if rec, found := monitor.srv.KeyDB.GetByUUID(uuid); found && rec.Owner != "" {
+			owners[uuid] = rec.Owner
+		}
+	}
+	if err := mailer.Send(lostHostMail(conf.LostHostSubject, notify, owners, conf.LostHostUmount)); err != nil {
+		monitor.srv.Metrics.CountMailerError()
+		log.Printf("LostHostMonitor: failed to send email notification of lost computers - %v", err)
+	}
+}
+
+// Return subject and text of the notification email of lost computers, the owners of the records are by UUID.
+func lostHostMail(subject string, notify map[string][]keydb.LostHost, owners map[string]string, umount bool) (string, string) {
+	uuids := make([]string, 0, len(notify))
+	for uuid := range notify {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	first := notify[uuids[0]][0]
+	event := MailEvent{Hostname: first.Hostname, UUID: uuids[0], IP: first.IP, Owner: owners[uuids[0]], Time: time.Unix(first.LastSeen, 0)}
+	subject = mailSubject(subject, event, fmt.Sprintf("%s (%s) %s", first.IP, first.Hostname, uuids[0]))
+	text := "The following computers have stopped sending alive messages while holding an encryption key, their disks may still be unlocked:\r\n\r\n"
+	for _, uuid := range uuids {
+		for _, lost := range notify[uuid] {
+			text += fmt.Sprintf("%s (%s) %s%s - last seen %s, lost %d times\r\n", lost.IP, lost.Hostname, uuid, ownerNote(owners[uuid]),
+				time.Unix(lost.LastSeen, 0).Format("2006-01-02 15:04:05"), lost.Count)
+		}
+	}
+	if umount {
+		text += "\r\nThe computers will be told to umount the disks when they come back.\r\n"
+	}
+	return subject, text
+}
+
+// Stop stops looking for lost computers. It does nothing if the monitor is nil.
+func (monitor *LostHostMonitor) Stop() {
+	if monitor == nil {
+		return
+	}
+	close(monitor.stop)
+	monitor.done.Wait()
+}
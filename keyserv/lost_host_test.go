@@ -0,0 +1,27 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"strings"
+	"testing"
+)
+
+func TestLostHostMail(t *testing.T) {
+	notify := map[string][]keydb.LostHost{
+		"b": {{Hostname: "host-b", IP: "2.2.2.2", LastSeen: 1, Count: 3}},
+		"a": {{Hostname: "host-a", IP: "1.1.1.1", LastSeen: 1, Count: 1}},
+	}
+	subject, text := lostHostMail("Lost", notify, map[string]string{"b": "storage-team"}, true)
+	if subject != "Lost - 1.1.1.1 (host-a) a" {
+		t.Fatal(subject)
+	}
+	if !strings.Contains(text, "1.1.1.1 (host-a) a - last seen") || !strings.Contains(text, "lost 3 times") || !strings.Contains(text, "umount") ||
+		!strings.Contains(text, "2.2.2.2 (host-b) b (owner storage-team) - last seen") {
+		t.Fatal(text)
+	}
+	if subject, _ := lostHostMail("{{.Hostname}} is lost", notify, nil, false); subject != "host-a is lost" {
+		t.Fatal(subject)
+	}
+}
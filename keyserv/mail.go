@@ -3,12 +3,20 @@
 package keyserv
 
 import (
+	"bytes"
+	"cryptctl2/fs"
 	"cryptctl2/sys"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/smtp"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 const (
@@ -17,6 +25,17 @@ const (
 	SRV_CONF_MAIL_AGENT_AND_PORT = "EMAIL_AGENT_AND_PORT"
 	SRV_CONF_MAIL_AGENT_USERNAME = "EMAIL_AGENT_USERNAME"
 	SRV_CONF_MAIL_AGENT_PASSWORD = "EMAIL_AGENT_PASSWORD"
+	SRV_CONF_MAIL_TLS_MODE       = "EMAIL_AGENT_TLS_MODE"
+	SRV_CONF_MAIL_TLS_CA         = "EMAIL_AGENT_TLS_CA_PEM"
+	SRV_CONF_MAIL_TLS_INSECURE   = "EMAIL_AGENT_TLS_INSECURE_SKIP_VERIFY"
+
+	MailTLSNone     = "none"     // MailTLSNone speaks plain SMTP, it uses STARTTLS only if the mail agent offers it.
+	MailTLSStartTLS = "starttls" // MailTLSStartTLS requires the mail agent to switch to TLS before authentication.
+	MailTLSSMTPS    = "smtps"    // MailTLSSMTPS speaks TLS right from the start of connection (implicit TLS).
+
+	MailPortSubmission = "587" // MailPortSubmission is the mail submission port that speaks STARTTLS.
+	MailPortSMTPS      = "465" // MailPortSMTPS is the mail submission port that speaks implicit TLS.
+	MailDialTimeoutSec = 30    // MailDialTimeoutSec is the number of seconds to wait for connection to mail agent.
 )
 
 // Return true only if both at-sign and full-stop are in the string.
@@ -31,6 +50,9 @@ type Mailer struct {
 	AgentAddressPort string   // Address and port number of mail transportation agent for sending notifications
 	AuthUsername     string   // (Optional) Username for plain authentication, if the SMTP server requires it.
 	AuthPassword     string   // (Optional) Password for plain authentication, if the SMTP server requires it.
+	TLSMode          string   // TLSMode is one of MailTLSNone, MailTLSStartTLS, or MailTLSSMTPS, empty is the same as none.
+	TLSCAFile        string   // (Optional) PEM file of certificate authority that verifies the mail agent's certificate.
+	TLSSkipVerify    bool     // TLSSkipVerify accepts any certificate of the mail agent, it defeats the purpose of TLS.
 }
 
 // Return true only if all mail parameters are present.
@@ -56,32 +78,230 @@ func (mail *Mailer) ValidateConfig() error {
 	if mail.AgentAddressPort == "" {
 		errs = append(errs, errors.New("Mail agent (address and port) is empty"))
 	} else {
-		colon := strings.Index(mail.AgentAddressPort, ":")
-		if colon == -1 {
+		// An IPv6 address of the agent is written in brackets, e.g. "[2001:db8::25]:25"
+		if _, port, err := net.SplitHostPort(mail.AgentAddressPort); err != nil {
 			errs = append(errs, fmt.Errorf("Mail agent \"%s\" must contain address and port number", mail.FromAddress))
-		} else if _, err := strconv.Atoi(mail.AgentAddressPort[colon+1:]); err != nil {
+		} else if _, err := strconv.Atoi(port); err != nil {
 			errs = append(errs, fmt.Errorf("Failed to parse integer from port number from \"%s\"", mail.FromAddress))
 		}
 	}
+	// Validate TLS, a mode that does not match a well-known port is most likely a mistake.
+	_, port, _ := net.SplitHostPort(mail.AgentAddressPort)
+	switch mail.TLSMode {
+	case "", MailTLSNone:
+		if port == MailPortSMTPS {
+			errs = append(errs, fmt.Errorf("Mail agent port %s speaks implicit TLS, set TLS mode to \"%s\"", port, MailTLSSMTPS))
+		}
+	case MailTLSStartTLS:
+		if port == MailPortSMTPS {
+			errs = append(errs, fmt.Errorf("Mail agent port %s speaks implicit TLS instead of STARTTLS, set TLS mode to \"%s\"", port, MailTLSSMTPS))
+		}
+	case MailTLSSMTPS:
+		if port == "25" || port == MailPortSubmission {
+			errs = append(errs, fmt.Errorf("Mail agent port %s does not speak implicit TLS, set TLS mode to \"%s\"", port, MailTLSStartTLS))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Mail agent TLS mode \"%s\" must be one of %s, %s, %s", mail.TLSMode, MailTLSNone, MailTLSStartTLS, MailTLSSMTPS))
+	}
+	if mail.TLSCAFile != "" {
+		if err := fs.FileContains(mail.TLSCAFile, "CERTIFICATE"); err != nil {
+			errs = append(errs, fmt.Errorf("Mail agent certificate authority - %v", err))
+		}
+	}
 	if len(errs) == 0 {
 		return nil
 	}
 	return fmt.Errorf("%v", errs)
 }
 
+// Return the TLS configuration that verifies the mail agent.
+func (mail *Mailer) tlsConfig(host string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: host, InsecureSkipVerify: mail.TLSSkipVerify}
+	if mail.TLSCAFile != "" {
+		caPEM, err := ioutil.ReadFile(mail.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mail agent certificate authority - %v", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("mail agent certificate authority \"%s\" does not carry a certificate", mail.TLSCAFile)
+		}
+	}
+	return conf, nil
+}
+
 // Deliver an email to all recipients.
 func (mail *Mailer) Send(subject, text string) error {
 	if mail.Recipients == nil || len(mail.Recipients) == 0 {
 		return fmt.Errorf("No recipient specified for mail \"%s\"", subject)
 	}
+	host, _, err := net.SplitHostPort(mail.AgentAddressPort)
+	if err != nil {
+		return fmt.Errorf("Mail agent \"%s\" must contain address and port number", mail.AgentAddressPort)
+	}
 	var auth smtp.Auth
 	if mail.AuthUsername != "" {
-		auth = smtp.PlainAuth("", mail.AuthUsername, mail.AuthPassword, mail.AgentAddressPort)
+		auth = smtp.PlainAuth("", mail.AuthUsername, mail.AuthPassword, host)
 	}
 	// Construct appropriate mail headers
 	mailBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
 		mail.FromAddress, strings.Join(mail.Recipients, ", "), subject, text)
-	return smtp.SendMail(mail.AgentAddressPort, auth, mail.FromAddress, mail.Recipients, []byte(mailBody))
+	if mail.TLSMode == "" || mail.TLSMode == MailTLSNone {
+		return smtp.SendMail(mail.AgentAddressPort, auth, mail.FromAddress, mail.Recipients, []byte(mailBody))
+	}
+	client, err := mail.dialAgent(host, auth)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Mail(mail.FromAddress); err != nil {
+		return err
+	}
+	for _, addr := range mail.Recipients {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(mailBody)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/*
+Connect to the mail agent in the TLS mode, switch to TLS if the mode is STARTTLS, and log in if the authentication is
+given. The caller closes the client.
+*/
+func (mail *Mailer) dialAgent(host string, auth smtp.Auth) (*smtp.Client, error) {
+	var tlsConf *tls.Config
+	var err error
+	if mail.TLSMode != "" && mail.TLSMode != MailTLSNone {
+		if tlsConf, err = mail.tlsConfig(host); err != nil {
+			return nil, err
+		}
+	}
+	var conn net.Conn
+	if mail.TLSMode == MailTLSSMTPS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: MailDialTimeoutSec * time.Second}, "tcp", mail.AgentAddressPort, tlsConf)
+	} else {
+		conn, err = net.DialTimeout("tcp", mail.AgentAddressPort, MailDialTimeoutSec*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if mail.TLSMode == MailTLSStartTLS {
+		// Unlike plain SMTP, the password and mail never go out unless the mail agent switches to TLS
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("Mail agent \"%s\" does not offer STARTTLS", mail.AgentAddressPort)
+		}
+		if err := client.StartTLS(tlsConf); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("Mail agent \"%s\" failed to start TLS - %v", mail.AgentAddressPort, err)
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+/*
+Probe connects to the mail agent and logs in the same way as sending an email, then quits without sending anything. It
+tells whether notifications can reach the mail agent.
+*/
+func (mail *Mailer) Probe() error {
+	host, _, err := net.SplitHostPort(mail.AgentAddressPort)
+	if err != nil {
+		return fmt.Errorf("Mail agent \"%s\" must contain address and port number", mail.AgentAddressPort)
+	}
+	var auth smtp.Auth
+	if mail.AuthUsername != "" {
+		auth = smtp.PlainAuth("", mail.AuthUsername, mail.AuthPassword, host)
+	}
+	client, err := mail.dialAgent(host, auth)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Noop(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/*
+MailEvent carries the details of a notification that may appear in subject and greeting of the email, such as
+{{.Hostname}}, {{.UUID}}, {{.IP}}, {{.Owner}}, and {{.Time}}. A digest of several events only carries the time.
+*/
+type MailEvent struct {
+	Hostname string    // Hostname is the client's host name.
+	UUID     string    // UUID is the record UUID.
+	IP       string    // IP is the client's IP address.
+	Owner    string    // Owner is the owner of the record, empty if it has none or the event concerns several records.
+	Time     time.Time // Time is the moment of the event.
+}
+
+// Return true only if the notification text uses template variables.
+func IsMailTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// ValidateMailTemplate returns an error if the notification text is not a valid template of MailEvent.
+func ValidateMailTemplate(name, text string) error {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return fmt.Errorf("%s - %v", name, err)
+	}
+	if err := tmpl.Execute(new(bytes.Buffer), MailEvent{}); err != nil {
+		return fmt.Errorf("%s - %v", name, err)
+	}
+	return nil
+}
+
+/*
+RenderMailTemplate fills in the template variables of the notification text. The text has been validated upon start,
+nevertheless the text is returned as-is if it cannot be rendered.
+*/
+func RenderMailTemplate(text string, event MailEvent) string {
+	if !IsMailTemplate(text) {
+		return text
+	}
+	var out bytes.Buffer
+	tmpl, err := template.New("").Parse(text)
+	if err == nil {
+		err = tmpl.Execute(&out, event)
+	}
+	if err != nil {
+		return text
+	}
+	return out.String()
+}
+
+/*
+Return the subject of notification email. A subject that uses template variables is rendered alone, otherwise the
+event details are appended to it, as they were before subjects could use template variables.
+*/
+func mailSubject(subject string, event MailEvent, details string) string {
+	if IsMailTemplate(subject) {
+		return RenderMailTemplate(subject, event)
+	}
+	return fmt.Sprintf("%s - %s", subject, details)
 }
 
 // Read mail settings from keys in sysconfig file.
@@ -91,4 +311,7 @@ func (mail *Mailer) ReadFromSysconfig(sysconf *sys.Sysconfig) {
 	mail.AgentAddressPort = sysconf.GetString(SRV_CONF_MAIL_AGENT_AND_PORT, "")
 	mail.AuthUsername = sysconf.GetString(SRV_CONF_MAIL_AGENT_USERNAME, "")
 	mail.AuthPassword = sysconf.GetString(SRV_CONF_MAIL_AGENT_PASSWORD, "")
+	mail.TLSMode = sysconf.GetString(SRV_CONF_MAIL_TLS_MODE, MailTLSNone)
+	mail.TLSCAFile = sysconf.GetString(SRV_CONF_MAIL_TLS_CA, "")
+	mail.TLSSkipVerify = sysconf.GetBool(SRV_CONF_MAIL_TLS_INSECURE, false)
 }
@@ -0,0 +1,113 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RetrievalDigestEntry is a key handed out to a computer, it is listed in the next digest email.
+type RetrievalDigestEntry struct {
+	Time       time.Time // Time is the moment the key was handed out.
+	Hostname   string    // Hostname is the client's host name.
+	IP         string    // IP is the client's IP address.
+	UUID       string    // UUID is the record UUID.
+	MountPoint string    // MountPoint is the mount point of the record.
+}
+
+/*
+RetrievalDigest collects the key retrievals over a time window and notifies all of them in a single email at the end
+of the window, so that a rolling reboot of many computers does not flood the mailbox (or trip the rate limit of the
+mail agent) with one email per computer.
+*/
+type RetrievalDigest struct {
+	Window time.Duration // Window is the time over which retrievals are collected.
+
+	srv     *CryptServer
+	lock    sync.Mutex
+	entries []RetrievalDigestEntry
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// StartRetrievalDigest starts collecting key retrievals for digest emails if a digest window is configured.
+func (srv *CryptServer) StartRetrievalDigest() {
+	if srv.Config.KeyRetrievalDigestMinutes <= 0 {
+		return
+	}
+	srv.RetrievalDigest = &RetrievalDigest{
+		Window: time.Duration(srv.Config.KeyRetrievalDigestMinutes) * time.Minute,
+		srv:    srv,
+		stop:   make(chan struct{}),
+	}
+	srv.RetrievalDigest.done.Add(1)
+	go srv.RetrievalDigest.run()
+}
+
+// Send a digest at the end of each window until stopped, the retrievals collected by then are sent too.
+func (digest *RetrievalDigest) run() {
+	defer digest.done.Done()
+	for {
+		select {
+		case <-digest.stop:
+			digest.sendAndLog()
+			return
+		case <-time.After(digest.Window):
+			digest.sendAndLog()
+		}
+	}
+}
+
+// Add the key retrievals to the next digest.
+func (digest *RetrievalDigest) Add(entries ...RetrievalDigestEntry) {
+	digest.lock.Lock()
+	defer digest.lock.Unlock()
+	digest.entries = append(digest.entries, entries...)
+}
+
+// Send the digest and log the failure.
+func (digest *RetrievalDigest) sendAndLog() {
+	count, err := digest.Send()
+	if err != nil {
+		digest.srv.Metrics.CountMailerError()
+		log.Printf("RetrievalDigest: failed to send email notification of %d key retrievals - %v", count, err)
+	}
+}
+
+/*
+Send a digest email of the key retrievals collected so far and begin a new digest. Nothing is sent if no key has been
+retrieved. Return the number of retrievals in the digest.
+*/
+func (digest *RetrievalDigest) Send() (int, error) {
+	digest.lock.Lock()
+	entries := digest.entries
+	digest.entries = nil
+	digest.lock.Unlock()
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	digest.srv.configLock.RLock()
+	subject := digest.srv.Config.KeyRetrievalSubject
+	greeting := digest.srv.Config.KeyRetrievalGreeting
+	mailer := *digest.srv.Mailer
+	digest.srv.configLock.RUnlock()
+	event := MailEvent{Time: time.Now()}
+	subject = mailSubject(subject, event, fmt.Sprintf("%d keys in the past %s", len(entries), digest.Window))
+	text := fmt.Sprintf("%s\r\n\r\n", RenderMailTemplate(greeting, event))
+	for _, entry := range entries {
+		text += fmt.Sprintf("%s %s (%s) %s - %s\r\n", entry.Time.Format("2006-01-02 15:04:05"), entry.IP, entry.Hostname, entry.UUID, entry.MountPoint)
+	}
+	return len(entries), mailer.Send(subject, text)
+}
+
+// Stop sends the remaining retrievals and stops collecting. It does nothing if the digest is nil.
+func (digest *RetrievalDigest) Stop() {
+	if digest == nil {
+		return
+	}
+	close(digest.stop)
+	digest.done.Wait()
+}
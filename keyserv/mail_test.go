@@ -3,8 +3,14 @@
 package keyserv
 
 import (
+	"crypto/tls"
 	"net"
+	"net/textproto"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMailerValidateConfig(t *testing.T) {
@@ -36,6 +42,14 @@ func TestMailerValidateConfig(t *testing.T) {
 	if err := m.ValidateConfig(); err == nil {
 		t.Fatal("did not error")
 	}
+	m = Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: net.JoinHostPort("2001:db8::25", "25")}
+	if err := m.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	m = Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "2001:db8::25"}
+	if err := m.ValidateConfig(); err == nil {
+		t.Fatal("did not error")
+	}
 }
 
 func TestMailerSend(t *testing.T) {
@@ -67,3 +81,183 @@ func TestMailerReadFromSysconfig(t *testing.T) {
 		t.Fatal(m)
 	}
 }
+
+func TestMailTemplate(t *testing.T) {
+	if err := ValidateMailTemplate("subject", "Key of {{.UUID}} retrieved by {{.Hostname}} ({{.IP}}) at {{.Time.Unix}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateMailTemplate("subject", "Key of {{.UUID"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := ValidateMailTemplate("subject", "Key of {{.MountPoint}}"); err == nil {
+		t.Fatal("did not error")
+	}
+	event := MailEvent{Hostname: "host", UUID: "aaaa", IP: "1.1.1.1", Time: time.Unix(1, 0)}
+	if text := RenderMailTemplate("{{.UUID}} {{.Hostname}} {{.IP}} {{.Time.Unix}}", event); text != "aaaa host 1.1.1.1 1" {
+		t.Fatal(text)
+	}
+	if subject := mailSubject("Retrieved", event, "1.1.1.1 host"); subject != "Retrieved - 1.1.1.1 host" {
+		t.Fatal(subject)
+	}
+	if subject := mailSubject("Retrieved by {{.Hostname}}", event, "1.1.1.1 host"); subject != "Retrieved by host" {
+		t.Fatal(subject)
+	}
+}
+
+func TestRetrievalDigest(t *testing.T) {
+	srv := &CryptServer{Config: CryptServiceConfig{KeyRetrievalSubject: "Retrieved"}, Mailer: &Mailer{}}
+	digest := &RetrievalDigest{Window: time.Minute, srv: srv, stop: make(chan struct{})}
+	if count, err := digest.Send(); count != 0 || err != nil {
+		t.Fatal(count, err)
+	}
+	digest.Add(RetrievalDigestEntry{Hostname: "a", UUID: "1"}, RetrievalDigestEntry{Hostname: "b", UUID: "2"})
+	// The mailer has no recipient, the retrievals are dropped nevertheless so that they are not notified twice.
+	if count, err := digest.Send(); count != 2 || err == nil {
+		t.Fatal(count, err)
+	}
+	if count, err := digest.Send(); count != 0 || err != nil {
+		t.Fatal(count, err)
+	}
+	digest.done.Add(1)
+	go digest.run()
+	digest.Stop()
+	var nilDigest *RetrievalDigest
+	nilDigest.Stop()
+}
+
+/*
+Serve a single SMTP session on the listener and return the commands received by the stub, each prefixed by "TLS " if
+it arrived over TLS. With startTLS, the stub offers STARTTLS and switches to TLS upon request.
+*/
+func serveSMTPStub(t *testing.T, listener net.Listener, tlsConf *tls.Config, startTLS bool, commands chan<- []string) {
+	received := make([]string, 0, 8)
+	defer func() { commands <- received }()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	_, isTLS := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP stub")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		if isTLS {
+			received = append(received, "TLS "+verb)
+		} else {
+			received = append(received, verb)
+		}
+		switch verb {
+		case "EHLO":
+			if startTLS && !isTLS {
+				text.PrintfLine("250-localhost\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			} else {
+				text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, tlsConf)
+			if err := tlsConn.Handshake(); err != nil {
+				t.Error(err)
+				return
+			}
+			conn, isTLS = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			text.PrintfLine("235 authenticated")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			if _, err := text.ReadDotLines(); err != nil {
+				return
+			}
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestMailerSendTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(path.Join(PkgInGopath, "keyserv", "rpc_test.crt"), path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	// STARTTLS must be negotiated before the password is sent
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	commands := make(chan []string, 1)
+	go serveSMTPStub(t, listener, tlsConf, true, commands)
+	m := Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: listener.Addr().String(),
+		AuthUsername: "user", AuthPassword: "pass", TLSMode: MailTLSStartTLS, TLSSkipVerify: true}
+	if err := m.Send("subject", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-commands; !reflect.DeepEqual(received, []string{"EHLO", "STARTTLS", "TLS EHLO", "TLS AUTH", "TLS MAIL", "TLS RCPT", "TLS DATA", "TLS QUIT"}) {
+		t.Fatal(received)
+	}
+	// A mail agent that does not offer STARTTLS never sees the password
+	go serveSMTPStub(t, listener, tlsConf, false, commands)
+	if err := m.Send("subject", "text"); err == nil {
+		t.Fatal("did not error")
+	}
+	if received := <-commands; len(received) != 1 || received[0] != "EHLO" {
+		t.Fatal(received)
+	}
+	// Implicit TLS speaks TLS right from the start
+	tlsListener := tls.NewListener(listener, tlsConf)
+	go serveSMTPStub(t, tlsListener, tlsConf, false, commands)
+	m.TLSMode = MailTLSSMTPS
+	if err := m.Send("subject", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-commands; !reflect.DeepEqual(received, []string{"TLS EHLO", "TLS AUTH", "TLS MAIL", "TLS RCPT", "TLS DATA", "TLS QUIT"}) {
+		t.Fatal(received)
+	}
+	// The certificate is verified unless told otherwise
+	go serveSMTPStub(t, tlsListener, tlsConf, false, commands)
+	m.TLSSkipVerify = false
+	if err := m.Send("subject", "text"); err == nil {
+		t.Fatal("did not error")
+	}
+	<-commands
+}
+
+func TestMailerValidateTLS(t *testing.T) {
+	m := Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "a.example:587", TLSMode: MailTLSStartTLS}
+	if err := m.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	m.TLSCAFile = path.Join(PkgInGopath, "keyserv", "rpc_test.crt")
+	if err := m.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	m.TLSCAFile = "/does-not-exist"
+	if err := m.ValidateConfig(); err == nil {
+		t.Fatal("did not error")
+	}
+	m.TLSCAFile = ""
+	for mode, port := range map[string]string{MailTLSStartTLS: "465", MailTLSSMTPS: "587", MailTLSNone: "465", "ssl": "25"} {
+		m.TLSMode = mode
+		m.AgentAddressPort = "a.example:" + port
+		if err := m.ValidateConfig(); err == nil {
+			t.Fatal("did not error", mode, port)
+		}
+	}
+	m.TLSMode = MailTLSSMTPS
+	m.AgentAddressPort = "a.example:465"
+	if err := m.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
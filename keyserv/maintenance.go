@@ -0,0 +1,103 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	MaxMaintenanceDuration = 7 * 24 * time.Hour // MaxMaintenanceDuration is the longest time the maintenance mode may last before it has to be turned on again.
+)
+
+/*
+ErrMaintenance is returned to a key retrieval while the server is in maintenance mode. It is not a rejection, hence
+clients keep on trying until the maintenance mode ends.
+*/
+var ErrMaintenance = errors.New("the key server is in maintenance mode and does not hand out keys at the moment, try again later")
+
+// IsMaintenanceError returns true only if the RPC error tells that the server is in maintenance mode.
+func IsMaintenanceError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrMaintenance.Error())
+}
+
+// Return ErrMaintenance and audit the rejection of each UUID if the server is in maintenance mode.
+func (rpcConn *CryptServiceConn) rejectInMaintenance(event, hostname string, uuids []string) error {
+	mode := rpcConn.Svc.KeyDB.GetMaintenance()
+	if !mode.IsActive() {
+		return nil
+	}
+	for _, uuid := range uuids {
+		rpcConn.audit(event, hostname, uuid, AuditResultRejected, "maintenance mode is on until "+mode.Until.Format(time.RFC3339))
+	}
+	rpcConn.recordRejection(event, hostname, uuids, keydb.RejectionMaintenance, "until "+mode.Until.Format(time.RFC3339))
+	return ErrMaintenance
+}
+
+// SetMaintenanceReq turns the maintenance mode on for a while, or off.
+type SetMaintenanceReq struct {
+	PlainPassword string        // PlainPassword is the access password.
+	Enable        bool          // Enable is true to turn the mode on, false to turn it off.
+	Duration      time.Duration // Duration is how long the mode lasts, up to MaxMaintenanceDuration.
+	Reason        string        // Reason is the administrator's explanation, it is written to the audit log.
+}
+
+/*
+SetMaintenance turns the maintenance mode on or off and responds with the mode now in effect. While the mode is on, no
+key is handed out, and the mode survives a restart of the server. It may only be called via the domain socket.
+*/
+func (rpcConn *CryptServiceConn) SetMaintenance(req SetMaintenanceReq, resp *keydb.MaintenanceMode) error {
+	if rpcConn.RemoteHost != "@" {
+		return errors.New("SetMaintenance: the maintenance mode may only be changed via the domain socket")
+	}
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("SetMaintenance", "", "", AuditResultRejected, err.Error())
+		return err
+	}
+	mode := keydb.MaintenanceMode{}
+	if req.Enable {
+		if req.Duration <= 0 || req.Duration > MaxMaintenanceDuration {
+			return fmt.Errorf("SetMaintenance: the duration must be between 1 second and %s", MaxMaintenanceDuration)
+		}
+		now := time.Now()
+		mode = keydb.MaintenanceMode{Enabled: true, Since: now, Until: now.Add(req.Duration), Reason: req.Reason, By: rpcConn.requester()}
+	}
+	if err := rpcConn.Svc.KeyDB.SetMaintenance(mode); err != nil {
+		rpcConn.audit("SetMaintenance", "", "", AuditResultFailed, err.Error())
+		return err
+	}
+	log.Printf("CryptServiceConn.SetMaintenance: maintenance mode is now %s, changed by %s", mode, rpcConn.requester())
+	rpcConn.audit("SetMaintenance", "", "", AuditResultGranted, fmt.Sprintf("maintenance mode is now %s", mode))
+	rpcConn.notifyMaintenance(mode)
+	*resp = mode
+	return nil
+}
+
+// Send optional notification email of the changed maintenance mode in background, it is never put into a digest.
+func (rpcConn *CryptServiceConn) notifyMaintenance(mode keydb.MaintenanceMode) {
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	requester := rpcConn.requester()
+	go func() {
+		subject := "Maintenance: the key server no longer hands out keys"
+		text := fmt.Sprintf("The key server has been put into maintenance mode by %s, no keys are handed out until %s.\r\n",
+			requester, mode.Until.Format(time.RFC3339))
+		if mode.Reason != "" {
+			text += fmt.Sprintf("\r\nReason: %s\r\n", mode.Reason)
+		}
+		if !mode.Enabled {
+			subject = "Maintenance: the key server hands out keys again"
+			text = fmt.Sprintf("The maintenance mode of the key server has been turned off by %s, keys are handed out again.\r\n", requester)
+		}
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("CryptServiceConn.SetMaintenance: failed to send email notification - %v", err)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSetMaintenance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := NewSalt()
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordHash = HashPassword(salt, "pass")
+	admin := &CryptServiceConn{RemoteHost: "@", Peer: &PeerCred{UID: 0}, Svc: srv}
+	client := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+
+	var mode keydb.MaintenanceMode
+	onReq := SetMaintenanceReq{PlainPassword: "pass", Enable: true, Duration: time.Hour, Reason: "incident"}
+	// Only the domain socket may change the mode, and only with the correct password and a sensible duration
+	if err := client.SetMaintenance(onReq, &mode); err == nil {
+		t.Fatal("did not reject TCP client")
+	}
+	if err := admin.SetMaintenance(SetMaintenanceReq{PlainPassword: "wrong", Enable: true, Duration: time.Hour}, &mode); err == nil {
+		t.Fatal("did not reject incorrect password")
+	}
+	for _, duration := range []time.Duration{0, -time.Second, MaxMaintenanceDuration + time.Second} {
+		if err := admin.SetMaintenance(SetMaintenanceReq{PlainPassword: "pass", Enable: true, Duration: duration}, &mode); err == nil {
+			t.Fatal("did not reject duration", duration)
+		}
+	}
+	if err := admin.SetMaintenance(onReq, &mode); err != nil || !mode.IsActive() || mode.Reason != "incident" {
+		t.Fatal(mode, err)
+	}
+	// Key retrievals are answered by the maintenance error
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}}, &AutoRetrieveKeyResp{}); !IsMaintenanceError(err) {
+		t.Fatal(err)
+	}
+	if err := client.ManualRetrieveKey(ManualRetrieveKeyReq{PlainPassword: "pass", UUIDs: []string{"a"}}, &ManualRetrieveKeyResp{}); !IsMaintenanceError(err) {
+		t.Fatal(err)
+	}
+	if err := client.ForceRetrieveKey(ForceRetrieveKeyReq{PlainPassword: "pass", UUIDs: []string{"a"}}, &ForceRetrieveKeyResp{}); !IsMaintenanceError(err) {
+		t.Fatal(err)
+	}
+	if health := srv.checkHealth(); !health.Maintenance || health.Status != HealthStatusDegraded {
+		t.Fatalf("%+v", health)
+	}
+	// The mode survives a restart
+	if db, err = keydb.OpenDB(db.Dir); err != nil || !db.GetMaintenance().IsActive() {
+		t.Fatal(db.GetMaintenance(), err)
+	}
+	if err := admin.SetMaintenance(SetMaintenanceReq{PlainPassword: "pass"}, &mode); err != nil || mode.IsActive() {
+		t.Fatal(mode, err)
+	}
+	var resp AutoRetrieveKeyResp
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}}, &resp); err != nil || len(resp.Missing) != 1 {
+		t.Fatal(resp, err)
+	}
+	// The mode ends by itself
+	if (keydb.MaintenanceMode{Enabled: true, Since: time.Now().Add(-time.Hour), Until: time.Now()}).IsActive() {
+		t.Fatal("should have ended")
+	}
+}
@@ -0,0 +1,109 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	SRV_CONF_KEYDB_MASTER_KEY_SOURCE  = "KEYDB_MASTER_KEY_SOURCE"
+	SRV_CONF_KEYDB_MASTER_KEY_FILE    = "KEYDB_MASTER_KEY_FILE"
+	SRV_CONF_KEYDB_MASTER_KEY_KMIP_ID = "KEYDB_MASTER_KEY_KMIP_ID"
+	SRV_CONF_KEYDB_MASTER_KEY_SALT    = "KEYDB_MASTER_KEY_SALT"
+	SRV_CONF_KEYDB_MASTER_KEY_DIGEST  = "KEYDB_MASTER_KEY_DIGEST"
+
+	MasterKeySourcePassphrase = "passphrase" // MasterKeySourcePassphrase derives the master key from a passphrase entered at start.
+	MasterKeySourceFile       = "file"       // MasterKeySourceFile reads the master key from a file.
+	MasterKeySourceKMIP       = "kmip"       // MasterKeySourceKMIP retrieves the master key from the external KMIP server.
+
+	MasterKeySaltLen = 16 // MasterKeySaltLen is the length in bytes of the salt of passphrase-derived master key.
+)
+
+// Validate the key database encryption settings, which are all optional.
+func (conf *CryptServiceConfig) validateKeyDBEncryption() error {
+	switch conf.KeyDBMasterKeySource {
+	case "":
+	case MasterKeySourcePassphrase:
+	case MasterKeySourceFile:
+		if !strings.HasPrefix(conf.KeyDBMasterKeyFile, "/") {
+			return fmt.Errorf("Validate: master key file \"%s\" should be an absolute path", conf.KeyDBMasterKeyFile)
+		}
+	case MasterKeySourceKMIP:
+		if len(conf.KMIPAddresses) == 0 {
+			return errors.New("Validate: master key cannot be retrieved from KMIP server as the KMIP server is not configured")
+		}
+	default:
+		return fmt.Errorf("Validate: master key source must be empty or one of \"%s\", \"%s\", \"%s\"",
+			MasterKeySourcePassphrase, MasterKeySourceFile, MasterKeySourceKMIP)
+	}
+	return nil
+}
+
+/*
+ReadKeyDBMasterKey obtains the key database master key from the configured source without verifying it against the
+configured digest. The passphrase is only used by passphrase source. If the key database is not encrypted, the
+function returns nil.
+*/
+func ReadKeyDBMasterKey(conf CryptServiceConfig, passphrase string) (masterKey []byte, err error) {
+	switch conf.KeyDBMasterKeySource {
+	case "":
+		return nil, nil
+	case MasterKeySourcePassphrase:
+		if passphrase == "" {
+			return nil, errors.New("ReadKeyDBMasterKey: the passphrase of key database is empty")
+		} else if len(conf.KeyDBMasterKeySalt) == 0 {
+			return nil, fmt.Errorf("ReadKeyDBMasterKey: %s is not set", SRV_CONF_KEYDB_MASTER_KEY_SALT)
+		}
+		masterKey = keydb.DeriveMasterKey(passphrase, conf.KeyDBMasterKeySalt)
+	case MasterKeySourceFile:
+		content, err := ioutil.ReadFile(conf.KeyDBMasterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("ReadKeyDBMasterKey: failed to read master key file - %v", err)
+		}
+		// The file carries either the key itself or its hex encoding
+		if decoded, err := hex.DecodeString(string(bytes.TrimSpace(content))); err == nil {
+			content = decoded
+		}
+		masterKey = content
+	case MasterKeySourceKMIP:
+		if conf.KeyDBMasterKeyKMIPID == "" {
+			return nil, fmt.Errorf("ReadKeyDBMasterKey: %s is not set", SRV_CONF_KEYDB_MASTER_KEY_KMIP_ID)
+		}
+		client, err := NewExternalKMIPClient(conf)
+		if err != nil {
+			return nil, err
+		}
+		if masterKey, err = client.GetKey(conf.KeyDBMasterKeyKMIPID); err != nil {
+			return nil, fmt.Errorf("ReadKeyDBMasterKey: failed to retrieve master key from KMIP server - %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("ReadKeyDBMasterKey: unknown master key source \"%s\"", conf.KeyDBMasterKeySource)
+	}
+	return masterKey, keydb.ValidateMasterKey(masterKey)
+}
+
+/*
+LoadKeyDBMasterKey obtains the key database master key from the configured source and makes sure it is the one
+recorded by the configured digest, so that a mistyped passphrase or a wrong key file is refused up front.
+*/
+func LoadKeyDBMasterKey(conf CryptServiceConfig, passphrase string) ([]byte, error) {
+	masterKey, err := ReadKeyDBMasterKey(conf, passphrase)
+	if err != nil || masterKey == nil {
+		return masterKey, err
+	}
+	if conf.KeyDBMasterKeyDigest == "" {
+		return nil, fmt.Errorf("LoadKeyDBMasterKey: %s is not set, run \"cryptctl2 -action=migrate-keydb-encryption\" first", SRV_CONF_KEYDB_MASTER_KEY_DIGEST)
+	}
+	if subtle.ConstantTimeCompare([]byte(keydb.MasterKeyDigest(masterKey)), []byte(conf.KeyDBMasterKeyDigest)) != 1 {
+		return nil, errors.New("LoadKeyDBMasterKey: the master key does not match the digest of key database master key, is the passphrase correct?")
+	}
+	return masterKey, nil
+}
@@ -0,0 +1,78 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadKeyDBMasterKey(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2-masterkey-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if key, err := LoadKeyDBMasterKey(CryptServiceConfig{}, ""); key != nil || err != nil {
+		t.Fatal(key, err)
+	}
+	// Key file in hex
+	masterKey := bytes.Repeat([]byte{3}, keydb.MasterKeyLen)
+	keyFile := path.Join(tmpDir, "master.key")
+	if err := ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(masterKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := CryptServiceConfig{KeyDBMasterKeySource: MasterKeySourceFile, KeyDBMasterKeyFile: keyFile}
+	if err := conf.validateKeyDBEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ReadKeyDBMasterKey(conf, ""); err != nil || !bytes.Equal(key, masterKey) {
+		t.Fatal(key, err)
+	}
+	// The digest must be present and match
+	if _, err := LoadKeyDBMasterKey(conf, ""); err == nil {
+		t.Fatal("did not error")
+	}
+	conf.KeyDBMasterKeyDigest = keydb.MasterKeyDigest(masterKey)
+	if key, err := LoadKeyDBMasterKey(conf, ""); err != nil || !bytes.Equal(key, masterKey) {
+		t.Fatal(key, err)
+	}
+	// Key file in raw bytes of a wrong key
+	if err := ioutil.WriteFile(keyFile, bytes.Repeat([]byte{4}, keydb.MasterKeyLen), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyDBMasterKey(conf, ""); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Passphrase
+	conf = CryptServiceConfig{KeyDBMasterKeySource: MasterKeySourcePassphrase}
+	if _, err := ReadKeyDBMasterKey(conf, "pass"); err == nil {
+		t.Fatal("did not error without salt")
+	}
+	conf.KeyDBMasterKeySalt = []byte("salt")
+	key, err := ReadKeyDBMasterKey(conf, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.KeyDBMasterKeyDigest = keydb.MasterKeyDigest(key)
+	if _, err := LoadKeyDBMasterKey(conf, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyDBMasterKey(conf, "wrong"); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Unknown source and KMIP without KMIP server
+	for _, source := range []string{"unknown", MasterKeySourceKMIP} {
+		conf = CryptServiceConfig{KeyDBMasterKeySource: source}
+		if err := conf.validateKeyDBEncryption(); err == nil {
+			t.Fatal("did not error", source)
+		}
+	}
+}
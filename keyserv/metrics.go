@@ -0,0 +1,306 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_METRICS_ADDRESS  = "METRICS_LISTEN_ADDRESS"
+	SRV_CONF_METRICS_PORT     = "METRICS_LISTEN_PORT"
+	SRV_CONF_METRICS_PER_UUID = "METRICS_PER_UUID_LABELS"
+	SRV_CONF_METRICS_TLS      = "METRICS_TLS"
+
+	DefaultMetricsPort = 3739       // DefaultMetricsPort is the port of metrics listener if configuration does not specify one.
+	MetricsPath        = "/metrics" // MetricsPath is the URL path that serves the metrics.
+	MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// RPCLatencyBuckets are the upper bounds (in seconds) of the RPC latency histogram buckets.
+var RPCLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A histogram of observed durations in Prometheus fashion, bucket counts are cumulative when written out.
+type latencyHistogram struct {
+	buckets []uint64 // buckets counts observations per bucket, the last one is for those above all upper bounds.
+	sum     float64
+	count   uint64
+}
+
+func (hist *latencyHistogram) observe(seconds float64) {
+	if hist.buckets == nil {
+		hist.buckets = make([]uint64, len(RPCLatencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(RPCLatencyBuckets, seconds)
+	hist.buckets[i]++
+	hist.sum += seconds
+	hist.count++
+}
+
+/*
+Metrics collects the counters and histograms of key server, and writes them in Prometheus text format. Records, alive
+hosts and pending commands are counted from the key database when the metrics are written. Host names never appear in
+the metrics, and record UUIDs only appear if per-UUID labels are enabled.
+A nil Metrics does nothing, so that callers need not check whether metrics are enabled.
+*/
+type Metrics struct {
+	PerUUID bool // PerUUID adds key retrieval counters labelled with record UUID.
+
+	mutex                sync.Mutex
+	keyRetrievals        map[[2]string]uint64 // keyRetrievals is keyed by event (e.g. AutoRetrieveKey) and result.
+	keyRetrievalsByUUID  map[[2]string]uint64 // keyRetrievalsByUUID is keyed by UUID and result.
+	rpcLatency           map[string]*latencyHistogram
+	rpcErrors            map[string]uint64 // rpcErrors is keyed by method.
+	tlsHandshakeFailures uint64
+	mailerErrors         uint64
+	httpListener         net.Listener
+	httpServer           *http.Server
+	keyDB                *keydb.DB
+}
+
+// NewMetrics returns metrics that count records, alive hosts and pending commands from the database.
+func NewMetrics(db *keydb.DB, perUUID bool) *Metrics {
+	return &Metrics{
+		PerUUID:             perUUID,
+		keyRetrievals:       make(map[[2]string]uint64),
+		keyRetrievalsByUUID: make(map[[2]string]uint64),
+		rpcLatency:          make(map[string]*latencyHistogram),
+		rpcErrors:           make(map[string]uint64),
+		keyDB:               db,
+	}
+}
+
+// CountKeyRetrieval counts the outcome (one of AuditResult* constants) of a key retrieval request.
+func (metrics *Metrics) CountKeyRetrieval(event, uuid, result string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.keyRetrievals[[2]string{event, result}]++
+	if metrics.PerUUID {
+		metrics.keyRetrievalsByUUID[[2]string{uuid, result}]++
+	}
+}
+
+// ObserveRPC records how long an RPC call took, the method is such as "CryptServiceConn.Ping".
+func (metrics *Metrics) ObserveRPC(method string, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	hist, found := metrics.rpcLatency[method]
+	if !found {
+		hist = &latencyHistogram{}
+		metrics.rpcLatency[method] = hist
+	}
+	hist.observe(duration.Seconds())
+}
+
+// CountRPCError counts an RPC call that returned an error to the client, the method is such as "CryptServiceConn.Ping".
+func (metrics *Metrics) CountRPCError(method string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.rpcErrors[method]++
+}
+
+// CountTLSHandshakeFailure counts a TCP connection that failed TLS handshake.
+func (metrics *Metrics) CountTLSHandshakeFailure() {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.tlsHandshakeFailures++
+}
+
+// CountMailerError counts a notification email that could not be sent.
+func (metrics *Metrics) CountMailerError() {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.mailerErrors++
+}
+
+// Escape a label value according to Prometheus text format.
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Return the keys of a counter map sorted by both key elements.
+func sortedCounterKeys(counters map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// WriteTo writes all metrics in Prometheus text format.
+func (metrics *Metrics) WriteTo(out io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	// Take the figures from database first, the database lock is never held together with the metrics lock.
+	numRecords := 0
+	pendingCmds := make(map[string]int)
+	numAliveHosts := 0
+	rejections := make(map[string]uint64)
+	if metrics.keyDB != nil {
+		recs := metrics.keyDB.List()
+		numRecords = len(recs)
+		for _, rec := range recs {
+			for _, cmds := range rec.PendingCommands {
+				for _, cmd := range cmds {
+					pendingCmds[cmd.Status()]++
+				}
+			}
+		}
+		numAliveHosts = len(metrics.keyDB.ListAliveHosts("", ""))
+		rejections = metrics.keyDB.RejectionCounts()
+	}
+	fmt.Fprint(&buf, "# HELP cryptctl2_records Number of key records in the database.\n# TYPE cryptctl2_records gauge\n")
+	fmt.Fprintf(&buf, "cryptctl2_records %d\n", numRecords)
+	fmt.Fprint(&buf, "# HELP cryptctl2_alive_hosts Number of computers that are currently using a key.\n# TYPE cryptctl2_alive_hosts gauge\n")
+	fmt.Fprintf(&buf, "cryptctl2_alive_hosts %d\n", numAliveHosts)
+	fmt.Fprint(&buf, "# HELP cryptctl2_pending_commands Number of pending commands by status.\n# TYPE cryptctl2_pending_commands gauge\n")
+	for _, status := range []string{
+		keydb.PendingCommandStatusPending, keydb.PendingCommandStatusFetched, keydb.PendingCommandStatusSucceeded,
+		keydb.PendingCommandStatusFailed, keydb.PendingCommandStatusExpired,
+	} {
+		fmt.Fprintf(&buf, "cryptctl2_pending_commands{status=\"%s\"} %d\n", status, pendingCmds[status])
+	}
+	fmt.Fprint(&buf, "# HELP cryptctl2_key_rejections_total Number of key retrievals rejected, by reason.\n# TYPE cryptctl2_key_rejections_total counter\n")
+	for _, reason := range keydb.SortedRejectionReasons(rejections) {
+		fmt.Fprintf(&buf, "cryptctl2_key_rejections_total{reason=\"%s\"} %d\n", escapeMetricLabel(reason), rejections[reason])
+	}
+
+	metrics.mutex.Lock()
+	fmt.Fprint(&buf, "# HELP cryptctl2_key_retrievals_total Number of keys requested by computers, by request and result.\n# TYPE cryptctl2_key_retrievals_total counter\n")
+	for _, key := range sortedCounterKeys(metrics.keyRetrievals) {
+		fmt.Fprintf(&buf, "cryptctl2_key_retrievals_total{event=\"%s\",result=\"%s\"} %d\n",
+			escapeMetricLabel(key[0]), escapeMetricLabel(key[1]), metrics.keyRetrievals[key])
+	}
+	if metrics.PerUUID {
+		fmt.Fprint(&buf, "# HELP cryptctl2_key_retrievals_by_uuid_total Number of keys requested by computers, by record and result.\n# TYPE cryptctl2_key_retrievals_by_uuid_total counter\n")
+		for _, key := range sortedCounterKeys(metrics.keyRetrievalsByUUID) {
+			fmt.Fprintf(&buf, "cryptctl2_key_retrievals_by_uuid_total{uuid=\"%s\",result=\"%s\"} %d\n",
+				escapeMetricLabel(key[0]), escapeMetricLabel(key[1]), metrics.keyRetrievalsByUUID[key])
+		}
+	}
+	fmt.Fprint(&buf, "# HELP cryptctl2_rpc_duration_seconds Time taken to serve RPC calls, by method.\n# TYPE cryptctl2_rpc_duration_seconds histogram\n")
+	methods := make([]string, 0, len(metrics.rpcLatency))
+	for method := range metrics.rpcLatency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		hist := metrics.rpcLatency[method]
+		label := escapeMetricLabel(method)
+		var cumulative uint64
+		for i, upperBound := range RPCLatencyBuckets {
+			cumulative += hist.buckets[i]
+			fmt.Fprintf(&buf, "cryptctl2_rpc_duration_seconds_bucket{method=\"%s\",le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(upperBound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&buf, "cryptctl2_rpc_duration_seconds_bucket{method=\"%s\",le=\"+Inf\"} %d\n", label, hist.count)
+		fmt.Fprintf(&buf, "cryptctl2_rpc_duration_seconds_sum{method=\"%s\"} %s\n", label, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(&buf, "cryptctl2_rpc_duration_seconds_count{method=\"%s\"} %d\n", label, hist.count)
+	}
+	fmt.Fprint(&buf, "# HELP cryptctl2_rpc_errors_total Number of RPC calls that returned an error, by method.\n# TYPE cryptctl2_rpc_errors_total counter\n")
+	methods = methods[:0]
+	for method := range metrics.rpcErrors {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		fmt.Fprintf(&buf, "cryptctl2_rpc_errors_total{method=\"%s\"} %d\n", escapeMetricLabel(method), metrics.rpcErrors[method])
+	}
+	fmt.Fprint(&buf, "# HELP cryptctl2_tls_handshake_failures_total Number of TCP connections that failed TLS handshake.\n# TYPE cryptctl2_tls_handshake_failures_total counter\n")
+	fmt.Fprintf(&buf, "cryptctl2_tls_handshake_failures_total %d\n", metrics.tlsHandshakeFailures)
+	fmt.Fprint(&buf, "# HELP cryptctl2_mailer_errors_total Number of notification emails that could not be sent.\n# TYPE cryptctl2_mailer_errors_total counter\n")
+	fmt.Fprintf(&buf, "cryptctl2_mailer_errors_total %d\n", metrics.mailerErrors)
+	metrics.mutex.Unlock()
+	return buf.WriteTo(out)
+}
+
+// ServeHTTP serves the metrics in Prometheus text format.
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != MetricsPath {
+		http.NotFound(w, r)
+		return
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", MetricsContentType)
+	if _, err := metrics.WriteTo(w); err != nil {
+		log.Printf("Metrics.ServeHTTP: failed to write metrics to %s - %v", r.RemoteAddr, err)
+	}
+}
+
+/*
+Listen starts the listener that serves metrics on the address and port, e.g. "localhost" and 3739. The metrics are
+served over HTTPS if the TLS configuration is given, or over plain HTTP otherwise.
+*/
+func (metrics *Metrics) Listen(address string, port int, tlsConfig *tls.Config) (err error) {
+	addrPort := net.JoinHostPort(address, strconv.Itoa(port))
+	scheme := "http"
+	if tlsConfig == nil {
+		metrics.httpListener, err = net.Listen("tcp", addrPort)
+	} else {
+		metrics.httpListener, err = tls.Listen("tcp", addrPort, tlsConfig)
+		scheme = "https"
+	}
+	if err != nil {
+		return fmt.Errorf("Metrics.Listen: failed to listen on %s:%d - %v", address, port, err)
+	}
+	metrics.httpServer = &http.Server{Handler: metrics, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("Metrics.Listen: serving metrics on %s://%s%s", scheme, metrics.httpListener.Addr().String(), MetricsPath)
+	return nil
+}
+
+// Addr returns the address of the HTTP listener, or nil if it is not listening.
+func (metrics *Metrics) Addr() net.Addr {
+	if metrics == nil || metrics.httpListener == nil {
+		return nil
+	}
+	return metrics.httpListener.Addr()
+}
+
+// HandleConnections serves HTTP requests on the listener. Blocks caller until the listener closes.
+func (metrics *Metrics) HandleConnections() {
+	if err := metrics.httpServer.Serve(metrics.httpListener); err != nil && err != http.ErrServerClosed {
+		log.Printf("Metrics.HandleConnections: quit now - %v", err)
+	}
+}
+
+// Shutdown closes the HTTP listener, it does nothing if the listener was not started.
+func (metrics *Metrics) Shutdown() {
+	if metrics == nil || metrics.httpServer == nil {
+		return
+	}
+	metrics.httpServer.Close()
+}
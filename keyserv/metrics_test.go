@@ -0,0 +1,162 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return the metrics served by the HTTP listener.
+func scrapeMetrics(t *testing.T, metrics *Metrics) string {
+	resp, err := http.Get("http://" + metrics.Addr().String() + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != MetricsContentType {
+		t.Fatal(err, resp.StatusCode, resp.Header)
+	}
+	return string(body)
+}
+
+// Fail the test if the metrics do not contain all the expected lines.
+func expectMetrics(t *testing.T, text string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains("\n"+text, "\n"+line+"\n") {
+			t.Fatalf("missing line \"%s\" in:\n%s", line, text)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var nilMetrics *Metrics
+	nilMetrics.CountKeyRetrieval("AutoRetrieveKey", "a", AuditResultGranted)
+	nilMetrics.ObserveRPC("CryptServiceConn.Ping", time.Second)
+	nilMetrics.CountTLSHandshakeFailure()
+	nilMetrics.CountMailerError()
+	nilMetrics.Shutdown()
+
+	metrics := NewMetrics(nil, false)
+	metrics.ObserveRPC("CryptServiceConn.Ping", 3*time.Millisecond)
+	metrics.ObserveRPC("CryptServiceConn.Ping", 20*time.Second)
+	metrics.CountKeyRetrieval("AutoRetrieveKey", "a\"b", AuditResultGranted)
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expectMetrics(t, buf.String(),
+		`cryptctl2_records 0`,
+		`cryptctl2_rpc_duration_seconds_bucket{method="CryptServiceConn.Ping",le="0.005"} 1`,
+		`cryptctl2_rpc_duration_seconds_bucket{method="CryptServiceConn.Ping",le="10"} 1`,
+		`cryptctl2_rpc_duration_seconds_bucket{method="CryptServiceConn.Ping",le="+Inf"} 2`,
+		`cryptctl2_rpc_duration_seconds_count{method="CryptServiceConn.Ping"} 2`,
+		`cryptctl2_key_retrievals_total{event="AutoRetrieveKey",result="granted"} 1`)
+	// UUIDs are only present if they are enabled
+	if strings.Contains(buf.String(), "uuid") {
+		t.Fatal(buf.String())
+	}
+	metrics.PerUUID = true
+	metrics.CountKeyRetrieval("AutoRetrieveKey", "a\"b", AuditResultGranted)
+	buf.Reset()
+	metrics.WriteTo(&buf)
+	expectMetrics(t, buf.String(), `cryptctl2_key_retrievals_by_uuid_total{uuid="a\"b",result="granted"} 1`)
+}
+
+func TestServerMetrics(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	server.Config.MetricsAddress = "127.0.0.1"
+	server.Config.MetricsPort = 0
+	server.Metrics = NewMetrics(server.KeyDB, false)
+	if err := server.ListenMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	go server.Metrics.HandleConnections()
+
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := client.CreateKey(CreateKeyReq{
+		PlainPassword: TEST_RPC_PASS, Hostname: "client-host", UUID: "aaa", MountPoint: "/a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The first retrieval is granted and uses up the only active user, the second is rejected.
+	for i := 0; i < 2; i++ {
+		if _, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"aaa", "bbb"}, Hostname: "client-host"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A connection that does not speak TLS is dropped without disrupting the server
+	conn, err := net.Dial("tcp", "localhost:3737")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("not a TLS handshake\n"))
+	conn.Close()
+	var text string
+	for i := 0; i < 20; i++ {
+		if text = scrapeMetrics(t, server.Metrics); strings.Contains(text, "\ncryptctl2_tls_handshake_failures_total 1\n") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	expectMetrics(t, text,
+		`cryptctl2_records 1`,
+		`cryptctl2_alive_hosts 1`,
+		`cryptctl2_key_retrievals_total{event="AutoRetrieveKey",result="granted"} 1`,
+		`cryptctl2_key_retrievals_total{event="AutoRetrieveKey",result="missing"} 2`,
+		`cryptctl2_key_retrievals_total{event="AutoRetrieveKey",result="rejected"} 1`,
+		`cryptctl2_rpc_duration_seconds_count{method="CryptServiceConn.AutoRetrieveKey"} 2`,
+		`cryptctl2_rpc_duration_seconds_count{method="CryptServiceConn.CreateKey"} 1`,
+		`cryptctl2_rpc_duration_seconds_count{method="CryptServiceConn.Ping"} 2`,
+		`cryptctl2_rpc_errors_total{method="CryptServiceConn.Ping"} 1`,
+		`cryptctl2_tls_handshake_failures_total 1`,
+		`cryptctl2_mailer_errors_total 0`)
+	// Neither host names nor UUIDs are exposed by default
+	if strings.Contains(text, "client-host") || strings.Contains(text, "aaa") {
+		t.Fatal(text)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("rpc_test.crt", "rpc_test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics(nil, false)
+	if err := metrics.Listen("127.0.0.1", 0, &tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Shutdown()
+	go metrics.HandleConnections()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + metrics.Addr().String() + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal(err, resp.StatusCode)
+	}
+	expectMetrics(t, string(body), `cryptctl2_records 0`)
+	// Plain HTTP is not served
+	if resp, err := http.Get("http://" + metrics.Addr().String() + MetricsPath); err == nil && resp.StatusCode == http.StatusOK {
+		t.Fatal("plain HTTP was served")
+	}
+}
@@ -0,0 +1,280 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	KeyMigrationToKMIP  = "to-kmip"  // KeyMigrationToKMIP moves the keys kept in key database onto the external KMIP server.
+	KeyMigrationToLocal = "to-local" // KeyMigrationToLocal moves the keys kept on the external KMIP server into key database.
+
+	KeyMigrationRegistered = "registered" // the key has been stored on KMIP server but the record may still carry it
+	KeyMigrationRelocating = "relocating" // the record is being changed to carry the key, the KMIP copy still exists
+	KeyMigrationDone       = "done"       // the key has been moved and the other copy removed
+	KeyMigrationSkipped    = "skipped"    // the key was already stored in the destination
+	KeyMigrationFailed     = "failed"     // the key could not be moved and remains where it was, see the error
+
+	KeyMigrationReportFile = "key-migration.json" // name of the report file, it is placed next to key database directory.
+)
+
+// KeyMigrationEntry is the outcome of moving the key of one record.
+type KeyMigrationEntry struct {
+	State string    // State is one of the KeyMigration* states.
+	OldID string    // OldID is the ID the record referred to before the migration.
+	NewID string    // NewID is the ID the record refers to after the migration.
+	Error string    // Error describes the most recent failure, it is empty if the key has been moved successfully.
+	Time  time.Time // Time is the moment the entry was last updated.
+}
+
+/*
+KeyMigrationReport records the outcome of moving the keys of each record (by UUID). The report is written to disk before
+and after each record is changed, so that an interrupted migration picks up where it stopped when it is run again.
+*/
+type KeyMigrationReport struct {
+	Direction string                       // Direction is either KeyMigrationToKMIP or KeyMigrationToLocal.
+	StartTime time.Time                    // StartTime is the moment the most recent run started.
+	EndTime   time.Time                    // EndTime is the moment the most recent run completed, zero if it was interrupted.
+	Entries   map[string]KeyMigrationEntry // Entries are the outcome of each record by its UUID.
+}
+
+// Unfinished returns true if the key of a record has been copied without having had the other copy removed.
+func (report KeyMigrationReport) Unfinished() bool {
+	for _, entry := range report.Entries {
+		if entry.State == KeyMigrationRegistered || entry.State == KeyMigrationRelocating {
+			return true
+		}
+	}
+	return false
+}
+
+// Count returns the number of records in each state.
+func (report KeyMigrationReport) Count() map[string]int {
+	ret := make(map[string]int)
+	for _, entry := range report.Entries {
+		ret[entry.State]++
+	}
+	return ret
+}
+
+// ReadKeyMigrationReport reads the report file, a report without entries is returned if the file does not exist yet.
+func ReadKeyMigrationReport(reportPath string) (report KeyMigrationReport, err error) {
+	report.Entries = make(map[string]KeyMigrationEntry)
+	content, err := ioutil.ReadFile(reportPath)
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(content, &report); err != nil {
+		return report, fmt.Errorf("ReadKeyMigrationReport: failed to decode \"%s\" - %v", reportPath, err)
+	}
+	if report.Entries == nil {
+		report.Entries = make(map[string]KeyMigrationEntry)
+	}
+	return
+}
+
+// GetKeyMigrationReportPath returns the location of the report file of the key database directory.
+func GetKeyMigrationReportPath(keyDBDir string) string {
+	return path.Join(path.Dir(path.Clean(keyDBDir)), KeyMigrationReportFile)
+}
+
+/*
+KeyMigrator moves encryption keys between key database and an external KMIP server. A key is only removed from its
+original place after its copy has been read back and found identical, so that an interruption at any moment never
+loses a key.
+*/
+type KeyMigrator struct {
+	KMIPClient *KMIPClient // KMIPClient converses with the external KMIP server.
+	DB         *keydb.DB   // DB provides the records to migrate, its record files are read back to verify each change.
+	ReportPath string      // ReportPath is the location of the report file.
+	/*
+		Relocate changes the record's key reference, it is keydb.DB.RelocateKey if the key server is not running, or
+		an RPC that asks the running key server to do so.
+	*/
+	Relocate func(uuid, expectedID, newID string, key []byte) (string, error)
+
+	report KeyMigrationReport
+}
+
+// Persist the report after an entry has been updated.
+func (migrator *KeyMigrator) saveEntry(uuid string, entry KeyMigrationEntry) error {
+	entry.Time = time.Now()
+	migrator.report.Entries[uuid] = entry
+	content, err := json.MarshalIndent(migrator.report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return sys.ReplaceFile(migrator.ReportPath, content, keydb.DB_REC_FILE_MODE, true)
+}
+
+// Read the record back from its file, so that the verification does not rely on a copy in memory.
+func (migrator *KeyMigrator) readBack(uuid string) (keydb.Record, error) {
+	return migrator.DB.ReadRecord(path.Join(migrator.DB.Dir, uuid))
+}
+
+/*
+Migrate moves the keys of all records in the direction and returns the report. Records that fail are left in place
+and noted in the report, they are attempted again the next time. An error is only returned if the migration cannot
+start or the report cannot be written.
+*/
+func (migrator *KeyMigrator) Migrate(direction string) (KeyMigrationReport, error) {
+	if direction != KeyMigrationToKMIP && direction != KeyMigrationToLocal {
+		return KeyMigrationReport{}, fmt.Errorf("Migrate: direction must be either \"%s\" or \"%s\"", KeyMigrationToKMIP, KeyMigrationToLocal)
+	}
+	report, err := ReadKeyMigrationReport(migrator.ReportPath)
+	if err != nil {
+		return report, err
+	}
+	if report.Direction != direction {
+		if report.Unfinished() {
+			return report, fmt.Errorf("Migrate: the previous migration \"%s\" has not finished, run it again to finish it first", report.Direction)
+		}
+		report = KeyMigrationReport{Entries: make(map[string]KeyMigrationEntry)}
+	}
+	report.Direction = direction
+	report.StartTime = time.Now()
+	report.EndTime = time.Time{}
+	migrator.report = report
+	for _, listed := range migrator.DB.List() {
+		entry := migrator.report.Entries[listed.UUID]
+		// The listed records do not carry key content, and the running key server may have changed the record meanwhile.
+		rec, err := migrator.readBack(listed.UUID)
+		if err != nil {
+			err = fmt.Errorf("failed to read the record - %v", err)
+		} else if direction == KeyMigrationToKMIP {
+			err = migrator.toKMIP(rec, &entry)
+		} else {
+			err = migrator.toLocal(rec, &entry)
+		}
+		if err != nil {
+			log.Printf("KeyMigrator.Migrate: failed to migrate the key of %s - %v", listed.UUID, err)
+			entry.Error = err.Error()
+			// A record caught in the middle keeps its state, so that the next run can finish it.
+			if entry.State != KeyMigrationRegistered && entry.State != KeyMigrationRelocating {
+				entry.State = KeyMigrationFailed
+			}
+		} else {
+			entry.Error = ""
+		}
+		if err := migrator.saveEntry(listed.UUID, entry); err != nil {
+			return migrator.report, fmt.Errorf("Migrate: failed to write report - %v", err)
+		}
+	}
+	migrator.report.EndTime = time.Now()
+	content, err := json.MarshalIndent(migrator.report, "", "  ")
+	if err != nil {
+		return migrator.report, err
+	}
+	return migrator.report, sys.ReplaceFile(migrator.ReportPath, content, keydb.DB_REC_FILE_MODE, true)
+}
+
+// Move the key of the record from key database onto KMIP server.
+func (migrator *KeyMigrator) toKMIP(rec keydb.Record, entry *KeyMigrationEntry) error {
+	if len(rec.Key) == 0 {
+		if entry.State == KeyMigrationRegistered && rec.ID == entry.NewID {
+			// The previous run was interrupted right after changing the record
+			entry.State = KeyMigrationDone
+		} else if entry.State != KeyMigrationDone {
+			entry.State = KeyMigrationSkipped
+		}
+		return nil
+	}
+	newID := ""
+	if entry.State == KeyMigrationRegistered && entry.NewID != "" {
+		// The previous run was interrupted after storing the key, reuse the copy if it is intact.
+		if key, err := migrator.KMIPClient.GetKey(entry.NewID); err == nil && bytes.Equal(key, rec.Key) {
+			newID = entry.NewID
+		}
+	}
+	if newID == "" {
+		id, err := migrator.KMIPClient.RegisterKey(KeyNamePrefix+rec.UUID, rec.Key)
+		if err != nil {
+			return fmt.Errorf("failed to store the key on KMIP server - %v", err)
+		}
+		*entry = KeyMigrationEntry{State: KeyMigrationRegistered, OldID: rec.ID, NewID: id}
+		if err := migrator.saveEntry(rec.UUID, *entry); err != nil {
+			return err
+		}
+		key, err := migrator.KMIPClient.GetKey(id)
+		if err != nil || !bytes.Equal(key, rec.Key) {
+			entry.State = KeyMigrationFailed
+			if destroyErr := migrator.KMIPClient.DestroyKey(id); destroyErr != nil {
+				log.Printf("KeyMigrator.toKMIP: failed to remove the bad copy \"%s\" of %s - %v", id, rec.UUID, destroyErr)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read back the key from KMIP server - %v", err)
+			}
+			return errors.New("the key read back from KMIP server is not identical")
+		}
+		newID = id
+	}
+	if _, err := migrator.Relocate(rec.UUID, rec.ID, newID, nil); err != nil {
+		return fmt.Errorf("failed to change the record - %v", err)
+	}
+	if saved, err := migrator.readBack(rec.UUID); err != nil || saved.ID != newID || len(saved.Key) != 0 {
+		return fmt.Errorf("the record was not saved with the new key ID - %v", err)
+	}
+	entry.State = KeyMigrationDone
+	return nil
+}
+
+// Move the key of the record from KMIP server into key database.
+func (migrator *KeyMigrator) toLocal(rec keydb.Record, entry *KeyMigrationEntry) error {
+	if len(rec.Key) > 0 {
+		if entry.State == KeyMigrationRelocating {
+			// The previous run was interrupted after changing the record
+			return migrator.removeKMIPCopy(rec, entry)
+		} else if entry.State != KeyMigrationDone {
+			entry.State = KeyMigrationSkipped
+		}
+		return nil
+	}
+	key, err := migrator.KMIPClient.GetKey(rec.ID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the key from KMIP server - %v", err)
+	}
+	*entry = KeyMigrationEntry{State: KeyMigrationRelocating, OldID: rec.ID}
+	if err := migrator.saveEntry(rec.UUID, *entry); err != nil {
+		return err
+	}
+	if entry.NewID, err = migrator.Relocate(rec.UUID, rec.ID, "", key); err != nil {
+		return fmt.Errorf("failed to change the record - %v", err)
+	}
+	saved, err := migrator.readBack(rec.UUID)
+	if err != nil || saved.ID != entry.NewID || !bytes.Equal(saved.Key, key) {
+		return fmt.Errorf("the record was not saved with the key content - %v", err)
+	}
+	return migrator.removeKMIPCopy(saved, entry)
+}
+
+// Remove the key from KMIP server after the record has been found carrying the identical key.
+func (migrator *KeyMigrator) removeKMIPCopy(rec keydb.Record, entry *KeyMigrationEntry) error {
+	key, err := migrator.KMIPClient.GetKey(entry.OldID)
+	if IsKMIPNotFound(err) {
+		// The previous run was interrupted right after removing the key
+		entry.State = KeyMigrationDone
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read the key from KMIP server before removing it - %v", err)
+	} else if !bytes.Equal(key, rec.Key) {
+		return fmt.Errorf("KMIP object \"%s\" holds a different key, it is left in place", entry.OldID)
+	}
+	if err := migrator.KMIPClient.DestroyKey(entry.OldID); err != nil {
+		return fmt.Errorf("failed to remove the key from KMIP server - %v", err)
+	}
+	entry.State = KeyMigrationDone
+	return nil
+}
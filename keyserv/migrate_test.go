@@ -0,0 +1,130 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestKeyMigrator(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2-migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The built-in KMIP server with its own database plays the external KMIP appliance
+	applianceDB, err := keydb.OpenDB(path.Join(tmpDir, "appliance"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appliance, err := NewKMIPServer(applianceDB, path.Join(PkgInGopath, "keyserv", "rpc_test.crt"), path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appliance.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go appliance.HandleConnections()
+	defer appliance.Shutdown()
+	client, err := NewKMIPClient([]string{"localhost:" + strconv.Itoa(appliance.GetPort())}, "username-does-not-matter", string(appliance.PasswordChallenge), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TLSConfig.InsecureSkipVerify = true
+
+	keyA := GetNewDiskEncryptionKeyBits()
+	keyB := bytes.Repeat([]byte{1}, 64) // a rotated key of a different size
+	for uuid, key := range map[string][]byte{"a": keyA, "b": keyB} {
+		if _, err := db.Upsert(keydb.Record{UUID: uuid, Key: key, MountPoint: "/" + uuid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrator := &KeyMigrator{KMIPClient: client, DB: db, ReportPath: GetKeyMigrationReportPath(db.Dir), Relocate: db.RelocateKey}
+	if migrator.ReportPath != path.Join(tmpDir, KeyMigrationReportFile) {
+		t.Fatal(migrator.ReportPath)
+	}
+	if _, err := migrator.Migrate("sideways"); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// An interrupted run left a copy of "a" on KMIP server, the copy is reused.
+	interruptedID, err := client.RegisterKey(KeyNamePrefix+"a", keyA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator.report = KeyMigrationReport{Direction: KeyMigrationToKMIP, Entries: map[string]KeyMigrationEntry{
+		"a": {State: KeyMigrationRegistered, NewID: interruptedID},
+	}}
+	if err := migrator.saveEntry("a", migrator.report.Entries["a"]); err != nil {
+		t.Fatal(err)
+	}
+	// Moving to the opposite direction is refused until the interrupted run is finished
+	if _, err := migrator.Migrate(KeyMigrationToLocal); err == nil {
+		t.Fatal("did not error")
+	}
+	report, err := migrator.Migrate(KeyMigrationToKMIP)
+	if err != nil || report.Count()[KeyMigrationDone] != 2 || report.Unfinished() || report.EndTime.IsZero() {
+		t.Fatalf("%+v %v", report, err)
+	}
+	if len(applianceDB.RecordsByUUID) != 2 || report.Entries["a"].NewID != interruptedID {
+		t.Fatalf("%+v %+v", report, applianceDB.RecordsByUUID)
+	}
+	for uuid, key := range map[string][]byte{"a": keyA, "b": keyB} {
+		rec, _ := db.GetByUUID(uuid)
+		if len(rec.Key) != 0 || rec.ID != report.Entries[uuid].NewID || rec.MountPoint != "/"+uuid {
+			t.Fatalf("%+v", rec)
+		}
+		if stored, err := client.GetKey(rec.ID); err != nil || !bytes.Equal(stored, key) {
+			t.Fatal(uuid, err)
+		}
+	}
+	// The report survives on disk
+	if saved, err := ReadKeyMigrationReport(migrator.ReportPath); err != nil || saved.Entries["b"].State != KeyMigrationDone {
+		t.Fatalf("%+v %v", saved, err)
+	}
+
+	// Move the keys back into key database
+	if report, err = migrator.Migrate(KeyMigrationToLocal); err != nil || report.Count()[KeyMigrationDone] != 2 {
+		t.Fatalf("%+v %v", report, err)
+	}
+	if db, err = keydb.OpenDB(db.Dir); err != nil {
+		t.Fatal(err)
+	}
+	for uuid, key := range map[string][]byte{"a": keyA, "b": keyB} {
+		rec, _ := db.GetByUUID(uuid)
+		if !bytes.Equal(rec.Key, key) || rec.ID != report.Entries[uuid].NewID || rec.ID == report.Entries[uuid].OldID {
+			t.Fatalf("%+v %+v", rec, report.Entries[uuid])
+		}
+	}
+	// Running it again leaves the records alone
+	migrator.DB = db
+	if report, err = migrator.Migrate(KeyMigrationToLocal); err != nil || report.Count()[KeyMigrationDone] != 2 {
+		t.Fatalf("%+v %v", report, err)
+	}
+}
+
+func TestRelocateKeyRPC(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: "aaa", MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := server.KeyDB.GetByUUID("aaa")
+	// The request carries key content, it is refused over the network even with the correct password.
+	if _, err := client.RelocateKey(RelocateKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "aaa", ExpectedID: rec.ID, NewID: "kmip-1"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if after, _ := server.KeyDB.GetByUUID("aaa"); after.ID != rec.ID || !bytes.Equal(after.Key, rec.Key) {
+		t.Fatalf("%+v", after)
+	}
+}
@@ -0,0 +1,48 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"fmt"
+)
+
+// Return the owner of a record in parentheses for notification email, or nothing if the record has no owner.
+func ownerNote(owner string) string {
+	if owner == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (owner %s)", owner)
+}
+
+// Return an error if the record has an owner on whose behalf the requester has not acknowledged to act.
+func checkOwnerAcknowledged(rec keydb.Record, acknowledged bool) error {
+	if rec.Owner != "" && !acknowledged {
+		return fmt.Errorf("the disk %s belongs to owner \"%s\", erasing its key has to be acknowledged on the owner's behalf", rec.UUID, rec.Owner)
+	}
+	return nil
+}
+
+// EraseKeyCheckResp tells whether the record that EraseKey would erase exists, and who owns it.
+type EraseKeyCheckResp struct {
+	Found bool   // Found is true if the record exists.
+	Owner string // Owner is the owner of the record, empty if it has none.
+}
+
+/*
+CheckEraseKey answers whether EraseKey would erase the record, without erasing it. A client asks before destroying the
+encryption header, as the header cannot be brought back if the key server refuses to erase the record afterwards.
+*/
+func (rpcConn *CryptServiceConn) CheckEraseKey(req EraseKeyReq, resp *EraseKeyCheckResp) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	resp.Found, resp.Owner = found, rec.Owner
+	if err := checkOwnerAcknowledged(rec, req.OwnerAcknowledged); err != nil {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultRejected, "owner did not acknowledge")
+		return fmt.Errorf("EraseKey: %v", err)
+	}
+	return nil
+}
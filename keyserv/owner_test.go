@@ -0,0 +1,65 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEraseKey_Owner(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []keydb.Record{
+		{ID: "1", Version: keydb.CurrentRecordVersion, UUID: "owned", Key: []byte("key"), MountPoint: "/a", Owner: "storage-team"},
+		{ID: "2", Version: keydb.CurrentRecordVersion, UUID: "unowned", Key: []byte("key"), MountPoint: "/b"},
+	} {
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	salt := NewSalt()
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordHash = HashPassword(salt, "pass")
+	conn := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+
+	var resp EraseKeyCheckResp
+	if err := conn.CheckEraseKey(EraseKeyReq{PlainPassword: "wrong", UUID: "unowned"}, &resp); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := conn.CheckEraseKey(EraseKeyReq{PlainPassword: "pass", UUID: "unowned"}, &resp); err != nil || !resp.Found || resp.Owner != "" {
+		t.Fatal(resp, err)
+	}
+	if err := conn.CheckEraseKey(EraseKeyReq{PlainPassword: "pass", UUID: "missing"}, &resp); err != nil || resp.Found {
+		t.Fatal(resp, err)
+	}
+	// An owned record tells its owner, and is only erased on the owner's behalf
+	err = conn.CheckEraseKey(EraseKeyReq{PlainPassword: "pass", UUID: "owned"}, &resp)
+	if err == nil || !strings.Contains(err.Error(), "storage-team") || resp.Owner != "storage-team" {
+		t.Fatal(resp, err)
+	}
+	if err := conn.CheckEraseKey(EraseKeyReq{PlainPassword: "pass", UUID: "owned", OwnerAcknowledged: true}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.EraseKey(EraseKeyReq{PlainPassword: "pass", UUID: "owned"}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, found := db.GetByUUID("owned"); !found {
+		t.Fatal("record is gone")
+	}
+	if note := ownerNote("storage-team"); note != " (owner storage-team)" || ownerNote("") != "" {
+		t.Fatal(note)
+	}
+}
@@ -0,0 +1,277 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	SRV_CONF_PASS_KDF = "AUTH_PASSWORD_KDF"
+
+	PasswordKDFScrypt             = "scrypt"        // PasswordKDFScrypt is the memory-hard scrypt (RFC 7914), the function of new password hashes.
+	DefaultPasswordKDFCost        = 1 << 15         // DefaultPasswordKDFCost is the scrypt CPU and memory cost N of a new password hash.
+	DefaultPasswordKDFBlockSize   = 8               // DefaultPasswordKDFBlockSize is the scrypt block size r of a new password hash.
+	DefaultPasswordKDFParallelism = 1               // DefaultPasswordKDFParallelism is the scrypt parallelisation p of a new password hash.
+	MinPasswordKDFCost            = 1 << 10         // MinPasswordKDFCost is the lowest scrypt cost N accepted from configuration.
+	MaxPasswordKDFMemory          = 1 << 30         // MaxPasswordKDFMemory is the most memory in bytes (128*N*r) an scrypt hash accepted from configuration may need.
+	MaxPasswordKDFBlockSize       = 32              // MaxPasswordKDFBlockSize is the largest scrypt block size r accepted from configuration.
+	MaxPasswordKDFParallelism     = 16              // MaxPasswordKDFParallelism is the largest scrypt parallelisation p accepted from configuration.
+	PasswordKDFPBKDF2SHA512       = "pbkdf2-sha512" // PasswordKDFPBKDF2SHA512 is PBKDF2 (RFC 8018) with HMAC-SHA512, its hashes are upgraded to scrypt.
+	MinPasswordKDFIterations      = 1000            // MinPasswordKDFIterations is the fewest PBKDF2 iterations accepted from configuration.
+	MaxPasswordKDFIterations      = 10000000        // MaxPasswordKDFIterations is the most PBKDF2 iterations accepted from configuration.
+	MaxConcurrentPasswordChecks   = 4               // MaxConcurrentPasswordChecks is the most passwords run through the key derivation function at once.
+	passwordKDFIterationSeparator = ":"
+)
+
+// ErrPasswordCheckBusy is returned without checking the password while MaxConcurrentPasswordChecks passwords are being checked.
+var ErrPasswordCheckBusy = errors.New("the server is busy checking other passwords, try again later")
+
+/*
+Each password check takes a slot for the duration of its key derivation function, which needs 32 MB of memory by
+default and may be triggered by any peer, so that a flood of requests cannot exhaust the server's memory. A check that
+finds no free slot fails right away instead of waiting.
+*/
+var passwordCheckSlots = make(chan struct{}, MaxConcurrentPasswordChecks)
+
+// Take a password check slot, return ErrPasswordCheckBusy if none is free. The returned function gives the slot back.
+func acquirePasswordCheck() (release func(), err error) {
+	select {
+	case passwordCheckSlots <- struct{}{}:
+		return func() { <-passwordCheckSlots }, nil
+	default:
+		return nil, ErrPasswordCheckBusy
+	}
+}
+
+/*
+PasswordKDF is the key derivation function that turns the access password into its hash, written in sysconfig as
+"scrypt:N:R:P", or "pbkdf2-sha512:ITERATIONS" by earlier versions. The zero value is the single salted SHA512 round of
+HashPassword, which hashes written by older versions still use.
+*/
+type PasswordKDF struct {
+	Name        string // Name is PasswordKDFScrypt, PasswordKDFPBKDF2SHA512, or empty for the single SHA512 round.
+	Iterations  int    // Iterations is the number of PBKDF2 iterations.
+	Cost        int    // Cost is the scrypt CPU and memory cost N, a power of two.
+	BlockSize   int    // BlockSize is the scrypt block size r.
+	Parallelism int    // Parallelism is the scrypt parallelisation p.
+}
+
+// DefaultPasswordKDF returns the key derivation function of new password hashes.
+func DefaultPasswordKDF() PasswordKDF {
+	return PasswordKDF{Name: PasswordKDFScrypt, Cost: DefaultPasswordKDFCost, BlockSize: DefaultPasswordKDFBlockSize, Parallelism: DefaultPasswordKDFParallelism}
+}
+
+// ParsePasswordKDF returns the key derivation function written in sysconfig, an empty string is the single SHA512 round.
+func ParsePasswordKDF(str string) (kdf PasswordKDF, err error) {
+	if str = strings.TrimSpace(str); str == "" {
+		return
+	}
+	fields := strings.Split(str, passwordKDFIterationSeparator)
+	switch {
+	case fields[0] == PasswordKDFScrypt && len(fields) == 4:
+		params := make([]int, 3)
+		for i, field := range fields[1:] {
+			if params[i], err = strconv.Atoi(field); err != nil {
+				return kdf, fmt.Errorf("ParsePasswordKDF: \"%s\" has a malformed number - %v", str, err)
+			}
+		}
+		kdf = PasswordKDF{Name: PasswordKDFScrypt, Cost: params[0], BlockSize: params[1], Parallelism: params[2]}
+		if kdf.Cost < MinPasswordKDFCost || kdf.Cost&(kdf.Cost-1) != 0 {
+			return PasswordKDF{}, fmt.Errorf("ParsePasswordKDF: cost in \"%s\" must be a power of two of at least %d", str, MinPasswordKDFCost)
+		} else if kdf.BlockSize < 1 || kdf.BlockSize > MaxPasswordKDFBlockSize {
+			return PasswordKDF{}, fmt.Errorf("ParsePasswordKDF: block size in \"%s\" must be between 1 and %d", str, MaxPasswordKDFBlockSize)
+		} else if kdf.Parallelism < 1 || kdf.Parallelism > MaxPasswordKDFParallelism {
+			return PasswordKDF{}, fmt.Errorf("ParsePasswordKDF: parallelisation in \"%s\" must be between 1 and %d", str, MaxPasswordKDFParallelism)
+		} else if kdf.Cost > MaxPasswordKDFMemory/(128*kdf.BlockSize) {
+			return PasswordKDF{}, fmt.Errorf("ParsePasswordKDF: \"%s\" needs more than %d MB of memory", str, MaxPasswordKDFMemory>>20)
+		}
+		return kdf, nil
+	case fields[0] == PasswordKDFPBKDF2SHA512 && len(fields) == 2:
+		iterations, err := strconv.Atoi(fields[1])
+		if err != nil || iterations < MinPasswordKDFIterations || iterations > MaxPasswordKDFIterations {
+			return kdf, fmt.Errorf("ParsePasswordKDF: number of iterations in \"%s\" must be between %d and %d", str, MinPasswordKDFIterations, MaxPasswordKDFIterations)
+		}
+		return PasswordKDF{Name: fields[0], Iterations: iterations}, nil
+	}
+	return kdf, fmt.Errorf("ParsePasswordKDF: \"%s\" should be in the form of \"%s:N:R:P\" or \"%s:ITERATIONS\"", str, PasswordKDFScrypt, PasswordKDFPBKDF2SHA512)
+}
+
+// IsLegacy returns true if the function is the single SHA512 round.
+func (kdf PasswordKDF) IsLegacy() bool {
+	return kdf.Name == ""
+}
+
+// IsOutdated returns true if the function is not the one of new password hashes, and its hash should be upgraded.
+func (kdf PasswordKDF) IsOutdated() bool {
+	return kdf.Name != PasswordKDFScrypt
+}
+
+// String returns the function in the form written in sysconfig.
+func (kdf PasswordKDF) String() string {
+	switch kdf.Name {
+	case "":
+		return ""
+	case PasswordKDFScrypt:
+		return strings.Join([]string{kdf.Name, strconv.Itoa(kdf.Cost), strconv.Itoa(kdf.BlockSize), strconv.Itoa(kdf.Parallelism)}, passwordKDFIterationSeparator)
+	}
+	return kdf.Name + passwordKDFIterationSeparator + strconv.Itoa(kdf.Iterations)
+}
+
+// Hash returns the salted hash of the password.
+func (kdf PasswordKDF) Hash(salt PasswordSalt, plainText string) (hash HashedPassword) {
+	switch kdf.Name {
+	case "":
+		return HashPassword(salt, plainText)
+	case PasswordKDFScrypt:
+		copy(hash[:], keydb.ScryptKey([]byte(plainText), salt[:], kdf.Cost, kdf.BlockSize, kdf.Parallelism, len(hash)))
+		return
+	}
+	return pbkdf2SHA512([]byte(plainText), salt[:], kdf.Iterations)
+}
+
+// Derive a key as long as the SHA512 digest from the password using PBKDF2 with HMAC-SHA512, the key is a single block.
+func pbkdf2SHA512(password, salt []byte, iterations int) (key HashedPassword) {
+	copy(key[:], keydb.PBKDF2Key(sha512.New, password, salt, iterations, len(key)))
+	return
+}
+
+// Return a copy of the salt, hash, and key derivation function of the access password currently in effect.
+func (srv *CryptServer) passwordParams() (salt PasswordSalt, hash HashedPassword, kdf PasswordKDF) {
+	srv.passwordLock.RLock()
+	defer srv.passwordLock.RUnlock()
+	copy(salt[:], srv.Config.PasswordSalt[:])
+	copy(hash[:], srv.Config.PasswordHash[:])
+	return salt, hash, srv.Config.PasswordKDF
+}
+
+/*
+ValidatePlainPassword returns an error if the password is incorrect. Every password, correct or not, is run through the
+key derivation function, so that no cheaper hash of the password is ever kept in memory. A hash of an outdated function
+is upgraded as soon as the correct password is given. ErrPasswordCheckBusy is returned if too many passwords are being
+checked at the moment.
+*/
+func (srv *CryptServer) ValidatePlainPassword(password string) error {
+	release, err := acquirePasswordCheck()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return srv.validatePlainPassword(password)
+}
+
+// Check the password like ValidatePlainPassword does, the caller holds a password check slot.
+func (srv *CryptServer) validatePlainPassword(password string) error {
+	salt, hash, kdf := srv.passwordParams()
+	if err := checkPasswordParams(salt, hash); err != nil {
+		return err
+	}
+	pass := kdf.Hash(salt, password)
+	if subtle.ConstantTimeCompare(pass[:], hash[:]) != 1 {
+		return errors.New("ValidatePlainPassword: password is incorrect")
+	}
+	if kdf.IsOutdated() {
+		srv.upgradePassword(salt, password)
+	}
+	return nil
+}
+
+/*
+Replace the outdated hash of the correct password by a hash of the default key derivation function with a new salt,
+both in memory and in configuration file via SavePassword. The hash stays as it is if it cannot be saved.
+*/
+func (srv *CryptServer) upgradePassword(oldSalt PasswordSalt, password string) {
+	if srv.SavePassword == nil {
+		return
+	}
+	kdf := DefaultPasswordKDF()
+	newSalt := NewSalt()
+	newHash := kdf.Hash(newSalt, password)
+	srv.passwordLock.Lock()
+	defer srv.passwordLock.Unlock()
+	if srv.Config.PasswordSalt != oldSalt || !srv.Config.PasswordKDF.IsOutdated() {
+		// The password has been changed or upgraded in the meantime
+		return
+	}
+	if err := srv.SavePassword(newSalt, newHash, kdf); err != nil {
+		log.Printf("CryptServer.ValidatePlainPassword: failed to save the upgraded password hash - %v", err)
+		return
+	}
+	srv.Config.PasswordSalt, srv.Config.PasswordHash, srv.Config.PasswordKDF = newSalt, newHash, kdf
+	log.Printf("CryptServer.ValidatePlainPassword: the password hash has been upgraded to %s", kdf)
+}
+
+// ChangePasswordReq asks the running server to accept a new access password from now on.
+type ChangePasswordReq struct {
+	PlainPassword string         // PlainPassword is the current password, it is validated to grant access to this function.
+	NewSalt       PasswordSalt   // NewSalt is the salt of the new password.
+	NewHash       HashedPassword // NewHash is the hash of the new password calculated with the new salt.
+	NewKDF        string         // NewKDF is the key derivation function that calculated the new hash, in the form of sysconfig.
+}
+
+/*
+ChangePassword replaces the password hash and salt in effect, requests carrying the current password are rejected
+right after it returns. It may only be called via the domain socket, and the caller is expected to have saved the same
+hash and salt into the server's configuration file, so that they are also in effect after a reload or restart.
+*/
+func (rpcConn *CryptServiceConn) ChangePassword(req ChangePasswordReq, _ *DummyAttr) error {
+	if rpcConn.RemoteHost != "@" {
+		return errors.New("ChangePassword: the password may only be changed via the domain socket")
+	}
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("ChangePassword", "", "", AuditResultRejected, err.Error())
+		return err
+	}
+	if err := checkPasswordParams(req.NewSalt, req.NewHash); err != nil {
+		return errors.New("ChangePassword: the new password hash or salt is missing")
+	}
+	kdf, err := ParsePasswordKDF(req.NewKDF)
+	if err != nil {
+		return fmt.Errorf("ChangePassword: %v", err)
+	}
+	rpcConn.Svc.passwordLock.Lock()
+	copy(rpcConn.Svc.Config.PasswordSalt[:], req.NewSalt[:])
+	copy(rpcConn.Svc.Config.PasswordHash[:], req.NewHash[:])
+	rpcConn.Svc.Config.PasswordKDF = kdf
+	rpcConn.Svc.passwordLock.Unlock()
+	log.Printf("CryptServiceConn.ChangePassword: the access password has been changed by %s", rpcConn.requester())
+	rpcConn.audit("ChangePassword", "", "", AuditResultGranted, "")
+	rpcConn.notifyPasswordChange()
+	return nil
+}
+
+// Describe the local user who called via the domain socket by name and peer credentials.
+func (rpcConn *CryptServiceConn) requester() string {
+	if rpcConn.Peer == nil {
+		return rpcConn.RemoteHost
+	}
+	if peerUser, err := user.LookupId(strconv.Itoa(rpcConn.Peer.UID)); err == nil {
+		return fmt.Sprintf("local user %s (%s)", peerUser.Username, rpcConn.Peer)
+	}
+	return fmt.Sprintf("local user (%s)", rpcConn.Peer)
+}
+
+// Send optional notification email of a changed password in background, it is never put into a digest.
+func (rpcConn *CryptServiceConn) notifyPasswordChange() {
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	requester := rpcConn.requester()
+	go func() {
+		subject := "Changed: the key server's access password has been changed"
+		text := fmt.Sprintf("The key server's access password has been changed on request of %s.\r\n\r\n"+
+			"If the change was not expected, please make sure the key server has not been compromised.\r\n", requester)
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("CryptServiceConn.ChangePassword: failed to send email notification - %v", err)
+		}
+	}()
+}
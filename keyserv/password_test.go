@@ -0,0 +1,240 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChangePassword(t *testing.T) {
+	oldSalt := NewSalt()
+	srv := &CryptServer{Mailer: &Mailer{}}
+	srv.Config.PasswordSalt = oldSalt
+	srv.Config.PasswordHash = HashPassword(oldSalt, "old password")
+	conn := &CryptServiceConn{RemoteHost: "@", Peer: &PeerCred{UID: 0}, Svc: srv}
+
+	newSalt := NewSalt()
+	req := ChangePasswordReq{PlainPassword: "old password", NewSalt: newSalt, NewHash: HashPassword(newSalt, "new password")}
+	// Only the domain socket may change the password
+	if err := (&CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}).ChangePassword(req, nil); err == nil {
+		t.Fatal("did not reject TCP client")
+	}
+	// The current password must be correct
+	wrongReq := req
+	wrongReq.PlainPassword = "wrong password"
+	if err := conn.ChangePassword(wrongReq, nil); err == nil {
+		t.Fatal("did not reject incorrect password")
+	}
+	// The new password parameters must be present
+	if err := conn.ChangePassword(ChangePasswordReq{PlainPassword: "old password"}, nil); err == nil {
+		t.Fatal("did not reject empty hash")
+	}
+	if err := conn.ChangePassword(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ValidatePlainPassword("new password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ValidatePlainPassword("old password"); err == nil {
+		t.Fatal("still accepts old password")
+	}
+	var salt PasswordSalt
+	if err := conn.GetSalt(false, &salt); err != nil || salt != newSalt {
+		t.Fatal(salt, err)
+	}
+}
+
+func TestPBKDF2SHA512(t *testing.T) {
+	// Test vectors are calculated by Python's hashlib.pbkdf2_hmac
+	for iterations, expected := range map[int]string{
+		1:    "867f70cf1ade02cff3752599a3a53dc4af34c7a669815ae5d513554e1c8cf252c02d470a285a0501bad999bfe943c08f050235d7d68b1da55e63f73b60a57fce",
+		4096: "d197b1b33db0143e018b12f3d1d1479e6cdebdcc97c5c0f87f6902e072f457b5143f30602641b3d55cd335988cb36b84376060ecd532e039b742a239434af2d5",
+	} {
+		key := pbkdf2SHA512([]byte("password"), []byte("salt"), iterations)
+		if hex.EncodeToString(key[:]) != expected {
+			t.Fatal(iterations, hex.EncodeToString(key[:]))
+		}
+	}
+}
+
+func TestParsePasswordKDF(t *testing.T) {
+	if kdf, err := ParsePasswordKDF(""); err != nil || !kdf.IsLegacy() || kdf.String() != "" {
+		t.Fatal(kdf, err)
+	}
+	if kdf, err := ParsePasswordKDF("pbkdf2-sha512:5000"); err != nil || kdf != (PasswordKDF{Name: PasswordKDFPBKDF2SHA512, Iterations: 5000}) || kdf.String() != "pbkdf2-sha512:5000" {
+		t.Fatal(kdf, err)
+	}
+	if kdf, err := ParsePasswordKDF("scrypt:16384:8:2"); err != nil || kdf != (PasswordKDF{Name: PasswordKDFScrypt, Cost: 16384, BlockSize: 8, Parallelism: 2}) || kdf.String() != "scrypt:16384:8:2" {
+		t.Fatal(kdf, err)
+	}
+	for _, bad := range []string{"pbkdf2-sha512", "pbkdf2-sha512:", "pbkdf2-sha512:10", "pbkdf2-sha512:99999999", "scrypt:5000", "pbkdf2-sha512:5000:1",
+		"scrypt", "scrypt:16384:8", "scrypt:16384:8:1:1", "scrypt:512:8:1", "scrypt:20000:8:1", "scrypt:16384:0:1", "scrypt:16384:33:1",
+		"scrypt:16384:8:0", "scrypt:16384:8:17", "scrypt:1048576:16:1", "scrypt:x:8:1", "bcrypt:16384:8:1"} {
+		if _, err := ParsePasswordKDF(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if kdf, err := ParsePasswordKDF(DefaultPasswordKDF().String()); err != nil || kdf != DefaultPasswordKDF() {
+		t.Fatal(kdf, err)
+	}
+}
+
+func FuzzParsePasswordKDF(f *testing.F) {
+	f.Add("")
+	f.Add("pbkdf2-sha512:210000")
+	f.Add("pbkdf2-sha512:-1")
+	f.Add("scrypt:32768:8:1")
+	f.Add("scrypt:-1024:-8:1")
+	f.Fuzz(func(t *testing.T, str string) {
+		kdf, err := ParsePasswordKDF(str)
+		if err != nil {
+			return
+		}
+		// A function accepted from configuration reads back the same and never costs more than the maximum
+		if again, err := ParsePasswordKDF(kdf.String()); err != nil || again != kdf {
+			t.Fatal(str, kdf, again, err)
+		} else if kdf.Iterations > MaxPasswordKDFIterations || 128*kdf.Cost*kdf.BlockSize > MaxPasswordKDFMemory {
+			t.Fatal(str, kdf)
+		}
+	})
+}
+
+func FuzzPasswordHashRoundTrip(f *testing.F) {
+	f.Add("the password", "wrong password", uint8(0))
+	f.Add("", " ", uint8(1))
+	f.Add("pässwört", "passwort", uint8(2))
+	// The cheapest parameters accepted from configuration keep each round trip fast
+	kdfs := []PasswordKDF{
+		{Name: PasswordKDFScrypt, Cost: MinPasswordKDFCost, BlockSize: 1, Parallelism: 1},
+		{Name: PasswordKDFPBKDF2SHA512, Iterations: MinPasswordKDFIterations},
+		{},
+	}
+	salt := NewSalt()
+	f.Fuzz(func(t *testing.T, password, other string, choice uint8) {
+		kdf := kdfs[int(choice)%len(kdfs)]
+		if kdf.Name != "" && strings.ContainsRune(password+other, 0) {
+			// HMAC pads a short password with zeros, so passwords that differ by trailing NUL characters are the same to it
+			t.Skip()
+		}
+		srv := &CryptServer{}
+		srv.Config.PasswordSalt = salt
+		srv.Config.PasswordKDF = kdf
+		srv.Config.PasswordHash = kdf.Hash(salt, password)
+		// The hash verifies the password it was calculated from, and no other
+		if err := srv.ValidatePlainPassword(password); err != nil {
+			t.Fatal(kdf, password, err)
+		}
+		if err := srv.ValidatePlainPassword(other); (err == nil) != (other == password) {
+			t.Fatal(kdf, password, other, err)
+		}
+	})
+}
+
+func TestValidatePlainPassword_Upgrade(t *testing.T) {
+	oldSalt := NewSalt()
+	srv := &CryptServer{}
+	srv.Config.PasswordSalt = oldSalt
+	srv.Config.PasswordHash = HashPassword(oldSalt, "the password")
+	// Without a way to save the upgraded hash, the hash stays as it is
+	if err := srv.ValidatePlainPassword("the password"); err != nil || !srv.Config.PasswordKDF.IsLegacy() {
+		t.Fatal(err, srv.Config.PasswordKDF)
+	}
+	var saved PasswordKDF
+	var savedSalt PasswordSalt
+	var savedHash HashedPassword
+	srv.SavePassword = func(salt PasswordSalt, hash HashedPassword, kdf PasswordKDF) error {
+		savedSalt, savedHash, saved = salt, hash, kdf
+		return nil
+	}
+	// An incorrect password does not upgrade the hash
+	if err := srv.ValidatePlainPassword("wrong password"); err == nil || !saved.IsLegacy() {
+		t.Fatal(err, saved)
+	}
+	if err := srv.ValidatePlainPassword("the password"); err != nil {
+		t.Fatal(err)
+	}
+	if saved != DefaultPasswordKDF() || savedSalt == oldSalt || srv.Config.PasswordKDF != saved ||
+		srv.Config.PasswordSalt != savedSalt || srv.Config.PasswordHash != savedHash || saved.Hash(savedSalt, "the password") != savedHash {
+		t.Fatal(saved, srv.Config.PasswordKDF)
+	}
+	// The upgraded hash keeps on validating the correct password only
+	for i := 0; i < 3; i++ {
+		if err := srv.ValidatePlainPassword("the password"); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.ValidatePlainPassword("wrong password"); err == nil {
+			t.Fatal("did not reject incorrect password")
+		}
+	}
+	// A PBKDF2 hash written by an earlier version is upgraded too
+	srv.Config.PasswordKDF = PasswordKDF{Name: PasswordKDFPBKDF2SHA512, Iterations: MinPasswordKDFIterations}
+	srv.Config.PasswordHash = srv.Config.PasswordKDF.Hash(srv.Config.PasswordSalt, "the password")
+	if err := srv.ValidatePlainPassword("the password"); err != nil || srv.Config.PasswordKDF != DefaultPasswordKDF() {
+		t.Fatal(err, srv.Config.PasswordKDF)
+	}
+}
+
+// Return the upper bound of a password verification, CRYPTCTL2_TEST_PASSWORD_KDF_MAX_MS overrides the default.
+func passwordKDFMaxDuration(t testing.TB) time.Duration {
+	maxMS := 1000
+	if env := os.Getenv("CRYPTCTL2_TEST_PASSWORD_KDF_MAX_MS"); env != "" {
+		var err error
+		if maxMS, err = strconv.Atoi(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Duration(maxMS) * time.Millisecond
+}
+
+func TestPasswordKDFCost(t *testing.T) {
+	// New hashes use scrypt with at least 32 MB of memory, and the parameters are accepted back from configuration
+	kdf := DefaultPasswordKDF()
+	if kdf.IsOutdated() || kdf.Cost < 1<<15 || kdf.BlockSize < 8 || kdf.Parallelism < 1 || 128*kdf.Cost*kdf.BlockSize < 32<<20 {
+		t.Fatal(kdf)
+	}
+	if again, err := ParsePasswordKDF(kdf.String()); err != nil || again != kdf {
+		t.Fatal(again, err)
+	}
+	// Each parameter takes effect on the hash
+	salt := NewSalt()
+	cheap := PasswordKDF{Name: PasswordKDFScrypt, Cost: MinPasswordKDFCost, BlockSize: 1, Parallelism: 1}
+	cheapHash := cheap.Hash(salt, "the password")
+	for _, costlier := range []PasswordKDF{
+		{Name: PasswordKDFScrypt, Cost: 2 * MinPasswordKDFCost, BlockSize: 1, Parallelism: 1},
+		{Name: PasswordKDFScrypt, Cost: MinPasswordKDFCost, BlockSize: 2, Parallelism: 1},
+		{Name: PasswordKDFScrypt, Cost: MinPasswordKDFCost, BlockSize: 1, Parallelism: 2},
+	} {
+		if costlier.Hash(salt, "the password") == cheapHash {
+			t.Fatal("parameter has no effect", costlier)
+		}
+	}
+	// The password is checked against the hash in effect on every call, nothing is remembered from an earlier call
+	srv := &CryptServer{}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordKDF = cheap
+	srv.Config.PasswordHash = cheapHash
+	if err := srv.ValidatePlainPassword("the password"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.PasswordHash = cheap.Hash(salt, "another password")
+	if err := srv.ValidatePlainPassword("the password"); err == nil {
+		t.Fatal("accepted a password that no longer matches the hash")
+	}
+}
+
+func BenchmarkPasswordKDF(b *testing.B) {
+	salt := NewSalt()
+	kdf := DefaultPasswordKDF()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kdf.Hash(salt, "the password")
+	}
+	if perOp := b.Elapsed() / time.Duration(b.N); perOp > passwordKDFMaxDuration(b) {
+		b.Fatalf("verification took %v, more than %v", perOp, passwordKDFMaxDuration(b))
+	}
+}
@@ -0,0 +1,146 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+const (
+	SRV_CONF_SOCKET_GROUP = "DOMAIN_SOCKET_GROUP"
+
+	DomainSocketFileMode = 0660 // DomainSocketFileMode is the permission of the domain socket file, the group is configurable.
+)
+
+// PeerCred is the identity of the local process on the other end of a domain socket connection, as told by the kernel.
+type PeerCred struct {
+	PID int // PID is the process ID of the peer at the moment it connected.
+	UID int // UID is the effective user ID of the peer.
+	GID int // GID is the effective group ID of the peer.
+}
+
+func (cred PeerCred) String() string {
+	return fmt.Sprintf("pid %d uid %d gid %d", cred.PID, cred.UID, cred.GID)
+}
+
+// peerCredentials tells the identity of the peer of a domain socket connection, test cases substitute it to fake a peer.
+var peerCredentials = unixPeerCredentials
+
+// Ask the kernel for the credentials (SO_PEERCRED) of the peer of the domain socket connection.
+func unixPeerCredentials(conn net.Conn) (cred PeerCred, err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return cred, errors.New("unixPeerCredentials: not a domain socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return cred, fmt.Errorf("unixPeerCredentials: %v", err)
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return cred, fmt.Errorf("unixPeerCredentials: %v", err)
+	} else if credErr != nil {
+		return cred, fmt.Errorf("unixPeerCredentials: failed to read peer credentials - %v", credErr)
+	}
+	return PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
+
+// LookupSocketGroup returns the ID of the group given by name or number, it returns -1 if the name is empty.
+func LookupSocketGroup(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(name); err == nil && gid >= 0 {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, fmt.Errorf("LookupSocketGroup: %v", err)
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+/*
+IsPeerPermitted returns true if the local process may call administrative functions via the domain socket: it runs as
+root, or as a member (primary or supplementary) of the domain socket group if one is configured.
+*/
+func (srv *CryptServer) IsPeerPermitted(cred PeerCred) bool {
+	if cred.UID == 0 {
+		return true
+	}
+	gid, err := LookupSocketGroup(srv.Config.SocketGroup)
+	if err != nil {
+		log.Printf("CryptServer.IsPeerPermitted: %v", err)
+		return false
+	} else if gid < 0 {
+		return false
+	} else if cred.GID == gid {
+		return true
+	}
+	peerUser, err := user.LookupId(strconv.Itoa(cred.UID))
+	if err != nil {
+		return false
+	}
+	groupIDs, err := peerUser.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, id := range groupIDs {
+		if id == strconv.Itoa(gid) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Return an error if the connection comes from the domain socket and its peer is neither root nor in the domain socket
+group. The check comes before the password, so that other local users cannot guess the password via the socket.
+Connections over TCP are not affected.
+*/
+func (rpcConn *CryptServiceConn) checkPeer() error {
+	if rpcConn.RemoteHost != "@" {
+		return nil
+	} else if rpcConn.Peer == nil {
+		return errors.New("checkPeer: the identity of the local peer is unknown")
+	} else if !rpcConn.Svc.IsPeerPermitted(*rpcConn.Peer) {
+		return fmt.Errorf("checkPeer: local peer (%s) is neither root nor a member of the domain socket group", rpcConn.Peer)
+	}
+	return nil
+}
+
+// Validate the peer of the connection and then the password, see checkPeer and checkPasswordWithLockout.
+func (rpcConn *CryptServiceConn) validatePassword(plainPassword string) error {
+	if err := rpcConn.checkPeer(); err != nil {
+		log.Print(err)
+		return err
+	}
+	return rpcConn.checkPasswordWithLockout(plainPassword)
+}
+
+// Make the domain socket file accessible to root and the domain socket group only.
+func (srv *CryptServer) secureDomainSocket() error {
+	gid, err := LookupSocketGroup(srv.Config.SocketGroup)
+	if err != nil {
+		return err
+	}
+	if gid >= 0 {
+		if err := os.Chown(DomainSocketFile, -1, gid); err != nil {
+			return fmt.Errorf("CryptServer.ListenUnix: failed to change group of \"%s\" - %v", DomainSocketFile, err)
+		}
+	}
+	if err := os.Chmod(DomainSocketFile, DomainSocketFileMode); err != nil {
+		return fmt.Errorf("CryptServer.ListenUnix: failed to change permission of \"%s\" - %v", DomainSocketFile, err)
+	}
+	return nil
+}
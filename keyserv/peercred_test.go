@@ -0,0 +1,89 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Return both ends of a connected pair of domain sockets.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		if conns[i], err = net.FileConn(file); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	return conns[0], conns[1]
+}
+
+func TestUnixPeerCredentials(t *testing.T) {
+	server, client := socketPair(t)
+	defer server.Close()
+	defer client.Close()
+	cred, err := unixPeerCredentials(server)
+	if err != nil || cred.UID != os.Geteuid() || cred.GID != os.Getegid() || cred.PID != os.Getpid() {
+		t.Fatal(cred, err)
+	}
+	if _, err := unixPeerCredentials(&net.TCPConn{}); err == nil {
+		t.Fatal("did not error on TCP connection")
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	srv := &CryptServer{}
+	conn := CryptServiceConn{RemoteHost: "@", Svc: srv}
+	if err := conn.checkPeer(); err == nil {
+		t.Fatal("did not reject unknown peer")
+	}
+	conn.Peer = &PeerCred{UID: 0, GID: 0}
+	if err := conn.checkPeer(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Peer = &PeerCred{UID: 12345, GID: 23456}
+	if err := conn.checkPeer(); err == nil {
+		t.Fatal("did not reject ordinary user")
+	}
+	srv.Config.SocketGroup = "23456"
+	if err := conn.checkPeer(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.SocketGroup = "this-group-does-not-exist"
+	if err := conn.checkPeer(); err == nil {
+		t.Fatal("did not reject peer of missing group")
+	}
+	// Clients connected over TCP are not concerned
+	if err := (&CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}).checkPeer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeConn_PeerRejected(t *testing.T) {
+	defer func() {
+		peerCredentials = unixPeerCredentials
+	}()
+	peerCredentials = func(net.Conn) (PeerCred, error) {
+		return PeerCred{PID: 1, UID: 12345, GID: 12345}, nil
+	}
+	srv := &CryptServer{}
+	server, client := socketPair(t)
+	go srv.ServeConn(server)
+	rpcClient := rpc.NewClient(client)
+	defer rpcClient.Close()
+	// The peer is turned away before its password is checked
+	err := rpcClient.Call("CryptServiceConn.ReloadRecord", ReloadRecordReq{PlainPassword: "wrong", UUID: "a"}, new(DummyAttr))
+	if err == nil || !strings.Contains(err.Error(), "uid 12345") {
+		t.Fatal(err)
+	}
+}
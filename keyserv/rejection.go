@@ -0,0 +1,71 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"time"
+)
+
+const (
+	SRV_CONF_REJECTIONS_PERSIST     = "KEY_REJECTIONS_PERSIST"
+	SRV_CONF_RETRIEVAL_HISTORY_SIZE = "KEY_RETRIEVAL_HISTORY_SIZE"
+)
+
+/*
+Keep the rejected key retrieval on the records of the UUIDs and count it by its reason, see keydb.DB.AddRejection. The
+reason is one of keydb.Rejection* constants. A request may carry several device IDs of a disk, the rejection is kept
+once per record.
+*/
+func (rpcConn *CryptServiceConn) recordRejection(event, hostname string, uuids []string, reason, detail string) {
+	rej := keydb.Rejection{
+		Time:     time.Now().Unix(),
+		Event:    event,
+		Hostname: hostname,
+		IP:       rpcConn.RemoteHost,
+		Reason:   reason,
+		Detail:   detail,
+	}
+	seen := make(map[string]bool)
+	for _, uuid := range uuids {
+		rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid)
+		if !found || seen[rec.UUID] {
+			continue
+		}
+		seen[rec.UUID] = true
+		rpcConn.Svc.KeyDB.AddRejection(rec.UUID, rej, rpcConn.Svc.Config.RejectionsPersist)
+	}
+}
+
+/*
+Tell why the record was rejected by keydb.DB.Select or ForceSelect, which is either that the requester is not an
+allowed client or that the record is used by as many computers as it allows. Return one of keydb.Rejection* constants
+along with the reason for the audit log.
+*/
+func (rpcConn *CryptServiceConn) classifySelectRejection(uuid string) (reason, auditReason string) {
+	if rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid); found && !rpcConn.Svc.KeyDB.IsClientAllowed(rec, rpcConn.CertDNSName, rpcConn.CertIPAddress) {
+		return keydb.RejectionNotAllowed, "client is not allowed"
+	}
+	return keydb.RejectionMaxActive, "maximum number of active users is reached"
+}
+
+/*
+Keep the decision on the key retrieval in the retrieval history of the record, see keydb.DB.AddRetrieval. A granted
+retrieval is written to the record file right away, a rejected one only if rejections are persisted too, so that a
+computer retrying over and over does not keep the disk busy.
+*/
+func (rpcConn *CryptServiceConn) recordRetrieval(event, hostname, uuid string, granted bool, reason string) {
+	if rpcConn.Svc.Config.RetrievalHistorySize < 1 {
+		return
+	}
+	ret := keydb.Retrieval{
+		Time:     time.Now().Unix(),
+		Event:    event,
+		Hostname: hostname,
+		IP:       rpcConn.RemoteHost,
+		Granted:  granted,
+		Reason:   reason,
+	}
+	persist := granted || rpcConn.Svc.Config.RejectionsPersist
+	rpcConn.Svc.KeyDB.AddRetrieval(uuid, ret, rpcConn.Svc.Config.RetrievalHistorySize, persist)
+}
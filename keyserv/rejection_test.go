@@ -0,0 +1,133 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRecordRejection(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The computer is not an allowed client of "a", and "b" is already used by another computer
+	if _, err := db.Upsert(keydb.Record{UUID: "a", Key: []byte("key a"), MountPoint: "/a", MaxActive: 1, AllowedClients: []string{"10.9.9.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "b", Key: []byte("key b"), MountPoint: "/b", MaxActive: 1, AliveIntervalSec: 10, AliveCount: 10,
+		AliveMessages: map[string][]keydb.AliveMessage{"10.0.0.2": {{IP: "10.0.0.2", Hostname: "host2", Timestamp: time.Now().Unix()}}}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}, Metrics: NewMetrics(db, false)}
+	srv.Config.RejectionsPersist = true
+	client := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+
+	var resp AutoRetrieveKeyResp
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a", "b", "c"}, Hostname: "host1"}, &resp); err != nil || len(resp.Rejected) != 2 {
+		t.Fatal(resp, err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.Rejections) != 1 || rec.Rejections[0].Reason != keydb.RejectionNotAllowed || rec.Rejections[0].IP != "10.0.0.1" || rec.Rejections[0].Hostname != "host1" {
+		t.Fatal(rec.Rejections)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Rejections) != 1 || rec.Rejections[0].Reason != keydb.RejectionMaxActive {
+		t.Fatal(rec.Rejections)
+	}
+	// A request naming the same record twice is kept once
+	if err := db.SetMaintenance(keydb.MaintenanceMode{Enabled: true, Since: time.Now(), Until: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a", "a", "c"}}, &AutoRetrieveKeyResp{}); !IsMaintenanceError(err) {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.Rejections) != 2 || rec.Rejections[0].Reason != keydb.RejectionMaintenance || rec.Rejections[0].Detail == "" {
+		t.Fatal(rec.Rejections)
+	}
+	if err := db.SetMaintenance(keydb.MaintenanceMode{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.TokenRetrieveKey(TokenRetrieveKeyReq{Token: "bogus", UUIDs: []string{"b"}}, &TokenRetrieveKeyResp{}); err == nil {
+		t.Fatal("accepted bogus token")
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Rejections) != 2 || rec.Rejections[0].Reason != keydb.RejectionUnlockToken {
+		t.Fatal(rec.Rejections)
+	}
+	// The counters are in the health details and metrics
+	health := srv.checkHealth()
+	if health.Rejections[keydb.RejectionNotAllowed] != 1 || health.Rejections[keydb.RejectionMaintenance] != 1 || health.Rejections[keydb.RejectionUnlockWindow] != 0 {
+		t.Fatal(health.Rejections)
+	}
+	var buf bytes.Buffer
+	if _, err := srv.Metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expectMetrics(t, buf.String(),
+		`cryptctl2_key_rejections_total{reason="max-active"} 1`,
+		`cryptctl2_key_rejections_total{reason="unlock-token"} 1`,
+		`cryptctl2_key_rejections_total{reason="unlock-window"} 0`)
+}
+
+func TestRecordRetrieval(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The computer may use "a", but is not an allowed client of "b"
+	if _, err := db.Upsert(keydb.Record{UUID: "a", Key: []byte("key a"), MountPoint: "/a", MaxActive: 0, AliveIntervalSec: 10, AliveCount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "b", Key: []byte("key b"), MountPoint: "/b", MaxActive: 1, AllowedClients: []string{"10.9.9.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}, Metrics: NewMetrics(db, false)}
+	srv.Config.RetrievalHistorySize = 2
+	client := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+	for i := 0; i < 3; i++ {
+		var resp AutoRetrieveKeyResp
+		if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a", "b"}, Hostname: "host1"}, &resp); err != nil || len(resp.Granted) != 1 || len(resp.Rejected) != 1 {
+			t.Fatal(resp, err)
+		}
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.Retrievals) != 2 || !rec.Retrievals[0].Granted || rec.Retrievals[0].IP != "10.0.0.1" ||
+		rec.Retrievals[0].Hostname != "host1" || rec.Retrievals[0].Event != "AutoRetrieveKey" {
+		t.Fatal(rec.Retrievals)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Retrievals) != 2 || rec.Retrievals[0].Granted || rec.Retrievals[0].Reason == "" {
+		t.Fatal(rec.Retrievals)
+	}
+	// Granted retrievals are persisted, rejected ones only along with rejections
+	if db, err = keydb.OpenDB(path.Join(tmpDir, "keydb")); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.Retrievals) != 2 {
+		t.Fatal(rec.Retrievals)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Retrievals) != 0 {
+		t.Fatal(rec.Retrievals)
+	}
+	// No history is kept if its size is 0
+	srv.KeyDB = db
+	srv.Config.RetrievalHistorySize = 0
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"b"}, Hostname: "host1"}, &AutoRetrieveKeyResp{}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.Retrievals) != 0 {
+		t.Fatal(rec.Retrievals)
+	}
+}
@@ -0,0 +1,97 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// StartKeyRotationReq asks the server to replace the encryption key of a record by a key it generates.
+type StartKeyRotationReq struct {
+	PlainPassword string // PlainPassword grants access to this function.
+	UUID          string // UUID is the record UUID.
+}
+
+// StartKeyRotationResp tells which computers have been told to carry out the rotation.
+type StartKeyRotationResp struct {
+	Holders []string // Holders are the IPs of the computers currently holding the disk, each has received a rotate command.
+}
+
+/*
+StartKeyRotation generates a new encryption key for the record and keeps the replaced key until a computer confirms
+that the disk's encryption header carries the new key, see keydb.DB.StartKeyRotation. Rotation is only supported when
+keys are stored by the built-in KMIP server.
+*/
+func (rpcConn *CryptServiceConn) StartKeyRotation(req StartKeyRotationReq, resp *StartKeyRotationResp) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("StartKeyRotation", "", req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	if err := keydb.ValidateUUID(req.UUID); err != nil {
+		return err
+	}
+	if _, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID); !found {
+		rpcConn.audit("StartKeyRotation", "", req.UUID, AuditResultMissing, "")
+		return fmt.Errorf("StartKeyRotation: record \"%s\" does not exist", req.UUID)
+	}
+	if rpcConn.Svc.BuiltInKMIPServer == nil {
+		rpcConn.audit("StartKeyRotation", "", req.UUID, AuditResultRejected, "keys are stored on an external KMIP server")
+		return errors.New("StartKeyRotation: key rotation is not supported when keys are stored on an external KMIP server")
+	}
+	holders, err := rpcConn.Svc.KeyDB.StartKeyRotation(req.UUID, GetNewDiskEncryptionKeyBits())
+	if err != nil {
+		rpcConn.audit("StartKeyRotation", "", req.UUID, AuditResultFailed, err.Error())
+		return err
+	}
+	resp.Holders = holders
+	rpcConn.audit("StartKeyRotation", "", req.UUID, AuditResultGranted, strings.Join(holders, " "))
+	log.Printf("CryptServiceConn.StartKeyRotation: %s has started the rotation of the key of %s, computers told to rotate: %v",
+		rpcConn.RemoteHost, req.UUID, holders)
+	return nil
+}
+
+// ConfirmKeyRotationReq tells the server that the encryption header of a disk no longer carries the previous key.
+type ConfirmKeyRotationReq struct {
+	PlainPassword string // PlainPassword grants access, leave it empty to act on behalf of a computer that is currently holding the key.
+	Hostname      string // Hostname is the client's host name (for logging only).
+	UUID          string // UUID is the record UUID.
+	KeyDigest     []byte // KeyDigest is the SHA-256 digest of the key that has replaced the previous one.
+}
+
+/*
+ConfirmKeyRotation drops the previous key of a record whose rotation has been carried out. Without a password, only a
+computer that currently holds the key and is allowed to retrieve it may confirm the rotation.
+*/
+func (rpcConn *CryptServiceConn) ConfirmKeyRotation(req ConfirmKeyRotationReq, _ *DummyAttr) error {
+	if err := keydb.ValidateUUID(req.UUID); err != nil {
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		rpcConn.audit("ConfirmKeyRotation", req.Hostname, req.UUID, AuditResultMissing, "")
+		return fmt.Errorf("ConfirmKeyRotation: record \"%s\" does not exist", req.UUID)
+	}
+	if req.PlainPassword != "" {
+		if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+			rpcConn.audit("ConfirmKeyRotation", req.Hostname, req.UUID, AuditResultRejected, err.Error())
+			return err
+		}
+	} else if alive, _ := rec.IsHostAlive(rpcConn.RemoteHost); !alive || !rpcConn.Svc.KeyDB.IsClientAllowed(rec, rpcConn.CertDNSName, rpcConn.CertIPAddress) {
+		rpcConn.audit("ConfirmKeyRotation", req.Hostname, req.UUID, AuditResultRejected, "computer is not holding the key")
+		return fmt.Errorf("ConfirmKeyRotation: %s is not currently holding the key of \"%s\", a password is required", rpcConn.RemoteHost, req.UUID)
+	}
+	pending := rec.IsKeyRotationPending()
+	if err := rpcConn.Svc.KeyDB.ConfirmKeyRotation(req.UUID, req.KeyDigest); err != nil {
+		rpcConn.audit("ConfirmKeyRotation", req.Hostname, req.UUID, AuditResultFailed, err.Error())
+		return err
+	}
+	if pending {
+		rpcConn.audit("ConfirmKeyRotation", req.Hostname, req.UUID, AuditResultGranted, "")
+		log.Printf("CryptServiceConn.ConfirmKeyRotation: %s (%s) has completed the rotation of the key of %s", rpcConn.RemoteHost, req.Hostname, req.UUID)
+	}
+	return nil
+}
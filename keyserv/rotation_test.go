@@ -0,0 +1,62 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+)
+
+func TestServerKeyRotation(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	createResp, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: "aaa", MountPoint: "/a", AliveIntervalSec: 10, AliveCount: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := createResp.KeyContent
+	if _, err := client.StartKeyRotation(StartKeyRotationReq{PlainPassword: "wrong password", UUID: "aaa"}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The server generates the new key, and tells the computer holding the disk to rotate
+	if _, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "localhost", UUIDs: []string{"aaa"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.StartKeyRotation(StartKeyRotationReq{PlainPassword: TEST_RPC_PASS, UUID: "aaa"})
+	if err != nil || !reflect.DeepEqual(resp.Holders, []string{"127.0.0.1"}) {
+		t.Fatal(resp, err)
+	}
+	if _, err := client.StartKeyRotation(StartKeyRotationReq{PlainPassword: TEST_RPC_PASS, UUID: "aaa"}); err == nil {
+		t.Fatal("did not error")
+	}
+	cmd, err := client.PollCommand(PollCommandReq{UUIDs: []string{"aaa"}})
+	if err != nil || len(cmd.Commands["aaa"]) != 1 || cmd.Commands["aaa"][0].Content != keydb.KeyRotationCommand {
+		t.Fatal(cmd, err)
+	}
+	// Both keys are handed out until the rotation is confirmed
+	autoResp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{Hostname: "localhost", UUIDs: []string{"aaa"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := autoResp.Granted["aaa"]
+	if bytes.Equal(granted.Key, oldKey) || len(granted.Key) != len(oldKey) || !bytes.Equal(granted.PreviousKey, oldKey) {
+		t.Fatalf("%+v", granted)
+	}
+	oldDigest := sha256.Sum256(oldKey)
+	if err := client.ConfirmKeyRotation(ConfirmKeyRotationReq{Hostname: "localhost", UUID: "aaa", KeyDigest: oldDigest[:]}); err == nil {
+		t.Fatal("did not error")
+	}
+	newDigest := sha256.Sum256(granted.Key)
+	if err := client.ConfirmKeyRotation(ConfirmKeyRotationReq{PlainPassword: "wrong password", UUID: "aaa", KeyDigest: newDigest[:]}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ConfirmKeyRotation(ConfirmKeyRotationReq{Hostname: "localhost", UUID: "aaa", KeyDigest: newDigest[:]}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := server.KeyDB.GetByUUID("aaa"); rec.IsKeyRotationPending() || !bytes.Equal(rec.Key, granted.Key) {
+		t.Fatalf("%+v", rec)
+	}
+}
@@ -3,6 +3,7 @@
 package keyserv
 
 import (
+	"cryptctl2/keydb"
 	"cryptctl2/sys"
 	"crypto/tls"
 	"crypto/x509"
@@ -12,8 +13,11 @@ import (
 	"io/ioutil"
 	"net"
 	"net/rpc"
+	"net/url"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -28,25 +32,43 @@ const (
 	TEST_RPC_PASS        = "pass"
 )
 
-// CryptClient implements an RPC client for CryptServer.
+/*
+CryptClient implements an RPC client for CryptServer. A TCP client may know several key servers, each RPC is made on
+the one that most recently answered and fails over to the others in order of preference.
+*/
 type CryptClient struct {
-	Address   string // Address is the server address string, IP:port for TCP and file name for domain socket.
-	Type      string // Type is either "tcp" or "unix" depends on the connection address.
-	TLSCert   string // TLSCert is path to TLS certificate that is presented by client to server.
-	TLSKey    string // TLSKey is path to TLS key corresponding to the certificate.
+	Address   string   // Address is the server address string, IP:port for TCP and file name for domain socket. It is the preferred server of several.
+	Addresses []string // Addresses are all the server addresses in order of preference, the first one is Address.
+	Type      string   // Type is either "tcp" or "unix" depends on the connection address.
+	TLSCert   string   // TLSCert is path to TLS certificate that is presented by client to server.
+	TLSKey    string   // TLSKey is path to TLS key corresponding to the certificate.
 	tlsConfig *tls.Config
+	localAddr *net.TCPAddr // localAddr is the bind address of TCP connections, see SetConnection.
+	proxy     *url.URL     // proxy is contacted in place of the key server, see SetConnection.
+	// verifyServer replaces the built-in verification of the server certificate if set, it is given the host name or IP
+	// the server is contacted by, see SetTLSVerification.
+	verifyServer func(state tls.ConnectionState, host string) error
+
+	mutex   sync.Mutex // mutex protects current.
+	current int        // current is the index of the server in Addresses that most recently answered.
 }
 
 /*
-Initialise an RPC client.
+Initialise an RPC client. A TCP address may list several "IP:port" of key servers separated by comma, in order of
+preference, each of them is verified by the same TLS settings.
 The function does not immediately establish a connection to server, connection is only made along with each RPC call.
 */
 func NewCryptClient(connType, address string, caCertPEM []byte, certPath, certKeyPath string) (*CryptClient, error) {
 	client := &CryptClient{
 		Type:      connType,
 		Address:   address,
+		Addresses: []string{address},
 		tlsConfig: new(tls.Config),
 	}
+	if connType == "tcp" && strings.Contains(address, ",") {
+		client.Addresses = strings.Split(address, ",")
+		client.Address = client.Addresses[0]
+	}
 	if caCertPEM != nil && len(caCertPEM) > 0 {
 		// Use custom CA
 		caCertPool := x509.NewCertPool()
@@ -67,7 +89,7 @@ func NewCryptClient(connType, address string, caCertPEM []byte, certPath, certKe
 	return client, nil
 }
 
-// Initialise an RPC client by reading settings from sysconfig file.
+// Initialise an RPC client by reading settings from sysconfig file, the host setting may list several key servers.
 func NewCryptClientFromSysconfig(sysconf *sys.Sysconfig) (*CryptClient, error) {
 	host := sysconf.GetString(CLIENT_CONF_HOST, "")
 	if host == "" {
@@ -77,6 +99,10 @@ func NewCryptClientFromSysconfig(sysconf *sys.Sysconfig) (*CryptClient, error) {
 	if port == 0 {
 		return nil, errors.New("NewCryptClientFromSysconfig: key server port number is empty")
 	}
+	addrs, err := ParseServerAddresses(host, port)
+	if err != nil {
+		return nil, fmt.Errorf("NewCryptClientFromSysconfig: %v", err)
+	}
 	var caCertPEM []byte
 	if ca := sysconf.GetString(CLIENT_CONF_CA, ""); ca != "" {
 		var err error
@@ -85,37 +111,56 @@ func NewCryptClientFromSysconfig(sysconf *sys.Sysconfig) (*CryptClient, error) {
 			return nil, fmt.Errorf("NewCryptClientFromSysconfig: failed to read CA PEM file at \"%s\" - %v", ca, err)
 		}
 	}
-	return NewCryptClient("tcp", fmt.Sprintf("%s:%d", host, port), caCertPEM, sysconf.GetString(CLIENT_CONF_CERT, ""), sysconf.GetString(CLIENT_CONF_CERT_KEY, ""))
+	client, err := NewCryptClient("tcp", strings.Join(addrs, ","), caCertPEM, sysconf.GetString(CLIENT_CONF_CERT, ""), sysconf.GetString(CLIENT_CONF_CERT_KEY, ""))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.SetTLSVerification(TLSVerificationFromSysconfig(sysconf)); err != nil {
+		return nil, fmt.Errorf("NewCryptClientFromSysconfig: %s - %v", CLIENT_CONF_SERVER_FINGERPRINT, err)
+	}
+	if err := client.SetConnection(ConnectionSettingsFromSysconfig(sysconf)); err != nil {
+		return nil, fmt.Errorf("NewCryptClientFromSysconfig: %v", err)
+	}
+	return client, nil
 }
 
 /*
-Establish a new TLS connection to RPC server and then invoke an RPC on the connection.
+Establish a new TLS connection to RPC server and then invoke an RPC on the connection, see doRPCWithFailover for
+clients of several key servers.
 The function deliberately establishes a new connection on each RPC call, in order to reduce complexity in managing
 the client connections, especially in the area of keep-alive. The client is not expected to make high volume of calls
 hence there is absolutely no performance concern.
 */
 func (client *CryptClient) DoRPC(fun func(*rpc.Client) error) (err error) {
+	if client.Type != "tcp" && client.Type != "unix" {
+		return fmt.Errorf("DoRPC: invalid client type \"%s\"", client.Type)
+	}
+	return client.doRPCWithFailover(fun)
+}
+
+/*
+Invoke the RPC on the server at the address. Failover is true if the server could not be reached or the connection
+broke during the call, an error returned by the server itself (e.g. an incorrect password) is the answer to the request.
+*/
+func (client *CryptClient) doRPCOn(address string, fun func(*rpc.Client) error) (failover bool, err error) {
 	var conn net.Conn
 	if client.Type == "tcp" {
-		conn, err = tls.DialWithDialer(
-			&net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second},
-			"tcp", client.Address, client.tlsConfig)
-	} else if client.Type == "unix" {
-		// TLS is not involved in domain socket communication
-		conn, err = net.Dial("unix", client.Address)
+		conn, err = client.dialTCP(address)
 	} else {
-		return fmt.Errorf("DoRPC: invalid client type \"%s\"", client.Type)
+		// TLS is not involved in domain socket communication
+		conn, err = net.Dial("unix", address)
 	}
 	if err != nil {
-		return fmt.Errorf("DoRPC: failed to connect to %s via %s - %v", client.Address, client.Type, err)
+		return true, fmt.Errorf("DoRPC: failed to connect to %s via %s - %v", address, client.Type, err)
 	}
 	defer conn.Close()
 	rpcClient := rpc.NewClient(conn)
 	defer rpcClient.Close()
 	if err := fun(rpcClient); err != nil {
-		return fmt.Errorf("DoRPC: call failed - %v", err)
+		_, isServerErr := err.(rpc.ServerError)
+		return !isServerErr, fmt.Errorf("DoRPC: call failed - %v", err)
 	}
-	return nil
+	return false, nil
 }
 
 // Retrieve the salt that was used to hash server's access password.
@@ -135,6 +180,23 @@ func (client *CryptClient) Ping(req PingRequest) error {
 	})
 }
 
+// Retrieve server's protocol version, optional features, limits, and certificate expiry.
+func (client *CryptClient) GetCapabilities() (caps Capabilities, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetCapabilities"), &dummy, &caps)
+	})
+	return
+}
+
+// GetHealth asks server whether it is fully functional, the details are only reported if the password is given.
+func (client *CryptClient) GetHealth(req HealthReq) (health Health, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetHealth"), req, &health)
+	})
+	return
+}
+
 // Create a new key record.
 func (client *CryptClient) CreateKey(req CreateKeyReq) (resp CreateKeyResp, err error) {
 	err = client.DoRPC(func(rpcClient *rpc.Client) error {
@@ -159,6 +221,14 @@ func (client *CryptClient) ManualRetrieveKey(req ManualRetrieveKeyReq) (resp Man
 	return
 }
 
+// Retrieve encryption keys on authority of an administrator, evicting the stalest computer from records that are full.
+func (client *CryptClient) ForceRetrieveKey(req ForceRetrieveKeyReq) (resp ForceRetrieveKeyResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ForceRetrieveKey"), req, &resp)
+	})
+	return
+}
+
 /*
 Submit a report that says the requester is still alive and holding the encryption keys. Return UUID of keys that are
 rejected - which means they previously lost contact with this host and no longer consider it eligible to hold the keys.
@@ -178,6 +248,62 @@ func (client *CryptClient) EraseKey(req EraseKeyReq) error {
 	})
 }
 
+// CheckEraseKey asks whether EraseKey would erase the record, and who owns it, without erasing it.
+func (client *CryptClient) CheckEraseKey(req EraseKeyReq) (resp EraseKeyCheckResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "CheckEraseKey"), req, &resp)
+	})
+	return
+}
+
+// ForgetKey tells server to destroy the encryption key of a record and keep the record itself.
+func (client *CryptClient) ForgetKey(req EraseKeyReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ForgetKey"), req, &dummy)
+	})
+}
+
+// ReportKeySlotRemoved tells server that the key slot of a disk has been removed, the server only writes it down.
+func (client *CryptClient) ReportKeySlotRemoved(req KeySlotRemovedReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReportKeySlotRemoved"), req, &dummy)
+	})
+}
+
+// ReportAutoEncryption tells server that this computer has encrypted the blank disk of a record on its own.
+func (client *CryptClient) ReportAutoEncryption(req ReportAutoEncryptionReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReportAutoEncryption"), req, &dummy)
+	})
+}
+
+// UpdateKey replaces the encryption key of an existing record.
+func (client *CryptClient) UpdateKey(req UpdateKeyReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "UpdateKey"), req, &dummy)
+	})
+}
+
+// StartKeyRotation makes the server replace the encryption key of a record by a key it generates.
+func (client *CryptClient) StartKeyRotation(req StartKeyRotationReq) (resp StartKeyRotationResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "StartKeyRotation"), req, &resp)
+	})
+	return
+}
+
+// ConfirmKeyRotation tells the server that the rotation of a record's key has been carried out.
+func (client *CryptClient) ConfirmKeyRotation(req ConfirmKeyRotationReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ConfirmKeyRotation"), req, &dummy)
+	})
+}
+
 // Shut down server's listener.
 func (client *CryptClient) Shutdown(req ShutdownReq) error {
 	return client.DoRPC(func(rpcClient *rpc.Client) error {
@@ -194,6 +320,110 @@ func (client *CryptClient) ReloadRecord(req ReloadRecordReq) error {
 	})
 }
 
+// ChangePassword tells the running server to accept the new password from now on.
+func (client *CryptClient) ChangePassword(req ChangePasswordReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ChangePassword"), req, &dummy)
+	})
+}
+
+// SetMaintenance tells server to turn the maintenance mode on or off, and returns the mode now in effect.
+func (client *CryptClient) SetMaintenance(req SetMaintenanceReq) (mode keydb.MaintenanceMode, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "SetMaintenance"), req, &mode)
+	})
+	return
+}
+
+// CreateUnlockToken asks server for a new one-time unlock token of a record.
+func (client *CryptClient) CreateUnlockToken(req CreateUnlockTokenReq) (resp CreateUnlockTokenResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "CreateUnlockToken"), req, &resp)
+	})
+	return
+}
+
+// TokenRetrieveKey retrieves the key of a record by its one-time unlock token.
+func (client *CryptClient) TokenRetrieveKey(req TokenRetrieveKeyReq) (resp TokenRetrieveKeyResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "TokenRetrieveKey"), req, &resp)
+	})
+	return
+}
+
+// ImportRecords tells server to restore records from a backup.
+func (client *CryptClient) ImportRecords(req ImportRecordsReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ImportRecords"), req, &dummy)
+	})
+}
+
+// RelocateKey tells server to change where the encryption key of a record is stored.
+func (client *CryptClient) RelocateKey(req RelocateKeyReq) (resp RelocateKeyResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RelocateKey"), req, &resp)
+	})
+	return
+}
+
+// GetRecord asks server for one record as it is in memory, without its key.
+func (client *CryptClient) GetRecord(req GetRecordReq) (resp GetRecordResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetRecord"), req, &resp)
+	})
+	return
+}
+
+// UpdateRecordFields tells server to save the administrator's changes to a record.
+func (client *CryptClient) UpdateRecordFields(req UpdateRecordFieldsReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "UpdateRecordFields"), req, &dummy)
+	})
+}
+
+// ListAliveHosts asks server for the computers currently using encryption keys.
+func (client *CryptClient) ListAliveHosts(req ListAliveHostsReq) (resp ListAliveHostsResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListAliveHosts"), req, &resp)
+	})
+	return
+}
+
+// GetRecordInfo asks server for the details of key records without retrieving their keys.
+func (client *CryptClient) GetRecordInfo(req GetRecordInfoReq) (resp GetRecordInfoResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetRecordInfo"), req, &resp)
+	})
+	return
+}
+
+// ListClientDevices asks server for the records this computer is allowed to unlock.
+func (client *CryptClient) ListClientDevices(req ListClientDevicesReq) (resp ListClientDevicesResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListClientDevices"), req, &resp)
+	})
+	return
+}
+
+// ReportInventory sends the disk inventory of this computer to server.
+func (client *CryptClient) ReportInventory(req ReportInventoryReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReportInventory"), req, &dummy)
+	})
+}
+
+// ReportClientError tells server about a persistent failure experienced by this computer on an encrypted disk.
+func (client *CryptClient) ReportClientError(req ReportClientErrorReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReportClientError"), req, &dummy)
+	})
+}
+
 func (client *CryptClient) PollCommand(req PollCommandReq) (resp PollCommandResp, err error) {
 	err = client.DoRPC(func(rpcClient *rpc.Client) error {
 		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "PollCommand"), req, &resp)
@@ -208,6 +438,30 @@ func (client *CryptClient) SaveCommandResult(req SaveCommandResultReq) error {
 	})
 }
 
+// ReportCommandResult tells server whether a pending command has been carried out successfully.
+func (client *CryptClient) ReportCommandResult(req ReportCommandResultReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReportCommandResult"), req, &dummy)
+	})
+}
+
+// Create a one-time enrollment token for a new client computer, this only works via the domain socket.
+func (client *CryptClient) CreateEnrollmentToken(req CreateEnrollmentTokenReq) (resp CreateEnrollmentTokenResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "CreateEnrollmentToken"), req, &resp)
+	})
+	return
+}
+
+// Request a client certificate for this computer by the password or an enrollment token.
+func (client *CryptClient) EnrollClient(req EnrollClientReq) (resp EnrollClientResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "EnrollClient"), req, &resp)
+	})
+	return
+}
+
 // Start an RPC server in a testing configuration, return a client connected to the server and a teardown function.
 func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB)) {
 	keydbDir, err := ioutil.TempDir("", "cryptctl2-rpctest")
@@ -224,6 +478,8 @@ func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB
 	sysconf.Set(SRV_CONF_TLS_KEY, path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
 	sysconf.Set(SRV_CONF_PASS_SALT, hex.EncodeToString(salt[:]))
 	sysconf.Set(SRV_CONF_PASS_HASH, hex.EncodeToString(passHash[:]))
+	// Benchmarks call the server as fast as they can
+	sysconf.Set(SRV_CONF_CLIENT_CALLS_PER_MIN, 0)
 	// Start server
 	srvConf := CryptServiceConfig{}
 	srvConf.ReadFromSysconfig(sysconf)
@@ -3,9 +3,11 @@
 package keyserv
 
 import (
-	"fmt"
+	"bytes"
 	"cryptctl2/keydb"
 	"cryptctl2/sys"
+	"crypto/sha256"
+	"fmt"
 	"path"
 	"reflect"
 	"strconv"
@@ -36,7 +38,7 @@ func TestCreateKeyReq_Validate(t *testing.T) {
 func TestRPCCalls(t *testing.T) {
 	client, _, tearDown := StartTestServer(t)
 	defer tearDown(t)
-	if err := client.Ping(PingRequest{PlainPassword: "wrong password")); err == nil {
+	if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil {
 		t.Fatal("did not error")
 	}
 	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
@@ -153,16 +155,16 @@ func TestRPCCalls(t *testing.T) {
 
 	// Forcibly retrieve both keys and verify
 	if _, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{
-		PlainPassword:    "wrong password",
-		UUIDs:    []string{"aaa"},
-		Hostname: "localhost",
+		PlainPassword: "wrong password",
+		UUIDs:         []string{"aaa"},
+		Hostname:      "localhost",
 	}); err == nil {
 		t.Fatal("did not error")
 	}
 	manResp, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{
-		PlainPassword:    TEST_RPC_PASS,
-		UUIDs:    []string{"aaa", "bbb", "does_not_exist"},
-		Hostname: "localhost",
+		PlainPassword: TEST_RPC_PASS,
+		UUIDs:         []string{"aaa", "bbb", "does_not_exist"},
+		Hostname:      "localhost",
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -184,34 +186,54 @@ func TestRPCCalls(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 
+	// Rotate key of bbb, which is currently held by this computer
+	oldDigest := sha256.Sum256(manResp.Granted["bbb"].Key)
+	newKey := bytes.Repeat([]byte{1}, KMIPAESKeySizeBits/8)
+	if err := client.UpdateKey(UpdateKeyReq{PlainPassword: "wrong password", UUID: "bbb", OldKeyDigest: oldDigest[:], NewKey: newKey}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.UpdateKey(UpdateKeyReq{UUID: "bbb", OldKeyDigest: oldDigest[:], NewKey: newKey[:8]}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.UpdateKey(UpdateKeyReq{UUID: "bbb", OldKeyDigest: oldDigest[:], NewKey: newKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdateKey(UpdateKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "bbb", OldKeyDigest: oldDigest[:], NewKey: newKey}); err == nil {
+		t.Fatal("did not error")
+	}
+	manResp, err = client.ManualRetrieveKey(ManualRetrieveKeyReq{PlainPassword: TEST_RPC_PASS, UUIDs: []string{"bbb"}, Hostname: "localhost"})
+	if err != nil || !bytes.Equal(manResp.Granted["bbb"].Key, newKey) || manResp.Granted["bbb"].MountPoint != "/b" {
+		t.Fatal(err, manResp.Granted)
+	}
+
 	// Delete key
 	if err := client.EraseKey(EraseKeyReq{
-		PlainPassword:    "wrong password",
-		Hostname: "localhost",
-		UUID:     "aaa",
+		PlainPassword: "wrong password",
+		Hostname:      "localhost",
+		UUID:          "aaa",
 	}); err == nil {
 		t.Fatal("did not error")
 	}
 	// Erasing a non-existent key should not result in an error
 	if err := client.EraseKey(EraseKeyReq{
-		PlainPassword:    TEST_RPC_PASS,
-		Hostname: "localhost",
-		UUID:     "doesnotexist",
+		PlainPassword: TEST_RPC_PASS,
+		Hostname:      "localhost",
+		UUID:          "doesnotexist",
 	}); err != nil {
 		t.Fatal(err)
 	}
 	if err := client.EraseKey(EraseKeyReq{
-		PlainPassword:    TEST_RPC_PASS,
-		Hostname: "localhost",
-		UUID:     "aaa",
+		PlainPassword: TEST_RPC_PASS,
+		Hostname:      "localhost",
+		UUID:          "aaa",
 	}); err != nil {
 		t.Fatal(err)
 	}
 	// Erasing a non-existent key should not result in an error
 	if err := client.EraseKey(EraseKeyReq{
-		PlainPassword:    TEST_RPC_PASS,
-		Hostname: "localhost",
-		UUID:     "aaa",
+		PlainPassword: TEST_RPC_PASS,
+		Hostname:      "localhost",
+		UUID:          "aaa",
 	}); err != nil {
 		t.Fatal(err)
 	}
@@ -241,13 +263,13 @@ func TestPendingCommands(t *testing.T) {
 	}
 	// Save four pending commands - first command is still valid and unseen
 	rec, _ := server.KeyDB.GetByUUID("a-a-a-a")
-	cmd1 := keydb.PendingCommand{
-		ValidFrom: time.Now(),
+	// The command travels without the monotonic clock reading, and is given an ID when it is added.
+	cmd1, _ := rec.AddPendingCommand("127.0.0.1", keydb.PendingCommand{
+		ValidFrom: time.Now().Round(0),
 		Validity:  10 * time.Hour,
 		IP:        "127.0.0.1",
 		Content:   "1",
-	}
-	rec.AddPendingCommand("127.0.0.1", cmd1)
+	})
 	// Second command is expired
 	rec.AddPendingCommand("127.0.0.1", keydb.PendingCommand{
 		ValidFrom: time.Now().Add(-1 * time.Hour),
@@ -319,4 +341,70 @@ func TestPendingCommands(t *testing.T) {
 	if len(rec.PendingCommands["127.0.0.1"]) != 2 {
 		t.Fatal(rec.PendingCommands)
 	}
+	// Report the outcome of the command, it is told apart from other commands by the moment it was issued
+	if err := client.ReportCommandResult(ReportCommandResultReq{
+		UUID:           "a-a-a-a",
+		ValidFrom:      cmd1.ValidFrom.Add(time.Second),
+		CommandContent: "1",
+		Succeeded:      false,
+		Message:        "dummy-result",
+	}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ReportCommandResult(ReportCommandResultReq{
+		UUID:           "a-a-a-a",
+		ValidFrom:      cmd1.ValidFrom,
+		CommandContent: "1",
+		Succeeded:      false,
+		Message:        "target is busy",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = server.KeyDB.GetByUUID("a-a-a-a")
+	if cmd1 := rec.PendingCommands["127.0.0.1"][0]; cmd1.Status() != keydb.PendingCommandStatusFailed || cmd1.ClientResult != "target is busy" {
+		t.Fatal(cmd1)
+	}
+}
+
+func TestPurgeSealedAfterErase(t *testing.T) {
+	client, server, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	rec := keydb.Record{UUID: "sealed", Key: []byte{1, 2, 3}, MountPoint: "/a", SealToTPM: true, AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]keydb.AliveMessage{"127.0.0.1": {{Hostname: "localhost", IP: "127.0.0.1", Timestamp: time.Now().Unix()}}}}
+	if _, err := server.KeyDB.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EraseKey(EraseKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: "sealed"}); err != nil {
+		t.Fatal(err)
+	}
+	// The computer that used the erased record is told to remove its sealed copy, only once
+	cmds, err := client.PollCommand(PollCommandReq{UUIDs: []string{"sealed", "this-does-not-exist"}})
+	if err != nil || len(cmds.Commands) != 1 || len(cmds.Commands["sealed"]) != 1 {
+		t.Fatal(cmds, err)
+	}
+	purge := cmds.Commands["sealed"][0]
+	if purge.Content != keydb.PurgeSealedCommand || purge.ID == "" || !purge.IsValid() {
+		t.Fatalf("%+v", purge)
+	}
+	if cmds, err := client.PollCommand(PollCommandReq{UUIDs: []string{"sealed"}}); err != nil || len(cmds.Commands) != 0 {
+		t.Fatal(cmds, err)
+	}
+	// A failure keeps the command, the success removes it
+	report := ReportCommandResultReq{UUID: "sealed", CommandID: purge.ID, ValidFrom: purge.ValidFrom, CommandContent: purge.Content, Succeeded: false, Message: "read-only file system"}
+	if err := client.ReportCommandResult(report); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := server.KeyDB.SealedPurges["sealed"]["127.0.0.1"]; !found {
+		t.Fatal(server.KeyDB.SealedPurges)
+	}
+	report.Succeeded, report.Message = true, "Success"
+	if err := client.ReportCommandResult(report); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := server.KeyDB.SealedPurges["sealed"]["127.0.0.1"]; found {
+		t.Fatal(server.KeyDB.SealedPurges)
+	}
+	if err := client.ReportCommandResult(report); err == nil {
+		t.Fatal("did not error")
+	}
 }
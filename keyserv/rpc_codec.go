@@ -0,0 +1,102 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+/*
+lockingServerCodec is the gob codec of net/rpc, which holds a read lock from the moment a request has been read until
+its response is written. The server holds the write lock while it reloads its configuration, so that reloading waits
+for the RPC calls in progress without interrupting them, and idle connections do not hold up reloading.
+net/rpc writes exactly one response for each request body it reads, including the invalid requests.
+The codec also measures the time taken by each RPC call, and counts the calls that return an error, for the optional metrics.
+*/
+type lockingServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	lock   *sync.RWMutex
+	closed bool
+
+	metrics *Metrics             // metrics is nil if disabled
+	mutex   sync.Mutex           // mutex protects started
+	started map[uint64]time.Time // started is keyed by request sequence number
+}
+
+// Return an RPC server codec that speaks gob over the connection, like rpc.ServeConn does.
+func newLockingServerCodec(conn io.ReadWriteCloser, lock *sync.RWMutex, metrics *Metrics) *lockingServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &lockingServerCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		lock:    lock,
+		metrics: metrics,
+		started: make(map[uint64]time.Time),
+	}
+}
+
+func (c *lockingServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	if err == nil && c.metrics != nil {
+		c.mutex.Lock()
+		c.started[r.Seq] = time.Now()
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+func (c *lockingServerCodec) ReadRequestBody(body interface{}) error {
+	err := c.dec.Decode(body)
+	c.lock.RLock()
+	return err
+}
+
+func (c *lockingServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	defer c.lock.RUnlock()
+	if c.metrics != nil {
+		c.mutex.Lock()
+		started, found := c.started[r.Seq]
+		delete(c.started, r.Seq)
+		c.mutex.Unlock()
+		if found {
+			c.metrics.ObserveRPC(r.ServiceMethod, time.Since(started))
+		}
+		if r.Error != "" {
+			c.metrics.CountRPCError(r.ServiceMethod)
+		}
+	}
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("lockingServerCodec: gob error encoding response:", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("lockingServerCodec: gob error encoding body:", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *lockingServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -3,6 +3,7 @@
 package keyserv
 
 import (
+	"bytes"
 	"cryptctl2/fs"
 	"cryptctl2/helper"
 	"cryptctl2/keydb"
@@ -13,6 +14,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -24,6 +26,8 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -35,17 +39,22 @@ const (
 	SRV_CONF_PASS_HASH           = "AUTH_PASSWORD_HASH"
 	SRV_CONF_PASS_SALT           = "AUTH_PASSWORD_SALT"
 	SRV_CONF_TLS_CA              = "TLS_CA_PEM"
+	SRV_CONF_TLS_CRL             = "TLS_CRL_PEM"
 	SRV_CONF_TLS_CERT            = "TLS_CERT_PEM"
 	SRV_CONF_TLS_KEY             = "TLS_CERT_KEY_PEM"
 	SRV_CONF_TLS_VALIDATE_CLIENT = "TLS_VALIDATE_CLIENT"
+	SRV_CONF_TLS_ADMIN_CLIENT_CN = "TLS_ADMIN_CLIENT_CN"
 	SRV_CONF_LISTEN_ADDR         = "LISTEN_ADDRESS"
 	SRV_CONF_LISTEN_PORT         = "LISTEN_PORT"
 	SRV_CONF_KEYDB_DIR           = "KEY_DB_DIR"
+	SRV_CONF_KEYDB_VERSIONS      = "KEYDB_RECORD_VERSIONS"
+	SRV_CONF_KEYDB_ALIVE_FLUSH   = "KEYDB_ALIVE_FLUSH_INTERVAL_SEC"
 	SRV_CONF_CERT_DIR            = "CERT_DIR"
 	SRV_CONF_MAIL_CREATION_SUBJ  = "EMAIL_KEY_CREATION_SUBJECT"
 	SRV_CONF_MAIL_CREATION_TEXT  = "EMAIL_KEY_CREATION_GREETING"
 	SRV_CONF_MAIL_RETRIEVAL_SUBJ = "EMAIL_KEY_RETRIEVAL_SUBJECT"
 	SRV_CONF_MAIL_RETRIEVAL_TEXT = "EMAIL_KEY_RETRIEVAL_GREETING"
+	SRV_CONF_MAIL_DIGEST_MINUTES = "EMAIL_KEY_RETRIEVAL_DIGEST_MINUTES"
 	SRV_CONF_ALLOW_HASH_AUTH     = "ALLOW_HASH_AUTH"
 
 	SRV_CONF_KMIP_SERVER_ADDRS    = "KMIP_SERVER_ADDRESSES"
@@ -59,6 +68,35 @@ const (
 	KeyNamePrefix = "cryptctl2-" // Prefix string prepended to KMIP keys
 
 	DomainSocketFile = "/var/run/cryptctl2-domainsocket" // DomainSocketFile is the file name of unix domain socket server
+
+	ProtocolVersion = 1 // ProtocolVersion is the version of RPC protocol spoken by this server, reported in Capabilities.
+
+	// Names of optional features reported in Capabilities. A feature that is absent from the report is not supported.
+	FeatureKMIPBuiltIn          = "kmip-builtin"           // keys are stored by the built-in KMIP server
+	FeatureKMIPExternal         = "kmip-external"          // keys are stored on an external KMIP appliance
+	FeatureClientCertValidation = "client-cert-validation" // clients must present a certificate signed by the CA
+	FeatureAuditLog             = "audit-log"              // key retrievals and administrative changes are audited
+	FeatureConsistencyGroups    = "consistency-groups"     // pending commands can address a consistency group
+	FeatureDiskInventory        = "disk-inventory"         // clients may report their disk inventory
+	FeatureClientErrors         = "client-errors"          // clients may report their persistent failures
+	FeatureRecordInfo           = "record-info"            // clients may read record details without retrieving keys
+	FeatureCommandResult        = "command-result"         // clients may report success or failure of pending commands
+	FeatureKeyRotation          = "key-rotation"           // clients may replace the encryption key of a record
+	FeatureServerKeyRotation    = "server-key-rotation"    // administrators may have the server generate a new key for the clients to rotate to
+	FeatureHealth               = "health"                 // clients may check the health of server
+	FeatureRecordUpdate         = "record-update"          // administrators may read and change records via the domain socket
+	FeatureClientDevices        = "client-devices"         // clients may ask which records they are allowed to unlock
+	FeatureChangePassword       = "change-password"        // administrators may change the password without restarting the server
+	FeatureMaintenance          = "maintenance-mode"       // administrators may stop the server from handing out keys for a while
+	FeatureUnlockToken          = "unlock-token"           // clients may retrieve a key once by a token instead of the password
+	FeatureHTTPAPI              = "http-api"               // the server serves a JSON API over HTTPS for programs not written in Go
+	FeatureEnrollment           = "enrollment"             // new clients may request a client certificate by the password or an enrollment token
+	FeatureRecordOwner          = "record-owner"           // erasing the key of a disk that has an owner must be acknowledged on the owner's behalf
+	FeatureForgetKey            = "forget-key"             // the key of a record may be destroyed while the record is kept for audit
+	FeatureAutoEncryption       = "auto-encryption"        // clients may report that they have encrypted a blank disk on their own
+
+	MinRotatedKeyLen    = 16   // MinRotatedKeyLen is the minimum length in bytes of a replacement encryption key.
+	MaxCommandResultLen = 1024 // MaxCommandResultLen is the maximum length of a pending command result message, longer messages are cut short.
 )
 
 var PkgInGopath = path.Join(path.Join(os.Getenv("GOPATH"), "/src/cryptctl2")) // this package in gopath
@@ -95,26 +133,70 @@ func HashPassword(salt PasswordSalt, plainText string) HashedPassword {
 
 // Configuration for RPC server.
 type CryptServiceConfig struct {
-	PasswordHash         [sha512.Size]byte   // password hash (salted) that authenticates incoming requests
-	PasswordSalt         [LEN_PASS_SALT]byte // password hash salt
-	CertAuthorityPEM     string              // path to PEM-encoded CA certificate
-	ValidateClientCert   bool                // whether the server will authenticate its client before accepting RPC request
-	CertPEM              string              // path to PEM-encoded TLS certificate
-	KeyPEM               string              // path to PEM-encoded TLS certificate key
-	Address              string              // address of the network interface to listen on
-	Port                 int                 // port to listen on
-	KeyDBDir             string              // key database directory
-	KeyCreationSubject   string              // subject of the notification email sent by key creation request
-	KeyCreationGreeting  string              // greeting of the notification email sent by key creation request
-	KeyRetrievalSubject  string              // subject of the notification email sent by key retrieval request
-	KeyRetrievalGreeting string              // greeting of the notification email sent by key retrieval request
-	KMIPAddresses        []string            // optional KMIP server addresses (server1:port1 server2:port2 ...)
-	KMIPUser             string              // optional KMIP service access user
-	KMIPPass             string              // optional KMIP service access password
-	KMIPCertAuthorityPEM string              // optional KMIP server CA certificate
-	KMIPTLSDoVerify      bool                // Enable verification on KMIP server's TLS certificate
-	KMIPCertPEM          string              // optional KMIP client certificate
-	KMIPKeyPEM           string              // optional KMIP client certificate key
+	PasswordHash              [sha512.Size]byte   // password hash (salted) that authenticates incoming requests
+	PasswordSalt              [LEN_PASS_SALT]byte // password hash salt
+	PasswordKDF               PasswordKDF         // key derivation function of the password hash
+	CertAuthorityPEM          string              // path to PEM-encoded CA certificate
+	CertRevocationListPEM     string              // optional path to PEM-encoded revocation list of client certificates issued by the CA
+	ValidateClientCert        bool                // whether the server will authenticate its client before accepting RPC request
+	AdminClientCNs            []string            // common names of client certificates that may force key retrieval without password
+	CertPEM                   string              // path to PEM-encoded TLS certificate
+	KeyPEM                    string              // path to PEM-encoded TLS certificate key
+	Address                   string              // address of the network interface to listen on
+	Port                      int                 // port to listen on
+	KeyDBDir                  string              // key database directory
+	KeyDBVersionsKept         int                 // number of previous versions kept of each key record, 0 to keep none
+	KeyDBAliveFlushSec        int                 // alive messages are written to the key database this often, 0 to write them upon each report
+	KeyCreationSubject        string              // subject of the notification email sent by key creation request
+	KeyCreationGreeting       string              // greeting of the notification email sent by key creation request
+	KeyRetrievalSubject       string              // subject of the notification email sent by key retrieval request
+	KeyRetrievalGreeting      string              // greeting of the notification email sent by key retrieval request
+	KeyRetrievalDigestMinutes int                 // minutes over which key retrievals are notified in a single email, 0 to notify each
+	KMIPAddresses             []string            // optional KMIP server addresses (server1:port1 server2:port2 ...)
+	KMIPUser                  string              // optional KMIP service access user
+	KMIPPass                  string              // optional KMIP service access password
+	KMIPCertAuthorityPEM      string              // optional KMIP server CA certificate
+	KMIPTLSDoVerify           bool                // Enable verification on KMIP server's TLS certificate
+	KMIPCertPEM               string              // optional KMIP client certificate
+	KMIPKeyPEM                string              // optional KMIP client certificate key
+	AuditLogPath              string              // optional location of audit log file, empty to disable audit log
+	InventoryEnable           bool                // whether clients may report their disk inventory
+	InventoryDir              string              // directory of disk inventory reports
+	InventoryRetention        int                 // number of days a disk inventory report is kept
+	ClientErrorMail           bool                // whether to send notification email when a new class of client error appears on a record
+	ClientErrorSubject        string              // subject of the notification email sent by a new class of client error
+	LostHostMail              bool                // whether to send notification email when a computer stops sending alive messages
+	LostHostSubject           string              // subject of the notification email sent by lost computers
+	LostHostDebounceMinutes   int                 // minimum number of minutes between two notifications of the same lost computer
+	AuthMaxFailures           int                 // number of consecutive incorrect passwords that locks out an IP, 0 to never lock out
+	AuthLockoutMinutes        int                 // number of minutes of the first lockout, each further lockout lasts twice as long
+	LockoutSubject            string              // subject of the notification email sent by a lockout
+	ClientCallsPerMinute      int                 // number of AutoRetrieveKey and ReportAlive calls admitted from a client per minute, 0 for unlimited
+	LostHostUmount            bool                // whether to issue an umount command to a lost computer for when it comes back
+	LostHostUmountHours       int                 // number of hours the umount command issued to a lost computer is valid
+	MetricsAddress            string              // address of the metrics HTTP listener, empty to disable metrics
+	MetricsPort               int                 // port of the metrics HTTP listener
+	MetricsPerUUID            bool                // whether metrics may carry record UUID labels
+	MetricsTLS                bool                // whether metrics are served over HTTPS with the server certificate
+	HTTPAPIAddress            string              // address of the JSON API HTTPS listener, empty to disable the API
+	HTTPAPIPort               int                 // port of the JSON API HTTPS listener
+	RejectionsPersist         bool                // whether a rejected key retrieval is written to the record file right away
+	RetrievalHistorySize      int                 // number of most recent key retrievals kept on each record, 0 to keep none
+	KeyDBMasterKeySource      string              // optional source of key database master key: passphrase, file, or kmip
+	KeyDBMasterKeyFile        string              // file that carries key database master key
+	KeyDBMasterKeyKMIPID      string              // KMIP object ID of key database master key
+	KeyDBMasterKeySalt        []byte              // salt that derives key database master key from passphrase
+	KeyDBMasterKeyDigest      string              // digest that identifies the correct key database master key
+	KeyDBMasterKey            []byte              // key database master key, it is not read from sysconfig but obtained by LoadKeyDBMasterKey
+	BackupDir                 string              // optional directory of scheduled key database backups, empty to disable
+	BackupIntervalHours       int                 // number of hours between two scheduled backups
+	BackupKeep                int                 // number of scheduled backups to keep
+	BackupPublicKeyPEM        string              // PEM-encoded RSA public key or certificate that encrypts scheduled backups
+	BackupMailOnFailure       bool                // whether to send notification email when a scheduled backup fails
+	SocketGroup               string              // optional group (name or ID) whose members may call administrative functions via the domain socket
+	CertExpiryWarnDays        int                 // number of days before expiry of TLS certificate a warning is logged, 0 to never warn
+	TLSMinVersion             string              // oldest TLS version accepted from clients ("1.0" to "1.3"), empty for DefaultTLSMinVersion
+	TLSCipherSuites           []string            // names of cipher suites accepted from clients, empty for the defaults of Go TLS library
 }
 
 // Preliminarily validate configuration and report error.
@@ -123,18 +205,98 @@ func (conf *CryptServiceConfig) Validate() error {
 		return fmt.Errorf("Validate: TLS certificate file - %v", err)
 	} else if err := fs.FileContains(conf.KeyPEM, "KEY"); err != nil {
 		return fmt.Errorf("Validate: TLS certificate key file - %v", err)
-	} else if conf.Address == "" {
+	}
+	return conf.ValidateWithoutCert()
+}
+
+// ValidateWithoutCert validates all of the configuration but the TLS certificate and key files, e.g. before they are generated.
+func (conf *CryptServiceConfig) ValidateWithoutCert() error {
+	if conf.Address == "" {
 		return errors.New("Validate: network address to listen on is empty")
 	} else if conf.Port == 0 {
 		return errors.New("Validate: network port to listen on is not specified")
+	} else if conf.HTTPAPIAddress != "" && (conf.HTTPAPIPort == 0 || conf.HTTPAPIPort == conf.Port) {
+		return fmt.Errorf("Validate: JSON API (%s) needs a port of its own", SRV_CONF_HTTP_API_PORT)
+	} else if conf.MetricsAddress != "" && (conf.MetricsPort == 0 || conf.MetricsPort == conf.Port ||
+		(conf.HTTPAPIAddress != "" && conf.MetricsPort == conf.HTTPAPIPort)) {
+		return fmt.Errorf("Validate: metrics (%s) need a port of their own", SRV_CONF_METRICS_PORT)
 	} else if !strings.HasPrefix(conf.KeyDBDir, "/") {
 		return fmt.Errorf("Validate: key database directory \"%s\" should be an absolute path", conf.KeyDBDir)
+	} else if conf.KeyDBVersionsKept < 0 {
+		return fmt.Errorf("Validate: number of record versions to keep (%s) must not be negative", SRV_CONF_KEYDB_VERSIONS)
+	} else if conf.KeyDBAliveFlushSec < 0 {
+		return fmt.Errorf("Validate: alive message flush interval (%s) must not be negative", SRV_CONF_KEYDB_ALIVE_FLUSH)
+	} else if conf.CertExpiryWarnDays < 0 {
+		return fmt.Errorf("Validate: TLS certificate expiry warning (%s) must not be negative", SRV_CONF_TLS_CERT_WARN_DAYS)
+	}
+	if _, err := ParseTLSVersion(conf.TLSMinVersion); err != nil {
+		return fmt.Errorf("Validate: minimum TLS version (%s) - %v", SRV_CONF_TLS_MIN_VERSION, err)
+	} else if _, err := ParseCipherSuites(conf.TLSCipherSuites); err != nil {
+		return fmt.Errorf("Validate: TLS cipher suites (%s) - %v", SRV_CONF_TLS_CIPHER_SUITES, err)
+	}
+	if len(conf.AdminClientCNs) > 0 && !conf.ValidateClientCert {
+		return fmt.Errorf("Validate: administrator client certificates (%s) require client certificate validation (%s)",
+			SRV_CONF_TLS_ADMIN_CLIENT_CN, SRV_CONF_TLS_VALIDATE_CLIENT)
+	}
+	if err := conf.validateKeyDBEncryption(); err != nil {
+		return err
+	}
+	if conf.LostHostDebounceMinutes < 0 {
+		return fmt.Errorf("Validate: lost computer notification debounce (%s) must not be negative", SRV_CONF_MAIL_LOST_HOST_DEBOUNCE)
+	} else if conf.LostHostUmount && conf.LostHostUmountHours < 1 {
+		return fmt.Errorf("Validate: umount command of lost computer (%s) must be valid for at least an hour", SRV_CONF_LOST_HOST_UMOUNT_HOURS)
+	}
+	if conf.AuthMaxFailures < 0 || conf.AuthMaxFailures > 0 && conf.AuthLockoutMinutes < 1 {
+		return fmt.Errorf("Validate: password lockout (%s) must not be negative, and last for at least a minute (%s)", SRV_CONF_AUTH_MAX_FAILURES, SRV_CONF_AUTH_LOCKOUT_MINUTES)
+	} else if conf.ClientCallsPerMinute < 0 {
+		return fmt.Errorf("Validate: client call limit (%s) must not be negative", SRV_CONF_CLIENT_CALLS_PER_MIN)
+	}
+	if conf.KeyRetrievalDigestMinutes < 0 {
+		return fmt.Errorf("Validate: key retrieval digest window (%s) must not be negative", SRV_CONF_MAIL_DIGEST_MINUTES)
+	} else if conf.RetrievalHistorySize < 0 {
+		return fmt.Errorf("Validate: key retrieval history size (%s) must not be negative", SRV_CONF_RETRIEVAL_HISTORY_SIZE)
+	}
+	// A bad template is reported upon start rather than by the first notification
+	for name, text := range map[string]string{
+		SRV_CONF_MAIL_CREATION_SUBJ:     conf.KeyCreationSubject,
+		SRV_CONF_MAIL_CREATION_TEXT:     conf.KeyCreationGreeting,
+		SRV_CONF_MAIL_RETRIEVAL_SUBJ:    conf.KeyRetrievalSubject,
+		SRV_CONF_MAIL_RETRIEVAL_TEXT:    conf.KeyRetrievalGreeting,
+		SRV_CONF_MAIL_CLIENT_ERROR_SUBJ: conf.ClientErrorSubject,
+		SRV_CONF_MAIL_LOST_HOST_SUBJ:    conf.LostHostSubject,
+		SRV_CONF_MAIL_LOCKOUT_SUBJ:      conf.LockoutSubject,
+	} {
+		if err := ValidateMailTemplate(name, text); err != nil {
+			return fmt.Errorf("Validate: email template %v", err)
+		}
+	}
+	if conf.BackupDir != "" {
+		if !strings.HasPrefix(conf.BackupDir, "/") {
+			return fmt.Errorf("Validate: backup directory \"%s\" should be an absolute path", conf.BackupDir)
+		} else if conf.BackupPublicKeyPEM == "" {
+			return fmt.Errorf("Validate: scheduled backups require a public key (%s)", SRV_CONF_BACKUP_PUBLIC_KEY)
+		} else if conf.BackupIntervalHours < 1 {
+			return errors.New("Validate: backup interval must be at least an hour")
+		} else if conf.BackupKeep < 1 {
+			return errors.New("Validate: at least one backup must be kept")
+		}
+	}
+	if _, err := LookupSocketGroup(conf.SocketGroup); err != nil {
+		return fmt.Errorf("Validate: domain socket group (%s) - %v", SRV_CONF_SOCKET_GROUP, err)
 	}
 	return nil
 }
 
-// Read key server configuration from a sysconfig file.
+// Read key server configuration from a sysconfig file and validate it.
 func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error {
+	if err := conf.LoadFromSysconfig(sysconf); err != nil {
+		return err
+	}
+	return conf.Validate()
+}
+
+// LoadFromSysconfig reads key server configuration from a sysconfig file without validating it.
+func (conf *CryptServiceConfig) LoadFromSysconfig(sysconf *sys.Sysconfig) error {
 	passwordHash, err := hex.DecodeString(sysconf.GetString(SRV_CONF_PASS_HASH, ""))
 	if err != nil {
 		return fmt.Errorf("NewCryptService: malformed value in key %s", SRV_CONF_PASS_HASH)
@@ -145,20 +307,32 @@ func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error
 	}
 	copy(conf.PasswordHash[:], passwordHash)
 	copy(conf.PasswordSalt[:], passwordSalt)
+	if conf.PasswordKDF, err = ParsePasswordKDF(sysconf.GetString(SRV_CONF_PASS_KDF, "")); err != nil {
+		return fmt.Errorf("NewCryptService: malformed value in key %s - %v", SRV_CONF_PASS_KDF, err)
+	}
 
 	conf.CertAuthorityPEM = sysconf.GetString(SRV_CONF_TLS_CA, "")
+	conf.CertRevocationListPEM = sysconf.GetString(SRV_CONF_TLS_CRL, "")
 	conf.ValidateClientCert = sysconf.GetBool(SRV_CONF_TLS_VALIDATE_CLIENT, false)
+	conf.AdminClientCNs = sysconf.GetStringArray(SRV_CONF_TLS_ADMIN_CLIENT_CN, []string{})
 	conf.CertPEM = sysconf.GetString(SRV_CONF_TLS_CERT, "")
 	conf.KeyPEM = sysconf.GetString(SRV_CONF_TLS_KEY, "")
-	conf.Address = sysconf.GetString(SRV_CONF_LISTEN_ADDR, "0.0.0.0")
+	conf.CertExpiryWarnDays = sysconf.GetInt(SRV_CONF_TLS_CERT_WARN_DAYS, DefaultCertExpiryWarnDays)
+	conf.TLSMinVersion = sysconf.GetString(SRV_CONF_TLS_MIN_VERSION, DefaultTLSMinVersion)
+	conf.TLSCipherSuites = sysconf.GetStringArray(SRV_CONF_TLS_CIPHER_SUITES, []string{})
+	// An IPv6 listen address may be written in brackets, e.g. "[::]"
+	conf.Address = keydb.CanonicalHost(sysconf.GetString(SRV_CONF_LISTEN_ADDR, "0.0.0.0"))
 	conf.Port = sysconf.GetInt(SRV_CONF_LISTEN_PORT, SRV_DEFAULT_PORT)
 
 	conf.KeyDBDir = sysconf.GetString(SRV_CONF_KEYDB_DIR, "/var/lib/cryptctl2/keydb")
+	conf.KeyDBVersionsKept = sysconf.GetInt(SRV_CONF_KEYDB_VERSIONS, keydb.DefaultRecordVersionsKept)
+	conf.KeyDBAliveFlushSec = sysconf.GetInt(SRV_CONF_KEYDB_ALIVE_FLUSH, int(keydb.DefaultAliveFlushInterval/time.Second))
 
 	conf.KeyCreationSubject = sysconf.GetString(SRV_CONF_MAIL_CREATION_SUBJ, "A new file system has been encrypted")
 	conf.KeyCreationGreeting = sysconf.GetString(SRV_CONF_MAIL_CREATION_TEXT, "The key server now has encryption key for the following file system:")
 	conf.KeyRetrievalSubject = sysconf.GetString(SRV_CONF_MAIL_RETRIEVAL_SUBJ, "An encrypted file system has been accessed")
 	conf.KeyRetrievalGreeting = sysconf.GetString(SRV_CONF_MAIL_RETRIEVAL_TEXT, "The key server has sent the following encryption key to allow access to its file systems:")
+	conf.KeyRetrievalDigestMinutes = sysconf.GetInt(SRV_CONF_MAIL_DIGEST_MINUTES, 0)
 
 	conf.KMIPAddresses = sysconf.GetStringArray(SRV_CONF_KMIP_SERVER_ADDRS, []string{})
 	conf.KMIPUser = sysconf.GetString(SRV_CONF_KMIP_SERVER_USER, "")
@@ -167,20 +341,86 @@ func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error
 	conf.KMIPTLSDoVerify = sysconf.GetBool(SRV_CONF_KMIP_TLS_DO_VERIFY, true)
 	conf.KMIPCertPEM = sysconf.GetString(SRV_CONF_KMIP_SERVER_TLS_CERT, "")
 	conf.KMIPKeyPEM = sysconf.GetString(SRV_CONF_KMIP_SERVER_TLS_KEY, "")
-	return conf.Validate()
+
+	conf.AuditLogPath = sysconf.GetString(SRV_CONF_AUDIT_LOG, DefaultAuditLogPath)
+
+	conf.InventoryEnable = sysconf.GetBool(SRV_CONF_INVENTORY_ENABLE, false)
+	conf.InventoryDir = sysconf.GetString(SRV_CONF_INVENTORY_DIR, DefaultInventoryDir)
+	conf.InventoryRetention = sysconf.GetInt(SRV_CONF_INVENTORY_RETENTION, DefaultInventoryRetentionDays)
+
+	conf.ClientErrorMail = sysconf.GetBool(SRV_CONF_MAIL_CLIENT_ERROR, false)
+	conf.ClientErrorSubject = sysconf.GetString(SRV_CONF_MAIL_CLIENT_ERROR_SUBJ, "A computer has failed to use an encrypted file system")
+
+	conf.LostHostMail = sysconf.GetBool(SRV_CONF_MAIL_LOST_HOST, false)
+	conf.LostHostSubject = sysconf.GetString(SRV_CONF_MAIL_LOST_HOST_SUBJ, "A computer has stopped reporting while holding an encryption key")
+	conf.LostHostDebounceMinutes = sysconf.GetInt(SRV_CONF_MAIL_LOST_HOST_DEBOUNCE, DefaultLostHostDebounceMinutes)
+	conf.LostHostUmount = sysconf.GetBool(SRV_CONF_LOST_HOST_UMOUNT, false)
+	conf.LostHostUmountHours = sysconf.GetInt(SRV_CONF_LOST_HOST_UMOUNT_HOURS, DefaultLostHostUmountHours)
+
+	conf.AuthMaxFailures = sysconf.GetInt(SRV_CONF_AUTH_MAX_FAILURES, DefaultAuthMaxFailures)
+	conf.AuthLockoutMinutes = sysconf.GetInt(SRV_CONF_AUTH_LOCKOUT_MINUTES, DefaultAuthLockoutMinutes)
+	conf.LockoutSubject = sysconf.GetString(SRV_CONF_MAIL_LOCKOUT_SUBJ, "A computer is locked out after too many incorrect passwords")
+	conf.ClientCallsPerMinute = sysconf.GetInt(SRV_CONF_CLIENT_CALLS_PER_MIN, DefaultClientCallsPerMin)
+
+	conf.MetricsAddress = keydb.CanonicalHost(sysconf.GetString(SRV_CONF_METRICS_ADDRESS, ""))
+	conf.MetricsPort = sysconf.GetInt(SRV_CONF_METRICS_PORT, DefaultMetricsPort)
+	conf.MetricsPerUUID = sysconf.GetBool(SRV_CONF_METRICS_PER_UUID, false)
+	conf.MetricsTLS = sysconf.GetBool(SRV_CONF_METRICS_TLS, false)
+	conf.HTTPAPIAddress = keydb.CanonicalHost(sysconf.GetString(SRV_CONF_HTTP_API_ADDRESS, ""))
+	conf.HTTPAPIPort = sysconf.GetInt(SRV_CONF_HTTP_API_PORT, DefaultHTTPAPIPort)
+	conf.RejectionsPersist = sysconf.GetBool(SRV_CONF_REJECTIONS_PERSIST, true)
+	conf.RetrievalHistorySize = sysconf.GetInt(SRV_CONF_RETRIEVAL_HISTORY_SIZE, keydb.DefaultMaxRetrievalsPerRecord)
+
+	conf.KeyDBMasterKeySource = sysconf.GetString(SRV_CONF_KEYDB_MASTER_KEY_SOURCE, "")
+	conf.KeyDBMasterKeyFile = sysconf.GetString(SRV_CONF_KEYDB_MASTER_KEY_FILE, "/etc/cryptctl2/keydb-master.key")
+	conf.KeyDBMasterKeyKMIPID = sysconf.GetString(SRV_CONF_KEYDB_MASTER_KEY_KMIP_ID, "")
+	if conf.KeyDBMasterKeySalt, err = hex.DecodeString(sysconf.GetString(SRV_CONF_KEYDB_MASTER_KEY_SALT, "")); err != nil {
+		return fmt.Errorf("NewCryptService: malformed value in key %s", SRV_CONF_KEYDB_MASTER_KEY_SALT)
+	}
+	conf.KeyDBMasterKeyDigest = sysconf.GetString(SRV_CONF_KEYDB_MASTER_KEY_DIGEST, "")
+
+	conf.BackupDir = sysconf.GetString(SRV_CONF_BACKUP_DIR, "")
+	conf.BackupIntervalHours = sysconf.GetInt(SRV_CONF_BACKUP_INTERVAL_HOURS, DefaultBackupIntervalHours)
+	conf.BackupKeep = sysconf.GetInt(SRV_CONF_BACKUP_KEEP, DefaultBackupKeep)
+	conf.BackupPublicKeyPEM = sysconf.GetString(SRV_CONF_BACKUP_PUBLIC_KEY, "")
+	conf.BackupMailOnFailure = sysconf.GetBool(SRV_CONF_BACKUP_MAIL_ON_FAILURE, false)
+	conf.SocketGroup = sysconf.GetString(SRV_CONF_SOCKET_GROUP, "")
+	return nil
 }
 
 // RPC and KMIP server for accessing encryption keys.
 type CryptServer struct {
-	Config            CryptServiceConfig // service configuration
-	Mailer            *Mailer            // mail notification sender
-	KeyDB             *keydb.DB          // encryption key database
-	TLSConfig         *tls.Config        // TLS certificate chain and private key
-	TCPListener       net.Listener       // TCPListener is the TCP server that serves all RPC functions
-	UnixListener      net.Listener       // UnixListener is the Unix domain socket that serves all RPC functions
-	BuiltInKMIPServer *KMIPServer        // Built-in KMIP server in case there's no external server
-	KMIPClient        *KMIPClient        // KMIP client connected to either built-in KMIP server or external server
-	AdminChallenge    []byte             // a random secret that must be verified for incoming shutdown/reload requests
+	Config            CryptServiceConfig   // service configuration
+	Mailer            *Mailer              // mail notification sender
+	KeyDB             *keydb.DB            // encryption key database
+	TLSConfig         *tls.Config          // TLS certificate chain and private key
+	Certs             *CertReloader        // hands out the TLS certificate chain to handshakes and picks up its renewal
+	RevokedCerts      *CRLReloader         // turns away revoked client certificates and picks up new revocations, nil without a revocation list
+	TCPListener       net.Listener         // TCPListener is the TCP server that serves all RPC functions
+	UnixListener      net.Listener         // UnixListener is the Unix domain socket that serves all RPC functions
+	BuiltInKMIPServer *KMIPServer          // Built-in KMIP server in case there's no external server
+	KMIPClient        *KMIPClient          // KMIP client connected to either built-in KMIP server or external server
+	AdminChallenge    []byte               // a random secret that must be verified for incoming shutdown/reload requests
+	Audit             *AuditLog            // audit log of key retrievals and administrative changes, nil if disabled
+	Inventory         *InventoryStore      // disk inventory reports of client computers, nil if disabled
+	ClientErrorLimit  *RateLimiter         // limits the rate of client error reports from each client
+	ClientCallLimit   *RateLimiter         // limits the rate of AutoRetrieveKey and ReportAlive calls from each client, nil for unlimited
+	PasswordLockout   *PasswordLockout     // refuses the password of an IP after too many incorrect ones, nil to never lock out
+	Metrics           *Metrics             // counters and histograms served over HTTP, nil if disabled
+	Backups           *BackupScheduler     // scheduled key database backups, nil if disabled
+	RetrievalDigest   *RetrievalDigest     // key retrievals collected for the next digest email, nil if each retrieval is notified
+	LostHosts         *LostHostMonitor     // looks for computers that stopped sending alive messages, nil if not started
+	UnlockWindows     *UnlockWindowMonitor // tells computers to umount disks whose unlock window has ended, nil if not started
+	HTTPAPI           *HTTPAPI             // JSON API served over HTTPS, nil if disabled
+	StartTime         time.Time            // the moment the server was initialised
+	// SavePassword saves the upgraded password hash into configuration file, see ValidatePlainPassword. Nil to never upgrade.
+	SavePassword func(salt PasswordSalt, hash HashedPassword, kdf PasswordKDF) error
+	// IssueClientCert signs a new client certificate for the DNS name and IP (may be empty) by the server's CA, see EnrollClient. Nil to never enroll.
+	IssueClientCert func(dnsName, ipAddress string) (certPEM, keyPEM, caPEM []byte, err error)
+
+	configLock   sync.RWMutex   // held for reading by each RPC call, and for writing while the configuration is reloaded
+	passwordLock sync.RWMutex   // protects the password parameters of Config, which are replaced while RPC calls are served
+	connections  sync.WaitGroup // connections that are being served
 }
 
 // Initialise an RPC server from sysconfig file text.
@@ -189,19 +429,51 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 		return nil, err
 	}
 	srv = &CryptServer{
-		Config:    config,
-		Mailer:    &mailer,
-		TLSConfig: new(tls.Config),
+		Config:           config,
+		Mailer:           &mailer,
+		TLSConfig:        new(tls.Config),
+		ClientErrorLimit: NewRateLimiter(ClientErrorRateLimit, ClientErrorRatePeriodSec*time.Second),
+		StartTime:        time.Now(),
 	}
-	srv.KeyDB, err = keydb.OpenDB(config.KeyDBDir)
+	if config.AuthMaxFailures > 0 {
+		srv.PasswordLockout = NewPasswordLockout(config.AuthMaxFailures, time.Duration(config.AuthLockoutMinutes)*time.Minute)
+	}
+	if config.ClientCallsPerMinute > 0 {
+		srv.ClientCallLimit = NewRateLimiter(config.ClientCallsPerMinute, time.Minute)
+	}
+	if config.KeyDBMasterKeySource != "" && config.KeyDBMasterKey == nil {
+		return nil, fmt.Errorf("NewCryptServer: key database master key from %s has not been loaded", config.KeyDBMasterKeySource)
+	}
+	// Encrypted records fail to load without the master key, hence the server refuses to start.
+	srv.KeyDB, err = keydb.OpenDBWithMasterKey(config.KeyDBDir, config.KeyDBMasterKey)
 	if err != nil {
 		return nil, err
 	}
-	/*
-	 The author of TLS related libraries in Go has an opinion about CRL
-	*/
-	srv.TLSConfig.Certificates = make([]tls.Certificate, 1)
-	srv.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(config.CertPEM, config.KeyPEM)
+	srv.KeyDB.VersionsKept = config.KeyDBVersionsKept
+	srv.KeyDB.StartAliveFlush(time.Duration(config.KeyDBAliveFlushSec) * time.Second)
+	if srv.Audit, err = NewAuditLog(config.AuditLogPath); err != nil {
+		return nil, err
+	}
+	if config.InventoryEnable {
+		retention := time.Duration(config.InventoryRetention) * 24 * time.Hour
+		if srv.Inventory, err = NewInventoryStore(config.InventoryDir, retention); err != nil {
+			return nil, err
+		}
+	}
+	if config.MetricsAddress != "" {
+		srv.Metrics = NewMetrics(srv.KeyDB, config.MetricsPerUUID)
+	}
+	if config.HTTPAPIAddress != "" {
+		srv.HTTPAPI = NewHTTPAPI(srv)
+	}
+	// The certificate is read again once its files are modified, so that a renewal does not require a restart
+	if srv.Certs, err = NewCertReloader(config.CertPEM, config.KeyPEM, config.CertExpiryWarnDays); err != nil {
+		return nil, err
+	}
+	srv.TLSConfig.GetCertificate = srv.Certs.GetCertificate
+	// Both have been validated along with the configuration
+	srv.TLSConfig.MinVersion, _ = ParseTLSVersion(config.TLSMinVersion)
+	srv.TLSConfig.CipherSuites, _ = ParseCipherSuites(config.TLSCipherSuites)
 	// Configure client authentication upon request
 	if config.ValidateClientCert {
 		log.Printf("NewCryptServer: server will validate client certificates.")
@@ -213,8 +485,17 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 		caPool.AppendCertsFromPEM(caPEM)
 		srv.TLSConfig.ClientCAs = caPool
 		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		// Go TLS library does not consult revocation lists by itself
+		if config.CertRevocationListPEM != "" {
+			if srv.RevokedCerts, err = NewCRLReloader(config.CertRevocationListPEM, config.CertAuthorityPEM); err != nil {
+				return nil, err
+			}
+			srv.TLSConfig.VerifyPeerCertificate = srv.RevokedCerts.VerifyPeerCertificate
+		}
+	} else {
+		log.Printf("<4>NewCryptServer: WARNING - server does not validate client certificates (%s), client computers are only told apart by IP, and the host names they report are taken at their word.",
+			SRV_CONF_TLS_VALIDATE_CLIENT)
 	}
-	srv.TLSConfig.BuildNameToCertificate()
 	// Admin challenge is an array of random bytes
 	srv.AdminChallenge = make([]byte, LenAdminChallenge)
 	if _, err = rand.Read(srv.AdminChallenge); err != nil {
@@ -223,6 +504,32 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 	return
 }
 
+/*
+NewExternalKMIPClient initialises a client of the external KMIP servers in the configuration. The servers are tried in
+the order of configuration. The function does not immediately establish a connection to server.
+*/
+func NewExternalKMIPClient(conf CryptServiceConfig) (*KMIPClient, error) {
+	if len(conf.KMIPAddresses) == 0 {
+		return nil, errors.New("NewExternalKMIPClient: KMIP server addresses are not configured")
+	}
+	var caCert []byte
+	if conf.KMIPCertAuthorityPEM != "" {
+		var err error
+		if caCert, err = ioutil.ReadFile(conf.KMIPCertAuthorityPEM); err != nil {
+			return nil, fmt.Errorf("NewExternalKMIPClient: failed to read KMIP CA certificate - %v", err)
+		}
+	}
+	client, err := NewKMIPClient(conf.KMIPAddresses, conf.KMIPUser, conf.KMIPPass, caCert, conf.KMIPCertPEM, conf.KMIPKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !conf.KMIPTLSDoVerify {
+		log.Printf("NewExternalKMIPClient: KMIP client will not verify KMIP server's identity, as instructed by configuration.")
+		client.TLSConfig.InsecureSkipVerify = true
+	}
+	return client, nil
+}
+
 /*
 Start RPC server. If the RPC server does not have KMIP connectivity settings, start an incomplete implementation
 of KMIP server.
@@ -249,29 +556,15 @@ func (srv *CryptServer) ListenTCP() error {
 		srv.KMIPClient.TLSConfig.InsecureSkipVerify = true
 	} else {
 		// No need to start built-in KMIP server, so only initialise the client.
-		var caCert []byte
-		if srv.Config.KMIPCertAuthorityPEM != "" {
-			caCert, err = ioutil.ReadFile(srv.Config.KMIPCertAuthorityPEM)
-			if err != nil {
-				return err
-			}
-		}
-		if srv.KMIPClient, err = NewKMIPClient(
-			srv.Config.KMIPAddresses,
-			srv.Config.KMIPUser, srv.Config.KMIPPass,
-			caCert, srv.Config.KMIPCertPEM, srv.Config.KMIPKeyPEM); err != nil {
+		if srv.KMIPClient, err = NewExternalKMIPClient(srv.Config); err != nil {
 			return err
 		}
-		if !srv.Config.KMIPTLSDoVerify {
-			log.Printf("CryptServer.ListenTCP: KMIP client will not verify KMIP server's identity, as instructed by configuration.")
-			srv.KMIPClient.TLSConfig.InsecureSkipVerify = !srv.Config.KMIPTLSDoVerify
-		}
 	}
 	// Start ordinary RPC server
-	if srv.TCPListener, err = tls.Listen("tcp", fmt.Sprintf("%s:%d", srv.Config.Address, srv.Config.Port), srv.TLSConfig); err != nil {
+	if srv.TCPListener, err = tls.Listen("tcp", net.JoinHostPort(srv.Config.Address, strconv.Itoa(srv.Config.Port)), srv.TLSConfig); err != nil {
 		return fmt.Errorf("CryptServer.ListenTCP: failed to listen on %s:%d - %v", srv.Config.Address, srv.Config.Port, err)
 	}
-	log.Printf("CryptServer.ListenTCP: listening on %s:%d using TLS certficate \"%s\"", srv.Config.Address, srv.Config.Port, srv.Config.CertPEM)
+	log.Printf("CryptServer.ListenTCP: listening with TLS certificate \"%s\" - %s", srv.Config.CertPEM, srv.Config.GetTLSSummary())
 	return nil
 }
 
@@ -280,28 +573,61 @@ func (srv *CryptServer) ListenUnix() (err error) {
 	if err = os.RemoveAll(DomainSocketFile); err != nil {
 		return
 	}
+	// The socket file is created inaccessible to others, and then opened to the domain socket group
+	oldUmask := syscall.Umask(0177)
 	srv.UnixListener, err = net.Listen("unix", DomainSocketFile)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return
+	}
+	if err = srv.secureDomainSocket(); err != nil {
+		srv.UnixListener.Close()
+		return
+	}
 	log.Printf("CryptServer.ListenUnix: listening on %s", DomainSocketFile)
 	return
 }
 
+/*
+ListenMetrics starts the HTTP listener of metrics, it does nothing if metrics are disabled. If metrics are to be served
+over TLS, the listener uses the certificate and client certificate validation settings of the RPC server.
+*/
+func (srv *CryptServer) ListenMetrics() error {
+	if srv.Metrics == nil {
+		return nil
+	}
+	var tlsConfig *tls.Config
+	if srv.Config.MetricsTLS {
+		tlsConfig = srv.TLSConfig
+	}
+	return srv.Metrics.Listen(srv.Config.MetricsAddress, srv.Config.MetricsPort, tlsConfig)
+}
+
+// ListenHTTPAPI starts the HTTPS listener of JSON API, it does nothing if the API is disabled.
+func (srv *CryptServer) ListenHTTPAPI() error {
+	if srv.HTTPAPI == nil {
+		return nil
+	}
+	return srv.HTTPAPI.Listen(srv.Config.HTTPAPIAddress, srv.Config.HTTPAPIPort, srv.TLSConfig)
+}
+
 func printConnState(conn *tls.Conn) {
-	log.Print(">>>>>>>>>>>>>>>> TCP State <<<<<<<<<<<<<<<<")
+	log.Print("<7>>>>>>>>>>>>>>>>> TCP State <<<<<<<<<<<<<<<<")
 	state := conn.ConnectionState()
-	log.Printf("Version: %x", state.Version)
-	log.Printf("DidResume: %t", state.DidResume)
-	log.Printf("CipherSuite: %x", state.CipherSuite)
-	log.Printf("NegotiatedProtocol: %s", state.NegotiatedProtocol)
-	log.Printf("NegotiatedProtocolIsMutual: %t", state.NegotiatedProtocolIsMutual)
+	log.Printf("<7>Version: %x", state.Version)
+	log.Printf("<7>DidResume: %t", state.DidResume)
+	log.Printf("<7>CipherSuite: %x", state.CipherSuite)
+	log.Printf("<7>NegotiatedProtocol: %s", state.NegotiatedProtocol)
+	log.Printf("<7>NegotiatedProtocolIsMutual: %t", state.NegotiatedProtocolIsMutual)
 
-	log.Printf("Certificate chain: %v", len(state.PeerCertificates))
+	log.Printf("<7>Certificate chain: %v", len(state.PeerCertificates))
 	for i, cert := range state.PeerCertificates {
 		subject := cert.Subject
 		issuer := cert.Issuer
-		log.Printf(" %d s:/C=%v/ST=%v/L=%v/O=%v/OU=%v/CN=%s", i, subject.Country, subject.Province, subject.Locality, subject.Organization, subject.OrganizationalUnit, subject.CommonName)
-		log.Printf("   i:/C=%v/ST=%v/L=%v/O=%v/OU=%v/CN=%s", issuer.Country, issuer.Province, issuer.Locality, issuer.Organization, issuer.OrganizationalUnit, issuer.CommonName)
+		log.Printf("<7> %d s:/C=%v/ST=%v/L=%v/O=%v/OU=%v/CN=%s", i, subject.Country, subject.Province, subject.Locality, subject.Organization, subject.OrganizationalUnit, subject.CommonName)
+		log.Printf("<7>   i:/C=%v/ST=%v/L=%v/O=%v/OU=%v/CN=%s", issuer.Country, issuer.Province, issuer.Locality, issuer.Organization, issuer.OrganizationalUnit, issuer.CommonName)
 	}
-	log.Print(">>>>>>>>>>>>>>>> State End <<<<<<<<<<<<<<<<")
+	log.Print("<7>>>>>>>>>>>>>>>>> State End <<<<<<<<<<<<<<<<")
 }
 
 /*
@@ -319,11 +645,16 @@ func (srv *CryptServer) HandleTCPConnections() {
 		tlscon, _ := incoming.(*tls.Conn)
 		err = tlscon.Handshake()
 		if err != nil {
-			log.Fatalf("Handshake error: %s", err)
+			log.Printf("<4>CryptServer.HandleTCPConnections: TLS handshake with %s failed - %v", incoming.RemoteAddr().String(), err)
+			srv.Metrics.CountTLSHandshakeFailure()
+			incoming.Close()
+			continue
 		}
 		// The connection is served by a dedicated RPC server instance
+		srv.connections.Add(1)
 		go func(conn net.Conn) {
-			log.Printf("TCP connection is arrived: %s", conn.RemoteAddr().String())
+			defer srv.connections.Done()
+			log.Printf("<7>TCP connection is arrived: %s", conn.RemoteAddr().String())
 			srv.ServeConn(conn)
 			conn.Close()
 		}(incoming)
@@ -341,8 +672,10 @@ func (srv *CryptServer) HandleUnixConnections() {
 			log.Printf("CryptServer.HandleUnixConnections: quit now - %v", err)
 			return
 		}
+		srv.connections.Add(1)
 		go func(conn net.Conn) {
-			log.Printf("Unix connection is arived: %s", conn.RemoteAddr().String())
+			defer srv.connections.Done()
+			log.Printf("<7>Unix connection is arived: %s", conn.RemoteAddr().String())
 			srv.ServeConn(conn)
 			conn.Close()
 		}(incoming)
@@ -360,6 +693,107 @@ func (srv *CryptServer) Shutdown() {
 	if kmipServer := srv.BuiltInKMIPServer; kmipServer != nil {
 		kmipServer.Shutdown()
 	}
+	srv.Backups.Stop()
+	srv.RetrievalDigest.Stop()
+	srv.LostHosts.Stop()
+	srv.UnlockWindows.Stop()
+	srv.HTTPAPI.Shutdown()
+	if err := srv.KeyDB.StopAliveFlush(); err != nil {
+		log.Printf("CryptServer.Shutdown: failed to write alive messages to key database - %v", err)
+	}
+	srv.Metrics.Shutdown()
+	srv.Audit.Close()
+}
+
+/*
+GracefulShutdown stops accepting new connections, waits up to the timeout for the connections being served to finish
+their RPC calls, and then shuts down the server. Return false if some connections were still being served when the
+timeout elapsed.
+*/
+func (srv *CryptServer) GracefulShutdown(timeout time.Duration) (finished bool) {
+	if srv.TCPListener != nil {
+		srv.TCPListener.Close()
+	}
+	if srv.UnixListener != nil {
+		srv.UnixListener.Close()
+	}
+	srv.HTTPAPI.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		srv.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		finished = true
+	case <-time.After(timeout):
+		log.Printf("CryptServer.GracefulShutdown: gave up waiting for connections after %s", timeout)
+	}
+	if kmipServer := srv.BuiltInKMIPServer; kmipServer != nil {
+		kmipServer.Shutdown()
+	}
+	srv.Backups.Stop()
+	srv.RetrievalDigest.Stop()
+	srv.LostHosts.Stop()
+	srv.UnlockWindows.Stop()
+	// Alive messages are kept in memory for a while and written without waiting for the disk, make sure they are not lost.
+	if err := srv.KeyDB.StopAliveFlush(); err != nil {
+		log.Printf("CryptServer.GracefulShutdown: failed to write alive messages to key database - %v", err)
+	}
+	srv.KeyDB.Lock.Lock()
+	syscall.Sync()
+	srv.KeyDB.Lock.Unlock()
+	srv.Metrics.Shutdown()
+	srv.Audit.Close()
+	return finished
+}
+
+/*
+Reload takes over the new configuration and mailer, and reloads all records of the key database from disk. Connections
+being served are allowed to finish before the new configuration takes effect, and they are not interrupted. Only the
+password, email notification subjects and greetings are taken over, and the TLS certificate and key files are read
+again; the listener, other TLS, KMIP, audit and inventory settings only take effect after a restart.
+*/
+func (srv *CryptServer) Reload(config CryptServiceConfig, mailer Mailer) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	srv.configLock.Lock()
+	defer srv.configLock.Unlock()
+	// The master key is obtained only once at start
+	config.KeyDBMasterKey = srv.Config.KeyDBMasterKey
+	newConfig := srv.Config
+	newConfig.PasswordHash = config.PasswordHash
+	newConfig.PasswordSalt = config.PasswordSalt
+	newConfig.PasswordKDF = config.PasswordKDF
+	newConfig.KeyCreationSubject = config.KeyCreationSubject
+	newConfig.KeyCreationGreeting = config.KeyCreationGreeting
+	newConfig.KeyRetrievalSubject = config.KeyRetrievalSubject
+	newConfig.KeyRetrievalGreeting = config.KeyRetrievalGreeting
+	newConfig.ClientErrorMail = config.ClientErrorMail
+	newConfig.ClientErrorSubject = config.ClientErrorSubject
+	newConfig.LockoutSubject = config.LockoutSubject
+	if !reflect.DeepEqual(newConfig, config) {
+		log.Print("CryptServer.Reload: listener, TLS, KMIP, audit and inventory settings have changed, they will take effect after a restart")
+	}
+	if srv.Certs != nil {
+		if err := srv.Certs.Reload(); err != nil {
+			log.Printf("CryptServer.Reload: keep using the previous TLS certificate - %v", err)
+		}
+	}
+	if srv.RevokedCerts != nil {
+		if err := srv.RevokedCerts.Reload(); err != nil {
+			log.Printf("CryptServer.Reload: keep using the previous revocation list - %v", err)
+		}
+	}
+	if err := srv.KeyDB.ReloadDB(); err != nil {
+		return err
+	}
+	srv.passwordLock.Lock()
+	srv.Config = newConfig
+	srv.passwordLock.Unlock()
+	*srv.Mailer = mailer
+	return nil
 }
 
 /*
@@ -368,15 +802,21 @@ Return nil if all OK.
 Return an error with description text if password parameters are incomplete.
 */
 func (srv *CryptServer) CheckInitialSetup() error {
+	salt, hash, _ := srv.passwordParams()
+	return checkPasswordParams(salt, hash)
+}
+
+// Return an error if either password parameter is all zeros.
+func checkPasswordParams(salt PasswordSalt, hash HashedPassword) error {
 	// Make sure the password parameters have correct length
 	zero1 := true
-	for _, b := range srv.Config.PasswordHash {
+	for _, b := range hash {
 		if b != 0 {
 			zero1 = false
 		}
 	}
 	zero2 := true
-	for _, b := range srv.Config.PasswordSalt {
+	for _, b := range salt {
 		if b != 0 {
 			zero2 = false
 		}
@@ -387,17 +827,20 @@ func (srv *CryptServer) CheckInitialSetup() error {
 	return nil
 }
 
-func (srv *CryptServer) ValidatePlainPassword(password string) error {
-	var salt PasswordSalt
-	copy(salt[:], srv.Config.PasswordSalt[:])
-	pass := HashPassword(salt, password)
-	if err := srv.CheckInitialSetup(); err != nil {
-		return err
+/*
+NormaliseRemoteHost turns a client IP into the form under which server identifies the client, e.g. in pending commands
+and alive messages. Anything that is not an IP address is returned as-is.
+*/
+func NormaliseRemoteHost(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
 	}
-	if subtle.ConstantTimeCompare(pass[:], srv.Config.PasswordHash[:]) != 1 {
-		return errors.New("ValidatePlainPassword: password is incorrect")
+	// Turn IPv6 localhost address into IPv4 address to aid in several test cases that rely on 127.0.0.1 being localhost
+	if ip.Equal(net.IPv6loopback) {
+		return "127.0.0.1"
 	}
-	return nil
+	return ip.String()
 }
 
 // Create an RPC service object that handles requests from an incoming connection.
@@ -406,25 +849,32 @@ func (srv *CryptServer) ServeConn(incoming net.Conn) {
 	remoteHost, _, err := net.SplitHostPort(incoming.RemoteAddr().String())
 	certDNSName := ""
 	certIPAddress := ""
+	certCN := ""
+	var peer *PeerCred
 	if err != nil {
 		if incoming.RemoteAddr().String() == "@" {
 			remoteHost = "@"
+			if cred, err := peerCredentials(incoming); err != nil {
+				log.Printf("CryptServer.ServeConn: administrative functions are unavailable to the local peer - %v", err)
+			} else {
+				peer = &cred
+			}
 		} else {
 			log.Printf("CryptServer.ServeConn: failed to parse weird looking address - %v", err)
 			return
 		}
 	} else {
-		certDNSName, certIPAddress = helper.GetCertificatInfo(incoming.(*tls.Conn))
-		log.Printf("Certficat for connection from %s contains DNSName '%s' and IPAddress '%s'", remoteHost, certDNSName, certIPAddress)
-	}
-	// Turn IPv6 localhost address into IPv4 address to aid in several test cases that rely on 127.0.0.1 being localhost
-	if remoteHost == "::1" {
-		remoteHost = "127.0.0.1"
+		certDNSName, _ = helper.GetCertificatInfo(incoming.(*tls.Conn))
+		certIPAddress = helper.GetStateCertificatIPAddress(incoming.(*tls.Conn).ConnectionState(), NormaliseRemoteHost(remoteHost))
+		certCN = helper.GetCertificateCommonName(incoming.(*tls.Conn))
+		log.Printf("<7>Certficat for connection from %s contains DNSName '%s' and IPAddress '%s'", remoteHost, certDNSName, certIPAddress)
 	}
-	if err := rpcSvc.Register(&CryptServiceConn{RemoteHost: remoteHost, CertDNSName: certDNSName, CertIPAddress: certIPAddress, Svc: srv}); err != nil {
+	remoteHost = NormaliseRemoteHost(remoteHost)
+	if err := rpcSvc.Register(&CryptServiceConn{RemoteHost: remoteHost, CertDNSName: certDNSName, CertIPAddress: certIPAddress, CertCN: certCN, Peer: peer, Svc: srv}); err != nil {
 		log.Panicf("ServeConn: failed to register RPC service - %v", err)
 	}
-	rpcSvc.ServeConn(incoming)
+	// Configuration and records are not reloaded in the middle of an RPC call
+	rpcSvc.ServeCodec(newLockingServerCodec(incoming, &srv.configLock, srv.Metrics))
 	return
 }
 
@@ -433,9 +883,64 @@ type CryptServiceConn struct {
 	RemoteHost    string
 	CertDNSName   string
 	CertIPAddress string
+	CertCN        string
+	Peer          *PeerCred // Peer is the identity of the local process connected via the domain socket, nil otherwise.
 	Svc           *CryptServer
 }
 
+// audit records an event concerning the peer of this connection in audit log.
+func (rpcConn *CryptServiceConn) audit(event, hostname, uuid, result, reason string) {
+	peer := ""
+	if rpcConn.Peer != nil {
+		peer = rpcConn.Peer.String()
+	}
+	evt := AuditEvent{
+		Peer:             peer,
+		Event:            event,
+		IP:               rpcConn.RemoteHost,
+		CertCN:           rpcConn.CertCN,
+		Hostname:         hostname,
+		IdentityMismatch: !keydb.HostnamesAgree(hostname, rpcConn.verifiedHostname()),
+		UUID:             uuid,
+		Result:           result,
+		Reason:           reason,
+	}
+	rpcConn.Svc.Audit.Record(evt)
+	logAuditEvent(evt)
+}
+
+/*
+verifiedHostname returns the host name the validated certificate of the peer is issued for, its first DNS name or
+otherwise its common name. It is empty if the server does not validate client certificates, as the names in the
+certificate are then nothing but the peer's own claim.
+*/
+func (rpcConn *CryptServiceConn) verifiedHostname() string {
+	if !rpcConn.Svc.Config.ValidateClientCert {
+		return ""
+	} else if rpcConn.CertDNSName != "" {
+		return rpcConn.CertDNSName
+	}
+	return rpcConn.CertCN
+}
+
+/*
+newRequester returns the alive message of the peer for the moment, carrying both the host name the peer reported and
+the identity verified by the server: the IP of the connection, and the host name of its validated certificate. Access
+control and maximum active users are decided by the verified identity only.
+*/
+func (rpcConn *CryptServiceConn) newRequester(claimedHostname string) keydb.AliveMessage {
+	requester := keydb.AliveMessage{
+		IP:        rpcConn.RemoteHost,
+		Hostname:  claimedHostname,
+		CertName:  rpcConn.verifiedHostname(),
+		Timestamp: time.Now().Unix(),
+	}
+	if requester.IdentityMismatch() {
+		log.Printf("CryptServiceConn: %s reports host name \"%s\" but its certificate is issued for \"%s\"", requester.IP, requester.Hostname, requester.CertName)
+	}
+	return requester
+}
+
 var RPCObjNameFmt = reflect.TypeOf(CryptServiceConn{}).Name() + ".%s" // for constructing RPC function name in RPC call
 
 // A request to ping server and test its readiness for key operations.
@@ -446,7 +951,7 @@ type PingRequest struct {
 
 // If the server is ready to manage encryption keys, return nothing successfully. Return an error if otherwise.
 func (rpcConn *CryptServiceConn) Ping(req PingRequest, _ *DummyAttr) error {
-	if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
 		return err
 	}
 	if err := rpcConn.Svc.CheckInitialSetup(); err != nil {
@@ -457,47 +962,246 @@ func (rpcConn *CryptServiceConn) Ping(req PingRequest, _ *DummyAttr) error {
 
 type DummyAttr bool // dummy type for a placeholder receiver in an RPC function
 
+/*
+Capabilities describe the protocol version, optional features, limits, and certificate expiry of the server.
+It must never carry secrets or configuration details that help an attacker, because it is handed out without a password.
+New attributes may be appended over time, clients built against an older version simply ignore them.
+*/
+type Capabilities struct {
+	ProtocolVersion    int             // ProtocolVersion is the version of RPC protocol spoken by the server.
+	Features           map[string]bool // Features are the optional features enabled on the server (Feature* constants).
+	ReplicationRole    string          // ReplicationRole is the role of the server among its replicas, or "standalone".
+	MaxUUIDsPerRequest int             // MaxUUIDsPerRequest is the maximum number of UUIDs in one key request, 0 if unlimited.
+	MaxRequestSize     int             // MaxRequestSize is the maximum size in bytes of an RPC request, 0 if unlimited.
+	CertNotAfter       time.Time       // CertNotAfter is the expiry of the server's TLS certificate.
+	CANotAfter         time.Time       // CANotAfter is the expiry of the CA certificate, zero if CA is not configured.
+	/*
+		ServerTime is the clock of the server at the moment of answering, zero if the server is older. It is carried
+		here rather than by Ping, as the reply of Ping cannot change without upsetting clients of older versions.
+	*/
+	ServerTime time.Time
+}
+
+// Return the expiry of the first certificate found in the PEM file, or zero time if it cannot be read.
+func getCertNotAfter(pemPath string) time.Time {
+	if pemPath == "" {
+		return time.Time{}
+	}
+	content, err := ioutil.ReadFile(pemPath)
+	if err != nil {
+		return time.Time{}
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter
+}
+
+// GetCapabilities reports the server's capabilities. No password is required.
+func (rpcConn *CryptServiceConn) GetCapabilities(_ DummyAttr, caps *Capabilities) error {
+	conf := rpcConn.Svc.Config
+	*caps = Capabilities{
+		ProtocolVersion: ProtocolVersion,
+		Features: map[string]bool{
+			FeatureKMIPBuiltIn:          len(conf.KMIPAddresses) == 0,
+			FeatureKMIPExternal:         len(conf.KMIPAddresses) > 0,
+			FeatureClientCertValidation: conf.ValidateClientCert,
+			FeatureAuditLog:             rpcConn.Svc.Audit != nil,
+			FeatureConsistencyGroups:    true,
+			FeatureDiskInventory:        rpcConn.Svc.Inventory != nil,
+			FeatureClientErrors:         true,
+			FeatureRecordInfo:           true,
+			FeatureCommandResult:        true,
+			FeatureKeyRotation:          len(conf.KMIPAddresses) == 0,
+			FeatureServerKeyRotation:    len(conf.KMIPAddresses) == 0,
+			FeatureHealth:               true,
+			FeatureRecordUpdate:         true,
+			FeatureClientDevices:        true,
+			FeatureChangePassword:       true,
+			FeatureMaintenance:          true,
+			FeatureUnlockToken:          true,
+			FeatureHTTPAPI:              rpcConn.Svc.HTTPAPI != nil,
+			FeatureEnrollment:           rpcConn.Svc.IssueClientCert != nil,
+			FeatureRecordOwner:          true,
+			FeatureForgetKey:            true,
+			FeatureAutoEncryption:       true,
+		},
+		ReplicationRole: "standalone",
+		CertNotAfter:    getCertNotAfter(conf.CertPEM),
+		CANotAfter:      getCertNotAfter(conf.CertAuthorityPEM),
+		ServerTime:      time.Now(),
+	}
+	return nil
+}
+
 // A request to create an encryption key on server.
 type CreateKeyReq struct {
-	PlainPassword    string   // access is granted only after the correct password is given
-	Hostname         string   // computer host name (for logging only)
-	UUID             string   // file system uuid
-	MappedName       string   // The mapped name which will be used when opening the device. If empty the device uuid name will be used.
-	MountPoint       string   // mount point of the file system
-	MountOptions     []string // mount options of the file system
-	MaxActive        int      // maximum allowed active key users (computers), set to <=0 to allow unlimited.
-	AllowedClients   []string // Array of DNS-names of clients which have access to the device. The client must use certificate containing the DNS-name in this case
-	AliveIntervalSec int      // interval in seconds at which all user of the file system holding this key must report they're online
-	AliveCount       int      // a computer holding the file system is considered offline after missing so many alive messages
-	AutoEncryption   bool     // If it is true automatic encryption is allowed when the first client detects this device and the device is not already encypted.
-	FileSystem       string   // Filesystem to be created if AutoEncryption is true
+	PlainPassword    string            // access is granted only after the correct password is given
+	Hostname         string            // computer host name (for logging only)
+	UUID             string            // file system uuid
+	MappedName       string            // The mapped name which will be used when opening the device. If empty the device uuid name will be used.
+	MountPoint       string            // mount point of the file system
+	MountOptions     []string          // mount options of the file system
+	MaxActive        int               // maximum allowed active key users (computers), set to <=0 to allow unlimited.
+	AllowedClients   []string          // Array of DNS-names, DNS-name patterns, IPs, and subnets of clients which have access to the device. The client must use certificate containing the DNS-name or IP in this case
+	AliveIntervalSec int               // interval in seconds at which all user of the file system holding this key must report they're online
+	AliveCount       int               // a computer holding the file system is considered offline after missing so many alive messages
+	AutoEncryption   bool              // If it is true automatic encryption is allowed when the first client detects this device and the device is not already encypted.
+	FileSystem       string            // Filesystem to be created if AutoEncryption is true
+	Group            string            // optional consistency group the file system belongs to
+	GroupPriority    int               // mount order of the file system among its group members
+	Tags             map[string]string // optional free-form name-value pairs that describe the file system
+	Owner            string            // optional team or administrator responsible for the file system
+	UnlockAfter      []string          // optional UUIDs of records whose file systems are unlocked before this one
+	TangURL          string            // optional Tang server the disk is also bound to
+	FsckPolicy       string            // how the client checks the file system before mounting it, empty for the default
+
+	UnlockWindows     []keydb.UnlockWindow // optional periods of time during which the key is handed out for auto-unlock
+	UmountAtWindowEnd bool                 // issue an umount command to the computers using the disk once an unlock window ends
+
+	CryptOptions fs.CryptFormatOptions // LUKS header parameters used when the disk is formatted
+
+	KeyContent     []byte // optional key of a disk encrypted elsewhere, the server generates a new key if it is empty
+	UpdateExisting bool   // update the attributes of the record if it already exists, its key is kept
+}
+
+// Validate checks the request attributes that do not depend on the other records.
+func (req CreateKeyReq) Validate() error {
+	if err := keydb.ValidateUUID(req.UUID); err != nil {
+		return err
+	}
+	if req.MountPoint == "" {
+		return errors.New("Mount point must not be empty")
+	}
+	return nil
 }
 
 // Make sure that the request attributes are sane.
 func (rpcConn *CryptServiceConn) Validate(req CreateKeyReq) error {
-	if err := keydb.ValidateUUID(req.UUID); err != nil {
+	if err := req.Validate(); err != nil {
 		return err
 	}
 	_, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
-	if found {
+	if found && !req.UpdateExisting {
 		return fmt.Errorf("Device with UUID '%s' does already exists", req.UUID)
+	} else if found && len(req.KeyContent) > 0 {
+		return fmt.Errorf("Device with UUID '%s' already has a key, which is kept when its record is updated - rotate the key to replace it", req.UUID)
 	}
-	return nil
+	if len(req.KeyContent) > 0 {
+		if len(req.KeyContent) < MinRotatedKeyLen {
+			return fmt.Errorf("The key of device with UUID '%s' is too short (%d bytes), it must have at least %d bytes", req.UUID, len(req.KeyContent), MinRotatedKeyLen)
+		} else if req.AutoEncryption {
+			return errors.New("A disk whose key is imported is already encrypted, it cannot be encrypted automatically")
+		}
+	}
+	if req.AutoEncryption {
+		if err := keydb.ValidateFileSystem(req.FileSystem, true); err != nil {
+			return err
+		}
+	}
+	if req.MappedName != "" {
+		if strings.ContainsAny(req.MappedName, "/ \t\n") {
+			return fmt.Errorf("Mapped name \"%s\" must not contain slash or space", req.MappedName)
+		}
+		for _, rec := range rpcConn.Svc.KeyDB.List() {
+			if rec.MappedName == req.MappedName && rec.UUID != keydb.CanonicalRecordID(req.UUID) {
+				return fmt.Errorf("Mapped name \"%s\" is already used by device with UUID '%s'", req.MappedName, rec.UUID)
+			}
+		}
+	}
+	for _, entry := range req.AllowedClients {
+		if err := keydb.ValidateAllowedClient(strings.TrimSpace(entry)); err != nil {
+			return err
+		}
+	}
+	if _, err := fs.ValidateMountOptions(req.FileSystem, req.MountOptions); err != nil {
+		return err
+	}
+	if err := keydb.ValidateFsckPolicy(req.FsckPolicy); err != nil {
+		return err
+	}
+	if err := keydb.ValidateTangURL(req.TangURL); err != nil {
+		return err
+	}
+	if err := keydb.ValidateOwner(req.Owner); err != nil {
+		return err
+	}
+	tagged := keydb.Record{UUID: keydb.CanonicalRecordID(req.UUID), Tags: req.Tags, UnlockAfter: req.UnlockAfter,
+		UnlockWindows: req.UnlockWindows, UmountAtWindowEnd: req.UmountAtWindowEnd}
+	if err := tagged.ValidateTags(); err != nil {
+		return err
+	}
+	if err := tagged.ValidateUnlockWindows(); err != nil {
+		return err
+	}
+	if err := tagged.ValidateUnlockAfter(); err != nil {
+		return err
+	}
+	if err := rpcConn.Svc.KeyDB.CheckUnlockAfter(tagged); err != nil {
+		return err
+	}
+	return req.CryptOptions.Validate()
 }
 
 // A response to a newly saved key
 type CreateKeyResp struct {
-	KeyContent []byte // Disk encryption key
+	KeyContent sys.SecureBytes // Disk encryption key
+}
+
+// Copy the attributes of the file system from the request into the record, leaving key and usage alone.
+func (req CreateKeyReq) applyTo(keyRecord *keydb.Record) {
+	keyRecord.UUID = req.UUID
+	keyRecord.MountPoint = req.MountPoint
+	keyRecord.MountOptions = req.MountOptions
+	keyRecord.MaxActive = req.MaxActive
+	keyRecord.MappedName = req.MappedName
+	keyRecord.AliveIntervalSec = req.AliveIntervalSec
+	keyRecord.AliveCount = req.AliveCount
+	keyRecord.AllowedClients = req.AllowedClients
+	keyRecord.AutoEncryption = req.AutoEncryption
+	keyRecord.FileSystem = req.FileSystem
+	keyRecord.Group = req.Group
+	keyRecord.GroupPriority = req.GroupPriority
+	keyRecord.Tags = req.Tags
+	keyRecord.Owner = req.Owner
+	keyRecord.UnlockAfter = req.UnlockAfter
+	keyRecord.FsckPolicy = req.FsckPolicy
+	keyRecord.UnlockWindows = req.UnlockWindows
+	keyRecord.UmountAtWindowEnd = req.UmountAtWindowEnd
+	keyRecord.TangURL = req.TangURL
+	keyRecord.CryptOptions = req.CryptOptions
 }
 
-// Save a new key record.
+/*
+Save a new key record. The key is generated by the KMIP server, unless the request carries the key of a disk encrypted
+elsewhere. If the record exists and the request asks to update it, only its attributes are updated and no key is
+handed out.
+*/
 func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp) error {
-	if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("CreateKey", req.Hostname, req.UUID, AuditResultRejected, err.Error())
 		return err
 	}
 	if err := rpcConn.Validate(req); err != nil {
+		rpcConn.audit("CreateKey", req.Hostname, req.UUID, AuditResultRejected, err.Error())
 		return err
 	}
+	if existing, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID); found {
+		req.UUID = existing.UUID
+		req.applyTo(&existing)
+		if _, err := rpcConn.Svc.KeyDB.UpdateFields(existing, false); err != nil {
+			rpcConn.audit("CreateKey", req.Hostname, req.UUID, AuditResultFailed, err.Error())
+			return fmt.Errorf("CryptServiceConn.CreateKey: failed to update key tracking record - %v", err)
+		}
+		rpcConn.audit("CreateKey", req.Hostname, req.UUID, AuditResultGranted, "updated the existing record, its key is kept")
+		log.Printf(`CryptServiceConn.CreateKey: %s (%s) has updated the record of %s`, rpcConn.RemoteHost, req.Hostname, req.UUID)
+		return nil
+	}
 	/*
 		No matter key is located in built-in KMIP server or external KMIP server, the KMIP client needs to create the key.
 		But if the KMIP server is an external appliance, having the name prefix makes it more apparent where the key
@@ -505,7 +1209,13 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 		If KMIP server is the built-in one, the server will remove the prefix string before storing record UUID in built-in key database.
 		But key database only recognises UUID, there's no need for a prefix to be stored in key database.
 	*/
-	kmipKeyID, err := rpcConn.Svc.KMIPClient.CreateKey(KeyNamePrefix + req.UUID)
+	var kmipKeyID string
+	var err error
+	if len(req.KeyContent) > 0 {
+		kmipKeyID, err = rpcConn.Svc.KMIPClient.RegisterKey(KeyNamePrefix+req.UUID, req.KeyContent)
+	} else {
+		kmipKeyID, err = rpcConn.Svc.KMIPClient.CreateKey(KeyNamePrefix + req.UUID)
+	}
 	if err != nil {
 		return fmt.Errorf("CryptServiceConn.CreateKey: KMIP client refused to create the key - %v", err)
 	}
@@ -527,21 +1237,14 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	keyRecord.ID = kmipKeyID
 	keyRecord.Version = keydb.CurrentRecordVersion
 	keyRecord.CreationTime = time.Now()
-	keyRecord.UUID = req.UUID
-	keyRecord.MountPoint = req.MountPoint
-	keyRecord.MountOptions = req.MountOptions
-	keyRecord.MaxActive = req.MaxActive
-	keyRecord.MappedName = req.MappedName
-	keyRecord.AliveIntervalSec = req.AliveIntervalSec
-	keyRecord.AliveCount = req.AliveCount
-	keyRecord.AllowedClients = req.AllowedClients
-	keyRecord.AutoEncryption = req.AutoEncryption
-	keyRecord.FileSystem = req.FileSystem
+	req.applyTo(&keyRecord)
 	if _, err := rpcConn.Svc.KeyDB.Upsert(keyRecord); err != nil {
+		rpcConn.audit("CreateKey", req.Hostname, req.UUID, AuditResultFailed, err.Error())
 		return fmt.Errorf("CryptServiceConn.CreateKey: failed to save key tracking record into database - %v", err)
 	}
+	rpcConn.audit("CreateKey", req.Hostname, req.UUID, AuditResultGranted, "")
 	// Ask server for the actual encryption key to formulate RPC response
-	resp.KeyContent, err = rpcConn.askForKeyContent(kmipKeyID)
+	resp.KeyContent, err = rpcConn.askForKeyContent(keyRecord)
 	if err != nil {
 		return err
 	}
@@ -555,11 +1258,13 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	if rpcConn.Svc.Mailer.ValidateConfig() == nil {
 		go func() {
 			// Put IP and mount point in subject and key record details in text
-			subject := fmt.Sprintf("%s - %s (%s) %s", rpcConn.Svc.Config.KeyCreationSubject,
-				rpcConn.RemoteHost, req.Hostname, journalRec.MountPoint)
-			text := fmt.Sprintf("%s\r\n\r\n%s", rpcConn.Svc.Config.KeyCreationGreeting, journalRec.FormatAttrs("\r\n"))
+			event := MailEvent{Hostname: req.Hostname, UUID: journalRec.UUID, IP: rpcConn.RemoteHost, Owner: journalRec.Owner, Time: time.Now()}
+			subject := mailSubject(rpcConn.Svc.Config.KeyCreationSubject, event,
+				fmt.Sprintf("%s (%s) %s%s", rpcConn.RemoteHost, req.Hostname, journalRec.MountPoint, ownerNote(journalRec.Owner)))
+			text := fmt.Sprintf("%s\r\n\r\n%s", RenderMailTemplate(rpcConn.Svc.Config.KeyCreationGreeting, event), journalRec.FormatAttrs("\r\n"))
 			if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
-				log.Printf("CryptServiceConn.CreateKey: failed to send email notification after saving %s (%s)'s key of %s - %v",
+				rpcConn.Svc.Metrics.CountMailerError()
+				log.Printf("<3>CryptServiceConn.CreateKey: failed to send email notification after saving %s (%s)'s key of %s - %v",
 					rpcConn.RemoteHost, req.Hostname, journalRec.MountPoint, err)
 			}
 		}()
@@ -568,8 +1273,32 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	return nil
 }
 
-// Log key retrieval event to stderr and send optional notification emails.
-func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, granted map[string]keydb.Record, rejected, missing []string) {
+/*
+Log key retrieval event to stderr and audit log, and send optional notification emails. Reasons explain some of the
+rejections (UUID - reason), it may be nil; the caller has already kept those rejections on the records. The other
+rejections are kept on the records here.
+*/
+func (rpcConn *CryptServiceConn) logRetrieval(event string, uuids []string, hostname string, granted map[string]keydb.Record, rejected, missing []string, reasons map[string]string) {
+	for uuid := range granted {
+		rpcConn.audit(event, hostname, uuid, AuditResultGranted, "")
+		rpcConn.Svc.Metrics.CountKeyRetrieval(event, uuid, AuditResultGranted)
+		rpcConn.recordRetrieval(event, hostname, uuid, true, "")
+	}
+	for _, uuid := range rejected {
+		reason, found := reasons[uuid]
+		if !found {
+			var class string
+			class, reason = rpcConn.classifySelectRejection(uuid)
+			rpcConn.recordRejection(event, hostname, []string{uuid}, class, "")
+		}
+		rpcConn.audit(event, hostname, uuid, AuditResultRejected, reason)
+		rpcConn.Svc.Metrics.CountKeyRetrieval(event, uuid, AuditResultRejected)
+		rpcConn.recordRetrieval(event, hostname, uuid, false, reason)
+	}
+	for _, uuid := range missing {
+		rpcConn.audit(event, hostname, uuid, AuditResultMissing, "")
+		rpcConn.Svc.Metrics.CountKeyRetrieval(event, uuid, AuditResultMissing)
+	}
 	// Always log to system journal
 	retrievedUUIDs := make([]string, 0, len(uuids))
 	for uuid := range granted {
@@ -584,21 +1313,54 @@ func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, g
 			rpcConn.RemoteHost, hostname, strings.Join(rejected, " "))
 	}
 	// There is really no need to log the missing keys
-	// Send optional notification email in background
-	if rpcConn.Svc.Mailer.ValidateConfig() == nil && len(granted) > 0 {
-		go func(granted map[string]keydb.Record) {
-			// Put IP + host name in subject and UUID + mount point in text
-			subject := fmt.Sprintf("%s - %s %s", rpcConn.Svc.Config.KeyRetrievalSubject, rpcConn.RemoteHost, hostname)
-			text := fmt.Sprintf("%s\r\n\r\n", rpcConn.Svc.Config.KeyRetrievalGreeting)
-			for uuid, record := range granted {
-				text += fmt.Sprintf("%s - %s\r\n", uuid, record.MountPoint)
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	now := time.Now()
+	// Rejected retrievals are security relevant, they are notified right away even if retrievals go into a digest.
+	if len(rejected) > 0 {
+		go func() {
+			event := MailEvent{Hostname: hostname, UUID: strings.Join(rejected, " "), IP: rpcConn.RemoteHost, Time: now}
+			subject := "Rejected: " + mailSubject(rpcConn.Svc.Config.KeyRetrievalSubject, event, fmt.Sprintf("%s %s", rpcConn.RemoteHost, hostname))
+			text := fmt.Sprintf("The key server has refused to give %s (%s) the following encryption keys, because the maximum number of active users is reached or the client is not allowed:\r\n\r\n",
+				rpcConn.RemoteHost, hostname)
+			for _, uuid := range rejected {
+				rec, _ := rpcConn.Svc.KeyDB.GetByUUID(uuid)
+				text += uuid + ownerNote(rec.Owner) + "\r\n"
 			}
 			if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
-				log.Printf("CryptServiceConn.logRetrieval: failed to send email notification after granting keys to %s (%s) - %v",
+				rpcConn.Svc.Metrics.CountMailerError()
+				log.Printf("<3>CryptServiceConn.logRetrieval: failed to send email notification after rejecting keys of %s (%s) - %v",
 					rpcConn.RemoteHost, hostname, err)
 			}
-		}(granted)
+		}()
+	}
+	if len(granted) == 0 {
+		return
+	}
+	if digest := rpcConn.Svc.RetrievalDigest; digest != nil {
+		entries := make([]RetrievalDigestEntry, 0, len(granted))
+		for uuid, record := range granted {
+			entries = append(entries, RetrievalDigestEntry{Time: now, Hostname: hostname, IP: rpcConn.RemoteHost, UUID: uuid, MountPoint: record.MountPoint})
+		}
+		digest.Add(entries...)
+		return
 	}
+	// Send optional notification email in background
+	go func(granted map[string]keydb.Record) {
+		// Put IP + host name in subject and UUID + mount point in text
+		event := MailEvent{Hostname: hostname, UUID: strings.Join(retrievedUUIDs, " "), IP: rpcConn.RemoteHost, Time: now}
+		subject := mailSubject(rpcConn.Svc.Config.KeyRetrievalSubject, event, fmt.Sprintf("%s %s", rpcConn.RemoteHost, hostname))
+		text := fmt.Sprintf("%s\r\n\r\n", RenderMailTemplate(rpcConn.Svc.Config.KeyRetrievalGreeting, event))
+		for uuid, record := range granted {
+			text += fmt.Sprintf("%s - %s%s\r\n", uuid, record.MountPoint, ownerNote(record.Owner))
+		}
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("<3>CryptServiceConn.logRetrieval: failed to send email notification after granting keys to %s (%s) - %v",
+				rpcConn.RemoteHost, hostname, err)
+		}
+	}(granted)
 }
 
 // A request to retrieve encryption keys without using password.
@@ -612,13 +1374,28 @@ type AutoRetrieveKeyResp struct {
 	Granted  map[string]keydb.Record // these keys are now granted to the requester
 	Rejected []string                // these keys exist in database but are not allowed to be retrieved at the moment
 	Missing  []string                // these keys cannot be found in database
+	Matches  map[string]string       // these explain which allowed client entry matched the requester (UUID - explanation)
+
+	RejectReasons map[string]string // these explain why some of the rejected keys are not allowed at the moment (UUID - reason)
+
+	Suggestions map[string][]string // similar records the requester may use, for the missing file system UUIDs (UUID - suggested UUIDs)
 }
 
-// Retrieve key content by KMIP record ID. Return key content.
-func (rpcConn *CryptServiceConn) askForKeyContent(kmipID string) (key []byte, err error) {
-	key, err = rpcConn.Svc.KMIPClient.GetKey(kmipID)
-	if err != nil {
-		// This is severe enough to deserve a server side log message
+/*
+Retrieve key content of the record by its KMIP ID. Return key content.
+While keys are being migrated off an external KMIP server, the records already migrated carry their key content and
+refer to a key database sequence number that means nothing to the KMIP server, so their key content is used directly.
+*/
+func (rpcConn *CryptServiceConn) askForKeyContent(rec keydb.Record) (key []byte, err error) {
+	if rec.IsKeyForgotten() {
+		return nil, fmt.Errorf("CryptServiceConn.askForKeyContent: the key of \"%s\" was destroyed on %s", rec.UUID, rec.ForgetTime.Format(time.RFC3339))
+	}
+	if rpcConn.Svc.BuiltInKMIPServer == nil && len(rec.Key) > 0 {
+		return rec.Key, nil
+	}
+	key, err = rpcConn.Svc.KMIPClient.GetKey(rec.ID)
+	if err != nil {
+		// This is severe enough to deserve a server side log message
 		msg := fmt.Sprintf("CryptServiceConn.askForKeyContent: KMIP client failed to answer to key request - %v", err)
 		log.Print(msg)
 		return nil, errors.New(msg)
@@ -626,25 +1403,73 @@ func (rpcConn *CryptServiceConn) askForKeyContent(kmipID string) (key []byte, er
 	return
 }
 
+/*
+Return the records similar to the missing file system UUIDs, perhaps mistyped by the administrator. Only the records the
+requester is allowed to use are suggested, so that nothing is revealed about the others.
+*/
+func (rpcConn *CryptServiceConn) suggestRecords(missing []string) map[string][]string {
+	visible := func(rec keydb.Record) bool {
+		return rpcConn.Svc.KeyDB.IsClientAllowed(rec, rpcConn.CertDNSName, rpcConn.CertIPAddress)
+	}
+	suggestions := make(map[string][]string)
+	for _, uuid := range missing {
+		// Other device IDs of the disks are missing as a matter of course
+		if !keydb.RegexFSUUID.MatchString(keydb.CanonicalRecordID(uuid)) {
+			continue
+		}
+		if similar := rpcConn.Svc.KeyDB.SuggestRecords(uuid, visible); len(similar) > 0 {
+			suggestions[uuid] = similar
+		}
+	}
+	return suggestions
+}
+
 // Retrieve encryption keys without using a password. The request is usually sent automatically when disk comes online.
 func (rpcConn *CryptServiceConn) AutoRetrieveKey(req AutoRetrieveKeyReq, resp *AutoRetrieveKeyResp) error {
+	if err := rpcConn.limitClientCalls("AutoRetrieveKey"); err != nil {
+		return err
+	}
+	if err := rpcConn.rejectInMaintenance("AutoRetrieveKey", req.Hostname, req.UUIDs); err != nil {
+		return err
+	}
 	// Retrieve the keys and write down who retrieved it
-	requester := keydb.AliveMessage{
-		IP:        rpcConn.RemoteHost,
-		Hostname:  req.Hostname,
-		Timestamp: time.Now().Unix(),
+	requester := rpcConn.newRequester(req.Hostname)
+	// The disks outside of their unlock windows are rejected by server's wall clock
+	now := time.Now()
+	resp.RejectReasons = make(map[string]string)
+	open, closed := make([]string, 0, len(req.UUIDs)), make([]string, 0)
+	for _, uuid := range req.UUIDs {
+		if rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid); found && rec.IsKeyForgotten() {
+			resp.RejectReasons[uuid] = "the key was destroyed on " + rec.ForgetTime.Format(time.RFC3339)
+			rpcConn.recordRejection("AutoRetrieveKey", req.Hostname, []string{uuid}, keydb.RejectionKeyForgotten, resp.RejectReasons[uuid])
+			closed = append(closed, uuid)
+		} else if found && !rec.IsUnlockWindowOpen(now, time.Local) {
+			resp.RejectReasons[uuid] = rec.DescribeUnlockWindows(now, time.Local)
+			rpcConn.recordRejection("AutoRetrieveKey", req.Hostname, []string{uuid}, keydb.RejectionUnlockWindow, resp.RejectReasons[uuid])
+			closed = append(closed, uuid)
+		} else {
+			open = append(open, uuid)
+		}
 	}
-	resp.Granted, resp.Rejected, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, true, rpcConn.CertDNSName, rpcConn.CertIPAddress, req.UUIDs...)
+	resp.Granted, resp.Rejected, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, true, rpcConn.CertDNSName, rpcConn.CertIPAddress, open...)
+	resp.Rejected = append(resp.Rejected, closed...)
+	resp.Matches = make(map[string]string)
+	for _, uuid := range req.UUIDs {
+		if rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid); found {
+			resp.Matches[uuid] = rpcConn.Svc.KeyDB.DescribeClientMatch(rec, rpcConn.CertDNSName, rpcConn.CertIPAddress)
+		}
+	}
+	resp.Suggestions = rpcConn.suggestRecords(resp.Missing)
 	// Key content of granted records are stored in KMIP
 	for uuid, grantedRecord := range resp.Granted {
-		key, err := rpcConn.askForKeyContent(grantedRecord.ID)
+		key, err := rpcConn.askForKeyContent(grantedRecord)
 		if err != nil {
 			return err
 		}
 		grantedRecord.Key = key
 		resp.Granted[uuid] = grantedRecord
 	}
-	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, resp.Rejected, resp.Missing)
+	rpcConn.logRetrieval("AutoRetrieveKey", req.UUIDs, req.Hostname, resp.Granted, resp.Rejected, resp.Missing, resp.RejectReasons)
 	return nil
 }
 
@@ -663,33 +1488,129 @@ type ManualRetrieveKeyResp struct {
 
 // Retrieve encryption keys using a password. All requested keys will be granted regardless of MaxActive restriction.
 func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, resp *ManualRetrieveKeyResp) error {
-	if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		for _, uuid := range req.UUIDs {
+			rpcConn.audit("ManualRetrieveKey", req.Hostname, uuid, AuditResultRejected, err.Error())
+		}
 		return err
 	}
-	// Retrieve the keys and write down who retrieved it
-	requester := keydb.AliveMessage{
-		IP:        rpcConn.RemoteHost,
-		Hostname:  req.Hostname,
-		Timestamp: time.Now().Unix(),
+	if err := rpcConn.rejectInMaintenance("ManualRetrieveKey", req.Hostname, req.UUIDs); err != nil {
+		return err
 	}
+	// Retrieve the keys and write down who retrieved it
+	requester := rpcConn.newRequester(req.Hostname)
 	resp.Granted, _, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, false, rpcConn.CertDNSName, rpcConn.CertIPAddress, req.UUIDs...)
 	// Key content of granted records are stored in KMIP
 	for uuid, grantedRecord := range resp.Granted {
-		key, err := rpcConn.askForKeyContent(grantedRecord.ID)
+		key, err := rpcConn.askForKeyContent(grantedRecord)
+		if err != nil {
+			return err
+		}
+		grantedRecord.Key = key
+		resp.Granted[uuid] = grantedRecord
+	}
+	rpcConn.logRetrieval("ManualRetrieveKey", req.UUIDs, req.Hostname, resp.Granted, []string{}, resp.Missing, nil)
+	return nil
+}
+
+// ForceRetrieveKeyReq asks for encryption keys even if their records are already in use by as many computers as allowed.
+type ForceRetrieveKeyReq struct {
+	PlainPassword string   // PlainPassword grants access, leave it empty if the client presents an administrator certificate.
+	UUIDs         []string // UUIDs are the (locked) file system UUIDs.
+	Hostname      string   // Hostname is the client's host name (for logging only).
+}
+
+// ForceRetrieveKeyResp is the response to forced key retrieval request.
+type ForceRetrieveKeyResp struct {
+	Granted  map[string]keydb.Record   // Granted keys are now granted to the requester.
+	Evicted  map[string]keydb.Eviction // Evicted are the computers removed from active users of the granted records (UUID - eviction).
+	Rejected []string                  // Rejected keys are not granted because the requester is not an allowed client.
+	Missing  []string                  // Missing keys cannot be found in database.
+}
+
+/*
+Return the identity of the administrator who authorised a request, which is either the correct password or the
+certificate of an administrator client. Return an error if neither is presented.
+*/
+func (rpcConn *CryptServiceConn) adminIdentity(plainPassword string) (string, error) {
+	if plainPassword == "" && rpcConn.CertCN != "" && rpcConn.Svc.Config.ValidateClientCert {
+		for _, cn := range rpcConn.Svc.Config.AdminClientCNs {
+			if cn == rpcConn.CertCN {
+				return "certificate CN=" + cn, nil
+			}
+		}
+	}
+	if err := rpcConn.validatePassword(plainPassword); err != nil {
+		return "", err
+	}
+	return "password", nil
+}
+
+/*
+ForceRetrieveKey retrieves encryption keys on authority of an administrator. If a record is already in use by as many
+computers as it allows, the computer that has not sent an alive message for the longest time is evicted to make room
+for the requester. The evictions are written to the records and audit log, and notified by email.
+*/
+func (rpcConn *CryptServiceConn) ForceRetrieveKey(req ForceRetrieveKeyReq, resp *ForceRetrieveKeyResp) error {
+	evictedBy, err := rpcConn.adminIdentity(req.PlainPassword)
+	if err != nil {
+		for _, uuid := range req.UUIDs {
+			rpcConn.audit("ForceRetrieveKey", req.Hostname, uuid, AuditResultRejected, err.Error())
+		}
+		return err
+	}
+	if err := rpcConn.rejectInMaintenance("ForceRetrieveKey", req.Hostname, req.UUIDs); err != nil {
+		return err
+	}
+	requester := rpcConn.newRequester(req.Hostname)
+	resp.Granted, resp.Evicted, resp.Rejected, resp.Missing = rpcConn.Svc.KeyDB.ForceSelect(requester, evictedBy, rpcConn.CertDNSName, rpcConn.CertIPAddress, req.UUIDs...)
+	for uuid, grantedRecord := range resp.Granted {
+		key, err := rpcConn.askForKeyContent(grantedRecord)
 		if err != nil {
 			return err
 		}
 		grantedRecord.Key = key
 		resp.Granted[uuid] = grantedRecord
 	}
-	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, []string{}, resp.Missing)
+	for uuid, eviction := range resp.Evicted {
+		reason := fmt.Sprintf("evicted %s (%s) authorised by %s", eviction.IP, eviction.Hostname, evictedBy)
+		rpcConn.audit("ForceRetrieveKey", req.Hostname, uuid, AuditResultGranted, reason)
+		log.Printf("CryptServiceConn.ForceRetrieveKey: %s (%s) %s of %s", rpcConn.RemoteHost, req.Hostname, reason, uuid)
+	}
+	rpcConn.notifyEviction(req.Hostname, resp.Evicted)
+	rpcConn.logRetrieval("ForceRetrieveKey", req.UUIDs, req.Hostname, resp.Granted, resp.Rejected, resp.Missing, nil)
 	return nil
 }
 
+// Send an email notification of computers evicted by forced key retrieval.
+func (rpcConn *CryptServiceConn) notifyEviction(hostname string, evicted map[string]keydb.Eviction) {
+	if len(evicted) == 0 || rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	go func() {
+		subject := fmt.Sprintf("Evicted: %s (%s) has forcibly retrieved keys in use by other computers", rpcConn.RemoteHost, hostname)
+		var text bytes.Buffer
+		text.WriteString(fmt.Sprintf("The key server has granted the following encryption keys to %s (%s) beyond their maximum number of active users, and evicted the computers that last reported the longest time ago:\r\n\r\n",
+			rpcConn.RemoteHost, hostname))
+		for uuid, eviction := range evicted {
+			rec, _ := rpcConn.Svc.KeyDB.GetByUUID(uuid)
+			text.WriteString(fmt.Sprintf("%s%s - evicted %s (%s), last seen %s, authorised by %s\r\n", uuid, ownerNote(rec.Owner), eviction.IP, eviction.Hostname,
+				time.Unix(eviction.LastSeen, 0).Format(time.RFC3339), eviction.EvictedBy))
+		}
+		if err := rpcConn.Svc.Mailer.Send(subject, text.String()); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("<3>CryptServiceConn.ForceRetrieveKey: failed to send email notification of evictions - %v", err)
+		}
+	}()
+}
+
 // A request to submit an alive report.
 type ReportAliveReq struct {
-	Hostname string   // client's host name (for logging only)
-	UUIDs    []string // UUID of disks that are reportedly alive
+	Hostname string            // client's host name (for logging only)
+	UUIDs    []string          // UUID of disks that are reportedly alive
+	Health   map[string]string // optional description of problems experienced by the disks (UUID - description)
+	// optional moments (Unix seconds) disks were unlocked by their keys sealed by TPM2 while key server was unreachable (UUID - moment)
+	OfflineUnlocks map[string]int64
 }
 
 /*
@@ -698,12 +1619,25 @@ Respond with UUID of keys that are rejected - which means they previously lost c
 consider it eligible to hold the keys.
 */
 func (rpcConn *CryptServiceConn) ReportAlive(req ReportAliveReq, rejectedUUIDs *[]string) error {
-	requester := keydb.AliveMessage{
-		IP:        rpcConn.RemoteHost,
-		Hostname:  req.Hostname,
-		Timestamp: time.Now().Unix(),
+	if err := rpcConn.limitClientCalls("ReportAlive"); err != nil {
+		return err
+	}
+	requester := rpcConn.newRequester(req.Hostname)
+	for uuid, moment := range req.OfflineUnlocks {
+		when := time.Unix(moment, 0).Format(time.RFC3339)
+		log.Printf("CryptServiceConn.ReportAlive: %s (%s) unlocked disk %s by its key sealed in TPM2 on %s, while key server was unreachable", rpcConn.RemoteHost, req.Hostname, uuid, when)
+		rpcConn.audit("OfflineUnlock", req.Hostname, uuid, AuditResultGranted, "unlocked by the key sealed in TPM2 on "+when)
+	}
+	if len(req.Health) == 0 {
+		*rejectedUUIDs = rpcConn.Svc.KeyDB.UpdateAliveMessage(requester, req.UUIDs...)
+		return nil
+	}
+	// Each disk carries its own health description
+	*rejectedUUIDs = make([]string, 0, 8)
+	for _, uuid := range req.UUIDs {
+		requester.Health = req.Health[uuid]
+		*rejectedUUIDs = append(*rejectedUUIDs, rpcConn.Svc.KeyDB.UpdateAliveMessage(requester, uuid)...)
 	}
-	*rejectedUUIDs = rpcConn.Svc.KeyDB.UpdateAliveMessage(requester, req.UUIDs...)
 	return nil
 }
 
@@ -713,25 +1647,123 @@ type EraseKeyReq struct {
 	Password      HashedPassword // access is granted only after the correct password is given
 	Hostname      string         // client's host name (for logging only)
 	UUID          string         // UUID of the disk to delete key for
+
+	OwnerAcknowledged bool // the requester acts on behalf of the record owner, a record that has an owner is only erased if true
 }
 
 func (rpcConn *CryptServiceConn) EraseKey(req EraseKeyReq, _ *DummyAttr) error {
-	if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultRejected, err.Error())
 		return err
 	}
 	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
 	if !found {
 		// No need to return error in case key has already disappeared from key server
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultMissing, "")
 		return nil
 	}
+	if err := checkOwnerAcknowledged(rec, req.OwnerAcknowledged); err != nil {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultRejected, "owner did not acknowledge")
+		return fmt.Errorf("EraseKey: %v", err)
+	}
 	kmipErr := rpcConn.Svc.KMIPClient.DestroyKey(rec.ID)
 	dbErr := rpcConn.Svc.KeyDB.Erase(req.UUID)
-	if dbErr == nil && kmipErr != nil {
+	if dbErr == nil {
+		rpcConn.notifyErase(req.Hostname, rec)
+	}
+	if dbErr != nil {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultFailed, dbErr.Error())
+	} else if kmipErr != nil {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultGranted, "KMIP did not erase the key - "+kmipErr.Error())
 		return fmt.Errorf("EraseKey: key tracking record has been erased from database, but KMIP did not erase it - %v", kmipErr)
+	} else {
+		rpcConn.audit("EraseKey", req.Hostname, req.UUID, AuditResultGranted, "")
 	}
 	return dbErr
 }
 
+// Send optional notification email of an erased key in background, it is never put into a digest.
+func (rpcConn *CryptServiceConn) notifyErase(hostname string, rec keydb.Record) {
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	go func() {
+		subject := fmt.Sprintf("Erased: key of %s (%s)%s has been erased by %s (%s)", rec.UUID, rec.MountPoint, ownerNote(rec.Owner), rpcConn.RemoteHost, hostname)
+		text := fmt.Sprintf("The key server has erased the encryption key of the following file system on request of %s (%s):\r\n\r\n%s - %s%s\r\n",
+			rpcConn.RemoteHost, hostname, rec.UUID, rec.MountPoint, ownerNote(rec.Owner))
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("<3>CryptServiceConn.EraseKey: failed to send email notification after erasing key of %s - %v", rec.UUID, err)
+		}
+	}()
+}
+
+// UpdateKeyReq asks the server to replace the encryption key of an existing record.
+type UpdateKeyReq struct {
+	PlainPassword string // PlainPassword grants access, leave it empty to act on behalf of a computer that is currently holding the key.
+	Hostname      string // Hostname is the client's host name (for logging only).
+	UUID          string // UUID is the record UUID.
+	OldKeyDigest  []byte // OldKeyDigest is the SHA-256 digest of the key that is being replaced.
+	NewKey        []byte // NewKey is the replacement encryption key.
+}
+
+/*
+UpdateKey replaces the encryption key of a record and leaves all other record details, such as allowed clients and mount
+options, in place. Without a password, only a computer that currently holds the key and is allowed to retrieve it may
+replace it. The key is only replaced if the old key digest matches, so that two concurrent rotations cannot overwrite
+each other. Rotation is only supported when keys are stored by the built-in KMIP server.
+*/
+func (rpcConn *CryptServiceConn) UpdateKey(req UpdateKeyReq, _ *DummyAttr) error {
+	if err := keydb.ValidateUUID(req.UUID); err != nil {
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultMissing, "")
+		return fmt.Errorf("UpdateKey: record \"%s\" does not exist", req.UUID)
+	}
+	if req.PlainPassword != "" {
+		if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+			rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultRejected, err.Error())
+			return err
+		}
+	} else if alive, _ := rec.IsHostAlive(rpcConn.RemoteHost); !alive || !rpcConn.Svc.KeyDB.IsClientAllowed(rec, rpcConn.CertDNSName, rpcConn.CertIPAddress) {
+		rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultRejected, "computer is not holding the key")
+		return fmt.Errorf("UpdateKey: %s is not currently holding the key of \"%s\", a password is required", rpcConn.RemoteHost, req.UUID)
+	}
+	if rpcConn.Svc.BuiltInKMIPServer == nil {
+		rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultRejected, "keys are stored on an external KMIP server")
+		return errors.New("UpdateKey: key rotation is not supported when keys are stored on an external KMIP server")
+	}
+	if len(req.NewKey) < MinRotatedKeyLen {
+		rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultRejected, "new key is too short")
+		return fmt.Errorf("UpdateKey: the new key must be at least %d bytes long", MinRotatedKeyLen)
+	}
+	if err := rpcConn.Svc.KeyDB.UpdateKey(req.UUID, req.OldKeyDigest, req.NewKey); err != nil {
+		rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultFailed, err.Error())
+		return err
+	}
+	rpcConn.audit("UpdateKey", req.Hostname, req.UUID, AuditResultGranted, "")
+	log.Printf("CryptServiceConn.UpdateKey: %s (%s) has rotated the key of %s", rpcConn.RemoteHost, req.Hostname, req.UUID)
+	// Send optional notification email in background
+	if rpcConn.Svc.Mailer.ValidateConfig() == nil {
+		go func() {
+			event := MailEvent{Hostname: req.Hostname, UUID: req.UUID, IP: rpcConn.RemoteHost, Owner: rec.Owner, Time: time.Now()}
+			subject := mailSubject(rpcConn.Svc.Config.KeyCreationSubject, event,
+				fmt.Sprintf("%s (%s) %s%s key rotated", rpcConn.RemoteHost, req.Hostname, rec.MountPoint, ownerNote(rec.Owner)))
+			journalRec := rec
+			journalRec.Key = nil
+			text := fmt.Sprintf("%s\r\n\r\n%s", RenderMailTemplate(rpcConn.Svc.Config.KeyCreationGreeting, event), journalRec.FormatAttrs("\r\n"))
+			if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+				rpcConn.Svc.Metrics.CountMailerError()
+				log.Printf("<3>CryptServiceConn.UpdateKey: failed to send email notification after rotating %s (%s)'s key of %s - %v",
+					rpcConn.RemoteHost, req.Hostname, rec.MountPoint, err)
+			}
+		}()
+	}
+	return nil
+}
+
 // A request to shut down the server so that it stops accepting connections.
 type ShutdownReq struct {
 	Challenge []byte
@@ -748,7 +1780,7 @@ func (rpcConn *CryptServiceConn) Shutdown(req ShutdownReq, _ *DummyAttr) error {
 
 // Hand over the salt that was used to hash server's access password.
 func (rpcConn *CryptServiceConn) GetSalt(_ DummyAttr, salt *PasswordSalt) error {
-	copy((*salt)[:], rpcConn.Svc.Config.PasswordSalt[:])
+	*salt, _, _ = rpcConn.Svc.passwordParams()
 	return nil
 }
 
@@ -761,7 +1793,8 @@ type ReloadRecordReq struct {
 
 // ReloadRecord causes exactly one database record to be reloaded from disk.
 func (rpcConn *CryptServiceConn) ReloadRecord(req ReloadRecordReq, _ *DummyAttr) error {
-	if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("ReloadRecord", "", req.UUID, AuditResultRejected, err.Error())
 		return err
 	}
 	if err := rpcConn.Svc.KeyDB.ReloadRecord(req.UUID); err != nil {
@@ -770,6 +1803,328 @@ func (rpcConn *CryptServiceConn) ReloadRecord(req ReloadRecordReq, _ *DummyAttr)
 	return nil
 }
 
+// RelocateKeyReq asks server to change where the encryption key of a record is stored, see keydb.DB.RelocateKey.
+type RelocateKeyReq struct {
+	PlainPassword string // Password is provided by client and validated to grant access to this function.
+	UUID          string // UUID is the UUID of record to be changed.
+	ExpectedID    string // ExpectedID is the ID the record must still refer to.
+	NewID         string // NewID is the KMIP ID of the key, or empty to assign the next sequence number.
+	Key           []byte // Key is the key content to be stored in the record, or nil if the key is stored on KMIP server.
+}
+
+// RelocateKeyResp carries the new ID of the record.
+type RelocateKeyResp struct {
+	ID string
+}
+
+/*
+RelocateKey changes where the encryption key of a record is stored, so that keys can be migrated between key database
+and an external KMIP server while the server is running. The request carries key content, therefore it is only
+accepted from the local domain socket.
+*/
+func (rpcConn *CryptServiceConn) RelocateKey(req RelocateKeyReq, resp *RelocateKeyResp) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("RelocateKey", "", req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	if rpcConn.RemoteHost != "@" {
+		rpcConn.audit("RelocateKey", "", req.UUID, AuditResultRejected, "not connected via domain socket")
+		return errors.New("RelocateKey: the request is only accepted from the domain socket")
+	}
+	id, err := rpcConn.Svc.KeyDB.RelocateKey(req.UUID, req.ExpectedID, req.NewID, req.Key)
+	if err != nil {
+		rpcConn.audit("RelocateKey", "", req.UUID, AuditResultFailed, err.Error())
+		return err
+	}
+	rpcConn.audit("RelocateKey", "", req.UUID, AuditResultGranted, fmt.Sprintf("key ID changed from \"%s\" to \"%s\"", req.ExpectedID, id))
+	resp.ID = id
+	return nil
+}
+
+// GetRecordReq asks server for one record as it is in memory.
+type GetRecordReq struct {
+	PlainPassword string // Password is provided by client and validated to grant access to this function.
+	UUID          string // UUID is the UUID of the record.
+}
+
+// GetRecordResp carries the record without its key.
+type GetRecordResp struct {
+	Record keydb.Record
+}
+
+/*
+GetRecord returns the record as the server holds it in memory, e.g. for the administrator to edit, the key is not
+included. The request is only accepted from the local domain socket.
+*/
+func (rpcConn *CryptServiceConn) GetRecord(req GetRecordReq, resp *GetRecordResp) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("GetRecord", "", req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	if rpcConn.RemoteHost != "@" {
+		rpcConn.audit("GetRecord", "", req.UUID, AuditResultRejected, "not connected via domain socket")
+		return errors.New("GetRecord: the request is only accepted from the domain socket")
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		return fmt.Errorf("GetRecord: %v", rpcConn.Svc.KeyDB.NotFoundError(req.UUID, nil))
+	}
+	rec.Key = nil
+	rec.SealedKey = nil
+	rec.PreviousKey = nil
+	rec.SealedPrev = nil
+	resp.Record = rec
+	return nil
+}
+
+// UpdateRecordFieldsReq carries the administrator's changes to a record.
+type UpdateRecordFieldsReq struct {
+	PlainPassword          string       // Password is provided by client and validated to grant access to this function.
+	Record                 keydb.Record // Record is the record with the changes, its key and usage are ignored.
+	ReplacePendingCommands bool         // ReplacePendingCommands is true if the pending commands of Record replace those of the server.
+}
+
+/*
+UpdateRecordFields saves the administrator's changes to an existing record, see keydb.DB.UpdateFields. The key and the
+record usage the server has gathered in the meantime, such as alive messages, are kept. The request is only accepted
+from the local domain socket.
+*/
+func (rpcConn *CryptServiceConn) UpdateRecordFields(req UpdateRecordFieldsReq, _ *DummyAttr) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("UpdateRecordFields", "", req.Record.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	if rpcConn.RemoteHost != "@" {
+		rpcConn.audit("UpdateRecordFields", "", req.Record.UUID, AuditResultRejected, "not connected via domain socket")
+		return errors.New("UpdateRecordFields: the request is only accepted from the domain socket")
+	}
+	if _, found := rpcConn.Svc.KeyDB.GetByUUID(req.Record.UUID); !found {
+		return fmt.Errorf("UpdateRecordFields: %v", rpcConn.Svc.KeyDB.NotFoundError(req.Record.UUID, nil))
+	}
+	if _, err := rpcConn.Svc.KeyDB.UpdateFields(req.Record, req.ReplacePendingCommands); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ImportRecordsReq asks server to restore records from a backup.
+type ImportRecordsReq struct {
+	PlainPassword string            // Password is provided by client and validated to grant access to this function.
+	Records       map[string][]byte // Records are the record file contents by record UUID.
+}
+
+/*
+ImportRecords creates or replaces records with the record files of a backup, so that a backup can be restored while
+the server is running. The request carries key content, therefore it is only accepted from the local domain socket.
+*/
+func (rpcConn *CryptServiceConn) ImportRecords(req ImportRecordsReq, _ *DummyAttr) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("ImportRecords", "", "", AuditResultRejected, err.Error())
+		return err
+	}
+	if rpcConn.RemoteHost != "@" {
+		rpcConn.audit("ImportRecords", "", "", AuditResultRejected, "not connected via domain socket")
+		return errors.New("ImportRecords: the request is only accepted from the domain socket")
+	}
+	// Validate all records before changing any of them
+	recs := make([]keydb.Record, 0, len(req.Records))
+	for uuid, content := range req.Records {
+		rec, err := rpcConn.Svc.KeyDB.DecodeRecord(content)
+		if err == nil && rec.UUID != uuid {
+			err = fmt.Errorf("the record file carries a different record \"%s\"", rec.UUID)
+		}
+		if err != nil {
+			rpcConn.audit("ImportRecords", "", uuid, AuditResultFailed, err.Error())
+			return fmt.Errorf("ImportRecords: record \"%s\" - %v", uuid, err)
+		}
+		recs = append(recs, rec)
+	}
+	for _, rec := range recs {
+		if err := rpcConn.Svc.KeyDB.ImportRecord(rec); err != nil {
+			rpcConn.audit("ImportRecords", "", rec.UUID, AuditResultFailed, err.Error())
+			return err
+		}
+		rpcConn.audit("ImportRecords", "", rec.UUID, AuditResultGranted, "restored from backup")
+	}
+	return nil
+}
+
+// ListAliveHostsReq asks server for the computers currently using encryption keys.
+type ListAliveHostsReq struct {
+	PlainPassword string // Password is provided by client and validated to grant access to this function.
+	UUID          string // UUID restricts the result to the computers using this record, or all records if empty.
+	Host          string // Host restricts the result to the computers of this IP or host name, or all computers if empty.
+}
+
+// ListAliveHostsResp contains the computers currently using encryption keys.
+type ListAliveHostsResp struct {
+	Hosts []keydb.AliveHost
+}
+
+// ListAliveHosts removes dead hosts from the records in memory, and then returns the computers that are still alive.
+func (rpcConn *CryptServiceConn) ListAliveHosts(req ListAliveHostsReq, resp *ListAliveHostsResp) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		return err
+	}
+	*resp = ListAliveHostsResp{Hosts: rpcConn.Svc.KeyDB.ListAliveHosts(req.UUID, req.Host)}
+	return nil
+}
+
+// GetRecordInfoReq asks for the details of key records.
+type GetRecordInfoReq struct {
+	PlainPassword string   // Password is provided by client and validated to grant access to this function.
+	Hostname      string   // Hostname is the client's host name (for logging only).
+	UUIDs         []string // UUIDs identify the records, any of the device IDs accepted by key records may be used.
+}
+
+// GetRecordInfoResp contains the details of key records, the keys themselves are not included.
+type GetRecordInfoResp struct {
+	Records map[string]keydb.Record // Records are the records found, keyed by the requested UUIDs.
+	Missing []string                // Missing are the requested UUIDs that do not have a record.
+}
+
+/*
+GetRecordInfo returns the details of key records without their keys, e.g. the mount point and mapped name. Unlike key
+retrieval, the request does not count as using the records.
+*/
+func (rpcConn *CryptServiceConn) GetRecordInfo(req GetRecordInfoReq, resp *GetRecordInfoResp) error {
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("GetRecordInfo", req.Hostname, "", AuditResultRejected, err.Error())
+		return err
+	}
+	resp.Records = make(map[string]keydb.Record)
+	resp.Missing = make([]string, 0, 8)
+	for _, uuid := range req.UUIDs {
+		rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid)
+		if !found {
+			resp.Missing = append(resp.Missing, uuid)
+			continue
+		}
+		rec.Key = nil
+		rec.PreviousKey = nil
+		resp.Records[uuid] = rec
+	}
+	return nil
+}
+
+// ListClientDevicesReq asks for the records the client is allowed to unlock.
+type ListClientDevicesReq struct {
+	Hostname string // Hostname is the client's host name (for logging only).
+}
+
+// ListClientDevicesResp contains the records the client is allowed to unlock, without their keys.
+type ListClientDevicesResp struct {
+	Devices []keydb.ClientDevice
+}
+
+/*
+ListClientDevices tells the client which records it is entitled to, identified by its certificate just like key
+retrieval, e.g. so that it can make the mount points in advance. No password is required as only the client's own
+records are listed, and neither their keys nor their other details are handed out.
+*/
+func (rpcConn *CryptServiceConn) ListClientDevices(req ListClientDevicesReq, resp *ListClientDevicesResp) error {
+	resp.Devices = rpcConn.Svc.KeyDB.ListClientDevices(rpcConn.CertDNSName, []string{rpcConn.CertIPAddress}, rpcConn.RemoteHost)
+	rpcConn.audit("ListClientDevices", req.Hostname, "", AuditResultGranted, fmt.Sprintf("%d records", len(resp.Devices)))
+	return nil
+}
+
+// ReportInventoryReq carries the disk inventory of a client computer.
+type ReportInventoryReq struct {
+	Hostname  string          // Hostname is the host name reported by the computer itself.
+	Disks     []InventoryDisk // Disks are the block devices found on the computer.
+	CryptOnly bool            // CryptOnly is true if the disks are only the LUKS and crypt devices, as requested by a pending command.
+}
+
+/*
+ReportInventory saves the disk inventory of the client. The client is identified by its certificate common name, or
+by its host name if it did not present a certificate.
+*/
+func (rpcConn *CryptServiceConn) ReportInventory(req ReportInventoryReq, _ *DummyAttr) error {
+	if rpcConn.Svc.Inventory == nil {
+		return ErrInventoryDisabled
+	}
+	client := rpcConn.CertCN
+	if client == "" {
+		client = req.Hostname
+	}
+	return rpcConn.Svc.Inventory.Save(InventoryReport{
+		Client:    client,
+		Hostname:  req.Hostname,
+		IP:        rpcConn.RemoteHost,
+		Time:      time.Now(),
+		Disks:     req.Disks,
+		CryptOnly: req.CryptOnly,
+	})
+}
+
+// ReportClientErrorReq carries a persistent failure experienced by a client computer with an encrypted disk.
+type ReportClientErrorReq struct {
+	Hostname string // Hostname is the host name reported by the computer itself.
+	UUID     string // UUID is the UUID of the disk that experienced the failure.
+	Class    string // Class is a short category of the failure, e.g. "mount".
+	Message  string // Message is the human readable description of the failure.
+}
+
+/*
+ReportClientError records a persistent failure of a client on the disk's record. Repeated reports of the same class
+from the same client are counted, and the number of reports is limited for each client. The client is identified by
+its certificate common name, or by its IP if it did not present a certificate. If enabled, a notification email is
+sent when a class of failure appears on the record for the first time.
+*/
+func (rpcConn *CryptServiceConn) ReportClientError(req ReportClientErrorReq, _ *DummyAttr) error {
+	if err := keydb.ValidateUUID(req.UUID); err != nil {
+		return err
+	}
+	if len(req.Class) > MaxClientErrorClassLen || !RegexClientErrorClass.MatchString(req.Class) {
+		return fmt.Errorf("ReportClientError: error class \"%s\" should be made of lower case letters, digits, and hyphens", req.Class)
+	}
+	if len(req.Message) > MaxClientErrorMessageLen {
+		req.Message = req.Message[:MaxClientErrorMessageLen]
+	}
+	client := rpcConn.CertCN
+	if client == "" {
+		client = rpcConn.RemoteHost
+	}
+	if !rpcConn.Svc.ClientErrorLimit.Allow(client) {
+		return ErrClientErrorRateLimited
+	}
+	now := time.Now().Unix()
+	newClass, err := rpcConn.Svc.KeyDB.AddClientError(req.UUID, keydb.ClientError{
+		Client:   client,
+		Hostname: req.Hostname,
+		IP:       rpcConn.RemoteHost,
+		Class:    req.Class,
+		Message:  req.Message,
+		LastSeen: now,
+	})
+	if err != nil {
+		return err
+	}
+	if !newClass {
+		return nil
+	}
+	log.Printf("CryptServiceConn.ReportClientError: %s (%s) has reported a new class of error \"%s\" on %s - %s",
+		rpcConn.RemoteHost, req.Hostname, req.Class, req.UUID, req.Message)
+	// Send optional notification email in background
+	if rpcConn.Svc.Config.ClientErrorMail && rpcConn.Svc.Mailer.ValidateConfig() == nil {
+		go func() {
+			rec, _ := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+			event := MailEvent{Hostname: req.Hostname, UUID: req.UUID, IP: rpcConn.RemoteHost, Owner: rec.Owner, Time: time.Now()}
+			subject := mailSubject(rpcConn.Svc.Config.ClientErrorSubject, event, fmt.Sprintf("%s (%s) %s%s", rpcConn.RemoteHost, req.Hostname, req.UUID, ownerNote(rec.Owner)))
+			text := fmt.Sprintf("UUID: %s\r\nClient: %s\r\nClass: %s\r\nMessage: %s\r\n", req.UUID, client, req.Class, req.Message)
+			if rec.Owner != "" {
+				text += fmt.Sprintf("Owner: %s\r\n", rec.Owner)
+			}
+			if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+				rpcConn.Svc.Metrics.CountMailerError()
+				log.Printf("<3>CryptServiceConn.ReportClientError: failed to send email notification about %s (%s)'s error on %s - %v",
+					rpcConn.RemoteHost, req.Hostname, req.UUID, err)
+			}
+		}()
+	}
+	return nil
+}
+
 // PollCommandReq instructs server to return the oldest unseen pending command associated with requested UUIDs.
 type PollCommandReq struct {
 	UUIDs []string // UUIDs is an array of UUID to poll commands from.
@@ -777,17 +2132,27 @@ type PollCommandReq struct {
 
 // PollCommandResp contains the oldest unseen pending command from each of requested UUIDs.
 type PollCommandResp struct {
-	Commands map[string][]keydb.PendingCommand
+	Commands   map[string][]keydb.PendingCommand
+	ServerTime time.Time // ServerTime is the server's clock at the moment of response, by which client tells whether a command expired.
 }
 
-// PollCommand returns exactly one unseen pending command.
+/*
+PollCommand returns exactly one unseen pending command. Expired commands are left out by the server's clock, so a
+client whose clock is behind does not receive them.
+*/
 func (rpcConn *CryptServiceConn) PollCommand(req PollCommandReq, resp *PollCommandResp) error {
-	*resp = PollCommandResp{Commands: make(map[string][]keydb.PendingCommand)}
+	now := time.Now()
+	*resp = PollCommandResp{Commands: make(map[string][]keydb.PendingCommand), ServerTime: now}
 	counter := 0
 	for _, uuid := range req.UUIDs {
 		rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid)
 		if !found {
-			// Not-found UUID is not an error condition
+			// Not-found UUID is not an error condition, though the computer may still keep a sealed copy of the erased record
+			if cmd, found := rpcConn.Svc.KeyDB.PollSealedPurge(uuid, rpcConn.RemoteHost, now); found {
+				resp.Commands[uuid] = []keydb.PendingCommand{cmd}
+				rpcConn.audit("PollCommand", "", uuid, AuditResultGranted, fmt.Sprintf("command \"%v\" is delivered", cmd.Content))
+				counter++
+			}
 			continue
 		}
 		cmds, found := rec.PendingCommands[rpcConn.RemoteHost]
@@ -796,14 +2161,15 @@ func (rpcConn *CryptServiceConn) PollCommand(req PollCommandReq, resp *PollComma
 			continue
 		}
 		for _, cmd := range cmds {
-			if cmd.IsValid() && !cmd.SeenByClient {
+			if cmd.IsValidAt(now) && !cmd.SeenByClient {
 				if _, found := resp.Commands[uuid]; !found {
 					resp.Commands[uuid] = make([]keydb.PendingCommand, 0, 1)
 				}
 				// Respond with the oldest yet still valid pending command of the record
 				resp.Commands[uuid] = append(resp.Commands[uuid], cmd)
 				// The command is now "seen" by client.
-				rpcConn.Svc.KeyDB.UpdateSeenFlag(uuid, rpcConn.RemoteHost, cmd.Content)
+				rpcConn.Svc.KeyDB.UpdateSeenFlag(uuid, rpcConn.RemoteHost, cmd.ID, cmd.Content)
+				rpcConn.audit("PollCommand", "", uuid, AuditResultGranted, fmt.Sprintf("command \"%v\" is delivered", cmd.Content))
 				counter++
 				break
 			}
@@ -822,5 +2188,42 @@ type SaveCommandResultReq struct {
 // SaveCommandResult saves execution result of a pending command.
 func (rpcConn *CryptServiceConn) SaveCommandResult(req SaveCommandResultReq, _ *DummyAttr) error {
 	rpcConn.Svc.KeyDB.UpdateCommandResult(req.UUID, rpcConn.RemoteHost, req.CommandContent, req.Result)
+	rpcConn.audit("SaveCommandResult", "", req.UUID, AuditResultGranted, fmt.Sprintf("command \"%v\" result: %s", req.CommandContent, req.Result))
+	return nil
+}
+
+// ReportCommandResultReq tells whether a pending command previously polled by a client has been carried out successfully.
+type ReportCommandResultReq struct {
+	UUID           string        // UUID is the UUID of record.
+	CommandID      string        // CommandID is the ID of the command as it was originally received, empty if the command has none.
+	ValidFrom      time.Time     // ValidFrom is the moment the command was issued, as it was originally received.
+	CommandContent interface{}   // CommandContent is the content of pending command as it was originally received.
+	Succeeded      bool          // Succeeded is true if the command was carried out successfully.
+	Message        string        // Message is a short human readable description of the outcome, e.g. the reason of failure.
+	Duration       time.Duration // Duration is how long it took to carry out the command, older clients leave it zero.
+}
+
+/*
+ReportCommandResult saves the outcome of a pending command on the record and persists it immediately. The command is
+identified by its ID, or by the moment it was issued along with its content if the client does not tell the ID, so
+that a repeated command is not confused with an earlier one.
+*/
+func (rpcConn *CryptServiceConn) ReportCommandResult(req ReportCommandResultReq, _ *DummyAttr) error {
+	if err := keydb.ValidateUUID(req.UUID); err != nil {
+		return err
+	}
+	if len(req.Message) > MaxCommandResultLen {
+		req.Message = req.Message[:MaxCommandResultLen]
+	}
+	if !rpcConn.Svc.KeyDB.SetCommandResult(req.UUID, rpcConn.RemoteHost, req.CommandID, req.ValidFrom, req.CommandContent, req.Succeeded, req.Message, req.Duration) &&
+		!(req.CommandContent == keydb.PurgeSealedCommand && rpcConn.Svc.KeyDB.SetSealedPurgeResult(req.UUID, rpcConn.RemoteHost, req.CommandID, req.Succeeded)) {
+		rpcConn.audit("ReportCommandResult", "", req.UUID, AuditResultMissing, fmt.Sprintf("command \"%v\" is not pending for %s", req.CommandContent, rpcConn.RemoteHost))
+		return fmt.Errorf("ReportCommandResult: command \"%v\" of %s is not pending for this computer", req.CommandContent, req.UUID)
+	}
+	auditResult := AuditResultGranted
+	if !req.Succeeded {
+		auditResult = AuditResultFailed
+	}
+	rpcConn.audit("ReportCommandResult", "", req.UUID, auditResult, fmt.Sprintf("command \"%v\" result: %s", req.CommandContent, req.Message))
 	return nil
 }
@@ -3,13 +3,26 @@
 package keyserv
 
 import (
+	"bytes"
+	"cryptctl2/keydb"
 	"crypto/sha512"
+	"encoding/gob"
 	"encoding/hex"
+	"io/ioutil"
+	"os"
 	"path"
 	"reflect"
 	"testing"
+	"time"
 )
 
+func init() {
+	// Test cases read certificates and the sysconfig template from this source tree, wherever it is checked out.
+	if wd, err := os.Getwd(); err == nil {
+		PkgInGopath = path.Dir(wd)
+	}
+}
+
 func TestHashPassword(t *testing.T) {
 	salt := [sha512.Size]byte{
 		0, 0, 0, 0, 0, 0, 0, 0,
@@ -95,23 +108,212 @@ func TestServiceReadFromSysconfig(t *testing.T) {
 	if err := svcConf.ReadFromSysconfig(sysconf); err != nil {
 		t.Fatal(err)
 	}
+	// The settings left out of the sysconfig take their defaults
 	if !reflect.DeepEqual(svcConf, CryptServiceConfig{
-		PasswordHash:         hash,
-		PasswordSalt:         salt,
-		CertPEM:              path.Join(PkgInGopath, "keyserv", "rpc_test.crt"),
-		KeyPEM:               path.Join(PkgInGopath, "keyserv", "rpc_test.key"),
-		Address:              "1.1.1.1",
-		Port:                 1234,
-		KeyDBDir:             "/abc",
-		KeyCreationSubject:   "a",
-		KeyCreationGreeting:  "b",
-		KeyRetrievalSubject:  "c",
-		KeyRetrievalGreeting: "d",
-		KMIPAddresses:        []string{},
-		KMIPTLSDoVerify:      true,
+		PasswordHash:            hash,
+		PasswordSalt:            salt,
+		CertAuthorityPEM:        "/var/lib/cryptctl2/certs/ca.crt",
+		CertRevocationListPEM:   "/var/lib/cryptctl2/certs/ca.crl",
+		AdminClientCNs:          []string{},
+		CertPEM:                 path.Join(PkgInGopath, "keyserv", "rpc_test.crt"),
+		KeyPEM:                  path.Join(PkgInGopath, "keyserv", "rpc_test.key"),
+		Address:                 "1.1.1.1",
+		Port:                    1234,
+		KeyDBDir:                "/abc",
+		KeyDBVersionsKept:       5,
+		KeyDBAliveFlushSec:      5,
+		KeyCreationSubject:      "a",
+		KeyCreationGreeting:     "b",
+		KeyRetrievalSubject:     "c",
+		KeyRetrievalGreeting:    "d",
+		KMIPAddresses:           []string{},
+		KMIPTLSDoVerify:         true,
+		AuditLogPath:            "/var/log/cryptctl2/audit.log",
+		InventoryDir:            "/var/lib/cryptctl2/inventory",
+		InventoryRetention:      30,
+		ClientErrorSubject:      "A computer has failed to use an encrypted file system",
+		LostHostSubject:         "A computer has stopped reporting while holding an encryption key",
+		LostHostDebounceMinutes: 60,
+		AuthMaxFailures:         5,
+		AuthLockoutMinutes:      15,
+		LockoutSubject:          "A computer is locked out after too many incorrect passwords",
+		ClientCallsPerMinute:    120,
+		LostHostUmountHours:     24,
+		MetricsPort:             3739,
+		HTTPAPIPort:             3740,
+		RejectionsPersist:       true,
+		RetrievalHistorySize:    100,
+		KeyDBMasterKeyFile:      "/etc/cryptctl2/keydb-master.key",
+		KeyDBMasterKeySalt:      []byte{},
+		BackupIntervalHours:     24,
+		BackupKeep:              7,
+		CertExpiryWarnDays:      30,
+		TLSMinVersion:           "1.2",
+		TLSCipherSuites:         []string{},
 	}) {
 		t.Fatalf("%+v", svcConf)
 	}
 }
 
 // RPC functions are tested by CryptClient test cases.
+
+func TestNormaliseRemoteHost(t *testing.T) {
+	for input, expected := range map[string]string{
+		"192.168.1.2":      "192.168.1.2",
+		"::ffff:10.0.0.1":  "10.0.0.1",
+		"::1":              "127.0.0.1",
+		"2001:DB8:0:0::1":  "2001:db8::1",
+		"@":                "@",
+		"host.example.com": "host.example.com",
+	} {
+		if actual := NormaliseRemoteHost(input); actual != expected {
+			t.Fatal(input, actual, expected)
+		}
+	}
+}
+
+func TestCapabilitiesCompatibility(t *testing.T) {
+	// A client built against the very first version of Capabilities must be able to decode a newer response
+	type capabilitiesV1 struct {
+		ProtocolVersion int
+		ReplicationRole string
+	}
+	caps := Capabilities{
+		ProtocolVersion:    ProtocolVersion,
+		Features:           map[string]bool{FeatureAuditLog: true},
+		ReplicationRole:    "standalone",
+		MaxUUIDsPerRequest: 1,
+		CertNotAfter:       time.Now(),
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(caps); err != nil {
+		t.Fatal(err)
+	}
+	var old capabilitiesV1
+	if err := gob.NewDecoder(&buf).Decode(&old); err != nil {
+		t.Fatal(err)
+	}
+	if old.ProtocolVersion != ProtocolVersion || old.ReplicationRole != "standalone" {
+		t.Fatalf("%+v", old)
+	}
+}
+
+func TestServerReloadAndGracefulShutdown(t *testing.T) {
+	client, server, _ := StartTestServer(t)
+	defer os.RemoveAll(server.Config.KeyDBDir)
+	// Another program (e.g. edit-key) writes a record directly into the database directory
+	db, err := keydb.OpenDB(server.Config.KeyDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "a-a-a-a", Key: []byte{1, 2, 3}, MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := server.KeyDB.GetByUUID("a-a-a-a"); found {
+		t.Fatal("record should not be loaded yet")
+	}
+	newConf := server.Config
+	newConf.KeyRetrievalSubject = "new subject"
+	newConf.Port = server.Config.Port + 1
+	if err := server.Reload(newConf, Mailer{FromAddress: "root@localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := server.KeyDB.GetByUUID("a-a-a-a"); !found {
+		t.Fatal("record was not reloaded")
+	}
+	// Listener settings only change after a restart
+	if server.Config.KeyRetrievalSubject != "new subject" || server.Config.Port == newConf.Port || server.Mailer.FromAddress != "root@localhost" {
+		t.Fatal(server.Config, server.Mailer)
+	}
+	// The server keeps serving after reload
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	if !server.GracefulShutdown(5 * time.Second) {
+		t.Fatal("connections did not finish")
+	}
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("server did not shut down")
+	}
+}
+
+func TestCreateKeyValidationAndImport(t *testing.T) {
+	client, _, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	newReq := func(uuid, mappedName string) CreateKeyReq {
+		return CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "client-host", UUID: uuid, MappedName: mappedName,
+			MountPoint: "/" + uuid, MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}
+	}
+	if _, err := client.CreateKey(newReq("aaa", "data-a")); err != nil {
+		t.Fatal(err)
+	}
+	importedKey := bytes.Repeat([]byte{7}, 32)
+	rejections := map[string]func(*CreateKeyReq){
+		"existing record":          func(req *CreateKeyReq) { req.UUID = "aaa" },
+		"key of existing record":   func(req *CreateKeyReq) { req.UUID, req.UpdateExisting, req.KeyContent = "aaa", true, importedKey },
+		"mapped name in use":       func(req *CreateKeyReq) { req.MappedName = "data-a" },
+		"mapped name with slash":   func(req *CreateKeyReq) { req.MappedName = "data/b" },
+		"auto encryption no fs":    func(req *CreateKeyReq) { req.AutoEncryption = true },
+		"auto encryption bad fs":   func(req *CreateKeyReq) { req.AutoEncryption, req.FileSystem = true, "vfat" },
+		"auto encryption imported": func(req *CreateKeyReq) { req.AutoEncryption, req.FileSystem, req.KeyContent = true, "xfs", importedKey },
+		"short imported key":       func(req *CreateKeyReq) { req.KeyContent = []byte("short") },
+		"bad allowed client":       func(req *CreateKeyReq) { req.AllowedClients = []string{"bad client/99"} },
+	}
+	for name, modify := range rejections {
+		req := newReq("bbb", "data-b")
+		modify(&req)
+		if _, err := client.CreateKey(req); err == nil {
+			t.Fatal(name, "did not error")
+		}
+	}
+	// Import the key of a disk encrypted elsewhere
+	req := newReq("bbb", "data-b")
+	req.KeyContent = importedKey
+	if _, err := client.CreateKey(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "client-host", UUIDs: []string{"bbb"}})
+	if err != nil || !bytes.Equal(resp.Granted["bbb"].Key, importedKey) {
+		t.Fatal(resp, err)
+	}
+	// Update the attributes of the existing record and keep its key
+	req = newReq("bbb", "data-b2")
+	req.MountPoint = "/b2"
+	req.UpdateExisting = true
+	if _, err := client.CreateKey(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.ManualRetrieveKey(ManualRetrieveKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "client-host", UUIDs: []string{"bbb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := resp.Granted["bbb"]; !bytes.Equal(rec.Key, importedKey) || rec.MountPoint != "/b2" || rec.MappedName != "data-b2" {
+		t.Fatalf("%+v", rec)
+	}
+}
+
+func TestReportAliveOfflineUnlocks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := NewAuditLog(path.Join(tmpDir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: &CryptServer{KeyDB: db, Audit: audit}}
+	var rejected []string
+	if err := conn.ReportAlive(ReportAliveReq{Hostname: "db-1", OfflineUnlocks: map[string]int64{"sealed": 100}}, &rejected); err != nil || len(rejected) != 0 {
+		t.Fatal(rejected, err)
+	}
+	audit.Close()
+	events, err := ReadAuditLog(audit.Path, AuditFilter{UUID: "sealed"})
+	if err != nil || len(events) != 1 || events[0].Event != "OfflineUnlock" || events[0].IP != "10.0.0.1" || events[0].Hostname != "db-1" {
+		t.Fatal(events, err)
+	}
+}
@@ -0,0 +1,157 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	SRV_CONF_TLS_MIN_VERSION   = "TLS_MIN_VERSION"
+	SRV_CONF_TLS_CIPHER_SUITES = "TLS_CIPHER_SUITES"
+
+	DefaultTLSMinVersion = "1.2" // DefaultTLSMinVersion is the oldest TLS version accepted from clients if configuration does not specify one.
+)
+
+// The TLS versions that may be configured as the minimum, by their name in sysconfig.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version of the name ("1.0" to "1.3"), an empty name means DefaultTLSMinVersion.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		name = DefaultTLSMinVersion
+	}
+	version, found := tlsVersions[strings.TrimPrefix(strings.TrimPrefix(name, "TLS"), "v")]
+	if !found {
+		return 0, fmt.Errorf("ParseTLSVersion: unknown TLS version \"%s\", use 1.0, 1.1, 1.2, or 1.3", name)
+	}
+	return version, nil
+}
+
+// TLSVersionName returns the name of the TLS version as it is written in sysconfig.
+func TLSVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+/*
+ParseCipherSuites returns the IDs of the cipher suites given by their standard names, e.g.
+"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384". An unknown name is an error, and so is a suite considered insecure. An empty
+list means the default suites of the Go TLS library. The suites of TLS 1.3 are not configurable.
+*/
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		var id uint16
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				id = suite.ID
+			}
+		}
+		for _, suite := range tls.InsecureCipherSuites() {
+			if suite.Name == name {
+				return nil, fmt.Errorf("ParseCipherSuites: cipher suite \"%s\" is insecure", name)
+			}
+		}
+		if id == 0 {
+			return nil, fmt.Errorf("ParseCipherSuites: unknown cipher suite \"%s\"", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+/*
+CertFingerprint returns the SHA256 fingerprint of the first certificate in the PEM file, in the colon separated form
+printed by "openssl x509 -fingerprint -sha256". It is empty if the file cannot be read or carries no certificate.
+*/
+func CertFingerprint(pemPath string) string {
+	if pemPath == "" {
+		return ""
+	}
+	content, err := ioutil.ReadFile(pemPath)
+	if err != nil {
+		return ""
+	}
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return ""
+		}
+		return FingerprintOf(block.Bytes)
+	}
+	return ""
+}
+
+// FingerprintOf returns the SHA256 fingerprint of the DER-encoded certificate in the colon separated form.
+func FingerprintOf(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexDigits := make([]string, len(sum))
+	for i, b := range sum {
+		hexDigits[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexDigits, ":")
+}
+
+// TLSSummary describes how the server's TLS listener is set up, so that auditors can verify it.
+type TLSSummary struct {
+	ListenAddress        string   // ListenAddress is the "address:port" of TLS listener.
+	MinVersion           string   // MinVersion is the oldest TLS version accepted from clients.
+	CipherSuites         []string // CipherSuites are the configured cipher suites, empty if the defaults of Go TLS library are used.
+	ClientCertValidation bool     // ClientCertValidation is true if clients must present a certificate signed by the CA.
+	CAFingerprint        string   // CAFingerprint is the SHA256 fingerprint of the CA certificate, empty if CA is not configured.
+}
+
+func (summary TLSSummary) String() string {
+	suites := "default"
+	if len(summary.CipherSuites) > 0 {
+		suites = strings.Join(summary.CipherSuites, ",")
+	}
+	validation := "off"
+	if summary.ClientCertValidation {
+		validation = "on"
+	}
+	fingerprint := summary.CAFingerprint
+	if fingerprint == "" {
+		fingerprint = "none"
+	}
+	return fmt.Sprintf("address %s, TLS min version %s, cipher suites %s, client certificate validation %s, CA fingerprint %s",
+		summary.ListenAddress, summary.MinVersion, suites, validation, fingerprint)
+}
+
+// GetTLSSummary describes the TLS settings of the server's configuration.
+func (conf *CryptServiceConfig) GetTLSSummary() TLSSummary {
+	minVersion, err := ParseTLSVersion(conf.TLSMinVersion)
+	if err != nil {
+		minVersion = tls.VersionTLS12
+	}
+	return TLSSummary{
+		ListenAddress:        net.JoinHostPort(conf.Address, strconv.Itoa(conf.Port)),
+		MinVersion:           TLSVersionName(minVersion),
+		CipherSuites:         conf.TLSCipherSuites,
+		ClientCertValidation: conf.ValidateClientCert,
+		CAFingerprint:        CertFingerprint(conf.CertAuthorityPEM),
+	}
+}
@@ -0,0 +1,55 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for name, expected := range map[string]uint16{"": tls.VersionTLS12, "1.0": tls.VersionTLS10, "1.3": tls.VersionTLS13, "TLSv1.2": tls.VersionTLS12} {
+		if version, err := ParseTLSVersion(name); err != nil || version != expected {
+			t.Fatal(name, version, err)
+		}
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Fatal("did not error")
+	}
+	if name := TLSVersionName(tls.VersionTLS13); name != "1.3" {
+		t.Fatal(name)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	if ids, err := ParseCipherSuites(nil); err != nil || ids != nil {
+		t.Fatal(ids, err)
+	}
+	ids, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil || !reflect.DeepEqual(ids, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Fatal(ids, err)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil || !strings.Contains(err.Error(), "insecure") {
+		t.Fatal(err)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_NO_SUCH_SUITE"}); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTLSSummary(t *testing.T) {
+	conf := CryptServiceConfig{Address: "0.0.0.0", Port: 3737, ValidateClientCert: true, CertAuthorityPEM: path.Join(PkgInGopath, "keyserv", "rpc_test.crt")}
+	summary := conf.GetTLSSummary()
+	if summary.ListenAddress != "0.0.0.0:3737" || summary.MinVersion != "1.2" || !summary.ClientCertValidation || len(summary.CAFingerprint) != 32*3-1 {
+		t.Fatalf("%+v", summary)
+	}
+	if text := summary.String(); !strings.Contains(text, "client certificate validation on") || !strings.Contains(text, "cipher suites default") {
+		t.Fatal(text)
+	}
+	if CertFingerprint("/this/file/does/not/exist") != "" {
+		t.Fatal("fingerprint of missing file")
+	}
+}
@@ -0,0 +1,100 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/sys"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	CLIENT_CONF_SERVER_FINGERPRINT = "TLS_SERVER_FINGERPRINT"
+	CLIENT_CONF_VERIFY_HOSTNAME    = "TLS_VERIFY_HOSTNAME"
+)
+
+/*
+TLSVerification are the client's settings of trusting the key server certificate, in addition to the CA. A pinned
+fingerprint replaces the CA: the server is trusted if and only if it presents exactly that certificate, which suits
+sites where distributing a CA is not worthwhile.
+*/
+type TLSVerification struct {
+	Fingerprint  string // Fingerprint is the expected SHA256 fingerprint of the server certificate, empty to verify by CA.
+	SkipHostname bool   // SkipHostname is true if the server certificate does not have to carry the server's host name or IP.
+}
+
+// TLSVerificationFromSysconfig reads the settings of trusting the key server certificate from client sysconfig.
+func TLSVerificationFromSysconfig(sysconf *sys.Sysconfig) TLSVerification {
+	return TLSVerification{
+		Fingerprint:  sysconf.GetString(CLIENT_CONF_SERVER_FINGERPRINT, ""),
+		SkipHostname: !sysconf.GetBool(CLIENT_CONF_VERIFY_HOSTNAME, true),
+	}
+}
+
+/*
+NormaliseFingerprint turns the SHA256 fingerprint, either in the colon separated form printed by "openssl x509
+-fingerprint -sha256" or as plain hex digits, into the colon separated form.
+*/
+func NormaliseFingerprint(fingerprint string) (string, error) {
+	digits := strings.ToUpper(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimPrefix(strings.TrimSpace(fingerprint), "SHA256 Fingerprint=")))
+	if raw, err := hex.DecodeString(digits); err != nil || len(raw) != 32 {
+		return "", fmt.Errorf("NormaliseFingerprint: \"%s\" is not a SHA256 fingerprint of 64 hex digits", fingerprint)
+	}
+	pairs := make([]string, 0, 32)
+	for i := 0; i < len(digits); i += 2 {
+		pairs = append(pairs, digits[i:i+2])
+	}
+	return strings.Join(pairs, ":"), nil
+}
+
+// Verify the certificate chain presented by the server contacted by the host name or IP, see TLSVerification.
+func verifyServerCert(state tls.ConnectionState, host string, roots *x509.CertPool, fingerprint string, checkHostname bool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	if fingerprint != "" {
+		if presented := FingerprintOf(leaf.Raw); presented != fingerprint {
+			return fmt.Errorf("server certificate fingerprint does not match, expected %s but the server presented %s", fingerprint, presented)
+		}
+	} else {
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return err
+		}
+	}
+	if checkHostname {
+		return leaf.VerifyHostname(host)
+	}
+	return nil
+}
+
+// SetTLSVerification changes how the client trusts the key server certificate of TCP connections, see TLSVerification.
+func (client *CryptClient) SetTLSVerification(verify TLSVerification) error {
+	fingerprint := ""
+	if verify.Fingerprint != "" {
+		var err error
+		if fingerprint, err = NormaliseFingerprint(verify.Fingerprint); err != nil {
+			return err
+		}
+	}
+	if fingerprint == "" && !verify.SkipHostname {
+		// The Go TLS library verifies the chain and host name by itself
+		client.tlsConfig.InsecureSkipVerify = false
+		client.verifyServer = nil
+		return nil
+	}
+	roots := client.tlsConfig.RootCAs
+	// The built-in verification is replaced by the one below for each connection
+	client.verifyServer = func(state tls.ConnectionState, host string) error {
+		return verifyServerCert(state, host, roots, fingerprint, !verify.SkipHostname)
+	}
+	return nil
+}
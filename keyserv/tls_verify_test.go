@@ -0,0 +1,136 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormaliseFingerprint(t *testing.T) {
+	colons := strings.Repeat("AB:", 31) + "CD"
+	for _, input := range []string{colons, strings.ToLower(colons), strings.Repeat("ab", 31) + "cd", "SHA256 Fingerprint=" + colons} {
+		if fingerprint, err := NormaliseFingerprint(input); err != nil || fingerprint != colons {
+			t.Fatal(input, fingerprint, err)
+		}
+	}
+	for _, input := range []string{"", "AB:CD", strings.Repeat("zz", 32)} {
+		if _, err := NormaliseFingerprint(input); err == nil {
+			t.Fatal("did not error", input)
+		}
+	}
+}
+
+func TestVerifyServerCert(t *testing.T) {
+	_, _, caCert, caKey := makeTestCert(t, 1, time.Now().Add(time.Hour), nil, nil)
+	_, _, leaf, _ := makeTestCert(t, 2, time.Now().Add(time.Hour), caCert, caKey)
+	_, _, other, _ := makeTestCert(t, 3, time.Now().Add(time.Hour), nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := verifyServerCert(state, host, roots, "", true); err != nil {
+			t.Fatal(host, err)
+		}
+	}
+	// Host name is checked unless turned off
+	if err := verifyServerCert(state, "10.0.0.1", roots, "", true); err == nil {
+		t.Fatal("did not check host name")
+	}
+	if err := verifyServerCert(state, "10.0.0.1", roots, "", false); err != nil {
+		t.Fatal(err)
+	}
+	// A certificate of another CA is rejected, unless its fingerprint is pinned
+	state.PeerCertificates = []*x509.Certificate{other}
+	if err := verifyServerCert(state, "localhost", roots, "", false); err == nil {
+		t.Fatal("did not check CA")
+	}
+	if err := verifyServerCert(state, "localhost", nil, FingerprintOf(other.Raw), false); err != nil {
+		t.Fatal(err)
+	}
+	err := verifyServerCert(state, "localhost", nil, FingerprintOf(leaf.Raw), false)
+	if err == nil || !strings.Contains(err.Error(), FingerprintOf(leaf.Raw)) || !strings.Contains(err.Error(), FingerprintOf(other.Raw)) {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptClient_SetTLSVerification(t *testing.T) {
+	client, err := NewCryptClient("tcp", "localhost:3737", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetTLSVerification(TLSVerification{Fingerprint: "bad"}); err == nil {
+		t.Fatal("did not error on bad fingerprint")
+	}
+	if err := client.SetTLSVerification(TLSVerification{Fingerprint: strings.Repeat("ab", 32)}); err != nil || client.verifyServer == nil {
+		t.Fatal(err)
+	}
+	if tlsConfig := client.tlsConfigFor("localhost:3737"); !tlsConfig.InsecureSkipVerify || tlsConfig.VerifyConnection == nil || tlsConfig.ServerName != "localhost" {
+		t.Fatal(tlsConfig)
+	}
+	if err := client.SetTLSVerification(TLSVerification{}); err != nil || client.tlsConfig.InsecureSkipVerify || client.verifyServer != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig := client.tlsConfigFor("[::1]:3737"); tlsConfig.InsecureSkipVerify || tlsConfig.VerifyConnection != nil || tlsConfig.ServerName != "::1" {
+		t.Fatal(tlsConfig)
+	}
+}
+
+func TestCryptClient_VerifyServerByIP(t *testing.T) {
+	caPEM, _, caCert, caKey := makeTestCert(t, 1, time.Now().Add(time.Hour), nil, nil)
+	leafPEM, leafKeyPEM, leaf, _ := makeTestCert(t, 2, time.Now().Add(time.Hour), caCert, caKey)
+	serverCert, err := tls.X509KeyPair(leafPEM, leafKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server is contacted by its IP, which the connection state does not tell
+	for _, listenAddr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listener, err := tls.Listen("tcp", listenAddr, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+		if err != nil {
+			if listenAddr == "[::1]:0" {
+				t.Log("IPv6 is not available -", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		address := listener.Addr().String()
+		for _, verify := range []TLSVerification{{}, {Fingerprint: FingerprintOf(leaf.Raw)}, {Fingerprint: FingerprintOf(leaf.Raw), SkipHostname: true}} {
+			client, err := NewCryptClient("tcp", address, caPEM, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.SetTLSVerification(verify); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := client.dialTCP(address)
+			if err != nil {
+				t.Fatal(address, verify, err)
+			}
+			conn.Close()
+			// The server name of the settings takes precedence over the address
+			client.tlsConfig.ServerName = "db.example.com"
+			if conn, err := client.dialTCP(address); err == nil {
+				conn.Close()
+				if !verify.SkipHostname {
+					t.Fatal("did not check host name", address, verify)
+				}
+			} else if verify.SkipHostname {
+				t.Fatal(address, verify, err)
+			}
+		}
+		listener.Close()
+	}
+}
@@ -0,0 +1,137 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	MaxUnlockTokenValidity = 30 * 24 * time.Hour // MaxUnlockTokenValidity is the longest time an unlock token may stay valid.
+)
+
+// CreateUnlockTokenReq asks for a new one-time unlock token of a record.
+type CreateUnlockTokenReq struct {
+	PlainPassword string        // PlainPassword is the access password.
+	UUID          string        // UUID is the record the token unlocks, no other record accepts the token.
+	Hostname      string        // Hostname optionally restricts the computer that may use the token, by IP or validated certificate name.
+	Validity      time.Duration // Validity is how long the token may be used, up to MaxUnlockTokenValidity.
+}
+
+// CreateUnlockTokenResp carries the token, which is never shown again, along with its record.
+type CreateUnlockTokenResp struct {
+	Token       string            // Token is the secret to be handed to whoever unlocks the disk.
+	UnlockToken keydb.UnlockToken // UnlockToken is the token as it is kept on the record.
+}
+
+/*
+CreateUnlockToken makes a new random token that lets a computer retrieve the key of the record once, without the
+password and regardless of allowed clients. Only the digest of the token is kept. It may only be called via the domain
+socket.
+*/
+func (rpcConn *CryptServiceConn) CreateUnlockToken(req CreateUnlockTokenReq, resp *CreateUnlockTokenResp) error {
+	if rpcConn.RemoteHost != "@" {
+		rpcConn.audit("CreateUnlockToken", "", req.UUID, AuditResultRejected, "not connected via domain socket")
+		return errors.New("CreateUnlockToken: unlock tokens may only be created via the domain socket")
+	}
+	if err := rpcConn.validatePassword(req.PlainPassword); err != nil {
+		rpcConn.audit("CreateUnlockToken", "", req.UUID, AuditResultRejected, err.Error())
+		return err
+	}
+	if req.Validity <= 0 || req.Validity > MaxUnlockTokenValidity {
+		return fmt.Errorf("CreateUnlockToken: the validity must be between 1 second and %s", MaxUnlockTokenValidity)
+	}
+	if _, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID); !found {
+		return fmt.Errorf("CreateUnlockToken: %v", rpcConn.Svc.KeyDB.NotFoundError(req.UUID, nil))
+	}
+	token, tokenRec := keydb.NewUnlockToken(req.Hostname, req.Validity)
+	if err := rpcConn.Svc.KeyDB.AddUnlockToken(req.UUID, tokenRec); err != nil {
+		rpcConn.audit("CreateUnlockToken", "", req.UUID, AuditResultFailed, err.Error())
+		return err
+	}
+	detail := fmt.Sprintf("token %s valid until %s", tokenRec.ID, tokenRec.ExpiresAt.Format(time.RFC3339))
+	if tokenRec.Hostname != "" {
+		detail += " for " + tokenRec.Hostname
+	}
+	log.Printf("CryptServiceConn.CreateUnlockToken: %s has created unlock %s of %s", rpcConn.requester(), detail, req.UUID)
+	rpcConn.audit("CreateUnlockToken", "", req.UUID, AuditResultGranted, detail)
+	resp.Token = token
+	resp.UnlockToken = tokenRec
+	return nil
+}
+
+// TokenRetrieveKeyReq presents a one-time unlock token in place of the password.
+type TokenRetrieveKeyReq struct {
+	Token    string   // Token is the secret of the unlock token.
+	UUIDs    []string // UUIDs are the IDs of the (locked) file system, the token only unlocks the record it was created for.
+	Hostname string   // Hostname is the client's host name (for logging only).
+}
+
+// TokenRetrieveKeyResp is the response to key retrieval by unlock token.
+type TokenRetrieveKeyResp struct {
+	Granted map[string]keydb.Record // Granted is the only key granted to the requester.
+}
+
+/*
+TokenRetrieveKey hands out the key of the record that carries the unlock token, and uses up the token. Allowed clients
+and the number of active computers are not checked, the host restriction of the token is. Each use, successful or not,
+is audited, and the administrator is notified of a successful one.
+*/
+func (rpcConn *CryptServiceConn) TokenRetrieveKey(req TokenRetrieveKeyReq, resp *TokenRetrieveKeyResp) error {
+	if err := rpcConn.rejectInMaintenance("TokenRetrieveKey", req.Hostname, req.UUIDs); err != nil {
+		return err
+	}
+	requester := rpcConn.newRequester(req.Hostname)
+	/*
+		The host name in request is told by the client itself, hence it does not satisfy the token's host restriction,
+		neither do the names in a client certificate that has not been validated.
+	*/
+	names := []string{rpcConn.RemoteHost}
+	if rpcConn.Svc.Config.ValidateClientCert {
+		names = append(names, rpcConn.CertDNSName, rpcConn.CertIPAddress, rpcConn.CertCN)
+	}
+	rec, token, detail, err := rpcConn.Svc.KeyDB.UseUnlockToken(req.Token, requester, names, req.UUIDs...)
+	if err != nil {
+		log.Printf("CryptServiceConn.TokenRetrieveKey: rejected unlock token from %s (%s) - %s %v", rpcConn.RemoteHost, req.Hostname, detail, err)
+		for _, uuid := range req.UUIDs {
+			rpcConn.audit("TokenRetrieveKey", req.Hostname, uuid, AuditResultRejected, detail)
+			rpcConn.Svc.Metrics.CountKeyRetrieval("TokenRetrieveKey", uuid, AuditResultRejected)
+		}
+		rpcConn.recordRejection("TokenRetrieveKey", req.Hostname, req.UUIDs, keydb.RejectionUnlockToken, detail)
+		return err
+	}
+	key, err := rpcConn.askForKeyContent(rec)
+	if err != nil {
+		return err
+	}
+	rec.Key = key
+	// The other tokens of the record are not for the requester to see
+	rec.UnlockTokens = nil
+	resp.Granted = map[string]keydb.Record{rec.UUID: rec}
+	log.Printf("CryptServiceConn.TokenRetrieveKey: %s (%s) has been granted key of %s by unlock token %s", rpcConn.RemoteHost, req.Hostname, rec.UUID, token.ID)
+	rpcConn.audit("TokenRetrieveKey", req.Hostname, rec.UUID, AuditResultGranted, "unlock token "+token.ID)
+	rpcConn.Svc.Metrics.CountKeyRetrieval("TokenRetrieveKey", rec.UUID, AuditResultGranted)
+	rpcConn.notifyTokenUse(rec, token, req.Hostname)
+	return nil
+}
+
+// Send optional notification email of a used unlock token in background, it is never put into a digest.
+func (rpcConn *CryptServiceConn) notifyTokenUse(rec keydb.Record, token keydb.UnlockToken, hostname string) {
+	if rpcConn.Svc.Mailer.ValidateConfig() != nil {
+		return
+	}
+	ip := rpcConn.RemoteHost
+	go func() {
+		subject := fmt.Sprintf("Unlock token used: %s (%s) %s%s", ip, hostname, rec.UUID, ownerNote(rec.Owner))
+		text := fmt.Sprintf("The key of %s%s (mount point %s) has been handed out to %s (%s) by unlock token %s, created on %s. "+
+			"The token cannot be used again.\r\n", rec.UUID, ownerNote(rec.Owner), rec.MountPoint, ip, hostname, token.ID, token.CreatedAt.Format(time.RFC3339))
+		if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
+			rpcConn.Svc.Metrics.CountMailerError()
+			log.Printf("CryptServiceConn.TokenRetrieveKey: failed to send email notification - %v", err)
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestUnlockToken(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither computer is an allowed client of the record
+	if _, err := db.Upsert(keydb.Record{UUID: "a", Key: []byte("key a"), MountPoint: "/a", MaxActive: 1, AllowedClients: []string{"10.9.9.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(keydb.Record{UUID: "b", Key: []byte("key b"), MountPoint: "/b", MaxActive: 1}); err != nil {
+		t.Fatal(err)
+	}
+	salt := NewSalt()
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}}
+	srv.Config.PasswordSalt = salt
+	srv.Config.PasswordHash = HashPassword(salt, "pass")
+	admin := &CryptServiceConn{RemoteHost: "@", Peer: &PeerCred{UID: 0}, Svc: srv}
+	tech := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+	other := &CryptServiceConn{RemoteHost: "10.0.0.2", CertCN: "10.0.0.1", Svc: srv}
+
+	req := CreateUnlockTokenReq{PlainPassword: "pass", UUID: "a", Hostname: "10.0.0.1", Validity: time.Hour}
+	var created CreateUnlockTokenResp
+	// Only the domain socket may create a token, and only with the correct password and a sensible validity
+	if err := tech.CreateUnlockToken(req, &created); err == nil {
+		t.Fatal("did not reject TCP client")
+	}
+	for _, bad := range []CreateUnlockTokenReq{
+		{PlainPassword: "wrong", UUID: "a", Validity: time.Hour},
+		{PlainPassword: "pass", UUID: "a"},
+		{PlainPassword: "pass", UUID: "a", Validity: MaxUnlockTokenValidity + time.Second},
+		{PlainPassword: "pass", UUID: "c", Validity: time.Hour},
+	} {
+		if err := admin.CreateUnlockToken(bad, &created); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if err := admin.CreateUnlockToken(req, &created); err != nil || created.Token == "" || created.UnlockToken.Hostname != "10.0.0.1" {
+		t.Fatal(created, err)
+	}
+	// The key is handed out without the password, neither by AutoRetrieveKey nor to another UUID or computer
+	var autoResp AutoRetrieveKeyResp
+	if err := tech.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}}, &autoResp); err != nil || len(autoResp.Granted) != 0 {
+		t.Fatal(autoResp, err)
+	}
+	var resp TokenRetrieveKeyResp
+	if err := tech.TokenRetrieveKey(TokenRetrieveKeyReq{Token: created.Token, UUIDs: []string{"b"}}, &resp); err == nil {
+		t.Fatal("accepted token of another record")
+	}
+	// A certificate that has not been validated does not satisfy the host restriction
+	if err := other.TokenRetrieveKey(TokenRetrieveKeyReq{Token: created.Token, UUIDs: []string{"a"}}, &resp); err == nil {
+		t.Fatal("accepted token from another computer")
+	}
+	if err := tech.TokenRetrieveKey(TokenRetrieveKeyReq{Token: created.Token, UUIDs: []string{"a"}, Hostname: "tech"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec := resp.Granted["a"]; string(rec.Key) != "key a" || len(rec.UnlockTokens) != 0 {
+		t.Fatal(rec)
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.UnlockTokens) != 1 || !rec.UnlockTokens[0].IsUsed() || rec.LastRetrieval.IP != "10.0.0.1" {
+		t.Fatal(rec.UnlockTokens)
+	}
+	// The token is used up
+	if err := tech.TokenRetrieveKey(TokenRetrieveKeyReq{Token: created.Token, UUIDs: []string{"a"}}, &TokenRetrieveKeyResp{}); err == nil {
+		t.Fatal("accepted token twice")
+	}
+}
@@ -0,0 +1,92 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	UnlockWindowCheckIntervalSec = 30 // UnlockWindowCheckIntervalSec is the interval at which records are checked for unlock windows that have ended.
+	MaxWindowUmountHours         = 24 // MaxWindowUmountHours is the longest validity of the umount command issued at the end of an unlock window.
+)
+
+/*
+UnlockWindowMonitor tells the computers using a disk to umount it once the disk's unlock window ends, for the records
+that ask for it. The umount command stays valid until the next window begins, so that a computer coming back later
+does not umount a disk it has legitimately unlocked again.
+*/
+type UnlockWindowMonitor struct {
+	Interval time.Duration // Interval is the time between two checks.
+
+	srv       *CryptServer
+	lastCheck time.Time
+	stop      chan struct{}
+	done      sync.WaitGroup
+}
+
+// StartUnlockWindowMonitor starts looking for unlock windows that have ended periodically.
+func (srv *CryptServer) StartUnlockWindowMonitor() {
+	srv.UnlockWindows = &UnlockWindowMonitor{
+		Interval:  UnlockWindowCheckIntervalSec * time.Second,
+		srv:       srv,
+		lastCheck: time.Now(),
+		stop:      make(chan struct{}),
+	}
+	srv.UnlockWindows.done.Add(1)
+	go srv.UnlockWindows.run()
+}
+
+// Check for ended unlock windows after each interval until stopped.
+func (monitor *UnlockWindowMonitor) run() {
+	defer monitor.done.Done()
+	for {
+		select {
+		case <-monitor.stop:
+			return
+		case <-time.After(monitor.Interval):
+			monitor.Check(time.Now())
+		}
+	}
+}
+
+/*
+Check issues an umount command to the computers that report alive for a disk whose unlock window was open at the
+previous check and is closed at the moment. Windows that end while the server is not running are not noticed.
+*/
+func (monitor *UnlockWindowMonitor) Check(moment time.Time) {
+	since := monitor.lastCheck
+	monitor.lastCheck = moment
+	for _, rec := range monitor.srv.KeyDB.List() {
+		if !rec.UmountAtWindowEnd || !rec.IsUnlockWindowOpen(since, time.Local) || rec.IsUnlockWindowOpen(moment, time.Local) {
+			continue
+		}
+		validity := MaxWindowUmountHours * time.Hour
+		if next, found := rec.NextUnlockWindow(moment, time.Local); found && next.Sub(moment) < validity {
+			validity = next.Sub(moment)
+		}
+		for ip := range rec.AliveMessages {
+			log.Printf("UnlockWindowMonitor: unlock window of %s has ended, telling %s to umount the disk", rec.UUID, ip)
+			cmd := keydb.PendingCommand{
+				ValidFrom: moment,
+				Validity:  validity,
+				Content:   LostHostUmountCommand,
+			}
+			if _, _, err := monitor.srv.KeyDB.AddPendingCommand(rec.UUID, ip, cmd); err != nil {
+				log.Printf("UnlockWindowMonitor: failed to save umount command for %s - %v", ip, err)
+			}
+		}
+	}
+}
+
+// Stop stops looking for ended unlock windows. It does nothing if the monitor is nil.
+func (monitor *UnlockWindowMonitor) Stop() {
+	if monitor == nil {
+		return
+	}
+	close(monitor.stop)
+	monitor.done.Wait()
+}
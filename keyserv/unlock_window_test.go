@@ -0,0 +1,92 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnlockWindows(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := keydb.OpenDB(path.Join(tmpDir, "keydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The window of "a" begins in two hours, "b" does not have one
+	nowMin := time.Now().Hour()*60 + time.Now().Minute()
+	closed := keydb.UnlockWindow{
+		Days:     []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+		StartMin: (nowMin + 120) % (24 * 60),
+		EndMin:   (nowMin + 180) % (24 * 60),
+	}
+	alive := map[string][]keydb.AliveMessage{"10.0.0.1": {{IP: "10.0.0.1", Hostname: "host", Timestamp: time.Now().Unix()}}}
+	for _, rec := range []keydb.Record{
+		{UUID: "a", Key: []byte("key a"), MountPoint: "/a", MaxActive: -1, UnlockWindows: []keydb.UnlockWindow{closed}, UmountAtWindowEnd: true, AliveMessages: alive},
+		{UUID: "b", Key: []byte("key b"), MountPoint: "/b", MaxActive: -1, AliveMessages: alive},
+	} {
+		if _, err := db.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &CryptServer{KeyDB: db, Mailer: &Mailer{}}
+
+	client := &CryptServiceConn{RemoteHost: "10.0.0.1", Svc: srv}
+	var resp AutoRetrieveKeyResp
+	if err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "host"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Granted) != 0 || len(resp.Rejected) != 1 || !strings.Contains(resp.RejectReasons["a"], "unlock windows") {
+		t.Fatalf("%+v", resp)
+	}
+
+	// 2023-01-02 is a Monday, the window of "a" ends at 11:00
+	window := keydb.UnlockWindow{Days: []time.Weekday{time.Monday}, StartMin: 9 * 60, EndMin: 11 * 60}
+	rec, _ := db.GetByUUID("a")
+	rec.UnlockWindows = []keydb.UnlockWindow{window}
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	monitor := &UnlockWindowMonitor{srv: srv, lastCheck: time.Date(2023, 1, 2, 10, 0, 0, 0, time.Local)}
+	// Nothing happens while the window is open
+	monitor.Check(time.Date(2023, 1, 2, 10, 30, 0, 0, time.Local))
+	if rec, _ := db.GetByUUID("a"); len(rec.PendingCommands["10.0.0.1"]) != 0 {
+		t.Fatal(rec.PendingCommands)
+	}
+	end := time.Date(2023, 1, 2, 11, 0, 30, 0, time.Local)
+	monitor.Check(end)
+	rec, _ = db.GetByUUID("a")
+	if cmds := rec.PendingCommands["10.0.0.1"]; len(cmds) != 1 || cmds[0].Content != LostHostUmountCommand ||
+		!cmds[0].ValidFrom.Equal(end) || cmds[0].Validity != MaxWindowUmountHours*time.Hour {
+		t.Fatal(cmds)
+	}
+	// The window stays closed and the record without window is left alone
+	monitor.Check(end.Add(time.Minute))
+	if rec, _ := db.GetByUUID("a"); len(rec.PendingCommands["10.0.0.1"]) != 1 {
+		t.Fatal(rec.PendingCommands)
+	}
+	if rec, _ := db.GetByUUID("b"); len(rec.PendingCommands["10.0.0.1"]) != 0 {
+		t.Fatal(rec.PendingCommands)
+	}
+	// The umount command expires when the next window begins
+	rec.UnlockWindows = []keydb.UnlockWindow{window, {Days: []time.Weekday{time.Monday}, StartMin: 12 * 60, EndMin: 13 * 60}}
+	rec.PendingCommands = nil
+	if _, err := db.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	monitor.lastCheck = time.Date(2023, 1, 2, 10, 0, 0, 0, time.Local)
+	monitor.Check(end)
+	rec, _ = db.GetByUUID("a")
+	if cmds := rec.PendingCommands["10.0.0.1"]; len(cmds) != 1 || cmds[0].Validity != time.Hour-30*time.Second {
+		t.Fatal(cmds)
+	}
+}
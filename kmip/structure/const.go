@@ -106,7 +106,32 @@ var TagResultMessage = RegisterDefinedTag("42007d")
 const ValKeyFormatTypeRaw = 1
 const ValCryptoAlgoAES = 3
 
+// Register request - the template attributes and key block are the same as those of create request and get response
+const ValOperationRegister = 3
+
 // Destroy request
 const ValOperationDestroy = 20
 
 // Destroy response - nothing more
+
+// Revoke request
+const ValOperationRevoke = 19
+
+var TagRevocationReason = RegisterDefinedTag("420081")
+var TagRevocationReasonCode = RegisterDefinedTag("420082")
+
+const ValRevocationReasonCessationOfOperation = 6
+
+// Revoke response - nothing more
+
+// Query request
+const ValOperationQuery = 24
+
+var TagQueryFunction = RegisterDefinedTag("420074")
+
+const ValQueryFunctionOperations = 1
+const ValQueryFunctionObjects = 2
+const ValQueryFunctionServerInformation = 3
+
+// Query response
+var TagVendorIdentification = RegisterDefinedTag("42009d")
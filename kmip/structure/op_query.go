@@ -0,0 +1,139 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package structure
+
+import (
+	"cryptctl2/kmip/ttlv"
+	"errors"
+	"fmt"
+)
+
+// KMIP request message 420078
+type SQueryRequest struct {
+	SRequestHeader    SRequestHeader    // IBatchCount is assumed to be 1 in serialisation operations
+	SRequestBatchItem SRequestBatchItem // payload is SRequestPayloadQuery
+}
+
+func (queryReq *SQueryRequest) SerialiseToTTLV() ttlv.Item {
+	queryReq.SRequestHeader.IBatchCount.Value = 1
+	ret := ttlv.NewStructure(TagRequestMessage, queryReq.SRequestHeader.SerialiseToTTLV(), queryReq.SRequestBatchItem.SerialiseToTTLV())
+	return ret
+}
+func (queryReq *SQueryRequest) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagRequestMessage, TagRequestHeader, &queryReq.SRequestHeader); err != nil {
+		return err
+	}
+	if val := queryReq.SRequestHeader.IBatchCount.Value; val != 1 {
+		return fmt.Errorf("SQueryRequest.DeserialiseFromTTLV: was expecting exactly 1 item, but received %d instead.", val)
+	}
+	queryReq.SRequestBatchItem = SRequestBatchItem{SRequestPayload: &SRequestPayloadQuery{}}
+	if err := DecodeStructItem(in, TagRequestMessage, TagBatchItem, &queryReq.SRequestBatchItem); err != nil {
+		return err
+	}
+	if queryReq.SRequestBatchItem.EOperation.Value != ValOperationQuery {
+		return errors.New("SQueryRequest.DeserialiseFromTTLV: input is not a query request")
+	}
+	return nil
+}
+
+// 420079 - request payload from a query request
+type SRequestPayloadQuery struct {
+	EQueryFunctions []ttlv.Enumeration // 420074
+}
+
+func (queryPayload *SRequestPayloadQuery) SerialiseToTTLV() ttlv.Item {
+	ret := ttlv.NewStructure(TagRequestPayload)
+	for i := range queryPayload.EQueryFunctions {
+		queryPayload.EQueryFunctions[i].Tag = TagQueryFunction
+		ret.Items = append(ret.Items, &queryPayload.EQueryFunctions[i])
+	}
+	return ret
+}
+func (queryPayload *SRequestPayloadQuery) DeserialiseFromTTLV(in ttlv.Item) error {
+	functions := make([]ttlv.Enumeration, 0, 2)
+	makeReceiver := func() interface{} {
+		return &ttlv.Enumeration{}
+	}
+	afterReceiver := func(in interface{}) {
+		functions = append(functions, *in.(*ttlv.Enumeration))
+	}
+	if err := DecodeStructItems(in, TagRequestPayload, TagQueryFunction, makeReceiver, afterReceiver); err != nil {
+		return err
+	}
+	queryPayload.EQueryFunctions = functions
+	return nil
+}
+
+// KMIP response message 42007b
+type SQueryResponse struct {
+	SResponseHeader    SResponseHeader    // IBatchCount is assumed to be 1 in serialisation operations
+	SResponseBatchItem SResponseBatchItem // payload is SResponsePayloadQuery
+}
+
+func (queryResp *SQueryResponse) SerialiseToTTLV() ttlv.Item {
+	queryResp.SResponseHeader.IBatchCount.Value = 1
+	ret := ttlv.NewStructure(TagResponseMessage, queryResp.SResponseHeader.SerialiseToTTLV(), queryResp.SResponseBatchItem.SerialiseToTTLV())
+	return ret
+}
+func (queryResp *SQueryResponse) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagResponseMessage, TagResponseHeader, &queryResp.SResponseHeader); err != nil {
+		return err
+	}
+	if val := queryResp.SResponseHeader.IBatchCount.Value; val != 1 {
+		return fmt.Errorf("SQueryResponse.DeserialiseFromTTLV: was expecting exactly 1 item, but received %d instead.", val)
+	}
+	queryResp.SResponseBatchItem = SResponseBatchItem{SResponsePayload: &SResponsePayloadQuery{}}
+	if err := DecodeStructItem(in, TagResponseMessage, TagBatchItem, &queryResp.SResponseBatchItem); err != nil {
+		return err
+	}
+	if queryResp.SResponseBatchItem.EOperation.Value != ValOperationQuery {
+		return errors.New("SQueryResponse.DeserialiseFromTTLV: input is not a query response")
+	}
+	return nil
+}
+
+// 42007c - response payload from a query response, all items are optional.
+type SResponsePayloadQuery struct {
+	EOperations           []ttlv.Enumeration // 42005c
+	EObjectTypes          []ttlv.Enumeration // 420057
+	TVendorIdentification ttlv.Text          // 42009d
+}
+
+func (queryPayload *SResponsePayloadQuery) SerialiseToTTLV() ttlv.Item {
+	ret := ttlv.NewStructure(TagResponsePayload)
+	for i := range queryPayload.EOperations {
+		queryPayload.EOperations[i].Tag = TagOperation
+		ret.Items = append(ret.Items, &queryPayload.EOperations[i])
+	}
+	for i := range queryPayload.EObjectTypes {
+		queryPayload.EObjectTypes[i].Tag = TagObjectType
+		ret.Items = append(ret.Items, &queryPayload.EObjectTypes[i])
+	}
+	if queryPayload.TVendorIdentification.Value != "" {
+		queryPayload.TVendorIdentification.Tag = TagVendorIdentification
+		ret.Items = append(ret.Items, &queryPayload.TVendorIdentification)
+	}
+	return ret
+}
+func (queryPayload *SResponsePayloadQuery) DeserialiseFromTTLV(in ttlv.Item) error {
+	decodeEnums := func(tag ttlv.Tag) ([]ttlv.Enumeration, error) {
+		enums := make([]ttlv.Enumeration, 0, 4)
+		makeReceiver := func() interface{} {
+			return &ttlv.Enumeration{}
+		}
+		afterReceiver := func(in interface{}) {
+			enums = append(enums, *in.(*ttlv.Enumeration))
+		}
+		err := DecodeStructItems(in, TagResponsePayload, tag, makeReceiver, afterReceiver)
+		return enums, err
+	}
+	var err error
+	if queryPayload.EOperations, err = decodeEnums(TagOperation); err != nil {
+		return err
+	} else if queryPayload.EObjectTypes, err = decodeEnums(TagObjectType); err != nil {
+		return err
+	}
+	// Vendor identification is only present if server information was queried
+	DecodeStructItem(in, TagResponsePayload, TagVendorIdentification, &queryPayload.TVendorIdentification)
+	return nil
+}
@@ -0,0 +1,104 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package structure
+
+import (
+	"cryptctl2/kmip/ttlv"
+	"errors"
+	"fmt"
+)
+
+// KMIP request message 420078
+type SRegisterRequest struct {
+	SRequestHeader    SRequestHeader    // IBatchCount is assumed to be 1 in serialisation operations
+	SRequestBatchItem SRequestBatchItem // payload is SRequestPayloadRegister
+}
+
+func (registerReq *SRegisterRequest) SerialiseToTTLV() ttlv.Item {
+	registerReq.SRequestHeader.IBatchCount.Value = 1
+	ret := ttlv.NewStructure(TagRequestMessage, registerReq.SRequestHeader.SerialiseToTTLV(), registerReq.SRequestBatchItem.SerialiseToTTLV())
+	return ret
+}
+func (registerReq *SRegisterRequest) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagRequestMessage, TagRequestHeader, &registerReq.SRequestHeader); err != nil {
+		return err
+	}
+	if val := registerReq.SRequestHeader.IBatchCount.Value; val != 1 {
+		return fmt.Errorf("SRegisterRequest.DeserialiseFromTTLV: was expecting exactly 1 item, but received %d instead.", val)
+	}
+	registerReq.SRequestBatchItem = SRequestBatchItem{SRequestPayload: &SRequestPayloadRegister{}}
+	if err := DecodeStructItem(in, TagRequestMessage, TagBatchItem, &registerReq.SRequestBatchItem); err != nil {
+		return err
+	}
+	if registerReq.SRequestBatchItem.EOperation.Value != ValOperationRegister {
+		return errors.New("SRegisterRequest.DeserialiseFromTTLV: input is not a register request")
+	}
+	return nil
+}
+
+// 420079 - request payload from a register request, it carries the key content supplied by client.
+type SRequestPayloadRegister struct {
+	EObjectType        ttlv.Enumeration   // 420057
+	STemplateAttribute STemplateAttribute // 420091
+	SSymmetricKey      SSymmetricKey      // 42008f
+}
+
+func (registerPayload *SRequestPayloadRegister) SerialiseToTTLV() ttlv.Item {
+	registerPayload.EObjectType.Tag = TagObjectType
+	return ttlv.NewStructure(TagRequestPayload, &registerPayload.EObjectType, registerPayload.STemplateAttribute.SerialiseToTTLV(),
+		registerPayload.SSymmetricKey.SerialiseToTTLV())
+}
+func (registerPayload *SRequestPayloadRegister) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagRequestPayload, TagObjectType, &registerPayload.EObjectType); err != nil {
+		return err
+	} else if err := DecodeStructItem(in, TagRequestPayload, TagTemplateAttribute, &registerPayload.STemplateAttribute); err != nil {
+		return err
+	} else if err := DecodeStructItem(in, TagRequestPayload, TagSymmetricKey, &registerPayload.SSymmetricKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// KMIP response message 42007b
+type SRegisterResponse struct {
+	SResponseHeader    SResponseHeader    // IBatchCount is assumed to be 1 in serialisation operations
+	SResponseBatchItem SResponseBatchItem // payload is SResponsePayloadRegister
+}
+
+func (registerResp *SRegisterResponse) SerialiseToTTLV() ttlv.Item {
+	registerResp.SResponseHeader.IBatchCount.Value = 1
+	ret := ttlv.NewStructure(TagResponseMessage, registerResp.SResponseHeader.SerialiseToTTLV(), registerResp.SResponseBatchItem.SerialiseToTTLV())
+	return ret
+}
+func (registerResp *SRegisterResponse) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagResponseMessage, TagResponseHeader, &registerResp.SResponseHeader); err != nil {
+		return err
+	}
+	if val := registerResp.SResponseHeader.IBatchCount.Value; val != 1 {
+		return fmt.Errorf("SRegisterResponse.DeserialiseFromTTLV: was expecting exactly 1 item, but received %d instead.", val)
+	}
+	registerResp.SResponseBatchItem = SResponseBatchItem{SResponsePayload: &SResponsePayloadRegister{}}
+	if err := DecodeStructItem(in, TagResponseMessage, TagBatchItem, &registerResp.SResponseBatchItem); err != nil {
+		return err
+	}
+	if registerResp.SResponseBatchItem.EOperation.Value != ValOperationRegister {
+		return errors.New("SRegisterResponse.DeserialiseFromTTLV: input is not a register response")
+	}
+	return nil
+}
+
+// 42007c - response payload from a register response
+type SResponsePayloadRegister struct {
+	TUniqueID ttlv.Text // 420094
+}
+
+func (registerPayload *SResponsePayloadRegister) SerialiseToTTLV() ttlv.Item {
+	registerPayload.TUniqueID.Tag = TagUniqueID
+	return ttlv.NewStructure(TagResponsePayload, &registerPayload.TUniqueID)
+}
+func (registerPayload *SResponsePayloadRegister) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagResponsePayload, TagUniqueID, &registerPayload.TUniqueID); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package structure
+
+import (
+	"cryptctl2/kmip/ttlv"
+	"errors"
+	"fmt"
+)
+
+// KMIP request message 420078
+type SRevokeRequest struct {
+	SRequestHeader    SRequestHeader    // IBatchCount is assumed to be 1 in serialisation operations
+	SRequestBatchItem SRequestBatchItem // payload is SRequestPayloadRevoke
+}
+
+func (revokeReq SRevokeRequest) SerialiseToTTLV() ttlv.Item {
+	revokeReq.SRequestHeader.IBatchCount.Value = 1
+	ret := ttlv.NewStructure(TagRequestMessage, revokeReq.SRequestHeader.SerialiseToTTLV(), revokeReq.SRequestBatchItem.SerialiseToTTLV())
+	return ret
+}
+func (revokeReq *SRevokeRequest) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagRequestMessage, TagRequestHeader, &revokeReq.SRequestHeader); err != nil {
+		return err
+	}
+	if val := revokeReq.SRequestHeader.IBatchCount.Value; val != 1 {
+		return fmt.Errorf("SRevokeRequest.DeserialiseFromTTLV: was expecting exactly 1 item, but received %d instead.", val)
+	}
+	revokeReq.SRequestBatchItem = SRequestBatchItem{SRequestPayload: &SRequestPayloadRevoke{}}
+	if err := DecodeStructItem(in, TagRequestMessage, TagBatchItem, &revokeReq.SRequestBatchItem); err != nil {
+		return err
+	}
+	if revokeReq.SRequestBatchItem.EOperation.Value != ValOperationRevoke {
+		return errors.New("SRevokeRequest.DeserialiseFromTTLV: input is not a revoke request")
+	}
+	return nil
+}
+
+// 420079 - request payload from a revoke request
+type SRequestPayloadRevoke struct {
+	TUniqueID         ttlv.Text         // 420094
+	SRevocationReason SRevocationReason // 420081
+}
+
+func (revokePayload SRequestPayloadRevoke) SerialiseToTTLV() ttlv.Item {
+	revokePayload.TUniqueID.Tag = TagUniqueID
+	return ttlv.NewStructure(TagRequestPayload, &revokePayload.TUniqueID, revokePayload.SRevocationReason.SerialiseToTTLV())
+}
+func (revokePayload *SRequestPayloadRevoke) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagRequestPayload, TagUniqueID, &revokePayload.TUniqueID); err != nil {
+		return err
+	}
+	if err := DecodeStructItem(in, TagRequestPayload, TagRevocationReason, &revokePayload.SRevocationReason); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 420081 - the reason of revocation, the optional message is left out
+type SRevocationReason struct {
+	ERevocationReasonCode ttlv.Enumeration // 420082
+}
+
+func (reason SRevocationReason) SerialiseToTTLV() ttlv.Item {
+	reason.ERevocationReasonCode.Tag = TagRevocationReasonCode
+	return ttlv.NewStructure(TagRevocationReason, &reason.ERevocationReasonCode)
+}
+func (reason *SRevocationReason) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagRevocationReason, TagRevocationReasonCode, &reason.ERevocationReasonCode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// KMIP response message 42007b
+type SRevokeResponse struct {
+	SResponseHeader    SResponseHeader    // IBatchCount is assumed to be 1 in serialisation operations
+	SResponseBatchItem SResponseBatchItem // payload is SResponsePayloadRevoke
+}
+
+func (revokeResp SRevokeResponse) SerialiseToTTLV() ttlv.Item {
+	revokeResp.SResponseHeader.IBatchCount.Value = 1
+	ret := ttlv.NewStructure(TagResponseMessage, revokeResp.SResponseHeader.SerialiseToTTLV(), revokeResp.SResponseBatchItem.SerialiseToTTLV())
+	return ret
+}
+func (revokeResp *SRevokeResponse) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagResponseMessage, TagResponseHeader, &revokeResp.SResponseHeader); err != nil {
+		return err
+	}
+	if val := revokeResp.SResponseHeader.IBatchCount.Value; val != 1 {
+		return fmt.Errorf("SRevokeResponse.DeserialiseFromTTLV: was expecting exactly 1 item, but received %d instead.", val)
+	}
+	revokeResp.SResponseBatchItem = SResponseBatchItem{SResponsePayload: &SResponsePayloadRevoke{}}
+	if err := DecodeStructItem(in, TagResponseMessage, TagBatchItem, &revokeResp.SResponseBatchItem); err != nil {
+		return err
+	}
+	if revokeResp.SResponseBatchItem.EOperation.Value != ValOperationRevoke {
+		return errors.New("SRevokeResponse.DeserialiseFromTTLV: input is not a revoke response")
+	}
+	return nil
+}
+
+// 42007c - response payload from a revoke response
+type SResponsePayloadRevoke struct {
+	TUniqueID ttlv.Text // 420094
+}
+
+func (revokePayload SResponsePayloadRevoke) SerialiseToTTLV() ttlv.Item {
+	revokePayload.TUniqueID.Tag = TagUniqueID
+	return ttlv.NewStructure(TagResponsePayload, &revokePayload.TUniqueID)
+}
+func (revokePayload *SResponsePayloadRevoke) DeserialiseFromTTLV(in ttlv.Item) error {
+	if err := DecodeStructItem(in, TagResponsePayload, TagUniqueID, &revokePayload.TUniqueID); err != nil {
+		return err
+	}
+	return nil
+}
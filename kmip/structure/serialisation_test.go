@@ -116,3 +116,187 @@ func TestSerialiseStruct(t *testing.T) {
 		}
 	}
 }
+
+func TestSerialiseQuery(t *testing.T) {
+	header := SRequestHeader{
+		SProtocolVersion: SProtocolVersion{
+			IMajor: ttlv.Integer{Value: ValProtocolVersionMajorKMIP1_3},
+			IMinor: ttlv.Integer{Value: ValProtocolVersionMinorKMIP1_3},
+		},
+	}
+	req := &SQueryRequest{
+		SRequestHeader: header,
+		SRequestBatchItem: SRequestBatchItem{
+			EOperation: ttlv.Enumeration{Value: ValOperationQuery},
+			SRequestPayload: &SRequestPayloadQuery{EQueryFunctions: []ttlv.Enumeration{
+				{Value: ValQueryFunctionOperations}, {Value: ValQueryFunctionServerInformation},
+			}},
+		},
+	}
+	bin := ttlv.EncodeAny(req.SerialiseToTTLV())
+	decoded, _, err := ttlv.DecodeAny(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without username the request does not carry credential
+	if _, err := FindStructItem(decoded.(*ttlv.Structure).Items[0], TagRequestHeader, TagAuthentication); err == nil {
+		t.Fatal("should not have sent credential")
+	}
+	var recoveredReq SQueryRequest
+	if err := recoveredReq.DeserialiseFromTTLV(decoded); err != nil {
+		t.Fatal(err)
+	}
+	functions := recoveredReq.SRequestBatchItem.SRequestPayload.(*SRequestPayloadQuery).EQueryFunctions
+	if len(functions) != 2 || functions[0].Value != ValQueryFunctionOperations || functions[1].Value != ValQueryFunctionServerInformation {
+		t.Fatalf("%+v", functions)
+	}
+	// Create, get, and destroy requests are not mistaken for a query
+	if err := (&SGetRequest{}).DeserialiseFromTTLV(decoded); err == nil {
+		t.Fatal("query decoded as get request")
+	}
+
+	resp := &SQueryResponse{
+		SResponseHeader: SResponseHeader{SVersion: header.SProtocolVersion, IBatchCount: ttlv.Integer{Value: 1}},
+		SResponseBatchItem: SResponseBatchItem{
+			EOperation:    ttlv.Enumeration{Value: ValOperationQuery},
+			EResultStatus: ttlv.Enumeration{Value: ValResultStatusSuccess},
+			SResponsePayload: &SResponsePayloadQuery{
+				EOperations:           []ttlv.Enumeration{{Value: ValOperationCreate}, {Value: ValOperationGet}},
+				TVendorIdentification: ttlv.Text{Value: "vendor"},
+			},
+		},
+	}
+	if decoded, _, err = ttlv.DecodeAny(ttlv.EncodeAny(resp.SerialiseToTTLV())); err != nil {
+		t.Fatal(err)
+	}
+	var recoveredResp SQueryResponse
+	if err := recoveredResp.DeserialiseFromTTLV(decoded); err != nil {
+		t.Fatal(err)
+	}
+	payload := recoveredResp.SResponseBatchItem.SResponsePayload.(*SResponsePayloadQuery)
+	if len(payload.EOperations) != 2 || payload.EOperations[1].Value != ValOperationGet || len(payload.EObjectTypes) != 0 || payload.TVendorIdentification.Value != "vendor" {
+		t.Fatalf("%+v", payload)
+	}
+}
+
+func TestSerialiseRegister(t *testing.T) {
+	req := &SRegisterRequest{
+		SRequestHeader: SRequestHeader{
+			SProtocolVersion: SProtocolVersion{
+				IMajor: ttlv.Integer{Value: ValProtocolVersionMajorKMIP1_3},
+				IMinor: ttlv.Integer{Value: ValProtocolVersionMinorKMIP1_3},
+			},
+		},
+		SRequestBatchItem: SRequestBatchItem{
+			EOperation: ttlv.Enumeration{Value: ValOperationRegister},
+			SRequestPayload: &SRequestPayloadRegister{
+				EObjectType: ttlv.Enumeration{Value: ValObjectTypeSymmetricKey},
+				STemplateAttribute: STemplateAttribute{
+					Attributes: []SAttribute{
+						{
+							TAttributeName: ttlv.Text{Value: ValAttributeNameCryptoAlg},
+							AttributeValue: &ttlv.Enumeration{TTL: ttlv.TTL{Tag: TagAttributeValue}, Value: ValCryptoAlgoAES},
+						},
+					},
+				},
+				SSymmetricKey: SSymmetricKey{
+					SKeyBlock: SKeyBlock{
+						EFormatType:      ttlv.Enumeration{Value: ValKeyFormatTypeRaw},
+						SKeyValue:        SKeyValue{BKeyMaterial: ttlv.Bytes{Value: []byte("key content")}},
+						ECryptoAlgorithm: ttlv.Enumeration{Value: ValCryptoAlgoAES},
+						ECryptoLen:       ttlv.Integer{Value: 88},
+					},
+				},
+			},
+		},
+	}
+	decoded, _, err := ttlv.DecodeAny(ttlv.EncodeAny(req.SerialiseToTTLV()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recoveredReq SRegisterRequest
+	if err := recoveredReq.DeserialiseFromTTLV(decoded); err != nil {
+		t.Fatal(err)
+	}
+	payload := recoveredReq.SRequestBatchItem.SRequestPayload.(*SRequestPayloadRegister)
+	if string(payload.SSymmetricKey.SKeyBlock.SKeyValue.BKeyMaterial.Value) != "key content" || payload.SSymmetricKey.SKeyBlock.ECryptoLen.Value != 88 ||
+		len(payload.STemplateAttribute.Attributes) != 1 || payload.STemplateAttribute.Attributes[0].TAttributeName.Value != ValAttributeNameCryptoAlg {
+		t.Fatalf("%+v", payload)
+	}
+	// A register request is not mistaken for a create request
+	if err := (&SCreateRequest{}).DeserialiseFromTTLV(decoded); err == nil {
+		t.Fatal("register decoded as create request")
+	}
+
+	resp := &SRegisterResponse{
+		SResponseHeader: SResponseHeader{SVersion: req.SRequestHeader.SProtocolVersion, IBatchCount: ttlv.Integer{Value: 1}},
+		SResponseBatchItem: SResponseBatchItem{
+			EOperation:       ttlv.Enumeration{Value: ValOperationRegister},
+			EResultStatus:    ttlv.Enumeration{Value: ValResultStatusSuccess},
+			SResponsePayload: &SResponsePayloadRegister{TUniqueID: ttlv.Text{Value: "id"}},
+		},
+	}
+	if decoded, _, err = ttlv.DecodeAny(ttlv.EncodeAny(resp.SerialiseToTTLV())); err != nil {
+		t.Fatal(err)
+	}
+	var recoveredResp SRegisterResponse
+	if err := recoveredResp.DeserialiseFromTTLV(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if id := recoveredResp.SResponseBatchItem.SResponsePayload.(*SResponsePayloadRegister).TUniqueID.Value; id != "id" {
+		t.Fatal(id)
+	}
+}
+
+func TestSerialiseRevoke(t *testing.T) {
+	req := &SRevokeRequest{
+		SRequestHeader: SRequestHeader{
+			SProtocolVersion: SProtocolVersion{
+				IMajor: ttlv.Integer{Value: ValProtocolVersionMajorKMIP1_3},
+				IMinor: ttlv.Integer{Value: ValProtocolVersionMinorKMIP1_3},
+			},
+		},
+		SRequestBatchItem: SRequestBatchItem{
+			EOperation: ttlv.Enumeration{Value: ValOperationRevoke},
+			SRequestPayload: &SRequestPayloadRevoke{
+				TUniqueID:         ttlv.Text{Value: "id"},
+				SRevocationReason: SRevocationReason{ERevocationReasonCode: ttlv.Enumeration{Value: ValRevocationReasonCessationOfOperation}},
+			},
+		},
+	}
+	decoded, _, err := ttlv.DecodeAny(ttlv.EncodeAny(req.SerialiseToTTLV()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recoveredReq SRevokeRequest
+	if err := recoveredReq.DeserialiseFromTTLV(decoded); err != nil {
+		t.Fatal(err)
+	}
+	payload := recoveredReq.SRequestBatchItem.SRequestPayload.(*SRequestPayloadRevoke)
+	if payload.TUniqueID.Value != "id" || payload.SRevocationReason.ERevocationReasonCode.Value != ValRevocationReasonCessationOfOperation {
+		t.Fatalf("%+v", payload)
+	}
+	// A revoke request is not mistaken for a destroy request
+	if err := (&SDestroyRequest{}).DeserialiseFromTTLV(decoded); err == nil {
+		t.Fatal("revoke decoded as destroy request")
+	}
+
+	resp := &SRevokeResponse{
+		SResponseHeader: SResponseHeader{SVersion: req.SRequestHeader.SProtocolVersion, IBatchCount: ttlv.Integer{Value: 1}},
+		SResponseBatchItem: SResponseBatchItem{
+			EOperation:       ttlv.Enumeration{Value: ValOperationRevoke},
+			EResultStatus:    ttlv.Enumeration{Value: ValResultStatusSuccess},
+			SResponsePayload: &SResponsePayloadRevoke{TUniqueID: ttlv.Text{Value: "id"}},
+		},
+	}
+	if decoded, _, err = ttlv.DecodeAny(ttlv.EncodeAny(resp.SerialiseToTTLV())); err != nil {
+		t.Fatal(err)
+	}
+	var recoveredResp SRevokeResponse
+	if err := recoveredResp.DeserialiseFromTTLV(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if id := recoveredResp.SResponseBatchItem.SResponsePayload.(*SResponsePayloadRevoke).TUniqueID.Value; id != "id" {
+		t.Fatal(id)
+	}
+}
@@ -7,6 +7,8 @@ package main
 
 import (
 	"cryptctl2/command"
+	"cryptctl2/fs"
+	"cryptctl2/routine"
 	"cryptctl2/sys"
 	"flag"
 	"fmt"
@@ -15,6 +17,7 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var helpText = `cryptctl2: encrypt and decrypt file systems using network key server.
@@ -27,46 +30,202 @@ Syntax: cryptctl2 -action <action> [options]
 Server actions:
 daemon
 	Start the cryptctl2 server daemon.
-init-server
-	Set up this computer as a new key server.
-list-keys
-	Show all encryption keys.
-show-key -deviceID=UUID
-	Display pending-commands and details of a key.
-edit-key -deviceID=UUID
-	Edit stored key information.
-send-command
-	Record a pending mount/umount command for a disk.
-clear-commands
-	Clear all pending commands of a disk.
-add-allowed-client -deviceID=String -allowedClient=String
-	Allow a client to access a device.
-remove-allowed-client -disk=String -allowedClient=String
-	Remove client from the access list of a device.
-list-allowed-clients -disk=String
-	List the clients which has access to a device.
-create-client-certificate -dnsName=String [-ipAdress=String]
-	Creates a client certificate for the given DNS-Name and if given IP-Address
+init-server [-answerFile=File -startService -keyType=rsa2048|rsa4096|ecdsa-p256|ecdsa-p384]
+	Set up this computer as a new key server. With -answerFile, take all answers from the file (KEY=VALUE lines or
+	JSON) instead of asking for them, and with -startService, (re)start the key server afterwards.
+change-password [-oldPasswordFile=File -newPasswordFile=File]
+	Change the key server's access password, the running key server accepts the new one right away. The passwords are
+	read from the first line of the files if given, otherwise they are asked for.
+list-keys [-filter=String -owner=String -client=String -onlyStale=Duration -unused
+           -sort=last-retrieval|lastaccess|uuid|mountpoint|active -output=text|json]
+	Show all encryption keys, or only those meeting all of the comma-separated filter conditions:
+	tag.NAME=VALUE, uuid=PREFIX, client=HOST, mount=PREFIX, stale=DAYS (not retrieved for so many days) or
+	stale=DURATION (neither retrieved nor kept alive for e.g. 72h), and owner=OWNER. With -owner, show only the keys
+	of disks that belong to the owner. -client shows the keys the client is allowed to or currently does use,
+	-onlyStale=DURATION works like stale=DURATION, and -unused shows the keys no computer currently uses.
+show-key -deviceID=UUID [-output=text|json -history]
+	Display pending-commands, their results, and details of a key. With -history, list the versions kept of the
+	record along with the details changed by each version, and the key retrievals granted and rejected, newest first.
+revert-key -deviceID=UUID -version=Int
+	Bring back the record details of a version shown by show-key -history. The encryption key is not reverted.
+edit-key -deviceID=UUID [-setOwner=String]
+	Edit stored key information. With -setOwner, only change the owner of the disk (empty to remove it), which always
+	requires the key server password.
+delete-key -deviceID=UUID [-force -iAmOwner]
+	Remove the key record of a disk that is gone for good without touching the disk, along with its key on the external
+	KMIP server. Asks for confirmation, and refuses a key still in use by a computer unless -force is given.
+send-command [-deviceID=UUID -allowedClients=IPs -command=String -expireMin=Int -group=String -wait -timeout=Seconds -iAmOwner]
+	Record a pending mount/umount/lock/erase/refresh-status/fstrim/inventory/remount-ro command for a disk, or for all disks
+	of a consistency group. The rotate command is only sent by the key server itself, see rotate-key.
+	The command goes to a computer given by IP or host name, or to all computers currently using the disk.
+	With -wait, wait up to the timeout (default 300 seconds) for the computer to report the result. The erase command
+	of a disk that has an owner requires -iAmOwner (or -force) to confirm acting on the owner's behalf.
+	The disk, the computers (comma separated, or "all"), the command, and its expiry are asked for unless given.
+clear-commands [-deviceID=UUID -iAmOwner]
+	Clear all pending commands of a disk, which is asked for unless given. A disk that has an owner requires -iAmOwner (or -force).
+add-allowed-client -deviceID=UUID|PATTERN|all -allowedClients=String
+	Allow clients to access a device, each given by DNS name, IP, DNS name pattern (node-*.example.com), or subnet (10.20.0.0/16).
+	A UUID pattern such as "5f1c*" or "all" changes every matching device at once.
+remove-allowed-client -deviceID=UUID|PATTERN|all -allowedClients=String [-force]
+	Remove clients from the access list of a device, or of every device matching the pattern.
+	The last client of a device, without which any computer would be allowed, is only removed with -force.
+list-allowed-clients -deviceID=String [-output=text|json]
+	List the clients which has access to a device, along with the type of each entry.
+create-group -clientGroup=String -allowedClients=String
+	Create a client group of allowed clients, which devices refer to by the allowed client "@name".
+edit-group -clientGroup=String [-allowedClients=String]
+	Replace the members of a client group, all devices referring to it are affected right away.
+delete-group -clientGroup=String [-force]
+	Delete a client group. With -force, also remove it from the devices and client groups that still refer to it.
+list-groups [-output=text|json]
+	List the client groups along with their members and the devices referring to them.
+create-client-certificate -dnsName=String [-ipAddress=String -validityDays=Number -keyType=rsa2048|rsa4096|ecdsa-p256|ecdsa-p384]
+create-client-certificate -csr=File [-dnsName=String -ipAddress=String -validityDays=Number]
+	Creates a client certificate for the given comma-separated DNS-Names and if given IP-Addresses, named after the first
+	DNS-Name, its key is of the CA key's type unless given. With -csr, sign the certificate request instead, only the
+	certificate is written and it carries the names of the request unless given.
+revoke-client-certificate -dnsName=String|-serial=Number
+	Revoke the client certificate issued for the DNS name, or of the serial number, and write the revocation list
+	(ca.crl) in the certificate directory.
+list-client-certificates [-output=text|json]
+	Show the certificates issued by the CA of the certificate directory, along with their revocation status.
+show-audit [-deviceID=UUID -host=String -since=Time -until=Time]
+	Show audit log of key retrievals and administrative changes.
+list-client-inventory [-client=String -output=text|json]
+	Show the disks reported by client computers, to help planning which disks to encrypt.
+show-client -client=String [-output=text|json]
+	Show the LUKS and crypt devices last reported by a client computer, send it the "inventory" command to refresh.
+list-client-devices -allowedClient=String [-output=text|json]
+	Show the devices a client computer (DNS name or IP) is allowed to unlock, and whether it is using each of them.
+list-alive [-deviceID=UUID -host=String -output=text|json -live]
+	Show computers that are currently using encryption keys. With -live, ask the running server instead of reading the database.
+kmip-status [-output=text|json]
+	Query the external KMIP server, show which of the configured servers answered, and list the KMIP object IDs of
+	key records.
+kmip-test [-output=text|json]
+	Store, read back, and destroy a dummy key on each configured KMIP server, to verify the addresses, CA, client
+	certificate, and credentials before the key server relies on them.
+server-status [-output=text|json -detail]
+	Show whether the running key server is healthy. With -detail, enter the password to see key database, KMIP, and
+	email notification status along with the warnings.
+maintenance-mode [-state=on|off -duration=Duration -reason=String]
+	Stop the running key server from handing out any key for the duration (1h by default, up to 168h), or let it hand
+	out keys again. Clients keep on retrying and sending alive reports meanwhile. Without -state, show the mode.
+create-unlock-token -deviceID=UUID [-host=String -duration=Duration]
+	Create a token that lets a computer retrieve the key of the disk once, without the password and regardless of
+	allowed clients, e.g. for break-glass access. The token is valid for the duration (1h by default, up to 720h),
+	optionally only for the computer given by IP or validated certificate name. It is printed once and never again.
+create-enrollment-token [-host=String -duration=Duration]
+	Create a token that lets a new client computer request its client certificate once by register-client, without
+	the password. The token is valid for the duration (1h by default, up to 720h), optionally only for the host name or
+	IP given. It is printed once and never again.
+migrate-keys -direction=to-kmip|to-local [-online -output=text|json]
+	Move the encryption keys from the key database onto the external KMIP server, or back. Each key is verified before
+	its other copy is removed, and an interrupted migration carries on when run again. With -online, the running key
+	server changes the records, otherwise the key server must be stopped.
+fsck-keydb [-restore -output=text|json]
+	Report the key records that cannot be loaded. With -restore, restore them from their previous version, which is
+	kept whenever a record is updated. Fails if there is a damaged record that cannot be restored.
+backup-keydb -archive=File [-publicKey=PEM | -passwordFile=File]
+	Write the key records and server configuration (without email password) into a new encrypted backup file after
+	the key server password is checked. The backup is encrypted by a passphrase, which is asked for or read from the
+	password file, or by the RSA public key (or certificate) if given. export-keys -out=File does the same.
+restore-keydb -archive=File [-privateKey=PEM | -passwordFile=File] [-overwrite]
+	Validate a backup, show which records are new and which exist already, and restore the new records upon
+	confirmation. With -overwrite, existing records are replaced too. A running key server restores them on its own.
+	import-keys -in=File does the same.
+migrate-keydb-encryption
+	Set up the key database master key from the configured source, back up the key database, and encrypt the key
+	content of existing records. The key server must be stopped.
+migrate-keydb
+	Rewrite all key records at the current record version. Records written by a newer version of cryptctl2 are left
+	as they are. The key server must be stopped.
 
 Client actions:
 client-daemon
 	Start the cryptctl2 client daemon.
-encrypt
-	Set up a new file system for encryption.
+capabilities [-server=Host:Port -output=text|json]
+	Show key server's protocol version, features, limits, and certificate expiry.
+register-client [-server=Host:Port -token=String -dnsName=String -inventory] [TLS-Options]
+	Request a client certificate for this computer's host name (or -dnsName) from the key server by the password, or by
+	an enrollment token created by create-enrollment-token. The certificate, its key, and the key server CA are written
+	into /etc/cryptctl2/client, and the key server into the client configuration. With -inventory, also report the
+	LUKS devices of this computer to the key server.
+list-client-devices [-output=text|json]
+	Without -allowedClient, ask the key server which devices this computer is allowed to unlock.
+encrypt [-resume -tang=URL -dryRun] [LUKS-Options]
+	Set up a new file system for encryption. With -resume, carry on copying data after an interrupted encryption.
+	With -tang, also bind the disk to the Tang server, which unlocks it while the key server is unreachable.
 inplace-encrypt
 	Set up an existing file system for encryption.
-auto-unlock -deviceID=UUID
-	Paswordless unlock a registered device.
+auto-unlock -deviceID=UUID[,UUID...] | -all [-maxRetrySec=Int -retryIntervalSec=Int -dryRun] | -deviceID=UUID -token=String
+	Paswordless unlock registered devices, asking the key server for all of their keys at once. With -all, unlock every
+	encrypted file system on this computer, those without a key on the server are only warned about. The key server is
+	asked every -retryIntervalSec seconds for up to -maxRetrySec seconds, 0 makes a single attempt and -1 retries forever.
+	With -token, the disk is unlocked once by its one-time unlock token, even if this computer is not an allowed client.
 check-auto-unlock -deviceID=UUID
 	Check if a passwordless unlock is possible on this client.
-online-unlock
-	Forcibly unlock all file systems via key server.
+online-unlock [-parallel=Int -force | -dryRun] | -deviceID=UUID -token=String
+	Forcibly unlock all file systems via key server, unlocking up to so many file systems at a time (default 4).
+	With -force, also unlock file systems already in use by as many computers as allowed, the computer that has not
+	reported for the longest time is evicted from the key. With -token, unlock only the disk by its one-time unlock
+	token instead of the password.
 offline-unlock
 	Unlock a file system via a key record file.
+client-status [-output=text|json]
+	Ask the client daemon which encrypted devices are locked, being unlocked, unlocked, or failed to unlock, and
+	whether the key server is reachable.
+generate-systemd-units [-deviceID=UUID -unitDir=Dir -enable -force -maxRetrySec=Int -retryIntervalSec=Int]
+	Write a unit for each disk that has a key record (or only for the device), which unlocks the disk under the mapped
+	name of its record before its mount point is mounted. With -enable, enable the units too. With -force, overwrite
+	units that have been edited by hand. The retry options are written into the units. The root file system is refused,
+	it is unlocked by generate-initrd-config.
+remove-systemd-units [-deviceID=UUID -unitDir=Dir -force]
+	Disable and remove the units written by generate-systemd-units, for the device or for all disks. With -force,
+	remove units that have been edited by hand too.
+generate-initrd-config -deviceID=UUID [-initrdDir=Dir]
+	Write the key server address, client certificate, device UUID, and retry settings into a bundle (by default in
+	/etc/cryptctl2/initrd) for a dracut module that unlocks the encrypted root file system.
+initrd-unlock [-initrdDir=Dir]
+	Only retrieve the key and open the device according to the bundle, for use in the initrd. Exits with status 2 if
+	the key server is unreachable, 3 if the key is denied, 4 if the device is not found, 1 or 5 on other failures.
+rotate-key -deviceID=UUID
+	Replace the encryption key of the disk with a new one, both on the disk and on the key server. On the key server,
+	generate a new key of the record and tell every computer holding the disk to rotate to it.
+erase [-iAmOwner -keySlotOnly -forgetKey]
+	Destroy the encryption header of a disk and erase its key from the key server. A disk that has an owner requires
+	-iAmOwner (or -force) to confirm acting on the owner's behalf. -keySlotOnly only removes the key slot managed by
+	cryptctl2 and keeps the other key slots, such as a recovery passphrase. -forgetKey only destroys the key server's
+	copy of the key and keeps the record for audit. Both together remove the key slot, then forget the key.
 
 Actions on both server and client:
-add-device -deviceID=String -mappedName=String [-mountPoint=String -mountOptions=String -maxActive=Int -allowedClients=String -autoEncyption=Bool]
-	Creates a new device in the keydb.
+add-device -deviceID=String -mappedName=String [-mountPoint=String -mountOptions=String -maxActive=Int -allowedClients=String -autoEncryption=Bool -group=String -groupPriority=Int -tags=String -owner=String -unlockAfter=String -fsck=String -tang=URL -unlockWindows=String -umountAtWindowEnd=Bool -keyFile=Path -force LUKS-Options]
+	Creates a new device in the keydb. Auto encryption formats the device using the LUKS options. Unlock windows
+	(e.g. "Mon-Fri 22:00-04:00; Sat,Sun 20:00-06:00") limit the hours during which the disk is unlocked automatically.
+	The owner (e.g. a team name or email address) is shown before destructive actions and in notification emails.
+doctor [-output=text|json] [TLS-Options]
+	Check the configuration of the key server and of the client, whichever is set up on this computer: certificates,
+	key database, KMIP server, email, programs, key server connection, clock, and encrypted devices. Each finding is
+	PASS, WARN, or FAIL along with a hint to remedy it. Exits with an error if any check fails.
+
+LUKS-Options: -luksVersion=1|2 -cipher=String -keySize=Bits -pbkdf=pbkdf2|argon2i|argon2id -pbkdfIterTime=Milliseconds
+	-pbkdfIterations=Int -pbkdfMemory=KB -sectorSize=Bytes
+	Parameters of the encryption header, they cannot be changed once the disk has been formatted.
+
+TLS-Options: -tlsCA=File -tlsFingerprint=SHA256 -tlsVerifyHostname=Bool -bindAddress=IP -proxy=URL
+	How client actions trust and reach the key server, they take precedence over the client configuration. The -proxy
+	is socks5://host:port or http://host:port (CONNECT), optionally with user:password@ in front of the host.
+
+Scripted use: -passwordFile=File
+	Actions that ask for the key server password take it from the first line of the file, or from environment variable
+	CRYPTCTL2_ACCESS_PASSWORD. While standard input is not a terminal, questions are answered line by line from it,
+	and an answer that is missing or invalid ends the action with an error instead of asking again.
+
+Troubleshooting: -verbose -dryRun
+	With -verbose, every external program (cryptsetup, mount, etc.) is logged to standard error along with its exit
+	status and error output, keys handed to the program are never shown. With -dryRun, encrypt, auto-unlock, and
+	online-unlock talk to the key server and look for the devices, then only print what they would run. A dry run
+	writes no key anywhere, yet it checks that the device mapper name is free and the mount point is usable.
 `
 
 func PrintHelpAndExit(exitStatus int) {
@@ -96,34 +255,176 @@ func main() {
 	}()
 
 	action := flag.String("action", "daemon", helpText)
-	deviceID := flag.String("deviceID", "", "The id of the device. In normal case this is the partition UUID. Ohterwise the type of the used ID need to be added as prefix separated by '='. Ex.: SERIAL:3600140585b053f0034b46ccbe409913b")
+	deviceID := flag.String("deviceID", "", "The id of the device. In normal case this is the partition UUID. Otherwise the type of the used ID (UUID, LABEL, SERIAL, PATH, PARTUUID, PTUUID) needs to be added as prefix separated by ':'. Ex.: SERIAL:3600140585b053f0034b46ccbe409913b, LABEL:data, PATH:/dev/disk/by-id/wwn-0x5000c500a1b2c3d4-part1")
 	mappedName := flag.String("mappedName", "", "The mapped name of the device.")
 	mountPoint := flag.String("mountPoint", "", "The path where the device need to be mounted if any.")
 	mountOptions := flag.String("mountOptions", "", "Comma separated list of mount options.")
 	//maxAlive := flag.Int("maxAlive",3600,"How long (in seconds) should be stay the device encripted if the cryptcl server is not accessible.")
-	maxActive := flag.Int("maxActive", 0, "How many clients may encrypt the device to same time.")
+	maxActive := flag.Int("maxActive", 1, "How many clients may unlock the device at the same time, at least 1.")
+	keyFile := flag.String("keyFile", "", "File of the raw or base64-encoded key of a disk encrypted elsewhere, which add-device keeps in the new record.")
 	allowedClients := flag.String("allowedClients", "", "Comma separated list of client which may have acces to the device.")
+	allowedClient := flag.String("allowedClient", "", "DNS name or IP of the client computer whose devices are listed.")
 	autoEncryption := flag.Bool("autoEncryption", false, "Should the device autmaticaly encrypted if it will be accessed at first time?")
 	fileSystem := flag.String("fileSystem", "", "File system to be created if auto encryption is turned on.")
-	dnsName := flag.String("dnsName", "", "DNS-Name of the client.")
-	ipAddress := flag.String("ipAddress", "", "IPAddress of the client.")
+	dnsName := flag.String("dnsName", "", "DNS-Name of the client, or several of them separated by comma.")
+	ipAddress := flag.String("ipAddress", "", "IPAddress of the client, or several of them separated by comma.")
+	validityDays := flag.Int("validityDays", 0, "Days the certificate of create-client-certificate is valid for, as long as the CA by default and at most.")
+	csrPath := flag.String("csr", "", "Certificate signing request that create-client-certificate signs instead of generating a key.")
+	certSerial := flag.String("serial", "", "Serial number of the certificate revoke-client-certificate revokes, in place of its DNS name.")
+	group := flag.String("group", "", "Name of the consistency group whose member disks are mounted and umounted together.")
+	groupPriority := flag.Int("groupPriority", 0, "Mount order of the disk among its consistency group members, lower number is mounted first.")
+	clientGroup := flag.String("clientGroup", "", "Name of the client group shared by allowed clients of many devices.")
+	tags := flag.String("tags", "", "Comma separated tags of the device in the format of name=value, e.g. \"cluster=ceph-prod\".")
+	owner := flag.String("owner", "", "Owner of the device given to add-device, e.g. a team name or email address, or the owner whose devices list-keys shows.")
+	setOwner := flag.String("setOwner", "", "New owner of the device during edit-key, an empty value removes the owner.")
+	iAmOwner := flag.Bool("iAmOwner", false, "Confirm acting on behalf of the owner of the device during erase, clear-commands, and send-command erase.")
+	keySlotOnly := flag.Bool("keySlotOnly", false, "Have erase only remove the key slot managed by cryptctl2 from the disk, and keep its other key slots.")
+	forgetKey := flag.Bool("forgetKey", false, "Have erase only destroy the key server's copy of the key, and keep the record.")
+	tang := flag.String("tang", "", "URL of a Tang server to also bind the disk to, e.g. \"http://tang.example.com\".")
+	fsck := flag.String("fsck", "", "Check the file system before mounting it: off, preen (default), or force.")
+	unlockAfter := flag.String("unlockAfter", "", "Comma separated UUIDs of devices to unlock and mount before this one, e.g. the disk hosting its LVM volume.")
+	unlockWindows := flag.String("unlockWindows", "", "Semicolon separated periods during which the disk is unlocked automatically, e.g. \"Mon-Fri 22:00-04:00; Sat,Sun 20:00-06:00\".")
+	umountAtWindowEnd := flag.Bool("umountAtWindowEnd", false, "Have the computers umount the disk once its unlock window ends.")
+	filter := flag.String("filter", "", "Comma separated conditions of list-keys that must all be met: tag.NAME=VALUE, uuid=PREFIX, client=HOST, mount=PREFIX, stale=DAYS or stale=DURATION.")
+	sortBy := flag.String("sort", "", "Order of list-keys: last-retrieval (default, also called lastaccess), uuid, mountpoint, or active (most computers using the key first).")
+	onlyStale := flag.Duration("onlyStale", 0, "Have list-keys show only the keys neither retrieved nor kept alive for the duration, e.g. 72h.")
+	unused := flag.Bool("unused", false, "Have list-keys show only the keys no computer currently uses.")
+	host := flag.String("host", "", "IP, host name, or certificate common name of a client computer.")
+	since := flag.String("since", "", "Beginning of time range (e.g. \"2006-01-02 15:04:05\").")
+	until := flag.String("until", "", "End of time range (e.g. \"2006-01-02 15:04:05\").")
+	server := flag.String("server", "", "Key server address in the format of \"host:port\", or several of them separated by comma in order of preference, defaults to the configured key server.")
+	output := flag.String("output", "text", "Output format of reports, either \"text\" or \"json\".")
+	logLevel := flag.String("logLevel", "", "Least urgent messages the key server daemon logs: error, warning, notice, info, or debug. Overrides LOG_LEVEL of the server configuration.")
+	clientName := flag.String("client", "", "Certificate common name or host name of a client computer.")
+	parallel := flag.Int("parallel", 4, "Number of file systems to unlock at the same time.")
+	resume := flag.Bool("resume", false, "Resume copying data into the encrypted disk after an interrupted encryption.")
+	unitDir := flag.String("unitDir", "", "Directory where generate-systemd-units writes the units, defaults to /etc/systemd/system.")
+	initrdDir := flag.String("initrdDir", "", "Directory of the initrd configuration bundle, defaults to /etc/cryptctl2/initrd.")
+	enable := flag.Bool("enable", false, "Enable the units written by generate-systemd-units.")
+	force := flag.Bool("force", false, "Overwrite units that have been edited by hand, evict the stalest computer during online-unlock, remove references to a deleted client group, update the existing record in add-device, remove the last allowed client of a device, or act like -iAmOwner.")
+	maxRetrySec := flag.Int64("maxRetrySec", 0, "Number of seconds auto-unlock keeps retrying, 0 for a single attempt and -1 to retry forever, defaults to the client configuration.")
+	retryIntervalSec := flag.Int64("retryIntervalSec", 0, "Number of seconds between auto-unlock attempts, defaults to the client configuration.")
+	all := flag.Bool("all", false, "Auto-unlock all encrypted file systems on this computer that have their keys on the key server.")
+	live := flag.Bool("live", false, "Query the running key server over its domain socket instead of reading the key database directory.")
+	detail := flag.Bool("detail", false, "Ask for the password and show the details of server-status.")
+	direction := flag.String("direction", "", "Direction of migrate-keys, either \"to-kmip\" or \"to-local\".")
+	online := flag.Bool("online", false, "Let the running key server change the records during migrate-keys.")
+	archive := flag.String("archive", "", "Key database backup file of backup-keydb and restore-keydb.")
+	publicKey := flag.String("publicKey", "", "PEM-encoded RSA public key or certificate that encrypts the backup of backup-keydb.")
+	privateKey := flag.String("privateKey", "", "PEM-encoded RSA private key that decrypts the backup of restore-keydb.")
+	overwrite := flag.Bool("overwrite", false, "Replace the existing records with their backup during restore-keydb.")
+	exportOut := flag.String("out", "", "Key database backup file written by export-keys, same as -archive.")
+	importIn := flag.String("in", "", "Key database backup file read by import-keys, same as -archive.")
+	restore := flag.Bool("restore", false, "Restore the damaged key records from their previous version during fsck-keydb.")
+	history := flag.Bool("history", false, "Show the versions kept of the key record during show-key.")
+	version := flag.Int("version", 0, "Version of the key record to revert to during revert-key.")
+	pendingCommand := flag.String("command", "", "Command of send-command: "+strings.Join(command.PendingCommandContents, ", ")+".")
+	expireMin := flag.Int("expireMin", 0, "Number of minutes until the command of send-command expires, from 1 to a week (10080).")
+	wait := flag.Bool("wait", false, "Wait for the computer to report the result of the pending command.")
+	timeout := flag.Int("timeout", 300, "Number of seconds to wait for the result of the pending command.")
+	luksVersion := flag.Int("luksVersion", 2, "LUKS version (1 or 2) of the encryption header created by encrypt and auto encryption.")
+	cipher := flag.String("cipher", "", "Cipher of the encryption header (e.g. aes-xts-plain64), defaults to cryptsetup's default.")
+	keySize := flag.Int("keySize", 0, "Size in bits of the volume key (e.g. 512), defaults to cryptsetup's default.")
+	pbkdf := flag.String("pbkdf", "", "Key derivation function of the encryption header: pbkdf2, argon2i, or argon2id.")
+	pbkdfIterTime := flag.Int("pbkdfIterTime", 0, "Number of milliseconds spent deriving the key slot key.")
+	pbkdfIterations := flag.Int("pbkdfIterations", 0, "Fixed number of key derivation iterations, used instead of -pbkdfIterTime.")
+	pbkdfMemory := flag.Int("pbkdfMemory", 0, "Memory cost in kilobytes of argon2 key derivation.")
+	sectorSize := flag.Int("sectorSize", 0, "Encryption sector size in bytes (e.g. 4096 for 4K-native disks), LUKS2 only.")
+	answerFile := flag.String("answerFile", "", "File that answers all questions of init-server, KEY=VALUE lines or a JSON object.")
+	startService := flag.Bool("startService", false, "Start or restart the key server once init-server has saved the answer file's settings.")
+	keyType := flag.String("keyType", "", "Key type of the certificates generated by init-server (rsa4096 by default) and create-client-certificate (that of the CA by default): rsa2048, rsa4096, ecdsa-p256, or ecdsa-p384.")
+	oldPasswordFile := flag.String("oldPasswordFile", "", "File carrying the current key server password on its first line, for change-password.")
+	newPasswordFile := flag.String("newPasswordFile", "", "File carrying the new key server password on its first line, for change-password.")
+	passwordFile := flag.String("passwordFile", "", "File carrying the key server password on its first line, for actions that ask for it.")
+	verbose := flag.Bool("verbose", false, "Log every external program run by the action, its exit status, and error output to standard error.")
+	dryRun := flag.Bool("dryRun", false, "Only print what encrypt, auto-unlock, and online-unlock would do to the disks, without writing a key anywhere.")
+	maintenanceState := flag.String("state", "", "Turn maintenance-mode \"on\" or \"off\", leave empty to show the mode.")
+	duration := flag.Duration("duration", time.Hour, "How long maintenance-mode lasts or an unlock or enrollment token stays valid, e.g. \"30m\" or \"4h\".")
+	token := flag.String("token", "", "One-time unlock token of online-unlock and auto-unlock, or enrollment token of register-client.")
+	inventory := flag.Bool("inventory", false, "Report the LUKS devices of this computer to the key server during register-client.")
+	maintenanceReason := flag.String("reason", "", "Explanation of maintenance-mode written to the audit log and notification email.")
+	tlsCA := flag.String("tlsCA", "", "PEM file of the key server CA bundle.")
+	tlsFingerprint := flag.String("tlsFingerprint", "", "Expected SHA256 fingerprint of the key server certificate, used instead of the CA.")
+	tlsVerifyHostname := flag.Bool("tlsVerifyHostname", true, "Check that the key server certificate carries the server's host name or IP.")
+	bindAddress := flag.String("bindAddress", "", "Local IP address to connect to the key server from.")
+	proxy := flag.String("proxy", "", "SOCKS5 or HTTP CONNECT proxy to reach the key server through, e.g. \"socks5://10.0.0.1:1080\".")
 	flag.Parse()
+	tlsOverrides := command.TLSOverrides{CAFile: *tlsCA, Fingerprint: *tlsFingerprint, BindAddress: *bindAddress, Proxy: *proxy}
+	flag.Visit(func(f *flag.Flag) {
+		// Only an explicit -tlsVerifyHostname takes precedence over the client configuration
+		if f.Name == "tlsVerifyHostname" {
+			tlsOverrides.VerifyHostname = map[bool]string{true: "yes", false: "no"}[*tlsVerifyHostname]
+		}
+	})
+	command.SetTLSOverrides(tlsOverrides)
+	setOwnerGiven := false
+	flag.Visit(func(f *flag.Flag) {
+		// An empty -setOwner removes the owner, hence it is told apart from no -setOwner
+		if f.Name == "setOwner" {
+			setOwnerGiven = true
+		}
+	})
+	// Destructive actions on a device that has an owner are confirmed by either flag
+	ownerAcknowledged := *iAmOwner || *force
+	command.SetPasswordFile(*passwordFile)
+	if *verbose {
+		fs.SetTrace(os.Stderr)
+	}
+	if *dryRun {
+		switch {
+		case *action != "encrypt" && *action != "auto-unlock" && *action != "online-unlock":
+			sys.ErrorExit("-dryRun only applies to actions encrypt, auto-unlock, and online-unlock.")
+		case *token != "":
+			sys.ErrorExit("-dryRun cannot be combined with -token, the key server would use up the unlock token.")
+		case *resume:
+			sys.ErrorExit("-dryRun cannot be combined with -resume, the encryption to resume has already written its key.")
+		case *force && *action == "online-unlock":
+			sys.ErrorExit("-dryRun cannot be combined with -force, the key server would evict computers from the keys.")
+		}
+		routine.SetDryRun(true)
+	}
+	// A question that cannot be answered in scripted use ends the program with an error message
+	defer sys.ExitOnInputError()
+	cryptOpts := fs.CryptFormatOptions{
+		LUKSVersion:     *luksVersion,
+		Cipher:          *cipher,
+		KeySizeBits:     *keySize,
+		PBKDF:           *pbkdf,
+		PBKDFIterTimeMS: *pbkdfIterTime,
+		PBKDFIterations: *pbkdfIterations,
+		PBKDFMemoryKB:   *pbkdfMemory,
+		SectorSize:      *sectorSize,
+	}
 	switch *action {
+	case "doctor":
+		// Server and client - check the setup of this computer and print the findings
+		if err := command.Doctor(*output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "help":
 		PrintHelpAndExit(0)
 	case "daemon":
 		// Server - run key service daemon
-		if err := command.KeyRPCDaemon(); err != nil {
+		if err := command.KeyRPCDaemon(*logLevel); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "init-server":
 		// Server - complete the initial setup
-		if err := command.InitKeyServer(); err != nil {
+		if *answerFile != "" {
+			if err := command.InitKeyServerFromAnswers(*answerFile, *startService, *keyType); err != nil {
+				sys.ErrorExit("%v", err)
+			}
+		} else if err := command.InitKeyServer(*keyType); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "change-password":
+		// Server - change the access password without going through initial setup
+		if err := command.ChangeServerPassword(*oldPasswordFile, *newPasswordFile); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "list-keys":
-		// Server - print all key records sorted according to last access
-		if err := command.ListKeys(); err != nil {
+		// Server - print key records that meet the conditions, sorted according to last access by default
+		if err := command.ListKeys(*filter, *owner, *clientName, *sortBy, *onlyStale, *unused, *output); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "edit-key":
@@ -131,6 +432,12 @@ func main() {
 		if *deviceID == "" {
 			sys.ErrorExit("Please specify -deviceID of the key that you wish to edit.")
 		}
+		if setOwnerGiven {
+			if err := command.SetKeyOwner(*deviceID, *setOwner); err != nil {
+				sys.ErrorExit("%v", err)
+			}
+			return
+		}
 		if err := command.EditKey(*deviceID); err != nil {
 			sys.ErrorExit("%v", err)
 		}
@@ -139,57 +446,199 @@ func main() {
 		if *deviceID == "" {
 			sys.ErrorExit("Please specify -deviceID of the key that you wish to see.")
 		}
-		if err := command.ShowKey(*deviceID); err != nil {
+		if err := command.ShowKey(*deviceID, *output, *history); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "revert-key":
+		// Server - bring back the record details of a previous version
+		if *deviceID == "" || *version < 1 {
+			sys.ErrorExit("Please specify -deviceID of the key and the -version to revert to, see show-key -history.")
+		}
+		if err := command.RevertKey(*deviceID, *version); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "send-command":
-		if err := command.SendCommand(); err != nil {
+		if *timeout < 1 {
+			sys.ErrorExit("Please specify a positive -timeout in seconds.")
+		}
+		if err := command.SendCommand(*deviceID, *allowedClients, *pendingCommand, *expireMin, *group, *wait, *timeout, ownerAcknowledged); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "clear-commands":
-		if err := command.ClearPendingCommands(); err != nil {
+		if err := command.ClearPendingCommands(*deviceID, ownerAcknowledged); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "add-device":
 		if *deviceID == "" {
 			sys.ErrorExit("Please specify atlast -deviceID of the device.")
 		}
-		if err := command.AddDevice(*deviceID, *mappedName, *mountPoint, *mountOptions, *allowedClients, *maxActive, *autoEncryption, *fileSystem); err != nil {
+		if err := command.AddDevice(command.AddDeviceOptions{
+			DeviceID:          *deviceID,
+			MappedName:        *mappedName,
+			MountPoint:        *mountPoint,
+			MountOptions:      *mountOptions,
+			AllowedClients:    *allowedClients,
+			MaxActive:         *maxActive,
+			AutoEncryption:    *autoEncryption,
+			FileSystem:        *fileSystem,
+			Group:             *group,
+			GroupPriority:     *groupPriority,
+			Tags:              *tags,
+			Owner:             *owner,
+			UnlockAfter:       *unlockAfter,
+			FsckPolicy:        *fsck,
+			TangURL:           *tang,
+			UnlockWindows:     *unlockWindows,
+			UmountAtWindowEnd: *umountAtWindowEnd,
+			CryptOptions:      cryptOpts,
+			KeyFile:           *keyFile,
+			Force:             *force,
+		}); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "add-allowed-client":
-		if *deviceID == "" && *allowedClients == "" {
+		if *deviceID == "" || *allowedClients == "" {
 			sys.ErrorExit("Please specify -deviceID of the disk and the concerned DNS Name(s).")
 		}
-		for _, client := range strings.Split(*allowedClients, ",") {
-			if err := command.AddAllowedClient(*deviceID, client); err != nil {
-				sys.ErrorExit("%v", err)
-			}
+		if err := command.AddAllowedClient(*deviceID, strings.Split(*allowedClients, ",")); err != nil {
+			sys.ErrorExit("%v", err)
 		}
 
 	case "remove-allowed-client":
-		if *deviceID == "" && *allowedClients == "" {
+		if *deviceID == "" || *allowedClients == "" {
 			sys.ErrorExit("Please specify -deviceID of the disk and the concerned DNS Name(s).")
 		}
-		for _, client := range strings.Split(*allowedClients, ",") {
-			if err := command.AddAllowedClient(*deviceID, client); err != nil {
-				sys.ErrorExit("%v", err)
-			}
+		if err := command.DeleteAllowedClient(*deviceID, strings.Split(*allowedClients, ","), *force); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "create-group":
+		// Server - share allowed clients among many devices
+		if err := command.CreateClientGroup(*clientGroup, *allowedClients); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "edit-group":
+		if err := command.EditClientGroup(*clientGroup, *allowedClients); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "delete-group":
+		if err := command.DeleteClientGroup(*clientGroup, *force); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-groups":
+		if err := command.ListClientGroups(*output); err != nil {
+			sys.ErrorExit("%v", err)
 		}
 	case "list-allowed-clients":
 		if *deviceID == "" {
 			sys.ErrorExit("Please specify following parameter: -deviceID")
 		}
-		if err := command.ListAllowedClient(*deviceID); err != nil {
+		if err := command.ListAllowedClient(*deviceID, *output); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "create-client-certificate":
-		if *dnsName != "" {
-			if err := command.CreateCertificate(*dnsName, *ipAddress); err != nil {
+		if *dnsName != "" || *csrPath != "" {
+			if err := command.CreateCertificate(*dnsName, *ipAddress, *keyType, *csrPath, *validityDays); err != nil {
 				sys.ErrorExit("%v", err)
 			}
 		} else {
-			sys.ErrorExit("Please specify following parameter: -dnsName [-ipAddress]")
+			sys.ErrorExit("Please specify following parameter: -dnsName [-ipAddress] or -csr")
+		}
+	case "revoke-client-certificate":
+		if err := command.RevokeClientCertificate(*dnsName, *certSerial); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-client-certificates":
+		if err := command.ListClientCertificates(*output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "show-audit":
+		if err := command.ShowAudit(*deviceID, *host, *since, *until); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-client-inventory":
+		if err := command.ListClientInventory(*clientName, *output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "show-client":
+		// Server - show the encrypted devices of a client computer
+		if err := command.ShowClient(*clientName, *output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-client-devices":
+		// Server - list the devices of the given client, client - ask key server about this computer
+		if *allowedClient == "" {
+			if err := command.ListEntitledDevices(*output); err != nil {
+				sys.ErrorExit("%v", err)
+			}
+		} else if err := command.ListClientDevices(*allowedClient, *output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-alive":
+		if err := command.ListAlive(*deviceID, *host, *output, *live); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "kmip-status":
+		if err := command.ShowKMIPStatus(*output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "kmip-test":
+		if err := command.TestKMIPServers(*output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "server-status":
+		if err := command.ServerStatus(*output, *detail); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "maintenance-mode":
+		// Server - stop or resume handing out keys without shutting down the key server
+		if err := command.SetMaintenanceMode(*maintenanceState, *duration, *maintenanceReason); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "create-unlock-token":
+		// Server - create a one-time unlock token for break-glass access to a disk
+		if *deviceID == "" {
+			sys.ErrorExit("Please specify following parameter: -deviceID")
+		}
+		if err := command.CreateUnlockToken(*deviceID, *host, *duration); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "create-enrollment-token":
+		// Server - create a one-time enrollment token for a new client computer
+		if err := command.CreateEnrollmentToken(*host, *duration); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "migrate-keys":
+		if err := command.MigrateKeys(*direction, *online, *output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "backup-keydb", "export-keys":
+		if *exportOut != "" {
+			*archive = *exportOut
+		}
+		// The password file carries the backup passphrase, the key server password is asked for or taken from environment
+		command.SetPasswordFile("")
+		if err := command.BackupKeyDB(*archive, *publicKey, *passwordFile); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "restore-keydb", "import-keys":
+		if *importIn != "" {
+			*archive = *importIn
+		}
+		command.SetPasswordFile("")
+		if err := command.RestoreKeyDB(*archive, *privateKey, *passwordFile, *overwrite); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "fsck-keydb":
+		if err := command.FsckKeyDB(*restore, *output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "migrate-keydb-encryption":
+		if err := command.MigrateKeyDBEncryption(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "migrate-keydb":
+		if err := command.MigrateKeyDB(); err != nil {
+			sys.ErrorExit("%v", err)
 		}
 	// Client functions
 	case "client-daemon":
@@ -197,17 +646,119 @@ func main() {
 		if err := command.ClientDaemon(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "client-status":
+		// Client - ask the client daemon for the state of encrypted devices and key server connection
+		if err := command.ClientStatus(*output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "capabilities":
+		// Client - print key server capabilities
+		if err := command.ShowCapabilities(*server, *output); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "register-client":
+		// Client - request a client certificate and store the key server in client configuration
+		if err := command.RegisterClient(*server, *token, *dnsName, *inventory); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "encrypt":
 		// Client - set up a new encrypted disk
-		if err := command.EncryptFS(); err != nil {
+		if err := command.EncryptFS(*resume, *tang, cryptOpts); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "generate-systemd-units":
+		// Client - write systemd units that unlock disks before they are mounted
+		// The retry budget given on the command line is written into the units, otherwise the client configuration applies at boot
+		var retry *routine.UnlockRetry
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "maxRetrySec" || f.Name == "retryIntervalSec" {
+				if retry == nil {
+					defaults := command.AutoUnlockRetry()
+					retry = &defaults
+				}
+				if f.Name == "maxRetrySec" {
+					retry.MaxRetrySec = *maxRetrySec
+				} else {
+					retry.IntervalSec = *retryIntervalSec
+				}
+			}
+		})
+		if err := command.GenerateSystemdUnits(*deviceID, *unitDir, *enable, *force, retry); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "remove-systemd-units":
+		// Client - disable and remove the units written by generate-systemd-units
+		if err := command.RemoveSystemdUnits(*deviceID, *unitDir, *force); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "generate-initrd-config":
+		// Client - write the bundle for unlocking the root file system in the initrd
+		if *deviceID == "" {
+			sys.ErrorExit("Please specify -deviceID of the encrypted root file system.")
+		}
+		if err := command.GenerateInitrdConfig(*deviceID, *initrdDir); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "initrd-unlock":
+		// Client - unlock the root file system in the initrd, exit status tells the kind of failure
+		dir := *initrdDir
+		if dir == "" {
+			dir = routine.INITRD_CONFIG_DIR
+		}
+		sys.LockMem()
+		if err := routine.InitrdUnlock(os.Stderr, dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if initrdErr, isInitrdErr := err.(routine.InitrdError); isInitrdErr {
+				os.Exit(initrdErr.ExitStatus)
+			}
+			os.Exit(routine.InitrdExitConfig)
+		}
+	case "rotate-key":
+		// Client - replace the encryption key of a disk
+		if *deviceID == "" {
+			sys.ErrorExit("Please specify -deviceID of the disk whose key you wish to rotate.")
+		}
+		if err := command.RotateKey(*deviceID); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "inplace-encrypt":
+		// Client - encrypt an existing file system in-place
+		if err := command.InplaceEncryptFS(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "auto-unlock":
 		// Client - automatically unlock a file system without using a password
-		if *deviceID == "" {
-			sys.ErrorExit("Please specify following parameter: -deviceID")
+		if *token != "" {
+			if *deviceID == "" || strings.Contains(*deviceID, ",") || *all {
+				sys.ErrorExit("An unlock token unlocks a single disk, please specify it by -deviceID")
+			}
+			if err := command.TokenAutoUnlockFS(*deviceID, *token); err != nil {
+				sys.ErrorExit("%v", err)
+			}
+			return
+		}
+		if *deviceID == "" && !*all {
+			sys.ErrorExit("Please specify following parameter: -deviceID or -all")
 		}
-		if err := command.AutoOnlineUnlockFS(*deviceID); err != nil {
+		deviceIDs := make([]string, 0, 4)
+		seen := make(map[string]bool)
+		for _, id := range strings.Split(*deviceID, ",") {
+			if id = strings.TrimSpace(id); id != "" && !seen[id] {
+				seen[id] = true
+				deviceIDs = append(deviceIDs, id)
+			}
+		}
+		// Retry settings given on the command line take precedence over the client configuration
+		retry := command.AutoUnlockRetry()
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "maxRetrySec":
+				retry.MaxRetrySec = *maxRetrySec
+			case "retryIntervalSec":
+				retry.IntervalSec = *retryIntervalSec
+			}
+		})
+		if err := command.AutoOnlineUnlockFS(deviceIDs, *all, retry); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "check-auto-unlock":
@@ -219,8 +770,17 @@ func main() {
 			sys.ErrorExit("%v", err)
 		}
 	case "online-unlock":
-		// Client - manually unlock all file systems using a key server and password
-		if err := command.ManOnlineUnlockFS(); err != nil {
+		// Client - manually unlock all file systems using a key server and password, or a single one by unlock token
+		if *token != "" {
+			if *deviceID == "" {
+				sys.ErrorExit("An unlock token unlocks a single disk, please specify it by -deviceID")
+			}
+			if err := command.TokenOnlineUnlockFS(*deviceID, *token); err != nil {
+				sys.ErrorExit("%v", err)
+			}
+			return
+		}
+		if err := command.ManOnlineUnlockFS(*parallel, *force); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "offline-unlock":
@@ -228,9 +788,17 @@ func main() {
 		if err := command.ManOfflineUnlockFS(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "delete-key":
+		// Server - remove the key record of a disk that is gone, the disk itself is not touched
+		if *deviceID == "" {
+			sys.ErrorExit("Please specify -deviceID of the key record that you wish to delete.")
+		}
+		if err := command.DeleteKey(*deviceID, *force, ownerAcknowledged); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "erase":
 		// Client - erase encryption headers for the encrypted disk
-		if err := command.EraseKey(); err != nil {
+		if err := command.EraseKey(ownerAcknowledged, *keySlotOnly, *forgetKey); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	default:
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Called once the network is online (ip= on the kernel command line), the key never leaves memory.
+
+[ -e /tmp/cryptctl2-initrd-unlocked ] && exit 0
+/usr/sbin/cryptctl2 -action initrd-unlock
+case $? in
+	0) : > /tmp/cryptctl2-initrd-unlocked ;;
+	2) warn "cryptctl2: key server is unreachable" ;;
+	3) warn "cryptctl2: key server denied the key of the root file system" ;;
+	4) warn "cryptctl2: encrypted root device is not found" ;;
+	*) warn "cryptctl2: failed to unlock the root file system" ;;
+esac
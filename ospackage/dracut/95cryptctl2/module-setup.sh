@@ -0,0 +1,23 @@
+#!/bin/bash
+# Unlock the encrypted root file system by retrieving its key from the cryptctl2 key server.
+# Generate the bundle first: cryptctl2 -action generate-initrd-config -deviceID=UUID
+
+check() {
+	[ -f /etc/cryptctl2/initrd/config.json ] || return 1
+	return 0
+}
+
+depends() {
+	echo network crypt
+	return 0
+}
+
+install() {
+	inst /usr/sbin/cryptctl2
+	inst_multiple /sbin/cryptsetup /usr/bin/lsblk
+	inst_simple /etc/cryptctl2/initrd/config.json
+	inst_simple /etc/cryptctl2/initrd/client.crt
+	inst_simple /etc/cryptctl2/initrd/client.key
+	[ -f /etc/cryptctl2/initrd/ca.pem ] && inst_simple /etc/cryptctl2/initrd/ca.pem
+	inst_hook initqueue/online 90 "$moddir/cryptctl2-initrd-unlock.sh"
+}
@@ -0,0 +1,321 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ALIVE_STATE_DIR    = "/run/cryptctl2/alive"
+	HeldDiskFileMode   = sys.SecureFileMode // HeldDiskFileMode is the permission of held disk files.
+	HELD_DISK_POLL_SEC = 1                  // HELD_DISK_POLL_SEC is the interval at which a holder checks whether the disk is still held.
+)
+
+/*
+HeldDisk is a disk unlocked on this computer that needs alive reports. The auto-unlock process that unlocked the disk
+registers it in the alive state directory, and the client daemon sends the alive reports of all registered disks in
+one request.
+*/
+type HeldDisk struct {
+	UUID        string `json:"uuid"`         // UUID is the key record UUID.
+	Health      string `json:"health"`       // Health describes the problems of the disk, empty if healthy.
+	IntervalSec int    `json:"interval_sec"` // IntervalSec is the alive-report interval of the key record.
+	PID         int    `json:"pid"`          // PID is the process that holds the disk, the disk is released once it is gone.
+}
+
+// Return the path of the file that registers the held disk.
+func heldDiskPath(stateDir, uuid string) string {
+	return path.Join(stateDir, url.PathEscape(uuid)+".json")
+}
+
+// HoldDisk registers the disk in the state directory, so that the client daemon sends alive reports for it.
+func HoldDisk(stateDir string, disk HeldDisk) error {
+	if err := sys.MkdirSecure(stateDir); err != nil {
+		return err
+	}
+	content, err := json.Marshal(disk)
+	if err != nil {
+		return fmt.Errorf("HoldDisk: failed to serialise held disk - %v", err)
+	}
+	return sys.ReplaceFile(heldDiskPath(stateDir, disk.UUID), content, HeldDiskFileMode, false)
+}
+
+// ReleaseDisk removes the disk from the state directory, it is not an error if the disk is not held.
+func ReleaseDisk(stateDir, uuid string) error {
+	if err := os.Remove(heldDiskPath(stateDir, uuid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ReleaseDisk: failed to release disk \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
+
+// IsDiskHeld returns true if the disk is registered in the state directory.
+func IsDiskHeld(stateDir, uuid string) bool {
+	_, err := os.Stat(heldDiskPath(stateDir, uuid))
+	return err == nil
+}
+
+/*
+ListHeldDisks returns the disks registered in the state directory. Disks whose holder process is gone are released,
+and the files that cannot be read are skipped.
+*/
+func ListHeldDisks(stateDir string) (disks []HeldDisk, err error) {
+	entries, err := ioutil.ReadDir(stateDir)
+	if os.IsNotExist(err) {
+		return []HeldDisk{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ListHeldDisks: failed to read directory \"%s\" - %v", stateDir, err)
+	}
+	disks = make([]HeldDisk, 0, len(entries))
+	for _, entry := range entries {
+		// Skip the temporary files of sys.ReplaceFile
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(stateDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var disk HeldDisk
+		if err := json.Unmarshal(content, &disk); err != nil || disk.UUID == "" {
+			continue
+		}
+		if disk.PID > 0 && syscall.Kill(disk.PID, 0) == syscall.ESRCH {
+			ReleaseDisk(stateDir, disk.UUID)
+			continue
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+/*
+WaitForRelease blocks until the disk is no longer registered in the state directory, which happens when the key server
+rejects the alive report of the disk, or until stop is closed.
+*/
+func WaitForRelease(stateDir, uuid string, stop <-chan struct{}) {
+	for IsDiskHeld(stateDir, uuid) {
+		select {
+		case <-stop:
+			return
+		case <-time.After(HELD_DISK_POLL_SEC * time.Second):
+		}
+	}
+}
+
+/*
+AliveReporter sends the alive reports of all disks held by this computer in a single request per interval. Disks may
+be held and released at any time, the change takes effect on the next report. Disks rejected by the key server are
+released, and the rejection callback is invoked for each of them.
+*/
+type AliveReporter struct {
+	Client     *keyserv.CryptClient
+	OnRejected func(uuid string) // OnRejected is invoked after key server has rejected the alive report of a disk.
+	// MaxBackoffSec caps the number of seconds between reports as they back off after consecutive failures, the
+	// reports stay at the interval if it is not greater.
+	MaxBackoffSec int
+	// SealDir, if set, is where the offline unlocks by keys sealed by TPM2 are remembered, they are told to the key
+	// server along with the next report that succeeds.
+	SealDir string
+
+	mutex      sync.Mutex
+	held       map[string]HeldDisk
+	lastReport time.Time // lastReport is the moment of the most recent successful report.
+	lastErr    string    // lastErr is the failure of the most recent report, empty if it succeeded.
+}
+
+// NewAliveReporter returns an alive reporter that does not hold any disk yet.
+func NewAliveReporter(client *keyserv.CryptClient, onRejected func(uuid string)) *AliveReporter {
+	return &AliveReporter{
+		Client:     client,
+		OnRejected: onRejected,
+		held:       make(map[string]HeldDisk),
+	}
+}
+
+// Hold adds the disk to the reports, or updates its health and interval if it is already held.
+func (reporter *AliveReporter) Hold(disk HeldDisk) {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	reporter.held[disk.UUID] = disk
+}
+
+// Release removes the disk from the reports.
+func (reporter *AliveReporter) Release(uuid string) {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	delete(reporter.held, uuid)
+}
+
+// Held returns the sorted UUIDs of the held disks.
+func (reporter *AliveReporter) Held() []string {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	uuids := make([]string, 0, len(reporter.held))
+	for uuid := range reporter.held {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// SyncHeldDisks makes the held disks identical to those registered in the state directory.
+func (reporter *AliveReporter) SyncHeldDisks(stateDir string) error {
+	disks, err := ListHeldDisks(stateDir)
+	if err != nil {
+		return err
+	}
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	reporter.held = make(map[string]HeldDisk)
+	for _, disk := range disks {
+		reporter.held[disk.UUID] = disk
+	}
+	return nil
+}
+
+// LastReport returns the moment of the most recent successful report, and the failure of the most recent report if any.
+func (reporter *AliveReporter) LastReport() (time.Time, string) {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	return reporter.lastReport, reporter.lastErr
+}
+
+/*
+Interval returns the number of seconds until the next report, which is the shortest alive-report interval among the
+held disks, or REPORT_ALIVE_INTERVAL_SEC if no disk is held.
+*/
+func (reporter *AliveReporter) Interval() int {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	interval := 0
+	for _, disk := range reporter.held {
+		if disk.IntervalSec > 0 && (interval == 0 || disk.IntervalSec < interval) {
+			interval = disk.IntervalSec
+		}
+	}
+	if interval == 0 {
+		return REPORT_ALIVE_INTERVAL_SEC
+	} else if interval > MAX_REPORT_ALIVE_INTERVAL_SEC {
+		return MAX_REPORT_ALIVE_INTERVAL_SEC
+	}
+	return interval
+}
+
+/*
+Report sends one alive report for all held disks, along with the offline unlocks not yet told to the key server. The
+disks rejected by key server are released and returned, the other disks remain held. If no disk is held and there is no
+offline unlock to tell, nothing is sent.
+*/
+func (reporter *AliveReporter) Report() (rejected []string, err error) {
+	var offlineUnlocks map[string]int64
+	if reporter.SealDir != "" {
+		if offlineUnlocks, err = ListOfflineUnlocks(reporter.SealDir); err != nil {
+			return nil, err
+		}
+	}
+	reporter.mutex.Lock()
+	if len(reporter.held) == 0 && len(offlineUnlocks) == 0 {
+		reporter.mutex.Unlock()
+		return []string{}, nil
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	req := keyserv.ReportAliveReq{
+		Hostname: hostname,
+		UUIDs:    make([]string, 0, len(reporter.held)),
+	}
+	if len(offlineUnlocks) > 0 {
+		req.OfflineUnlocks = offlineUnlocks
+	}
+	for uuid, disk := range reporter.held {
+		req.UUIDs = append(req.UUIDs, uuid)
+		if disk.Health != "" {
+			if req.Health == nil {
+				req.Health = make(map[string]string)
+			}
+			req.Health[uuid] = disk.Health
+		}
+	}
+	reporter.mutex.Unlock()
+	sort.Strings(req.UUIDs)
+
+	rejected, err = reporter.Client.ReportAlive(req)
+	reporter.mutex.Lock()
+	if err == nil {
+		reporter.lastReport, reporter.lastErr = time.Now(), ""
+	} else {
+		reporter.lastErr = err.Error()
+	}
+	reporter.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for uuid, moment := range offlineUnlocks {
+		if err := ClearOfflineUnlock(reporter.SealDir, uuid, moment); err != nil {
+			return nil, err
+		}
+	}
+	for _, uuid := range rejected {
+		reporter.Release(uuid)
+		if reporter.OnRejected != nil {
+			reporter.OnRejected(uuid)
+		}
+	}
+	return rejected, nil
+}
+
+/*
+Run continuously sends alive reports for the held disks. If the state directory is given, the held disks are
+synchronised with the disks registered in it before each report, and the rejected disks are released from it too.
+Block caller until stop is closed.
+*/
+func (reporter *AliveReporter) Run(progressOut io.Writer, stateDir string, stop <-chan struct{}) {
+	numFailures := 0
+	for {
+		if stateDir != "" {
+			if err := reporter.SyncHeldDisks(stateDir); err != nil {
+				fmt.Fprintf(progressOut, "AliveReporter: %v\n", err)
+			}
+		}
+		rejected, err := reporter.Report()
+		if stateDir != "" {
+			for _, uuid := range rejected {
+				if err := ReleaseDisk(stateDir, uuid); err != nil {
+					fmt.Fprintf(progressOut, "AliveReporter: %v\n", err)
+				}
+			}
+		}
+		// In case of failure, only report the first few occasions among consecutive failures.
+		if err == nil {
+			if numFailures > 0 {
+				fmt.Fprintf(progressOut, "AliveReporter: succeeded for %d disks\n", len(reporter.Held()))
+			}
+			numFailures = 0
+		} else {
+			if numFailures == 5 {
+				fmt.Fprint(progressOut, "AliveReporter: suppress further failure messages until next success\n")
+			} else if numFailures < 5 {
+				fmt.Fprintf(progressOut, "AliveReporter: failed to send message for %d disks - %v\n", len(reporter.Held()), err)
+			}
+			numFailures++
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(Backoff{BaseSec: int64(reporter.Interval()), MaxSec: int64(reporter.MaxBackoffSec)}.Wait(numFailures)):
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeldDisks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if disks, err := ListHeldDisks(tmpDir + "/does-not-exist"); err != nil || len(disks) != 0 {
+		t.Fatal(disks, err)
+	}
+	if err := HoldDisk(tmpDir, HeldDisk{UUID: "SERIAL:abc", IntervalSec: 30, PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+	// The holder of this disk is long gone
+	if err := HoldDisk(tmpDir, HeldDisk{UUID: "def", PID: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := ListHeldDisks(tmpDir)
+	if err != nil || len(disks) != 1 || disks[0].UUID != "SERIAL:abc" || disks[0].IntervalSec != 30 {
+		t.Fatal(disks, err)
+	}
+	if IsDiskHeld(tmpDir, "def") || !IsDiskHeld(tmpDir, "SERIAL:abc") {
+		t.Fatal("wrong held disks")
+	}
+	stop := make(chan struct{})
+	close(stop)
+	WaitForRelease(tmpDir, "SERIAL:abc", stop)
+	if err := ReleaseDisk(tmpDir, "SERIAL:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseDisk(tmpDir, "SERIAL:abc"); err != nil {
+		t.Fatal(err)
+	}
+	WaitForRelease(tmpDir, "SERIAL:abc", make(chan struct{}))
+	if disks, err := ListHeldDisks(tmpDir); err != nil || len(disks) != 0 {
+		t.Fatal(disks, err)
+	}
+}
+
+func TestAliveReporter(t *testing.T) {
+	client, server, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	now := time.Now().Unix()
+	rec := keydb.Record{
+		UUID:             "held",
+		Key:              []byte{1, 2, 3},
+		MountPoint:       "/a",
+		AliveIntervalSec: 1,
+		AliveCount:       4,
+		AliveMessages:    map[string][]keydb.AliveMessage{"127.0.0.1": {{Hostname: "localhost", IP: "127.0.0.1", Timestamp: now}}},
+	}
+	if _, err := server.KeyDB.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	rejectedByCallback := make([]string, 0)
+	reporter := NewAliveReporter(client, func(uuid string) {
+		rejectedByCallback = append(rejectedByCallback, uuid)
+	})
+	if rejected, err := reporter.Report(); err != nil || len(rejected) != 0 {
+		t.Fatal(rejected, err)
+	}
+	if interval := reporter.Interval(); interval != REPORT_ALIVE_INTERVAL_SEC {
+		t.Fatal(interval)
+	}
+	reporter.Hold(HeldDisk{UUID: "held", IntervalSec: 20, Health: "bind-mount failed"})
+	reporter.Hold(HeldDisk{UUID: "gone", IntervalSec: 5})
+	if interval := reporter.Interval(); interval != 5 {
+		t.Fatal(interval)
+	}
+	// Only the disk without a record is rejected
+	if rejected, err := reporter.Report(); err != nil || !reflect.DeepEqual(rejected, []string{"gone"}) {
+		t.Fatal(rejected, err)
+	}
+	if held := reporter.Held(); !reflect.DeepEqual(held, []string{"held"}) || !reflect.DeepEqual(rejectedByCallback, []string{"gone"}) {
+		t.Fatal(held, rejectedByCallback)
+	}
+	rec, _ = server.KeyDB.GetByUUID("held")
+	if beats := rec.AliveMessages["127.0.0.1"]; len(beats) != 2 || beats[1].Health != "bind-mount failed" {
+		t.Fatal(beats)
+	}
+	reporter.Release("held")
+	if held := reporter.Held(); len(held) != 0 {
+		t.Fatal(held)
+	}
+}
+
+func TestAliveReporterOfflineUnlocks(t *testing.T) {
+	client, _, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	sealDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sealDir)
+	if err := MarkOfflineUnlock(sealDir, "sealed", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// The offline unlock stays until the key server is reachable
+	unreachable, err := keyserv.NewCryptClient("tcp", "127.0.0.1:1", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := NewAliveReporter(unreachable, nil)
+	reporter.SealDir = sealDir
+	if _, err := reporter.Report(); err == nil {
+		t.Fatal("did not error")
+	}
+	if unlocks, err := ListOfflineUnlocks(sealDir); err != nil || len(unlocks) != 1 {
+		t.Fatal(unlocks, err)
+	}
+	// It is told even if no disk is held, and then forgotten
+	reporter = NewAliveReporter(client, nil)
+	reporter.SealDir = sealDir
+	if rejected, err := reporter.Report(); err != nil || len(rejected) != 0 {
+		t.Fatal(rejected, err)
+	}
+	if unlocks, err := ListOfflineUnlocks(sealDir); err != nil || len(unlocks) != 0 {
+		t.Fatal(unlocks, err)
+	}
+}
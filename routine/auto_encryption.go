@@ -0,0 +1,131 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	CLIENT_CONF_AUTO_ENCRYPT_SCAN = "AUTO_ENCRYPT_SCAN_INTERVAL_SEC" // CLIENT_CONF_AUTO_ENCRYPT_SCAN is the client configuration key of the interval between scans for blank disks.
+
+	AUTO_ENCRYPT_SCAN_INTERVAL_SEC = 300 // AUTO_ENCRYPT_SCAN_INTERVAL_SEC is the default interval between scans for blank disks, 0 turns the scans off.
+)
+
+/*
+Return true if the block device carries nothing that auto-encryption could destroy: neither a file system (nor any
+other signature such as LUKS or LVM), nor a partition table, and it is not mounted.
+*/
+func IsBlankDevice(dev fs.BlockDevice) bool {
+	return dev.FileSystem == "" && dev.MountPoint == "" && !(dev.Type == "disk" && dev.PTUUID != "")
+}
+
+/*
+Return true if a record that forces automatic encryption may format the block device regardless of its content: it is
+neither LUKS encrypted nor mounted, and none of its partitions are either.
+*/
+func IsForceEncryptableDevice(devs fs.BlockDevices, dev fs.BlockDevice) bool {
+	if dev.IsLUKSEncrypted() || dev.MountPoint != "" {
+		return false
+	}
+	if dev.Type == "disk" && dev.PTUUID != "" {
+		for _, part := range devs {
+			if part.Type != "disk" && part.PTUUID == dev.PTUUID && (part.IsLUKSEncrypted() || part.MountPoint != "") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+FindAutoEncryptDisks returns the blank block devices (see IsBlankDevice) that are identified by any of their stable
+IDs by a record that the computer is entitled to and that allows automatic encryption, by record UUID. A record that
+forces automatic encryption also gets the device if it is not blank, see IsForceEncryptableDevice.
+*/
+func FindAutoEncryptDisks(devs fs.BlockDevices, entitled []keydb.ClientDevice) map[string]fs.BlockDevice {
+	records := make(map[string]keydb.ClientDevice)
+	for _, device := range entitled {
+		if device.AutoEncryption {
+			records[keydb.CanonicalRecordID(device.UUID)] = device
+		}
+	}
+	disks := make(map[string]fs.BlockDevice)
+	for _, dev := range devs {
+		for _, id := range dev.DeviceIDs() {
+			device, found := records[keydb.CanonicalRecordID(id)]
+			if id == "" || !found {
+				continue
+			}
+			if IsBlankDevice(dev) || device.AutoEncryptForce && IsForceEncryptableDevice(devs, dev) {
+				disks[keydb.CanonicalRecordID(id)] = dev
+			}
+			break
+		}
+	}
+	return disks
+}
+
+/*
+AutoEncryptDisks retrieves the keys of the blank disks found by FindAutoEncryptDisks, and has UnlockFS encrypt, format,
+and mount each disk whose record still allows automatic encryption. Failures are reported to the key server like those
+of auto-unlock, and each disk that is encrypted is reported by ReportAutoEncryption so that show-key tells who did it.
+The results are returned in the order of record UUIDs.
+*/
+func AutoEncryptDisks(progressOut io.Writer, client *keyserv.CryptClient, disks map[string]fs.BlockDevice) ([]AutoUnlockResult, error) {
+	sys.LockMem()
+	uuids := make([]string, 0, len(disks))
+	for uuid := range disks {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	if len(uuids) == 0 {
+		return []AutoUnlockResult{}, nil
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.AutoRetrieveKey(keyserv.AutoRetrieveKeyReq{UUIDs: uuids, Hostname: hostname})
+	if err != nil {
+		return nil, fmt.Errorf("AutoEncryptDisks: failed to retrieve the keys of %d blank disks - %v", len(uuids), err)
+	}
+	defer wipeGrantedKeys(resp.Granted)
+	results := make([]AutoUnlockResult, 0, len(uuids))
+	for _, uuid := range uuids {
+		result := AutoUnlockResult{DeviceID: disks[uuid].Path, RecordID: uuid}
+		rec, found := resp.Granted[uuid]
+		if !found {
+			result.Missing = true
+			result.Err = fmt.Errorf("key server did not hand out the key of record \"%s\"", uuid)
+			results = append(results, result)
+			continue
+		} else if !rec.AutoEncryption {
+			result.Err = fmt.Errorf("record \"%s\" no longer allows automatic encryption", uuid)
+			results = append(results, result)
+			continue
+		} else if !IsBlankDevice(disks[uuid]) && !rec.AutoEncryptForce {
+			result.Err = fmt.Errorf("record \"%s\" no longer allows automatic encryption of a disk that is not blank", uuid)
+			results = append(results, result)
+			continue
+		}
+		result.AliveIntervalSec = rec.AliveIntervalSec
+		fmt.Fprintf(progressOut, "Going to encrypt blank disk \"%s\" for record \"%s\"\n", disks[uuid].Path, uuid)
+		if result.Err = unlockGranted(progressOut, client, rec, ""); result.Err == nil || isBindMountErrors(result.Err) {
+			if err := client.ReportAutoEncryption(keyserv.ReportAutoEncryptionReq{Hostname: hostname, UUID: uuid, Device: disks[uuid].Path}); err != nil {
+				fmt.Fprintf(progressOut, "AutoEncryptDisks: failed to report the encryption of disk \"%s\" - %v\n", uuid, err)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Return true if the error only tells about failed bind-mounts, the disk is in use regardless.
+func isBindMountErrors(err error) bool {
+	_, is := err.(BindMountErrors)
+	return is
+}
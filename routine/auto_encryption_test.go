@@ -0,0 +1,84 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"testing"
+)
+
+func TestFindAutoEncryptDisks(t *testing.T) {
+	devs := fs.BlockDevices{
+		{Path: "/dev/sdb", Type: "disk", SERIAL: "blank1"},
+		{Path: "/dev/sdc", Type: "disk", SERIAL: "hasfs", UUID: "fs-uuid", FileSystem: "xfs"},
+		{Path: "/dev/sdd", Type: "disk", SERIAL: "partitioned", PTUUID: "pt-uuid"},
+		{Path: "/dev/sdd1", Type: "part", PTUUID: "pt-uuid", PARTUUID: "part-uuid"},
+		{Path: "/dev/sde", Type: "disk", SERIAL: "notauto"},
+		{Path: "/dev/sdf", Type: "disk", SERIAL: "unknown"},
+	}
+	entitled := []keydb.ClientDevice{
+		{UUID: "SERIAL:blank1", AutoEncryption: true},
+		{UUID: "SERIAL:hasfs", AutoEncryption: true},
+		{UUID: "SERIAL:partitioned", AutoEncryption: true},
+		{UUID: "PARTUUID:part-uuid", AutoEncryption: true},
+		{UUID: "SERIAL:notauto"},
+	}
+	disks := FindAutoEncryptDisks(devs, entitled)
+	if len(disks) != 2 || disks["SERIAL:blank1"].Path != "/dev/sdb" || disks["PARTUUID:part-uuid"].Path != "/dev/sdd1" {
+		t.Fatalf("%+v", disks)
+	}
+	if IsBlankDevice(fs.BlockDevice{Path: "/dev/sdb", MountPoint: "/mnt"}) || IsBlankDevice(fs.BlockDevice{FileSystem: "crypto_LUKS"}) {
+		t.Fatal("not blank")
+	}
+}
+
+func TestAutoEncryptForce(t *testing.T) {
+	devs := fs.BlockDevices{
+		{Path: "/dev/sdb", Type: "disk", SERIAL: "hasfs", UUID: "fs-uuid", FileSystem: "xfs"},
+		{Path: "/dev/sdc", Type: "disk", SERIAL: "mounted", UUID: "mnt-uuid", FileSystem: "xfs", MountPoint: "/mnt"},
+		{Path: "/dev/sdd", Type: "disk", SERIAL: "partmounted", PTUUID: "pt-uuid"},
+		{Path: "/dev/sdd1", Type: "part", PTUUID: "pt-uuid", PARTUUID: "part-uuid", FileSystem: "ext4", MountPoint: "/"},
+		{Path: "/dev/sde", Type: "disk", SERIAL: "luks", UUID: "luks-uuid", FileSystem: "crypto_LUKS"},
+	}
+	entitled := []keydb.ClientDevice{
+		{UUID: "SERIAL:hasfs", AutoEncryption: true},
+		{UUID: "SERIAL:mounted", AutoEncryption: true, AutoEncryptForce: true},
+		{UUID: "SERIAL:partmounted", AutoEncryption: true, AutoEncryptForce: true},
+		{UUID: "SERIAL:luks", AutoEncryption: true, AutoEncryptForce: true},
+	}
+	// A disk carrying a file system is left alone without the force flag
+	if disks := FindAutoEncryptDisks(devs, entitled); len(disks) != 0 {
+		t.Fatalf("%+v", disks)
+	}
+	entitled[0].AutoEncryptForce = true
+	if disks := FindAutoEncryptDisks(devs, entitled); len(disks) != 1 || disks["SERIAL:hasfs"].Path != "/dev/sdb" {
+		t.Fatalf("%+v", disks)
+	}
+
+	fakeUnlockFS(t, 0)
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{{UUID: "fakeuuid", Path: "/dev/fake1", FileSystem: "xfs"}}
+	}
+	formatted := 0
+	cryptFormat = func(key sys.SecureBytes, blockDev, uuid string, opts fs.CryptFormatOptions) error {
+		formatted++
+		return nil
+	}
+	format = func(string, string) error { return nil }
+	t.Cleanup(func() {
+		cryptFormat, format = fs.CryptFormat, fs.Format
+	})
+	rec := keydb.Record{UUID: "fakeuuid", MappedName: "cryptctl2-unlocktest-doesnotexist", AutoEncryption: true, FileSystem: "ext4"}
+	var out bytes.Buffer
+	UnlockFS(&out, rec, 1)
+	if formatted != 0 {
+		t.Fatal("formatted a disk carrying a file system")
+	}
+	rec.AutoEncryptForce = true
+	if err := UnlockFS(&out, rec, 1); err != nil || formatted != 1 {
+		t.Fatal(err, formatted, out.String())
+	}
+}
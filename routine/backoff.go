@@ -0,0 +1,48 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	CLIENT_CONF_ALIVE_MAX_BACKOFF = "REPORT_ALIVE_MAX_BACKOFF_SEC" // CLIENT_CONF_ALIVE_MAX_BACKOFF is the client configuration key of AliveReporter.MaxBackoffSec.
+
+	AUTO_UNLOCK_MAX_RETRY_INTERVAL_SEC = 60 // AUTO_UNLOCK_MAX_RETRY_INTERVAL_SEC is the default cap of the wait between failed auto-unlock attempts.
+	REPORT_ALIVE_MAX_BACKOFF_SEC       = 60 // REPORT_ALIVE_MAX_BACKOFF_SEC is the default cap of the wait between failed alive reports.
+)
+
+/*
+Backoff tells how long to wait before trying again after consecutive failures to reach key server. The wait doubles
+with each failure up to the cap, and a random part of it is left out, so that the computers that lost the key server
+together (e.g. while it restarted) do not all come back to it at the same moment.
+*/
+type Backoff struct {
+	BaseSec int64 // BaseSec is the wait before the first retry.
+	MaxSec  int64 // MaxSec caps the wait, the wait does not grow if it is not greater than BaseSec.
+}
+
+/*
+Wait returns the wait after the number of consecutive failures, which is BaseSec exactly if there is none. Otherwise it
+is drawn at random from the upper half of BaseSec doubled for each failure but the first, and capped at MaxSec.
+*/
+func (backoff Backoff) Wait(failures int) time.Duration {
+	base := time.Duration(backoff.BaseSec) * time.Second
+	if failures < 1 || base <= 0 {
+		return base
+	}
+	limit := time.Duration(backoff.MaxSec) * time.Second
+	if limit < base {
+		limit = base
+	}
+	wait := base
+	for i := 1; i < failures && wait < limit; i++ {
+		wait *= 2
+	}
+	if wait > limit {
+		wait = limit
+	}
+	return wait - time.Duration(rand.Int63n(int64(wait/2)+1))
+}
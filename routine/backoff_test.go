@@ -0,0 +1,42 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	backoff := Backoff{BaseSec: 5, MaxSec: 60}
+	if wait := backoff.Wait(0); wait != 5*time.Second {
+		t.Fatal(wait)
+	}
+	for failures, upper := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 3: 20 * time.Second, 4: 40 * time.Second, 5: time.Minute, 100: time.Minute} {
+		spread := make(map[time.Duration]bool)
+		for i := 0; i < 50; i++ {
+			wait := backoff.Wait(failures)
+			if wait < upper/2 || wait > upper {
+				t.Fatal(failures, wait)
+			}
+			spread[wait] = true
+		}
+		// Computers that failed together must not retry in lockstep
+		if len(spread) < 2 {
+			t.Fatal(failures, spread)
+		}
+	}
+	// A cap below the base does not shorten the wait, and the wait does not grow
+	if wait := (Backoff{BaseSec: 10, MaxSec: 1}).Wait(3); wait < 5*time.Second || wait > 10*time.Second {
+		t.Fatal(wait)
+	}
+	if wait := (Backoff{}).Wait(3); wait != 0 {
+		t.Fatal(wait)
+	}
+	if wait := (UnlockRetry{IntervalSec: 2}).wait(0); wait != 2*time.Second {
+		t.Fatal(wait)
+	}
+	if wait := (UnlockRetry{IntervalSec: 2, MaxIntervalSec: 8}).wait(10); wait < 4*time.Second || wait > 8*time.Second {
+		t.Fatal(wait)
+	}
+}
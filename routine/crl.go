@@ -0,0 +1,214 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/sys"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CRLFileName     = "ca.crl"       // CRLFileName is the revocation list of the CA in the certificate directory.
+	RevokedFileName = "revoked.json" // RevokedFileName is the index of revoked certificates in the certificate directory.
+)
+
+// RevokedCert is a certificate revoked by the CA of the certificate directory.
+type RevokedCert struct {
+	Serial     string `json:"serial"`      // Serial is the serial number in decimal.
+	CommonName string `json:"common_name"` // CommonName is the common name of the certificate, empty if it was revoked by serial number alone.
+	RevokedAt  int64  `json:"revoked_at"`  // RevokedAt is the time of revocation in Unix seconds.
+}
+
+// IssuedCert is a certificate file of the certificate directory along with its revocation status.
+type IssuedCert struct {
+	Serial     string   `json:"serial"`
+	CommonName string   `json:"common_name"`
+	DNSNames   []string `json:"dns_names"`
+	NotAfter   int64    `json:"not_after"`
+	Revoked    bool     `json:"revoked"`
+	RevokedAt  int64    `json:"revoked_at,omitempty"`
+}
+
+// ReadRevokedCerts reads the index of certificates revoked by the CA of the certificate directory, none if there is no index.
+func ReadRevokedCerts(certDir string) ([]RevokedCert, error) {
+	content, err := os.ReadFile(path.Join(certDir, RevokedFileName))
+	if os.IsNotExist(err) {
+		return []RevokedCert{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	revoked := make([]RevokedCert, 0)
+	if err := json.Unmarshal(content, &revoked); err != nil {
+		return nil, fmt.Errorf("ReadRevokedCerts: failed to decode %s - %v", RevokedFileName, err)
+	}
+	return revoked, nil
+}
+
+/*
+ListCertificates returns the certificates issued into the certificate directory by its CA, in order of serial number,
+along with their revocation status. The server certificate is among them, the CA certificate is not.
+*/
+func ListCertificates(certDir string) ([]IssuedCert, error) {
+	revoked, err := ReadRevokedCerts(certDir)
+	if err != nil {
+		return nil, err
+	}
+	revokedAt := make(map[string]int64, len(revoked))
+	for _, rec := range revoked {
+		revokedAt[rec.Serial] = rec.RevokedAt
+	}
+	entries, err := os.ReadDir(certDir)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]IssuedCert, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".crt") || entry.Name() == "ca.crt" {
+			continue
+		}
+		cert, err := readCertificateFile(path.Join(certDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		issued := IssuedCert{
+			Serial:     cert.SerialNumber.String(),
+			CommonName: cert.Subject.CommonName,
+			DNSNames:   cert.DNSNames,
+			NotAfter:   cert.NotAfter.Unix(),
+		}
+		issued.RevokedAt, issued.Revoked = revokedAt[issued.Serial]
+		certs = append(certs, issued)
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		a, _ := new(big.Int).SetString(certs[i].Serial, 10)
+		b, _ := new(big.Int).SetString(certs[j].Serial, 10)
+		return a.Cmp(b) < 0
+	})
+	return certs, nil
+}
+
+// Read the PEM certificate file.
+func readCertificateFile(certPath string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("\"%s\" is not a PEM-encoded certificate", certPath)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+/*
+RevokeCertificate revokes the certificate issued for the DNS name (named after it in the certificate directory), or the
+certificate of the decimal serial number, which is revoked even if its file is gone. The revocation is recorded in the
+index of the certificate directory, and the revocation list of the CA is written again.
+*/
+func RevokeCertificate(certDir, dnsName, serial string) (RevokedCert, error) {
+	if (dnsName == "") == (serial == "") {
+		return RevokedCert{}, fmt.Errorf("Give either the DNS name or the serial number of the certificate to revoke")
+	}
+	revocation := RevokedCert{Serial: serial, RevokedAt: time.Now().Unix()}
+	if dnsName != "" {
+		if strings.ContainsAny(dnsName, "/ \t\n") || dnsName == "ca" {
+			return RevokedCert{}, fmt.Errorf("\"%s\" is not a valid DNS name", dnsName)
+		}
+		cert, err := readCertificateFile(path.Join(certDir, dnsName+".crt"))
+		if err != nil {
+			return RevokedCert{}, err
+		}
+		revocation.Serial, revocation.CommonName = cert.SerialNumber.String(), cert.Subject.CommonName
+	} else {
+		number, ok := new(big.Int).SetString(serial, 10)
+		if !ok || number.Sign() <= 0 {
+			return RevokedCert{}, fmt.Errorf("\"%s\" is not a valid serial number", serial)
+		}
+		revocation.Serial = number.String()
+		issued, err := ListCertificates(certDir)
+		if err != nil {
+			return RevokedCert{}, err
+		}
+		for _, cert := range issued {
+			if cert.Serial == revocation.Serial {
+				revocation.CommonName = cert.CommonName
+			}
+		}
+	}
+	caCert, _, err := LoadCA(certDir)
+	if err != nil {
+		return RevokedCert{}, err
+	}
+	if revocation.Serial == caCert.SerialNumber.String() {
+		return RevokedCert{}, fmt.Errorf("Serial number %s belongs to the CA certificate", revocation.Serial)
+	}
+	revoked, err := ReadRevokedCerts(certDir)
+	if err != nil {
+		return RevokedCert{}, err
+	}
+	for _, rec := range revoked {
+		if rec.Serial == revocation.Serial {
+			return RevokedCert{}, fmt.Errorf("Certificate of serial number %s has already been revoked on %s",
+				rec.Serial, time.Unix(rec.RevokedAt, 0).Format(time.RFC3339))
+		}
+	}
+	revoked = append(revoked, revocation)
+	content, err := json.MarshalIndent(revoked, "", "  ")
+	if err != nil {
+		return RevokedCert{}, err
+	}
+	if err := sys.ReplaceFile(path.Join(certDir, RevokedFileName), content, sys.SecureFileMode, true); err != nil {
+		return RevokedCert{}, err
+	}
+	return revocation, WriteRevocationList(certDir)
+}
+
+/*
+WriteRevocationList writes the revocation list of the CA in the certificate directory from the index of revoked
+certificates. The file is replaced as a whole, so that a key server never reads half of it.
+*/
+func WriteRevocationList(certDir string) error {
+	caCert, caPrivKey, err := LoadCA(certDir)
+	if err != nil {
+		return err
+	}
+	revoked, err := ReadRevokedCerts(certDir)
+	if err != nil {
+		return err
+	}
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, rec := range revoked {
+		number, ok := new(big.Int).SetString(rec.Serial, 10)
+		if !ok {
+			return fmt.Errorf("WriteRevocationList: malformed serial number \"%s\" in %s", rec.Serial, RevokedFileName)
+		}
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: number, RevocationTime: time.Unix(rec.RevokedAt, 0).UTC()})
+	}
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          caCert.NotAfter,
+		RevokedCertificates: entries,
+	}
+	// CAs generated by older versions lack the CRL signing key usage, the key server accepts their lists regardless
+	issuer := *caCert
+	issuer.KeyUsage |= x509.KeyUsageCRLSign
+	crlDER, err := x509.CreateRevocationList(rand.Reader, template, &issuer, caPrivKey)
+	if err != nil {
+		return err
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+	return sys.ReplaceFile(path.Join(certDir, CRLFileName), crlPEM, 0644, true)
+}
@@ -0,0 +1,79 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/keyserv"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokeCertificate(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+	if err := GenerateSelfSignedCaCert("server.example.com", "", certDir, "test", 1, CertKeyTypeECDSAP256); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"client1", "client2"} {
+		if err := GenerateCertificate(name, "", certDir, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Without a revocation list nothing is revoked
+	crl, err := keyserv.NewCRLReloader(path.Join(certDir, CRLFileName), path.Join(certDir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshakeWith(t, certDir, "server.example.com", "client1", crl.VerifyPeerCertificate); err != nil {
+		t.Fatal(err)
+	}
+	revocation, err := RevokeCertificate(certDir, "client1", "")
+	if err != nil || revocation.CommonName != "client1" || revocation.Serial != "3" {
+		t.Fatal(revocation, err)
+	}
+	// The key server picks up the revocation list as soon as it is written
+	if err := handshakeWith(t, certDir, "server.example.com", "client1", crl.VerifyPeerCertificate); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatal(err)
+	}
+	if err := handshakeWith(t, certDir, "server.example.com", "client2", crl.VerifyPeerCertificate); err != nil {
+		t.Fatal(err)
+	}
+	// Revoke by serial number
+	time.Sleep(10 * time.Millisecond)
+	if revocation, err := RevokeCertificate(certDir, "", "4"); err != nil || revocation.CommonName != "client2" {
+		t.Fatal(revocation, err)
+	}
+	if err := handshakeWith(t, certDir, "server.example.com", "client2", crl.VerifyPeerCertificate); err == nil {
+		t.Fatal("did not error")
+	}
+	for _, bad := range [][2]string{{"client1", ""}, {"", "4"}, {"", ""}, {"client1", "3"}, {"", "x"}, {"", "1"}, {"missing", ""}, {"ca", ""}} {
+		if _, err := RevokeCertificate(certDir, bad[0], bad[1]); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	certs, err := ListCertificates(certDir)
+	if err != nil || len(certs) != 3 {
+		t.Fatal(certs, err)
+	}
+	if certs[0].CommonName != "server.example.com" || certs[0].Revoked || !certs[1].Revoked || !certs[2].Revoked || certs[2].Serial != "4" {
+		t.Fatalf("%+v", certs)
+	}
+	// A revocation list that is tampered with keeps the previous one in effect
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(path.Join(certDir, CRLFileName), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshakeWith(t, certDir, "server.example.com", "client2", crl.VerifyPeerCertificate); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := keyserv.NewCRLReloader(path.Join(certDir, CRLFileName), path.Join(certDir, "ca.crt")); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,181 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DoctorClockSkewWarn = 30 * time.Second // DoctorClockSkewWarn is the clock difference from key server that is warned of.
+	DoctorClockSkewFail = 5 * time.Minute  // DoctorClockSkewFail is the clock difference from key server that upsets certificates and unlock tokens.
+)
+
+// The programs the client cannot do without.
+var doctorRequiredPrograms = []string{fs.BIN_CRYPTSETUP, fs.BIN_MOUNT, fs.BIN_UMOUNT, fs.BIN_LSBLK, fs.BIN_BLKID}
+
+// Return a finding of whether the program is present and executable, its absence is of the result given.
+func diagnoseProgram(program, absentResult, hint string) keyserv.DoctorFinding {
+	const check = "program"
+	st, err := os.Stat(program)
+	if err != nil {
+		return keyserv.NewDoctorFinding(check, absentResult, fmt.Sprintf("\"%s\" cannot be found - %v", program, err), hint)
+	} else if st.IsDir() || st.Mode()&0111 == 0 {
+		return keyserv.NewDoctorFinding(check, absentResult, fmt.Sprintf("\"%s\" is not executable", program), hint)
+	}
+	return keyserv.NewDoctorFinding(check, keyserv.DoctorPass, fmt.Sprintf("\"%s\" is present", program), "")
+}
+
+/*
+DiagnoseClockSkew compares the clock of key server with the local clock, which is taken as the middle of the moments
+before and after asking the server, so that the round trip does not count as difference.
+*/
+func DiagnoseClockSkew(serverTime, localBefore, localAfter time.Time) keyserv.DoctorFinding {
+	const check = "clock"
+	if serverTime.IsZero() {
+		return keyserv.NewDoctorFinding(check, keyserv.DoctorWarn, "key server is too old to tell its clock", "upgrade the key server to compare clocks")
+	}
+	local := localBefore.Add(localAfter.Sub(localBefore) / 2)
+	skew := serverTime.Sub(local)
+	if skew < 0 {
+		skew = -skew
+	}
+	detail := fmt.Sprintf("the clock differs from key server by %s", skew.Round(time.Millisecond))
+	hint := "synchronise the clocks of this computer and key server with NTP"
+	switch {
+	case skew > DoctorClockSkewFail:
+		return keyserv.NewDoctorFinding(check, keyserv.DoctorFail, detail, hint)
+	case skew > DoctorClockSkewWarn:
+		return keyserv.NewDoctorFinding(check, keyserv.DoctorWarn, detail, hint)
+	}
+	return keyserv.NewDoctorFinding(check, keyserv.DoctorPass, detail, "")
+}
+
+/*
+DiagnoseLocalDevices checks that each encrypted device of this computer has a record on key server that allows this
+computer, and that the device mapper names of the records do not collide with each other or with mappings of other
+devices. The mapping function returns the device behind an existing mapper name, or an empty string if the name is free.
+*/
+func DiagnoseLocalDevices(blockDevs fs.BlockDevices, entitled []keydb.ClientDevice, mappedDevice func(dmName string) string) []keyserv.DoctorFinding {
+	const check = "encrypted device"
+	findings := make([]keyserv.DoctorFinding, 0, len(blockDevs))
+	entitledByUUID := make(map[string]keydb.ClientDevice, len(entitled))
+	recordsByMappedName := make(map[string][]string)
+	mappedNames := make([]string, 0, len(entitled))
+	for _, dev := range entitled {
+		entitledByUUID[dev.UUID] = dev
+		if dev.MappedName != "" {
+			if _, seen := recordsByMappedName[dev.MappedName]; !seen {
+				mappedNames = append(mappedNames, dev.MappedName)
+			}
+			recordsByMappedName[dev.MappedName] = append(recordsByMappedName[dev.MappedName], dev.UUID)
+		}
+	}
+	for _, dmName := range mappedNames {
+		if uuids := recordsByMappedName[dmName]; len(uuids) > 1 {
+			findings = append(findings, keyserv.NewDoctorFinding("device mapper name", keyserv.DoctorFail,
+				fmt.Sprintf("records %s share device mapper name \"%s\", only one of them can be unlocked", strings.Join(uuids, ", "), dmName),
+				"give the records distinct mapped names by add-device -mappedName"))
+		}
+	}
+	for _, blkDev := range blockDevs {
+		if !blkDev.IsLUKSEncrypted() {
+			continue
+		}
+		dev, found := entitledByUUID[blkDev.UUID]
+		if !found {
+			findings = append(findings, keyserv.NewDoctorFinding(check, keyserv.DoctorWarn,
+				fmt.Sprintf("\"%s\" (UUID %s) has no record on key server that allows this computer", blkDev.Path, blkDev.UUID),
+				"if the key server keeps the key of the device, add this computer to its allowed clients with add-allowed-client, and check that the computer's certificate carries its host name; otherwise add the device with add-device"))
+			continue
+		}
+		dmName := dev.MappedName
+		if dmName == "" {
+			dmName = MakeDeviceMapperName(blkDev.Path)
+		}
+		if mapped := mappedDevice(dmName); mapped != "" && mapped != blkDev.Path {
+			findings = append(findings, keyserv.NewDoctorFinding("device mapper name", keyserv.DoctorFail,
+				fmt.Sprintf("\"%s\" (UUID %s) would be unlocked as \"%s\", which is already used by \"%s\"", blkDev.Path, blkDev.UUID, path.Join(DM_DIR, dmName), mapped),
+				"close the other mapping, or give the record another mapped name by add-device -mappedName"))
+			continue
+		}
+		findings = append(findings, keyserv.NewDoctorFinding(check, keyserv.DoctorPass,
+			fmt.Sprintf("\"%s\" (UUID %s) is allowed by key server (%s)", blkDev.Path, blkDev.UUID, dev.Match), ""))
+	}
+	return findings
+}
+
+// Return the device behind the device mapper name, or an empty string if the name is not in use.
+func mappedDeviceOf(dmName string) string {
+	if _, err := os.Stat(path.Join(DM_DIR, dmName)); err != nil {
+		return ""
+	}
+	mapping, err := fs.CryptStatus(dmName)
+	if err != nil {
+		// The name is in use by a mapping that is not a crypt device
+		return path.Join(DM_DIR, dmName)
+	}
+	return mapping.Device
+}
+
+/*
+DiagnoseClient runs all checks of the client configuration, the programs it relies on, the connection to key server,
+the clock, and the encrypted devices of this computer. Checks that need key server are left out if it cannot be reached.
+*/
+func DiagnoseClient(sysconf *sys.Sysconfig) []keyserv.DoctorFinding {
+	findings := make([]keyserv.DoctorFinding, 0, 16)
+	for _, program := range doctorRequiredPrograms {
+		findings = append(findings, diagnoseProgram(program, keyserv.DoctorFail, "install the package that provides the program"))
+	}
+	findings = append(findings, diagnoseProgram(fs.BIN_CLEVIS, keyserv.DoctorWarn, "install clevis to unlock disks by a tang server"))
+
+	if certPath := sysconf.GetString(keyserv.CLIENT_CONF_CERT, ""); certPath != "" {
+		findings = append(findings, keyserv.DiagnoseCertificate("client certificate", certPath, sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, ""), time.Now()))
+	}
+	if caPath := sysconf.GetString(keyserv.CLIENT_CONF_CA, ""); caPath != "" {
+		findings = append(findings, keyserv.DiagnoseCertificate("CA certificate", caPath, "", time.Now()))
+	}
+
+	const connCheck = "key server connection"
+	client, err := keyserv.NewCryptClientFromSysconfig(sysconf)
+	if err != nil {
+		return append(findings, keyserv.NewDoctorFinding(connCheck, keyserv.DoctorFail, err.Error(),
+			"correct "+keyserv.CLIENT_CONF_HOST+" and the related settings, or run register-client"))
+	}
+	before := time.Now()
+	caps, err := client.GetCapabilities()
+	after := time.Now()
+	if err != nil {
+		hint := "check that the key server is running, and that its port is open in the firewalls between"
+		if msg := err.Error(); strings.Contains(msg, "x509") || strings.Contains(msg, "certificate") || strings.Contains(msg, "fingerprint") {
+			hint = "check that " + keyserv.CLIENT_CONF_CA + " or " + keyserv.CLIENT_CONF_SERVER_FINGERPRINT + " matches the certificate of the key server"
+		}
+		return append(findings, keyserv.NewDoctorFinding(connCheck, keyserv.DoctorFail, err.Error(), hint))
+	}
+	findings = append(findings, keyserv.NewDoctorFinding(connCheck, keyserv.DoctorPass,
+		fmt.Sprintf("key server %s speaks protocol version %d", sysconf.GetString(keyserv.CLIENT_CONF_HOST, ""), caps.ProtocolVersion), ""))
+	findings = append(findings, DiagnoseClockSkew(caps.ServerTime, before, after))
+	if caps.Features[keyserv.FeatureClientCertValidation] && sysconf.GetString(keyserv.CLIENT_CONF_CERT, "") == "" {
+		findings = append(findings, keyserv.NewDoctorFinding("client certificate", keyserv.DoctorFail, "key server validates client certificates but none is configured",
+			"set "+keyserv.CLIENT_CONF_CERT+" and "+keyserv.CLIENT_CONF_CERT_KEY+", or run register-client"))
+	}
+
+	if !caps.Features[keyserv.FeatureClientDevices] {
+		return append(findings, keyserv.NewDoctorFinding("encrypted device", keyserv.DoctorWarn,
+			"key server is too old to tell which devices this computer is allowed to unlock", "upgrade the key server"))
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.ListClientDevices(keyserv.ListClientDevicesReq{Hostname: hostname})
+	if err != nil {
+		return append(findings, keyserv.NewDoctorFinding("encrypted device", keyserv.DoctorFail, err.Error(), "check the key server log"))
+	}
+	return append(findings, DiagnoseLocalDevices(fs.GetBlockDevices(), resp.Devices, mappedDeviceOf)...)
+}
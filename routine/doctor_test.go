@@ -0,0 +1,68 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseClockSkew(t *testing.T) {
+	local := time.Now()
+	// The round trip does not count as difference
+	if finding := DiagnoseClockSkew(local.Add(time.Second), local, local.Add(2*time.Second)); finding.Result != keyserv.DoctorPass {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseClockSkew(local.Add(-time.Minute), local, local); finding.Result != keyserv.DoctorWarn || finding.Hint == "" {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseClockSkew(local.Add(time.Hour), local, local); finding.Result != keyserv.DoctorFail {
+		t.Fatalf("%+v", finding)
+	}
+	if finding := DiagnoseClockSkew(time.Time{}, local, local); finding.Result != keyserv.DoctorWarn {
+		t.Fatalf("%+v", finding)
+	}
+}
+
+func TestDiagnoseLocalDevices(t *testing.T) {
+	blockDevs := fs.BlockDevices{
+		{Path: "/dev/sda1", UUID: "allowed", FileSystem: "crypto_LUKS"},
+		{Path: "/dev/sda2", UUID: "unknown", FileSystem: "crypto_LUKS"},
+		{Path: "/dev/sda3", UUID: "plain", FileSystem: "xfs"},
+		{Path: "/dev/sdb1", UUID: "collides", FileSystem: "crypto_LUKS"},
+		{Path: "/dev/sdc1", UUID: "unlocked", FileSystem: "crypto_LUKS"},
+	}
+	entitled := []keydb.ClientDevice{
+		{UUID: "allowed", Match: "host"},
+		{UUID: "collides", MappedName: "data"},
+		{UUID: "unlocked", MappedName: "data-c"},
+		{UUID: "elsewhere", MappedName: "data-c"},
+	}
+	mapped := map[string]string{"data": "/dev/sdx1", "data-c": "/dev/sdc1"}
+	findings := DiagnoseLocalDevices(blockDevs, entitled, func(dmName string) string { return mapped[dmName] })
+	results := make(map[string]string)
+	for _, finding := range findings {
+		results[finding.Detail] = finding.Result
+	}
+	expected := map[string]string{
+		`records unlocked, elsewhere share device mapper name "data-c", only one of them can be unlocked`:           keyserv.DoctorFail,
+		`"/dev/sda1" (UUID allowed) is allowed by key server (host)`:                                                keyserv.DoctorPass,
+		`"/dev/sda2" (UUID unknown) has no record on key server that allows this computer`:                          keyserv.DoctorWarn,
+		`"/dev/sdb1" (UUID collides) would be unlocked as "/dev/mapper/data", which is already used by "/dev/sdx1"`: keyserv.DoctorFail,
+		`"/dev/sdc1" (UUID unlocked) is allowed by key server ()`:                                                   keyserv.DoctorPass,
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("%+v", findings)
+	}
+	for detail, result := range expected {
+		if results[detail] != result {
+			t.Fatalf("%s: %s\n%+v", detail, results[detail], findings)
+		}
+	}
+	if !keyserv.DoctorFailed(findings) {
+		t.Fatal("did not fail")
+	}
+}
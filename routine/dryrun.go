@@ -0,0 +1,172 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	MSG_DRY_RUN_NOTHING_WRITTEN = "DRY RUN: nothing was changed on \"%s\", no key was written anywhere.\n"
+	MSG_DRY_RUN_ACTION          = "  would run: %s\n"
+	MSG_DRY_RUN_STEP            = "  would %s\n"
+)
+
+/*
+dryRun makes UnlockFS and EncryptFS talk to the key server and look for the devices as usual, but print the actions
+they would take instead of taking them. No key is written to a disk, TPM2, local record, or key server.
+*/
+var dryRun bool
+
+// SetDryRun turns the dry run of unlocking and encrypting file systems on or off.
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+// IsDryRun returns true if unlocking and encrypting file systems only prints the actions they would take.
+func IsDryRun() bool {
+	return dryRun
+}
+
+// Print the external program the dry run would run.
+func printDryRunCommand(progressOut io.Writer, programName string, programArgs ...string) {
+	fmt.Fprintf(progressOut, MSG_DRY_RUN_ACTION, fs.FormatCommand(programName, programArgs...))
+}
+
+/*
+Return an error if the directory cannot be mounted on: it is not a directory, or a file system is mounted there
+already. A directory that does not exist yet is usable if its nearest existing ancestor is a directory, in which case
+missing is true.
+*/
+func checkMountPoint(dir string) (missing bool, err error) {
+	if !filepath.IsAbs(dir) {
+		return false, fmt.Errorf("mount point \"%s\" is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	for ancestor := dir; ; ancestor = filepath.Dir(ancestor) {
+		st, err := os.Stat(ancestor)
+		if os.IsNotExist(err) && ancestor != "/" {
+			missing = true
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("cannot inspect mount point \"%s\" - %v", dir, err)
+		} else if !st.IsDir() {
+			return false, fmt.Errorf("mount point \"%s\" cannot be made, \"%s\" is not a directory", dir, ancestor)
+		}
+		break
+	}
+	if !missing {
+		if mount, found := fs.ParseMtab().GetByCriteria("", dir, ""); found {
+			return false, fmt.Errorf("mount point \"%s\" is already in use by \"%s\"", dir, mount.DeviceNode)
+		}
+	}
+	return missing, nil
+}
+
+/*
+Print the actions UnlockFS would take to unlock, format, and mount the device by the record, without taking them. The
+mapper name must be free and the mount points usable, otherwise an UnlockError is returned just like UnlockFS does.
+*/
+func dryRunUnlockFS(progressOut io.Writer, rec keydb.Record, unlockDev fs.BlockDevice) error {
+	fmt.Fprintf(progressOut, "Dry run of unlocking device with UUID '%s' (%s)\n", rec.UUID, unlockDev.Path)
+	if !unlockDev.IsLUKSEncrypted() {
+		if !rec.AutoEncryption {
+			return UnlockError{UnlockErrNotLUKS, fmt.Errorf("The device with UUID '%s' does not belongs to an LUKS device and AutoEncryption is set false.", rec.UUID)}
+		}
+		if unlockDev.FileSystem != "" {
+			return UnlockError{UnlockErrNotLUKS, fmt.Errorf("The device with UUID '%s' is not encrypted and has a %s file system, it will not be encrypted automatically.", rec.UUID, unlockDev.FileSystem)}
+		}
+		printDryRunCommand(progressOut, fs.BIN_CRYPTSETUP, fs.CryptFormatArgs(unlockDev.Path, rec.UUID, rec.CryptOptions)...)
+		if rec.TangURL != "" {
+			fmt.Fprintf(progressOut, MSG_DRY_RUN_STEP, "bind \""+unlockDev.Path+"\" to tang server \""+rec.TangURL+"\"")
+		}
+	}
+	dmName, err := GetDeviceMapperName(rec, unlockDev, DM_DIR)
+	if err != nil {
+		return UnlockError{UnlockErrMapperName, err}
+	}
+	dmDev := path.Join(DM_DIR, dmName)
+	if len(rec.Key) == 0 && rec.TangURL != "" {
+		printDryRunCommand(progressOut, fs.BIN_CLEVIS, "luks", "unlock", "-d", unlockDev.Path, "-n", dmName)
+	} else {
+		printDryRunCommand(progressOut, fs.BIN_CRYPTSETUP, fs.CryptOpenArgs(unlockDev.Path, dmName)...)
+	}
+	if rec.AutoEncryption && rec.FileSystem != "" {
+		fmt.Fprintf(progressOut, MSG_DRY_RUN_STEP, "run "+fs.FormatCommand(fs.BIN_MKFS, fs.FormatArgs(dmDev, rec.FileSystem)...)+" unless it already has a file system")
+	}
+	if rec.MountPoint != "" {
+		missing, err := checkMountPoint(rec.MountPoint)
+		if err != nil {
+			return UnlockError{UnlockErrMount, err}
+		}
+		if missing {
+			printDryRunCommand(progressOut, "mkdir", "-p", rec.MountPoint)
+		}
+		if policy := rec.FsckPolicy; policy != keydb.FsckOff {
+			if policy == "" {
+				policy = keydb.FsckPreen
+			}
+			fmt.Fprintf(progressOut, MSG_DRY_RUN_STEP, "check the file system on \""+dmDev+"\" ("+policy+")")
+		}
+		printDryRunCommand(progressOut, fs.BIN_MOUNT, fs.MountArgs(dmDev, rec.FileSystem, rec.MountOptions, rec.MountPoint)...)
+		for _, bind := range rec.BindMounts {
+			if missing, err := checkMountPoint(bind.Target); err != nil {
+				fmt.Fprintf(progressOut, "  *bind-mount \"%s\" would fail - %v\n", bind.Target, err)
+				continue
+			} else if missing {
+				printDryRunCommand(progressOut, "mkdir", "-p", bind.Target)
+			}
+			printDryRunCommand(progressOut, fs.BIN_MOUNT, "--bind", rec.MountPoint, bind.Target)
+		}
+	}
+	fmt.Fprintf(progressOut, MSG_DRY_RUN_NOTHING_WRITTEN, unlockDev.Path)
+	return nil
+}
+
+/*
+Print the actions EncryptFS would take to encrypt the disk and move the data of the directory into it, without taking
+them. The key server is not asked to create the key, the UUID is the one the encrypted disk would get.
+*/
+func dryRunEncryptFS(progressOut io.Writer, serverAddr, srcDir, encDisk, uuid string, srcDirMount fs.MountPoint, tangURL string, cryptOpts fs.CryptFormatOptions) error {
+	fmt.Fprintf(progressOut, "Dry run of encrypting \"%s\" by disk \"%s\"\n", srcDir, encDisk)
+	dmName := MakeDeviceMapperName(encDisk)
+	if _, err := os.Stat(path.Join(DM_DIR, dmName)); err == nil {
+		return fmt.Errorf("Device mapper name \"%s\" is already in use, is \"%s\" already unlocked?", path.Join(DM_DIR, dmName), encDisk)
+	}
+	srcDirIsMountPoint := srcDirMount.MountPoint == srcDir
+	srcDataDir := path.Join(path.Dir(srcDir), SRC_DIR_NEW_NAME_PREFIX+path.Base(srcDir))
+	if _, err := os.Stat(srcDataDir); err == nil && !srcDirIsMountPoint {
+		return fmt.Errorf("\"%s\" cannot be renamed into \"%s\", which already exists.", srcDir, srcDataDir)
+	}
+	fmt.Fprintf(progressOut, MSG_DRY_RUN_STEP, "ask key server \""+serverAddr+"\" to create the encryption key of UUID "+uuid)
+	for _, mount := range fs.ParseMtab() {
+		if mount.DeviceNode == encDisk {
+			printDryRunCommand(progressOut, fs.BIN_UMOUNT, mount.MountPoint)
+		}
+	}
+	printDryRunCommand(progressOut, fs.BIN_CRYPTSETUP, fs.CryptFormatArgs(encDisk, uuid, cryptOpts)...)
+	if tangURL != "" {
+		fmt.Fprintf(progressOut, MSG_DRY_RUN_STEP, "bind \""+encDisk+"\" to tang server \""+tangURL+"\"")
+	}
+	dmDev := path.Join(DM_DIR, dmName)
+	printDryRunCommand(progressOut, fs.BIN_CRYPTSETUP, fs.CryptOpenArgs(encDisk, dmName)...)
+	printDryRunCommand(progressOut, fs.BIN_MKFS, fs.FormatArgs(dmDev, srcDirMount.FileSystem)...)
+	if srcDirIsMountPoint {
+		printDryRunCommand(progressOut, fs.BIN_UMOUNT, srcDir)
+		printDryRunCommand(progressOut, "mkdir", "-p", srcDataDir)
+		printDryRunCommand(progressOut, fs.BIN_MOUNT, fs.MountArgs(srcDirMount.DeviceNode, srcDirMount.FileSystem, srcDirMount.Options, srcDataDir)...)
+	} else {
+		printDryRunCommand(progressOut, "mv", srcDir, srcDataDir)
+		printDryRunCommand(progressOut, "mkdir", "-p", srcDir)
+	}
+	printDryRunCommand(progressOut, fs.BIN_MOUNT, fs.MountArgs(dmDev, srcDirMount.FileSystem, srcDirMount.Options, srcDir)...)
+	fmt.Fprintf(progressOut, MSG_DRY_RUN_STEP, "copy the data from \""+srcDataDir+"\" into \""+srcDir+"\"")
+	fmt.Fprintf(progressOut, MSG_DRY_RUN_NOTHING_WRITTEN, encDisk)
+	return nil
+}
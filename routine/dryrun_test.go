@@ -0,0 +1,79 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCheckMountPoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-dryruntest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := checkMountPoint(dir); err != nil || missing {
+		t.Fatal(missing, err)
+	}
+	if missing, err := checkMountPoint(path.Join(dir, "a/b")); err != nil || !missing {
+		t.Fatal(missing, err)
+	}
+	for _, bad := range []string{"relative/dir", path.Join(dir, "file"), path.Join(dir, "file/sub")} {
+		if _, err := checkMountPoint(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestDryRunUnlockFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-dryruntest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opened, mounted := fakeUnlockFS(t, 0)
+	SetDryRun(true)
+	defer SetDryRun(false)
+	mountPoint := path.Join(dir, "mnt")
+	rec := keydb.Record{UUID: "fakeuuid", Key: []byte("key"), MountPoint: mountPoint, MountOptions: []string{"ro"}, FileSystem: "ext4",
+		BindMounts: []keydb.BindMount{{Target: path.Join(dir, "bind")}}}
+	var out bytes.Buffer
+	if err := UnlockFS(&out, rec, 3); err != nil {
+		t.Fatal(err, out.String())
+	}
+	// Nothing is opened, made, or mounted
+	if *opened != 0 || *mounted != 0 {
+		t.Fatal(*opened, *mounted)
+	}
+	if _, err := os.Stat(mountPoint); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, action := range []string{
+		"would run: /sbin/cryptsetup --batch-mode luksOpen --key-file=- /dev/fake1 " + DM_NAME_PREFIX + "fake1\n",
+		"would run: mkdir -p " + mountPoint + "\n",
+		"would run: /usr/bin/mount --make-shared -t ext4 -o ro /dev/mapper/" + DM_NAME_PREFIX + "fake1 " + mountPoint + "\n",
+		"would run: /usr/bin/mount --bind " + mountPoint + " " + path.Join(dir, "bind") + "\n",
+		"no key was written anywhere",
+	} {
+		if !strings.Contains(out.String(), action) {
+			t.Fatal(action, out.String())
+		}
+	}
+	// A mount point that cannot be used fails the dry run
+	rec.MountPoint, rec.BindMounts = path.Join(dir, "file"), nil
+	if err := ioutil.WriteFile(rec.MountPoint, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnlockFS(&out, rec, 3); err == nil || err.(UnlockError).Class != UnlockErrMount {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,7 @@ package routine
 
 import (
 	"cryptctl2/fs"
+	"cryptctl2/keydb"
 	"cryptctl2/keyserv"
 	"cryptctl2/sys"
 	"crypto/rand"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -21,6 +23,7 @@ import (
 const (
 	DM_NAME_PREFIX                = "cryptctl2-unlocked-"
 	SRC_DIR_NEW_NAME_PREFIX       = "cryptctl2-moved-"
+	MIGRATION_JOURNAL_PREFIX      = "cryptctl2-journal-"
 	MSG_E_ILLEGAL_PATH            = "Please specify absolute directory/file path in all path parameters"
 	MSG_E_SRC_DIR_MOUNT_NOT_FOUND = "Failed to determine the mount point of directory \"%s\"."
 	MSG_E_ENCRYPT_DISK_NOT_FOUND  = "Cannot find disk \"%s\". See output of \"lsblk\" command to determine available disks."
@@ -40,6 +43,28 @@ const (
 	MSG_E_NO_DEV_INFO             = "Failed to retrieve block device information of \"%s\""
 	MSG_E_RPC_KEY_CREATE          = "Failed to create an encryption key: %v"
 	MSG_OK_CONGRATS               = "\nCongratulations! Data in \"%s\" is now safely encrypted in \"%s\".\nRemember to manually delete the original un-encrypted copy in \"%s\".\n"
+
+	MSG_E_INPLACE_MOUNTED      = "Disk \"%s\" is mounted on \"%s\", please unmount it first. cryptsetup cannot encrypt a mounted file system in-place."
+	MSG_E_INPLACE_NO_FS        = "Disk \"%s\" does not have a file system, use action \"encrypt\" to set up encryption on an empty disk."
+	MSG_E_INPLACE_ENCRYPTED    = "Disk \"%s\" is already encrypted."
+	MSG_E_INPLACE_TOO_SMALL    = "Disk \"%s\" is too small for in-place encryption, which needs %d MBytes for the encryption header."
+	MSG_E_INPLACE_NO_KEY       = "The key server does not have the encryption key of disk \"%s\" (%s), the encryption cannot be resumed."
+	MSG_E_INPLACE_HEADER       = "Failed to write encryption header, the key has been withdrawn from the key server: %v"
+	MSG_E_INPLACE_HEADER_ERASE = "Failed to write encryption header (%v), and failed to withdraw the key %s from the key server: %v"
+	MSG_INPLACE_RESUME         = "\nDisk \"%s\" (%s) was being encrypted when it was interrupted, resuming the encryption.\n"
+	MSG_INPLACE_STEP_1         = "\n1. Shrink the file system on disk \"%s\" to make room for encryption header.\n"
+	MSG_INPLACE_STEP_2         = "\n2. Install encryption key on disk \"%s\" and announce it to key server \"%s\".\n"
+	MSG_INPLACE_STEP_3         = "\n3. Encrypt the data on disk \"%s\". If this is interrupted, run the same action again to resume.\n"
+	MSG_INPLACE_PROGRESS       = "\r  %5.1f%% encrypted"
+	MSG_INPLACE_CONGRATS       = "\nCongratulations! Data on disk \"%s\" (%s) is now safely encrypted.\n"
+
+	MSG_E_JOURNAL_EXISTS      = "The data of \"%s\" was partially copied into an encrypted disk when it was interrupted (see \"%s\"), use -resume to carry on."
+	MSG_E_JOURNAL_META        = "The migration journal \"%s\" lacks detail \"%s\", the migration cannot be resumed."
+	MSG_E_JOURNAL_DEST        = "The migration journal \"%s\" describes a copy into \"%s\" rather than \"%s\"."
+	MSG_E_RESUME_NO_SRC_DATA  = "The original data is missing from \"%s\", the migration cannot be resumed. Restore the data and remove \"%s\" to start over."
+	MSG_E_RESUME_NO_KEY       = "The key server does not have the encryption key of disk \"%s\" (%s), the migration cannot be resumed."
+	MSG_E_RESUME_DEST_MOUNTED = "\"%s\" is mounted from \"%s\" instead of the encrypted disk, please unmount it first."
+	MSG_STEP_2_RESUME         = "\n2. Resume copying data from \"%s\" into the disk, %d files were copied before interruption.\n"
 )
 
 // Create a new UUID.
@@ -62,12 +87,22 @@ func MakeDeviceMapperName(devName string) string {
 	return DM_NAME_PREFIX + devName
 }
 
+// Return the location of the journal that records the data copied into the encrypted directory, it sits next to the directory.
+func MigrationJournalPath(srcDir string) string {
+	srcDir = filepath.Clean(srcDir)
+	return path.Join(path.Dir(srcDir), MIGRATION_JOURNAL_PREFIX+path.Base(srcDir))
+}
+
 // Validate all pre-conditions for setting up encryption on the disk.
 func EncryptFSPreCheck(srcDir, encDisk string) error {
 	// Input paths should exist
 	if srcDir == "" || srcDir == "." || encDisk == "" || encDisk == "." || !filepath.IsAbs(srcDir) || !filepath.IsAbs(encDisk) {
 		return errors.New(MSG_E_ILLEGAL_PATH)
 	}
+	// An interrupted migration must be resumed rather than started over
+	if _, err := os.Stat(MigrationJournalPath(srcDir)); err == nil {
+		return fmt.Errorf(MSG_E_JOURNAL_EXISTS, srcDir, MigrationJournalPath(srcDir))
+	}
 	if err := fs.IsDir(srcDir); err != nil {
 		return err
 	}
@@ -90,7 +125,7 @@ func EncryptFSPreCheck(srcDir, encDisk string) error {
 	// The disk to encrypt may not have partitions underneath that are already mounted
 	if !unicode.IsDigit(rune(encDisk[len(encDisk)-1])) {
 		for _, mp := range mountPoints {
-			if strings.HasPrefix(mp.DeviceNode, encDisk) {
+			if strings.HasPrefix(mp.DeviceNode, encDisk) && len(mp.DeviceNode) > len(encDisk) {
 				if unicode.IsDigit(rune(mp.DeviceNode[len(encDisk)])) {
 					return fmt.Errorf(MSG_E_MOUNT_UNDERNEATH, mp.MountPoint)
 				}
@@ -163,12 +198,149 @@ func EncryptFSPreCheck(srcDir, encDisk string) error {
 }
 
 /*
-Set up encryption on a file system using a randomly generated key and upload the key to key server. Return UUID of
-now encrypted block device and any error encountered during the routine.
+Validate the pre-conditions for encrypting the existing file system on the disk in-place. Return true if the disk
+carries an unfinished in-place encryption, which is to be resumed instead of started over.
+*/
+func InplaceEncryptFSPreCheck(encDisk string) (resume bool, err error) {
+	if encDisk == "" || !filepath.IsAbs(encDisk) {
+		return false, errors.New(MSG_E_ILLEGAL_PATH)
+	}
+	if err := fs.CheckBlockDevice(encDisk); err != nil {
+		return false, err
+	}
+	if err := fs.CheckCryptReencryptSupport(); err != nil {
+		return false, err
+	}
+	if resume, err = fs.CryptReencryptInProgress(encDisk); err != nil || resume {
+		// An unfinished encryption may be resumed online, i.e. while the unlocked file system is mounted.
+		return
+	}
+	encDiskDev, found := fs.GetBlockDevice(encDisk)
+	if !found {
+		return false, fmt.Errorf(MSG_E_ENCRYPT_DISK_NOT_FOUND, encDisk)
+	}
+	if encDiskDev.IsLUKSEncrypted() {
+		return false, fmt.Errorf(MSG_E_INPLACE_ENCRYPTED, encDisk)
+	} else if encDiskDev.FileSystem == "" {
+		return false, fmt.Errorf(MSG_E_INPLACE_NO_FS, encDisk)
+	} else if encDiskDev.MountPoint != "" {
+		return false, fmt.Errorf(MSG_E_INPLACE_MOUNTED, encDisk, encDiskDev.MountPoint)
+	} else if mountPoint, found := fs.ParseMtab().GetByCriteria(encDisk, "", ""); found {
+		return false, fmt.Errorf(MSG_E_INPLACE_MOUNTED, encDisk, mountPoint.MountPoint)
+	}
+	// The header takes room away from the file system, leave at least as much room again for the data.
+	if encDiskDev.SizeByte < 2*fs.LUKS_REENCRYPT_HEADER_BYTES {
+		return false, fmt.Errorf(MSG_E_INPLACE_TOO_SMALL, encDisk, fs.LUKS_REENCRYPT_HEADER_BYTES/1024/1024)
+	}
+	for _, name := range fs.ShrinkableFileSystems {
+		if name == encDiskDev.FileSystem {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("The file system \"%s\" on disk \"%s\" cannot be shrunk to make room for encryption header, only %s can be encrypted in-place.",
+		encDiskDev.FileSystem, encDisk, strings.Join(fs.ShrinkableFileSystems, ", "))
+}
+
+// Return a progress function that prints the percentage whenever it advances by a tenth.
+func printReencryptProgress(progressOut io.Writer) func(percent float64) {
+	last := -1.0
+	return func(percent float64) {
+		if percent-last >= 0.1 {
+			fmt.Fprintf(progressOut, MSG_INPLACE_PROGRESS, percent)
+			last = percent
+		}
+	}
+}
+
+/*
+Encrypt the existing file system on the disk in-place using LUKS2 re-encryption, and keep the key on key server.
+The key record only remains on the key server once the encryption header has been written onto the disk.
+If the disk carries an unfinished encryption, for example after an interruption, its key is retrieved from the key
+server and the encryption is resumed. Return UUID of the encrypted block device.
+*/
+func InplaceEncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
+	password, encDisk, mountPoint string,
+	keyMaxActive, keyAliveIntervalSec, keyAliveCount int) (string, error) {
+	sys.LockMem()
+	encDisk = filepath.Clean(encDisk)
+	resume, err := InplaceEncryptFSPreCheck(encDisk)
+	if err != nil {
+		return "", err
+	}
+	encDiskDev, found := fs.GetBlockDevice(encDisk)
+	if !found {
+		return "", fmt.Errorf(MSG_E_NO_DEV_INFO, encDisk)
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	var key []byte
+	cryptDevUUID := encDiskDev.UUID
+	if resume {
+		// The header has been written, hence the key server must already have the key.
+		fmt.Fprintf(progressOut, MSG_INPLACE_RESUME, encDisk, cryptDevUUID)
+		resp, err := client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{
+			PlainPassword: password,
+			Hostname:      hostname,
+			UUIDs:         []string{cryptDevUUID},
+		})
+		if err != nil {
+			return "", err
+		}
+		rec, found := resp.Granted[cryptDevUUID]
+		if !found {
+			return "", fmt.Errorf(MSG_E_INPLACE_NO_KEY, encDisk, cryptDevUUID)
+		}
+		key = rec.Key
+	} else {
+		// Step 1. Make room for the header at the end of the file system, the data is shifted into it.
+		fmt.Fprintf(progressOut, MSG_INPLACE_STEP_1, encDisk)
+		if err := fs.ShrinkFileSystem(encDisk, encDiskDev.FileSystem, encDiskDev.SizeByte-fs.LUKS_REENCRYPT_HEADER_BYTES); err != nil {
+			return "", err
+		}
+		// Step 2. Write the header with a key from the key server.
+		fmt.Fprintf(progressOut, MSG_INPLACE_STEP_2, encDisk, client.CurrentAddress())
+		cryptDevUUID = MakeUUID()
+		resp, err := client.CreateKey(keyserv.CreateKeyReq{
+			PlainPassword:    password,
+			Hostname:         hostname,
+			UUID:             cryptDevUUID,
+			MountPoint:       mountPoint,
+			MountOptions:     []string{},
+			MaxActive:        keyMaxActive,
+			AliveIntervalSec: keyAliveIntervalSec,
+			AliveCount:       keyAliveCount,
+			FileSystem:       encDiskDev.FileSystem,
+		})
+		if err != nil {
+			return "", fmt.Errorf(MSG_E_RPC_KEY_CREATE, err)
+		}
+		key = resp.KeyContent
+		if err := fs.CryptReencryptInit(key, encDisk, cryptDevUUID); err != nil {
+			// Nothing on the disk refers to the key, withdraw it.
+			if eraseErr := client.EraseKey(keyserv.EraseKeyReq{PlainPassword: password, Hostname: hostname, UUID: cryptDevUUID}); eraseErr != nil {
+				return "", fmt.Errorf(MSG_E_INPLACE_HEADER_ERASE, err, cryptDevUUID, eraseErr)
+			}
+			return "", fmt.Errorf(MSG_E_INPLACE_HEADER, err)
+		}
+	}
+	// Step 3. Encrypt the data, this is the lengthy part that may be resumed.
+	fmt.Fprintf(progressOut, MSG_INPLACE_STEP_3, encDisk)
+	err = fs.CryptReencryptResume(key, encDisk, printReencryptProgress(progressOut))
+	fmt.Fprintln(progressOut)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(progressOut, MSG_INPLACE_CONGRATS, encDisk, cryptDevUUID)
+	return cryptDevUUID, nil
+}
+
+/*
+Set up encryption on a file system using a randomly generated key and upload the key to key server. The LUKS header
+is created according to the options, which are also kept in the key record. If a Tang server URL is given, the disk
+is also bound to it. Return UUID of now encrypted block device and any error encountered during the routine.
 */
 func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	password, srcDir, encDisk string,
-	keyMaxActive, keyAliveIntervalSec, keyAliveCount int) (string, error) {
+	keyMaxActive, keyAliveIntervalSec, keyAliveCount int, tangURL string, cryptOpts fs.CryptFormatOptions) (string, error) {
 	sys.LockMem()
 	srcDir = filepath.Clean(srcDir)
 	encDisk = filepath.Clean(encDisk)
@@ -178,6 +350,12 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	if err != nil {
 		return "", err
 	}
+	if err := cryptOpts.Validate(); err != nil {
+		return "", err
+	}
+	if err := keydb.ValidateTangURL(tangURL); err != nil {
+		return "", err
+	}
 
 	// Step 1 - ask server for an encryption key
 	mountPoints := fs.ParseMtab()
@@ -186,6 +364,9 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 		return "", fmt.Errorf(MSG_E_SRC_DIR_MOUNT_NOT_FOUND, srcDir)
 	}
 	cryptDevUUID := MakeUUID()
+	if dryRun {
+		return "", dryRunEncryptFS(progressOut, client.CurrentAddress(), srcDir, encDisk, cryptDevUUID, srcDirMount, tangURL, cryptOpts)
+	}
 	encryptionKeyResp, err := client.CreateKey(keyserv.CreateKeyReq{
 		PlainPassword:    password,
 		UUID:             cryptDevUUID,
@@ -194,6 +375,8 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 		MaxActive:        keyMaxActive,
 		AliveIntervalSec: keyAliveIntervalSec,
 		AliveCount:       keyAliveCount,
+		TangURL:          tangURL,
+		CryptOptions:     cryptOpts,
 	})
 	if err != nil {
 		return "", fmt.Errorf(MSG_E_RPC_KEY_CREATE, err)
@@ -212,10 +395,12 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 		}
 		break
 	}
+	defer encryptionKeyResp.KeyContent.Wipe()
 	// Step 1 (cont). Wipe the disk and install encryption key
-	if err := fs.CryptFormat(encryptionKeyResp.KeyContent, encDisk, cryptDevUUID); err != nil {
+	if err := fs.CryptFormat(encryptionKeyResp.KeyContent, encDisk, cryptDevUUID, cryptOpts); err != nil {
 		return "", err
 	}
+	bindTang(progressOut, encryptionKeyResp.KeyContent, encDisk, tangURL)
 	dmName := MakeDeviceMapperName(encDisk)
 	if err := fs.CryptOpen(encryptionKeyResp.KeyContent, encDisk, dmName); err != nil {
 		return "", err
@@ -224,11 +409,28 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	if err := fs.Format(encDiskMapper, srcDirMount.FileSystem); err != nil {
 		return "", err
 	}
+	srcDirIsMountPoint := srcDirMount.MountPoint == srcDir
+	srcDataDir := path.Join(path.Dir(srcDir), SRC_DIR_NEW_NAME_PREFIX+path.Base(srcDir))
+	// From now on the data is being moved around, record the details to allow the migration to be resumed.
+	journal, err := fs.CreateMigrationJournal(MigrationJournalPath(srcDir), fs.MigrationJournalHeader{
+		Source:      srcDataDir,
+		Destination: srcDir,
+		Meta: map[string]string{
+			"uuid":                  cryptDevUUID,
+			"disk":                  encDisk,
+			"file_system":           srcDirMount.FileSystem,
+			"mount_options":         strings.Join(srcDirMount.Options, ","),
+			"source_device":         srcDirMount.DeviceNode,
+			"source_is_mount_point": strconv.FormatBool(srcDirIsMountPoint),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer journal.Close()
 
 	// Step 2. Copy data from directory to encrypt into the encrypted disk
 	fmt.Fprintf(progressOut, MSG_STEP_2, srcDir)
-	srcDirIsMountPoint := srcDirMount.MountPoint == srcDir
-	srcDataDir := path.Join(path.Dir(srcDir), SRC_DIR_NEW_NAME_PREFIX+path.Base(srcDir))
 	// Give the directory to encrypt a prefix name
 	if srcDirIsMountPoint {
 		// If the directory is a mount point, remount it into the new directory name.
@@ -252,12 +454,23 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	if err := fs.Mount(path.Join("/dev/mapper", dmName), srcDirMount.FileSystem, srcDirMount.Options, srcDir); err != nil {
 		return "", err
 	}
-	if err := fs.MirrorFiles(srcDataDir, srcDir, progressOut); err != nil {
+	return migrateEncryptFS(progressOut, client, journal, encDisk)
+}
+
+// Copy the data into the encrypted directory as described by the journal, then announce the encrypted disk.
+func migrateEncryptFS(progressOut io.Writer, client *keyserv.CryptClient, journal *fs.MigrationJournal, encDisk string) (string, error) {
+	srcDataDir, srcDir := journal.Header.Source, journal.Header.Destination
+	if err := fs.MigrateFiles(srcDataDir, srcDir, journal, progressOut); err != nil {
 		return "", err
 	}
+	// All data is copied, there is nothing left to resume.
+	journal.Close()
+	if err := os.Remove(journal.Path); err != nil {
+		log.Printf("EncryptFS: failed to remove migration journal \"%s\" - %v", journal.Path, err)
+	}
 
 	// Step 3. Announce the encrypted disk to key server.
-	fmt.Fprintf(progressOut, MSG_STEP_3, client.Address)
+	fmt.Fprintf(progressOut, MSG_STEP_3, client.CurrentAddress())
 	cryptDev, found := fs.GetBlockDevice(encDisk)
 	if !found {
 		return "", fmt.Errorf(MSG_E_NO_DEV_INFO, encDisk)
@@ -265,3 +478,93 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	fmt.Fprintf(progressOut, MSG_OK_CONGRATS, srcDir, encDisk, srcDataDir)
 	return cryptDev.UUID, nil
 }
+
+/*
+Resume copying data into the encrypted disk after EncryptFS was interrupted, using the migration journal left next to
+the directory. The original data and the encrypted disk are mounted again if necessary, the key of the encrypted disk
+is retrieved from key server using the password. Files already copied are verified and not copied again.
+Return UUID of the encrypted block device.
+*/
+func ResumeEncryptFS(progressOut io.Writer, client *keyserv.CryptClient, password, srcDir string) (string, error) {
+	sys.LockMem()
+	srcDir = filepath.Clean(srcDir)
+	if srcDir == "" || srcDir == "." || !filepath.IsAbs(srcDir) {
+		return "", errors.New(MSG_E_ILLEGAL_PATH)
+	}
+	journal, err := fs.OpenMigrationJournal(MigrationJournalPath(srcDir))
+	if err != nil {
+		return "", err
+	}
+	defer journal.Close()
+	if journal.Header.Destination != srcDir {
+		return "", fmt.Errorf(MSG_E_JOURNAL_DEST, journal.Path, journal.Header.Destination, srcDir)
+	}
+	meta := journal.Header.Meta
+	for _, key := range []string{"uuid", "disk", "file_system", "source_device"} {
+		if meta[key] == "" {
+			return "", fmt.Errorf(MSG_E_JOURNAL_META, journal.Path, key)
+		}
+	}
+	encDisk, cryptDevUUID, fileSystem := meta["disk"], meta["uuid"], meta["file_system"]
+	var mountOptions []string
+	if meta["mount_options"] != "" {
+		mountOptions = strings.Split(meta["mount_options"], ",")
+	}
+	srcDataDir := journal.Header.Source
+
+	// The original data must be in place, remount it if it used to be a mount point (e.g. after a reboot).
+	mountPoints := fs.ParseMtab()
+	if meta["source_is_mount_point"] == "true" {
+		if _, found := mountPoints.GetByCriteria("", srcDataDir, ""); !found {
+			// After a reboot the original file system may have been mounted on the directory again
+			if _, found := mountPoints.GetByCriteria(meta["source_device"], srcDir, ""); found {
+				if err := fs.Umount(srcDir); err != nil {
+					return "", err
+				}
+			}
+			if err := fs.Mount(meta["source_device"], fileSystem, mountOptions, srcDataDir); err != nil {
+				return "", err
+			}
+			mountPoints = fs.ParseMtab()
+		}
+	}
+	if fs.IsDir(srcDataDir) != nil {
+		return "", fmt.Errorf(MSG_E_RESUME_NO_SRC_DATA, srcDataDir, journal.Path)
+	}
+
+	// Unlock the encrypted disk and mount it on the directory, unless it is still so from before the interruption.
+	dmName := MakeDeviceMapperName(encDisk)
+	encDiskMapper := path.Join("/dev/mapper", dmName)
+	if _, err := fs.CryptStatus(dmName); err != nil {
+		hostname, _ := sys.GetHostnameAndIP()
+		resp, err := client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{
+			PlainPassword: password,
+			Hostname:      hostname,
+			UUIDs:         []string{cryptDevUUID},
+		})
+		if err != nil {
+			return "", err
+		}
+		rec, found := resp.Granted[cryptDevUUID]
+		if !found {
+			return "", fmt.Errorf(MSG_E_RESUME_NO_KEY, encDisk, cryptDevUUID)
+		}
+		err = fs.CryptOpen(rec.Key, encDisk, dmName)
+		wipeGrantedKeys(resp.Granted)
+		if err != nil {
+			return "", err
+		}
+	}
+	if destMount, found := mountPoints.GetByCriteria("", srcDir, ""); !found {
+		if err := os.MkdirAll(srcDir, 0700); err != nil {
+			return "", fmt.Errorf(MSG_E_MKDIR, srcDir, err)
+		} else if err := fs.Mount(encDiskMapper, fileSystem, mountOptions, srcDir); err != nil {
+			return "", err
+		}
+	} else if destMount.DeviceNode != encDiskMapper {
+		return "", fmt.Errorf(MSG_E_RESUME_DEST_MOUNTED, srcDir, destMount.DeviceNode)
+	}
+
+	fmt.Fprintf(progressOut, MSG_STEP_2_RESUME, srcDataDir, len(journal.Done))
+	return migrateEncryptFS(progressOut, client, journal, encDisk)
+}
@@ -22,6 +22,13 @@ import (
 	"time"
 )
 
+func init() {
+	// The test key server reads its certificate and sysconfig template from this source tree.
+	if wd, err := os.Getwd(); err == nil {
+		keyserv.PkgInGopath = path.Dir(wd)
+	}
+}
+
 func TestPreCheck(t *testing.T) {
 	rootDev, found := fs.GetBlockDevices().GetByCriteria("", "", "", "", "/", "", "")
 	if !found {
@@ -67,6 +74,9 @@ func TestEncryptDecrypt(t *testing.T) {
 	if os.Getuid() != 0 {
 		t.Skip("This test case requires root privilege to run")
 	}
+	if _, err := os.Stat(fs.BIN_CRYPTSETUP); err != nil {
+		t.Skip("This test case requires cryptsetup to run", err)
+	}
 	// Start an RPC server
 	keydbDir := "/tmp/cryptctl2-encrypttest"
 	os.RemoveAll(keydbDir)
@@ -231,12 +241,12 @@ func TestEncryptDecrypt(t *testing.T) {
 	var encUUID0, encUUID1 string
 	// Run encryption routine on two directories + two disks
 	// The first disk can be unlocked twice at the same time
-	encUUID0, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir0, "/dev/loop0", 2, REPORT_ALIVE_INTERVAL_SEC, 2)
+	encUUID0, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir0, "/dev/loop0", 2, REPORT_ALIVE_INTERVAL_SEC, 2, "", fs.CryptFormatOptions{})
 	if err != nil || encUUID0 == "" {
 		t.Fatal(err, encUUID0)
 	}
 	//The second disk can only be unlocked once.
-	encUUID1, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir1, "/dev/loop1", 1, REPORT_ALIVE_INTERVAL_SEC, 2)
+	encUUID1, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir1, "/dev/loop1", 1, REPORT_ALIVE_INTERVAL_SEC, 2, "", fs.CryptFormatOptions{})
 	if err != nil || encUUID1 == "" {
 		t.Fatal(err, encUUID1)
 	}
@@ -299,7 +309,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	*/
 	resetDisks()
 	// Unlock disks with password
-	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS); err != nil {
+	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS, 4, false); err != nil {
 		t.Fatal(err)
 	}
 	checkSecret0()
@@ -320,7 +330,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	go srv.HandleTCPConnections()
 
 	// There's no need to make a new RPC client because the client does not hold a persistent connection
-	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS); err != nil {
+	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS, 4, false); err != nil {
 		t.Fatal(err)
 	}
 	checkSecret0()
@@ -364,12 +374,12 @@ func TestEncryptDecrypt(t *testing.T) {
 	for i := 0; i < 2; i++ {
 		go func(i int) {
 			log.Printf("About to run auto-unlock routine #%d on disk %s", i, loop0Dev.UUID)
-			err := AutoOnlineUnlockFS(os.Stdout, client, loop0Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
+			_, _, err := AutoOnlineUnlockFS(os.Stdout, client, loop0Dev.UUID, UnlockRetry{MaxRetrySec: REPORT_ALIVE_INTERVAL_SEC * 2}, "")
 			// Once key is retrieved successfully, begin sending alive messages.
 			if err == nil {
 				log.Printf("Auto-unlock routine #%d of disk %s succeeded, going to send keep-alive in background.", i, loop0Dev.UUID)
 				go func(i int) {
-					if aliveErr := ReportAlive(os.Stdout, client, loop0Dev.UUID); aliveErr != nil && !reportAliveMayEnd {
+					if aliveErr := ReportAlive(os.Stdout, client, loop0Dev.UUID, "", REPORT_ALIVE_INTERVAL_SEC); aliveErr != nil && !reportAliveMayEnd {
 						log.Printf("Keep-alive routine #%d of disk %s terminated - %v", i, loop0Dev.UUID, aliveErr)
 						t.Log(aliveErr)
 					} else {
@@ -385,11 +395,11 @@ func TestEncryptDecrypt(t *testing.T) {
 	// Next two attempts are made against loop1 that only allows one active user. Only one attempt should succeed.
 	for i := 2; i < 4; i++ {
 		go func(i int) {
-			err := AutoOnlineUnlockFS(os.Stdout, client, loop1Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
+			_, _, err := AutoOnlineUnlockFS(os.Stdout, client, loop1Dev.UUID, UnlockRetry{MaxRetrySec: REPORT_ALIVE_INTERVAL_SEC * 2}, "")
 			// Once key is retrieved successfully, begin sending alive messages.
 			if err == nil {
 				go func() {
-					if aliveErr := ReportAlive(os.Stdout, client, loop1Dev.UUID); aliveErr != nil && !reportAliveMayEnd {
+					if aliveErr := ReportAlive(os.Stdout, client, loop1Dev.UUID, "", REPORT_ALIVE_INTERVAL_SEC); aliveErr != nil && !reportAliveMayEnd {
 						t.Log(aliveErr)
 					} else {
 						finishedReportAlive.Done()
@@ -401,7 +411,8 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 	// The second last attempt is made against a disk that does not have key on the server.
 	go func() {
-		onlineUnlockAttempt[4] <- AutoOnlineUnlockFS(os.Stdout, client, "this-uuid-does-not-exist", 15)
+		_, _, err := AutoOnlineUnlockFS(os.Stdout, client, "this-uuid-does-not-exist", UnlockRetry{MaxRetrySec: 15}, "")
+		onlineUnlockAttempt[4] <- err
 	}()
 
 	// Bring server online now
@@ -440,7 +451,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		}
 	}
 	// Sending alive message to non-existing reports should result in immediate rejection
-	if ReportAlive(os.Stdout, client, "this-uuid-does-not-exist") == nil {
+	if ReportAlive(os.Stdout, client, "this-uuid-does-not-exist", "", REPORT_ALIVE_INTERVAL_SEC) == nil {
 		t.Fatal("did not error")
 	}
 	/*
@@ -532,7 +543,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		===============================================
 	*/
 	// First attempt erases an open & mounted file system
-	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID0); err != nil {
+	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID0, false); err != nil {
 		t.Fatal(err)
 	}
 	// Second attempt erases a not yet mounted file system
@@ -542,7 +553,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	if err := fs.CryptClose(loop1Crypt); err != nil {
 		t.Fatal(err)
 	}
-	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID1); err != nil {
+	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID1, false); err != nil {
 		t.Fatal(err)
 	}
 	if len(srv.KeyDB.RecordsByUUID) != 0 {
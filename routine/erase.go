@@ -0,0 +1,141 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+Make sure the server is able to forget a key and report a removed key slot, and let it refuse the request for a wrong
+password or an unacknowledged owner before anything is changed.
+*/
+func checkPartialErase(progressOut io.Writer, client *keyserv.CryptClient, eraseReq keyserv.EraseKeyReq) error {
+	caps, err := client.GetCapabilities()
+	if err != nil {
+		return err
+	} else if !caps.Features[keyserv.FeatureForgetKey] {
+		return errors.New("key server cannot forget a key or record a removed key slot, please upgrade it first")
+	}
+	check, err := client.CheckEraseKey(eraseReq)
+	if check.Owner != "" {
+		fmt.Fprintf(progressOut, "Disk \"%s\" belongs to owner \"%s\".\n", eraseReq.UUID, check.Owner)
+	}
+	if err != nil {
+		return err
+	} else if !check.Found {
+		return fmt.Errorf("key server does not have a record of \"%s\"", eraseReq.UUID)
+	}
+	return nil
+}
+
+/*
+RemoveKeySlot removes the key slot the key on server unlocks from the disk, along with the tang bindings and the key
+sealed by TPM2, and leaves the other key slots such as a recovery passphrase intact. The disk must keep another key
+slot, otherwise EraseKey is the way to go. A disk that is unlocked stays so, as the open mapping does not depend on key
+slots. The server is told of the removal only after the key is verified to no longer unlock the disk, and then forgets
+its key if forgetKey is true.
+*/
+func RemoveKeySlot(progressOut io.Writer, client *keyserv.CryptClient, password, uuid string, ownerAcknowledged, forgetKey bool) error {
+	hostname, _ := sys.GetHostnameAndIP()
+	eraseReq := keyserv.EraseKeyReq{PlainPassword: password, Hostname: hostname, UUID: uuid, OwnerAcknowledged: ownerAcknowledged}
+	if err := checkPartialErase(progressOut, client, eraseReq); err != nil {
+		return fmt.Errorf("RemoveKeySlot: %v", err)
+	}
+	hostDev, found := fs.GetBlockDevices().GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return fmt.Errorf("RemoveKeySlot: cannot find a block device corresponding to UUID \"%s\"", uuid)
+	}
+	rec, err := retrieveCurrentKey(client, password, []string{uuid})
+	if err != nil {
+		return fmt.Errorf("RemoveKeySlot: failed to retrieve the key - %v", err)
+	}
+	slot, err := fs.CryptKeySlotOf(rec.Key, hostDev.Path)
+	if err != nil {
+		return fmt.Errorf("RemoveKeySlot: %v", err)
+	}
+	active, err := fs.CryptActiveKeySlots(hostDev.Path)
+	if err != nil {
+		return fmt.Errorf("RemoveKeySlot: %v", err)
+	}
+	tangSlots, err := fs.ClevisTangSlots(hostDev.Path)
+	if err != nil {
+		// Without clevis there cannot be tang bindings
+		tangSlots = map[int]string{}
+	}
+	remaining := make([]int, 0, len(active))
+	for _, activeSlot := range active {
+		if _, isTang := tangSlots[activeSlot]; activeSlot != slot && !isTang {
+			remaining = append(remaining, activeSlot)
+		}
+	}
+	if len(remaining) == 0 {
+		return fmt.Errorf("RemoveKeySlot: \"%s\" does not have another key slot, removing slot %d would render its data lost, please use erase without -keySlotOnly instead", hostDev.Path, slot)
+	}
+	if len(tangSlots) > 0 {
+		fmt.Fprintf(progressOut, "Removing tang bindings of \"%s\"...\n", hostDev.Path)
+		if err := fs.ClevisTangUnbind(hostDev.Path); err != nil {
+			return fmt.Errorf("RemoveKeySlot: %v", err)
+		}
+	}
+	if err := RemoveTangRecord(TANG_RECORD_DIR, uuid); err != nil {
+		fmt.Fprintln(progressOut, err)
+	}
+	if err := RemoveSealedRecord(tpm2SealDir, uuid); err != nil {
+		fmt.Fprintln(progressOut, err)
+	}
+	fmt.Fprintf(progressOut, "Removing the key from slot %d of \"%s\", slots %v are left intact...\n", slot, hostDev.Path, remaining)
+	if err := fs.CryptRemoveKey(rec.Key, hostDev.Path); err != nil {
+		return fmt.Errorf("RemoveKeySlot: %v", err)
+	}
+	// The server must not be told before the disk has proven to refuse the key
+	if stillUnlocks, err := fs.CryptKeySlotOf(rec.Key, hostDev.Path); err == nil {
+		return fmt.Errorf("RemoveKeySlot: the key still unlocks slot %d of \"%s\", the key server is not told of the removal", stillUnlocks, hostDev.Path)
+	}
+	if active, err = fs.CryptActiveKeySlots(hostDev.Path); err != nil {
+		return fmt.Errorf("RemoveKeySlot: failed to verify the removal, the key server is not told of it - %v", err)
+	}
+	for _, activeSlot := range active {
+		if activeSlot == slot {
+			return fmt.Errorf("RemoveKeySlot: slot %d of \"%s\" is still in use, the key server is not told of the removal", slot, hostDev.Path)
+		}
+	}
+	if err := client.ReportKeySlotRemoved(keyserv.KeySlotRemovedReq{
+		PlainPassword:     password,
+		Hostname:          hostname,
+		UUID:              uuid,
+		OwnerAcknowledged: ownerAcknowledged,
+		Device:            hostDev.Path,
+		KeySlot:           slot,
+	}); err != nil {
+		return fmt.Errorf("RemoveKeySlot: slot %d of \"%s\" has been removed, but the key server did not record it - %v", slot, hostDev.Path, err)
+	}
+	fmt.Fprintf(progressOut, "The key of \"%s\" (%s) has been removed from slot %d, the disk remains accessible by its other key slots.\n", uuid, hostDev.Path, slot)
+	if forgetKey {
+		return ForgetKey(progressOut, client, password, uuid, ownerAcknowledged)
+	}
+	return nil
+}
+
+/*
+ForgetKey asks the server to destroy its copy of the key and keep the record for audit, the disk and the key sealed by
+TPM2 on this computer are left alone. Unless the disk has been given another key slot, its data is only accessible as
+long as it stays unlocked.
+*/
+func ForgetKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid string, ownerAcknowledged bool) error {
+	hostname, _ := sys.GetHostnameAndIP()
+	eraseReq := keyserv.EraseKeyReq{PlainPassword: password, Hostname: hostname, UUID: uuid, OwnerAcknowledged: ownerAcknowledged}
+	if err := checkPartialErase(progressOut, client, eraseReq); err != nil {
+		return fmt.Errorf("ForgetKey: %v", err)
+	}
+	if err := client.ForgetKey(eraseReq); err != nil {
+		return err
+	}
+	fmt.Fprintf(progressOut, "The key server has destroyed its copy of the key of \"%s\" and kept the record.\n", uuid)
+	return nil
+}
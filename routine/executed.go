@@ -0,0 +1,90 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	EXECUTED_COMMANDS_FILE = "/var/lib/cryptctl2/executed-commands.json" // EXECUTED_COMMANDS_FILE remembers the IDs of the pending commands the client has carried out.
+)
+
+/*
+ExecutedCommands remembers the IDs of the pending commands carried out by this computer, so that a command delivered
+again, e.g. replayed or polled twice, is never carried out a second time. An ID is forgotten only after the key server
+stops keeping the command.
+*/
+type ExecutedCommands struct {
+	FilePath string               `json:"-"`   // FilePath is the state file.
+	IDs      map[string]time.Time `json:"ids"` // IDs are the command IDs and the moment they may be forgotten.
+
+	mutex sync.Mutex
+}
+
+/*
+ReadExecutedCommands reads the IDs of executed commands from the state file, a missing file means none. If the file is
+damaged, an error is returned along with an empty state that will overwrite the file.
+*/
+func ReadExecutedCommands(filePath string) (*ExecutedCommands, error) {
+	executed := &ExecutedCommands{FilePath: filePath, IDs: make(map[string]time.Time)}
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return executed, nil
+	} else if err != nil {
+		return executed, fmt.Errorf("ReadExecutedCommands: failed to read \"%s\" - %v", filePath, err)
+	}
+	if err := json.Unmarshal(content, executed); err != nil {
+		executed.IDs = make(map[string]time.Time)
+		return executed, fmt.Errorf("ReadExecutedCommands: state file \"%s\" is damaged - %v", filePath, err)
+	}
+	if executed.IDs == nil {
+		executed.IDs = make(map[string]time.Time)
+	}
+	return executed, nil
+}
+
+// Has returns true only if the command of the ID has been carried out. A command without ID is never remembered.
+func (executed *ExecutedCommands) Has(id string) bool {
+	executed.mutex.Lock()
+	defer executed.mutex.Unlock()
+	_, found := executed.IDs[id]
+	return id != "" && found
+}
+
+/*
+Remember saves the IDs of the commands into the state file, forgetting those no longer kept by the key server along the
+way. It is called before the commands are carried out, so that a command is carried out at most once even if the
+client is interrupted. Commands without ID are not remembered.
+*/
+func (executed *ExecutedCommands) Remember(cmds ...keydb.PendingCommand) error {
+	executed.mutex.Lock()
+	defer executed.mutex.Unlock()
+	now := time.Now()
+	for id, forgetAt := range executed.IDs {
+		if !now.Before(forgetAt) {
+			delete(executed.IDs, id)
+		}
+	}
+	for _, cmd := range cmds {
+		if cmd.ID != "" {
+			executed.IDs[cmd.ID] = cmd.ValidFrom.Add(cmd.Validity * keydb.PendingCommandRetentionFactor)
+		}
+	}
+	if err := sys.MkdirSecure(path.Dir(executed.FilePath)); err != nil {
+		return err
+	}
+	content, err := json.Marshal(executed)
+	if err != nil {
+		return fmt.Errorf("ExecutedCommands.Remember: failed to serialise state - %v", err)
+	}
+	return sys.ReplaceFile(executed.FilePath, content, sys.SecureFileMode, true)
+}
@@ -0,0 +1,51 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestExecutedCommands(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filePath := path.Join(tmpDir, "state", "executed-commands.json")
+	executed, err := ReadExecutedCommands(filePath)
+	if err != nil || executed.Has("a") || executed.Has("") {
+		t.Fatal(executed, err)
+	}
+	// The old command is no longer kept by server and is forgotten once another command is remembered
+	old := keydb.PendingCommand{ID: "old", ValidFrom: time.Now().Add(-time.Hour), Validity: time.Minute}
+	if err := executed.Remember(old, keydb.PendingCommand{}); err != nil || !executed.Has("old") {
+		t.Fatal(executed, err)
+	}
+	if err := executed.Remember(keydb.PendingCommand{ID: "a", ValidFrom: time.Now(), Validity: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(filePath); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatal(err, st)
+	}
+	// The IDs survive a restart of the client
+	executed, err = ReadExecutedCommands(filePath)
+	if err != nil || !executed.Has("a") || executed.Has("old") || executed.Has("") || len(executed.IDs) != 1 {
+		t.Fatal(executed.IDs, err)
+	}
+	// A damaged state file is an error, and the state starts over
+	if err := ioutil.WriteFile(filePath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if executed, err = ReadExecutedCommands(filePath); err == nil || executed.Has("a") {
+		t.Fatal(executed.IDs, err)
+	}
+	if err := executed.Remember(keydb.PendingCommand{ID: "b", ValidFrom: time.Now(), Validity: time.Minute}); err != nil || !executed.Has("b") {
+		t.Fatal(err)
+	}
+}
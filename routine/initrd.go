@@ -0,0 +1,196 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	INITRD_CONFIG_DIR      = "/etc/cryptctl2/initrd" // INITRD_CONFIG_DIR holds the configuration bundle included in the initrd.
+	INITRD_CONFIG_FILE     = "config.json"           // INITRD_CONFIG_FILE is the name of the bundle's settings file.
+	INITRD_CA_FILE         = "ca.pem"                // INITRD_CA_FILE is the name of the bundle's copy of the key server CA.
+	INITRD_CERT_FILE       = "client.crt"            // INITRD_CERT_FILE is the name of the bundle's copy of the client certificate.
+	INITRD_CERT_KEY_FILE   = "client.key"            // INITRD_CERT_KEY_FILE is the name of the bundle's copy of the client certificate key.
+	INITRD_DEVICE_WAIT_SEC = 1                       // INITRD_DEVICE_WAIT_SEC is the interval of looking for a device that has not appeared yet.
+)
+
+// The exit status of "initrd-unlock" for each kind of failure, so that the dracut module can tell them apart.
+const (
+	InitrdExitConfig      = 1 // InitrdExitConfig means the configuration bundle cannot be read or is incomplete.
+	InitrdExitUnreachable = 2 // InitrdExitUnreachable means the key server could not be reached.
+	InitrdExitDenied      = 3 // InitrdExitDenied means the key server does not have the key or refuses to hand it out.
+	InitrdExitNoDevice    = 4 // InitrdExitNoDevice means the encrypted device did not appear.
+	InitrdExitOpen        = 5 // InitrdExitOpen means the key was granted but the device could not be opened with it.
+)
+
+// InitrdConfig is the configuration bundle of the initrd unlock, it is self-contained and does not depend on sysconfig.
+type InitrdConfig struct {
+	Server           string `json:"server"`             // Server is the key server's "host:port", or several of them separated by comma in order of preference.
+	UUID             string `json:"uuid"`               // UUID is the file system UUID of the encrypted root device.
+	MaxRetrySec      int64  `json:"max_retry_sec"`      // MaxRetrySec is how long to keep trying, -1 to retry forever.
+	RetryIntervalSec int64  `json:"retry_interval_sec"` // RetryIntervalSec is the interval between the attempts.
+	HasCA            bool   `json:"has_ca"`             // HasCA is true if the bundle carries a custom CA of the key server.
+
+	ServerFingerprint string `json:"server_fingerprint,omitempty"` // ServerFingerprint pins the key server certificate, see keyserv.TLSVerification.
+	SkipHostname      bool   `json:"skip_hostname,omitempty"`      // SkipHostname is true if the key server certificate does not carry the server's host name.
+	BindAddress       string `json:"bind_address,omitempty"`       // BindAddress is the local IP to connect from, see keyserv.ConnectionSettings.
+	Proxy             string `json:"proxy,omitempty"`              // Proxy is contacted in place of the key server, see keyserv.ConnectionSettings.
+}
+
+// InitrdError is returned by InitrdUnlock, the program exits with its status.
+type InitrdError struct {
+	ExitStatus int   // ExitStatus is one of InitrdExit* constants.
+	Err        error // Err is the underlying error.
+}
+
+func (err InitrdError) Error() string {
+	return err.Err.Error()
+}
+
+// Copy the file into the bundle directory, readable by root only.
+func copyIntoBundle(src, dir, name string) error {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("WriteInitrdConfig: failed to read \"%s\" - %v", src, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name), content, 0600); err != nil {
+		return fmt.Errorf("WriteInitrdConfig: failed to write \"%s\" - %v", path.Join(dir, name), err)
+	}
+	return nil
+}
+
+/*
+WriteInitrdConfig writes the configuration bundle into the directory: the settings, and copies of the key server CA
+(if given), the client certificate, and its key. The directory is meant to be included in the initrd by dracut.
+*/
+func WriteInitrdConfig(dir string, conf InitrdConfig, caFile, certFile, certKeyFile string) error {
+	if conf.Server == "" || conf.UUID == "" {
+		return fmt.Errorf("WriteInitrdConfig: key server address and device UUID must not be empty")
+	}
+	if certFile == "" || certKeyFile == "" {
+		return fmt.Errorf("WriteInitrdConfig: the client certificate and its key are required to retrieve the key without password")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("WriteInitrdConfig: failed to make directory \"%s\" - %v", dir, err)
+	}
+	conf.HasCA = caFile != ""
+	if conf.HasCA {
+		if err := copyIntoBundle(caFile, dir, INITRD_CA_FILE); err != nil {
+			return err
+		}
+	}
+	if err := copyIntoBundle(certFile, dir, INITRD_CERT_FILE); err != nil {
+		return err
+	}
+	if err := copyIntoBundle(certKeyFile, dir, INITRD_CERT_KEY_FILE); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, INITRD_CONFIG_FILE), content, 0600); err != nil {
+		return fmt.Errorf("WriteInitrdConfig: failed to write \"%s\" - %v", path.Join(dir, INITRD_CONFIG_FILE), err)
+	}
+	return nil
+}
+
+// ReadInitrdConfig reads the settings of the configuration bundle from the directory.
+func ReadInitrdConfig(dir string) (conf InitrdConfig, err error) {
+	content, err := ioutil.ReadFile(path.Join(dir, INITRD_CONFIG_FILE))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(content, &conf); err != nil {
+		return conf, fmt.Errorf("ReadInitrdConfig: failed to parse \"%s\" - %v", path.Join(dir, INITRD_CONFIG_FILE), err)
+	}
+	if conf.Server == "" || conf.UUID == "" {
+		return conf, fmt.Errorf("ReadInitrdConfig: \"%s\" lacks the key server address or device UUID", path.Join(dir, INITRD_CONFIG_FILE))
+	}
+	return
+}
+
+/*
+InitrdUnlock retrieves the key of the encrypted root device according to the configuration bundle in the directory,
+and opens the device. It does nothing else - no mounting, alive reports, or sysconfig - so that it fits into an initrd,
+where the network has been brought up by the kernel command line (ip=) already. The key is only ever kept in memory.
+The device and the key server are tried until the retry period elapses, the error tells the kind of failure.
+*/
+func InitrdUnlock(progressOut io.Writer, dir string) error {
+	conf, err := ReadInitrdConfig(dir)
+	if err != nil {
+		return InitrdError{InitrdExitConfig, err}
+	}
+	var caCertPEM []byte
+	if conf.HasCA {
+		if caCertPEM, err = ioutil.ReadFile(path.Join(dir, INITRD_CA_FILE)); err != nil {
+			return InitrdError{InitrdExitConfig, err}
+		}
+	}
+	client, err := keyserv.NewCryptClient("tcp", conf.Server, caCertPEM, path.Join(dir, INITRD_CERT_FILE), path.Join(dir, INITRD_CERT_KEY_FILE))
+	if err != nil {
+		return InitrdError{InitrdExitConfig, err}
+	}
+	if err := client.SetTLSVerification(keyserv.TLSVerification{Fingerprint: conf.ServerFingerprint, SkipHostname: conf.SkipHostname}); err != nil {
+		return InitrdError{InitrdExitConfig, err}
+	}
+	if err := client.SetConnection(keyserv.ConnectionSettings{BindAddress: conf.BindAddress, Proxy: conf.Proxy}); err != nil {
+		return InitrdError{InitrdExitConfig, err}
+	}
+	retry := UnlockRetry{MaxRetrySec: conf.MaxRetrySec, IntervalSec: conf.RetryIntervalSec}
+	begin := time.Now()
+	// The device may show up a while after the initrd starts
+	var unlockDev fs.BlockDevice
+	for found := false; !found; {
+		if unlockDev, found = getBlockDevices().GetByCriteria(conf.UUID, "", "", "", "", "", ""); !found {
+			if retry.exhausted(begin) {
+				return InitrdError{InitrdExitNoDevice, fmt.Errorf("InitrdUnlock: device with UUID '%s' did not appear", conf.UUID)}
+			}
+			time.Sleep(INITRD_DEVICE_WAIT_SEC * time.Second)
+		}
+	}
+	hostname, _ := os.Hostname()
+	for attempts := 1; ; attempts++ {
+		resp, err := client.AutoRetrieveKey(keyserv.AutoRetrieveKeyReq{Hostname: hostname, UUIDs: []string{conf.UUID}})
+		exitStatus := InitrdExitUnreachable
+		if err == nil {
+			if rec, granted := resp.Granted[conf.UUID]; granted {
+				err := initrdOpen(progressOut, rec, unlockDev)
+				wipeGrantedKeys(resp.Granted)
+				return err
+			} else if len(resp.Missing) > 0 {
+				return InitrdError{InitrdExitDenied, fmt.Errorf("InitrdUnlock: key server does not have encryption key for '%s'", conf.UUID)}
+			}
+			// Server may have rejected the key request due to MaxActive being exceeded
+			exitStatus, err = InitrdExitDenied, fmt.Errorf("key server rejected the request")
+		}
+		if retry.exhausted(begin) {
+			return InitrdError{exitStatus, fmt.Errorf("InitrdUnlock: failed to retrieve key for '%s' and have given up after %d attempts - %v", conf.UUID, attempts, err)}
+		}
+		fmt.Fprintf(progressOut, "InitrdUnlock: attempt %d failed, will retry in %d seconds - %v\n", attempts, retry.interval(), err)
+		time.Sleep(time.Duration(retry.interval()) * time.Second)
+	}
+}
+
+// Open the encrypted device under its mapper name using the granted record.
+func initrdOpen(progressOut io.Writer, rec keydb.Record, unlockDev fs.BlockDevice) error {
+	dmName, err := GetDeviceMapperName(rec, unlockDev, DM_DIR)
+	if err != nil {
+		return InitrdError{InitrdExitOpen, err}
+	}
+	if err := cryptOpenByKey(rec, unlockDev.Path, dmName); err != nil {
+		return InitrdError{InitrdExitOpen, err}
+	}
+	fmt.Fprintf(progressOut, "InitrdUnlock: device with UUID '%s' is now available as \"%s\"\n", rec.UUID, path.Join(DM_DIR, dmName))
+	return nil
+}
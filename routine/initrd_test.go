@@ -0,0 +1,49 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestInitrdUnlock(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var out bytes.Buffer
+	if err := InitrdUnlock(&out, tmpDir); err == nil || err.(InitrdError).ExitStatus != InitrdExitConfig {
+		t.Fatal(err)
+	}
+	certFile, keyFile := path.Join("..", "keyserv", "rpc_test.crt"), path.Join("..", "keyserv", "rpc_test.key")
+	if err := WriteInitrdConfig(tmpDir, InitrdConfig{Server: "localhost:1"}, certFile, certFile, keyFile); err == nil {
+		t.Fatal("did not error")
+	}
+	conf := InitrdConfig{Server: "localhost:1", UUID: "fakeuuid", MaxRetrySec: 0, RetryIntervalSec: 1}
+	if err := WriteInitrdConfig(tmpDir, conf, certFile, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if readConf, err := ReadInitrdConfig(tmpDir); err != nil || readConf.UUID != "fakeuuid" || !readConf.HasCA {
+		t.Fatal(readConf, err)
+	}
+	if info, err := os.Stat(path.Join(tmpDir, INITRD_CERT_KEY_FILE)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(info, err)
+	}
+	// The device is not there
+	fakeUnlockFS(t, 0)
+	getBlockDevices = func() fs.BlockDevices { return fs.BlockDevices{} }
+	if err := InitrdUnlock(&out, tmpDir); err == nil || err.(InitrdError).ExitStatus != InitrdExitNoDevice {
+		t.Fatal(err)
+	}
+	// Nothing listens on the key server port
+	fakeUnlockFS(t, 0)
+	if err := InitrdUnlock(&out, tmpDir); err == nil || err.(InitrdError).ExitStatus != InitrdExitUnreachable {
+		t.Fatal(err)
+	}
+}
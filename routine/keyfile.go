@@ -0,0 +1,32 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/keyserv"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+/*
+ReadKeyFile reads the encryption key of a disk encrypted elsewhere, e.g. a pre-encrypted image, so that its record can
+be created with the key. The file holds either the raw key bytes, or the key encoded in base64 on its own.
+*/
+func ReadKeyFile(keyFile string) ([]byte, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ReadKeyFile: failed to read key file - %v", err)
+	}
+	key := content
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 {
+		if decoded, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil {
+			key = decoded
+		}
+	}
+	if len(key) < keyserv.MinRotatedKeyLen {
+		return nil, fmt.Errorf("ReadKeyFile: the key in \"%s\" is too short (%d bytes), it must have at least %d bytes", keyFile, len(key), keyserv.MinRotatedKeyLen)
+	}
+	return key, nil
+}
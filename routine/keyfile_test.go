@@ -0,0 +1,39 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	rawKey := bytes.Repeat([]byte{0, 0xff, 'a', '\n'}, 16)
+	rawFile := path.Join(dir, "raw")
+	base64File := path.Join(dir, "base64")
+	shortFile := path.Join(dir, "short")
+	if err := os.WriteFile(rawFile, rawKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base64File, []byte(base64.StdEncoding.EncodeToString(rawKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(shortFile, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyFile := range []string{rawFile, base64File} {
+		if key, err := ReadKeyFile(keyFile); err != nil || !bytes.Equal(key, rawKey) {
+			t.Fatal(keyFile, key, err)
+		}
+	}
+	if _, err := ReadKeyFile(shortFile); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := ReadKeyFile(path.Join(dir, "missing")); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -4,26 +4,128 @@ package routine
 
 import (
 	"bytes"
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math/big"
 	"net"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
-// Reads the actual serial number increments it and saves the new value.
+const (
+	CertKeyTypeRSA2048   = "rsa2048"    // CertKeyTypeRSA2048 generates 2048-bit RSA keys for certificates.
+	CertKeyTypeRSA4096   = "rsa4096"    // CertKeyTypeRSA4096 generates 4096-bit RSA keys for certificates, it is the default for a new CA.
+	CertKeyTypeECDSAP256 = "ecdsa-p256" // CertKeyTypeECDSAP256 generates ECDSA keys on curve P-256 for certificates.
+	CertKeyTypeECDSAP384 = "ecdsa-p384" // CertKeyTypeECDSAP384 generates ECDSA keys on curve P-384 for certificates.
+)
+
+// CertKeyTypes are the key types that certificates may be generated with.
+var CertKeyTypes = []string{CertKeyTypeRSA2048, CertKeyTypeRSA4096, CertKeyTypeECDSAP256, CertKeyTypeECDSAP384}
+
+// ValidateCertKeyType returns an error if the key type is neither empty nor one of CertKeyTypes.
+func ValidateCertKeyType(keyType string) error {
+	for _, known := range CertKeyTypes {
+		if keyType == "" || keyType == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("Key type \"%s\" is not supported, use one of %v", keyType, CertKeyTypes)
+}
+
+// Generate a private key of the type.
+func generateCertKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case CertKeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case CertKeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case CertKeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case CertKeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, ValidateCertKeyType(keyType)
+}
+
+// Return the type of the private key, or an empty string if it is none of CertKeyTypes.
+func certKeyTypeOf(key crypto.Signer) string {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() <= 2048 {
+			return CertKeyTypeRSA2048
+		}
+		return CertKeyTypeRSA4096
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return CertKeyTypeECDSAP256
+		case elliptic.P384():
+			return CertKeyTypeECDSAP384
+		}
+	}
+	return ""
+}
+
+// Encode the private key in PEM as PKCS#8, which carries RSA and ECDSA keys alike.
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+/*
+Decode the PEM private key of a CA or certificate. Keys are written as PKCS#8, the RSA keys written as PKCS#1 by older
+versions and SEC 1 ECDSA keys are understood as well.
+*/
+func decodePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("the key file is not PEM-encoded")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("the key of type %T cannot sign certificates", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the key file carries neither a PKCS#8, PKCS#1, nor SEC 1 private key (PEM type \"%s\")", block.Type)
+}
+
+/*
+Reads the actual serial number increments it and saves the new value. The file is locked meanwhile, so that concurrent
+issuance never hands out the same serial twice. If the file is missing, empty, or corrupt, e.g. as the CA was created
+by a version that did not write it, the serial continues after the highest serial of the certificates in the directory
+and the current time in seconds, whichever is greater, so that it stays clear of certificates whose files are gone.
+*/
 func GetNextSerial(certDir string) (int64, error) {
 	serialPath := path.Join(certDir, "serial")
-	data := make([]byte, 100)
-	file, err := os.OpenFile(serialPath, os.O_RDWR, 0600)
+	file, err := os.OpenFile(serialPath, os.O_RDWR|os.O_CREATE, sys.SecureFileMode)
 	if err != nil {
 		return 0, err
 	}
@@ -31,27 +133,66 @@ func GetNextSerial(certDir string) (int64, error) {
 	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
 		return 0, err
 	}
-	len, err := file.Read(data)
+	data, err := io.ReadAll(file)
 	if err != nil {
 		return 0, err
 	}
-	if serial, err := strconv.ParseInt(string(data[:len]), 10, 64); err != nil {
-		return 0, err
-	} else {
-		serial++
-		file.Seek(0, 0)
-		if _, err := file.Write([]byte(strconv.FormatInt(serial, 10))); err != nil {
+	serial, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || serial < 1 {
+		if serial, err = recoverSerial(certDir); err != nil {
 			return 0, err
 		}
-		return serial, nil
+		log.Printf("GetNextSerial: serial file \"%s\" is missing or unusable (%q), continuing from serial %d", serialPath, data, serial)
+	}
+	serial++
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt([]byte(strconv.FormatInt(serial, 10)), 0); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return serial, nil
+}
+
+// Return the greater of the highest serial among the certificates of the directory and the current time in seconds.
+func recoverSerial(certDir string) (int64, error) {
+	highest := time.Now().Unix()
+	entries, err := os.ReadDir(certDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".crt") {
+			continue
+		}
+		if cert, err := readCertificateFile(path.Join(certDir, entry.Name())); err == nil && cert.SerialNumber.IsInt64() && cert.SerialNumber.Int64() > highest {
+			highest = cert.SerialNumber.Int64()
+		}
 	}
+	return highest, nil
 }
 
-func GenerateSelfSignedCaCert(commonName, ipAddress, certDir, organization string, maxAge int) error {
+/*
+Generates a CA into the certificate directory along with the server certificate for the common name, see
+GenerateCertificate for the IP addresses. Both keys are of the key type, CertKeyTypeRSA4096 if it is empty.
+*/
+func GenerateSelfSignedCaCert(commonName, ipAddresses, certDir, organization string, maxAge int, keyType string) error {
+	if _, err := keydb.ParseIPList(ipAddresses); err != nil {
+		return err
+	}
+	if keyType == "" {
+		keyType = CertKeyTypeRSA4096
+	}
+	if err := ValidateCertKeyType(keyType); err != nil {
+		return err
+	}
 	caCertFilePath := path.Join(certDir, "ca.crt")
 	caKeyFilePath := path.Join(certDir, "ca.key")
 
-	if err := os.WriteFile(path.Join(certDir, "serial"), []byte("1"), 0600); err != nil {
+	if err := sys.WriteNewFile(path.Join(certDir, "serial"), []byte("1"), sys.SecureFileMode, true); err != nil {
 		return err
 	}
 	// set up our CA certificate
@@ -64,18 +205,17 @@ func GenerateSelfSignedCaCert(commonName, ipAddress, certDir, organization strin
 		NotAfter:              time.Now().AddDate(maxAge, 0, 0),
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
 	caPEM := new(bytes.Buffer)
-	caPrivKeyPEM := new(bytes.Buffer)
 
 	// create ca private and public key
-	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	caPrivKey, err := generateCertKey(keyType)
 	if err != nil {
 		return err
 	}
-	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
+	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, caPrivKey.Public(), caPrivKey)
 	if err != nil {
 		return err
 	}
@@ -84,107 +224,274 @@ func GenerateSelfSignedCaCert(commonName, ipAddress, certDir, organization strin
 		Type:  "CERTIFICATE",
 		Bytes: caBytes,
 	})
+	caPrivKeyPEM, err := encodePrivateKey(caPrivKey)
+	if err != nil {
+		return err
+	}
 
-	pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caPrivKey),
-	})
-
-	if err = os.WriteFile(caCertFilePath, caPEM.Bytes(), 0400); err != nil {
+	if err = sys.WriteNewFile(caCertFilePath, caPEM.Bytes(), sys.ReadOnlyFileMode, true); err != nil {
 		return err
 	}
-	if err = os.WriteFile(caKeyFilePath, caPrivKeyPEM.Bytes(), 0400); err != nil {
+	if err = sys.WriteNewFile(caKeyFilePath, caPrivKeyPEM, sys.ReadOnlyFileMode, true); err != nil {
 		return err
 	}
-	return GenerateCertificate(commonName, ipAddress, certDir)
+	return GenerateCertificate(commonName, ipAddresses, certDir, keyType, 0)
 }
 
-func LoadCA(certDir string) (*x509.Certificate, *rsa.PrivateKey) {
-
-	caCertFilePath := path.Join(certDir, "ca.crt")
-	caKeyFilePath := path.Join(certDir, "ca.key")
-	cf, e := os.ReadFile(caCertFilePath)
-	if e != nil {
-		fmt.Println("cfload:", e.Error())
-		os.Exit(1)
+// LoadCA reads the CA certificate and its RSA or ECDSA private key from the certificate directory.
+func LoadCA(certDir string) (*x509.Certificate, crypto.Signer, error) {
+	cf, err := os.ReadFile(path.Join(certDir, "ca.crt"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("LoadCA: failed to read CA certificate - %v", err)
+	}
+	kf, err := os.ReadFile(path.Join(certDir, "ca.key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("LoadCA: failed to read CA key - %v", err)
+	}
+	cpb, _ := pem.Decode(cf)
+	if cpb == nil {
+		return nil, nil, errors.New("LoadCA: the CA certificate is not PEM-encoded")
+	}
+	crt, err := x509.ParseCertificate(cpb.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("LoadCA: failed to parse CA certificate - %v", err)
+	}
+	key, err := decodePrivateKey(kf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("LoadCA: failed to parse CA key - %v", err)
 	}
+	return crt, key, nil
+}
 
-	kf, e := os.ReadFile(caKeyFilePath)
-	if e != nil {
-		fmt.Println("kfload:", e.Error())
-		os.Exit(1)
+/*
+Parse the comma-separated DNS names of a certificate, e.g. the short and fully qualified name of the computer. The
+first name becomes the common name and the name of the certificate files.
+*/
+func parseCertDNSNames(dnsNames string) ([]string, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(dnsNames, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		} else if strings.ContainsAny(name, "/ \t\n") || name == "." || name == ".." {
+			return nil, fmt.Errorf("\"%s\" is not a valid DNS name", name)
+		}
+		names = append(names, name)
 	}
-	cpb, cr := pem.Decode(cf)
-	fmt.Println(string(cr))
-	kpb, kr := pem.Decode(kf)
-	fmt.Println(string(kr))
-	crt, e := x509.ParseCertificate(cpb.Bytes)
+	return names, nil
+}
 
-	if e != nil {
-		fmt.Println("parsex509:", e.Error())
-		os.Exit(1)
+// Return the subject key identifier of the public key, the SHA-1 hash of its bit string as suggested by RFC 5280.
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
 	}
-	key, e := x509.ParsePKCS1PrivateKey(kpb.Bytes)
-	if e != nil {
-		fmt.Println("parsekey:", e.Error())
-		os.Exit(1)
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
 	}
-	return crt, key
+	digest := sha1.Sum(spki.PublicKey.Bytes)
+	return digest[:], nil
 }
 
-func GenerateCertificate(dnsName, ipAdress, certDir string) error {
-	caCert, caPrivKey := LoadCA(certDir)
-	certPEM := new(bytes.Buffer)
-	certPrivKeyPEM := new(bytes.Buffer)
-	certFilePath := path.Join(certDir, dnsName+".crt")
-	keyFilePath := path.Join(certDir, dnsName+".key")
+/*
+Issue a certificate for the public key by the CA of the certificate directory, and write it to the directory under the
+first DNS name. The certificate is valid for the days, or as long as the CA if that is 0 or longer.
+*/
+func issueCertificate(certDir string, caCert *x509.Certificate, caPrivKey crypto.Signer, pub crypto.PublicKey, dnsNames []string, ips []net.IP, validityDays int) error {
 	serial, err := GetNextSerial(certDir)
 	if err != nil {
-		fmt.Println("Can not get new serial:", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("Can not get new serial - %v", err)
+	}
+	keyID, err := subjectKeyID(pub)
+	if err != nil {
+		return err
+	}
+	notAfter := caCert.NotAfter
+	if validityDays > 0 && time.Now().AddDate(0, 0, validityDays).Before(notAfter) {
+		notAfter = time.Now().AddDate(0, 0, validityDays)
 	}
 	// set up our server certificate
 	cert := &x509.Certificate{
 		SerialNumber: big.NewInt(serial),
 		Subject: pkix.Name{
-			CommonName:   dnsName,
+			CommonName:   dnsNames[0],
 			Organization: caCert.Subject.Organization,
 		},
 		NotBefore:    time.Now(),
-		NotAfter:     caCert.NotAfter,
-		SubjectKeyId: []byte{1, 2, 3, 4, 6},
+		NotAfter:     notAfter,
+		SubjectKeyId: keyID,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:     x509.KeyUsageDigitalSignature,
-		DNSNames:     []string{dnsName},
+		DNSNames:     dnsNames,
 	}
-	if ip := net.ParseIP(ipAdress); ip != nil {
-		cert.IPAddresses = []net.IP{ip}
+	if len(ips) > 0 {
+		cert.IPAddresses = ips
 	}
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, caCert, pub, caPrivKey)
 	if err != nil {
 		return err
 	}
-
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, caCert, &certPrivKey.PublicKey, caPrivKey)
-	if err != nil {
-		return err
-	}
-
-	pem.Encode(certPEM, &pem.Block{
+	certPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certBytes,
 	})
+	return sys.WriteNewFile(path.Join(certDir, dnsNames[0]+".crt"), certPEM, sys.ReadOnlyFileMode, true)
+}
 
-	pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
-	})
-	if err = os.WriteFile(certFilePath, certPEM.Bytes(), 0400); err != nil {
+/*
+Generates a certificate for the comma-separated DNS names signed by the CA of the certificate directory, the files are
+named after the first DNS name. The IP addresses, e.g. both the IPv4 and IPv6 address of the computer, are separated by
+comma and may be empty. The certificate key is of the key type, or of the CA key's type if it is empty. The certificate
+is valid for the days, or as long as the CA if that is 0 or longer.
+*/
+func GenerateCertificate(dnsNames, ipAddresses, certDir, keyType string, validityDays int) error {
+	names, err := parseCertDNSNames(dnsNames)
+	if err != nil {
+		return err
+	} else if len(names) == 0 {
+		return errors.New("The certificate needs a DNS name")
+	}
+	ips, err := keydb.ParseIPList(ipAddresses)
+	if err != nil {
+		return err
+	}
+	if err := ValidateCertKeyType(keyType); err != nil {
+		return err
+	}
+	if validityDays < 0 {
+		return fmt.Errorf("Validity of %d days must not be negative", validityDays)
+	}
+	caCert, caPrivKey, err := LoadCA(certDir)
+	if err != nil {
+		return err
+	}
+	if keyType == "" {
+		if keyType = certKeyTypeOf(caPrivKey); keyType == "" {
+			keyType = CertKeyTypeRSA4096
+		}
+	}
+	certPrivKey, err := generateCertKey(keyType)
+	if err != nil {
 		return err
 	}
-	if err = os.WriteFile(keyFilePath, certPrivKeyPEM.Bytes(), 0400); err != nil {
+	if err := issueCertificate(certDir, caCert, caPrivKey, certPrivKey.Public(), names, ips, validityDays); err != nil {
 		return err
 	}
+	certPrivKeyPEM, err := encodePrivateKey(certPrivKey)
+	if err != nil {
+		return err
+	}
+	return sys.WriteNewFile(path.Join(certDir, names[0]+".key"), certPrivKeyPEM, sys.ReadOnlyFileMode, true)
+}
 
+/*
+GenerateSelfSignedCertificate generates a certificate for the DNS name that is signed by its own RSA key, without a CA,
+and writes the certificate and key to the files. Existing files are never overwritten.
+*/
+func GenerateSelfSignedCertificate(commonName, certPath, keyPath string) error {
+	if commonName == "" {
+		return errors.New("The certificate needs a DNS name")
+	}
+	privKey, err := generateCertKey(CertKeyTypeRSA2048)
+	if err != nil {
+		return err
+	}
+	keyID, err := subjectKeyID(privKey.Public())
+	if err != nil {
+		return err
+	}
+	cert := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		SubjectKeyId:          keyID,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		DNSNames:              []string{commonName},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, cert, privKey.Public(), privKey)
+	if err != nil {
+		return err
+	}
+	privKeyPEM, err := encodePrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+	if err := sys.WriteNewFile(keyPath, privKeyPEM, sys.SecureFileMode, true); err != nil {
+		return err
+	}
+	if err := sys.WriteNewFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), sys.ReadOnlyFileMode, true); err != nil {
+		os.Remove(keyPath)
+		return err
+	}
 	return nil
 }
+
+/*
+SignCertificateRequest signs the PEM certificate signing request of the file by the CA of the certificate directory,
+so that the private key never leaves the computer that generated it. The certificate carries the comma-separated
+DNS names and IP addresses if given, otherwise those of the request, and is written to the directory under the first
+DNS name. Return the path of the certificate file.
+*/
+func SignCertificateRequest(csrPath, dnsNames, ipAddresses, certDir string, validityDays int) (string, error) {
+	csrPEM, err := os.ReadFile(csrPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", fmt.Errorf("\"%s\" is not a PEM-encoded certificate request", csrPath)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse certificate request - %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", fmt.Errorf("The signature of the certificate request is invalid - %v", err)
+	}
+	names, err := parseCertDNSNames(dnsNames)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		if csr.Subject.CommonName != "" {
+			names = append(names, csr.Subject.CommonName)
+		}
+		for _, name := range csr.DNSNames {
+			if name != csr.Subject.CommonName {
+				names = append(names, name)
+			}
+		}
+		// The names of the request go through the same validation as those given on command line
+		if names, err = parseCertDNSNames(strings.Join(names, ",")); err != nil {
+			return "", err
+		}
+	}
+	if len(names) == 0 {
+		return "", errors.New("The certificate request carries no DNS name, give one with the request")
+	}
+	ips := csr.IPAddresses
+	if ipAddresses != "" {
+		if ips, err = keydb.ParseIPList(ipAddresses); err != nil {
+			return "", err
+		}
+	}
+	if validityDays < 0 {
+		return "", fmt.Errorf("Validity of %d days must not be negative", validityDays)
+	}
+	caCert, caPrivKey, err := LoadCA(certDir)
+	if err != nil {
+		return "", err
+	}
+	if err := issueCertificate(certDir, caCert, caPrivKey, csr.PublicKey, names, ips, validityDays); err != nil {
+		return "", err
+	}
+	return path.Join(certDir, names[0]+".crt"), nil
+}
@@ -0,0 +1,345 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	KEY_ROTATION_STATE_DIR = "/var/lib/cryptctl2/key-rotation"
+	KeyRotationStateMode   = sys.SecureFileMode // KeyRotationStateMode is the permission of key rotation state files.
+)
+
+// The encryption header operations carried out by key rotation, test cases substitute them to simulate a disk.
+var (
+	cryptKeySlotOf      = fs.CryptKeySlotOf
+	cryptActiveKeySlots = fs.CryptActiveKeySlots
+	cryptAddKey         = fs.CryptAddKey
+	cryptKillSlot       = fs.CryptKillSlot
+)
+
+/*
+KeyRotationState is written to disk before a new key is added to the LUKS header, and removed once the old key slot is
+gone. If it is found when a rotation starts, the previous rotation was interrupted and is cleaned up first. The key
+itself is never written into the state.
+*/
+type KeyRotationState struct {
+	UUID    string    `json:"uuid"`     // UUID is the key record UUID.
+	Device  string    `json:"device"`   // Device is the encrypted block device, e.g. /dev/sdb1.
+	OldSlot int       `json:"old_slot"` // OldSlot is the key slot of the key that is being replaced.
+	NewSlot int       `json:"new_slot"` // NewSlot is the key slot that receives the new key.
+	Started time.Time `json:"started"`  // Started is the moment the rotation began.
+}
+
+// Return the path of the rotation state file of the record.
+func keyRotationStatePath(stateDir, uuid string) string {
+	return path.Join(stateDir, uuid+".json")
+}
+
+// ReadKeyRotationState returns the state of an interrupted rotation of the record, or found is false if there is none.
+func ReadKeyRotationState(stateDir, uuid string) (state KeyRotationState, found bool, err error) {
+	content, err := ioutil.ReadFile(keyRotationStatePath(stateDir, uuid))
+	if os.IsNotExist(err) {
+		return state, false, nil
+	} else if err != nil {
+		return state, false, fmt.Errorf("ReadKeyRotationState: failed to read state of \"%s\" - %v", uuid, err)
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, false, fmt.Errorf("ReadKeyRotationState: state file of \"%s\" is damaged - %v", uuid, err)
+	}
+	return state, true, nil
+}
+
+// WriteKeyRotationState saves the rotation state and flushes it to disk.
+func WriteKeyRotationState(stateDir string, state KeyRotationState) error {
+	if err := sys.MkdirSecure(stateDir); err != nil {
+		return err
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("WriteKeyRotationState: failed to serialise state - %v", err)
+	}
+	return sys.ReplaceFile(keyRotationStatePath(stateDir, state.UUID), content, KeyRotationStateMode, true)
+}
+
+// RemoveKeyRotationState removes the rotation state of the record, it is not an error if there is none.
+func RemoveKeyRotationState(stateDir, uuid string) error {
+	if err := os.Remove(keyRotationStatePath(stateDir, uuid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RemoveKeyRotationState: failed to remove state of \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
+
+// Return the lowest key slot number that is not among the active ones, or -1 if all slots are taken.
+func freeKeySlot(activeSlots []int) int {
+	inUse := make(map[int]bool)
+	for _, slot := range activeSlots {
+		inUse[slot] = true
+	}
+	for slot := 0; slot < fs.LUKS1_MAX_KEY_SLOTS; slot++ {
+		if !inUse[slot] {
+			return slot
+		}
+	}
+	return -1
+}
+
+// Retrieve the key record of the device from server, using the password if it is given or auto-unlock authorisation otherwise.
+func retrieveCurrentKey(client *keyserv.CryptClient, password string, candidates []string) (rec keydb.Record, err error) {
+	hostname, _ := sys.GetHostnameAndIP()
+	var granted map[string]keydb.Record
+	if password == "" {
+		resp, err := client.AutoRetrieveKey(keyserv.AutoRetrieveKeyReq{Hostname: hostname, UUIDs: candidates})
+		if err != nil {
+			return rec, err
+		}
+		granted = resp.Granted
+	} else {
+		resp, err := client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{PlainPassword: password, Hostname: hostname, UUIDs: candidates})
+		if err != nil {
+			return rec, err
+		}
+		granted = resp.Granted
+	}
+	rec, found := firstGranted(granted, candidates)
+	if !found {
+		return rec, fmt.Errorf("key server does not grant the key of \"%s\" to this computer", candidates[0])
+	}
+	return rec, nil
+}
+
+/*
+Clean up after an interrupted rotation. Whichever key the server holds now is the one to keep: if it is the new key, the
+old key slot is removed and the rotation is complete; if it is still the old key, the new key slot is removed so that
+the rotation may start over.
+*/
+func resumeKeyRotation(progressOut io.Writer, state KeyRotationState, serverKey []byte) (completed bool, err error) {
+	slot, err := cryptKeySlotOf(serverKey, state.Device)
+	if err != nil {
+		return false, fmt.Errorf("the key on server does not unlock \"%s\", please restore the record from backup - %v", state.Device, err)
+	}
+	active, err := cryptActiveKeySlots(state.Device)
+	if err != nil {
+		return false, err
+	}
+	completed = slot == state.NewSlot
+	discard := state.NewSlot
+	if completed {
+		discard = state.OldSlot
+	}
+	for _, activeSlot := range active {
+		if activeSlot == discard && discard != slot {
+			fmt.Fprintf(progressOut, "Removing key slot %d left behind by the interrupted rotation...\n", discard)
+			return completed, cryptKillSlot(serverKey, state.Device, discard)
+		}
+	}
+	return completed, nil
+}
+
+/*
+Bring the copies of the record that this computer keeps for unlocking without the key server up to date after a
+rotation, as they carry the replaced key. Without TPM2 PCRs the sealed copy cannot be renewed, and is removed instead.
+*/
+func refreshRotatedRecord(progressOut io.Writer, rec keydb.Record, tpmPCRs string) {
+	if tpmPCRs != "" {
+		RefreshSealedRecord(progressOut, tpm2SealDir, rec, tpmPCRs)
+	} else if err := RemoveSealedRecord(tpm2SealDir, rec.UUID); err != nil {
+		fmt.Fprintln(progressOut, err)
+	}
+	RefreshTangRecord(progressOut, TANG_RECORD_DIR, rec)
+}
+
+/*
+RotateKey replaces the encryption key of the device. The new key is added to a free key slot and uploaded to the
+server, and the old key slot is only removed after the server has been verified to hand out the new key. Should the
+rotation be interrupted at any point, the device remains unlockable with the key held by the server, and the next
+rotation of the device cleans up before starting over. The sealed and Tang copies of the record are refreshed
+afterwards, the TPM2 PCRs are empty if keys are not to be sealed.
+*/
+func RotateKey(progressOut io.Writer, client *keyserv.CryptClient, password, deviceID, stateDir, tpmPCRs string) error {
+	blkDevs := getBlockDevices()
+	blkDev, _, err := blkDevs.ResolveDeviceID(deviceID)
+	if err != nil {
+		return fmt.Errorf("RotateKey: cannot find a block device corresponding to \"%s\" - %v", deviceID, err)
+	} else if !blkDev.IsLUKSEncrypted() {
+		return fmt.Errorf("RotateKey: \"%s\" is not an encrypted disk", blkDev.Path)
+	}
+	candidates := recordIDCandidates(blkDevs, deviceID)
+	rec, err := retrieveCurrentKey(client, password, candidates)
+	if err != nil {
+		return fmt.Errorf("RotateKey: failed to retrieve the current key - %v", err)
+	}
+	if rec.IsKeyRotationPending() {
+		fmt.Fprintf(progressOut, "The key server has started a rotation of the key of \"%s\" (%s), carrying it out...\n", blkDev.Path, rec.UUID)
+		return applyKeyRotation(progressOut, client, password, rec, blkDev.Path, tpmPCRs)
+	}
+	state, found, err := ReadKeyRotationState(stateDir, rec.UUID)
+	if err != nil {
+		return fmt.Errorf("RotateKey: %v", err)
+	} else if found {
+		fmt.Fprintf(progressOut, "The previous key rotation of \"%s\" (%s) started on %s was interrupted, cleaning up...\n",
+			blkDev.Path, rec.UUID, state.Started.Format(time.RFC3339))
+		state.Device = blkDev.Path
+		completed, err := resumeKeyRotation(progressOut, state, rec.Key)
+		if err != nil {
+			return fmt.Errorf("RotateKey: %v", err)
+		}
+		if err := RemoveKeyRotationState(stateDir, rec.UUID); err != nil {
+			return fmt.Errorf("RotateKey: %v", err)
+		}
+		if completed {
+			refreshRotatedRecord(progressOut, rec, tpmPCRs)
+			fmt.Fprintf(progressOut, "The encryption key of \"%s\" (%s) has been rotated successfully.\n", blkDev.Path, rec.UUID)
+			return nil
+		}
+	}
+
+	oldSlot, err := cryptKeySlotOf(rec.Key, blkDev.Path)
+	if err != nil {
+		return fmt.Errorf("RotateKey: %v", err)
+	}
+	active, err := cryptActiveKeySlots(blkDev.Path)
+	if err != nil {
+		return fmt.Errorf("RotateKey: %v", err)
+	}
+	newSlot := freeKeySlot(active)
+	if newSlot == -1 {
+		return fmt.Errorf("RotateKey: all key slots of \"%s\" are in use, please remove an unused one", blkDev.Path)
+	}
+	// The state must be on disk before the header changes, so that an interruption can be cleaned up.
+	state = KeyRotationState{UUID: rec.UUID, Device: blkDev.Path, OldSlot: oldSlot, NewSlot: newSlot, Started: time.Now()}
+	if err := WriteKeyRotationState(stateDir, state); err != nil {
+		return fmt.Errorf("RotateKey: %v", err)
+	}
+	newKey := sys.SecureBytes(keyserv.GetNewDiskEncryptionKeyBits())
+	defer newKey.Wipe()
+	fmt.Fprintf(progressOut, "Adding the new key to slot %d of \"%s\"...\n", newSlot, blkDev.Path)
+	if err := cryptAddKey(rec.Key, newKey, blkDev.Path, newSlot); err != nil {
+		return fmt.Errorf("RotateKey: %v", err)
+	}
+	if slot, err := cryptKeySlotOf(newKey, blkDev.Path); err != nil || slot != newSlot {
+		return fmt.Errorf("RotateKey: the new key does not unlock slot %d of \"%s\" (%d) - %v", newSlot, blkDev.Path, slot, err)
+	}
+
+	fmt.Fprintf(progressOut, "Uploading the new key of \"%s\" (%s) to key server...\n", blkDev.Path, rec.UUID)
+	hostname, _ := sys.GetHostnameAndIP()
+	oldDigest := sha256.Sum256(rec.Key)
+	if err := client.UpdateKey(keyserv.UpdateKeyReq{
+		PlainPassword: password,
+		Hostname:      hostname,
+		UUID:          rec.UUID,
+		OldKeyDigest:  oldDigest[:],
+		NewKey:        newKey,
+	}); err != nil {
+		return fmt.Errorf("RotateKey: failed to upload the new key, the old key remains in use and the next rotation will clean up slot %d - %v", newSlot, err)
+	}
+	// Only remove the old key after the server has proven to hand out the new one
+	stored, err := retrieveCurrentKey(client, password, []string{rec.UUID})
+	if err != nil {
+		return fmt.Errorf("RotateKey: failed to verify the new key on server, the next rotation will clean up - %v", err)
+	}
+	defer stored.Key.Wipe()
+	if !bytes.Equal(stored.Key, newKey) {
+		return fmt.Errorf("RotateKey: key server did not store the new key of \"%s\", the next rotation will clean up", rec.UUID)
+	}
+	fmt.Fprintf(progressOut, "Removing the old key from slot %d of \"%s\"...\n", oldSlot, blkDev.Path)
+	if err := cryptKillSlot(newKey, blkDev.Path, oldSlot); err != nil {
+		return fmt.Errorf("RotateKey: the new key is in use, but the old key slot remains and the next rotation will clean up - %v", err)
+	}
+	if err := RemoveKeyRotationState(stateDir, rec.UUID); err != nil {
+		return fmt.Errorf("RotateKey: %v", err)
+	}
+	refreshRotatedRecord(progressOut, stored, tpmPCRs)
+	fmt.Fprintf(progressOut, "The encryption key of \"%s\" (%s) has been rotated successfully.\n", blkDev.Path, rec.UUID)
+	return nil
+}
+
+/*
+ApplyKeyRotation carries out the rotation of the device's key that the key server has started: the new key is added to
+a free key slot unless the encryption header carries it already, the key slot of the previous key is removed, and the
+key server is told that the rotation is complete. A step that has been done already, by an interrupted attempt or by
+another computer sharing the disk, is skipped, so that the rotation may be carried out any number of times. If the key
+server is not waiting for a rotation, the device must unlock by the current key. The sealed and Tang copies of the
+record are refreshed as RotateKey does.
+*/
+func ApplyKeyRotation(progressOut io.Writer, client *keyserv.CryptClient, password, deviceID, tpmPCRs string) error {
+	blkDevs := getBlockDevices()
+	blkDev, _, err := blkDevs.ResolveDeviceID(deviceID)
+	if err != nil {
+		return fmt.Errorf("ApplyKeyRotation: cannot find a block device corresponding to \"%s\" - %v", deviceID, err)
+	} else if !blkDev.IsLUKSEncrypted() {
+		return fmt.Errorf("ApplyKeyRotation: \"%s\" is not an encrypted disk", blkDev.Path)
+	}
+	rec, err := retrieveCurrentKey(client, password, recordIDCandidates(blkDevs, deviceID))
+	if err != nil {
+		return fmt.Errorf("ApplyKeyRotation: failed to retrieve the current key - %v", err)
+	}
+	defer rec.Key.Wipe()
+	defer rec.PreviousKey.Wipe()
+	return applyKeyRotation(progressOut, client, password, rec, blkDev.Path, tpmPCRs)
+}
+
+// Bring the encryption header of the device to the record's key and confirm the rotation to key server.
+func applyKeyRotation(progressOut io.Writer, client *keyserv.CryptClient, password string, rec keydb.Record, dev, tpmPCRs string) error {
+	if !rec.IsKeyRotationPending() {
+		if _, err := cryptKeySlotOf(rec.Key, dev); err != nil {
+			return fmt.Errorf("ApplyKeyRotation: the key on server does not unlock \"%s\" - %v", dev, err)
+		}
+		refreshRotatedRecord(progressOut, rec, tpmPCRs)
+		fmt.Fprintf(progressOut, "The encryption key of \"%s\" (%s) has already been rotated.\n", dev, rec.UUID)
+		return nil
+	}
+	if _, err := cryptKeySlotOf(rec.Key, dev); err != nil {
+		active, err := cryptActiveKeySlots(dev)
+		if err != nil {
+			return fmt.Errorf("ApplyKeyRotation: %v", err)
+		}
+		newSlot := freeKeySlot(active)
+		if newSlot == -1 {
+			return fmt.Errorf("ApplyKeyRotation: all key slots of \"%s\" are in use, please remove an unused one", dev)
+		}
+		fmt.Fprintf(progressOut, "Adding the new key to slot %d of \"%s\"...\n", newSlot, dev)
+		if err := cryptAddKey(rec.PreviousKey, rec.Key, dev, newSlot); err != nil {
+			return fmt.Errorf("ApplyKeyRotation: %v", err)
+		}
+		if slot, err := cryptKeySlotOf(rec.Key, dev); err != nil || slot != newSlot {
+			return fmt.Errorf("ApplyKeyRotation: the new key does not unlock slot %d of \"%s\" (%d) - %v", newSlot, dev, slot, err)
+		}
+	}
+	if oldSlot, err := cryptKeySlotOf(rec.PreviousKey, dev); err == nil {
+		fmt.Fprintf(progressOut, "Removing the old key from slot %d of \"%s\"...\n", oldSlot, dev)
+		if err := cryptKillSlot(rec.Key, dev, oldSlot); err != nil {
+			// Another computer sharing the disk may have removed the slot in the meantime
+			if _, stillThere := cryptKeySlotOf(rec.PreviousKey, dev); stillThere == nil {
+				return fmt.Errorf("ApplyKeyRotation: the new key is in use, but the old key slot remains and the next rotation will clean up - %v", err)
+			}
+		}
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	newDigest := sha256.Sum256(rec.Key)
+	if err := client.ConfirmKeyRotation(keyserv.ConfirmKeyRotationReq{
+		PlainPassword: password,
+		Hostname:      hostname,
+		UUID:          rec.UUID,
+		KeyDigest:     newDigest[:],
+	}); err != nil {
+		return fmt.Errorf("ApplyKeyRotation: the disk carries the new key only, but key server has not learnt of it yet - %v", err)
+	}
+	rec.PreviousKey = nil
+	refreshRotatedRecord(progressOut, rec, tpmPCRs)
+	fmt.Fprintf(progressOut, "The encryption key of \"%s\" (%s) has been rotated successfully.\n", dev, rec.UUID)
+	return nil
+}
@@ -0,0 +1,198 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyRotationState(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	stateDir := path.Join(tmpDir, "key-rotation")
+	if _, found, err := ReadKeyRotationState(stateDir, "abc"); found || err != nil {
+		t.Fatal(found, err)
+	}
+	state := KeyRotationState{UUID: "abc", Device: "/dev/sdb1", OldSlot: 0, NewSlot: 1, Started: time.Unix(1500000000, 0)}
+	if err := WriteKeyRotationState(stateDir, state); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path.Join(stateDir, "abc.json")); err != nil || st.Mode().Perm() != KeyRotationStateMode {
+		t.Fatal(err, st)
+	}
+	read, found, err := ReadKeyRotationState(stateDir, "abc")
+	if !found || err != nil || read.Device != "/dev/sdb1" || read.OldSlot != 0 || read.NewSlot != 1 || !read.Started.Equal(state.Started) {
+		t.Fatal(read, found, err)
+	}
+	if err := RemoveKeyRotationState(stateDir, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveKeyRotationState(stateDir, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := ReadKeyRotationState(stateDir, "abc"); found || err != nil {
+		t.Fatal(found, err)
+	}
+	// A damaged state file must not be mistaken for the lack of one
+	if err := ioutil.WriteFile(path.Join(stateDir, "abc.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadKeyRotationState(stateDir, "abc"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestFreeKeySlot(t *testing.T) {
+	if slot := freeKeySlot([]int{}); slot != 0 {
+		t.Fatal(slot)
+	}
+	if slot := freeKeySlot([]int{0, 1, 3}); slot != 2 {
+		t.Fatal(slot)
+	}
+	if slot := freeKeySlot([]int{0, 1, 2, 3, 4, 5, 6, 7}); slot != -1 {
+		t.Fatal(slot)
+	}
+}
+
+// Simulate the key slots of an encryption header by the key each of them carries.
+func fakeKeySlots(t *testing.T, slots map[int]string) {
+	cryptKeySlotOf = func(key []byte, blockDev string) (int, error) {
+		for slot, slotKey := range slots {
+			if slotKey == string(key) {
+				return slot, nil
+			}
+		}
+		return -1, errors.New("no key slot matches the key")
+	}
+	cryptActiveKeySlots = func(blockDev string) ([]int, error) {
+		active := make([]int, 0, len(slots))
+		for slot := range slots {
+			active = append(active, slot)
+		}
+		return active, nil
+	}
+	cryptAddKey = func(existingKey, newKey []byte, blockDev string, slot int) error {
+		if _, err := cryptKeySlotOf(existingKey, blockDev); err != nil {
+			return err
+		}
+		slots[slot] = string(newKey)
+		return nil
+	}
+	cryptKillSlot = func(key []byte, blockDev string, slot int) error {
+		if _, err := cryptKeySlotOf(key, blockDev); err != nil {
+			return err
+		}
+		delete(slots, slot)
+		return nil
+	}
+	t.Cleanup(func() {
+		cryptKeySlotOf, cryptActiveKeySlots, cryptAddKey, cryptKillSlot = fs.CryptKeySlotOf, fs.CryptActiveKeySlots, fs.CryptAddKey, fs.CryptKillSlot
+	})
+}
+
+func TestApplyKeyRotation(t *testing.T) {
+	client, server, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	fakeUnlockFS(t, 0)
+	oldKey, newKey, newerKey := bytes.Repeat([]byte{1}, 64), bytes.Repeat([]byte{2}, 64), bytes.Repeat([]byte{3}, 64)
+	if _, err := server.KeyDB.Upsert(keydb.Record{UUID: "fakeuuid", Key: oldKey, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	slots := map[int]string{0: string(oldKey)}
+	fakeKeySlots(t, slots)
+	var out bytes.Buffer
+	// Without a rotation started by the server, the current key must unlock the disk
+	if err := ApplyKeyRotation(&out, client, "", "fakeuuid", ""); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if _, err := server.KeyDB.StartKeyRotation("fakeuuid", newKey); err != nil {
+		t.Fatal(err)
+	}
+	// The disk still unlocks by the previous key while the rotation is pending
+	rec, _ := server.KeyDB.GetByUUID("fakeuuid")
+	cryptOpen = func(key sys.SecureBytes, blockDev, name string) error {
+		if !bytes.Equal(key, oldKey) {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	if err := cryptOpenByKey(rec, "/dev/fake1", "fake"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyKeyRotation(&out, client, "", "fakeuuid", ""); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if !reflect.DeepEqual(slots, map[int]string{1: string(newKey)}) {
+		t.Fatal(slots)
+	}
+	if rec, _ := server.KeyDB.GetByUUID("fakeuuid"); rec.IsKeyRotationPending() || !bytes.Equal(rec.Key, newKey) {
+		t.Fatalf("%+v", rec)
+	}
+	// Another computer sharing the disk finds the rotation done already
+	if err := ApplyKeyRotation(&out, client, "", "fakeuuid", ""); err != nil || !reflect.DeepEqual(slots, map[int]string{1: string(newKey)}) {
+		t.Fatal(err, slots)
+	}
+	// A computer that rotated the disk without confirming it leaves the confirmation to the next one
+	if _, err := server.KeyDB.StartKeyRotation("fakeuuid", newerKey); err != nil {
+		t.Fatal(err)
+	}
+	slots[0] = string(newerKey)
+	delete(slots, 1)
+	if err := ApplyKeyRotation(&out, client, "", "fakeuuid", ""); err != nil || !reflect.DeepEqual(slots, map[int]string{0: string(newerKey)}) {
+		t.Fatal(err, slots)
+	}
+	if rec, _ := server.KeyDB.GetByUUID("fakeuuid"); rec.IsKeyRotationPending() {
+		t.Fatalf("%+v", rec)
+	}
+	// Rotate-key on the client carries out the rotation started by the server instead of starting its own
+	if _, err := server.KeyDB.StartKeyRotation("fakeuuid", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := RotateKey(&out, client, "", "fakeuuid", t.TempDir(), ""); err != nil || !reflect.DeepEqual(slots, map[int]string{1: string(oldKey)}) {
+		t.Fatal(err, slots, out.String())
+	}
+}
+
+func TestRotateKeyRemovesSealedRecord(t *testing.T) {
+	client, server, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	fakeUnlockFS(t, 0)
+	oldKey := bytes.Repeat([]byte{1}, 64)
+	if _, err := server.KeyDB.Upsert(keydb.Record{UUID: "fakeuuid", Key: oldKey, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	slots := map[int]string{0: string(oldKey)}
+	fakeKeySlots(t, slots)
+	origSealDir := tpm2SealDir
+	tpm2SealDir = t.TempDir()
+	defer func() { tpm2SealDir = origSealDir }()
+	if err := ioutil.WriteFile(sealedRecordPath(tpm2SealDir, "fakeuuid"), []byte("sealed old key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := RotateKey(&out, client, "", "fakeuuid", t.TempDir(), ""); err != nil {
+		t.Fatal(err, out.String())
+	}
+	rec, _ := server.KeyDB.GetByUUID("fakeuuid")
+	if !reflect.DeepEqual(slots, map[int]string{1: string(rec.Key)}) || bytes.Equal(rec.Key, oldKey) {
+		t.Fatal(slots)
+	}
+	// The sealed copy carries the replaced key, and cannot be renewed without TPM2 PCRs
+	if HasSealedRecord(tpm2SealDir, []string{"fakeuuid"}) {
+		t.Fatal("sealed record remains")
+	}
+}
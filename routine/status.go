@@ -0,0 +1,295 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/sys"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	CLIENT_STATUS_SOCKET     = "/run/cryptctl2-client-status" // CLIENT_STATUS_SOCKET is the unix domain socket where the client daemon answers status queries.
+	CLIENT_CONF_STATUS_GROUP = "STATUS_SOCKET_GROUP"          // CLIENT_CONF_STATUS_GROUP is the group that may query the status socket besides root.
+	UNLOCK_STATE_DIR         = "/run/cryptctl2/unlock"        // UNLOCK_STATE_DIR is where auto-unlock records the progress of the devices it unlocks.
+	StatusQueryTimeout       = 5 * time.Second                // StatusQueryTimeout limits the time a status query may take, on both ends.
+	StatusQuery              = "status"                       // StatusQuery asks the client daemon for the client status.
+)
+
+// States of a device in the client status.
+const (
+	DeviceLocked    = "locked"    // DeviceLocked is an encrypted device that is not unlocked.
+	DeviceUnlocking = "unlocking" // DeviceUnlocking is a device whose key auto-unlock is retrieving from key server.
+	DeviceUnlocked  = "unlocked"  // DeviceUnlocked is a device that has an unlocked crypt device.
+	DeviceError     = "error"     // DeviceError is a device that auto-unlock has failed to unlock.
+)
+
+/*
+UnlockProgress is the state of a device that auto-unlock is unlocking, it is kept in the unlock state directory so
+that the client daemon can report it. The progress is cleared once the device is unlocked.
+*/
+type UnlockProgress struct {
+	DeviceID string    `json:"device_id"` // DeviceID is the device as it was given to auto-unlock.
+	State    string    `json:"state"`     // State is either DeviceUnlocking or DeviceError.
+	Error    string    `json:"error"`     // Error is the most recent failure, empty if there is none yet.
+	PID      int       `json:"pid"`       // PID is the auto-unlock process, an unlocking device whose process is gone is cleared.
+	Time     time.Time `json:"time"`      // Time is the moment the progress was recorded.
+}
+
+// Return the path of the file that records the unlock progress of the device.
+func unlockProgressPath(stateDir, deviceID string) string {
+	return path.Join(stateDir, url.PathEscape(deviceID)+".json")
+}
+
+// RecordUnlockProgress saves the unlock progress of the device into the state directory.
+func RecordUnlockProgress(stateDir string, progress UnlockProgress) error {
+	if err := sys.MkdirSecure(stateDir); err != nil {
+		return err
+	}
+	progress.Time = time.Now()
+	content, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("RecordUnlockProgress: failed to serialise unlock progress - %v", err)
+	}
+	return sys.ReplaceFile(unlockProgressPath(stateDir, progress.DeviceID), content, sys.SecureFileMode, false)
+}
+
+// ClearUnlockProgress removes the unlock progress of the device, it is not an error if there is none.
+func ClearUnlockProgress(stateDir, deviceID string) error {
+	if err := os.Remove(unlockProgressPath(stateDir, deviceID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ClearUnlockProgress: failed to clear progress of \"%s\" - %v", deviceID, err)
+	}
+	return nil
+}
+
+/*
+ListUnlockProgress returns the unlock progress recorded in the state directory. The devices still being unlocked by a
+process that is gone are cleared, and the files that cannot be read are skipped.
+*/
+func ListUnlockProgress(stateDir string) ([]UnlockProgress, error) {
+	entries, err := ioutil.ReadDir(stateDir)
+	if os.IsNotExist(err) {
+		return []UnlockProgress{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ListUnlockProgress: failed to read directory \"%s\" - %v", stateDir, err)
+	}
+	progresses := make([]UnlockProgress, 0, len(entries))
+	for _, entry := range entries {
+		// Skip the temporary files of sys.ReplaceFile
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(stateDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var progress UnlockProgress
+		if err := json.Unmarshal(content, &progress); err != nil || progress.DeviceID == "" {
+			continue
+		}
+		if progress.State == DeviceUnlocking && progress.PID > 0 && syscall.Kill(progress.PID, 0) == syscall.ESRCH {
+			ClearUnlockProgress(stateDir, progress.DeviceID)
+			continue
+		}
+		progresses = append(progresses, progress)
+	}
+	return progresses, nil
+}
+
+// DeviceStatus is the state of an encrypted device on this computer.
+type DeviceStatus struct {
+	UUID       string `json:"uuid"`        // UUID is the stable ID of the device (see fs.BlockDevice.CanonicalID).
+	MapperName string `json:"mapper_name"` // MapperName is the name of the unlocked crypt device, empty if locked.
+	MountPoint string `json:"mount_point"` // MountPoint is where the unlocked crypt device is mounted, empty if not mounted.
+	State      string `json:"state"`       // State is one of Device* constants.
+	LastError  string `json:"last_error"`  // LastError is the most recent failure of unlocking or of the unlocked disk.
+}
+
+/*
+CollectDeviceStatus returns the state of each LUKS device among the block devices, sorted by UUID. An unlocked device
+is unlocked regardless of the unlock progress, and the health of a held disk is its last error. Devices that auto-unlock
+is working on but that are not found among the block devices are included too.
+*/
+func CollectDeviceStatus(blkDevs fs.BlockDevices, held []HeldDisk, progresses []UnlockProgress) []DeviceStatus {
+	statuses := make([]DeviceStatus, 0, 8)
+	known := make(map[string]bool)
+	for _, dev := range blkDevs {
+		if !dev.IsLUKSEncrypted() {
+			continue
+		}
+		status := DeviceStatus{UUID: dev.CanonicalID(), State: DeviceLocked}
+		if status.UUID == "" {
+			status.UUID = dev.Path
+		}
+		if cryptDev, found := blkDevs.GetByCriteria("", "", "crypt", "", "", dev.Name, ""); found {
+			status.MapperName = path.Base(cryptDev.Path)
+			status.MountPoint = cryptDev.MountPoint
+			status.State = DeviceUnlocked
+		}
+		ids := dev.DeviceIDs()
+		for _, disk := range held {
+			if disk.UUID != "" && containsString(ids, disk.UUID) {
+				status.State = DeviceUnlocked
+				status.LastError = disk.Health
+			}
+		}
+		for _, progress := range progresses {
+			if progressDev, _, err := blkDevs.ResolveDeviceID(progress.DeviceID); err != nil || progressDev.Path != dev.Path {
+				continue
+			}
+			known[progress.DeviceID] = true
+			if status.State != DeviceUnlocked {
+				status.State = progress.State
+				status.LastError = progress.Error
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	for _, progress := range progresses {
+		if !known[progress.DeviceID] {
+			statuses = append(statuses, DeviceStatus{UUID: progress.DeviceID, State: progress.State, LastError: progress.Error})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].UUID < statuses[j].UUID })
+	return statuses
+}
+
+// Return true if the string is among the slice.
+func containsString(slice []string, str string) bool {
+	for _, s := range slice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientStatus is the answer of the client daemon to a status query.
+type ClientStatus struct {
+	Time              time.Time      `json:"time"`                // Time is the moment the status was collected.
+	Server            string         `json:"server"`              // Server is the address of key server.
+	ServerReachable   bool           `json:"server_reachable"`    // ServerReachable is true if the most recent request to key server succeeded.
+	LastServerContact time.Time      `json:"last_server_contact"` // LastServerContact is the moment of the most recent successful request to key server.
+	ServerError       string         `json:"server_error"`        // ServerError is the failure of the most recent request to key server.
+	LastAliveReport   time.Time      `json:"last_alive_report"`   // LastAliveReport is the moment of the most recent successful alive report.
+	AliveReportError  string         `json:"alive_report_error"`  // AliveReportError is the failure of the most recent alive report.
+	Devices           []DeviceStatus `json:"devices"`             // Devices are the encrypted devices on this computer.
+}
+
+// StatusRequest is the query sent to the status socket, a single JSON object per connection.
+type StatusRequest struct {
+	Query string `json:"query"` // Query is StatusQuery.
+}
+
+// StatusResponse is the answer sent back through the status socket, a single JSON object per connection.
+type StatusResponse struct {
+	Status *ClientStatus `json:"status,omitempty"` // Status answers StatusQuery.
+	Error  string        `json:"error,omitempty"`  // Error tells why the query could not be answered.
+}
+
+/*
+StatusServer answers status queries on a unix domain socket. The status is collected by the function for each query,
+the function must not wait for key server, so that the queries are answered even while key server is unreachable.
+*/
+type StatusServer struct {
+	Listener net.Listener
+	Status   func() ClientStatus
+}
+
+/*
+ListenStatus starts listening on the unix domain socket, which only root may use, or also the group if its ID is not
+negative.
+*/
+func ListenStatus(socketPath string, gid int, status func() ClientStatus) (*StatusServer, error) {
+	if err := os.RemoveAll(socketPath); err != nil {
+		return nil, fmt.Errorf("ListenStatus: failed to remove old socket - %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("ListenStatus: failed to listen on %s - %v", socketPath, err)
+	}
+	mode := sys.SecureFileMode
+	if gid >= 0 {
+		if err := os.Chown(socketPath, -1, gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("ListenStatus: failed to change group of %s - %v", socketPath, err)
+		}
+		mode = 0660
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("ListenStatus: failed to change permission of %s - %v", socketPath, err)
+	}
+	return &StatusServer{Listener: listener, Status: status}, nil
+}
+
+// Serve answers the queries of each connection in a continuous loop. Blocks caller until listener closes.
+func (srv *StatusServer) Serve() {
+	for {
+		conn, err := srv.Listener.Accept()
+		if err != nil {
+			log.Printf("StatusServer.Serve: quit now - %v", err)
+			return
+		}
+		go srv.answer(conn)
+	}
+}
+
+// Answer the query of the connection and close it.
+func (srv *StatusServer) answer(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(StatusQueryTimeout))
+	var req StatusRequest
+	var resp StatusResponse
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("failed to read the query - %v", err)
+	} else if req.Query == StatusQuery {
+		status := srv.Status()
+		resp.Status = &status
+	} else {
+		resp.Error = fmt.Sprintf("query \"%s\" is not supported", req.Query)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("StatusServer.answer: failed to send the answer - %v", err)
+	}
+}
+
+// Close stops listening and removes the socket.
+func (srv *StatusServer) Close() error {
+	return srv.Listener.Close()
+}
+
+// QueryClientStatus asks the client daemon listening on the unix domain socket for the client status.
+func QueryClientStatus(socketPath string) (status ClientStatus, err error) {
+	conn, err := net.DialTimeout("unix", socketPath, StatusQueryTimeout)
+	if err != nil {
+		return status, fmt.Errorf("QueryClientStatus: failed to connect to client daemon, is it running? - %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(StatusQueryTimeout))
+	if err := json.NewEncoder(conn).Encode(StatusRequest{Query: StatusQuery}); err != nil {
+		return status, fmt.Errorf("QueryClientStatus: failed to send the query - %v", err)
+	}
+	var resp StatusResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return status, fmt.Errorf("QueryClientStatus: failed to read the answer - %v", err)
+	}
+	if resp.Error != "" {
+		return status, errors.New("QueryClientStatus: " + resp.Error)
+	} else if resp.Status == nil {
+		return status, errors.New("QueryClientStatus: the answer does not carry the status")
+	}
+	return *resp.Status, nil
+}
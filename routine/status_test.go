@@ -0,0 +1,115 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnlockProgress(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if progresses, err := ListUnlockProgress(tmpDir + "/does-not-exist"); err != nil || len(progresses) != 0 {
+		t.Fatal(progresses, err)
+	}
+	if err := RecordUnlockProgress(tmpDir, UnlockProgress{DeviceID: "LABEL:data", State: DeviceUnlocking, PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+	// The process unlocking this device is long gone, but a failure is kept
+	if err := RecordUnlockProgress(tmpDir, UnlockProgress{DeviceID: "gone", State: DeviceUnlocking, PID: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordUnlockProgress(tmpDir, UnlockProgress{DeviceID: "failed", State: DeviceError, Error: "no key", PID: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	progresses, err := ListUnlockProgress(tmpDir)
+	if err != nil || len(progresses) != 2 {
+		t.Fatal(progresses, err)
+	}
+	if err := ClearUnlockProgress(tmpDir, "LABEL:data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearUnlockProgress(tmpDir, "LABEL:data"); err != nil {
+		t.Fatal(err)
+	}
+	if progresses, err := ListUnlockProgress(tmpDir); err != nil || len(progresses) != 1 || progresses[0].DeviceID != "failed" {
+		t.Fatal(progresses, err)
+	}
+}
+
+func TestCollectDeviceStatus(t *testing.T) {
+	blkDevs := fs.BlockDevices{
+		{UUID: "aaa", Name: "sda1", Path: "/dev/sda1", FileSystem: "crypto_LUKS"},
+		{Name: "data", Path: "/dev/mapper/data", Type: "crypt", PKName: "sda1", MountPoint: "/data"},
+		{UUID: "bbb", Name: "sdb1", Path: "/dev/sdb1", FileSystem: "crypto_LUKS", Label: "backup"},
+		{UUID: "ccc", Name: "sdc1", Path: "/dev/sdc1", FileSystem: "crypto_LUKS"},
+		{UUID: "ddd", Name: "sdd1", Path: "/dev/sdd1", FileSystem: "ext4"},
+	}
+	held := []HeldDisk{{UUID: "aaa", Health: "bind-mount failed"}}
+	progresses := []UnlockProgress{
+		{DeviceID: "aaa", State: DeviceError, Error: "stale"},
+		{DeviceID: "LABEL:backup", State: DeviceUnlocking, Error: "connection refused"},
+		{DeviceID: "eee", State: DeviceError, Error: "no such device"},
+	}
+	statuses := CollectDeviceStatus(blkDevs, held, progresses)
+	expected := []DeviceStatus{
+		{UUID: "aaa", MapperName: "data", MountPoint: "/data", State: DeviceUnlocked, LastError: "bind-mount failed"},
+		{UUID: "bbb", State: DeviceUnlocking, LastError: "connection refused"},
+		{UUID: "ccc", State: DeviceLocked},
+		{UUID: "eee", State: DeviceError, LastError: "no such device"},
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("%+v", statuses)
+	}
+}
+
+func TestStatusServer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := path.Join(tmpDir, "status")
+	// Status is answered without waiting for anything else
+	srv, err := ListenStatus(socketPath, -1, func() ClientStatus {
+		return ClientStatus{Server: "localhost:3737", Devices: []DeviceStatus{{UUID: "aaa", State: DeviceLocked}}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go srv.Serve()
+	if info, err := os.Stat(socketPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(info, err)
+	}
+	status, err := QueryClientStatus(socketPath)
+	if err != nil || status.Server != "localhost:3737" || len(status.Devices) != 1 || status.Devices[0].State != DeviceLocked {
+		t.Fatal(status, err)
+	}
+	// Unknown queries are refused
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(`{"query": "shutdown"}`)); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil || string(answer) != `{"error":"query \"shutdown\" is not supported"}`+"\n" {
+		t.Fatal(string(answer), err)
+	}
+	if _, err := QueryClientStatus(path.Join(tmpDir, "does-not-exist")); err == nil {
+		t.Fatal("did not error")
+	}
+}
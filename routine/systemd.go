@@ -0,0 +1,263 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	SYSTEMD_UNIT_DIR           = "/etc/systemd/system"
+	SYSTEMD_UNLOCK_UNIT_PREFIX = "cryptctl2-unlock@"
+	SYSTEMD_UNIT_MARKER        = "# Generated by cryptctl2 generate-systemd-units, checksum "
+	SystemdUnitFileMode        = 0644 // SystemdUnitFileMode is the permission of generated unit files.
+)
+
+// SystemdUnit is a generated unit file.
+type SystemdUnit struct {
+	Name    string // Name is the unit file name, e.g. "cryptctl2-unlock@data.service".
+	Content string // Content is the complete unit file content, including the marker line.
+}
+
+// Return the checksum of unit content (without marker) that goes into the marker line.
+func systemdUnitChecksum(body string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body)))
+}
+
+// Escape percent signs so that systemd does not expand specifiers (e.g. "%i") in the text.
+func systemdEscapeSpecifiers(text string) string {
+	return strings.Replace(text, "%", "%%", -1)
+}
+
+// Quote a command line argument for ExecStart, so that systemd neither splits it nor expands specifiers in it.
+func systemdQuoteArg(arg string) string {
+	arg = strings.Replace(arg, "\\", "\\\\", -1)
+	arg = strings.Replace(arg, "\"", "\\\"", -1)
+	return "\"" + systemdEscapeSpecifiers(arg) + "\""
+}
+
+/*
+MakeSystemdUnlockUnit generates the unit file that unlocks the disk of the record by running auto-unlock. The unit is
+named after the device mapper name, and if the record has a mount point, it is ordered before and required by the
+mount unit of the mount point. The unit only becomes active once the disk is unlocked, as auto-unlock notifies
+systemd, and it does not time out before auto-unlock gives up. If retry settings are given, they are handed to
+auto-unlock, otherwise auto-unlock retries according to the client configuration.
+*/
+func MakeSystemdUnlockUnit(rec keydb.Record, dmName string, retry *UnlockRetry) SystemdUnit {
+	var body bytes.Buffer
+	mountUnit := ""
+	if rec.MountPoint != "" {
+		mountUnit = fs.GetSystemdMountNameForDir(rec.MountPoint)
+		fmt.Fprintf(&body, "[Unit]\nDescription=Disk encryption utility (cryptctl2) - unlock disk %s and mount it on %s\n",
+			systemdEscapeSpecifiers(rec.UUID), systemdEscapeSpecifiers(rec.MountPoint))
+	} else {
+		fmt.Fprintf(&body, "[Unit]\nDescription=Disk encryption utility (cryptctl2) - unlock disk %s\n", systemdEscapeSpecifiers(rec.UUID))
+	}
+	body.WriteString("After=network-online.target\nWants=network-online.target\n")
+	if mountUnit != "" {
+		fmt.Fprintf(&body, "Before=%s\n", mountUnit)
+	}
+	body.WriteString("\n[Service]\nType=notify\nNotifyAccess=main\n")
+	fmt.Fprintf(&body, "ExecStart=/usr/sbin/cryptctl2 --action auto-unlock --deviceID %s", systemdQuoteArg(rec.UUID))
+	if retry != nil {
+		fmt.Fprintf(&body, " --maxRetrySec %d --retryIntervalSec %d", retry.MaxRetrySec, retry.interval())
+	}
+	body.WriteString("\n")
+	body.WriteString("User=root\nGroup=root\nWorkingDirectory=/\nTimeoutStartSec=infinity\n")
+	body.WriteString("\n[Install]\n")
+	if mountUnit != "" {
+		fmt.Fprintf(&body, "RequiredBy=%s\n", mountUnit)
+	} else {
+		body.WriteString("WantedBy=multi-user.target\n")
+	}
+	return SystemdUnit{
+		Name:    SYSTEMD_UNLOCK_UNIT_PREFIX + fs.SystemdEscape(dmName) + ".service",
+		Content: SYSTEMD_UNIT_MARKER + systemdUnitChecksum(body.String()) + "\n" + body.String(),
+	}
+}
+
+// IsGeneratedSystemdUnit returns true only if the unit content was generated by cryptctl2 and has not been edited since.
+func IsGeneratedSystemdUnit(content string) bool {
+	newline := strings.IndexByte(content, '\n')
+	if newline == -1 || !strings.HasPrefix(content, SYSTEMD_UNIT_MARKER) {
+		return false
+	}
+	return content[len(SYSTEMD_UNIT_MARKER):newline] == systemdUnitChecksum(content[newline+1:])
+}
+
+/*
+WriteSystemdUnit writes the unit file into the directory. An existing unit file is only overwritten if it was generated
+by cryptctl2 and left unchanged since, or if force is true. Return true if the file has been written, or false if the
+existing file already has the same content.
+*/
+func WriteSystemdUnit(unitDir string, unit SystemdUnit, force bool) (written bool, err error) {
+	unitPath := path.Join(unitDir, unit.Name)
+	existing, err := ioutil.ReadFile(unitPath)
+	if err == nil {
+		if string(existing) == unit.Content {
+			return false, nil
+		} else if !force && !IsGeneratedSystemdUnit(string(existing)) {
+			return false, fmt.Errorf("WriteSystemdUnit: \"%s\" has been edited by hand, use -force to overwrite it", unitPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("WriteSystemdUnit: failed to read \"%s\" - %v", unitPath, err)
+	}
+	if err := sys.ReplaceFile(unitPath, []byte(unit.Content), SystemdUnitFileMode, true); err != nil {
+		return false, fmt.Errorf("WriteSystemdUnit: %v", err)
+	}
+	return true, nil
+}
+
+/*
+Return true if the record or the crypt device opened from the block device carries the root file system, which can only
+be unlocked in the initrd.
+*/
+func isRootDisk(allDevs fs.BlockDevices, blkDev fs.BlockDevice, rec keydb.Record) bool {
+	if rec.MountPoint != "" && path.Clean(rec.MountPoint) == "/" {
+		return true
+	}
+	cryptDev, found := allDevs.GetByCriteria("", "", "crypt", "", "", blkDev.Name, "")
+	return found && cryptDev.MountPoint == "/"
+}
+
+/*
+GenerateSystemdUnlockUnits writes an unlock unit into the directory for each block device on this computer that has a
+key record, or only for the device if an ID is given. Return the names of the units that are now in place, including
+those that were already up to date. Units that cannot be written are reported and skipped, and an error is returned
+at the end. The root file system is skipped too, as the units run long after it has to be mounted.
+*/
+func GenerateSystemdUnlockUnits(progressOut io.Writer, client *keyserv.CryptClient, password, deviceID, unitDir string, force bool, retry *UnlockRetry) (unitNames []string, err error) {
+	allDevs := getBlockDevices()
+	blkDevs := allDevs
+	if deviceID != "" {
+		blkDev, _, err := allDevs.ResolveDeviceID(deviceID)
+		if err != nil {
+			return nil, fmt.Errorf("GenerateSystemdUnlockUnits: cannot find a block device corresponding to \"%s\" - %v", deviceID, err)
+		}
+		blkDevs = fs.BlockDevices{blkDev}
+	}
+	// Ask for the records of all devices at once, a record may be kept under any of the device IDs.
+	ids := make([]string, 0, len(blkDevs))
+	for _, blkDev := range blkDevs {
+		for _, id := range blkDev.DeviceIDs() {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.GetRecordInfo(keyserv.GetRecordInfoReq{PlainPassword: password, Hostname: hostname, UUIDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	unitNames = make([]string, 0, len(resp.Records))
+	numFailures := 0
+	for _, blkDev := range blkDevs {
+		rec, found := firstGranted(resp.Records, blkDev.DeviceIDs())
+		if !found {
+			continue
+		}
+		if isRootDisk(allDevs, blkDev, rec) {
+			fmt.Fprintf(progressOut, "Skipped disk %s (%s) because it carries the root file system, use generate-initrd-config for it instead\n", blkDev.Path, rec.UUID)
+			numFailures++
+			continue
+		}
+		dmName := rec.MappedName
+		if dmName == "" {
+			dmName = MakeDeviceMapperName(blkDev.Path)
+		}
+		unit := MakeSystemdUnlockUnit(rec, dmName, retry)
+		written, err := WriteSystemdUnit(unitDir, unit, force)
+		if err != nil {
+			fmt.Fprintf(progressOut, "Skipped %s for disk %s - %v\n", unit.Name, blkDev.Path, err)
+			numFailures++
+			continue
+		} else if written {
+			fmt.Fprintf(progressOut, "Wrote %s for disk %s (%s)\n", path.Join(unitDir, unit.Name), blkDev.Path, rec.UUID)
+		} else {
+			fmt.Fprintf(progressOut, "%s for disk %s (%s) is up to date\n", path.Join(unitDir, unit.Name), blkDev.Path, rec.UUID)
+		}
+		unitNames = append(unitNames, unit.Name)
+	}
+	if deviceID != "" && len(unitNames) == 0 && numFailures == 0 {
+		return nil, fmt.Errorf("GenerateSystemdUnlockUnits: key server does not have a record for \"%s\"", deviceID)
+	} else if numFailures > 0 {
+		return unitNames, fmt.Errorf("GenerateSystemdUnlockUnits: %d units could not be written", numFailures)
+	}
+	return unitNames, nil
+}
+
+/*
+RemoveSystemdUnlockUnits removes the unlock units generated in the directory for the device, or all of them if the ID
+is empty. The unit is found by the device IDs its auto-unlock is given, so the key server is not needed. A unit that has
+been edited by hand is only removed if force is true. If disable is given, it is called for each unit before the unit
+file is removed, a failure leaves the unit in place. Return the names of the removed units.
+*/
+func RemoveSystemdUnlockUnits(progressOut io.Writer, deviceID, unitDir string, force bool, disable func(unitName string) error) (unitNames []string, err error) {
+	var deviceIDs []string
+	if deviceID != "" {
+		blkDev, _, err := getBlockDevices().ResolveDeviceID(deviceID)
+		if err != nil {
+			return nil, fmt.Errorf("RemoveSystemdUnlockUnits: cannot find a block device corresponding to \"%s\" - %v", deviceID, err)
+		}
+		deviceIDs = append(blkDev.DeviceIDs(), deviceID)
+	}
+	entries, err := ioutil.ReadDir(unitDir)
+	if err != nil {
+		return nil, fmt.Errorf("RemoveSystemdUnlockUnits: failed to read directory \"%s\" - %v", unitDir, err)
+	}
+	unitNames = make([]string, 0, 4)
+	numFailures := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), SYSTEMD_UNLOCK_UNIT_PREFIX) || !strings.HasSuffix(entry.Name(), ".service") {
+			continue
+		}
+		unitPath := path.Join(unitDir, entry.Name())
+		content, err := ioutil.ReadFile(unitPath)
+		if err != nil {
+			return unitNames, fmt.Errorf("RemoveSystemdUnlockUnits: failed to read \"%s\" - %v", unitPath, err)
+		}
+		matched := len(deviceIDs) == 0
+		for _, id := range deviceIDs {
+			if id != "" && strings.Contains(string(content), " --deviceID "+systemdQuoteArg(id)) {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		} else if !force && !IsGeneratedSystemdUnit(string(content)) {
+			fmt.Fprintf(progressOut, "Skipped %s because it has been edited by hand, use -force to remove it\n", unitPath)
+			numFailures++
+			continue
+		}
+		if disable != nil {
+			if err := disable(entry.Name()); err != nil {
+				fmt.Fprintf(progressOut, "Skipped %s - %v\n", unitPath, err)
+				numFailures++
+				continue
+			}
+		}
+		if err := os.Remove(unitPath); err != nil {
+			return unitNames, fmt.Errorf("RemoveSystemdUnlockUnits: %v", err)
+		}
+		fmt.Fprintf(progressOut, "Removed %s\n", unitPath)
+		unitNames = append(unitNames, entry.Name())
+	}
+	if deviceID != "" && len(unitNames) == 0 && numFailures == 0 {
+		return nil, fmt.Errorf("RemoveSystemdUnlockUnits: there is no unlock unit for \"%s\" in %s", deviceID, unitDir)
+	} else if numFailures > 0 {
+		return unitNames, fmt.Errorf("RemoveSystemdUnlockUnits: %d units were left in place", numFailures)
+	}
+	return unitNames, nil
+}
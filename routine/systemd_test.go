@@ -0,0 +1,147 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMakeSystemdUnlockUnit(t *testing.T) {
+	unit := MakeSystemdUnlockUnit(keydb.Record{UUID: "SERIAL:36001405%i", MountPoint: "/srv/my-data"}, "cryptctl2-unlocked-sdb1", nil)
+	if unit.Name != `cryptctl2-unlock@cryptctl2\x2dunlocked\x2dsdb1.service` {
+		t.Fatal(unit.Name)
+	}
+	for _, line := range []string{
+		"Before=srv-my\\x2ddata.mount\n",
+		"RequiredBy=srv-my\\x2ddata.mount\n",
+		"Type=notify\n",
+		"ExecStart=/usr/sbin/cryptctl2 --action auto-unlock --deviceID \"SERIAL:36001405%%i\"\n",
+		"Description=Disk encryption utility (cryptctl2) - unlock disk SERIAL:36001405%%i and mount it on /srv/my-data\n",
+	} {
+		if !strings.Contains(unit.Content, line) {
+			t.Fatal(line, unit.Content)
+		}
+	}
+	if !IsGeneratedSystemdUnit(unit.Content) {
+		t.Fatal("not recognised as generated")
+	}
+	// A disk without mount point is unlocked during boot
+	unit = MakeSystemdUnlockUnit(keydb.Record{UUID: "9edcdeb9-86bd-4602-be5d-7a45a29fefc0"}, "data", nil)
+	if unit.Name != "cryptctl2-unlock@data.service" || strings.Contains(unit.Content, "Before=") || !strings.Contains(unit.Content, "WantedBy=multi-user.target\n") {
+		t.Fatal(unit)
+	}
+}
+
+func TestWriteSystemdUnit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	unit := MakeSystemdUnlockUnit(keydb.Record{UUID: "9edcdeb9-86bd-4602-be5d-7a45a29fefc0", MountPoint: "/srv"}, "data", nil)
+	unitPath := path.Join(tmpDir, unit.Name)
+	if written, err := WriteSystemdUnit(tmpDir, unit, false); err != nil || !written {
+		t.Fatal(written, err)
+	}
+	if written, err := WriteSystemdUnit(tmpDir, unit, false); err != nil || written {
+		t.Fatal(written, err)
+	}
+	// A generated unit that has not been edited is overwritten
+	newUnit := MakeSystemdUnlockUnit(keydb.Record{UUID: "9edcdeb9-86bd-4602-be5d-7a45a29fefc0", MountPoint: "/srv/data"}, "data", nil)
+	if written, err := WriteSystemdUnit(tmpDir, newUnit, false); err != nil || !written {
+		t.Fatal(written, err)
+	}
+	// A unit that has been edited by hand is left alone unless forced
+	edited := strings.Replace(newUnit.Content, "TimeoutStartSec=infinity", "TimeoutStartSec=600", 1)
+	if err := ioutil.WriteFile(unitPath, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if IsGeneratedSystemdUnit(edited) {
+		t.Fatal("edit was not detected")
+	}
+	if written, err := WriteSystemdUnit(tmpDir, unit, false); err == nil || written {
+		t.Fatal(written, err)
+	}
+	if content, err := ioutil.ReadFile(unitPath); err != nil || string(content) != edited {
+		t.Fatal(err, string(content))
+	}
+	if written, err := WriteSystemdUnit(tmpDir, unit, true); err != nil || !written {
+		t.Fatal(written, err)
+	}
+	if content, err := ioutil.ReadFile(unitPath); err != nil || string(content) != unit.Content {
+		t.Fatal(err, string(content))
+	}
+}
+
+func TestMakeSystemdUnlockUnit_Retry(t *testing.T) {
+	unit := MakeSystemdUnlockUnit(keydb.Record{UUID: "9edcdeb9-86bd-4602-be5d-7a45a29fefc0"}, "data", &UnlockRetry{MaxRetrySec: 600})
+	if !strings.Contains(unit.Content, "--deviceID \"9edcdeb9-86bd-4602-be5d-7a45a29fefc0\" --maxRetrySec 600 --retryIntervalSec 5\n") {
+		t.Fatal(unit.Content)
+	}
+}
+
+func TestIsRootDisk(t *testing.T) {
+	devs := fs.BlockDevices{
+		{UUID: "a", Path: "/dev/sda2", Type: "part", FileSystem: "crypto_LUKS", Name: "sda2"},
+		{Path: "/dev/mapper/root", Type: "crypt", FileSystem: "ext4", MountPoint: "/", PKName: "sda2", Name: "root"},
+		{UUID: "b", Path: "/dev/sdb1", Type: "part", FileSystem: "crypto_LUKS", Name: "sdb1"},
+	}
+	if !isRootDisk(devs, devs[0], keydb.Record{UUID: "a"}) || !isRootDisk(devs, devs[2], keydb.Record{UUID: "b", MountPoint: "//"}) {
+		t.Fatal("root disk not recognised")
+	}
+	if isRootDisk(devs, devs[2], keydb.Record{UUID: "b", MountPoint: "/srv"}) || isRootDisk(devs, devs[2], keydb.Record{UUID: "b"}) {
+		t.Fatal("not a root disk")
+	}
+}
+
+func TestRemoveSystemdUnlockUnits(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer func(orig func() fs.BlockDevices) { getBlockDevices = orig }(getBlockDevices)
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{{UUID: "9edcdeb9-86bd-4602-be5d-7a45a29fefc0", SERIAL: "36001405", Path: "/dev/sdb1", Type: "part", FileSystem: "crypto_LUKS", Name: "sdb1"}}
+	}
+	var out bytes.Buffer
+	data := MakeSystemdUnlockUnit(keydb.Record{UUID: "SERIAL:36001405", MountPoint: "/srv"}, "data", nil)
+	other := MakeSystemdUnlockUnit(keydb.Record{UUID: "167c3f2a-6b5c-4b8f-8a29-2f4a4f0d3df1"}, "other", nil)
+	for _, unit := range []SystemdUnit{data, other} {
+		if _, err := WriteSystemdUnit(tmpDir, unit, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The unit is found by any ID of the device, not only by the one its record is kept under
+	if names, err := RemoveSystemdUnlockUnits(&out, "9edcdeb9-86bd-4602-be5d-7a45a29fefc0", tmpDir, false, nil); err != nil || len(names) != 1 || names[0] != data.Name {
+		t.Fatal(names, err, out.String())
+	}
+	if _, err := os.Stat(path.Join(tmpDir, other.Name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RemoveSystemdUnlockUnits(&out, "SERIAL:36001405", tmpDir, false, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	// Units edited by hand are left alone unless forced
+	if err := ioutil.WriteFile(path.Join(tmpDir, other.Name), []byte(other.Content+"# edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := RemoveSystemdUnlockUnits(&out, "", tmpDir, false, nil); err == nil || len(names) != 0 {
+		t.Fatal(names, err)
+	}
+	var disabled []string
+	disable := func(name string) error {
+		disabled = append(disabled, name)
+		return nil
+	}
+	if names, err := RemoveSystemdUnlockUnits(&out, "", tmpDir, true, disable); err != nil || len(names) != 1 || len(disabled) != 1 || disabled[0] != other.Name {
+		t.Fatal(names, err)
+	}
+}
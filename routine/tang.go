@@ -0,0 +1,189 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	CLIENT_CONF_TANG_FALLBACK = "TANG_FALLBACK_AFTER_SEC"
+
+	TANG_RECORD_DIR         = "/var/lib/cryptctl2/tang" // TANG_RECORD_DIR keeps the record details of disks that are bound to a Tang server.
+	TANG_FALLBACK_SEC       = 60                        // TANG_FALLBACK_SEC is how long key server is unreachable before Tang is tried by default.
+	TANG_ADV_TIMEOUT        = 5 * time.Second           // TANG_ADV_TIMEOUT is the timeout of asking Tang server for its advertisement.
+	TangRecordFileMode      = sys.SecureFileMode        // TangRecordFileMode is the permission of the record files.
+	tangRecordFileExtension = ".rec"
+)
+
+// The clevis operations, test cases substitute them as there is neither clevis nor Tang server to work with.
+var (
+	clevisBind      = fs.ClevisTangBind
+	clevisUnlock    = fs.ClevisUnlock
+	clevisTangSlots = fs.ClevisTangSlots
+	tangReachable   = isTangReachable
+)
+
+// Return nil if the Tang server hands out its advertisement.
+func isTangReachable(tangURL string) error {
+	client := http.Client{Timeout: TANG_ADV_TIMEOUT}
+	resp, err := client.Get(strings.TrimSuffix(tangURL, "/") + "/adv")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tang server responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Return the path of the file that keeps the record of a disk bound to Tang server.
+func tangRecordPath(dir, uuid string) string {
+	return path.Join(dir, url.PathEscape(uuid)+tangRecordFileExtension)
+}
+
+/*
+SaveTangRecord saves the details needed to unlock and mount the disk when key server is unreachable into the directory.
+The saved copy carries neither the key nor the alive reports, pending commands, or client errors; the disk is unlocked
+by its clevis binding instead.
+*/
+func SaveTangRecord(dir string, rec keydb.Record) error {
+	rec.Key = nil
+	rec.SealedKey = nil
+	rec.PreviousKey = nil
+	rec.SealedPrev = nil
+	rec.AliveMessages = nil
+	rec.PendingCommands = nil
+	rec.ClientErrors = nil
+	if err := sys.MkdirSecure(dir); err != nil {
+		return err
+	}
+	return sys.ReplaceFile(tangRecordPath(dir, rec.UUID), rec.Serialise(), TangRecordFileMode, true)
+}
+
+// LoadTangRecord reads the saved record, found is false if the disk is not bound to a Tang server.
+func LoadTangRecord(dir, uuid string) (rec keydb.Record, found bool, err error) {
+	recPath := tangRecordPath(dir, uuid)
+	content, err := ioutil.ReadFile(recPath)
+	if os.IsNotExist(err) {
+		return rec, false, nil
+	} else if err != nil {
+		return rec, false, fmt.Errorf("LoadTangRecord: failed to read \"%s\" - %v", recPath, err)
+	}
+	if err := rec.Deserialise(content); err != nil {
+		return rec, true, fmt.Errorf("LoadTangRecord: record \"%s\" is damaged - %v", recPath, err)
+	}
+	return rec, true, nil
+}
+
+// RemoveTangRecord removes the saved record, it is not an error if there is none.
+func RemoveTangRecord(dir, uuid string) error {
+	if err := os.Remove(tangRecordPath(dir, uuid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RemoveTangRecord: failed to remove record of \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
+
+/*
+RefreshTangRecord brings the saved record up to date after it has been retrieved from key server, or removes it if the
+record no longer names a Tang server. Failures are only reported, they never stop the disk from being used.
+*/
+func RefreshTangRecord(progressOut io.Writer, dir string, rec keydb.Record) {
+	var err error
+	if rec.TangURL == "" {
+		err = RemoveTangRecord(dir, rec.UUID)
+	} else {
+		err = SaveTangRecord(dir, rec)
+	}
+	if err != nil {
+		fmt.Fprintln(progressOut, err)
+	}
+}
+
+// Bind the freshly encrypted disk to the record's Tang server, a failure is only reported as the key server still works.
+func bindTang(progressOut io.Writer, key []byte, blockDev, tangURL string) {
+	if tangURL == "" {
+		return
+	}
+	if err := clevisBind(key, blockDev, tangURL); err != nil {
+		fmt.Fprintf(progressOut, "Failed to bind \"%s\" to tang server, it can only be unlocked via key server - %v\n", blockDev, err)
+		return
+	}
+	fmt.Fprintf(progressOut, "\"%s\" is now bound to tang server \"%s\" too.\n", blockDev, tangURL)
+}
+
+/*
+Unlock the device by its clevis binding to Tang server. Return false if the device is not bound, or cannot be unlocked
+by the binding, in which case the key server should be asked again.
+*/
+func unlockByTang(progressOut io.Writer, candidates []string) (recordID string, aliveIntervalSec int, unlocked bool, err error) {
+	for _, id := range candidates {
+		rec, found, err := LoadTangRecord(TANG_RECORD_DIR, id)
+		if !found {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: cannot use the tang binding of \"%s\" - %v\n", id, err)
+			return "", 0, false, nil
+		}
+		err = UnlockFS(progressOut, rec, 1)
+		rec.Key.Wipe()
+		if _, isBindErr := err.(BindMountErrors); err != nil && !isBindErr {
+			fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: failed to unlock \"%s\" by tang server \"%s\" - %v\n", id, rec.TangURL, err)
+			return "", 0, false, nil
+		}
+		fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: unlocked \"%s\" by tang server \"%s\" while key server is unreachable\n", id, rec.TangURL)
+		return rec.UUID, rec.AliveIntervalSec, true, err
+	}
+	return "", 0, false, nil
+}
+
+/*
+Report whether the device can be unlocked without key server: by the key sealed in TPM2, or by the binding to Tang
+server, which must be reachable right now. Return true if either can.
+*/
+func reportFallbackPaths(progressOut io.Writer, candidates []string, tpmPCRs string) (viable bool) {
+	if tpmPCRs != "" && HasSealedRecord(tpm2SealDir, candidates) {
+		fmt.Fprintln(progressOut, "CheckAutoUnlock: the key sealed in TPM2 is available")
+		viable = true
+	}
+	for _, id := range candidates {
+		rec, found, err := LoadTangRecord(TANG_RECORD_DIR, id)
+		if !found {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(progressOut, "CheckAutoUnlock: tang binding is unusable - %v\n", err)
+			break
+		}
+		blkDev, found := getBlockDevices().GetByCriteria(rec.UUID, "", "", "", "", "", "")
+		if !found {
+			break
+		}
+		slots, err := clevisTangSlots(blkDev.Path)
+		bound := false
+		for _, tangURL := range slots {
+			bound = bound || tangURL == rec.TangURL
+		}
+		if err != nil || !bound {
+			fmt.Fprintf(progressOut, "CheckAutoUnlock: the device is not bound to tang server \"%s\" (%v)\n", rec.TangURL, err)
+		} else if err := tangReachable(rec.TangURL); err != nil {
+			fmt.Fprintf(progressOut, "CheckAutoUnlock: tang server \"%s\" is unreachable - %v\n", rec.TangURL, err)
+		} else {
+			fmt.Fprintf(progressOut, "CheckAutoUnlock: tang server \"%s\" is reachable\n", rec.TangURL)
+			viable = true
+		}
+		break
+	}
+	return
+}
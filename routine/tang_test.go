@@ -0,0 +1,80 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTangRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-tangtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, found, err := LoadTangRecord(dir, "fakeuuid"); found || err != nil {
+		t.Fatal(found, err)
+	}
+	rec := keydb.Record{UUID: "fakeuuid", Key: []byte{1, 2, 3}, PreviousKey: []byte{4, 5, 6}, MountPoint: "/a", TangURL: "http://tang.example.com"}
+	RefreshTangRecord(ioutil.Discard, dir, rec)
+	saved, found, err := LoadTangRecord(dir, "fakeuuid")
+	if !found || err != nil {
+		t.Fatal(found, err)
+	}
+	if len(saved.Key) != 0 || len(saved.PreviousKey) != 0 || saved.MountPoint != "/a" || saved.TangURL != rec.TangURL {
+		t.Fatalf("%+v", saved)
+	}
+	// The copy goes away once the record no longer names a Tang server
+	rec.TangURL = ""
+	RefreshTangRecord(ioutil.Discard, dir, rec)
+	if _, found, err := LoadTangRecord(dir, "fakeuuid"); found || err != nil {
+		t.Fatal(found, err)
+	}
+	if err := RemoveTangRecord(dir, "fakeuuid"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTangDue(t *testing.T) {
+	retry := UnlockRetry{TangFallbackSec: 10}
+	if retry.tangDue(time.Time{}) || retry.tangDue(time.Now().Add(-5*time.Second)) {
+		t.Fatal("should not be due")
+	}
+	if !retry.tangDue(time.Now().Add(-10 * time.Second)) {
+		t.Fatal("should be due")
+	}
+	if (UnlockRetry{}).tangDue(time.Now().Add(-10 * time.Second)) {
+		t.Fatal("default should apply")
+	}
+}
+
+func TestOpenDeviceByTang(t *testing.T) {
+	var clevisOpened, keyOpened int
+	clevisUnlock = func(string, string) error {
+		clevisOpened++
+		return nil
+	}
+	cryptOpen = func(sys.SecureBytes, string, string) error {
+		keyOpened++
+		return errors.New("simulated failure")
+	}
+	defer func() {
+		clevisUnlock = fs.ClevisUnlock
+		cryptOpen = fs.CryptOpen
+	}()
+	// A record saved for Tang does not carry the key
+	if err := openDevice(keydb.Record{UUID: "fakeuuid", TangURL: "http://tang.example.com"}, "/dev/fake1", "fake"); err != nil || clevisOpened != 1 || keyOpened != 0 {
+		t.Fatal(err, clevisOpened, keyOpened)
+	}
+	// The key from key server is always preferred
+	if err := openDevice(keydb.Record{UUID: "fakeuuid", Key: []byte{1}, TangURL: "http://tang.example.com"}, "/dev/fake1", "fake"); err == nil || clevisOpened != 1 || keyOpened != 1 {
+		t.Fatal(err, clevisOpened, keyOpened)
+	}
+}
@@ -0,0 +1,202 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl2/keydb"
+	"cryptctl2/sys"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CLIENT_CONF_TPM2_UNLOCK = "TPM2_UNLOCK_ENABLE"
+	CLIENT_CONF_TPM2_PCRS   = "TPM2_PCRS"
+
+	TPM2_SEALED_KEY_DIR   = "/var/lib/cryptctl2/tpm2"
+	DefaultTPM2PCRs       = "7"                // DefaultTPM2PCRs binds the sealed key to the secure boot state.
+	TPM2SealedKeyFileMode = sys.SecureFileMode // TPM2SealedKeyFileMode is the permission of sealed key files.
+)
+
+// The TPM2 operations, test cases substitute them as there is no TPM to work with.
+var (
+	hasTPM2    = sys.HasTPM2
+	tpm2Seal   = sys.TPM2Seal
+	tpm2Unseal = sys.TPM2Unseal
+
+	tpm2SealDir = TPM2_SEALED_KEY_DIR // tpm2SealDir keeps the sealed records of auto-unlock, test cases substitute it.
+)
+
+// Return the path of the file that keeps the sealed record. The record UUID may carry an ID prefix such as "SERIAL:".
+func sealedRecordPath(sealDir, uuid string) string {
+	return path.Join(sealDir, url.PathEscape(uuid)+".cred")
+}
+
+/*
+SealRecord seals the record by TPM2 and saves it into the directory. The sealed copy carries the key and the details
+needed to unlock and mount the disk, but none of the alive reports, pending commands, or client errors.
+*/
+func SealRecord(sealDir string, rec keydb.Record, pcrs string) error {
+	rec.AliveMessages = nil
+	rec.PendingCommands = nil
+	rec.ClientErrors = nil
+	sealed, err := tpm2Seal(rec.Serialise(), path.Base(sealedRecordPath(sealDir, rec.UUID)), pcrs)
+	if err != nil {
+		return fmt.Errorf("SealRecord: %v", err)
+	}
+	if err := sys.MkdirSecure(sealDir); err != nil {
+		return err
+	}
+	return sys.ReplaceFile(sealedRecordPath(sealDir, rec.UUID), sealed, TPM2SealedKeyFileMode, true)
+}
+
+// UnsealRecord reads and unseals the record, found is false if the record has not been sealed.
+func UnsealRecord(sealDir, uuid string) (rec keydb.Record, found bool, err error) {
+	sealedPath := sealedRecordPath(sealDir, uuid)
+	sealed, err := ioutil.ReadFile(sealedPath)
+	if os.IsNotExist(err) {
+		return rec, false, nil
+	} else if err != nil {
+		return rec, false, fmt.Errorf("UnsealRecord: failed to read \"%s\" - %v", sealedPath, err)
+	}
+	content, err := tpm2Unseal(sealed, path.Base(sealedPath))
+	if err != nil {
+		return rec, true, fmt.Errorf("UnsealRecord: %v", err)
+	}
+	if err := rec.Deserialise(content); err != nil {
+		return rec, true, fmt.Errorf("UnsealRecord: sealed record \"%s\" is damaged - %v", sealedPath, err)
+	}
+	return rec, true, nil
+}
+
+/*
+SealedRecordExpired returns true if the sealed copy of the record is older than the record allows, the key server must
+then hand out the key again before the disk is unlocked. The copy is as old as its file, which is written anew whenever
+the key server hands out the key.
+*/
+func SealedRecordExpired(sealDir string, rec keydb.Record, now time.Time) bool {
+	if rec.SealMaxHours < 1 {
+		return false
+	}
+	st, err := os.Stat(sealedRecordPath(sealDir, rec.UUID))
+	if err != nil {
+		return true
+	}
+	return now.Sub(st.ModTime()) > time.Duration(rec.SealMaxHours)*time.Hour
+}
+
+// RemoveSealedRecord removes the sealed copy of the record, it is not an error if there is none.
+func RemoveSealedRecord(sealDir, uuid string) error {
+	if err := os.Remove(sealedRecordPath(sealDir, uuid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RemoveSealedRecord: failed to remove sealed record of \"%s\" - %v", uuid, err)
+	}
+	return nil
+}
+
+// HasSealedRecord returns true if any of the IDs has a sealed record on this computer.
+func HasSealedRecord(sealDir string, ids []string) bool {
+	for _, id := range ids {
+		if _, err := os.Stat(sealedRecordPath(sealDir, id)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+RefreshSealedRecord brings the sealed copy of the record up to date after it has been retrieved from key server. If the
+record no longer allows sealing, the sealed copy is removed. Computers without TPM2 do not seal anything. Failures are
+only reported, they never stop the disk from being used.
+*/
+func RefreshSealedRecord(progressOut io.Writer, sealDir string, rec keydb.Record, pcrs string) {
+	if !rec.SealToTPM {
+		if err := RemoveSealedRecord(sealDir, rec.UUID); err != nil {
+			fmt.Fprintln(progressOut, err)
+		}
+		return
+	}
+	if !hasTPM2() {
+		fmt.Fprintf(progressOut, "This computer does not have a usable TPM2, the key of \"%s\" is not sealed.\n", rec.UUID)
+		return
+	}
+	if err := SealRecord(sealDir, rec, pcrs); err != nil {
+		fmt.Fprintf(progressOut, "Failed to seal the key of \"%s\" - %v\n", rec.UUID, err)
+		return
+	}
+	fmt.Fprintf(progressOut, "The key of \"%s\" is now sealed by TPM2 (PCRs %s).\n", rec.UUID, pcrs)
+}
+
+// Return the path of the file that remembers the moment the disk was unlocked by its sealed record.
+func offlineUnlockPath(sealDir, uuid string) string {
+	return path.Join(sealDir, url.PathEscape(uuid)+".offline")
+}
+
+/*
+MarkOfflineUnlock remembers that the disk was unlocked by its sealed record at the moment, while the key server was
+unreachable, so that the alive reporter tells the key server once it is reachable again.
+*/
+func MarkOfflineUnlock(sealDir, uuid string, moment time.Time) error {
+	if err := sys.MkdirSecure(sealDir); err != nil {
+		return err
+	}
+	if err := sys.ReplaceFile(offlineUnlockPath(sealDir, uuid), []byte(strconv.FormatInt(moment.Unix(), 10)), TPM2SealedKeyFileMode, true); err != nil {
+		return fmt.Errorf("MarkOfflineUnlock: %v", err)
+	}
+	return nil
+}
+
+// ListOfflineUnlocks returns the moments (Unix seconds) of the offline unlocks not yet told to the key server by record UUID.
+func ListOfflineUnlocks(sealDir string) (map[string]int64, error) {
+	entries, err := ioutil.ReadDir(sealDir)
+	if os.IsNotExist(err) {
+		return map[string]int64{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ListOfflineUnlocks: failed to read directory \"%s\" - %v", sealDir, err)
+	}
+	unlocks := make(map[string]int64)
+	for _, entry := range entries {
+		// Skip the temporary files of sys.ReplaceFile
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".offline") {
+			continue
+		}
+		uuid, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), ".offline"))
+		if err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(sealDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if moment, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil {
+			unlocks[uuid] = moment
+		}
+	}
+	return unlocks, nil
+}
+
+/*
+ClearOfflineUnlock forgets the offline unlock of the moment (Unix seconds) after it has been told to the key server. An
+offline unlock that happened after the moment is kept.
+*/
+func ClearOfflineUnlock(sealDir, uuid string, moment int64) error {
+	content, err := ioutil.ReadFile(offlineUnlockPath(sealDir, uuid))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("ClearOfflineUnlock: %v", err)
+	}
+	if marked, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil && marked > moment {
+		return nil
+	}
+	if err := os.Remove(offlineUnlockPath(sealDir, uuid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ClearOfflineUnlock: failed to remove \"%s\" - %v", offlineUnlockPath(sealDir, uuid), err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/keydb"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Substitute TPM2 operations with a reversible transformation that remembers the name and PCRs.
+func fakeTPM2(t *testing.T, present bool) (restore func()) {
+	origHas, origSeal, origUnseal := hasTPM2, tpm2Seal, tpm2Unseal
+	hasTPM2 = func() bool { return present }
+	tpm2Seal = func(secret []byte, name, pcrs string) ([]byte, error) {
+		return append([]byte(name+"|"+pcrs+"|"), secret...), nil
+	}
+	tpm2Unseal = func(sealed []byte, name string) ([]byte, error) {
+		parts := bytes.SplitN(sealed, []byte("|"), 3)
+		if len(parts) != 3 || string(parts[0]) != name {
+			return nil, errors.New("unseal failed")
+		}
+		return parts[2], nil
+	}
+	return func() {
+		hasTPM2, tpm2Seal, tpm2Unseal = origHas, origSeal, origUnseal
+	}
+}
+
+func TestSealRecord(t *testing.T) {
+	defer fakeTPM2(t, true)()
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sealDir := path.Join(tmpDir, "tpm2")
+	if _, found, err := UnsealRecord(sealDir, "SERIAL:abc"); found || err != nil {
+		t.Fatal(found, err)
+	}
+	rec := keydb.Record{
+		UUID:          "SERIAL:abc",
+		Key:           []byte{1, 2, 3},
+		MountPoint:    "/a",
+		SealToTPM:     true,
+		AliveMessages: map[string][]keydb.AliveMessage{"1.1.1.1": {{Hostname: "a", IP: "1.1.1.1", Timestamp: time.Now().Unix()}}},
+	}
+	if err := SealRecord(sealDir, rec, "0+7"); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path.Join(sealDir, "SERIAL:abc.cred")); err != nil || st.Mode().Perm() != TPM2SealedKeyFileMode {
+		t.Fatal(err, st)
+	}
+	if !HasSealedRecord(sealDir, []string{"def", "SERIAL:abc"}) || HasSealedRecord(sealDir, []string{"def"}) {
+		t.Fatal("wrong HasSealedRecord")
+	}
+	unsealed, found, err := UnsealRecord(sealDir, "SERIAL:abc")
+	if !found || err != nil || !bytes.Equal(unsealed.Key, rec.Key) || unsealed.MountPoint != "/a" || len(unsealed.AliveMessages) != 0 {
+		t.Fatal(unsealed, found, err)
+	}
+	// A sealed record that cannot be unsealed is reported as found
+	if err := ioutil.WriteFile(path.Join(sealDir, "SERIAL:abc.cred"), []byte("garbage"), TPM2SealedKeyFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := UnsealRecord(sealDir, "SERIAL:abc"); !found || err == nil {
+		t.Fatal(found, err)
+	}
+	if err := RemoveSealedRecord(sealDir, "SERIAL:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveSealedRecord(sealDir, "SERIAL:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if HasSealedRecord(sealDir, []string{"SERIAL:abc"}) {
+		t.Fatal("did not remove")
+	}
+}
+
+func TestRefreshSealedRecord(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var out bytes.Buffer
+	rec := keydb.Record{UUID: "abc", Key: []byte{1, 2, 3}, SealToTPM: true}
+
+	// Nothing is sealed without TPM2
+	restore := fakeTPM2(t, false)
+	RefreshSealedRecord(&out, tmpDir, rec, "7")
+	restore()
+	if HasSealedRecord(tmpDir, []string{"abc"}) {
+		t.Fatal("sealed without TPM2")
+	}
+
+	defer fakeTPM2(t, true)()
+	RefreshSealedRecord(&out, tmpDir, rec, "7")
+	if !HasSealedRecord(tmpDir, []string{"abc"}) {
+		t.Fatal("did not seal", out.String())
+	}
+	// The sealed copy goes away once the record no longer allows sealing
+	rec.SealToTPM = false
+	RefreshSealedRecord(&out, tmpDir, rec, "7")
+	if HasSealedRecord(tmpDir, []string{"abc"}) {
+		t.Fatal("did not remove")
+	}
+}
+
+func TestSealedRecordExpired(t *testing.T) {
+	defer fakeTPM2(t, true)()
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	now := time.Now()
+	rec := keydb.Record{UUID: "abc", Key: []byte{1, 2, 3}, SealToTPM: true}
+	// Without a limit, even a missing copy does not expire
+	if SealedRecordExpired(tmpDir, rec, now) {
+		t.Fatal("expired without limit")
+	}
+	rec.SealMaxHours = 2
+	if !SealedRecordExpired(tmpDir, rec, now) {
+		t.Fatal("missing copy did not expire")
+	}
+	if err := SealRecord(tmpDir, rec, "7"); err != nil {
+		t.Fatal(err)
+	}
+	if SealedRecordExpired(tmpDir, rec, now.Add(time.Hour)) || !SealedRecordExpired(tmpDir, rec, now.Add(3*time.Hour)) {
+		t.Fatal("wrong expiry")
+	}
+	// The limit travels with the sealed copy
+	if unsealed, _, err := UnsealRecord(tmpDir, "abc"); err != nil || unsealed.SealMaxHours != 2 {
+		t.Fatal(unsealed, err)
+	}
+}
+
+func TestOfflineUnlocks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if unlocks, err := ListOfflineUnlocks(path.Join(tmpDir, "does-not-exist")); err != nil || len(unlocks) != 0 {
+		t.Fatal(unlocks, err)
+	}
+	if err := MarkOfflineUnlock(tmpDir, "SERIAL:abc", time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Sealed records are not mistaken for offline unlocks
+	if err := ioutil.WriteFile(sealedRecordPath(tmpDir, "def"), []byte("sealed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlocks, err := ListOfflineUnlocks(tmpDir)
+	if err != nil || !reflect.DeepEqual(unlocks, map[string]int64{"SERIAL:abc": 100}) {
+		t.Fatal(unlocks, err)
+	}
+	// An offline unlock that happened after the report is kept
+	if err := MarkOfflineUnlock(tmpDir, "SERIAL:abc", time.Unix(200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearOfflineUnlock(tmpDir, "SERIAL:abc", 100); err != nil {
+		t.Fatal(err)
+	}
+	if unlocks, err := ListOfflineUnlocks(tmpDir); err != nil || unlocks["SERIAL:abc"] != 200 {
+		t.Fatal(unlocks, err)
+	}
+	if err := ClearOfflineUnlock(tmpDir, "SERIAL:abc", 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearOfflineUnlock(tmpDir, "SERIAL:abc", 200); err != nil {
+		t.Fatal(err)
+	}
+	if unlocks, err := ListOfflineUnlocks(tmpDir); err != nil || len(unlocks) != 0 {
+		t.Fatal(unlocks, err)
+	}
+}
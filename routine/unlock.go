@@ -12,55 +12,484 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	AUTO_UNLOCK_RETRY_INTERVAL_SEC = 5
-	REPORT_ALIVE_INTERVAL_SEC      = 10
+	AUTO_UNLOCK_RETRY_INTERVAL_SEC = 5    // AUTO_UNLOCK_RETRY_INTERVAL_SEC is the default number of seconds between auto-unlock attempts.
+	REPORT_ALIVE_INTERVAL_SEC      = 10   // REPORT_ALIVE_INTERVAL_SEC is the default interval of alive reports.
+	MAX_REPORT_ALIVE_INTERVAL_SEC  = 3600 // MAX_REPORT_ALIVE_INTERVAL_SEC is the longest interval of alive reports.
+	DM_NODE_WAIT_SEC               = 5
+	DM_DIR                         = "/dev/mapper"
+	UNLOCK_RETRY_INTERVAL          = 1 * time.Second
+	CLIENT_ERROR_REPORT_TIMEOUT    = 10 * time.Second
 )
 
-// Forcibly unlock all file systems that have their keys on a key server.
-func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, password string) error {
-	sys.LockMem()
-	// Collect information about all encrypted file systems
-	blockDevs := fs.GetBlockDevices()
-	reqUUIDs := make([]string, 0, 0)
-	reqDevs := make(map[string]fs.BlockDevice)
+// Classes of UnlockFS failures, they are reported to key server along with the error.
+const (
+	UnlockErrDeviceNotFound = "device-not-found"
+	UnlockErrNotLUKS        = "not-luks"
+	UnlockErrFormat         = "format"
+	UnlockErrMapperName     = "mapper-name"
+	UnlockErrOpen           = "open"
+	UnlockErrFsck           = "fsck"
+	UnlockErrMount          = "mount"
+)
+
+// The file system operations carried out by UnlockFS, test cases substitute them to simulate failures.
+var (
+	getBlockDevices = fs.GetBlockDevices
+	cryptFormat     = fs.CryptFormat
+	cryptOpen       = fs.CryptOpen
+	cryptStatus     = fs.CryptStatus
+	format          = fs.Format
+	mount           = fs.Mount
+	bindMount       = fs.BindMount
+	waitForNode     = waitForDeviceNode
+	probeFileSystem = fs.ProbeFileSystem
+	checkFileSystem = fs.CheckFileSystem
+	isMounted       = isDeviceMounted
+)
+
+// Return true if the device is mounted anywhere.
+func isDeviceMounted(dev string) bool {
+	_, found := fs.ParseMtab().GetByCriteria(dev, "", "")
+	return found
+}
+
+// Open the device by the record's key, or by its clevis binding if the record is a local copy without key (see SaveTangRecord).
+func openDevice(rec keydb.Record, blockDev, dmName string) error {
+	if len(rec.Key) == 0 && rec.TangURL != "" {
+		return clevisUnlock(blockDev, dmName)
+	}
+	return cryptOpenByKey(rec, blockDev, dmName)
+}
+
+/*
+Open the encrypted device by the record's key. While the key server is waiting for a computer to rotate the key, the
+encryption header may still carry the previous key only, which is tried next.
+*/
+func cryptOpenByKey(rec keydb.Record, blockDev, dmName string) error {
+	err := cryptOpen(rec.Key, blockDev, dmName)
+	if err != nil && rec.IsKeyRotationPending() {
+		if prevErr := cryptOpen(rec.PreviousKey, blockDev, dmName); prevErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/*
+Make the record's file system on the unlocked device of an auto-encrypted record, unless the device already has a file
+system. A device that was encrypted just now is blank for certain. A file system of another type than the record's is
+left as it is and mounted regardless.
+*/
+func formatIfBlank(progressOut io.Writer, rec keydb.Record, dmDev string, newEncrypted bool) error {
+	if !newEncrypted {
+		fsType, err := probeFileSystem(dmDev)
+		if err != nil {
+			fmt.Fprintf(progressOut, "  *cannot detect the file system type of \"%s\", leaving it unformatted - %v\n", dmDev, err)
+			return nil
+		} else if fsType == rec.FileSystem {
+			return nil
+		} else if fsType != "" {
+			fmt.Fprintf(progressOut, "  *device with UUID '%s' already has a %s file system, not formatting it as %s\n", rec.UUID, fsType, rec.FileSystem)
+			return nil
+		}
+	}
+	fmt.Fprintf(progressOut, "  *making %s file system on \"%s\"\n", rec.FileSystem, dmDev)
+	return format(dmDev, rec.FileSystem)
+}
+
+/*
+Return the type of the file system on the unlocked device, after checking it according to the record's policy. A type
+that differs from the record's file system is loudly warned about, the detected type is mounted nevertheless. A file
+system that is already mounted (e.g. by a previous run) is not checked again.
+*/
+func prepareMount(progressOut io.Writer, rec keydb.Record, dmDev string) (string, error) {
+	fsType, err := probeFileSystem(dmDev)
+	if err != nil || fsType == "" {
+		fmt.Fprintf(progressOut, "  *cannot detect the file system type of \"%s\", leaving it to mount - %v\n", dmDev, err)
+		return rec.FileSystem, nil
+	}
+	if rec.FileSystem != "" && fsType != rec.FileSystem {
+		fmt.Fprintf(progressOut, "  *WARNING: device with UUID '%s' has a %s file system, but its record says %s, mounting it as %s\n",
+			rec.UUID, fsType, rec.FileSystem, fsType)
+	}
+	if rec.FsckPolicy == keydb.FsckOff || isMounted(dmDev) {
+		return fsType, nil
+	}
+	fmt.Fprintf(progressOut, "  *checking %s file system on \"%s\"\n", fsType, dmDev)
+	output, err := checkFileSystem(dmDev, fsType, rec.FsckPolicy == keydb.FsckForce)
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" {
+			fmt.Fprintf(progressOut, "    %s\n", line)
+		}
+	}
+	return fsType, err
+}
+
+// UnlockError is returned by UnlockFS when the file system could not be unlocked and mounted.
+type UnlockError struct {
+	Class string // Class is one of UnlockErr* constants.
+	Err   error  // Err is the underlying error.
+}
+
+func (err UnlockError) Error() string {
+	return err.Err.Error()
+}
+
+/*
+BindMountErrors is returned by UnlockFS when some of the record's bind-mounts failed, the file system itself is
+mounted and usable nonetheless.
+*/
+type BindMountErrors []string
+
+func (errs BindMountErrors) Error() string {
+	return "failed bind-mounts: " + strings.Join(errs, "; ")
+}
+
+// Bind-mount the mounted file system onto the record's bind-mount targets in order, carrying on after a failure.
+func mountBindTargets(progressOut io.Writer, rec keydb.Record) error {
+	var errs BindMountErrors
+	for _, bind := range rec.BindMounts {
+		err := os.MkdirAll(bind.Target, 0755)
+		if err == nil {
+			err = bindMount(rec.MountPoint, bind.Target, bind.Options, bind.Propagation)
+		}
+		if err != nil {
+			fmt.Fprintf(progressOut, "  *failed to bind-mount \"%s\" on \"%s\" - %v\n", rec.MountPoint, bind.Target, err)
+			errs = append(errs, bind.Target)
+			continue
+		}
+		fmt.Fprintf(progressOut, "The file system has been bind-mounted on \"%s\".\n", bind.Target)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// lockedWriter serialises writes from concurrent goroutines, so that their lines do not interleave mid-way.
+type lockedWriter struct {
+	out  io.Writer
+	lock *sync.Mutex
+}
+
+func (writer lockedWriter) Write(p []byte) (int, error) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.out.Write(p)
+}
+
+// Return the number of directory levels of the mount point, an empty mount point has none.
+func mountPointDepth(mountPoint string) int {
+	if mountPoint == "" {
+		return 0
+	}
+	return strings.Count(path.Clean(mountPoint), "/")
+}
+
+// Return true only if the mount point is located underneath (but not at) the parent mount point.
+func isNestedMountPoint(mountPoint, parent string) bool {
+	if mountPoint == "" || parent == "" {
+		return false
+	}
+	parent = path.Clean(parent)
+	if parent == "/" {
+		return path.Clean(mountPoint) != "/"
+	}
+	return strings.HasPrefix(path.Clean(mountPoint), parent+"/")
+}
+
+/*
+Return the UUIDs of the records among recs that the record waits for before it is unlocked: those it is to be unlocked
+after (keydb.Record.UnlockAfter), and those whose mount point its own mount point is nested under.
+*/
+func unlockDependencies(rec keydb.Record, recs []keydb.Record) []string {
+	deps := make([]string, 0, len(rec.UnlockAfter))
+	for _, other := range recs {
+		if isUnlockDependency(rec, other) {
+			deps = append(deps, other.UUID)
+		}
+	}
+	return deps
+}
+
+// Return true if the record waits for the other record before it is unlocked, see unlockDependencies.
+func isUnlockDependency(rec, other keydb.Record) bool {
+	if other.UUID == rec.UUID {
+		return false
+	}
+	for _, uuid := range rec.UnlockAfter {
+		if keydb.CanonicalRecordID(uuid) == other.UUID {
+			return true
+		}
+	}
+	return isNestedMountPoint(rec.MountPoint, other.MountPoint)
+}
+
+/*
+Return the records in the order they are to be unlocked, each record after the records it waits for (see
+unlockDependencies). The records that wait for each other in a cycle, or for records in a cycle, cannot be ordered and
+are returned separately. The warnings tell about records to be unlocked after records that are not among them.
+*/
+func unlockOrder(recs []keydb.Record) (ordered, cyclic []keydb.Record, warnings []string) {
+	// Parents before their children unless the dependencies say otherwise
+	remaining := make([]keydb.Record, len(recs))
+	copy(remaining, recs)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return mountPointDepth(remaining[i].MountPoint) < mountPointDepth(remaining[j].MountPoint)
+	})
+	present := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		present[rec.UUID] = true
+	}
+	warnings = make([]string, 0)
+	for _, rec := range remaining {
+		for _, uuid := range rec.UnlockAfter {
+			if !present[keydb.CanonicalRecordID(uuid)] {
+				warnings = append(warnings, fmt.Sprintf("\"%s\" is unlocked without waiting for \"%s\", which is not being unlocked along with it", rec.UUID, uuid))
+			}
+		}
+	}
+	ordered = make([]keydb.Record, 0, len(recs))
+	placed := make(map[string]bool, len(recs))
+	for len(remaining) > 0 {
+		next := -1
+		for i, rec := range remaining {
+			ready := true
+			for _, dep := range unlockDependencies(rec, recs) {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return ordered, remaining, warnings
+		}
+		ordered = append(ordered, remaining[next])
+		placed[remaining[next].UUID] = true
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return ordered, []keydb.Record{}, warnings
+}
+
+/*
+UnlockManyFS unlocks the file systems using up to the number of parallel workers, and returns the UUIDs of the file
+systems that failed (sorted). A file system nested under another one's mount point (e.g. /data/archive under /data),
+or to be unlocked after another record (keydb.Record.UnlockAfter), is only unlocked after the other one has been
+mounted, and it fails without trying should the other one fail. Records that wait for each other in a cycle are a
+configuration error, they fail without trying too.
+*/
+func UnlockManyFS(progressOut io.Writer, recs []keydb.Record, maxAttempts, parallel int) (failedUUIDs []string) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	// Dispatch records after those they wait for, so that a worker never waits for a record that is not yet dispatched.
+	sorted, cyclic, warnings := unlockOrder(recs)
+	for _, warning := range warnings {
+		fmt.Fprintf(progressOut, "UnlockManyFS: warning - %s\n", warning)
+	}
+	out := lockedWriter{out: progressOut, lock: new(sync.Mutex)}
+	done := make(map[string]chan struct{}, len(sorted))
+	for _, rec := range sorted {
+		done[rec.UUID] = make(chan struct{})
+	}
+	failedLock := new(sync.Mutex)
+	failed := make(map[string]bool)
+	for _, rec := range cyclic {
+		fmt.Fprintf(progressOut, "UnlockManyFS: not unlocking \"%s\" because it waits for records that wait for each other in a cycle (UnlockAfter and mount points)\n", rec.UUID)
+		failed[rec.UUID] = true
+	}
+	work := make(chan keydb.Record)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range work {
+				var err error
+				for _, dep := range sorted {
+					if !isUnlockDependency(rec, dep) {
+						continue
+					}
+					<-done[dep.UUID]
+					failedLock.Lock()
+					depFailed := failed[dep.UUID]
+					failedLock.Unlock()
+					if depFailed && isNestedMountPoint(rec.MountPoint, dep.MountPoint) {
+						err = fmt.Errorf("UnlockManyFS: not mounting \"%s\" because its parent \"%s\" failed", rec.MountPoint, dep.MountPoint)
+						break
+					} else if depFailed {
+						err = fmt.Errorf("UnlockManyFS: not unlocking \"%s\" because \"%s\" that it is unlocked after failed", rec.UUID, dep.UUID)
+						break
+					}
+				}
+				if err == nil {
+					err = UnlockFS(out, rec, maxAttempts)
+				}
+				if err != nil {
+					fmt.Fprintf(out, "%v\n", err)
+				}
+				// The file system is usable despite failed bind-mounts
+				if _, isBindErr := err.(BindMountErrors); err != nil && !isBindErr {
+					failedLock.Lock()
+					failed[rec.UUID] = true
+					failedLock.Unlock()
+				}
+				close(done[rec.UUID])
+			}
+		}()
+	}
+	for _, rec := range sorted {
+		work <- rec
+	}
+	close(work)
+	wg.Wait()
+	failedUUIDs = make([]string, 0, len(failed))
+	for uuid := range failed {
+		failedUUIDs = append(failedUUIDs, uuid)
+	}
+	sort.Strings(failedUUIDs)
+	return
+}
+
+/*
+Return the device mapper name to unlock the device as - the record's mapped name if it is set, or a name computed from
+the device node otherwise. If the name is already taken by an entry in the mapper directory, an error is returned
+instead of opening the device over an existing mapping.
+*/
+func GetDeviceMapperName(rec keydb.Record, unlockDev fs.BlockDevice, mapperDir string) (string, error) {
+	dmName := rec.MappedName
+	if dmName == "" {
+		dmName = MakeDeviceMapperName(unlockDev.Path)
+	}
+	if _, err := os.Stat(path.Join(mapperDir, dmName)); err == nil {
+		return "", fmt.Errorf("GetDeviceMapperName: \"%s\" is already in use, is \"%s\" already unlocked?",
+			path.Join(mapperDir, dmName), unlockDev.Path)
+	}
+	return dmName, nil
+}
+
+/*
+Return the device mapper name to unlock the device as, see GetDeviceMapperName. If the name is taken by a mapping of
+the very device, e.g. by a previous run of unlock, the device is already open and alreadyOpen is true, so that
+unlocking it once more carries on rather than fails.
+*/
+func resolveDeviceMapperName(rec keydb.Record, unlockDev fs.BlockDevice, mapperDir string) (dmName string, alreadyOpen bool, err error) {
+	if dmName, err = GetDeviceMapperName(rec, unlockDev, mapperDir); err == nil {
+		return dmName, false, nil
+	}
+	dmName = rec.MappedName
+	if dmName == "" {
+		dmName = MakeDeviceMapperName(unlockDev.Path)
+	}
+	if mapping, statusErr := cryptStatus(dmName); statusErr == nil && mapping.Device == unlockDev.Path {
+		return dmName, true, nil
+	}
+	return "", false, err
+}
+
+// Wait for the device node to appear, it is created by udev shortly after cryptsetup returns.
+func waitForDeviceNode(nodePath string, timeoutSec int) error {
+	for i := 0; i < timeoutSec*10; i++ {
+		if _, err := os.Stat(nodePath); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("waitForDeviceNode: \"%s\" did not appear after %d seconds", nodePath, timeoutSec)
+}
+
+/*
+EncryptedFSToUnlock returns the UUIDs of encrypted file systems on this computer that are not mounted, along with the
+block devices by their UUID.
+*/
+func EncryptedFSToUnlock(blockDevs fs.BlockDevices) (uuids []string, devs map[string]fs.BlockDevice) {
+	uuids = make([]string, 0, 0)
+	devs = make(map[string]fs.BlockDevice)
 	for _, dev := range blockDevs {
 		if dev.MountPoint == "" && dev.IsLUKSEncrypted() && dev.UUID != "" {
-			reqUUIDs = append(reqUUIDs, dev.UUID)
-			reqDevs[dev.UUID] = dev
+			uuids = append(uuids, dev.UUID)
+			devs[dev.UUID] = dev
 		}
 	}
+	return
+}
+
+/*
+Forcibly unlock all file systems that have their keys on a key server. With force, keys already in use by as many
+computers as allowed are granted too, and the computer that has not reported for the longest time is evicted.
+*/
+func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, password string, parallel int, force bool) error {
+	sys.LockMem()
+	// Collect information about all encrypted file systems
+	reqUUIDs, reqDevs := EncryptedFSToUnlock(fs.GetBlockDevices())
 	if len(reqUUIDs) == 0 {
 		return errors.New("Cannot find any more encrypted file systems.")
 	}
 	hostname, _ := sys.GetHostnameAndIP()
-	resp, err := client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{
-		UUIDs:         reqUUIDs,
-		Hostname:      hostname,
-		PlainPassword: password,
-	})
+	var resp keyserv.ManualRetrieveKeyResp
+	var err error
+	if force {
+		var forceResp keyserv.ForceRetrieveKeyResp
+		forceResp, err = client.ForceRetrieveKey(keyserv.ForceRetrieveKeyReq{
+			UUIDs:         reqUUIDs,
+			Hostname:      hostname,
+			PlainPassword: password,
+		})
+		resp.Granted, resp.Missing = forceResp.Granted, forceResp.Missing
+		if len(forceResp.Evicted) > 0 {
+			fmt.Fprintln(progressOut, "The following computers have been evicted to make room for this computer:")
+			for uuid, eviction := range forceResp.Evicted {
+				fmt.Fprintf(progressOut, "- %s %s: %s (%s)\n", reqDevs[uuid].Path, uuid, eviction.IP, eviction.Hostname)
+			}
+		}
+		if len(forceResp.Rejected) > 0 {
+			fmt.Fprintln(progressOut, "This computer is not allowed to use the following encrypted file systems:")
+			for _, uuid := range forceResp.Rejected {
+				fmt.Fprintf(progressOut, "- %s %s\n", reqDevs[uuid].Path, uuid)
+			}
+		}
+	} else {
+		resp, err = client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{
+			UUIDs:         reqUUIDs,
+			Hostname:      hostname,
+			PlainPassword: password,
+		})
+	}
 	if err != nil {
 		return err
 	}
-	hasErr := false
-	if len(resp.Granted) > 0 {
-		// Unlock and mount all disks that have keys on the server
-		for _, rec := range resp.Granted {
-			UnlockFS(progressOut, rec, 2)
-			fmt.Fprintln(progressOut)
-		}
+	defer wipeGrantedKeys(resp.Granted)
+	// Unlock and mount all disks that have keys on the server
+	recs := make([]keydb.Record, 0, len(resp.Granted))
+	for _, rec := range resp.Granted {
+		recs = append(recs, rec)
 	}
+	failedUUIDs := UnlockManyFS(progressOut, recs, 2, parallel)
 	if len(resp.Missing) > 0 {
 		fmt.Fprintln(progressOut, "The following encrypted file systems do not have their keys on the server:")
 		for _, uuid := range resp.Missing {
 			fmt.Fprintf(progressOut, "- %s %s\n", reqDevs[uuid].Path, uuid)
 		}
 	}
-	if hasErr {
-		return errors.New("Failed to process some of the encrypted file systems. Check output for more details.")
+	if len(failedUUIDs) > 0 {
+		fmt.Fprintln(progressOut, "The following encrypted file systems could not be unlocked:")
+		for _, uuid := range failedUUIDs {
+			fmt.Fprintf(progressOut, "- %s %s\n", reqDevs[uuid].Path, uuid)
+		}
+		return fmt.Errorf("Failed to unlock %d of the encrypted file systems (%s). Check output for more details.",
+			len(failedUUIDs), strings.Join(failedUUIDs, ", "))
 	}
 	return nil
 }
@@ -68,161 +497,654 @@ func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, passw
 // Unlock a single file systems using a key record file.
 func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) error {
 	// Collect information from all encrypted file systems
-	blockDevs := fs.GetBlockDevices()
+	blockDevs := getBlockDevices()
 	unlockDev, found := blockDevs.GetByCriteria(rec.UUID, "", "", "", "", "", "")
 	newEncrypted := false
 	if !found {
-		return errors.New(fmt.Sprintf("Can not find device with UUID '%s'.", rec.UUID))
+		return UnlockError{UnlockErrDeviceNotFound, fmt.Errorf("Can not find device with UUID '%s'.", rec.UUID)}
+	}
+	if dryRun {
+		return dryRunUnlockFS(progressOut, rec, unlockDev)
 	}
 	if !unlockDev.IsLUKSEncrypted() {
 		if rec.AutoEncryption {
-			if unlockDev.FileSystem == "" {
-				// It is an empty device we can encrypt it.
-				if err := fs.CryptFormat(rec.Key, unlockDev.Path, rec.UUID); err != nil {
-					return err
+			if unlockDev.FileSystem == "" || rec.AutoEncryptForce && IsForceEncryptableDevice(blockDevs, unlockDev) {
+				// It is an empty device we can encrypt it, or the record accepts the loss of its content.
+				if err := cryptFormat(rec.Key, unlockDev.Path, rec.UUID, rec.CryptOptions); err != nil {
+					return UnlockError{UnlockErrFormat, err}
 				}
+				bindTang(progressOut, rec.Key, unlockDev.Path, rec.TangURL)
 				newEncrypted = true
 			}
 			//TODO inplace enryption if filesystem can be srink
 		} else {
-			return errors.New(fmt.Sprintf("The device with UUID '%s' does not belongs to an LUKS device and AutoEncrytion is set false.", rec.UUID))
+			return UnlockError{UnlockErrNotLUKS, fmt.Errorf("The device with UUID '%s' does not belongs to an LUKS device and AutoEncryption is set false.", rec.UUID)}
 		}
 	}
 	// Mount the encrypted file system
 	// Resume on error, in case some operations fail due to them being already carried out in previous runs.
-	dmName := rec.MappedName
-	if dmName == "" {
-		MakeDeviceMapperName(unlockDev.Path)
+	dmName, alreadyOpen, err := resolveDeviceMapperName(rec, unlockDev, DM_DIR)
+	if err != nil {
+		return UnlockError{UnlockErrMapperName, err}
+	}
+	dmDev := path.Join(DM_DIR, dmName)
+	if alreadyOpen {
+		fmt.Fprintf(progressOut, "  *device with UUID '%s' is already unlocked as \"%s\"\n", rec.UUID, dmDev)
 	}
-	dmDev := path.Join("/dev/mapper/", dmName)
 	/*
 		Due to race conditions in kernel it is possible for an attempt to fail without apparent reason.
 		The fs.GetBlockDevice function is especially fragile in this regard, sometimes it cannot see a freshly
 		mounted file system.
 		Sleep a second between retries.
 	*/
-	fmt.Fprintf(progressOut, "Start unlocking device with UUID '%s'", rec.UUID)
-	succeeded := true
-	mounted := false
-	for i := 0; i < maxAttempts; i++ {
-		if err := fs.CryptOpen(rec.Key, unlockDev.Path, dmName); err != nil {
-			fmt.Fprintf(progressOut, "  *%v\n", err)
-			succeeded = false
+	fmt.Fprintf(progressOut, "Start unlocking device with UUID '%s'\n", rec.UUID)
+	opened, formatChecked, checked := alreadyOpen, false, false
+	fsType := rec.FileSystem
+	var lastErr error
+	lastClass := UnlockErrOpen
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		// Each attempt starts clean and carries on from the last step that succeeded
+		lastErr = nil
+		lastClass = UnlockErrOpen
+		if !opened {
+			if lastErr = openDevice(rec, unlockDev.Path, dmName); lastErr == nil {
+				lastErr = waitForNode(dmDev, DM_NODE_WAIT_SEC)
+			}
+			opened = lastErr == nil
 		}
-		if succeeded && newEncrypted && rec.FileSystem != "" {
-			fs.Format(dmDev, rec.FileSystem)
+		if lastErr == nil && rec.AutoEncryption && rec.FileSystem != "" && !formatChecked {
+			// Format only once, a retry must not wipe the file system again
+			lastClass = UnlockErrFormat
+			lastErr = formatIfBlank(progressOut, rec, dmDev, newEncrypted)
+			formatChecked = lastErr == nil
 		}
-		if succeeded && rec.MountPoint != "" {
-			if err := os.MkdirAll(rec.MountPoint, 0755); err != nil {
-				fmt.Fprintf(progressOut, "  *failed to make mount point directory - %v\n", err)
-				succeeded = false
-			}
-			if err := fs.Mount(dmDev, "", rec.MountOptions, rec.MountPoint); err != nil {
-				fmt.Fprintf(progressOut, "  *%v\n", err)
-				succeeded = false
+		if lastErr == nil && rec.MountPoint != "" && !checked {
+			lastClass = UnlockErrFsck
+			fsType, lastErr = prepareMount(progressOut, rec, dmDev)
+			checked = lastErr == nil
+		}
+		if lastErr == nil && rec.MountPoint != "" {
+			lastClass = UnlockErrMount
+			if isMounted(dmDev) {
+				// Mounted by a previous run, mounting it again would stack another mount on top
+				fmt.Fprintf(progressOut, "  *\"%s\" is already mounted\n", dmDev)
+			} else if err := os.MkdirAll(rec.MountPoint, 0755); err != nil {
+				lastErr = fmt.Errorf("failed to make mount point directory - %v", err)
+			} else {
+				lastErr = mount(dmDev, fsType, rec.MountOptions, rec.MountPoint)
 			}
-			mounted = true
 		}
-		if succeeded {
+		if lastErr == nil {
 			break
 		}
-		fmt.Fprintf(progressOut, "'%d'-th unlocking of device with UUID '%s' failed", i+1, rec.UUID)
-		time.Sleep(1 * time.Second)
+		fmt.Fprintf(progressOut, "  *attempt %d of %d to unlock device with UUID '%s' failed - %v\n", attempt, maxAttempts, rec.UUID, lastErr)
+		if attempt < maxAttempts {
+			time.Sleep(UNLOCK_RETRY_INTERVAL)
+		}
+	}
+	if lastErr != nil {
+		fmt.Fprintf(progressOut, "Device with UUID '%s' has permanently failed after %d attempts.\n", rec.UUID, maxAttempts)
+		return UnlockError{lastClass, fmt.Errorf("UnlockFS: failed to unlock device with UUID '%s' after %d attempts - %v", rec.UUID, maxAttempts, lastErr)}
 	}
-	if succeeded && mounted {
+	if rec.MountPoint != "" {
 		fmt.Fprintf(progressOut, "The encrypted file system has been successfully mounted on \"%s\".\n", rec.MountPoint)
-	} else if succeeded {
-		fmt.Fprintf(progressOut, "The encrypted file system has been successfully unlocked \"%s\".\n", rec.UUID)
+		return mountBindTargets(progressOut, rec)
 	} else {
-		return errors.New("Failed to process the encrypted file system. Check output for more details.")
+		fmt.Fprintf(progressOut, "The encrypted file system has been successfully unlocked \"%s\".\n", rec.UUID)
 	}
 	return nil
 }
 
-func CheckAutoUnlock(client *keyserv.CryptClient, UUID string) error {
-	blkDevs := fs.GetBlockDevices()
-	_, foundHost := blkDevs.GetByCriteria(UUID, "", "", "", "", "", "")
-	if !foundHost {
-		return fmt.Errorf("CheckAutoUnlock: cannot find a block device corresponding to UUID \"%s\"", UUID)
+/*
+Return the IDs under which the key server may keep the record of the device: the canonical ID of the device first,
+followed by its other stable IDs. If the device cannot be found, the ID is returned as it is.
+*/
+func recordIDCandidates(blkDevs fs.BlockDevices, deviceID string) []string {
+	if blkDev, _, err := blkDevs.ResolveDeviceID(deviceID); err == nil {
+		return blkDev.DeviceIDs()
 	}
+	return []string{keydb.CanonicalRecordID(deviceID)}
+}
+
+// Return the records server suggests in place of the missing candidate IDs.
+func suggestedRecords(resp keyserv.AutoRetrieveKeyResp, candidates []string) []string {
+	suggestions := make([]string, 0, keydb.MaxSuggestions)
+	for _, id := range candidates {
+		suggestions = append(suggestions, resp.Suggestions[id]...)
+	}
+	return suggestions
+}
+
+/*
+Return the reason the key server gave for rejecting the key request of the candidate IDs, e.g. a closed unlock window.
+Without a reason, the server has rejected the request due to MaxActive being exceeded.
+*/
+func rejectionReason(resp keyserv.AutoRetrieveKeyResp, candidates []string) error {
+	for _, id := range candidates {
+		if reason, found := resp.RejectReasons[id]; found {
+			return errors.New(reason)
+		}
+	}
+	return errors.New("MaxActive is exceeded")
+}
+
+// Overwrite the keys of the granted records once they are no longer needed.
+func wipeGrantedKeys(granted map[string]keydb.Record) {
+	for _, rec := range granted {
+		rec.Key.Wipe()
+		rec.PreviousKey.Wipe()
+	}
+}
+
+// Return the first granted record among the candidate IDs.
+func firstGranted(granted map[string]keydb.Record, candidates []string) (rec keydb.Record, found bool) {
+	for _, id := range candidates {
+		if rec, found = granted[id]; found {
+			return
+		}
+	}
+	return
+}
+
+/*
+Return nil only if the key server grants this computer the key of the device, which may be given by any of its IDs.
+If TPM2 PCRs are given, the granted key is sealed by TPM2 should the record allow it, and a device that already has a
+sealed key may be unlocked even if the key server cannot be reached.
+*/
+func CheckAutoUnlock(progressOut io.Writer, client *keyserv.CryptClient, UUID, tpmPCRs string) error {
+	blkDevs := getBlockDevices()
+	if _, _, err := blkDevs.ResolveDeviceID(UUID); err != nil {
+		return fmt.Errorf("CheckAutoUnlock: cannot find a block device corresponding to \"%s\" - %v", UUID, err)
+	}
+	candidates := recordIDCandidates(blkDevs, UUID)
 	hostname, _ := sys.GetHostnameAndIP()
 	resp, err := client.AutoRetrieveKey(keyserv.AutoRetrieveKeyReq{
 		Hostname: hostname,
-		UUIDs:    []string{UUID},
+		UUIDs:    candidates,
 	})
 	if err == nil {
-		_, exists := resp.Granted[UUID]
+		defer wipeGrantedKeys(resp.Granted)
+		rec, exists := firstGranted(resp.Granted, candidates)
+		reason := "the key server did not explain which allowed client entry matched"
+		for _, id := range candidates {
+			if match, found := resp.Matches[id]; found {
+				reason = match
+				break
+			}
+		}
 		if exists {
+			fmt.Fprintf(progressOut, "CheckAutoUnlock: access granted, %s\n", reason)
+			if tpmPCRs != "" {
+				RefreshSealedRecord(progressOut, tpm2SealDir, rec, tpmPCRs)
+			}
+			RefreshTangRecord(progressOut, TANG_RECORD_DIR, rec)
+			reportFallbackPaths(progressOut, candidates, tpmPCRs)
+			return nil
+		} else if len(resp.Rejected) > 0 {
+			reportFallbackPaths(progressOut, candidates, tpmPCRs)
+			for _, id := range candidates {
+				if rejectReason, found := resp.RejectReasons[id]; found {
+					return fmt.Errorf("CheckAutoUnlock: access to block device corresponding to \"%s\" not allowed at the moment - %s", UUID, rejectReason)
+				}
+			}
+			return fmt.Errorf("CheckAutoUnlock: access to block device corresponding to \"%s\" not allowed (allowed clients: %s; if one matched, the maximum number of active users is reached)", UUID, reason)
+		}
+	} else if keyserv.IsMaintenanceError(err) {
+		return fmt.Errorf("CheckAutoUnlock: %v", keyserv.ErrMaintenance)
+	} else {
+		fmt.Fprintf(progressOut, "CheckAutoUnlock: key server is unreachable - %v\n", err)
+		if reportFallbackPaths(progressOut, candidates, tpmPCRs) {
 			return nil
 		}
 	}
-	return fmt.Errorf("CheckAutoUnlock: access to block device corresponding to UUID \"%s\" not allowed", UUID)
+	return fmt.Errorf("CheckAutoUnlock: access to block device corresponding to \"%s\" not allowed", UUID)
 }
 
 /*
-Make continuous attempts to retrieve encryption key from key server to unlock a file system specified by the UUID.
-If maxRetrySec is zero or negative, then only one attempt will be made to unlock the file system.
+Unlock the device using the key sealed by TPM2 while the key server is unreachable, and remember the offline unlock
+for the alive reporter to tell the key server later. Return false if there is no sealed key for the device, or it
+cannot be unsealed, or the device cannot be unlocked with it, in which case the key server should be asked again.
 */
-func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, UUID string, maxRetrySec int64) error {
+func unlockBySealedRecord(progressOut io.Writer, candidates []string) (recordID string, aliveIntervalSec int, unlocked bool, err error) {
+	for _, id := range candidates {
+		rec, found, err := UnsealRecord(tpm2SealDir, id)
+		if !found {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: cannot use the sealed key of \"%s\", asking key server instead - %v\n", id, err)
+			return "", 0, false, nil
+		} else if SealedRecordExpired(tpm2SealDir, rec, time.Now()) {
+			rec.Key.Wipe()
+			fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: the sealed key of \"%s\" is older than %d hours, asking key server instead\n", id, rec.SealMaxHours)
+			return "", 0, false, nil
+		}
+		err = UnlockFS(progressOut, rec, 3)
+		rec.Key.Wipe()
+		if _, isBindErr := err.(BindMountErrors); err != nil && !isBindErr {
+			fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: failed to unlock \"%s\" by its sealed key, asking key server instead - %v\n", id, err)
+			return "", 0, false, nil
+		}
+		fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: unlocked \"%s\" by the key sealed in TPM2\n", id)
+		if !dryRun {
+			if markErr := MarkOfflineUnlock(tpm2SealDir, rec.UUID, time.Now()); markErr != nil {
+				fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: the key server will not be told of the offline unlock - %v\n", markErr)
+			}
+		}
+		return rec.UUID, rec.AliveIntervalSec, true, err
+	}
+	return "", 0, false, nil
+}
+
+// Keys of the client configuration that set UnlockRetry of auto-unlock.
+const (
+	CLIENT_CONF_UNLOCK_MAX_RETRY    = "AUTO_UNLOCK_MAX_RETRY_SEC"
+	CLIENT_CONF_UNLOCK_INTERVAL     = "AUTO_UNLOCK_RETRY_INTERVAL_SEC"
+	CLIENT_CONF_UNLOCK_MAX_INTERVAL = "AUTO_UNLOCK_MAX_RETRY_INTERVAL_SEC"
+)
+
+// UnlockRetry tells how long and how often auto-unlock keeps asking key server for the encryption keys.
+type UnlockRetry struct {
+	MaxRetrySec int64 // MaxRetrySec is the number of seconds to keep retrying, 0 makes a single attempt and -1 retries forever.
+	IntervalSec int64 // IntervalSec is the number of seconds between attempts, AUTO_UNLOCK_RETRY_INTERVAL_SEC if it is not positive.
+	// MaxIntervalSec caps the number of seconds between attempts as they back off after consecutive failures, the
+	// attempts do not back off if it is not greater than the interval.
+	MaxIntervalSec int64
+	// TangFallbackSec is the number of seconds key server must be unreachable before disks bound to Tang server are
+	// unlocked by it, TANG_FALLBACK_SEC if it is not positive.
+	TangFallbackSec int64
+
+	OnFailure func(deviceID string, err error) // OnFailure, if set, is told about each failed attempt of a device still locked.
+}
+
+// Tell the failure callback about the failed attempt.
+func (retry UnlockRetry) failed(deviceID string, err error) {
+	if retry.OnFailure != nil && err != nil {
+		retry.OnFailure(deviceID, err)
+	}
+}
+
+// Return the number of seconds to wait before the next attempt.
+func (retry UnlockRetry) interval() int64 {
+	if retry.IntervalSec < 1 {
+		return AUTO_UNLOCK_RETRY_INTERVAL_SEC
+	}
+	return retry.IntervalSec
+}
+
+// Return the wait before the next attempt after the number of consecutive failures, which backs off from the interval.
+func (retry UnlockRetry) wait(failures int) time.Duration {
+	return Backoff{BaseSec: retry.interval(), MaxSec: retry.MaxIntervalSec}.Wait(failures)
+}
+
+// Return true if key server has been unreachable for long enough since then to fall back to Tang server.
+func (retry UnlockRetry) tangDue(unreachableSince time.Time) bool {
+	fallbackSec := retry.TangFallbackSec
+	if fallbackSec < 1 {
+		fallbackSec = TANG_FALLBACK_SEC
+	}
+	return !unreachableSince.IsZero() && time.Since(unreachableSince) >= time.Duration(fallbackSec)*time.Second
+}
+
+/*
+Return true if key server has been unreachable for long enough to fall back to the keys sealed by TPM2, which is as
+long as for Tang server, or if it is still unreachable once the attempts since the first attempt began are exhausted.
+*/
+func (retry UnlockRetry) sealedDue(unreachableSince, begin time.Time) bool {
+	return retry.tangDue(unreachableSince) || (!unreachableSince.IsZero() && retry.exhausted(begin))
+}
+
+// Return true if no further attempt should be made since the first attempt began.
+func (retry UnlockRetry) exhausted(begin time.Time) bool {
+	return retry.MaxRetrySec >= 0 && time.Since(begin) >= time.Duration(retry.MaxRetrySec)*time.Second
+}
+
+/*
+Make continuous attempts to retrieve encryption key from key server to unlock a file system specified by the UUID,
+which may also be any other ID of the device (e.g. "LABEL:data", see fs.SplitDeviceID). Return the ID of the key
+record that was used and the interval of its alive reports, alive reports must be sent for it.
+The attempts are made according to the retry settings, a MaxRetrySec of zero makes only one attempt.
+If TPM2 PCRs are given, the key sealed by TPM2 is only used once the key server has been unreachable as long as for
+Tang server or until the attempts are exhausted, so that a key server that answers, even to refuse, is never bypassed.
+The sealed key is refreshed after the key server has handed out the key.
+*/
+func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, UUID string, retry UnlockRetry, tpmPCRs string) (recordID string, aliveIntervalSec int, err error) {
 	sys.LockMem()
-	// Keep trying until maxRetrySec elapses
+	candidates := recordIDCandidates(getBlockDevices(), UUID)
+	// Keep trying until MaxRetrySec elapses
 	numFailures := 0
-	begin := time.Now().Unix()
-	for {
+	begin := time.Now()
+	var unreachableSince time.Time
+	tangTried, sealedTried := false, tpmPCRs == ""
+	for attempts := 1; ; attempts++ {
 		// Always send the up-to-date hostname in RPC request
 		hostname, _ := sys.GetHostnameAndIP()
 		resp, err := client.AutoRetrieveKey(keyserv.AutoRetrieveKeyReq{
 			Hostname: hostname,
-			UUIDs:    []string{UUID},
+			UUIDs:    candidates,
 		})
+		// A server in maintenance mode is reachable, it must not be bypassed by Tang server
+		if err == nil || keyserv.IsMaintenanceError(err) {
+			unreachableSince = time.Time{}
+		} else if unreachableSince.IsZero() {
+			unreachableSince = time.Now()
+		}
+		// The sealed key and Tang server unlock the disk once the key server has been unreachable for a while
+		if !sealedTried && retry.sealedDue(unreachableSince, begin) {
+			sealedTried = true
+			if recordID, aliveIntervalSec, unlocked, err := unlockBySealedRecord(progressOut, candidates); unlocked {
+				return recordID, aliveIntervalSec, err
+			}
+		}
+		if !tangTried && retry.tangDue(unreachableSince) {
+			tangTried = true
+			if recordID, aliveIntervalSec, unlocked, err := unlockByTang(progressOut, candidates); unlocked {
+				return recordID, aliveIntervalSec, err
+			}
+		}
 		if err == nil {
-			rec, exists := resp.Granted[UUID]
+			rec, exists := firstGranted(resp.Granted, candidates)
 			if exists {
 				// Key has been granted by server, proceed to unlock disk.
-				return UnlockFS(progressOut, rec, 3)
+				err = unlockGranted(progressOut, client, rec, tpmPCRs)
+				wipeGrantedKeys(resp.Granted)
+				return rec.UUID, rec.AliveIntervalSec, err
 			}
-			if len(resp.Missing) > 0 {
+			if len(resp.Missing) == len(candidates) {
 				// Stop trying if the server does not even have the key
-				return fmt.Errorf("AutoOnlineUnlockFS: server does not have encryption key for \"%s\"", UUID)
+				return "", 0, fmt.Errorf("AutoOnlineUnlockFS: server does not have encryption key for \"%s\"%s", UUID, keydb.DidYouMean(suggestedRecords(resp, candidates)))
 			}
 		}
-		// Server may have rejected the key request due to MaxActive being exceeded
 		if len(resp.Rejected) > 0 {
-			err = errors.New("MaxActive is exceeded")
+			err = rejectionReason(resp, candidates)
 		}
+		retry.failed(UUID, err)
 		// Retry the operation for a while
-		if time.Now().Unix() > begin+maxRetrySec {
-			return fmt.Errorf("AutoOnlineUnlockFS: failed to unlock \"%s\" (%v) and have given up after %d seconds",
-				UUID, err, maxRetrySec)
+		if retry.exhausted(begin) {
+			return "", 0, fmt.Errorf("AutoOnlineUnlockFS: failed to unlock \"%s\" (%v) and have given up after %d attempts in %d seconds",
+				UUID, err, attempts, int64(time.Since(begin).Seconds()))
 		}
-		// In case of failure, only report the first few occasions among consecutive failures.
+		// In case of failure, back off and only report the first few occasions among consecutive failures.
+		wait := retry.wait(0)
 		if err != nil {
-			if numFailures == 5 {
+			numFailures++
+			wait = retry.wait(numFailures)
+			if numFailures == 6 {
 				fmt.Fprint(progressOut, "AutoOnlineUnlockFS: suppress further failure messages until success\n")
-			} else if numFailures < 5 {
+			} else if numFailures < 6 {
 				fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: failed to unlock \"%s\", will retry in %d seconds - %v\n",
-					UUID, AUTO_UNLOCK_RETRY_INTERVAL_SEC, err)
+					UUID, int64(wait.Round(time.Second).Seconds()), err)
 			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+/*
+TokenUnlockFS retrieves the key of a file system specified by the device ID (see fs.SplitDeviceID) by a one-time unlock
+token instead of the password, and unlocks it. The token is used up once the key server accepts it, even if the file
+system fails to unlock afterwards. Return the key record that was used, its key has been wiped.
+*/
+func TokenUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, deviceID, token string) (keydb.Record, error) {
+	sys.LockMem()
+	candidates := recordIDCandidates(getBlockDevices(), deviceID)
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.TokenRetrieveKey(keyserv.TokenRetrieveKeyReq{Token: token, UUIDs: candidates, Hostname: hostname})
+	if err != nil {
+		return keydb.Record{}, fmt.Errorf("TokenUnlockFS: key server did not hand out the key of \"%s\" - %v", deviceID, err)
+	}
+	defer wipeGrantedKeys(resp.Granted)
+	rec, found := firstGranted(resp.Granted, candidates)
+	if !found {
+		return keydb.Record{}, fmt.Errorf("TokenUnlockFS: key server did not hand out the key of \"%s\"", deviceID)
+	}
+	return rec, unlockGranted(progressOut, client, rec, "")
+}
+
+// Unlock the file system by the key granted by server, and report a persistent failure to the server.
+func unlockGranted(progressOut io.Writer, client *keyserv.CryptClient, rec keydb.Record, tpmPCRs string) error {
+	err := UnlockFS(progressOut, rec, 3)
+	if dryRun {
+		// A dry run neither reports its failures nor keeps local copies of the key
+		return err
+	}
+	if unlockErr, isUnlockErr := err.(UnlockError); isUnlockErr {
+		// Local retries are exhausted, let the server know. Connectivity failures never get here.
+		ReportClientError(progressOut, client, rec.UUID, unlockErr.Class, unlockErr)
+	} else {
+		if tpmPCRs != "" {
+			RefreshSealedRecord(progressOut, tpm2SealDir, rec, tpmPCRs)
+		}
+		RefreshTangRecord(progressOut, TANG_RECORD_DIR, rec)
+	}
+	return err
+}
+
+// AutoUnlockResult is the outcome of automatically unlocking one of many file systems.
+type AutoUnlockResult struct {
+	DeviceID         string // DeviceID is the device as it was given.
+	RecordID         string // RecordID is the ID of the key record that was used, alive reports must be sent for it.
+	AliveIntervalSec int    // AliveIntervalSec is the interval of the record's alive reports.
+	Missing          bool   // Missing is true if the server does not have encryption key for the device.
+	Err              error  // Err is nil if the device is unlocked, BindMountErrors means that it is in use regardless.
+}
+
+/*
+Make continuous attempts to retrieve encryption keys from key server to unlock the file systems of the devices, which
+are given by any of their IDs just like AutoOnlineUnlockFS. Keys of all devices that are still locked are asked for in
+a single request per attempt made according to the retry settings. The results are returned in the order of the
+devices.
+*/
+func AutoOnlineUnlockManyFS(progressOut io.Writer, client *keyserv.CryptClient, deviceIDs []string, retry UnlockRetry, tpmPCRs string) []AutoUnlockResult {
+	sys.LockMem()
+	blkDevs := getBlockDevices()
+	results := make([]AutoUnlockResult, len(deviceIDs))
+	candidates := make([][]string, len(deviceIDs))
+	pending := make([]int, 0, len(deviceIDs))
+	for i, deviceID := range deviceIDs {
+		results[i].DeviceID = deviceID
+		candidates[i] = recordIDCandidates(blkDevs, deviceID)
+		pending = append(pending, i)
+	}
+	// Keep trying until MaxRetrySec elapses
+	numFailures := 0
+	begin := time.Now()
+	var unreachableSince time.Time
+	tangTried, sealedTried := false, tpmPCRs == ""
+	for attempts := 1; len(pending) > 0; attempts++ {
+		// Always send the up-to-date hostname in RPC request
+		hostname, _ := sys.GetHostnameAndIP()
+		req := keyserv.AutoRetrieveKeyReq{Hostname: hostname, UUIDs: make([]string, 0, len(pending))}
+		for _, i := range pending {
+			req.UUIDs = append(req.UUIDs, candidates[i]...)
+		}
+		resp, err := client.AutoRetrieveKey(req)
+		// A server in maintenance mode is reachable, it must not be bypassed by Tang server
+		if err == nil || keyserv.IsMaintenanceError(err) {
+			unreachableSince = time.Time{}
+		} else if unreachableSince.IsZero() {
+			unreachableSince = time.Now()
+		}
+		// The sealed keys and Tang server unlock the disks once the key server has been unreachable for a while
+		if !sealedTried && retry.sealedDue(unreachableSince, begin) {
+			sealedTried = true
+			stillPending := make([]int, 0, len(pending))
+			for _, i := range pending {
+				if recordID, aliveIntervalSec, unlocked, sealedErr := unlockBySealedRecord(progressOut, candidates[i]); unlocked {
+					results[i].RecordID, results[i].AliveIntervalSec, results[i].Err = recordID, aliveIntervalSec, sealedErr
+				} else {
+					stillPending = append(stillPending, i)
+				}
+			}
+			if pending = stillPending; len(pending) == 0 {
+				break
+			}
+		}
+		if !tangTried && retry.tangDue(unreachableSince) {
+			tangTried = true
+			stillPending := make([]int, 0, len(pending))
+			for _, i := range pending {
+				if recordID, aliveIntervalSec, unlocked, tangErr := unlockByTang(progressOut, candidates[i]); unlocked {
+					results[i].RecordID, results[i].AliveIntervalSec, results[i].Err = recordID, aliveIntervalSec, tangErr
+				} else {
+					stillPending = append(stillPending, i)
+				}
+			}
+			if pending = stillPending; len(pending) == 0 {
+				break
+			}
+		}
+		if err == nil {
+			missing := make(map[string]bool)
+			for _, id := range resp.Missing {
+				missing[id] = true
+			}
+			stillPending := make([]int, 0, len(pending))
+			grantedRecs := make([]keydb.Record, 0, len(pending))
+			grantedIndex := make(map[string]int, len(pending))
+			for _, i := range pending {
+				if rec, exists := firstGranted(resp.Granted, candidates[i]); exists {
+					results[i].RecordID, results[i].AliveIntervalSec = rec.UUID, rec.AliveIntervalSec
+					grantedRecs = append(grantedRecs, rec)
+					grantedIndex[rec.UUID] = i
+				} else if allMissing(candidates[i], missing) {
+					// Stop trying if the server does not even have the key
+					results[i].Missing = true
+					results[i].Err = fmt.Errorf("AutoOnlineUnlockManyFS: server does not have encryption key for \"%s\"%s", deviceIDs[i], keydb.DidYouMean(suggestedRecords(resp, candidates[i])))
+				} else {
+					stillPending = append(stillPending, i)
+				}
+			}
+			// Unlock the granted records after those they wait for
+			ordered, cyclic, warnings := unlockOrder(grantedRecs)
+			for _, warning := range warnings {
+				fmt.Fprintf(progressOut, "AutoOnlineUnlockManyFS: warning - %s\n", warning)
+			}
+			for _, rec := range ordered {
+				result := &results[grantedIndex[rec.UUID]]
+				for _, dep := range unlockDependencies(rec, ordered) {
+					// The file system is usable despite failed bind-mounts
+					if _, isBindErr := results[grantedIndex[dep]].Err.(BindMountErrors); results[grantedIndex[dep]].Err != nil && !isBindErr {
+						result.Err = fmt.Errorf("AutoOnlineUnlockManyFS: not unlocking \"%s\" because \"%s\" that it is unlocked after failed", rec.UUID, dep)
+						break
+					}
+				}
+				if result.Err == nil {
+					result.Err = unlockGranted(progressOut, client, rec, tpmPCRs)
+				}
+			}
+			for _, rec := range cyclic {
+				results[grantedIndex[rec.UUID]].Err = fmt.Errorf("AutoOnlineUnlockManyFS: not unlocking \"%s\" because it waits for records that wait for each other in a cycle (UnlockAfter and mount points)", rec.UUID)
+			}
+			wipeGrantedKeys(resp.Granted)
+			pending = stillPending
+			if len(pending) == 0 {
+				break
+			}
+		}
+		for _, i := range pending {
+			failure := err
+			if err == nil && len(resp.Rejected) > 0 {
+				failure = rejectionReason(resp, candidates[i])
+			}
+			retry.failed(deviceIDs[i], failure)
+		}
+		// Retry the operation for a while
+		if retry.exhausted(begin) {
+			for _, i := range pending {
+				results[i].Err = fmt.Errorf("AutoOnlineUnlockManyFS: failed to unlock \"%s\" (%v) and have given up after %d attempts in %d seconds",
+					deviceIDs[i], err, attempts, int64(time.Since(begin).Seconds()))
+			}
+			break
+		}
+		// In case of failure, back off and only report the first few occasions among consecutive failures.
+		wait := retry.wait(0)
+		if err != nil {
 			numFailures++
+			wait = retry.wait(numFailures)
+			if numFailures == 6 {
+				fmt.Fprint(progressOut, "AutoOnlineUnlockManyFS: suppress further failure messages until success\n")
+			} else if numFailures < 6 {
+				fmt.Fprintf(progressOut, "AutoOnlineUnlockManyFS: failed to unlock %d file systems, will retry in %d seconds - %v\n",
+					len(pending), int64(wait.Round(time.Second).Seconds()), err)
+			}
+		}
+		time.Sleep(wait)
+	}
+	return results
+}
+
+// Return true if none of the candidate IDs has a key on the server.
+func allMissing(candidates []string, missing map[string]bool) bool {
+	for _, id := range candidates {
+		if !missing[id] {
+			return false
 		}
-		time.Sleep(AUTO_UNLOCK_RETRY_INTERVAL_SEC * time.Second)
 	}
+	return true
+}
+
+/*
+Tell the key server about a persistent failure of the disk. The report is sent only once and is dropped should the
+server fail to respond within CLIENT_ERROR_REPORT_TIMEOUT, the caller is never held up any longer than that.
+*/
+func ReportClientError(progressOut io.Writer, client *keyserv.CryptClient, uuid, class string, reportErr error) {
+	hostname, _ := sys.GetHostnameAndIP()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.ReportClientError(keyserv.ReportClientErrorReq{
+			Hostname: hostname,
+			UUID:     uuid,
+			Class:    class,
+			Message:  reportErr.Error(),
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Fprintf(progressOut, "ReportClientError: the error report of disk \"%s\" has been dropped - %v\n", uuid, err)
+		}
+	case <-time.After(CLIENT_ERROR_REPORT_TIMEOUT):
+		fmt.Fprintf(progressOut, "ReportClientError: the error report of disk \"%s\" has been dropped as server did not respond\n", uuid)
+	}
+}
+
+/*
+Return the alive timeout rounded down to a multiple of the alive report interval, and the number of reports it spans.
+The timeout always spans at least two reports, so that a single late report does not make the computer appear dead.
+*/
+func RoundAliveTimeout(aliveTimeout, intervalSec int) (rounded, aliveCount int) {
+	aliveCount = aliveTimeout / intervalSec
+	if aliveCount < 2 {
+		aliveCount = 2
+	}
+	return aliveCount * intervalSec, aliveCount
 }
 
 /*
 Continuously send alive reports to server to indicate that this computer is still holding onto the encrypted disk.
+The reports are sent at the interval of the key record, or REPORT_ALIVE_INTERVAL_SEC if the record does not have one.
+The health description is sent along, it should be empty if the disk is not experiencing problems.
 Block caller until the program quits or server rejects this computer.
 */
-func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string) error {
-	fmt.Fprintf(progressOut, "ReportAlive: begin sending messages for encrypted disk \"%s\"\n", uuid)
+func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid, health string, intervalSec int) error {
+	if intervalSec < 1 {
+		intervalSec = REPORT_ALIVE_INTERVAL_SEC
+	} else if intervalSec > MAX_REPORT_ALIVE_INTERVAL_SEC {
+		intervalSec = MAX_REPORT_ALIVE_INTERVAL_SEC
+	}
+	fmt.Fprintf(progressOut, "ReportAlive: begin sending messages for encrypted disk \"%s\" every %d seconds\n", uuid, intervalSec)
 	numFailures := 0
 	for {
 		// Always send the up-to-date hostname in RPC request
 		hostname, _ := sys.GetHostnameAndIP()
-		rejected, err := client.ReportAlive(keyserv.ReportAliveReq{
+		req := keyserv.ReportAliveReq{
 			Hostname: hostname,
 			UUIDs:    []string{uuid},
-		})
+		}
+		if health != "" {
+			req.Health = map[string]string{uuid: health}
+		}
+		rejected, err := client.ReportAlive(req)
 		if len(rejected) > 0 {
 			return fmt.Errorf("ReportAlive: stop sending messages for disk \"%s\" because server has rejected it", uuid)
 		}
@@ -240,15 +1162,33 @@ func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string
 			}
 			numFailures++
 		}
-		time.Sleep(REPORT_ALIVE_INTERVAL_SEC * time.Second)
+		time.Sleep(Backoff{BaseSec: int64(intervalSec), MaxSec: REPORT_ALIVE_MAX_BACKOFF_SEC}.Wait(numFailures))
 	}
 }
 
 /*
 Erase encryption metadata on the specified disk, and then ask server to erase its key.
-This process renders all data on the disk irreversibly lost.
+This process renders all data on the disk irreversibly lost. A disk that has an owner is only erased if the requester
+has acknowledged to act on behalf of the owner.
 */
-func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid string) error {
+func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid string, ownerAcknowledged bool) error {
+	hostname, _ := sys.GetHostnameAndIP()
+	eraseReq := keyserv.EraseKeyReq{
+		PlainPassword:     password,
+		Hostname:          hostname,
+		UUID:              uuid,
+		OwnerAcknowledged: ownerAcknowledged,
+	}
+	// Let the server refuse to erase the record before the encryption header is gone for good
+	if caps, err := client.GetCapabilities(); err == nil && caps.Features[keyserv.FeatureRecordOwner] {
+		check, err := client.CheckEraseKey(eraseReq)
+		if check.Owner != "" {
+			fmt.Fprintf(progressOut, "Disk \"%s\" belongs to owner \"%s\".\n", uuid, check.Owner)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	// Find the device node and erase the encryption metadata
 	blkDevs := fs.GetBlockDevices()
 	hostDev, foundHost := blkDevs.GetByCriteria(uuid, "", "", "", "", "", "")
@@ -270,18 +1210,49 @@ func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid
 			return err
 		}
 	}
+	// Tang bindings are key slots of their own, remove them explicitly rather than relying on the header wipe.
+	if slots, err := fs.ClevisTangSlots(hostDev.Path); err == nil && len(slots) > 0 {
+		fmt.Fprintf(progressOut, "Removing tang bindings of \"%s\"...\n", hostDev.Path)
+		if err := fs.ClevisTangUnbind(hostDev.Path); err != nil {
+			return err
+		}
+	}
 	if err := fs.CryptErase(hostDev.Path); err != nil {
 		return err
 	}
+	if err := RemoveTangRecord(TANG_RECORD_DIR, uuid); err != nil {
+		fmt.Fprintln(progressOut, err)
+	}
+	// The sealed key is of no use with the encryption header gone
+	if err := RemoveSealedRecord(tpm2SealDir, uuid); err != nil {
+		fmt.Fprintln(progressOut, err)
+	}
 	// After metadata is erased, ask server to remove its key record as well.
-	hostname, _ := sys.GetHostnameAndIP()
-	if err := client.EraseKey(keyserv.EraseKeyReq{
-		PlainPassword: password,
-		Hostname:      hostname,
-		UUID:          uuid}); err != nil {
+	if err := client.EraseKey(eraseReq); err != nil {
 		return err
 	}
 	fmt.Fprintf(progressOut, "Encryption header has been wiped successfully, data in \"%s\" (%s) is now irreversibly lost.\n",
 		uuid, hostDev.Path)
 	return nil
 }
+
+/*
+PrepareMountPoints makes the mount point directories of the records this computer is entitled to, so that they are in
+place before the disks are unlocked, e.g. for services that are ordered after the mount points. Existing directories
+are left alone, failures are only reported. Return the number of directories made.
+*/
+func PrepareMountPoints(progressOut io.Writer, devices []keydb.ClientDevice) (made int) {
+	for _, dev := range devices {
+		if dev.MountPoint == "" || !path.IsAbs(dev.MountPoint) {
+			continue
+		} else if _, err := os.Stat(dev.MountPoint); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(dev.MountPoint, 0755); err != nil {
+			fmt.Fprintf(progressOut, "PrepareMountPoints: failed to make mount point \"%s\" of \"%s\" - %v\n", dev.MountPoint, dev.UUID, err)
+			continue
+		}
+		made++
+	}
+	return
+}
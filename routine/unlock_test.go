@@ -0,0 +1,585 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"bytes"
+	"cryptctl2/fs"
+	"cryptctl2/keydb"
+	"cryptctl2/keyserv"
+	"cryptctl2/sys"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetDeviceMapperName(t *testing.T) {
+	mapperDir, err := ioutil.TempDir("", "cryptctl2-mappertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mapperDir)
+	dev := fs.BlockDevice{Path: "/dev/sdb1"}
+	// Explicit mapped name
+	if name, err := GetDeviceMapperName(keydb.Record{MappedName: "data"}, dev, mapperDir); err != nil || name != "data" {
+		t.Fatal(name, err)
+	}
+	// Empty mapped name falls back to the name computed from device node
+	if name, err := GetDeviceMapperName(keydb.Record{}, dev, mapperDir); err != nil || name != DM_NAME_PREFIX+"sdb1" {
+		t.Fatal(name, err)
+	}
+	// Names already taken by existing mappings
+	for _, taken := range []string{"data", DM_NAME_PREFIX + "sdb1"} {
+		if err := ioutil.WriteFile(path.Join(mapperDir, taken), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name, err := GetDeviceMapperName(keydb.Record{MappedName: "data"}, dev, mapperDir); err == nil {
+		t.Fatal("did not error", name)
+	}
+	if name, err := GetDeviceMapperName(keydb.Record{}, dev, mapperDir); err == nil {
+		t.Fatal("did not error", name)
+	}
+	// A name taken by the mapping of the very device tells that the device is already open
+	cryptStatus = func(name string) (fs.CryptMapping, error) {
+		if name == "data" {
+			return fs.CryptMapping{Type: "LUKS2", Cipher: "aes-xts-plain64", KeySize: 512, Device: "/dev/sdb1"}, nil
+		}
+		return fs.CryptMapping{}, errors.New("simulated failure")
+	}
+	t.Cleanup(func() { cryptStatus = fs.CryptStatus })
+	if name, alreadyOpen, err := resolveDeviceMapperName(keydb.Record{MappedName: "data"}, dev, mapperDir); err != nil || !alreadyOpen || name != "data" {
+		t.Fatal(name, alreadyOpen, err)
+	}
+	if name, alreadyOpen, err := resolveDeviceMapperName(keydb.Record{MappedName: "data"}, fs.BlockDevice{Path: "/dev/sdc1"}, mapperDir); err == nil || alreadyOpen {
+		t.Fatal(name, alreadyOpen, err)
+	}
+	if name, alreadyOpen, err := resolveDeviceMapperName(keydb.Record{}, dev, mapperDir); err == nil || alreadyOpen {
+		t.Fatal(name, alreadyOpen, err)
+	}
+	if name, alreadyOpen, err := resolveDeviceMapperName(keydb.Record{MappedName: "free"}, dev, mapperDir); err != nil || alreadyOpen || name != "free" {
+		t.Fatal(name, alreadyOpen, err)
+	}
+}
+
+// Substitute file system operations used by UnlockFS, the first cryptOpenFailures calls to cryptOpen fail.
+func fakeUnlockFS(t *testing.T, cryptOpenFailures int) (opened, mounted *int) {
+	opened, mounted = new(int), new(int)
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{{UUID: "fakeuuid", Path: "/dev/fake1", FileSystem: "crypto_LUKS"}}
+	}
+	cryptOpen = func(key sys.SecureBytes, blockDev, name string) error {
+		if *opened++; *opened <= cryptOpenFailures {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	waitForNode = func(string, int) error { return nil }
+	probeFileSystem = func(string) (string, error) { return "ext4", nil }
+	checkFileSystem = func(string, string, bool) (string, error) { return "clean", nil }
+	isMounted = func(string) bool { return false }
+	mount = func(string, string, []string, string) error {
+		*mounted++
+		return nil
+	}
+	bindMount = func(source, target string, options []string, propagation string) error {
+		if strings.HasSuffix(target, "bad") {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		getBlockDevices, cryptOpen, waitForNode, mount, bindMount = fs.GetBlockDevices, fs.CryptOpen, waitForDeviceNode, fs.Mount, fs.BindMount
+		probeFileSystem, checkFileSystem, isMounted = fs.ProbeFileSystem, fs.CheckFileSystem, isDeviceMounted
+	})
+	return
+}
+
+func TestUnlockFSRetry(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "cryptctl2-unlocktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	rec := keydb.Record{UUID: "fakeuuid", MappedName: "cryptctl2-unlocktest-doesnotexist", MountPoint: mountPoint}
+	// The first attempt fails and the second succeeds
+	opened, mounted := fakeUnlockFS(t, 1)
+	var out bytes.Buffer
+	if err := UnlockFS(&out, rec, 2); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if *opened != 2 || *mounted != 1 || !strings.Contains(out.String(), "attempt 1 of 2") || strings.Contains(out.String(), "permanently") {
+		t.Fatal(*opened, *mounted, out.String())
+	}
+	// All attempts fail
+	opened, mounted = fakeUnlockFS(t, 2)
+	out.Reset()
+	if err := UnlockFS(&out, rec, 2); err == nil {
+		t.Fatal("did not error")
+	}
+	if *opened != 2 || *mounted != 0 || !strings.Contains(out.String(), "permanently failed after 2 attempts") {
+		t.Fatal(*opened, *mounted, out.String())
+	}
+	// A file system mounted by a previous run is not mounted again
+	opened, mounted = fakeUnlockFS(t, 0)
+	isMounted = func(string) bool { return true }
+	out.Reset()
+	if err := UnlockFS(&out, rec, 2); err != nil || *opened != 1 || *mounted != 0 || !strings.Contains(out.String(), "already mounted") {
+		t.Fatal(err, *opened, *mounted, out.String())
+	}
+}
+
+func TestUnlockFSCheck(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "cryptctl2-unlocktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	rec := keydb.Record{UUID: "fakeuuid", MappedName: "cryptctl2-unlocktest-doesnotexist", MountPoint: mountPoint, FileSystem: "xfs"}
+	_, mounted := fakeUnlockFS(t, 0)
+	var checks []bool
+	checkFileSystem = func(dev, fsType string, force bool) (string, error) {
+		checks = append(checks, force)
+		return "ext4: clean, 11/65536 files", nil
+	}
+	var mountedType string
+	mount = func(dev string, fsType string, options []string, mountPoint string) error {
+		*mounted++
+		mountedType = fsType
+		return nil
+	}
+	// The detected type is mounted despite the record saying otherwise
+	var out bytes.Buffer
+	if err := UnlockFS(&out, rec, 1); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if mountedType != "ext4" || !reflect.DeepEqual(checks, []bool{false}) ||
+		!strings.Contains(out.String(), "WARNING") || !strings.Contains(out.String(), "    ext4: clean") {
+		t.Fatal(mountedType, checks, out.String())
+	}
+	rec.FileSystem, rec.FsckPolicy = "", keydb.FsckForce
+	out.Reset()
+	if err := UnlockFS(&out, rec, 1); err != nil || !reflect.DeepEqual(checks, []bool{false, true}) || strings.Contains(out.String(), "WARNING") {
+		t.Fatal(err, checks, out.String())
+	}
+	rec.FsckPolicy = keydb.FsckOff
+	if err := UnlockFS(&out, rec, 1); err != nil || len(checks) != 2 {
+		t.Fatal(err, checks, out.String())
+	}
+	// Unrepaired errors fail the unlock before mounting
+	rec.FsckPolicy = keydb.FsckPreen
+	checkFileSystem = func(string, string, bool) (string, error) { return "", errors.New("simulated failure") }
+	*mounted = 0
+	err = UnlockFS(&out, rec, 1)
+	if unlockErr, ok := err.(UnlockError); !ok || unlockErr.Class != UnlockErrFsck || *mounted != 0 {
+		t.Fatal(err, *mounted)
+	}
+}
+
+func TestUnlockFSAutoEncryption(t *testing.T) {
+	fakeUnlockFS(t, 0)
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{{UUID: "fakeuuid", Path: "/dev/fake1"}}
+	}
+	var formatted fs.CryptFormatOptions
+	cryptFormat = func(key sys.SecureBytes, blockDev, uuid string, opts fs.CryptFormatOptions) error {
+		formatted = opts
+		return nil
+	}
+	var formattedAs []string
+	format = func(dev, fsType string) error {
+		formattedAs = append(formattedAs, fsType)
+		return nil
+	}
+	t.Cleanup(func() {
+		cryptFormat, format = fs.CryptFormat, fs.Format
+	})
+	// The empty disk is formatted using the options kept in the record
+	opts := fs.CryptFormatOptions{LUKSVersion: 2, KeySizeBits: 512, PBKDF: fs.CryptArgon2id}
+	rec := keydb.Record{UUID: "fakeuuid", MappedName: "cryptctl2-unlocktest-doesnotexist", AutoEncryption: true, FileSystem: "ext4", CryptOptions: opts}
+	var out bytes.Buffer
+	if err := UnlockFS(&out, rec, 1); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if formatted != opts || !reflect.DeepEqual(formattedAs, []string{"ext4"}) {
+		t.Fatalf("%+v %v", formatted, formattedAs)
+	}
+	// An encrypted device without a file system, e.g. after an interrupted first unlock, is formatted too
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{{UUID: "fakeuuid", Path: "/dev/fake1", FileSystem: "crypto_LUKS"}}
+	}
+	probeFileSystem = func(string) (string, error) { return "", nil }
+	if err := UnlockFS(&out, rec, 1); err != nil || !reflect.DeepEqual(formattedAs, []string{"ext4", "ext4"}) {
+		t.Fatal(err, formattedAs, out.String())
+	}
+	// Whereas a file system of another type is left alone
+	probeFileSystem = func(string) (string, error) { return "xfs", nil }
+	out.Reset()
+	if err := UnlockFS(&out, rec, 1); err != nil || len(formattedAs) != 2 || !strings.Contains(out.String(), "not formatting it as ext4") {
+		t.Fatal(err, formattedAs, out.String())
+	}
+	// A failure to make the file system fails the unlock
+	probeFileSystem = func(string) (string, error) { return "", nil }
+	format = func(string, string) error { return errors.New("simulated failure") }
+	if err := UnlockFS(&out, rec, 1); err == nil || err.(UnlockError).Class != UnlockErrFormat {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlockFSBindMounts(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "cryptctl2-unlocktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	rec := keydb.Record{
+		UUID:       "fakeuuid",
+		MappedName: "cryptctl2-unlocktest-doesnotexist",
+		MountPoint: path.Join(mountPoint, "primary"),
+		BindMounts: []keydb.BindMount{
+			{Target: path.Join(mountPoint, "bad")},
+			{Target: path.Join(mountPoint, "good"), Propagation: "rshared"},
+		},
+	}
+	_, mounted := fakeUnlockFS(t, 0)
+	var out bytes.Buffer
+	// A failed bind-mount does not fail the primary mount, and the remaining bind-mounts are still carried out.
+	err = UnlockFS(&out, rec, 1)
+	bindErrs, isBindErr := err.(BindMountErrors)
+	if !isBindErr || len(bindErrs) != 1 || bindErrs[0] != path.Join(mountPoint, "bad") || *mounted != 1 {
+		t.Fatal(err, *mounted, out.String())
+	}
+	if !strings.Contains(out.String(), "failed to bind-mount") || !strings.Contains(out.String(), "bind-mounted on \""+path.Join(mountPoint, "good")) {
+		t.Fatal(out.String())
+	}
+}
+
+func TestUnlockManyFS(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "cryptctl2-unlocktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	fakeUnlockFS(t, 0)
+	recs := []keydb.Record{
+		{UUID: "archive", MountPoint: path.Join(mountPoint, "data", "archive")},
+		{UUID: "old", MountPoint: path.Join(mountPoint, "data", "archive", "old")},
+		{UUID: "data", MountPoint: path.Join(mountPoint, "data")},
+		{UUID: "brokenparent", MountPoint: path.Join(mountPoint, "broken")},
+		{UUID: "brokenchild", MountPoint: path.Join(mountPoint, "broken", "child")},
+		{UUID: "other", MountPoint: path.Join(mountPoint, "other")},
+		{UUID: "nomount"},
+	}
+	devs := make(fs.BlockDevices, 0, len(recs))
+	for i := range recs {
+		recs[i].MappedName = "cryptctl2-unlocktest-doesnotexist-" + recs[i].UUID
+		devs = append(devs, fs.BlockDevice{UUID: recs[i].UUID, Path: "/dev/" + recs[i].UUID, FileSystem: "crypto_LUKS"})
+	}
+	getBlockDevices = func() fs.BlockDevices { return devs }
+	cryptOpen = func(key sys.SecureBytes, blockDev, name string) error {
+		if blockDev == "/dev/brokenparent" {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	mountLock := new(sync.Mutex)
+	mountOrder := make([]string, 0, len(recs))
+	mount = func(dev string, fsType string, options []string, mountPoint string) error {
+		mountLock.Lock()
+		defer mountLock.Unlock()
+		mountOrder = append(mountOrder, strings.TrimPrefix(dev, DM_DIR+"/cryptctl2-unlocktest-doesnotexist-"))
+		return nil
+	}
+	var out bytes.Buffer
+	failed := UnlockManyFS(&out, recs, 1, 4)
+	if !reflect.DeepEqual(failed, []string{"brokenchild", "brokenparent"}) {
+		t.Fatal(failed, out.String())
+	}
+	if len(mountOrder) != 4 {
+		t.Fatal(mountOrder)
+	}
+	position := make(map[string]int)
+	for i, uuid := range mountOrder {
+		position[uuid] = i
+	}
+	if !(position["data"] < position["archive"] && position["archive"] < position["old"]) {
+		t.Fatal(mountOrder)
+	}
+	if !strings.Contains(out.String(), "because its parent") {
+		t.Fatal(out.String())
+	}
+}
+
+func TestUnlockManyFSUnlockAfter(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "cryptctl2-unlocktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	fakeUnlockFS(t, 0)
+	recs := []keydb.Record{
+		{UUID: "volume", MountPoint: path.Join(mountPoint, "volume"), UnlockAfter: []string{"UUID:pv2", "pv1"}},
+		{UUID: "pv1", MountPoint: path.Join(mountPoint, "pv1")},
+		{UUID: "pv2", MountPoint: path.Join(mountPoint, "pv2"), UnlockAfter: []string{"not-here"}},
+		{UUID: "cycle1", MountPoint: path.Join(mountPoint, "cycle1"), UnlockAfter: []string{"cycle2"}},
+		{UUID: "cycle2", MountPoint: path.Join(mountPoint, "cycle2"), UnlockAfter: []string{"cycle1"}},
+	}
+	ordered, cyclic, warnings := unlockOrder(recs)
+	if len(ordered) != 3 || ordered[2].UUID != "volume" || len(cyclic) != 2 || len(warnings) != 1 {
+		t.Fatal(ordered, cyclic, warnings)
+	}
+	devs := make(fs.BlockDevices, 0, len(recs))
+	for i := range recs {
+		recs[i].MappedName = "cryptctl2-unlocktest-doesnotexist-" + recs[i].UUID
+		devs = append(devs, fs.BlockDevice{UUID: recs[i].UUID, Path: "/dev/" + recs[i].UUID, FileSystem: "crypto_LUKS"})
+	}
+	getBlockDevices = func() fs.BlockDevices { return devs }
+	mountLock := new(sync.Mutex)
+	mountOrder := make([]string, 0, len(recs))
+	mount = func(dev string, fsType string, options []string, mountPoint string) error {
+		mountLock.Lock()
+		defer mountLock.Unlock()
+		mountOrder = append(mountOrder, strings.TrimPrefix(dev, DM_DIR+"/cryptctl2-unlocktest-doesnotexist-"))
+		return nil
+	}
+	var out bytes.Buffer
+	failed := UnlockManyFS(&out, recs, 1, 4)
+	if !reflect.DeepEqual(failed, []string{"cycle1", "cycle2"}) {
+		t.Fatal(failed, out.String())
+	}
+	if len(mountOrder) != 3 || mountOrder[2] != "volume" {
+		t.Fatal(mountOrder)
+	}
+	if !strings.Contains(out.String(), "in a cycle") || !strings.Contains(out.String(), "\"not-here\", which is not being unlocked") {
+		t.Fatal(out.String())
+	}
+	// A record waiting for a failed one is not unlocked
+	cryptOpen = func(key sys.SecureBytes, blockDev, name string) error {
+		if blockDev == "/dev/pv1" {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	out.Reset()
+	if failed := UnlockManyFS(&out, recs[:3], 1, 4); !reflect.DeepEqual(failed, []string{"pv1", "volume"}) {
+		t.Fatal(failed, out.String())
+	}
+}
+
+func TestIsNestedMountPoint(t *testing.T) {
+	if !isNestedMountPoint("/data/archive", "/data") || !isNestedMountPoint("/data/archive/", "/data/") || !isNestedMountPoint("/data", "/") {
+		t.Fatal("should be nested")
+	}
+	if isNestedMountPoint("/database", "/data") || isNestedMountPoint("/data", "/data") || isNestedMountPoint("/data", "") || isNestedMountPoint("", "/data") {
+		t.Fatal("should not be nested")
+	}
+}
+
+func TestRoundAliveTimeout(t *testing.T) {
+	if rounded, count := RoundAliveTimeout(35, 10); rounded != 30 || count != 3 {
+		t.Fatal(rounded, count)
+	}
+	if rounded, count := RoundAliveTimeout(3600, 600); rounded != 3600 || count != 6 {
+		t.Fatal(rounded, count)
+	}
+	// The timeout spans at least two reports
+	if rounded, count := RoundAliveTimeout(30, 60); rounded != 120 || count != 2 {
+		t.Fatal(rounded, count)
+	}
+}
+
+func TestAutoOnlineUnlockManyFS(t *testing.T) {
+	client, server, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	fakeUnlockFS(t, 0)
+	for _, uuid := range []string{"one", "two"} {
+		rec := keydb.Record{UUID: uuid, Key: bytes.Repeat([]byte{1}, 64), MappedName: "cryptctl2-unlocktest-doesnotexist-" + uuid, AliveIntervalSec: 1, AliveCount: 4}
+		if _, err := server.KeyDB.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{
+			{UUID: "one", Path: "/dev/one", FileSystem: "crypto_LUKS"},
+			{UUID: "two", Path: "/dev/two", FileSystem: "crypto_LUKS"},
+			{UUID: "missing", Path: "/dev/missing", FileSystem: "crypto_LUKS"},
+		}
+	}
+	cryptOpen = func(key sys.SecureBytes, blockDev, name string) error {
+		if blockDev == "/dev/two" {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	var out bytes.Buffer
+	results := AutoOnlineUnlockManyFS(&out, client, []string{"one", "two", "missing"}, UnlockRetry{}, "")
+	if len(results) != 3 {
+		t.Fatal(results)
+	}
+	if results[0].DeviceID != "one" || results[0].RecordID != "one" || results[0].AliveIntervalSec != 1 || results[0].Err != nil {
+		t.Fatalf("%+v %s", results[0], out.String())
+	}
+	if _, isUnlockErr := results[1].Err.(UnlockError); results[1].RecordID != "two" || !isUnlockErr || results[1].Missing {
+		t.Fatalf("%+v %s", results[1], out.String())
+	}
+	if results[2].RecordID != "" || !results[2].Missing || results[2].Err == nil {
+		t.Fatalf("%+v", results[2])
+	}
+}
+
+func TestAutoOnlineUnlockWipesKey(t *testing.T) {
+	client, server, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	fakeUnlockFS(t, 0)
+	for _, uuid := range []string{"one", "two"} {
+		rec := keydb.Record{UUID: uuid, Key: bytes.Repeat([]byte{1}, 64), MappedName: "cryptctl2-wipetest-doesnotexist-" + uuid, AliveIntervalSec: 1, AliveCount: 4}
+		if _, err := server.KeyDB.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getBlockDevices = func() fs.BlockDevices {
+		return fs.BlockDevices{
+			{UUID: "one", Path: "/dev/one", FileSystem: "crypto_LUKS"},
+			{UUID: "two", Path: "/dev/two", FileSystem: "crypto_LUKS"},
+		}
+	}
+	var keys []sys.SecureBytes
+	cryptOpen = func(key sys.SecureBytes, blockDev, name string) error {
+		keys = append(keys, key)
+		if blockDev == "/dev/two" {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	assertWiped := func(what string, numOpened int) {
+		if len(keys) != numOpened {
+			t.Fatal(what, len(keys))
+		}
+		for _, key := range keys {
+			if len(key) != 64 || !key.IsWiped() {
+				t.Fatal(what, "key is not wiped")
+			}
+		}
+		keys = nil
+	}
+	// The key is wiped once the file system is unlocked, and once all attempts to unlock it have failed
+	var out bytes.Buffer
+	if _, _, err := AutoOnlineUnlockFS(&out, client, "one", UnlockRetry{}, ""); err != nil {
+		t.Fatal(err, out.String())
+	}
+	assertWiped("one", 1)
+	if _, _, err := AutoOnlineUnlockFS(&out, client, "two", UnlockRetry{}, ""); err == nil {
+		t.Fatal("did not error")
+	}
+	assertWiped("two", 3)
+	AutoOnlineUnlockManyFS(&out, client, []string{"one", "two"}, UnlockRetry{}, "")
+	assertWiped("many", 4)
+}
+
+func TestUnlockRetry(t *testing.T) {
+	begin := time.Now()
+	if !(UnlockRetry{}).exhausted(begin) || (UnlockRetry{MaxRetrySec: -1}).exhausted(begin.Add(-time.Hour)) {
+		t.Fatal("wrong single attempt or retry forever")
+	}
+	if (UnlockRetry{MaxRetrySec: 60}).exhausted(begin) || !(UnlockRetry{MaxRetrySec: 60}).exhausted(begin.Add(-time.Minute)) {
+		t.Fatal("wrong retry period")
+	}
+	if interval := (UnlockRetry{}).interval(); interval != AUTO_UNLOCK_RETRY_INTERVAL_SEC {
+		t.Fatal(interval)
+	}
+	if interval := (UnlockRetry{IntervalSec: 2}).interval(); interval != 2 {
+		t.Fatal(interval)
+	}
+}
+
+func TestPrepareMountPoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptctl2-mnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	existing := path.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0700); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	devices := []keydb.ClientDevice{
+		{UUID: "a", MountPoint: path.Join(dir, "data/a")},
+		{UUID: "b", MountPoint: existing},
+		{UUID: "c", MountPoint: "relative"},
+		{UUID: "d"},
+	}
+	if made := PrepareMountPoints(&out, devices); made != 1 || out.Len() != 0 {
+		t.Fatal(made, out.String())
+	}
+	if info, err := os.Stat(path.Join(dir, "data/a")); err != nil || !info.IsDir() {
+		t.Fatal(err)
+	}
+	if made := PrepareMountPoints(&out, devices); made != 0 {
+		t.Fatal(made)
+	}
+}
+
+func TestAutoOnlineUnlockBySealedRecord(t *testing.T) {
+	defer fakeTPM2(t, true)()
+	sealDir, err := ioutil.TempDir("", "cryptctl2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sealDir)
+	origSealDir := tpm2SealDir
+	tpm2SealDir = sealDir
+	defer func() { tpm2SealDir = origSealDir }()
+	opened, _ := fakeUnlockFS(t, 0)
+	rec := keydb.Record{UUID: "fakeuuid", Key: bytes.Repeat([]byte{1}, 64), MappedName: "cryptctl2-sealtest-doesnotexist",
+		SealToTPM: true, AliveIntervalSec: 1, AliveCount: 4, AllowedClients: []string{"192.0.2.1"}}
+	if err := SealRecord(sealDir, rec, "7"); err != nil {
+		t.Fatal(err)
+	}
+	client, server, tearDown := keyserv.StartTestServer(t)
+	defer tearDown(t)
+	if _, err := server.KeyDB.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	// A key server that refuses the disk is never bypassed by the sealed key, nor is a key server in maintenance
+	if _, _, err := AutoOnlineUnlockFS(&out, client, "fakeuuid", UnlockRetry{}, "7"); err == nil || *opened != 0 {
+		t.Fatal(err, *opened, out.String())
+	}
+	now := time.Now()
+	if err := server.KeyDB.SetMaintenance(keydb.MaintenanceMode{Enabled: true, Since: now, Until: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if results := AutoOnlineUnlockManyFS(&out, client, []string{"fakeuuid"}, UnlockRetry{}, "7"); results[0].Err == nil || *opened != 0 {
+		t.Fatal(results, *opened, out.String())
+	}
+	if unlocks, err := ListOfflineUnlocks(sealDir); err != nil || len(unlocks) != 0 {
+		t.Fatal(unlocks, err)
+	}
+	// The sealed key unlocks the disk once the key server is still unreachable after the attempts are exhausted
+	unreachable, err := keyserv.NewCryptClient("tcp", "127.0.0.1:1", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := AutoOnlineUnlockFS(&out, unreachable, "fakeuuid", UnlockRetry{}, ""); err == nil || *opened != 0 {
+		t.Fatal(err, *opened, out.String())
+	}
+	recordID, aliveIntervalSec, err := AutoOnlineUnlockFS(&out, unreachable, "fakeuuid", UnlockRetry{}, "7")
+	if err != nil || recordID != "fakeuuid" || aliveIntervalSec != 1 || *opened != 1 {
+		t.Fatal(err, recordID, aliveIntervalSec, *opened, out.String())
+	}
+	results := AutoOnlineUnlockManyFS(&out, unreachable, []string{"fakeuuid"}, UnlockRetry{}, "7")
+	if results[0].Err != nil || results[0].RecordID != "fakeuuid" || *opened != 2 {
+		t.Fatal(results, *opened, out.String())
+	}
+	// The offline unlock is remembered for the key server
+	if unlocks, err := ListOfflineUnlocks(sealDir); err != nil || len(unlocks) != 1 || unlocks["fakeuuid"] < now.Unix() {
+		t.Fatal(unlocks, err)
+	}
+}
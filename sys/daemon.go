@@ -56,6 +56,54 @@ func SystemctlStart(svc string) error {
 	return nil
 }
 
+// Call systemctl enable on the unit without starting it.
+func SystemctlEnable(svc string) error {
+	if out, err := exec.Command("systemctl", "enable", svc).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to enable service \"%s\" -  %v %s", svc, err, out)
+	}
+	return nil
+}
+
+// Call systemctl disable on the unit without stopping it.
+func SystemctlDisable(svc string) error {
+	if out, err := exec.Command("systemctl", "disable", svc).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to disable service \"%s\" -  %v %s", svc, err, out)
+	}
+	return nil
+}
+
+// Call systemctl daemon-reload to make systemd read unit files again.
+func SystemctlDaemonReload() error {
+	if out, err := exec.Command("systemctl", "daemon-reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to reload systemd units -  %v %s", err, out)
+	}
+	return nil
+}
+
+/*
+Tell systemd about the state of the service (e.g. "READY=1") via the notification socket. If the program was not
+started by systemd as a notify-type service, the function does nothing.
+*/
+func SdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if socketPath[0] == '@' {
+		// Abstract socket namespace
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("SdNotify: failed to connect to notification socket - %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("SdNotify: failed to send \"%s\" - %v", state, err)
+	}
+	return nil
+}
+
 // Cal systemctl enable and then systemctl start on the service.
 func SystemctlEnableStart(svc string) error {
 	if out, err := exec.Command("systemctl", "enable", svc).CombinedOutput(); err != nil {
@@ -78,6 +126,14 @@ func SystemctlEnableRestart(svc string) error {
 	return nil
 }
 
+// SystemctlReload uses systemctl command to ask a running service to reload its configuration.
+func SystemctlReload(svc string) error {
+	if out, err := exec.Command("systemctl", "reload", svc).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to reload service \"%s\" -  %v %s", svc, err, out)
+	}
+	return nil
+}
+
 // Cal systemctl to get main PID of a service. Return 0 on failure.
 func SystemctlGetMainPID(svc string) (mainPID int) {
 	out, err := exec.Command("systemctl", "show", "-p", "MainPID", svc).CombinedOutput()
@@ -2,7 +2,12 @@
 // This source code is licensed under GPL version 3 that can be found in LICENSE file.
 package sys
 
-import "testing"
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+)
 
 func TestSystemctl(t *testing.T) {
 	if err := SystemctlEnableStart("does-not-exist"); err == nil {
@@ -21,3 +26,27 @@ func TestSystemctl(t *testing.T) {
 		t.Fatal("journald is not running")
 	}
 }
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	socketPath := path.Join(os.TempDir(), "cryptctl2-notify-test")
+	os.Remove(socketPath)
+	defer os.Remove(socketPath)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatal(err, string(buf[:n]))
+	}
+}
@@ -49,14 +49,21 @@ func Exec(stdin io.Reader, stdout, stderr io.Writer, programName string, program
 	return
 }
 
-// Lock all program memory into main memory to prevent sensitive data from leaking into swap.
+/*
+Lock all program memory into main memory to prevent sensitive data from leaking into swap, and disable core dumps that
+would carry it to disk just the same.
+*/
 func LockMem() {
 	if os.Geteuid() != 0 {
 		fmt.Fprintln(os.Stderr, "Please run this cryptctl2 command with root privilege.")
 		os.Exit(111)
 	}
 	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to lock memory - %v", err)
+		fmt.Fprintf(os.Stderr, "Failed to lock memory - %v\n", err)
+		os.Exit(111)
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to disable core dumps - %v\n", err)
 		os.Exit(111)
 	}
 }
@@ -0,0 +1,123 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	SecureFileMode   os.FileMode = 0600 // SecureFileMode is the permission of files that carry secrets or settings.
+	ReadOnlyFileMode os.FileMode = 0400 // ReadOnlyFileMode is the permission of certificates and keys that are never modified.
+	SecureDirMode    os.FileMode = 0700 // SecureDirMode is the permission of directories that hold secure files.
+)
+
+/*
+Create a file that must not exist yet, write the content, and optionally flush the content to disk.
+The file gets exactly the permission given, regardless of umask, and it never exists with a looser permission.
+*/
+func WriteNewFile(filePath string, content []byte, mode os.FileMode, doSync bool) error {
+	fh, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("WriteNewFile: failed to create \"%s\" - %v", filePath, err)
+	}
+	if err := writeAndClose(fh, content, mode, doSync); err != nil {
+		os.Remove(filePath)
+		return fmt.Errorf("WriteNewFile: failed to write \"%s\" - %v", filePath, err)
+	}
+	return nil
+}
+
+/*
+Create or replace a file with the content. The content is written into a new temporary file in the same directory,
+which is then renamed over the original, hence readers never see partial content and the replaced file never exists
+with a looser permission than the one given. If doSync is true, both the content and the rename are flushed to disk.
+*/
+func ReplaceFile(filePath string, content []byte, mode os.FileMode, doSync bool) error {
+	fh, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".")
+	if err != nil {
+		return fmt.Errorf("ReplaceFile: failed to create temporary file for \"%s\" - %v", filePath, err)
+	}
+	tmpPath := fh.Name()
+	if err := writeAndClose(fh, content, mode, doSync); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ReplaceFile: failed to write \"%s\" - %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ReplaceFile: failed to rename \"%s\" into \"%s\" - %v", tmpPath, filePath, err)
+	}
+	if doSync {
+		// Flush the directory too, otherwise the rename may be lost upon power failure.
+		dir, err := os.Open(path.Dir(filePath))
+		if err != nil {
+			return fmt.Errorf("ReplaceFile: failed to open directory of \"%s\" - %v", filePath, err)
+		}
+		defer dir.Close()
+		if err := dir.Sync(); err != nil {
+			return fmt.Errorf("ReplaceFile: failed to flush directory of \"%s\" - %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+// Set permission of the open file, write the content, optionally flush it to disk, and close the file.
+func writeAndClose(fh *os.File, content []byte, mode os.FileMode, doSync bool) error {
+	defer fh.Close()
+	if err := fh.Chmod(mode); err != nil {
+		return err
+	}
+	if _, err := fh.Write(content); err != nil {
+		return err
+	}
+	if doSync {
+		if err := fh.Sync(); err != nil {
+			return err
+		}
+	}
+	return fh.Close()
+}
+
+/*
+Make the directory along with its parents if they do not yet exist. The directory itself gets SecureDirMode, while
+parents that are made along the way get the usual 0755.
+*/
+func MkdirSecure(dirPath string) error {
+	if _, err := os.Stat(dirPath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(dirPath), 0755); err != nil {
+		return fmt.Errorf("MkdirSecure: failed to make directory \"%s\" - %v", path.Dir(dirPath), err)
+	}
+	if err := os.Mkdir(dirPath, SecureDirMode); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("MkdirSecure: failed to make directory \"%s\" - %v", dirPath, err)
+	}
+	// Undo the effect of umask
+	return os.Chmod(dirPath, SecureDirMode)
+}
+
+/*
+Walk the file or directory and return the paths of files and directories that are accessible by more users than
+their maximum permission allows, e.g. a 0644 file is too loose when the maximum is 0600.
+*/
+func FindLooseFileModes(root string, maxFileMode, maxDirMode os.FileMode) (loose []string, err error) {
+	loose = make([]string, 0, 8)
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		maxMode := maxFileMode
+		if info.IsDir() {
+			maxMode = maxDirMode
+		}
+		if info.Mode().Perm()&^maxMode != 0 {
+			loose = append(loose, filePath)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,64 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestSecureFiles(t *testing.T) {
+	// A permissive umask must not loosen the permission of the files
+	defer syscall.Umask(syscall.Umask(0))
+	dir, err := ioutil.TempDir("", "cryptctl2-filetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secureDir := path.Join(dir, "a", "b")
+	if err := MkdirSecure(secureDir); err != nil {
+		t.Fatal(err)
+	}
+	newFile := path.Join(secureDir, "new")
+	if err := WriteNewFile(newFile, []byte("1"), ReadOnlyFileMode, true); err != nil {
+		t.Fatal(err)
+	}
+	// Existing file must not be overwritten
+	if err := WriteNewFile(newFile, []byte("2"), ReadOnlyFileMode, false); err == nil {
+		t.Fatal("did not error")
+	}
+	replacedFile := path.Join(secureDir, "replaced")
+	for _, content := range []string{"1", "2"} {
+		if err := ReplaceFile(replacedFile, []byte(content), SecureFileMode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, err := ioutil.ReadFile(replacedFile); err != nil || string(content) != "2" {
+		t.Fatal(string(content), err)
+	}
+	if content, err := ioutil.ReadFile(newFile); err != nil || string(content) != "1" {
+		t.Fatal(string(content), err)
+	}
+	// Only the files created above may be in the directory, no temporary file is left behind.
+	if files, err := ioutil.ReadDir(secureDir); err != nil || len(files) != 2 {
+		t.Fatal(files, err)
+	}
+	if loose, err := FindLooseFileModes(secureDir, SecureFileMode, SecureDirMode); err != nil || len(loose) != 0 {
+		t.Fatal(loose, err)
+	}
+	// Parent directories are not secure directories, and a file that is readable by everyone is too loose.
+	if err := ioutil.WriteFile(path.Join(secureDir, "loose"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loose, err := FindLooseFileModes(dir, SecureFileMode, SecureDirMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{path.Join(dir, "a"), path.Join(secureDir, "loose")}; !reflect.DeepEqual(loose, expected) {
+		t.Fatal(loose)
+	}
+}
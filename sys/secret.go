@@ -0,0 +1,39 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"fmt"
+	"runtime"
+)
+
+/*
+SecureBytes is key material held in memory. Its content is never printed by the fmt functions, whatever the verb, and
+Wipe overwrites it with zeros once it is no longer needed. It is encoded by gob and JSON just like a byte slice, and
+may be handed to any function that takes a byte slice without being copied.
+*/
+type SecureBytes []byte
+
+// Wipe overwrites the content with zeros. Copies made of the content beforehand are not affected.
+func (key SecureBytes) Wipe() {
+	for i := range key {
+		key[i] = 0
+	}
+	// The content is no longer read, the zeros must not be optimised away as dead stores
+	runtime.KeepAlive(key)
+}
+
+// IsWiped returns true if the content consists of zeros only, an empty content is wiped too.
+func (key SecureBytes) IsWiped() bool {
+	for _, b := range key {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Format prints the length of the content in place of the content, so that a key never appears in a log or an error.
+func (key SecureBytes) Format(f fmt.State, _ rune) {
+	fmt.Fprintf(f, "[%d bytes of key material]", len(key))
+}
@@ -0,0 +1,105 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecureBytes(t *testing.T) {
+	key := SecureBytes("secret-key")
+	backing := []byte(key)
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x", "% x", "%q", "%d"} {
+		if out := fmt.Sprintf(verb, key); strings.Contains(out, "secret") || strings.Contains(out, "73") || out != "[10 bytes of key material]" {
+			t.Fatal(verb, out)
+		}
+	}
+	holder := struct{ Key SecureBytes }{key}
+	if out := fmt.Sprintf("%+v", holder); strings.Contains(out, "secret") {
+		t.Fatal(out)
+	}
+	// Encoded just like a byte slice
+	var gobBuf bytes.Buffer
+	if err := gob.NewEncoder(&gobBuf).Encode(holder); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct{ Key []byte }
+	if err := gob.NewDecoder(&gobBuf).Decode(&decoded); err != nil || string(decoded.Key) != "secret-key" {
+		t.Fatal(decoded, err)
+	}
+	if jsonKey, err := json.Marshal(key); err != nil || string(jsonKey) != `"c2VjcmV0LWtleQ=="` {
+		t.Fatal(string(jsonKey), err)
+	}
+	if key.IsWiped() {
+		t.Fatal("not wiped yet")
+	}
+	key.Wipe()
+	if !key.IsWiped() || !bytes.Equal(backing, make([]byte, len(backing))) {
+		t.Fatal(backing)
+	}
+	SecureBytes(nil).Wipe()
+}
+
+// The fields that carry key material, and the fmt, log, and testing functions that would print them.
+var (
+	keyFields      = map[string]bool{"Key": true, "KeyContent": true, "SealedKey": true}
+	printFunctions = map[string]bool{
+		"Print": true, "Printf": true, "Println": true, "Sprint": true, "Sprintf": true, "Sprintln": true,
+		"Fprint": true, "Fprintf": true, "Fprintln": true, "Errorf": true, "Fatal": true, "Fatalf": true,
+		"Panic": true, "Panicf": true, "Log": true, "Logf": true, "Error": true, "Output": true,
+	}
+	// The fields of the same names that are not key material
+	notKeyMaterial = map[string]bool{"sys/sysconfig.go: kv.Key": true}
+)
+
+/*
+Look for key material handed to a print function anywhere in the source tree. SecureBytes prints redacted anyway, the
+fields are only ever printed by converting them explicitly, as show-key does.
+*/
+func TestKeyNotFormatted(t *testing.T) {
+	fset := token.NewFileSet()
+	err := filepath.Walk("..", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(filePath, ".go") || strings.HasSuffix(filePath, "_test.go") {
+			return err
+		}
+		file, err := parser.ParseFile(fset, filePath, nil, 0)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel("..", filePath)
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, isCall := node.(*ast.CallExpr)
+			if !isCall {
+				return true
+			}
+			if fun, isSel := call.Fun.(*ast.SelectorExpr); !isSel || !printFunctions[fun.Sel.Name] {
+				return true
+			}
+			for _, arg := range call.Args {
+				field, isSel := arg.(*ast.SelectorExpr)
+				if !isSel || !keyFields[field.Sel.Name] {
+					continue
+				}
+				if owner, isIdent := field.X.(*ast.Ident); isIdent && notKeyMaterial[relPath+": "+owner.Name+"."+field.Sel.Name] {
+					continue
+				}
+				t.Errorf("%s: key material is handed to %s", fset.Position(arg.Pos()), call.Fun.(*ast.SelectorExpr).Sel.Name)
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
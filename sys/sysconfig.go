@@ -36,7 +36,7 @@ func ParseSysconfigFile(fileName string, autoCreate bool) (*Sysconfig, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = ioutil.WriteFile(fileName, []byte{}, 0644)
+		err = WriteNewFile(fileName, []byte{}, SecureFileMode, false)
 		content = []byte{}
 		if err != nil {
 			return nil, err
@@ -5,6 +5,7 @@ package sys
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
@@ -15,6 +16,69 @@ import (
 
 var TermEcho bool = true // keep track of the latest change to terminal echo  made by SetTermEcho function
 
+var (
+	inputReader = bufio.NewReader(os.Stdin) // inputReader is shared by all prompts so that no input buffered by one is lost to the next
+	interactive = isTerminal(os.Stdin.Fd()) // interactive is true if the prompts are answered on a terminal
+)
+
+/*
+InputError is the panic value of a prompt that cannot be answered, e.g. standard input has come to an end or is not a
+terminal and gives an invalid answer. Scripted use thus fails at once instead of asking again forever, main turns it
+into an error message by deferring ExitOnInputError.
+*/
+type InputError struct {
+	Prompt string // Prompt is the question that could not be answered.
+	Reason string // Reason explains why, and what to give instead.
+}
+
+func (err InputError) Error() string {
+	return fmt.Sprintf("Cannot answer \"%s\" - %s", err.Prompt, err.Reason)
+}
+
+// ExitOnInputError is deferred by main, it terminates the program with the message of an InputError and re-panics anything else.
+func ExitOnInputError() {
+	if r := recover(); r != nil {
+		if inputErr, ok := r.(InputError); ok {
+			ErrorExit("%v", inputErr)
+		}
+		panic(r)
+	}
+}
+
+// Return true if the file descriptor is a terminal.
+func isTerminal(fd uintptr) bool {
+	term := &syscall.Termios{}
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(term)))
+	return err == 0
+}
+
+// IsInteractive returns true if the prompts are answered on a terminal.
+func IsInteractive() bool {
+	return interactive
+}
+
+/*
+SetInput makes the prompts read their answers from the reader, which is interactive or not as if it were a terminal.
+It is meant for tests of the command flows, e.g. SetInput(strings.NewReader("yes\n"), false). Call the function returned
+to go back to the previous input.
+*/
+func SetInput(in io.Reader, isInteractive bool) (restore func()) {
+	prevReader, prevInteractive := inputReader, interactive
+	inputReader, interactive = bufio.NewReader(in), isInteractive
+	return func() {
+		inputReader, interactive = prevReader, prevInteractive
+	}
+}
+
+// Panic with an InputError for the prompt if standard input is not interactive, or print the message to ask again.
+func reprompt(prompt, reason, message string, values ...interface{}) {
+	if !interactive {
+		panic(InputError{Prompt: prompt, Reason: reason})
+	}
+	fmt.Printf(message, values...)
+	os.Stdout.Sync()
+}
+
 // Enable or disable terminal echo.
 func SetTermEcho(echo bool) {
 	term := &syscall.Termios{}
@@ -37,37 +101,62 @@ func SetTermEcho(echo bool) {
 
 /*
 Print a prompt in stdout and return a trimmed line read from stdin.
-If mandatory switch is turned on, the function will keep asking for an input if default hint is unavailable.
+If mandatory switch is turned on, the function will keep asking for an input if default hint is unavailable. If stdin is
+not a terminal, a missing mandatory answer is an InputError instead. The end of input is an InputError either way.
 */
 func Input(mandatory bool, defaultHint string, format string, values ...interface{}) string {
-	if defaultHint == "" {
-		fmt.Printf(format+": ", values...)
+	return input(mandatory, defaultHint, defaultHint, format, values...)
+}
+
+// Implement Input, the default hint is printed as shownHint so that a secret default is not revealed.
+func input(mandatory bool, defaultHint, shownHint string, format string, values ...interface{}) string {
+	prompt := fmt.Sprintf(format, values...)
+	if shownHint == "" {
+		fmt.Print(prompt + ": ")
 	} else {
-		fmt.Printf(format+" ["+defaultHint+"]: ", values...)
+		fmt.Print(prompt + " [" + shownHint + "]: ")
 	}
+	os.Stdout.Sync()
 	for {
-		str, err := bufio.NewReader(os.Stdin).ReadString('\n')
-		if err != nil {
+		str, err := inputReader.ReadString('\n')
+		if err == io.EOF && str == "" {
+			fmt.Println()
+			panic(InputError{Prompt: prompt, Reason: "there is no more input"})
+		} else if err != nil && err != io.EOF {
 			log.Panicf("Input: failed to read from stadard input - %v", err)
 		}
+		if !interactive {
+			// The answer does not appear on the terminal by itself
+			fmt.Println()
+		}
 		str = strings.TrimSpace(str)
 		if str == "" && mandatory && defaultHint == "" {
 			if !TermEcho {
 				fmt.Println()
 			}
-			fmt.Print("Please enter a value: ")
-			os.Stdout.Sync()
+			reprompt(prompt, "a value is required", "Please enter a value: ")
 			continue
 		}
 		return str
 	}
 }
 
-// Disable terminal echo and read a password input from stdin, then re-enable terminal echo.
+/*
+Disable terminal echo and read a password input from stdin, then re-enable terminal echo. A default hint is shown as
+asterisks. If stdin is not a terminal, the password cannot be entered without echo, hence it is an InputError, and the
+caller should offer to take the password from a file or environment variable instead.
+*/
 func InputPassword(mandatory bool, defaultHint string, format string, values ...interface{}) string {
+	if !interactive {
+		panic(InputError{Prompt: fmt.Sprintf(format, values...), Reason: "a secret is only read from a terminal"})
+	}
+	shownHint := ""
+	if defaultHint != "" {
+		shownHint = "*****"
+	}
 	SetTermEcho(false)
 	defer SetTermEcho(true)
-	ret := Input(mandatory, defaultHint, format, values...)
+	ret := input(mandatory, defaultHint, shownHint, format, values...)
 	fmt.Println() // because the new-line character was not echoed by password entry
 	return ret
 }
@@ -81,11 +170,12 @@ func InputInt(mandatory bool, defaultHint, lowerLimit, upperLimit int, format st
 		}
 		valInt, err := strconv.Atoi(valStr)
 		if err != nil {
-			fmt.Println("Please enter a whole number.")
+			reprompt(fmt.Sprintf(format, values...), fmt.Sprintf("\"%s\" is not a whole number", valStr), "Please enter a whole number.\n")
 			continue
 		}
 		if valInt < lowerLimit || valInt > upperLimit {
-			fmt.Printf("Please enter a number between %d and %d.\n", lowerLimit, upperLimit)
+			reprompt(fmt.Sprintf(format, values...), fmt.Sprintf("%d is not between %d and %d", valInt, lowerLimit, upperLimit),
+				"Please enter a number between %d and %d.\n", lowerLimit, upperLimit)
 			continue
 		}
 		return valInt
@@ -116,8 +206,7 @@ func InputBool(defaultHint bool, format string, values ...interface{}) bool {
 		case "":
 			return defaultHint
 		default:
-			fmt.Print("Please enter \"yes\" or \"no\": ")
-			os.Stdout.Sync()
+			reprompt(fmt.Sprintf(format, values...), fmt.Sprintf("\"%s\" is neither yes nor no", answer), "Please enter \"yes\" or \"no\": ")
 			continue
 		}
 	}
@@ -131,11 +220,12 @@ func InputAbsFilePath(mandatory bool, defaultHint string, format string, values
 			return defaultHint
 		}
 		if val[0] != '/' {
-			fmt.Println("Please enter an absolute path led by a slash.")
+			reprompt(fmt.Sprintf(format, values...), fmt.Sprintf("\"%s\" is not an absolute path", val), "Please enter an absolute path led by a slash.\n")
 			continue
 		}
 		if _, err := os.Stat(val); err != nil {
-			fmt.Printf("The location \"%s\" cannot be read, please double check your input.\n", val)
+			reprompt(fmt.Sprintf(format, values...), fmt.Sprintf("the location \"%s\" cannot be read", val),
+				"The location \"%s\" cannot be read, please double check your input.\n", val)
 			continue
 		}
 		return val
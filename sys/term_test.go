@@ -0,0 +1,94 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Return the InputError that the function panics with, or nil if it does not panic.
+func catchInputError(fun func()) (inputErr *InputError) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := r.(InputError)
+			inputErr = &err
+		}
+	}()
+	fun()
+	return nil
+}
+
+func TestInput_NonInteractive(t *testing.T) {
+	restore := SetInput(strings.NewReader("first\n\n  second  \n12\nyes\nno\n/\nlast"), false)
+	defer restore()
+	if IsInteractive() {
+		t.Fatal("should not be interactive")
+	}
+	// Successive prompts do not lose the input buffered by one another
+	if answer := Input(true, "", "first"); answer != "first" {
+		t.Fatal(answer)
+	}
+	if answer := Input(false, "default", "empty"); answer != "" {
+		t.Fatal(answer)
+	}
+	if answer := Input(true, "", "second"); answer != "second" {
+		t.Fatal(answer)
+	}
+	if answer := InputInt(true, 1, 1, 100, "int"); answer != 12 {
+		t.Fatal(answer)
+	}
+	if !InputBool(false, "yes") || InputBool(true, "no") {
+		t.Fatal("wrong bool")
+	}
+	if answer := InputAbsFilePath(true, "", "path"); answer != "/" {
+		t.Fatal(answer)
+	}
+	// The final line does not need a line break, after that the input is at its end
+	if answer := Input(true, "", "last"); answer != "last" {
+		t.Fatal(answer)
+	}
+	if err := catchInputError(func() { Input(false, "default", "end") }); err == nil || err.Prompt != "end" {
+		t.Fatal(err)
+	}
+}
+
+func TestInput_NonInteractiveErrors(t *testing.T) {
+	for answer, fun := range map[string]func(){
+		"\n":              func() { Input(true, "", "mandatory") },
+		"abc\n":           func() { InputInt(true, 1, 1, 10, "not a number") },
+		"11\n":            func() { InputInt(true, 1, 1, 10, "out of range") },
+		"maybe\n":         func() { InputBool(true, "neither") },
+		"relative/path\n": func() { InputAbsFilePath(true, "", "relative") },
+		"/nonexistent\n":  func() { InputAbsFilePath(true, "", "missing") },
+		"secret\n":        func() { InputPassword(true, "", "secret") },
+	} {
+		restore := SetInput(strings.NewReader(answer), false)
+		if err := catchInputError(fun); err == nil || err.Reason == "" || err.Error() == "" {
+			t.Fatal("did not error", answer)
+		}
+		restore()
+	}
+	// A missing mandatory answer tells its prompt
+	restore := SetInput(strings.NewReader("\n"), false)
+	defer restore()
+	if err := catchInputError(func() { Input(true, "", "mandatory %s", "value") }); err == nil || err.Prompt != "mandatory value" {
+		t.Fatal(err)
+	}
+}
+
+func TestSetInput_Restore(t *testing.T) {
+	prevInteractive := IsInteractive()
+	restore := SetInput(strings.NewReader(""), !prevInteractive)
+	if IsInteractive() == prevInteractive {
+		t.Fatal("did not set")
+	}
+	restore()
+	if IsInteractive() != prevInteractive || inputReader == nil {
+		t.Fatal("did not restore")
+	}
+	if isTerminal(os.Stdin.Fd()) != interactive {
+		t.Fatal("wrong detection")
+	}
+}
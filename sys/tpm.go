@@ -0,0 +1,68 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	BIN_SYSTEMD_CREDS = "/usr/bin/systemd-creds"
+	TPM2_MAX_PCR      = 23 // TPM2_MAX_PCR is the highest PCR index of a TPM2 PCR bank.
+)
+
+// RegexTPM2PCRs matches a list of PCR indexes joined by "+", e.g. "0+7".
+var RegexTPM2PCRs = regexp.MustCompile(`^[0-9]+(\+[0-9]+)*$`)
+
+// ValidateTPM2PCRs returns an error if the text is not a list of PCR indexes joined by "+".
+func ValidateTPM2PCRs(pcrs string) error {
+	if !RegexTPM2PCRs.MatchString(pcrs) {
+		return fmt.Errorf("ValidateTPM2PCRs: \"%s\" should be a list of PCR indexes joined by \"+\", e.g. \"0+7\"", pcrs)
+	}
+	for _, pcr := range strings.Split(pcrs, "+") {
+		if index, _ := strconv.Atoi(pcr); index > TPM2_MAX_PCR {
+			return fmt.Errorf("ValidateTPM2PCRs: PCR index %s is out of range 0-%d", pcr, TPM2_MAX_PCR)
+		}
+	}
+	return nil
+}
+
+// HasTPM2 returns true only if systemd-creds is installed and finds a usable TPM2 on this computer.
+func HasTPM2() bool {
+	if _, err := os.Stat(BIN_SYSTEMD_CREDS); err != nil {
+		return false
+	}
+	_, _, _, err := Exec(nil, nil, nil, BIN_SYSTEMD_CREDS, "has-tpm2", "--quiet")
+	return err == nil
+}
+
+/*
+TPM2Seal encrypts the secret with a key that is sealed by the TPM2 of this computer and bound to the PCRs, hence the
+result can only be decrypted on this computer while the PCRs hold the same values. The name is bound into the result
+and must be given again to decrypt it.
+*/
+func TPM2Seal(secret []byte, name, pcrs string) ([]byte, error) {
+	if err := ValidateTPM2PCRs(pcrs); err != nil {
+		return nil, err
+	}
+	_, stdout, stderr, err := Exec(bytes.NewReader(secret), nil, nil, BIN_SYSTEMD_CREDS,
+		"encrypt", "--with-key=tpm2", "--tpm2-pcrs="+pcrs, "--name="+name, "-", "-")
+	if err != nil {
+		return nil, fmt.Errorf("TPM2Seal: failed to seal \"%s\" - %v %s", name, err, stderr)
+	}
+	return []byte(stdout), nil
+}
+
+// TPM2Unseal decrypts the result of TPM2Seal.
+func TPM2Unseal(sealed []byte, name string) ([]byte, error) {
+	_, stdout, stderr, err := Exec(bytes.NewReader(sealed), nil, nil, BIN_SYSTEMD_CREDS, "decrypt", "--name="+name, "-", "-")
+	if err != nil {
+		return nil, fmt.Errorf("TPM2Unseal: failed to unseal \"%s\" - %v %s", name, err, stderr)
+	}
+	return []byte(stdout), nil
+}
@@ -0,0 +1,18 @@
+// cryptctl2 - Copyright (c) 2023 SUSE Software Solutions Germany GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import "testing"
+
+func TestValidateTPM2PCRs(t *testing.T) {
+	for _, good := range []string{"7", "0+7", "0+2+4+7+23"} {
+		if err := ValidateTPM2PCRs(good); err != nil {
+			t.Fatal(good, err)
+		}
+	}
+	for _, bad := range []string{"", "7+", "+7", "0,7", "a", "24", "0+99"} {
+		if err := ValidateTPM2PCRs(bad); err == nil {
+			t.Fatal(bad, "did not error")
+		}
+	}
+}